@@ -0,0 +1,232 @@
+// cache.go - Katzenpost directory cache.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package cache implements the Katzenpost directory cache, which fetches
+// the verified consensus documents from the directory authorities and
+// re-serves them to clients, so that the clients need not connect to the
+// authorities.
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/authority/voting/schedule"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/worker"
+)
+
+var errNotCached = errors.New("cache: requested epoch document not in cache")
+
+// Source is a source of the consensus documents served by a Listener.
+type Source interface {
+	// GetRawConsensus returns the signed document for the epoch, or
+	// pki.ErrNoDocument if it will never exist.
+	GetRawConsensus(epoch uint64) ([]byte, error)
+
+	// GetConsensusPayload returns the signed document for the epoch, as
+	// a diff against the document of the previous epoch if the peer
+	// holds it, and compressed if requested.
+	GetConsensusPayload(epoch uint64, baseHash [pki.DiffBaseHashSize]byte, compress bool) (*pki.ConsensusPayload, error)
+}
+
+// Option is an option that may be passed to New.
+type Option func(*Cache)
+
+// WithClock sets the clock of the cache, which defaults to the system
+// time.
+func WithClock(clock epochtime.Clock) Option {
+	return func(c *Cache) {
+		c.clock = clock
+	}
+}
+
+// Cache fetches the documents of the current and next epochs with a
+// pki.Client, which verifies them against the authority keys, and keeps
+// them along with the document of the previous epoch. It implements
+// Source.
+type Cache struct {
+	sync.RWMutex
+	worker.Worker
+
+	client pki.Client
+	log    *logging.Logger
+	clock  epochtime.Clock
+
+	rawDocs          map[uint64][]byte
+	failedFetches    map[uint64]error
+	consensusEncoder *pki.ConsensusEncoder
+}
+
+func (c *Cache) recheckInterval() time.Duration {
+	return c.clock.Period() / 32
+}
+
+func (c *Cache) worker() {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	go func() {
+		select {
+		case <-c.HaltCh():
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+	defer c.log.Debugf("Halting cache worker.")
+
+	for {
+		for _, epoch := range c.documentsToFetch() {
+			c.fetch(ctx, epoch)
+		}
+		c.prune()
+
+		wakeup := c.clock.NewTimer(c.recheckInterval())
+		select {
+		case <-c.HaltCh():
+			wakeup.Stop()
+			return
+		case <-wakeup.C:
+		}
+	}
+}
+
+// documentsToFetch returns the epochs of the documents to fetch: the
+// current epoch, and the next once the authorities publish its document.
+func (c *Cache) documentsToFetch() []uint64 {
+	now, elapsed, _ := c.clock.Now()
+	epochs := []uint64{now}
+	if elapsed >= schedule.PublishConsensusDeadlineForPeriod(c.clock.Period()) {
+		epochs = append(epochs, now+1)
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	ret := make([]uint64, 0, len(epochs))
+	for _, epoch := range epochs {
+		if _, ok := c.rawDocs[epoch]; ok {
+			continue
+		}
+		if err, ok := c.failedFetches[epoch]; ok && err == pki.ErrNoDocument {
+			continue
+		}
+		ret = append(ret, epoch)
+	}
+	return ret
+}
+
+// fetch fetches the document for the epoch, as a diff against the
+// document of the previous epoch if possible.
+func (c *Cache) fetch(ctx context.Context, epoch uint64) {
+	c.RLock()
+	base, ok := c.rawDocs[epoch-1]
+	c.RUnlock()
+
+	var raw []byte
+	var err error
+	if dc, isDiffClient := c.client.(pki.DiffClient); ok && isDiffClient {
+		if _, raw, err = dc.GetDiff(ctx, epoch, base); err != nil && err != pki.ErrNoDocument {
+			c.log.Debugf("Failed to fetch diff for epoch %v, fetching it in full: %v", epoch, err)
+			_, raw, err = c.client.Get(ctx, epoch)
+		}
+	} else {
+		_, raw, err = c.client.Get(ctx, epoch)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if err != nil {
+		c.log.Warningf("Failed to fetch document for epoch %v: %v", epoch, err)
+		c.failedFetches[epoch] = err
+		return
+	}
+	c.log.Noticef("Cached document for epoch %v.", epoch)
+	delete(c.failedFetches, epoch)
+	c.rawDocs[epoch] = raw
+}
+
+// prune discards the documents older than the previous epoch, which
+// remains the base of the diffs of the current one.
+func (c *Cache) prune() {
+	now, _, _ := c.clock.Now()
+
+	c.Lock()
+	defer c.Unlock()
+	for epoch := range c.rawDocs {
+		if epoch < now-1 {
+			c.log.Debugf("Discarding document for epoch: %v", epoch)
+			delete(c.rawDocs, epoch)
+		}
+	}
+	for epoch := range c.failedFetches {
+		if epoch < now || epoch > now+1 {
+			delete(c.failedFetches, epoch)
+		}
+	}
+}
+
+// GetRawConsensus returns the cached document for the epoch.
+func (c *Cache) GetRawConsensus(epoch uint64) ([]byte, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if raw, ok := c.rawDocs[epoch]; ok {
+		return raw, nil
+	}
+	if err, ok := c.failedFetches[epoch]; ok && err == pki.ErrNoDocument {
+		return nil, pki.ErrNoDocument
+	}
+	// Return pki.ErrNoDocument if documents will never exist.
+	if now, _, _ := c.clock.Now(); epoch < now-1 {
+		return nil, pki.ErrNoDocument
+	}
+	return nil, errNotCached
+}
+
+// GetConsensusPayload returns the cached document for the epoch, as a diff
+// against the document of the previous epoch if the peer holds it, and
+// compressed if requested.
+func (c *Cache) GetConsensusPayload(epoch uint64, baseHash [pki.DiffBaseHashSize]byte, compress bool) (*pki.ConsensusPayload, error) {
+	raw, err := c.GetRawConsensus(epoch)
+	if err != nil {
+		return nil, err
+	}
+	c.RLock()
+	base := c.rawDocs[epoch-1]
+	c.RUnlock()
+	return c.consensusEncoder.Encode(raw, base, baseHash, compress)
+}
+
+// New returns a new Cache fetching the documents with the client, and
+// starts its worker.
+func New(client pki.Client, logBackend *log.Backend, opts ...Option) *Cache {
+	c := &Cache{
+		client:           client,
+		log:              logBackend.GetLogger("cache"),
+		clock:            epochtime.WallClock,
+		rawDocs:          make(map[uint64][]byte),
+		failedFetches:    make(map[uint64]error),
+		consensusEncoder: pki.NewConsensusEncoder(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.Go(c.worker)
+	return c
+}
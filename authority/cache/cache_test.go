@@ -0,0 +1,184 @@
+// cache_test.go - Katzenpost directory cache tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	vClient "github.com/katzenpost/katzenpost/authority/voting/client"
+	vConfig "github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+// mockClient is a pki.Client serving the documents of a map.
+type mockClient struct {
+	docs map[uint64][]byte
+}
+
+func (c *mockClient) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	raw, ok := c.docs[epoch]
+	if !ok {
+		return nil, nil, pki.ErrNoDocument
+	}
+	doc, err := pki.ParseDocument(raw)
+	return doc, raw, err
+}
+
+func (c *mockClient) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *pki.MixDescriptor) error {
+	return nil
+}
+
+func (c *mockClient) Deserialize(raw []byte) (*pki.Document, error) {
+	return pki.ParseDocument(raw)
+}
+
+func genDescriptor(require *require.Assertions, name string, isProvider bool, epoch uint64) *pki.MixDescriptor {
+	idPriv, idPub := cert.Scheme.NewKeypair()
+	_, linkPub := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	mixKeys := make(map[uint64][]byte)
+	for e := epoch; e < epoch+3; e++ {
+		pub, _, err := ecdh.EcdhScheme.GenerateKeyPairFromEntropy(rand.Reader)
+		require.NoError(err)
+		mixKeys[e] = pub.Bytes()
+	}
+	desc := &pki.MixDescriptor{
+		Name:        name,
+		Epoch:       epoch,
+		IdentityKey: idPub,
+		LinkKey:     linkPub,
+		MixKeys:     mixKeys,
+		Addresses: map[pki.Transport][]string{
+			pki.TransportTCPv4: []string{"tcp4://127.0.0.1:1"},
+		},
+		Provider: isProvider,
+	}
+	_, err := pki.SignDescriptor(idPriv, idPub, desc)
+	require.NoError(err, "SignDescriptor()")
+	return desc
+}
+
+func genDocument(require *require.Assertions, signer sign.PrivateKey, verifier sign.PublicKey, epoch, genesisEpoch uint64) []byte {
+	doc := &pki.Document{
+		Epoch:              epoch,
+		GenesisEpoch:       genesisEpoch,
+		SendRatePerMinute:  3,
+		Topology:           make([][]*pki.MixDescriptor, 3),
+		SharedRandomCommit: make(map[[pki.PublicKeyHashSize]byte][]byte),
+		SharedRandomReveal: make(map[[pki.PublicKeyHashSize]byte][]byte),
+		SharedRandomValue:  make([]byte, pki.SharedRandomValueLength),
+		PriorSharedRandom:  [][]byte{make([]byte, pki.SharedRandomValueLength)},
+	}
+	for i := range doc.Topology {
+		doc.Topology[i] = []*pki.MixDescriptor{genDescriptor(require, fmt.Sprintf("mix%d", i), false, epoch)}
+	}
+	doc.Providers = []*pki.MixDescriptor{genDescriptor(require, "provider", true, epoch)}
+	raw, err := pki.SignDocument(signer, verifier, doc)
+	require.NoError(err, "SignDocument()")
+	return raw
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	// The authority is unreachable, so the documents are only available
+	// from the cache.
+	authPriv, authPub := cert.Scheme.NewKeypair()
+	_, authLinkPub := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	authority := &vConfig.Authority{
+		Identifier:        "authority",
+		IdentityPublicKey: authPub,
+		LinkPublicKey:     authLinkPub,
+		Addresses:         []string{"tcp://127.0.0.1:1"},
+	}
+	epoch, _, _ := epochtime.Now()
+	upstream := &mockClient{docs: map[uint64][]byte{
+		epoch - 1: genDocument(require, authPriv, authPub, epoch-1, epoch-1),
+		epoch:     genDocument(require, authPriv, authPub, epoch, epoch-1),
+	}}
+
+	// Past the publication deadline of the previous epoch, the cache
+	// fetches the documents of the previous and current epochs.
+	clock := epochtime.NewFakeClockAtEpoch(epoch-1, epochtime.Period-time.Second, epochtime.Period)
+	c := New(upstream, logBackend, WithClock(clock))
+	defer c.Halt()
+	require.Eventually(func() bool {
+		_, err := c.GetRawConsensus(epoch)
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	clock.AdvanceToEpoch(epoch, 0)
+
+	cacheIdPriv, cacheIdPub := cert.Scheme.NewKeypair()
+	defer cacheIdPriv.Reset()
+	cacheLinkPriv, cacheLinkPub := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	l, err := NewListener(c, cacheIdPub, cacheLinkPriv, logBackend, []string{"tcp://127.0.0.1:0"})
+	require.NoError(err, "NewListener()")
+	defer l.Halt()
+
+	clientLinkKey, _ := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	client, err := vClient.New(&vClient.Config{
+		LinkKey:     clientLinkKey,
+		LogBackend:  logBackend,
+		Authorities: []*vConfig.Authority{authority},
+		Caches: []*vConfig.Authority{{
+			Identifier:        "cache",
+			IdentityPublicKey: cacheIdPub,
+			LinkPublicKey:     cacheLinkPub,
+			Addresses:         []string{"tcp://" + l.Addrs()[0].String()},
+		}},
+	})
+	require.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// The documents served by the cache are verified against the
+	// authority keys, in full or as diffs.
+	doc, raw, err := client.Get(ctx, epoch)
+	require.NoError(err, "Get()")
+	require.Equal(epoch, doc.Epoch)
+	require.Equal(upstream.docs[epoch], raw)
+	doc, raw, err = client.(pki.DiffClient).GetDiff(ctx, epoch, upstream.docs[epoch-1])
+	require.NoError(err, "GetDiff()")
+	require.Equal(epoch, doc.Epoch)
+	require.Equal(upstream.docs[epoch], raw)
+
+	// Documents the cache does not hold are fetched from the authorities.
+	_, _, err = client.Get(ctx, epoch+1)
+	require.Equal(pki.ErrNoDocument, err)
+
+	// A document not signed by the authorities is rejected.
+	roguePriv, roguePub := cert.Scheme.NewKeypair()
+	c.Lock()
+	c.rawDocs[epoch+1] = genDocument(require, roguePriv, roguePub, epoch+1, epoch-1)
+	c.Unlock()
+	_, _, err = client.Get(ctx, epoch+1)
+	require.Error(err)
+}
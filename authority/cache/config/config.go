@@ -0,0 +1,154 @@
+// config.go - Katzenpost directory cache configuration.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package config implements the Katzenpost directory cache configuration.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	vConfig "github.com/katzenpost/katzenpost/authority/voting/server/config"
+)
+
+const defaultLogLevel = "NOTICE"
+
+var defaultLogging = Logging{
+	Disable: false,
+	File:    "",
+	Level:   defaultLogLevel,
+}
+
+// Server is the directory cache server configuration.
+type Server struct {
+	// Identifier is the human readable identifier for the node (eg: FQDN).
+	Identifier string
+
+	// Addresses are the IP address/port combinations that the server will
+	// bind to for incoming connections.
+	Addresses []string
+
+	// DataDir is the absolute path to the server's state files.
+	DataDir string
+}
+
+func (sCfg *Server) validate() error {
+	if len(sCfg.Addresses) == 0 {
+		return errors.New("config: Server: No Addresses specified")
+	}
+	for _, v := range sCfg.Addresses {
+		if u, err := url.Parse(v); err != nil {
+			return fmt.Errorf("config: Server: Address '%v' is invalid: %v", v, err)
+		} else if u.Port() == "" {
+			return fmt.Errorf("config: Server: Address '%v' is invalid: Must contain Port", v)
+		}
+	}
+	if !filepath.IsAbs(sCfg.DataDir) {
+		return fmt.Errorf("config: Server: DataDir '%v' is not an absolute path", sCfg.DataDir)
+	}
+	return nil
+}
+
+// Logging is the directory cache logging configuration.
+type Logging struct {
+	// Disable disables logging entirely.
+	Disable bool
+
+	// File specifies the log file, if omitted stdout will be used.
+	File string
+
+	// Level specifies the log level.
+	Level string
+}
+
+func (lCfg *Logging) validate() error {
+	lvl := strings.ToUpper(lCfg.Level)
+	switch lvl {
+	case "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG":
+	case "":
+		lCfg.Level = defaultLogLevel
+	default:
+		return fmt.Errorf("config: Logging: Level '%v' is invalid", lCfg.Level)
+	}
+	lCfg.Level = lvl // Force uppercase.
+	return nil
+}
+
+// Config is the top level directory cache configuration.
+type Config struct {
+	Server  *Server
+	Logging *Logging
+
+	// Authorities is the set of Directory Authority servers, which the
+	// documents are fetched from and verified against.
+	Authorities []*vConfig.Authority
+}
+
+// FixupAndValidate applies defaults to config entries and validates the
+// supplied configuration.  Most people should call one of the Load variants
+// instead.
+func (cfg *Config) FixupAndValidate() error {
+	if cfg.Server == nil {
+		return errors.New("config: No Server block was present")
+	}
+	if cfg.Logging == nil {
+		cfg.Logging = &defaultLogging
+	}
+	if len(cfg.Authorities) == 0 {
+		return errors.New("config: No Authorities specified")
+	}
+
+	if err := cfg.Server.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Logging.validate(); err != nil {
+		return err
+	}
+	for _, v := range cfg.Authorities {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load parses and validates the provided buffer b as a config file body and
+// returns the Config.
+func Load(b []byte) (*Config, error) {
+	cfg := new(Config)
+	if err := toml.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.FixupAndValidate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFile loads, parses and validates the provided file and returns the
+// Config.
+func LoadFile(f string) (*Config, error) {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return Load(b)
+}
@@ -0,0 +1,263 @@
+// listener.go - Katzenpost directory cache listener.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/core/wire/commands"
+	kquic "github.com/katzenpost/katzenpost/quic"
+)
+
+// anyPeer is the wire.PeerAuthenticator of the listener, which serves
+// any peer, as the documents are public and verified by the clients.
+type anyPeer struct{}
+
+func (anyPeer) IsPeerValid(*wire.PeerCredentials) bool {
+	return true
+}
+
+// Listener serves the documents of a Source to any peer with the get
+// consensus commands of the PKI wire protocol, authenticated with the
+// identity and link keys of the directory cache, like an authority.
+type Listener struct {
+	sync.WaitGroup
+
+	source Source
+	log    *logging.Logger
+
+	identityPublicKey sign.PublicKey
+	linkKey           wire.PrivateKey
+
+	listeners  []net.Listener
+	haltOnce   sync.Once
+	closeAllCh chan interface{}
+}
+
+// Halt stops the listener, and waits for the connections to terminate.
+func (l *Listener) Halt() {
+	l.haltOnce.Do(func() {
+		for _, ln := range l.listeners {
+			ln.Close()
+		}
+		close(l.closeAllCh)
+		l.Wait()
+	})
+}
+
+func (l *Listener) listenWorker(ln net.Listener) {
+	addr := ln.Addr()
+	l.log.Noticef("Listening on: %v", addr)
+	defer func() {
+		l.log.Noticef("Stopping listening on: %v", addr)
+		ln.Close()
+		l.Done()
+	}()
+	for {
+		conn, err := ln.Accept()
+		switch e := err.(type) {
+		case nil: // No Error
+		case net.Error:
+			if !e.Timeout() && !e.Temporary() {
+				l.log.Errorf("accept failure: %v", err)
+				return
+			}
+			continue
+		default:
+			l.log.Errorf("accept failure: %v", err)
+			return
+		}
+		l.Add(1)
+		go l.onConn(conn)
+	}
+	// NOTREACHED
+}
+
+func (l *Listener) onConn(conn net.Conn) {
+	const (
+		initialDeadline  = 30 * time.Second
+		responseDeadline = 60 * time.Second
+	)
+
+	rAddr := conn.RemoteAddr()
+	l.log.Debugf("Accepted new connection: %v", rAddr)
+	doneCh := make(chan interface{})
+	defer func() {
+		close(doneCh)
+		conn.Close()
+		l.Done()
+	}()
+	go func() {
+		select {
+		case <-l.closeAllCh:
+			conn.Close()
+		case <-doneCh:
+		}
+	}()
+
+	// Initialize the wire protocol session.
+	keyHash := l.identityPublicKey.Sum256()
+	cfg := &wire.SessionConfig{
+		Geometry:          nil,
+		Authenticator:     anyPeer{},
+		AdditionalData:    keyHash[:],
+		AuthenticationKey: l.linkKey,
+		RandomReader:      rand.Reader,
+	}
+	wireConn, err := wire.NewPKISession(cfg, false)
+	if err != nil {
+		l.log.Debugf("Peer %v: Failed to initialize session: %v", rAddr, err)
+		return
+	}
+	defer wireConn.Close()
+
+	// Handshake.
+	if err = conn.SetDeadline(time.Now().Add(initialDeadline)); err != nil {
+		return
+	}
+	if err = wireConn.Initialize(conn); err != nil {
+		l.log.Debugf("Peer %v: Failed session handshake: %v", rAddr, err)
+		return
+	}
+
+	// Receive a command.
+	cmd, err := wireConn.RecvCommand()
+	if err != nil {
+		l.log.Debugf("Peer %v: Failed to receive command: %v", rAddr, err)
+		return
+	}
+
+	// Parse the command, and craft the response.
+	var resp commands.Command
+	switch c := cmd.(type) {
+	case *commands.GetConsensus:
+		resp = l.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusDiff:
+		resp = l.onGetConsensusDiff(rAddr, c)
+	default:
+		l.log.Debugf("Peer %v: Invalid request: %T", rAddr, c)
+		return
+	}
+
+	// Send the response.
+	if err = conn.SetDeadline(time.Now().Add(responseDeadline)); err != nil {
+		return
+	}
+	if err = wireConn.SendCommand(resp); err != nil {
+		l.log.Debugf("Peer %v: Failed to send response: %v", rAddr, err)
+	}
+}
+
+func (l *Listener) onGetConsensus(rAddr net.Addr, cmd *commands.GetConsensus) commands.Command {
+	resp := &commands.Consensus{}
+	raw, err := l.source.GetRawConsensus(cmd.Epoch)
+	switch err {
+	case nil:
+		l.log.Debugf("Peer: %v: Serving document for epoch %v.", rAddr, cmd.Epoch)
+		resp.ErrorCode = commands.ConsensusOk
+		resp.Payload = raw
+	case pki.ErrNoDocument:
+		resp.ErrorCode = commands.ConsensusGone
+	default:
+		l.log.Debugf("Peer %v: No document for epoch '%v': %v", rAddr, cmd.Epoch, err)
+		resp.ErrorCode = commands.ConsensusNotFound
+	}
+	return resp
+}
+
+func (l *Listener) onGetConsensusDiff(rAddr net.Addr, cmd *commands.GetConsensusDiff) commands.Command {
+	resp := &commands.ConsensusDiff{}
+	p, err := l.source.GetConsensusPayload(cmd.Epoch, cmd.BaseHash, cmd.Compress)
+	switch err {
+	case nil:
+		l.log.Debugf("Peer: %v: Serving document for epoch %v (diff: %v, compressed: %v).", rAddr, cmd.Epoch, p.IsDiff, p.IsCompressed)
+		resp.ErrorCode = commands.ConsensusOk
+		resp.IsDiff = p.IsDiff
+		resp.IsCompressed = p.IsCompressed
+		resp.Payload = p.Payload
+	case pki.ErrNoDocument:
+		resp.ErrorCode = commands.ConsensusGone
+	default:
+		l.log.Debugf("Peer %v: No document for epoch '%v': %v", rAddr, cmd.Epoch, err)
+		resp.ErrorCode = commands.ConsensusNotFound
+	}
+	return resp
+}
+
+// NewListener returns a new Listener serving the documents of the source
+// on the addresses, which are tcp or quic URLs.
+func NewListener(source Source, identityPublicKey sign.PublicKey, linkKey wire.PrivateKey, logBackend *log.Backend, addresses []string) (*Listener, error) {
+	l := &Listener{
+		source:            source,
+		log:               logBackend.GetLogger("cache/listener"),
+		identityPublicKey: identityPublicKey,
+		linkKey:           linkKey,
+		closeAllCh:        make(chan interface{}),
+	}
+
+	for _, v := range addresses {
+		u, err := url.Parse(v)
+		if err != nil {
+			l.Halt()
+			return nil, fmt.Errorf("cache: invalid listener address '%v': %v", v, err)
+		}
+		var ln net.Listener
+		switch u.Scheme {
+		case "tcp", "tcp4", "tcp6":
+			ln, err = net.Listen(u.Scheme, u.Host)
+		case "quic":
+			var ql *quic.Listener
+			ql, err = quic.ListenAddr(u.Host, kquic.GenerateTLSConfig(), nil)
+			if err == nil {
+				// Wrap quic.Listener with kquic.QuicListener
+				// so it implements like net.Listener for a
+				// single QUIC Stream
+				ln = &kquic.QuicListener{Listener: ql}
+			}
+		default:
+			err = fmt.Errorf("unsupported listener scheme")
+		}
+		if err != nil {
+			l.Halt()
+			return nil, fmt.Errorf("cache: failed to start listener '%v': %v", v, err)
+		}
+		l.listeners = append(l.listeners, ln)
+		l.Add(1)
+		go l.listenWorker(ln)
+	}
+	return l, nil
+}
+
+// Addrs returns the addresses the listener is bound to.
+func (l *Listener) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(l.listeners))
+	for _, ln := range l.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
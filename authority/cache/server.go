@@ -0,0 +1,235 @@
+// server.go - Katzenpost standalone directory cache server.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/authority/cache/config"
+	vClient "github.com/katzenpost/katzenpost/authority/voting/client"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/utils"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+// Server is a standalone directory cache server instance.
+type Server struct {
+	cfg *config.Config
+
+	identityPrivateKey sign.PrivateKey
+	identityPublicKey  sign.PublicKey
+	linkKey            wire.PrivateKey
+
+	logBackend *log.Backend
+	log        *logging.Logger
+
+	cache    *Cache
+	listener *Listener
+
+	fatalErrCh chan error
+	haltedCh   chan interface{}
+	haltOnce   sync.Once
+}
+
+func (s *Server) initLogging() error {
+	p := s.cfg.Logging.File
+	if !s.cfg.Logging.Disable && s.cfg.Logging.File != "" {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(s.cfg.Server.DataDir, p)
+		}
+	}
+
+	var err error
+	s.logBackend, err = log.New(p, s.cfg.Logging.Level, s.cfg.Logging.Disable)
+	if err == nil {
+		s.log = s.logBackend.GetLogger("cache/server")
+	}
+	return err
+}
+
+// IdentityKey returns the running Server's identity public key.
+func (s *Server) IdentityKey() sign.PublicKey {
+	return s.identityPublicKey
+}
+
+// LinkKey returns the running Server's link public key.
+func (s *Server) LinkKey() wire.PublicKey {
+	return s.linkKey.PublicKey()
+}
+
+// RotateLog rotates the log file
+// if logging to a file is enabled.
+func (s *Server) RotateLog() {
+	err := s.logBackend.Rotate()
+	if err != nil {
+		s.fatalErrCh <- fmt.Errorf("failed to rotate log file, shutting down server")
+	}
+	s.log.Notice("Log rotated.")
+}
+
+// Wait waits till the server is terminated for any reason.
+func (s *Server) Wait() {
+	<-s.haltedCh
+}
+
+// Shutdown cleanly shuts down a given Server instance.
+func (s *Server) Shutdown() {
+	s.haltOnce.Do(func() { s.halt() })
+}
+
+func (s *Server) halt() {
+	s.log.Notice("Starting graceful shutdown.")
+
+	if s.listener != nil {
+		s.listener.Halt()
+		s.listener = nil
+	}
+	if s.cache != nil {
+		s.cache.Halt()
+		s.cache = nil
+	}
+
+	s.identityPublicKey.Reset()
+	s.identityPrivateKey.Reset()
+	s.linkKey.Reset()
+	close(s.fatalErrCh)
+
+	s.log.Notice("Shutdown complete.")
+	close(s.haltedCh)
+}
+
+// NewServer returns a new Server instance parameterized with the specified
+// configuration.
+func NewServer(cfg *config.Config, opts ...Option) (*Server, error) {
+	s := &Server{
+		cfg:        cfg,
+		fatalErrCh: make(chan error),
+		haltedCh:   make(chan interface{}),
+	}
+
+	// Do the early initialization and bring up logging.
+	if err := utils.MkDataDir(s.cfg.Server.DataDir); err != nil {
+		return nil, err
+	}
+	if err := s.initLogging(); err != nil {
+		return nil, err
+	}
+
+	s.log.Notice("Katzenpost is still pre-alpha.  DO NOT DEPEND ON IT FOR STRONG SECURITY OR ANONYMITY.")
+	if s.cfg.Logging.Level == "DEBUG" {
+		s.log.Warning("Unsafe Debug logging is enabled.")
+	}
+
+	// Initialize the directory cache identity key.
+	identityPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.private.pem")
+	identityPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.public.pem")
+
+	s.identityPrivateKey, s.identityPublicKey = cert.Scheme.NewKeypair()
+	var err error
+	if pem.BothExists(identityPrivateKeyFile, identityPublicKeyFile) {
+		if err = pem.FromFile(identityPrivateKeyFile, s.identityPrivateKey); err != nil {
+			return nil, err
+		}
+		if err = pem.FromFile(identityPublicKeyFile, s.identityPublicKey); err != nil {
+			return nil, err
+		}
+	} else if pem.BothNotExists(identityPrivateKeyFile, identityPublicKeyFile) {
+		if err = pem.ToFile(identityPrivateKeyFile, s.identityPrivateKey); err != nil {
+			return nil, err
+		}
+		if err = pem.ToFile(identityPublicKeyFile, s.identityPublicKey); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%s and %s must either both exist or not exist", identityPrivateKeyFile, identityPublicKeyFile)
+	}
+
+	scheme := wire.DefaultScheme
+	linkPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "link.private.pem")
+	linkPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, "link.public.pem")
+
+	linkPrivateKey, linkPublicKey := scheme.GenerateKeypair(rand.Reader)
+	if pem.BothExists(linkPrivateKeyFile, linkPublicKeyFile) {
+		if err = pem.FromFile(linkPrivateKeyFile, linkPrivateKey); err != nil {
+			return nil, err
+		}
+		if err = pem.FromFile(linkPublicKeyFile, linkPublicKey); err != nil {
+			return nil, err
+		}
+	} else if pem.BothNotExists(linkPrivateKeyFile, linkPublicKeyFile) {
+		if err = pem.ToFile(linkPrivateKeyFile, linkPrivateKey); err != nil {
+			return nil, err
+		}
+		if err = pem.ToFile(linkPublicKeyFile, linkPublicKey); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%s and %s must either both exist or not exist", linkPrivateKeyFile, linkPublicKeyFile)
+	}
+	s.linkKey = linkPrivateKey
+
+	s.log.Noticef("Directory cache identity public key hash is: %x", s.identityPublicKey.Sum256())
+	s.log.Noticef("Directory cache link public key hash is: %x", linkPublicKey.Sum256())
+
+	// Past this point, failures need to call s.Shutdown() to do cleanup.
+	isOk := false
+	defer func() {
+		if !isOk {
+			s.Shutdown()
+		}
+	}()
+
+	// Start the fatal error watcher.
+	go func() {
+		err, ok := <-s.fatalErrCh
+		if !ok {
+			return
+		}
+		s.log.Warningf("Shutting down due to error: %v", err)
+		s.Shutdown()
+	}()
+
+	// Start up the cache, fetching the documents from the authorities with
+	// an ephemeral link key, as a client does.
+	clientLinkKey, _ := scheme.GenerateKeypair(rand.Reader)
+	client, err := vClient.New(&vClient.Config{
+		LinkKey:     clientLinkKey,
+		LogBackend:  s.logBackend,
+		Authorities: s.cfg.Authorities,
+		StateFile:   filepath.Join(s.cfg.Server.DataDir, "authority_sets.cbor"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.cache = New(client, s.logBackend, opts...)
+
+	// Start up the listener.
+	if s.listener, err = NewListener(s.cache, s.identityPublicKey, s.linkKey, s.logBackend, s.cfg.Server.Addresses); err != nil {
+		s.log.Errorf("Failed to start listener: %v", err)
+		return nil, err
+	}
+
+	isOk = true
+	return s, nil
+}
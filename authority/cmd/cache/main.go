@@ -0,0 +1,82 @@
+// main.go - Katzenpost directory cache binary.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/carlmjohnson/versioninfo"
+
+	"github.com/katzenpost/katzenpost/authority/cache"
+	"github.com/katzenpost/katzenpost/authority/cache/config"
+)
+
+func main() {
+	cfgFile := flag.String("f", "katzenpost-cache.toml", "Path to the directory cache config file.")
+	version := flag.Bool("v", false, "Get version info.")
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("version is %s\n", versioninfo.Short())
+		return
+	}
+
+	// Set the umask to something "paranoid".
+	syscall.Umask(0077)
+
+	cfg, err := config.LoadFile(*cfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", *cfgFile, err)
+		os.Exit(-1)
+	}
+
+	// Setup the signal handling.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	rotateCh := make(chan os.Signal, 1)
+	signal.Notify(rotateCh, syscall.SIGHUP)
+
+	// Start up the directory cache.
+	svr, err := cache.NewServer(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to spawn directory cache instance: %v\n", err)
+		os.Exit(-1)
+	}
+	defer svr.Shutdown()
+
+	// Halt the directory cache gracefully on SIGINT/SIGTERM.
+	go func() {
+		<-ch
+		svr.Shutdown()
+	}()
+
+	// Rotate server logs upon SIGHUP.
+	go func() {
+		for {
+			<-rotateCh
+			svr.RotateLog()
+		}
+	}()
+
+	// Wait for the directory cache to explode or be terminated.
+	svr.Wait()
+}
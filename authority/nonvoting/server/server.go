@@ -37,6 +37,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/wire"
 )
 
@@ -60,6 +61,8 @@ type Server struct {
 	state     *state
 	listeners []net.Listener
 
+	consensusEncoder *pki.ConsensusEncoder
+
 	fatalErrCh chan error
 	haltedCh   chan interface{}
 	haltOnce   sync.Once
@@ -191,6 +194,7 @@ func (s *Server) halt() {
 func New(cfg *config.Config) (*Server, error) {
 	s := new(Server)
 	s.cfg = cfg
+	s.consensusEncoder = pki.NewConsensusEncoder()
 	s.fatalErrCh = make(chan error)
 	s.haltedCh = make(chan interface{})
 
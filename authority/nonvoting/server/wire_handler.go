@@ -84,6 +84,8 @@ func (s *Server) onConn(conn net.Conn) {
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
 		resp = s.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusDiff:
+		resp = s.onGetConsensusDiff(rAddr, c)
 	case *commands.PostDescriptor:
 		if auth.peerIdentityKeyHash == nil {
 			// A client trying to post is actively evil, don't even dignify
@@ -127,6 +129,37 @@ func (s *Server) onGetConsensus(rAddr net.Addr, cmd *commands.GetConsensus) comm
 	return resp
 }
 
+func (s *Server) onGetConsensusDiff(rAddr net.Addr, cmd *commands.GetConsensusDiff) commands.Command {
+	resp := &commands.ConsensusDiff{}
+	doc, err := s.state.documentForEpoch(cmd.Epoch)
+	if err != nil {
+		s.log.Errorf("Peer %v: Failed to retrieve document for epoch '%v': %v", rAddr, cmd.Epoch, err)
+		switch err {
+		case errGone:
+			resp.ErrorCode = commands.ConsensusGone
+		default:
+			resp.ErrorCode = commands.ConsensusNotFound
+		}
+		return resp
+	}
+
+	// The document is served in full if there is no document for the
+	// previous epoch, or if it is not the peer's.
+	base, _ := s.state.documentForEpoch(cmd.Epoch - 1)
+	p, err := s.consensusEncoder.Encode(doc, base, cmd.BaseHash, cmd.Compress)
+	if err != nil {
+		s.log.Errorf("Peer %v: Failed to encode document for epoch '%v': %v", rAddr, cmd.Epoch, err)
+		resp.ErrorCode = commands.ConsensusNotFound
+		return resp
+	}
+	s.log.Debugf("Peer: %v: Serving document for epoch %v (diff: %v, compressed: %v).", rAddr, cmd.Epoch, p.IsDiff, p.IsCompressed)
+	resp.ErrorCode = commands.ConsensusOk
+	resp.IsDiff = p.IsDiff
+	resp.IsCompressed = p.IsCompressed
+	resp.Payload = p.Payload
+	return resp
+}
+
 func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor, pubKeyHash []byte) commands.Command {
 	resp := &commands.PostDescriptorStatus{
 		ErrorCode: commands.DescriptorInvalid,
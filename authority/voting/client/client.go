@@ -24,6 +24,11 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
 
 	"gopkg.in/op/go-logging.v1"
 
@@ -41,6 +46,12 @@ import (
 
 var defaultDialer = &net.Dialer{}
 
+// maxChainLength is the maximum number of documents fetched to follow the
+// changes of the authority set since the latest verified document, or
+// since the latest document signed by the configured set: a day of 20
+// minute epochs.
+const maxChainLength = 72
+
 // authorityAuthenticator implements the PeerAuthenticator interface
 type authorityAuthenticator struct {
 	IdentityPublicKey sign.PublicKey
@@ -74,6 +85,13 @@ type Config struct {
 	// Authorities is the set of Directory Authority servers.
 	Authorities []*config.Authority
 
+	// Caches is the optional set of directory caches, which serve the
+	// consensus documents on behalf of the authorities and are asked for
+	// them before the authorities. The documents they serve are verified
+	// against the authority keys, and descriptors are only ever posted
+	// to the authorities.
+	Caches []*config.Authority
+
 	// PreferedTransports is a list of the transports will be used to make
 	// outgoing network connections, with the most prefered first.
 	PreferedTransports []pki.Transport
@@ -81,23 +99,30 @@ type Config struct {
 	// DialContextFn is the optional alternative Dialer.DialContext function
 	// to be used when creating outgoing network connections.
 	DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// StateFile is the optional file in which the authority sets followed
+	// since the configured set are saved, so that they are not lost when
+	// the client restarts.
+	StateFile string
 }
 
 func (cfg *Config) validate() error {
 	if cfg.LogBackend == nil {
 		return fmt.Errorf("voting/client: LogBackend is mandatory")
 	}
-	for _, v := range cfg.Authorities {
-		for _, a := range v.Addresses {
-			if len(a) == 0 {
-				return errors.New("voting/client: Invalid Address: zero length")
+	for _, peers := range [][]*config.Authority{cfg.Authorities, cfg.Caches} {
+		for _, v := range peers {
+			for _, a := range v.Addresses {
+				if len(a) == 0 {
+					return errors.New("voting/client: Invalid Address: zero length")
+				}
+			}
+			if v.IdentityPublicKey == nil {
+				return fmt.Errorf("voting/client: Identity PublicKey is mandatory")
+			}
+			if v.LinkPublicKey == nil {
+				return fmt.Errorf("voting/client: Link PublicKey is mandatory")
 			}
-		}
-		if v.IdentityPublicKey == nil {
-			return fmt.Errorf("voting/client: Identity PublicKey is mandatory")
-		}
-		if v.LinkPublicKey == nil {
-			return fmt.Errorf("voting/client: Link PublicKey is mandatory")
 		}
 	}
 	return nil
@@ -112,13 +137,17 @@ type connection struct {
 type connector struct {
 	cfg *Config
 	log *logging.Logger
+
+	// authorities returns the current authority set.
+	authorities func() []*config.Authority
 }
 
 // newConnector returns a connector initialized from a Config.
-func newConnector(cfg *Config) *connector {
+func newConnector(cfg *Config, authorities func() []*config.Authority) *connector {
 	p := &connector{
-		cfg: cfg,
-		log: cfg.LogBackend.GetLogger("pki/voting/client/connector"),
+		cfg:         cfg,
+		log:         cfg.LogBackend.GetLogger("pki/voting/client/connector"),
+		authorities: authorities,
 	}
 	return p
 }
@@ -229,7 +258,7 @@ func (p *connector) allPeersRoundTrip(ctx context.Context, linkKey wire.PrivateK
 	doneCh := make(chan interface{})
 	defer close(doneCh)
 	responses := []commands.Command{}
-	for _, peer := range p.cfg.Authorities {
+	for _, peer := range p.authorities() {
 		conn, err := p.initSession(ctx, doneCh, linkKey, signingKey, peer)
 		if err != nil {
 			p.log.Noticef("pki/voting/client: failure to connect to Authority %s (%x)\n", peer.Identifier, peer.IdentityPublicKey.Sum256())
@@ -249,59 +278,92 @@ func (p *connector) allPeersRoundTrip(ctx context.Context, linkKey wire.PrivateK
 }
 
 func (p *connector) fetchConsensus(ctx context.Context, linkKey wire.PrivateKey, epoch uint64) (commands.Command, error) {
+	return p.fetch(ctx, linkKey, &commands.GetConsensus{Epoch: epoch}, epoch)
+}
+
+func (p *connector) fetchConsensusDiff(ctx context.Context, linkKey wire.PrivateKey, epoch uint64, baseHash [pki.DiffBaseHashSize]byte) (commands.Command, error) {
+	cmd := &commands.GetConsensusDiff{
+		Epoch:    epoch,
+		BaseHash: baseHash,
+		Compress: true,
+	}
+	return p.fetch(ctx, linkKey, cmd, epoch)
+}
+
+// fetch sends the consensus request to the directory caches, and then to
+// the authorities, in turn until one of them replies. Only the replies of
+// the caches which have the document are accepted, as a cache may lag
+// behind the authorities.
+func (p *connector) fetch(ctx context.Context, linkKey wire.PrivateKey, cmd commands.Command, epoch uint64) (commands.Command, error) {
 	doneCh := make(chan interface{})
 	defer close(doneCh)
 
-	if len(p.cfg.Authorities) == 0 {
+	authorities := p.authorities()
+	if len(authorities) == 0 {
 		return nil, errors.New("error: zero Authorities specified in configuration")
 	}
 
 	r := rand.NewMath()
-	peerIndex := r.Intn(len(p.cfg.Authorities))
+	caches := make([]*config.Authority, 0, len(p.cfg.Caches))
+	for _, idx := range r.Perm(len(p.cfg.Caches)) {
+		caches = append(caches, p.cfg.Caches[idx])
+	}
+	peerIndex := r.Intn(len(authorities))
+	peers := caches
+	for i := 0; i < len(authorities); i++ {
+		peers = append(peers, authorities[(peerIndex+i)%len(authorities)])
+	}
 
-	// try each authority
-	for i := 0; i < len(p.cfg.Authorities); i++ {
-		auth := p.cfg.Authorities[(peerIndex+i)%len(p.cfg.Authorities)]
-		conn, err := p.initSession(ctx, doneCh, linkKey, nil, auth)
+	// try each cache, then each authority
+	for i, peer := range peers {
+		isCache := i < len(caches)
+		conn, err := p.initSession(ctx, doneCh, linkKey, nil, peer)
 		if err != nil {
-			return nil, err
+			p.log.Noticef("failure to connect to %s (attempt %d, err=%v)", peer.Identifier, i, err)
+			continue
 		}
 		defer conn.conn.Close() // close connection after use
-		p.log.Noticef("sending getConsensus to %s", auth.Identifier)
-		cmd := &commands.GetConsensus{Epoch: epoch}
+		p.log.Noticef("sending %T to %s", cmd, peer.Identifier)
 		resp, err := p.roundTrip(conn.session, cmd)
 		if err != nil {
-			p.log.Noticef("got response from %s to GetConsensus(%d) (attempt %d, err=%v)", auth.Identifier, epoch, i, err)
-			continue
-		}
-
-		if err != nil {
-			p.log.Errorf("voting/Client: GetConsensus() error from %v %s", err, auth.Identifier)
+			p.log.Noticef("got response from %s to %T(%d) (attempt %d, err=%v)", peer.Identifier, cmd, epoch, i, err)
 			continue
 		}
 
-		r, ok := resp.(*commands.Consensus)
-		if !ok {
-			p.log.Errorf("voting/Client: GetConsensus() unexpected reply from %s %T", auth.Identifier, resp)
+		var errorCode uint8
+		switch r := resp.(type) {
+		case *commands.Consensus:
+			errorCode = r.ErrorCode
+		case *commands.ConsensusDiff:
+			errorCode = r.ErrorCode
+		default:
+			p.log.Errorf("voting/Client: %T unexpected reply from %s %T", cmd, peer.Identifier, resp)
 			continue
 		}
 
-		p.log.Noticef("got response from %s to GetConsensus(%d) (attempt %d, err=%v, res=%s)", auth.Identifier, epoch, i, err, getErrorToString(r.ErrorCode))
-		if err == pki.ErrNoDocument {
+		p.log.Noticef("got response from %s to %T(%d) (attempt %d, res=%s)", peer.Identifier, cmd, epoch, i, getErrorToString(errorCode))
+		if isCache && errorCode != commands.ConsensusOk {
 			continue
 		}
-		return resp, err
+		return resp, nil
 	}
 	return nil, pki.ErrNoDocument
 }
 
 // Client is a PKI client.
 type Client struct {
-	cfg       *Config
-	log       *logging.Logger
-	pool      *connector
-	verifiers []cert.Verifier
-	threshold int
+	sync.Mutex
+
+	cfg  *Config
+	log  *logging.Logger
+	pool *connector
+
+	// signers maps epochs to the authority set which signs their
+	// document, as named by the document of the previous epoch.
+	signers map[uint64][]*config.Authority
+
+	// fetch fetches the document of an epoch to follow the authority set.
+	fetch func(ctx context.Context, linkKey wire.PrivateKey, epoch uint64) (commands.Command, error)
 }
 
 // Post posts the node's descriptor to the PKI for the provided epoch.
@@ -378,18 +440,150 @@ func (c *Client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte,
 		return nil, nil, fmt.Errorf("voting/Client: Get() rejected by authority: %v", getErrorToString(r.ErrorCode))
 	}
 
-	// Verify document signatures.
-	doc := &pki.Document{}
-	_, good, bad, err := cert.VerifyThreshold(c.verifiers, c.threshold, r.Payload)
+	doc, err := c.verifyEpoch(ctx, linkKey, epoch, r.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.log.Noticef("voting/Client: Get() document:\n%s", doc)
+	return doc, r.Payload, nil
+}
+
+// GetDiff returns the PKI document along with the raw serialized form for
+// the provided epoch, fetched as a compressed diff against the raw
+// serialized document of the previous epoch. Authorities which do not
+// have the base document serve the document in full.
+func (c *Client) GetDiff(ctx context.Context, epoch uint64, base []byte) (*pki.Document, []byte, error) {
+	c.log.Noticef("GetDiff(ctx, %d)", epoch)
+
+	baseHash, err := pki.DiffBaseHash(base)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Generate a random keypair to use for the link authentication.
+	scheme := wire.DefaultScheme
+	linkKey, _ := scheme.GenerateKeypair(rand.Reader)
+	defer linkKey.Reset()
+
+	// Dispatch the get_consensus_diff command.
+	resp, err := c.pool.fetchConsensusDiff(ctx, linkKey, epoch, baseHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse the consensus_diff command.
+	r, ok := resp.(*commands.ConsensusDiff)
+	if !ok {
+		return nil, nil, fmt.Errorf("voting/Client: GetDiff() unexpected reply: %T", resp)
+	}
+	switch r.ErrorCode {
+	case commands.ConsensusOk:
+	case commands.ConsensusGone:
+		return nil, nil, pki.ErrNoDocument
+	default:
+		return nil, nil, fmt.Errorf("voting/Client: GetDiff() rejected by authority: %v", getErrorToString(r.ErrorCode))
+	}
+	p := &pki.ConsensusPayload{
+		Payload:      r.Payload,
+		IsDiff:       r.IsDiff,
+		IsCompressed: r.IsCompressed,
+	}
+	raw, err := p.Decode(base)
+	if err != nil {
+		return nil, nil, fmt.Errorf("voting/Client: GetDiff() invalid consensus diff: %s", err)
+	}
+
+	doc, err := c.verifyEpoch(ctx, linkKey, epoch, raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.log.Noticef("voting/Client: GetDiff() document (diff: %v, compressed: %v, %d of %d bytes):\n%s", r.IsDiff, r.IsCompressed, len(r.Payload), len(raw), doc)
+	return doc, raw, nil
+}
+
+// verifyEpoch verifies the document signatures, following the authority
+// set changes since the latest document if needed, and that it is the
+// document for the epoch.
+func (c *Client) verifyEpoch(ctx context.Context, linkKey wire.PrivateKey, epoch uint64, raw []byte) (*pki.Document, error) {
+	doc, err := c.verify(raw)
+	if err != nil {
+		if err = c.followChain(ctx, linkKey, epoch); err != nil {
+			c.log.Errorf("voting/Client: Get() failed to follow the authority set: %s", err)
+			return nil, fmt.Errorf("voting/Client: Get() invalid consensus document: %s", err)
+		}
+		if doc, err = c.verify(raw); err != nil {
+			return nil, fmt.Errorf("voting/Client: Get() invalid consensus document: %s", err)
+		}
+	}
+	if doc.Epoch != epoch {
+		return nil, fmt.Errorf("voting/Client: Get() consensus document for WRONG epoch: %v", doc.Epoch)
+	}
+	return doc, nil
+}
+
+// Deserialize returns PKI document given the raw bytes.
+func (c *Client) Deserialize(raw []byte) (*pki.Document, error) {
+	return c.verify(raw)
+}
+
+// authorities returns the authority set of the latest epoch.
+func (c *Client) authorities() []*config.Authority {
+	c.Lock()
+	defer c.Unlock()
+	var latest uint64
+	for epoch := range c.signers {
+		if epoch > latest {
+			latest = epoch
+		}
+	}
+	return c.signers[latest]
+}
+
+// signersFor returns the authority set which signs the document of the
+// epoch: the set named by the document of the previous epoch, or else by
+// the latest earlier document, or else the configured set. It also
+// returns the epoch of the first document signed by that set.
+func (c *Client) signersFor(epoch uint64) (uint64, []*config.Authority) {
+	c.Lock()
+	defer c.Unlock()
+	var from uint64
+	for e := range c.signers {
+		if e <= epoch && e >= from {
+			from = e
+		}
+	}
+	return from, c.signers[from]
+}
+
+func verifiersOf(authorities []*config.Authority) []cert.Verifier {
+	verifiers := make([]cert.Verifier, len(authorities))
+	for i, auth := range authorities {
+		verifiers[i] = auth.IdentityPublicKey
+	}
+	return verifiers
+}
+
+// verify verifies that the serialized document is signed by a threshold
+// of its authority set, and adopts the authority set it names for the
+// next epoch.
+func (c *Client) verify(raw []byte) (*pki.Document, error) {
+	doc, err := pki.ParseDocument(raw)
+	if err != nil {
+		c.log.Errorf("voting/Client: invalid consensus document: %s", err)
+		return nil, err
+	}
+	_, authorities := c.signersFor(doc.Epoch)
+	verifiers := verifiersOf(authorities)
+	_, good, bad, err := cert.VerifyThreshold(verifiers, pki.AuthorityThreshold(len(verifiers)), raw)
 	if err != nil {
 		c.log.Errorf("VerifyThreshold failure: %d good signatures, %d bad signatures: %v", len(good), len(bad), err)
-		return nil, nil, fmt.Errorf("voting/Client: Get() invalid consensus document: %s", err)
+		return nil, err
 	}
-	if len(good) == len(c.cfg.Authorities) {
+	if len(good) == len(authorities) {
 		c.log.Notice("OK, received fully signed consensus document.")
 	} else {
-		c.log.Noticef("OK, received consensus document with %d of %d signatures)", len(good), len(c.cfg.Authorities))
-		for _, auth := range c.cfg.Authorities {
+		c.log.Noticef("OK, received consensus document with %d of %d signatures)", len(good), len(authorities))
+		for _, auth := range authorities {
 			for _, badauth := range bad {
 				if badauth == auth.IdentityPublicKey {
 					c.log.Noticef("missing or invalid signature from %s", auth.Identifier)
@@ -398,36 +592,173 @@ func (c *Client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte,
 			}
 		}
 	}
-	doc, err = pki.ParseDocument(r.Payload)
-	if err != nil {
-		c.log.Errorf("voting/Client: Get() invalid consensus document: %s", err)
-		return nil, nil, err
+	if err = pki.IsDocumentWellFormed(doc, verifiers); err != nil {
+		c.log.Errorf("voting/Client: IsDocumentWellFormed: %s", err)
+		return nil, err
+	}
+	c.follow(doc)
+	return doc, nil
+}
+
+// follow records the authority set named by a verified document as the
+// signers of the document for the next epoch.
+func (c *Client) follow(doc *pki.Document) {
+	if len(doc.Authorities) == 0 {
+		return
+	}
+	authorities := make([]*config.Authority, len(doc.Authorities))
+	for i, a := range doc.Authorities {
+		authorities[i] = config.AuthorityFromDescriptor(a)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.signers[doc.Epoch+1]; ok {
+		return
+	}
+	c.signers[doc.Epoch+1] = authorities
+
+	// Forget the oldest sets, but keep the configured set.
+	epochs := make([]uint64, 0, len(c.signers))
+	for e := range c.signers {
+		if e != 0 {
+			epochs = append(epochs, e)
+		}
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] > epochs[j] })
+	for i := maxChainLength; i < len(epochs); i++ {
+		delete(c.signers, epochs[i])
+	}
+	if err := c.saveSigners(); err != nil {
+		c.log.Errorf("voting/Client: failed to save the authority sets: %s", err)
 	}
+}
 
-	err = pki.IsDocumentWellFormed(doc, c.verifiers)
+// saveSigners saves the followed authority sets to the StateFile, if set.
+// It must be called with the lock held.
+func (c *Client) saveSigners() error {
+	if c.cfg.StateFile == "" {
+		return nil
+	}
+	sets := make(map[uint64][]*pki.AuthorityDescriptor)
+	for e, authorities := range c.signers {
+		if e == 0 {
+			continue
+		}
+		sets[e] = make([]*pki.AuthorityDescriptor, len(authorities))
+		for i, a := range authorities {
+			sets[e][i] = a.Descriptor()
+		}
+	}
+	b, err := cbor.Marshal(sets)
 	if err != nil {
-		c.log.Errorf("voting/Client: IsDocumentWellFormed: %s", err)
-		return nil, nil, err
+		return err
+	}
+	tmpFile := c.cfg.StateFile + ".tmp"
+	if err = os.WriteFile(tmpFile, b, 0600); err != nil {
+		return err
 	}
+	return os.Rename(tmpFile, c.cfg.StateFile)
+}
 
-	if doc.Epoch != epoch {
-		return nil, nil, fmt.Errorf("voting/Client: Get() consensus document for WRONG epoch: %v", doc.Epoch)
+// loadSigners loads the authority sets saved to the StateFile, if any.
+func (c *Client) loadSigners() error {
+	if c.cfg.StateFile == "" {
+		return nil
 	}
-	c.log.Noticef("voting/Client: Get() document:\n%s", doc)
-	return doc, r.Payload, nil
+	b, err := os.ReadFile(c.cfg.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sets := make(map[uint64][]*pki.AuthorityDescriptor)
+	if err = cbor.Unmarshal(b, &sets); err != nil {
+		return fmt.Errorf("voting/Client: invalid StateFile: %s", err)
+	}
+	for e, descs := range sets {
+		if err = pki.IsAuthoritySetWellFormed(descs); err != nil || e == 0 {
+			return fmt.Errorf("voting/Client: invalid authority set for epoch %d in StateFile: %v", e, err)
+		}
+		authorities := make([]*config.Authority, len(descs))
+		for i, d := range descs {
+			authorities[i] = config.AuthorityFromDescriptor(d)
+		}
+		c.signers[e] = authorities
+	}
+	return nil
 }
 
-// Deserialize returns PKI document given the raw bytes.
-func (c *Client) Deserialize(raw []byte) (*pki.Document, error) {
-	_, _, _, err := cert.VerifyThreshold(c.verifiers, c.threshold, raw)
+// followChain fetches and verifies the documents between the latest
+// document which named an authority set and the epoch, so that the
+// changes of the authority set since then are followed. Without such a
+// recent document, the chain is followed from the latest document
+// signed by the configured set.
+func (c *Client) followChain(ctx context.Context, linkKey wire.PrivateKey, epoch uint64) error {
+	from, _ := c.signersFor(epoch)
+	if from >= epoch && from != 0 {
+		return errors.New("no document to follow the authority set from")
+	}
+	if from == 0 || epoch-from > maxChainLength {
+		var err error
+		if from, err = c.bootstrapChain(ctx, linkKey, epoch); err != nil {
+			return err
+		}
+	}
+	for e := from; e < epoch; e++ {
+		raw, err := c.fetchDocument(ctx, linkKey, e)
+		if err != nil {
+			return err
+		}
+		doc, err := c.verify(raw)
+		if err != nil {
+			return err
+		}
+		if doc.Epoch != e {
+			return fmt.Errorf("consensus document for WRONG epoch: %v", doc.Epoch)
+		}
+	}
+	return nil
+}
+
+// bootstrapChain finds the latest document before the epoch which is
+// signed by the configured set, and returns the following epoch, from
+// which the chain is followed.
+func (c *Client) bootstrapChain(ctx context.Context, linkKey wire.PrivateKey, epoch uint64) (uint64, error) {
+	verifiers := verifiersOf(c.cfg.Authorities)
+	for e := epoch - 1; e > 0 && epoch-e <= maxChainLength; e-- {
+		raw, err := c.fetchDocument(ctx, linkKey, e)
+		if err != nil {
+			return 0, err
+		}
+		if _, _, _, err = cert.VerifyThreshold(verifiers, pki.AuthorityThreshold(len(verifiers)), raw); err != nil {
+			continue
+		}
+		c.Lock()
+		c.signers[e] = c.cfg.Authorities
+		c.Unlock()
+		doc, err := c.verify(raw)
+		if err != nil {
+			return 0, err
+		}
+		if doc.Epoch != e {
+			return 0, fmt.Errorf("consensus document for WRONG epoch: %v", doc.Epoch)
+		}
+		return e + 1, nil
+	}
+	return 0, fmt.Errorf("no document signed by the configured authorities in the %d epochs before %d", maxChainLength, epoch)
+}
+
+// fetchDocument fetches the serialized document of the epoch.
+func (c *Client) fetchDocument(ctx context.Context, linkKey wire.PrivateKey, epoch uint64) ([]byte, error) {
+	resp, err := c.fetch(ctx, linkKey, epoch)
 	if err != nil {
 		return nil, err
 	}
-	doc, err := pki.ParseDocument(raw)
-	if err != nil {
-		fmt.Errorf("Deserialize failure: %s", err)
+	r, ok := resp.(*commands.Consensus)
+	if !ok || r.ErrorCode != commands.ConsensusOk {
+		return nil, fmt.Errorf("no consensus document for epoch %d", epoch)
 	}
-	return doc, err
+	return r.Payload, nil
 }
 
 // New constructs a new pki.Client instance.
@@ -442,12 +773,12 @@ func New(cfg *Config) (pki.Client, error) {
 	c := new(Client)
 	c.cfg = cfg
 	c.log = cfg.LogBackend.GetLogger("pki/voting/Client")
-	c.pool = newConnector(cfg)
-	c.verifiers = make([]cert.Verifier, len(c.cfg.Authorities))
-	for i, auth := range c.cfg.Authorities {
-		c.verifiers[i] = auth.IdentityPublicKey
+	c.pool = newConnector(cfg, c.authorities)
+	c.fetch = c.pool.fetchConsensus
+	c.signers = map[uint64][]*config.Authority{0: cfg.Authorities}
+	if err := c.loadSigners(); err != nil {
+		return nil, err
 	}
-	c.threshold = len(c.verifiers)/2 + 1
 	return c, nil
 }
 
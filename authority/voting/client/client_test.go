@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -203,6 +204,9 @@ type mockDialer struct {
 	sync.Mutex
 	netMap map[string]*conn
 	log    *logging.Logger
+
+	// docs are the documents served as diffs.
+	docs map[uint64][]byte
 }
 
 func newMockDialer(logBackend *log.Backend) *mockDialer {
@@ -310,6 +314,23 @@ func (d *mockDialer) mockServer(address string, linkPrivateKey wire.PrivateKey,
 			d.log.Errorf("SendCommand failure: %s", err)
 			return
 		}
+	case *commands.GetConsensusDiff:
+		p, err := pki.NewConsensusEncoder().Encode(d.docs[c.Epoch], d.docs[c.Epoch-1], c.BaseHash, c.Compress)
+		if err != nil {
+			d.log.Errorf("mockServer Encode failure: %s", err)
+			return
+		}
+		reply := &commands.ConsensusDiff{
+			ErrorCode:    commands.ConsensusOk,
+			IsDiff:       p.IsDiff,
+			IsCompressed: p.IsCompressed,
+			Payload:      p.Payload,
+		}
+		err = session.SendCommand(reply)
+		if err != nil {
+			d.log.Errorf("SendCommand failure: %s", err)
+			return
+		}
 	default:
 		return
 	}
@@ -372,3 +393,246 @@ func TestClient(t *testing.T) {
 	require.Equal(epoch, doc.Epoch)
 	t.Logf("rawDoc size is %d", len(rawDoc))
 }
+
+func TestClientGetDiff(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	dialer := newMockDialer(logBackend)
+	peers := []*config.Authority{}
+	privKeys, pubKeys := []sign.PrivateKey{}, []sign.PublicKey{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		peer, idPrivKey, idPubKey, linkPrivKey, err := generatePeer(i)
+		require.NoError(err)
+		peers = append(peers, peer)
+		privKeys = append(privKeys, idPrivKey)
+		pubKeys = append(pubKeys, idPubKey)
+		wg.Add(1)
+		go dialer.mockServer(peer.Addresses[0], linkPrivKey, idPrivKey, idPubKey, &wg)
+	}
+	wg.Wait()
+
+	// The document of the epoch only differs from the previous one by
+	// its epoch and one mix.
+	epoch, _, _ := epochtime.Now()
+	doc, err := generateMixnet(3, 2, epoch)
+	require.NoError(err)
+	raw, err := multiSignTestDocument(privKeys, pubKeys, doc)
+	require.NoError(err)
+	mixnet, err := generateMixnet(3, 2, epoch)
+	require.NoError(err)
+	doc.Epoch = epoch - 1
+	doc.Topology[0] = mixnet.Topology[0]
+	base, err := multiSignTestDocument(privKeys, pubKeys, doc)
+	require.NoError(err)
+	dialer.docs = map[uint64][]byte{epoch - 1: base, epoch: raw}
+
+	client, err := New(&Config{
+		LogBackend:    logBackend,
+		Authorities:   peers,
+		DialContextFn: dialer.dial,
+	})
+	require.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*100)
+	defer cancel()
+	gotDoc, gotRaw, err := client.(pki.DiffClient).GetDiff(ctx, epoch, base)
+	require.NoError(err)
+	require.Equal(epoch, gotDoc.Epoch)
+	require.Equal(raw, gotRaw)
+}
+
+// testAuthorities are authorities signing the documents of the tests
+// which change the authority set.
+type testAuthorities struct {
+	require     *require.Assertions
+	authorities []*testAuthority
+	mixnets     map[uint64]*pki.Document
+}
+
+type testAuthority struct {
+	peer    *config.Authority
+	privKey sign.PrivateKey
+	pubKey  sign.PublicKey
+}
+
+func newTestAuthorities(require *require.Assertions, n int) *testAuthorities {
+	a := &testAuthorities{
+		require:     require,
+		authorities: make([]*testAuthority, n),
+		mixnets:     make(map[uint64]*pki.Document),
+	}
+	for i := range a.authorities {
+		peer, idPrivKey, idPubKey, _, err := generatePeer(i)
+		require.NoError(err)
+		a.authorities[i] = &testAuthority{peer, idPrivKey, idPubKey}
+	}
+	return a
+}
+
+// peers returns the configuration of the authorities.
+func (a *testAuthorities) peers(members ...int) []*config.Authority {
+	peers := []*config.Authority{}
+	for _, i := range members {
+		peers = append(peers, a.authorities[i].peer)
+	}
+	return peers
+}
+
+// set returns the authority set of the authorities.
+func (a *testAuthorities) set(members ...int) []*pki.AuthorityDescriptor {
+	s := []*pki.AuthorityDescriptor{}
+	for _, i := range members {
+		s = append(s, a.authorities[i].peer.Descriptor())
+	}
+	return s
+}
+
+// signedDoc returns the document of the epoch naming the authority set
+// next, signed by the signers.
+func (a *testAuthorities) signedDoc(epoch uint64, next []*pki.AuthorityDescriptor, signers ...int) []byte {
+	doc, ok := a.mixnets[epoch]
+	if !ok {
+		var err error
+		doc, err = generateMixnet(3, 2, epoch)
+		a.require.NoError(err)
+		a.mixnets[epoch] = doc
+	}
+	doc.Authorities = next
+	privKeys, pubKeys := []sign.PrivateKey{}, []sign.PublicKey{}
+	for _, i := range signers {
+		privKeys = append(privKeys, a.authorities[i].privKey)
+		pubKeys = append(pubKeys, a.authorities[i].pubKey)
+	}
+	raw, err := multiSignTestDocument(privKeys, pubKeys, doc)
+	a.require.NoError(err)
+	return raw
+}
+
+func TestClientFollowsAuthorities(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	a := newTestAuthorities(require, 5)
+	set, signedDoc := a.set, a.signedDoc
+
+	epoch, _, _ := epochtime.Now()
+	client, err := New(&Config{
+		LogBackend:  logBackend,
+		Authorities: a.peers(0, 1, 2),
+	})
+	require.NoError(err)
+	c := client.(*Client)
+
+	// the configured authorities add authority 3
+	doc, err := c.Deserialize(signedDoc(epoch, set(0, 1, 2, 3), 0, 1))
+	require.NoError(err)
+	require.Equal(epoch, doc.Epoch)
+	require.Len(c.authorities(), 4)
+
+	// the new authority set must sign with a threshold of 3 of 4
+	_, err = c.Deserialize(signedDoc(epoch+1, set(1, 2, 3), 0, 1))
+	require.Error(err)
+	_, err = c.Deserialize(signedDoc(epoch+1, set(1, 2, 3), 0, 1, 3))
+	require.NoError(err)
+	require.Len(c.authorities(), 3)
+
+	// authority 0 was removed
+	_, err = c.Deserialize(signedDoc(epoch+2, set(1, 2, 4), 0, 1))
+	require.Error(err)
+
+	// authority 3 rotates its key to authority 4
+	_, err = c.Deserialize(signedDoc(epoch+2, set(1, 2, 4), 1, 3))
+	require.NoError(err)
+	_, err = c.Deserialize(signedDoc(epoch+3, set(1, 2, 4), 1, 3))
+	require.Error(err)
+	_, err = c.Deserialize(signedDoc(epoch+3, set(1, 2, 4), 2, 4))
+	require.NoError(err)
+
+	// documents of earlier epochs are verified with their authority set
+	_, err = c.Deserialize(signedDoc(epoch+1, set(1, 2, 3), 0, 2, 3))
+	require.NoError(err)
+	_, err = c.Deserialize(signedDoc(epoch-1, nil, 0, 1))
+	require.NoError(err)
+}
+
+func TestClientFollowsAuthoritiesAcrossRestarts(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	a := newTestAuthorities(require, 5)
+
+	// the configured authorities add authority 3, which replaces
+	// authority 0, and then rotates its key to authority 4
+	epoch, _, _ := epochtime.Now()
+	docs := map[uint64][]byte{
+		epoch:     a.signedDoc(epoch, a.set(0, 1, 2, 3), 0, 1),
+		epoch + 1: a.signedDoc(epoch+1, a.set(1, 2, 3), 0, 1, 3),
+		epoch + 2: a.signedDoc(epoch+2, a.set(1, 2, 4), 1, 3),
+		epoch + 3: a.signedDoc(epoch+3, a.set(1, 2, 4), 2, 4),
+		epoch + 4: a.signedDoc(epoch+4, a.set(1, 2, 4), 1, 4),
+	}
+	fetches := 0
+	newClient := func(stateFile string) *Client {
+		client, err := New(&Config{
+			LogBackend:  logBackend,
+			Authorities: a.peers(0, 1, 2),
+			StateFile:   stateFile,
+		})
+		require.NoError(err)
+		c := client.(*Client)
+		c.fetch = func(ctx context.Context, linkKey wire.PrivateKey, epoch uint64) (commands.Command, error) {
+			fetches++
+			raw, ok := docs[epoch]
+			if !ok {
+				return &commands.Consensus{ErrorCode: commands.ConsensusGone}, nil
+			}
+			return &commands.Consensus{ErrorCode: commands.ConsensusOk, Payload: raw}, nil
+		}
+		return c
+	}
+	ctx := context.Background()
+
+	// a client without a saved authority set follows the chain from the
+	// latest document signed by the configured authorities
+	stateFile := filepath.Join(t.TempDir(), "authority_sets.cbor")
+	c := newClient(stateFile)
+	doc, err := c.verifyEpoch(ctx, nil, epoch+3, docs[epoch+3])
+	require.NoError(err)
+	require.Equal(epoch+3, doc.Epoch)
+	addresses := []string{}
+	for _, auth := range c.authorities() {
+		addresses = append(addresses, auth.Addresses...)
+	}
+	require.Equal([]string{"tcp://127.0.0.1:1", "tcp://127.0.0.1:2", "tcp://127.0.0.1:4"}, addresses)
+
+	// after a restart, the followed authority sets are loaded, and the
+	// following documents are verified without fetching the chain again
+	c = newClient(stateFile)
+	fetches = 0
+	doc, err = c.verifyEpoch(ctx, nil, epoch+4, docs[epoch+4])
+	require.NoError(err)
+	require.Equal(epoch+4, doc.Epoch)
+	require.Zero(fetches)
+
+	// while without the saved sets, the chain is fetched again
+	c = newClient("")
+	_, err = c.verifyEpoch(ctx, nil, epoch+4, docs[epoch+4])
+	require.NoError(err)
+	require.NotZero(fetches)
+
+	// without a document signed by the configured authorities, the
+	// chain cannot be followed
+	delete(docs, epoch)
+	delete(docs, epoch+1)
+	c = newClient("")
+	_, err = c.verifyEpoch(ctx, nil, epoch+4, docs[epoch+4])
+	require.Error(err)
+}
@@ -0,0 +1,87 @@
+// schedule.go - Katzenpost voting authority schedule.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package schedule implements the voting schedule of the Katzenpost
+// voting authorities, which mixes and clients follow to publish and
+// fetch the documents in time.
+package schedule
+
+import (
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/epochtime"
+)
+
+// MixPublishDeadline returns the time into an epoch by which mixes must
+// have published their descriptors for the next epoch. The voting schedule
+// is derived from epochtime.Period each time it is consulted so that the
+// period may be shortened for testing.
+func MixPublishDeadline() time.Duration {
+	return MixPublishDeadlineForPeriod(epochtime.Period)
+}
+
+// AuthorityVoteDeadline returns the time into an epoch by which the
+// authorities must have exchanged their votes.
+func AuthorityVoteDeadline() time.Duration {
+	return AuthorityVoteDeadlineForPeriod(epochtime.Period)
+}
+
+// AuthorityRevealDeadline returns the time into an epoch by which the
+// authorities must have exchanged their shared random reveals.
+func AuthorityRevealDeadline() time.Duration {
+	return AuthorityRevealDeadlineForPeriod(epochtime.Period)
+}
+
+// AuthorityCertDeadline returns the time into an epoch by which the
+// authorities must have exchanged their certificates.
+func AuthorityCertDeadline() time.Duration {
+	return AuthorityCertDeadlineForPeriod(epochtime.Period)
+}
+
+// PublishConsensusDeadline returns the time into an epoch by which the
+// consensus for the next epoch is published.
+func PublishConsensusDeadline() time.Duration {
+	return PublishConsensusDeadlineForPeriod(epochtime.Period)
+}
+
+// MixPublishDeadlineForPeriod returns the MixPublishDeadline of epochs
+// of the given period, such as the period of a fake clock.
+func MixPublishDeadlineForPeriod(period time.Duration) time.Duration {
+	return period / 8
+}
+
+// AuthorityVoteDeadlineForPeriod returns the AuthorityVoteDeadline of
+// epochs of the given period.
+func AuthorityVoteDeadlineForPeriod(period time.Duration) time.Duration {
+	return MixPublishDeadlineForPeriod(period) + period/8
+}
+
+// AuthorityRevealDeadlineForPeriod returns the AuthorityRevealDeadline
+// of epochs of the given period.
+func AuthorityRevealDeadlineForPeriod(period time.Duration) time.Duration {
+	return AuthorityVoteDeadlineForPeriod(period) + period/8
+}
+
+// AuthorityCertDeadlineForPeriod returns the AuthorityCertDeadline of
+// epochs of the given period.
+func AuthorityCertDeadlineForPeriod(period time.Duration) time.Duration {
+	return AuthorityRevealDeadlineForPeriod(period) + period/8
+}
+
+// PublishConsensusDeadlineForPeriod returns the PublishConsensusDeadline
+// of epochs of the given period.
+func PublishConsensusDeadlineForPeriod(period time.Duration) time.Duration {
+	return AuthorityCertDeadlineForPeriod(period) + period/8
+}
@@ -0,0 +1,148 @@
+// authorities.go - Katzenpost voting authority membership.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+// sortedAuthorities returns a copy of the authority set sorted by
+// identity key hash.
+func sortedAuthorities(authorities []*pki.AuthorityDescriptor) []*pki.AuthorityDescriptor {
+	sorted := make([]*pki.AuthorityDescriptor, len(authorities))
+	copy(sorted, authorities)
+	pki.SortAuthorities(sorted)
+	return sorted
+}
+
+// authoritySetKey returns a serialization of the authority set which is
+// equal for equal sets.
+func authoritySetKey(authorities []*pki.AuthorityDescriptor) (string, error) {
+	b := new(bytes.Buffer)
+	for _, a := range sortedAuthorities(authorities) {
+		raw, err := a.MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		binary.Write(b, binary.BigEndian, uint32(len(raw)))
+		b.Write(raw)
+	}
+	return b.String(), nil
+}
+
+// setAuthorities makes authorities the set of authorities whose votes,
+// certificates and signatures are accepted, and whose threshold makes a
+// consensus.
+func (s *state) setAuthorities(authorities []*pki.AuthorityDescriptor) {
+	s.authorities = sortedAuthorities(authorities)
+	s.verifiers = make(map[[publicKeyHashSize]byte]cert.Verifier)
+	s.authorizedAuthorities = make(map[[publicKeyHashSize]byte]bool)
+	s.authorityLinkKeys = make(map[[publicKeyHashSize]byte]wire.PublicKey)
+	for _, a := range s.authorities {
+		pk := a.IdentityKey.Sum256()
+		s.verifiers[pk] = a.IdentityKey
+		s.authorizedAuthorities[pk] = true
+		s.authorityLinkKeys[pk] = a.LinkKey
+		s.reverseHash[pk] = a.IdentityKey
+	}
+	s.threshold = pki.AuthorityThreshold(len(s.authorities))
+	s.dissenters = len(s.authorities)/2 - 1
+}
+
+// proposedAuthorities returns the authority set configured by the
+// operator, which this authority votes for.
+func (s *state) proposedAuthorities() []*pki.AuthorityDescriptor {
+	authorities := make([]*pki.AuthorityDescriptor, 0, len(s.s.cfg.Authorities))
+	for _, a := range s.s.cfg.Authorities {
+		authorities = append(authorities, a.Descriptor())
+	}
+	return sortedAuthorities(authorities)
+}
+
+// authorityPeers returns the current authorities, to which the votes,
+// reveals, certificates and signatures are sent.
+func (s *state) authorityPeers() []*config.Authority {
+	peers := make([]*config.Authority, 0, len(s.authorities))
+	for _, a := range s.authorities {
+		peers = append(peers, config.AuthorityFromDescriptor(a))
+	}
+	return peers
+}
+
+// tallyAuthorities returns the authority set proposed by a threshold of
+// the votes for the epoch, or the current set if there is none, so that
+// a membership change takes effect once it is voted by a threshold of
+// the current authorities.
+func (s *state) tallyAuthorities(epoch uint64) []*pki.AuthorityDescriptor {
+	if s.TryLock() {
+		panic("write lock not held in tallyAuthorities(epoch)")
+	}
+
+	tally := make(map[string]int)
+	for id, vote := range s.votes[epoch] {
+		if err := pki.IsAuthoritySetWellFormed(vote.Authorities); err != nil {
+			s.log.Warningf("Ignoring invalid authority set voted by %x: %v", id, err)
+			continue
+		}
+		k, err := authoritySetKey(vote.Authorities)
+		if err != nil {
+			s.log.Errorf("Ignoring authority set voted by %x that failed to encode: %v", id, err)
+			continue
+		}
+		tally[k]++
+		if tally[k] >= s.threshold {
+			return sortedAuthorities(vote.Authorities)
+		}
+	}
+	return s.authorities
+}
+
+// followAuthorities adopts the authority set named by a consensus
+// document, which signs the document for the following epoch.
+func (s *state) followAuthorities(doc *pki.Document) {
+	if len(doc.Authorities) == 0 || doc.Epoch <= s.authoritiesEpoch {
+		return
+	}
+	if err := pki.IsAuthoritySetWellFormed(doc.Authorities); err != nil {
+		s.log.Errorf("Consensus for epoch %d has an invalid authority set: %v", doc.Epoch, err)
+		return
+	}
+	s.authoritiesEpoch = doc.Epoch
+	current, err := authoritySetKey(s.authorities)
+	if err != nil {
+		s.log.Errorf("Failed to encode the authority set: %v", err)
+		return
+	}
+	next, err := authoritySetKey(doc.Authorities)
+	if err != nil {
+		s.log.Errorf("Failed to encode the authority set of epoch %d: %v", doc.Epoch, err)
+		return
+	}
+	if current == next {
+		return
+	}
+	s.log.Noticef("Consensus for epoch %d changed the authority set to %v", doc.Epoch, doc.Authorities)
+	s.setAuthorities(doc.Authorities)
+	if !s.authorizedAuthorities[s.identityPubKeyHash()] {
+		s.log.Warningf("This authority is not a member of the authority set from epoch %d", doc.Epoch+1)
+	}
+}
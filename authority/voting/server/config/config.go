@@ -34,6 +34,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/wire"
@@ -49,6 +50,18 @@ const (
 	// rate limiting of client connections
 	defaultSendRatePerMinute = 100
 
+	// load balancing weights are clamped to twice the default weight
+	defaultMaxLoadWeight = 2 * pki.DefaultLoadWeight
+
+	// mixes delivering less than half of the probe loops are excluded
+	defaultMinDeliveryRate = 0.5
+
+	// probe loops are sent every 10 seconds and are considered lost
+	// one minute after they were expected back
+	defaultProbeInterval = 10 * 1000
+	defaultProbeTimeout  = 60 * 1000
+	defaultMinProbes     = 10
+
 	// Note: These values are picked primarily for debugging and need to
 	// be changed to something more suitable for a production deployment
 	// at some point.
@@ -140,6 +153,15 @@ type Parameters struct {
 
 	// LambdaMMaxDelay sets the maximum delay for LambdaP.
 	LambdaMMaxDelay uint64
+
+	// MaxLoadWeight is the upper bound to which the load balancing
+	// weights advertised by nodes are clamped when voting.
+	MaxLoadWeight uint8
+
+	// MinDeliveryRate is the fraction of the network-wide delivery rate
+	// of the probe loops that a mix must deliver to be included in the
+	// consensus, as measured by a threshold of the authorities.
+	MinDeliveryRate float64
 }
 
 func (pCfg *Parameters) validate() error {
@@ -173,6 +195,9 @@ func (pCfg *Parameters) validate() error {
 	if pCfg.LambdaMMaxDelay > absoluteMaxDelay {
 		return fmt.Errorf("config: Parameters: LambdaMMaxDelay %v is out of range", pCfg.LambdaPMaxDelay)
 	}
+	if pCfg.MinDeliveryRate < 0 || pCfg.MinDeliveryRate > 1 {
+		return fmt.Errorf("config: Parameters: MinDeliveryRate %v is out of range", pCfg.MinDeliveryRate)
+	}
 
 	return nil
 }
@@ -214,6 +239,66 @@ func (pCfg *Parameters) applyDefaults() {
 	if pCfg.LambdaMMaxDelay == 0 {
 		pCfg.LambdaMMaxDelay = uint64(rand.ExpQuantile(pCfg.LambdaM, defaultLambdaMMaxPercentile))
 	}
+	if pCfg.MaxLoadWeight == 0 {
+		pCfg.MaxLoadWeight = defaultMaxLoadWeight
+	}
+	if pCfg.MinDeliveryRate == 0 {
+		pCfg.MinDeliveryRate = defaultMinDeliveryRate
+	}
+}
+
+// Measurement is the configuration of the probe loops that the authority
+// sends through each mix to measure its delivery rate and latency.
+type Measurement struct {
+	// Provider is the identifier of the Provider through which the
+	// authority sends and receives probe loops.
+	Provider string
+
+	// User is the account of the authority on the Provider, which must
+	// be registered with the link key in measurement.link.public.pem.
+	User string
+
+	// ProbeInterval is the interval in milliseconds between probe loops.
+	ProbeInterval int
+
+	// ProbeTimeout is the time in milliseconds after its expected round
+	// trip time after which a probe loop is considered lost.
+	ProbeTimeout int
+
+	// MinProbes is the number of probe loops through a mix needed for the
+	// authority to vote its measurement.
+	MinProbes int
+}
+
+func (mCfg *Measurement) validate() error {
+	if mCfg.Provider == "" {
+		return errors.New("config: Measurement: Provider is not set")
+	}
+	if mCfg.User == "" || len(mCfg.User) > wire.MaxAdditionalDataLength {
+		return fmt.Errorf("config: Measurement: User '%v' is invalid", mCfg.User)
+	}
+	if mCfg.ProbeInterval < 0 {
+		return fmt.Errorf("config: Measurement: ProbeInterval %v is invalid", mCfg.ProbeInterval)
+	}
+	if mCfg.ProbeTimeout < 0 {
+		return fmt.Errorf("config: Measurement: ProbeTimeout %v is invalid", mCfg.ProbeTimeout)
+	}
+	if mCfg.MinProbes < 0 {
+		return fmt.Errorf("config: Measurement: MinProbes %v is invalid", mCfg.MinProbes)
+	}
+	return nil
+}
+
+func (mCfg *Measurement) applyDefaults() {
+	if mCfg.ProbeInterval == 0 {
+		mCfg.ProbeInterval = defaultProbeInterval
+	}
+	if mCfg.ProbeTimeout == 0 {
+		mCfg.ProbeTimeout = defaultProbeTimeout
+	}
+	if mCfg.MinProbes == 0 {
+		mCfg.MinProbes = defaultMinProbes
+	}
 }
 
 // Debug is the authority debug configuration.
@@ -307,6 +392,28 @@ func (a *Authority) Validate() error {
 	return nil
 }
 
+// Descriptor returns the pki.AuthorityDescriptor of the Authority, as
+// listed in the authority set of a PKI Document.
+func (a *Authority) Descriptor() *pki.AuthorityDescriptor {
+	return &pki.AuthorityDescriptor{
+		Identifier:  a.Identifier,
+		IdentityKey: a.IdentityPublicKey,
+		LinkKey:     a.LinkPublicKey,
+		Addresses:   a.Addresses,
+	}
+}
+
+// AuthorityFromDescriptor returns the Authority described by a
+// pki.AuthorityDescriptor.
+func AuthorityFromDescriptor(d *pki.AuthorityDescriptor) *Authority {
+	return &Authority{
+		Identifier:        d.Identifier,
+		IdentityPublicKey: d.IdentityKey,
+		LinkPublicKey:     d.LinkKey,
+		Addresses:         d.Addresses,
+	}
+}
+
 // Node is an authority mix node or provider entry.
 type Node struct {
 	// Identifier is the human readable node identifier, to be set iff
@@ -384,6 +491,7 @@ type Config struct {
 	Logging     *Logging
 	Parameters  *Parameters
 	Debug       *Debug
+	Measurement *Measurement
 
 	Mixes     []*Node
 	Providers []*Node
@@ -446,6 +554,12 @@ func (cfg *Config) FixupAndValidate() error {
 	}
 	cfg.Parameters.applyDefaults()
 	cfg.Debug.applyDefaults()
+	if cfg.Measurement != nil {
+		if err := cfg.Measurement.validate(); err != nil {
+			return err
+		}
+		cfg.Measurement.applyDefaults()
+	}
 
 	allNodes := make([]*Node, 0, len(cfg.Mixes)+len(cfg.Providers))
 	for _, v := range cfg.Mixes {
@@ -0,0 +1,290 @@
+// measurements.go - Katzenpost voting authority mix measurements.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+const (
+	measurementsBucket = "measurements"
+
+	// measurementEpochs is the number of epochs of probe loops that a
+	// vote includes, so that it reflects at least a full epoch.
+	measurementEpochs = 2
+)
+
+// recordProbe records the result of a probe loop sent through the mix
+// id during the epoch.  The measurement is persisted by the next call to
+// flushMeasurements.
+func (s *state) recordProbe(epoch uint64, id [publicKeyHashSize]byte, delivered bool, rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.measurements[epoch]; !ok {
+		s.measurements[epoch] = make(map[[publicKeyHashSize]byte]*pki.MixMeasurement)
+	}
+	m, ok := s.measurements[epoch][id]
+	if !ok {
+		m = new(pki.MixMeasurement)
+		s.measurements[epoch][id] = m
+	}
+	m.Record(delivered, rtt)
+
+	if s.unflushedMeasurements == nil {
+		s.unflushedMeasurements = make(map[uint64]map[[publicKeyHashSize]byte]bool)
+	}
+	if _, ok := s.unflushedMeasurements[epoch]; !ok {
+		s.unflushedMeasurements[epoch] = make(map[[publicKeyHashSize]byte]bool)
+	}
+	s.unflushedMeasurements[epoch][id] = true
+}
+
+// flushMeasurements persists the measurements recorded since the last
+// call, in a single transaction which runs without holding the state
+// lock.
+func (s *state) flushMeasurements() {
+	s.Lock()
+	unflushed := make(map[uint64]map[[publicKeyHashSize]byte][]byte)
+	lastEpoch := uint64(0)
+	for epoch, ids := range s.unflushedMeasurements {
+		for id := range ids {
+			m, ok := s.measurements[epoch][id]
+			if !ok {
+				continue
+			}
+			raw, err := m.MarshalBinary()
+			if err != nil {
+				s.log.Errorf("Failed to encode the measurement of %x: %v", id, err)
+				continue
+			}
+			if _, ok := unflushed[epoch]; !ok {
+				unflushed[epoch] = make(map[[publicKeyHashSize]byte][]byte)
+			}
+			unflushed[epoch][id] = raw
+		}
+		if epoch > lastEpoch {
+			lastEpoch = epoch
+		}
+	}
+	s.unflushedMeasurements = nil
+	s.Unlock()
+
+	if len(unflushed) == 0 {
+		return
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(measurementsBucket))
+		// The older measurements will not be voted anymore.
+		if err := pruneMeasurements(bkt, lastEpoch-measurementEpochs); err != nil {
+			return err
+		}
+		for epoch, measurements := range unflushed {
+			eBkt, err := bkt.CreateBucketIfNotExists(epochToBytes(epoch))
+			if err != nil {
+				return err
+			}
+			for id, raw := range measurements {
+				if err = eBkt.Put(id[:], raw); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		// Persistence failures are FATAL.
+		s.s.fatalErrCh <- err
+	}
+}
+
+// restoreMeasurements restores the persisted measurements of the epoch.
+func (s *state) restoreMeasurements(bkt *bolt.Bucket, epoch uint64) {
+	eBkt := bkt.Bucket(epochToBytes(epoch))
+	if eBkt == nil {
+		return
+	}
+	c := eBkt.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(k) != publicKeyHashSize {
+			s.log.Errorf("Discarding persisted measurement: invalid key")
+			continue
+		}
+		m := new(pki.MixMeasurement)
+		if err := m.UnmarshalBinary(v); err != nil {
+			s.log.Errorf("Failed to decode persisted measurement: %v", err)
+			continue
+		}
+		var id [publicKeyHashSize]byte
+		copy(id[:], k)
+		if _, ok := s.measurements[epoch]; !ok {
+			s.measurements[epoch] = make(map[[publicKeyHashSize]byte]*pki.MixMeasurement)
+		}
+		s.measurements[epoch][id] = m
+	}
+}
+
+// voteMeasurements returns the measurements of the probe loops sent by
+// this authority during the epochs preceding the vote's epoch, leaving
+// out the mixes through which too few probe loops were sent.
+func (s *state) voteMeasurements(epoch uint64) map[[publicKeyHashSize]byte]*pki.MixMeasurement {
+	if s.s.cfg.Measurement == nil {
+		return nil
+	}
+	sums := make(map[[publicKeyHashSize]byte]*pki.MixMeasurement)
+	for e := epoch - measurementEpochs; e < epoch; e++ {
+		for id, m := range s.measurements[e] {
+			if _, ok := sums[id]; !ok {
+				sums[id] = new(pki.MixMeasurement)
+			}
+			sums[id].Add(m)
+		}
+	}
+	for id, m := range sums {
+		if m.Probes < uint32(s.s.cfg.Measurement.MinProbes) {
+			delete(sums, id)
+		}
+	}
+	if len(sums) == 0 {
+		return nil
+	}
+	return sums
+}
+
+// tallyMeasurements returns, for every authorized mix measured by a
+// threshold of the votes for the epoch, the median of the measurements.
+func (s *state) tallyMeasurements(epoch uint64) map[[publicKeyHashSize]byte]*pki.MixMeasurement {
+	if s.TryLock() {
+		panic("write lock not held in tallyMeasurements(epoch)")
+	}
+
+	votes := make(map[[publicKeyHashSize]byte][]*pki.MixMeasurement)
+	for voter, vote := range s.votes[epoch] {
+		for id, m := range vote.Measurements {
+			if err := pki.IsMeasurementWellFormed(m); err != nil {
+				s.log.Warningf("Ignoring measurement of %x voted by %x: %v", id, voter, err)
+				continue
+			}
+			if !s.authorizedMixes[id] {
+				continue
+			}
+			votes[id] = append(votes[id], m)
+		}
+	}
+	measurements := make(map[[publicKeyHashSize]byte]*pki.MixMeasurement)
+	for id, ms := range votes {
+		if len(ms) >= s.threshold {
+			measurements[id] = pki.MedianMeasurement(ms)
+		}
+	}
+	if len(measurements) == 0 {
+		return nil
+	}
+	return measurements
+}
+
+// networkDelivery returns the probe loops sent and delivered through all
+// the measured mixes. A lost probe loop is recorded against the mix it was
+// pinned to, whichever hop dropped it, so that the mixes are judged
+// relative to the delivery rate of the whole network.
+func networkDelivery(measurements map[[publicKeyHashSize]byte]*pki.MixMeasurement) (probes, delivered uint64) {
+	for _, m := range measurements {
+		probes += uint64(m.Probes)
+		delivered += uint64(m.Delivered)
+	}
+	return
+}
+
+// relativeDeliveryRate returns the delivery rate of a mix as a fraction
+// of the network-wide delivery rate, capped at 1.
+func relativeDeliveryRate(m *pki.MixMeasurement, probes, delivered uint64) float64 {
+	if delivered == 0 {
+		return 1
+	}
+	rate := m.DeliveryRate() * float64(probes) / float64(delivered)
+	if rate > 1 {
+		return 1
+	}
+	return rate
+}
+
+// excludeUnreliable removes the mixes whose delivery rate is less than
+// minRate of the network-wide delivery rate, unless too few mixes would
+// remain to form a topology.
+func (s *state) excludeUnreliable(nodes []*pki.MixDescriptor, measurements map[[publicKeyHashSize]byte]*pki.MixMeasurement, minRate float64) []*pki.MixDescriptor {
+	probes, delivered := networkDelivery(measurements)
+	reliable := make([]*pki.MixDescriptor, 0, len(nodes))
+	nrMixes, nrReliable := 0, 0
+	for _, desc := range nodes {
+		if desc.Provider {
+			reliable = append(reliable, desc)
+			continue
+		}
+		nrMixes++
+		if m, ok := measurements[desc.IdentityKey.Sum256()]; ok && relativeDeliveryRate(m, probes, delivered) < minRate {
+			continue
+		}
+		nrReliable++
+		reliable = append(reliable, desc)
+	}
+	if nrReliable == nrMixes {
+		return nodes
+	}
+	if minNodes := s.s.cfg.Debug.Layers * s.s.cfg.Debug.MinNodesPerLayer; nrReliable < minNodes {
+		s.log.Warningf("Not excluding %d unreliable mixes, only %d mixes would remain", nrMixes-nrReliable, nrReliable)
+		return nodes
+	}
+	s.log.Noticef("Excluding %d mixes delivering less than %v of the network-wide delivery rate", nrMixes-nrReliable, minRate)
+	return reliable
+}
+
+// weighByDeliveryRate scales down the load balancing weights of the
+// measured nodes by their delivery rate relative to the network-wide
+// delivery rate.
+func weighByDeliveryRate(weights map[[publicKeyHashSize]byte]uint8, measurements map[[publicKeyHashSize]byte]*pki.MixMeasurement) map[[publicKeyHashSize]byte]uint8 {
+	probes, delivered := networkDelivery(measurements)
+	for id, w := range weights {
+		m, ok := measurements[id]
+		if !ok {
+			continue
+		}
+		scaled := uint64(float64(w) * relativeDeliveryRate(m, probes, delivered))
+		if scaled == 0 {
+			scaled = 1
+		}
+		weights[id] = uint8(scaled)
+	}
+	return weights
+}
+
+// pruneMeasurements discards the persisted measurements of the epochs
+// before cmpEpoch.
+func pruneMeasurements(bkt *bolt.Bucket, cmpEpoch uint64) error {
+	stale := [][]byte{}
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil && epochFromBytes(k) < cmpEpoch; k, _ = c.Next() {
+		stale = append(stale, k)
+	}
+	for _, k := range stale {
+		if err := bkt.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+// prober.go - Katzenpost voting authority mix probing.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mRand "math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/katzenpost/core/sphinx/path"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/core/worker"
+	"github.com/katzenpost/katzenpost/minclient"
+)
+
+// echoCapability is the capability of the Provider service which returns
+// the probe loops.
+const echoCapability = "echo"
+
+var errNoEchoProvider = errors.New("authority: no Provider runs an echo service")
+
+type probe struct {
+	id       [publicKeyHashSize]byte
+	epoch    uint64
+	sentAt   time.Time
+	deadline time.Time
+	sprpKey  []byte
+}
+
+type probeTarget struct {
+	layer int
+	desc  *pki.MixDescriptor
+}
+
+// prober sends probe loops through each mix of the current consensus in
+// turn, as a client of a Provider, and records whether they return.
+type prober struct {
+	worker.Worker
+	sync.Mutex
+
+	s      *Server
+	cfg    *config.Measurement
+	log    *logging.Logger
+	sphinx *sphinx.Sphinx
+	rng    *mRand.Rand
+	client *minclient.Client
+
+	probes       map[[sConstants.SURBIDLength]byte]*probe
+	targets      []probeTarget
+	targetsEpoch uint64
+}
+
+func (p *prober) Halt() {
+	p.Worker.Halt()
+	p.client.Shutdown()
+	p.s.state.flushMeasurements()
+}
+
+func (p *prober) worker() {
+	interval := time.Duration(p.cfg.ProbeInterval) * time.Millisecond
+	for {
+		wakeup := p.s.clock.NewTimer(interval)
+		select {
+		case <-p.HaltCh():
+			p.log.Debugf("Terminating gracefully.")
+			wakeup.Stop()
+			return
+		case <-wakeup.C:
+		}
+
+		p.expireProbes()
+		p.s.state.flushMeasurements()
+		doc := p.client.CurrentDocument()
+		if doc == nil {
+			p.log.Debugf("No PKI document for the current epoch, not probing.")
+			continue
+		}
+		if err := p.sendProbe(doc); err != nil {
+			p.log.Warningf("Failed to send probe loop: %v", err)
+		}
+	}
+}
+
+// nextTarget returns the next mix to probe, going through all the mixes
+// of the document in a random order.
+func (p *prober) nextTarget(doc *pki.Document) (probeTarget, bool) {
+	if p.targetsEpoch != doc.Epoch || len(p.targets) == 0 {
+		p.targets = p.targets[:0]
+		for layer, nodes := range doc.Topology {
+			for _, desc := range nodes {
+				p.targets = append(p.targets, probeTarget{layer: layer, desc: desc})
+			}
+		}
+		p.rng.Shuffle(len(p.targets), func(i, j int) {
+			p.targets[i], p.targets[j] = p.targets[j], p.targets[i]
+		})
+		p.targetsEpoch = doc.Epoch
+	}
+	if len(p.targets) == 0 {
+		return probeTarget{}, false
+	}
+	t := p.targets[0]
+	p.targets = p.targets[1:]
+	return t, true
+}
+
+// pinLayer returns a copy of the document whose layer only contains the
+// mix, so that the paths selected from it go through the mix.
+func pinLayer(doc *pki.Document, layer int, desc *pki.MixDescriptor) *pki.Document {
+	pinned := *doc
+	pinned.Topology = make([][]*pki.MixDescriptor, len(doc.Topology))
+	copy(pinned.Topology, doc.Topology)
+	pinned.Topology[layer] = []*pki.MixDescriptor{desc}
+	return &pinned
+}
+
+// echoProvider returns a random Provider running an echo service, and
+// the recipient of the service.
+func (p *prober) echoProvider(doc *pki.Document) (*pki.MixDescriptor, string, error) {
+	for _, idx := range p.rng.Perm(len(doc.Providers)) {
+		desc := doc.Providers[idx]
+		params, ok := desc.Kaetzchen[echoCapability]
+		if !ok {
+			continue
+		}
+		if endpoint, ok := params["endpoint"].(string); ok {
+			return desc, endpoint, nil
+		}
+	}
+	return nil, "", errNoEchoProvider
+}
+
+// sendProbe sends a probe loop through the next mix to an echo service,
+// with a SURB for the echo service to return it.
+func (p *prober) sendProbe(doc *pki.Document) error {
+	target, ok := p.nextTarget(doc)
+	if !ok {
+		return errors.New("document has no mixes")
+	}
+	src, err := doc.GetProvider(p.cfg.Provider)
+	if err != nil {
+		return err
+	}
+	dst, endpoint, err := p.echoProvider(doc)
+	if err != nil {
+		return err
+	}
+
+	var surbID [sConstants.SURBIDLength]byte
+	if _, err := rand.Reader.Read(surbID[:]); err != nil {
+		return err
+	}
+	geo := p.s.geo
+	now := p.s.clock.Time()
+	fwdPath, then, err := path.NewWithClock(p.s.clock, p.rng, geo, pinLayer(doc, target.layer, target.desc), []byte(endpoint), src, dst, &surbID, now, true, true)
+	if err != nil {
+		return fmt.Errorf("failed to select forward path: %v", err)
+	}
+	revPath, then, err := path.NewWithClock(p.s.clock, p.rng, geo, doc, []byte(p.cfg.User), dst, src, &surbID, then, true, false)
+	if err != nil {
+		return fmt.Errorf("failed to select reverse path: %v", err)
+	}
+	surb, k, err := p.sphinx.NewSURB(rand.Reader, revPath)
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, 2, 2+geo.SURBLength+geo.UserForwardPayloadLength)
+	payload[0] = 1 // Packet has a SURB.
+	payload = append(payload, surb...)
+	payload = append(payload, make([]byte, geo.UserForwardPayloadLength)...)
+	pkt, err := p.sphinx.NewPacket(rand.Reader, fwdPath, payload)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.probes[surbID] = &probe{
+		id:       target.desc.IdentityKey.Sum256(),
+		epoch:    doc.Epoch,
+		sentAt:   now,
+		deadline: then.Add(time.Duration(p.cfg.ProbeTimeout) * time.Millisecond),
+		sprpKey:  k,
+	}
+	p.Unlock()
+
+	if err := p.client.SendSphinxPacket(pkt); err != nil {
+		p.Lock()
+		delete(p.probes, surbID)
+		p.Unlock()
+		return err
+	}
+	p.log.Debugf("Sent probe loop through %x", target.desc.IdentityKey.Sum256())
+	return nil
+}
+
+// onACK records a returned probe loop.
+func (p *prober) onACK(surbID *[sConstants.SURBIDLength]byte, payload []byte) error {
+	p.Lock()
+	pr, ok := p.probes[*surbID]
+	delete(p.probes, *surbID)
+	p.Unlock()
+	if !ok {
+		// Duplicate or expired probe loop.
+		return nil
+	}
+
+	if _, err := p.sphinx.DecryptSURBPayload(payload, pr.sprpKey); err != nil {
+		p.log.Warningf("Failed to decrypt probe loop through %x: %v", pr.id, err)
+		p.s.state.recordProbe(pr.epoch, pr.id, false, 0)
+		return nil
+	}
+	rtt := p.s.clock.Time().Sub(pr.sentAt)
+	p.log.Debugf("Probe loop through %x returned after %v", pr.id, rtt)
+	p.s.state.recordProbe(pr.epoch, pr.id, true, rtt)
+	return nil
+}
+
+// expireProbes records the probe loops which did not return in time as
+// lost, against the mix they were pinned to. The losses of the other hops
+// are accounted for when tallying, see excludeUnreliable.
+func (p *prober) expireProbes() {
+	now := p.s.clock.Time()
+	expired := []*probe{}
+	p.Lock()
+	for surbID, pr := range p.probes {
+		if now.After(pr.deadline) {
+			expired = append(expired, pr)
+			delete(p.probes, surbID)
+		}
+	}
+	p.Unlock()
+
+	for _, pr := range expired {
+		p.log.Debugf("Probe loop through %x was lost", pr.id)
+		p.s.state.recordProbe(pr.epoch, pr.id, false, 0)
+	}
+}
+
+// localPKIClient is a pki.Client serving the documents of the authority,
+// so that the prober does not depend on its peers.
+type localPKIClient struct {
+	s *state
+}
+
+func (c *localPKIClient) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	raw, err := c.s.documentForEpoch(epoch)
+	switch err {
+	case nil:
+	case errGone:
+		return nil, nil, pki.ErrNoDocument
+	default:
+		return nil, nil, err
+	}
+	doc, err := c.Deserialize(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, raw, nil
+}
+
+func (c *localPKIClient) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *pki.MixDescriptor) error {
+	return errors.New("authority: descriptors are not posted by the prober")
+}
+
+func (c *localPKIClient) Deserialize(raw []byte) (*pki.Document, error) {
+	c.s.RLock()
+	verifiers, threshold := c.s.getVerifiers(), c.s.threshold
+	c.s.RUnlock()
+	if _, _, _, err := cert.VerifyThreshold(verifiers, threshold, raw); err != nil {
+		return nil, err
+	}
+	return pki.ParseDocument(raw)
+}
+
+func newProber(s *Server) (*prober, error) {
+	p := &prober{
+		s:      s,
+		cfg:    s.cfg.Measurement,
+		log:    s.logBackend.GetLogger("prober"),
+		rng:    rand.NewMath(),
+		probes: make(map[[sConstants.SURBIDLength]byte]*probe),
+	}
+	var err error
+	if p.sphinx, err = sphinx.FromGeometry(s.geo); err != nil {
+		return nil, err
+	}
+
+	// The prober authenticates to its Provider with its own link key,
+	// which must be registered for the configured User.
+	linkPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "measurement.link.private.pem")
+	linkPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, "measurement.link.public.pem")
+	linkPrivateKey, linkPublicKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	if pem.BothExists(linkPrivateKeyFile, linkPublicKeyFile) {
+		if err = pem.FromFile(linkPrivateKeyFile, linkPrivateKey); err != nil {
+			return nil, err
+		}
+	} else if pem.BothNotExists(linkPrivateKeyFile, linkPublicKeyFile) {
+		if err = pem.ToFile(linkPrivateKeyFile, linkPrivateKey); err != nil {
+			return nil, err
+		}
+		if err = pem.ToFile(linkPublicKeyFile, linkPublicKey); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%s and %s must either both exist or not exist", linkPrivateKeyFile, linkPublicKeyFile)
+	}
+
+	p.client, err = minclient.New(&minclient.ClientConfig{
+		SphinxGeometry: s.geo,
+		User:           p.cfg.User,
+		Provider:       p.cfg.Provider,
+		LinkKey:        linkPrivateKey,
+		LogBackend:     s.logBackend,
+		PKIClient:      &localPKIClient{s: s.state},
+		OnACKFn:        p.onACK,
+		Clock:          s.clock,
+
+		// Poll for returned probe loops as often as they are sent, so
+		// that the polling adds little to the measured latency.
+		MessagePollInterval: time.Duration(p.cfg.ProbeInterval) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.log.Noticef("Probing mixes as %v@%v with link key %x", p.cfg.User, p.cfg.Provider, linkPrivateKey.PublicKey().Sum256())
+	p.Go(p.worker)
+	return p, nil
+}
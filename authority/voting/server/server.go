@@ -33,7 +33,9 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/wire"
 	kquic "github.com/katzenpost/katzenpost/quic"
@@ -44,12 +46,24 @@ import (
 // terminates due to the `GenerateOnly` debug config option.
 var ErrGenerateOnly = errors.New("server: GenerateOnly set")
 
+// ServerOption is an option that may be passed to New.
+type ServerOption func(*Server)
+
+// WithClock sets the clock of the authority, which defaults to the
+// system time.
+func WithClock(clock epochtime.Clock) ServerOption {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
 // Server is a voting authority server instance.
 type Server struct {
 	sync.WaitGroup
 
-	cfg *config.Config
-	geo *geo.Geometry
+	cfg   *config.Config
+	geo   *geo.Geometry
+	clock epochtime.Clock
 
 	identityPrivateKey sign.PrivateKey
 	identityPublicKey  sign.PublicKey
@@ -59,8 +73,11 @@ type Server struct {
 	log        *logging.Logger
 
 	state     *state
+	prober    *prober
 	listeners []net.Listener
 
+	consensusEncoder *pki.ConsensusEncoder
+
 	fatalErrCh chan error
 	haltedCh   chan interface{}
 	haltOnce   sync.Once
@@ -175,6 +192,12 @@ func (s *Server) halt() {
 	// Wait for all the connections to terminate.
 	s.WaitGroup.Wait()
 
+	// Halt the prober before the state it records to.
+	if s.prober != nil {
+		s.prober.Halt()
+		s.prober = nil
+	}
+
 	// Halt the state worker.
 	if s.state != nil {
 		s.state.Halt()
@@ -192,10 +215,15 @@ func (s *Server) halt() {
 
 // New returns a new Server instance parameterized with the specific
 // configuration.
-func New(cfg *config.Config) (*Server, error) {
+func New(cfg *config.Config, opts ...ServerOption) (*Server, error) {
 	s := new(Server)
 	s.cfg = cfg
+	s.consensusEncoder = pki.NewConsensusEncoder()
 	s.geo = cfg.SphinxGeometry
+	s.clock = epochtime.WallClock
+	for _, opt := range opts {
+		opt(s)
+	}
 
 	s.fatalErrCh = make(chan error)
 	s.haltedCh = make(chan interface{})
@@ -311,6 +339,13 @@ func New(cfg *config.Config) (*Server, error) {
 	}
 	s.state.Go(s.state.worker)
 
+	// Start up the prober, if the authority measures the mixes.
+	if s.cfg.Measurement != nil {
+		if s.prober, err = newProber(s); err != nil {
+			return nil, err
+		}
+	}
+
 	// Start up the listeners.
 	for _, v := range s.cfg.Server.Addresses {
 		// parse the Address line as a URL
@@ -38,6 +38,7 @@ import (
 	"gopkg.in/op/go-logging.v1"
 
 	"github.com/katzenpost/katzenpost/authority/voting/client"
+	"github.com/katzenpost/katzenpost/authority/voting/schedule"
 	"github.com/katzenpost/katzenpost/authority/voting/server/config"
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
@@ -67,17 +68,75 @@ const (
 )
 
 var (
-	MixPublishDeadline       = epochtime.Period / 8
-	AuthorityVoteDeadline    = MixPublishDeadline + epochtime.Period/8
-	AuthorityRevealDeadline  = AuthorityVoteDeadline + epochtime.Period/8
-	AuthorityCertDeadline    = AuthorityRevealDeadline + epochtime.Period/8
-	PublishConsensusDeadline = AuthorityCertDeadline + epochtime.Period/8
-	errGone                  = errors.New("authority: Requested epoch will never get a Document")
-	errNotYet                = errors.New("authority: Document is not ready yet")
-	errInvalidTopology       = errors.New("authority: Invalid Topology")
-	weekOfEpochs             = uint64(time.Duration(time.Hour*24*7) / epochtime.Period)
+	errGone            = errors.New("authority: Requested epoch will never get a Document")
+	errNotYet          = errors.New("authority: Document is not ready yet")
+	errInvalidTopology = errors.New("authority: Invalid Topology")
 )
 
+// MixPublishDeadline returns the time into an epoch by which mixes must
+// have published their descriptors for the next epoch.
+func MixPublishDeadline() time.Duration {
+	return schedule.MixPublishDeadline()
+}
+
+// AuthorityVoteDeadline returns the time into an epoch by which the
+// authorities must have exchanged their votes.
+func AuthorityVoteDeadline() time.Duration {
+	return schedule.AuthorityVoteDeadline()
+}
+
+// AuthorityRevealDeadline returns the time into an epoch by which the
+// authorities must have exchanged their shared random reveals.
+func AuthorityRevealDeadline() time.Duration {
+	return schedule.AuthorityRevealDeadline()
+}
+
+// AuthorityCertDeadline returns the time into an epoch by which the
+// authorities must have exchanged their certificates.
+func AuthorityCertDeadline() time.Duration {
+	return schedule.AuthorityCertDeadline()
+}
+
+// PublishConsensusDeadline returns the time into an epoch by which the
+// consensus for the next epoch is published.
+func PublishConsensusDeadline() time.Duration {
+	return schedule.PublishConsensusDeadline()
+}
+
+// MixPublishDeadlineForPeriod returns the MixPublishDeadline of epochs
+// of the given period, such as the period of a fake clock.
+func MixPublishDeadlineForPeriod(period time.Duration) time.Duration {
+	return schedule.MixPublishDeadlineForPeriod(period)
+}
+
+// AuthorityVoteDeadlineForPeriod returns the AuthorityVoteDeadline of
+// epochs of the given period.
+func AuthorityVoteDeadlineForPeriod(period time.Duration) time.Duration {
+	return schedule.AuthorityVoteDeadlineForPeriod(period)
+}
+
+// AuthorityRevealDeadlineForPeriod returns the AuthorityRevealDeadline
+// of epochs of the given period.
+func AuthorityRevealDeadlineForPeriod(period time.Duration) time.Duration {
+	return schedule.AuthorityRevealDeadlineForPeriod(period)
+}
+
+// AuthorityCertDeadlineForPeriod returns the AuthorityCertDeadline of
+// epochs of the given period.
+func AuthorityCertDeadlineForPeriod(period time.Duration) time.Duration {
+	return schedule.AuthorityCertDeadlineForPeriod(period)
+}
+
+// PublishConsensusDeadlineForPeriod returns the PublishConsensusDeadline
+// of epochs of the given period.
+func PublishConsensusDeadlineForPeriod(period time.Duration) time.Duration {
+	return schedule.PublishConsensusDeadlineForPeriod(period)
+}
+
+func weekOfEpochs(period time.Duration) uint64 {
+	return uint64(time.Duration(time.Hour*24*7) / period)
+}
+
 type descriptor struct {
 	desc *pki.MixDescriptor
 	raw  []byte
@@ -114,6 +173,16 @@ type state struct {
 	reveals      map[uint64]map[[publicKeyHashSize]byte][]byte
 	commits      map[uint64]map[[publicKeyHashSize]byte][]byte
 	verifiers    map[[publicKeyHashSize]byte]cert.Verifier
+	measurements map[uint64]map[[publicKeyHashSize]byte]*pki.MixMeasurement
+
+	// unflushedMeasurements are the measurements recorded since they
+	// were last persisted.
+	unflushedMeasurements map[uint64]map[[publicKeyHashSize]byte]bool
+
+	// authorities is the current authority set, named by the consensus
+	// of authoritiesEpoch, or configured if there is no such consensus.
+	authorities      []*pki.AuthorityDescriptor
+	authoritiesEpoch uint64
 
 	updateCh chan interface{}
 
@@ -132,6 +201,11 @@ func (s *state) Halt() {
 	s.db.Close()
 }
 
+// clock returns the clock of the authority.
+func (s *state) clock() epochtime.Clock {
+	return epochtime.OrWallClock(s.s.clock)
+}
+
 func (s *state) onUpdate() {
 	// Non-blocking write, multiple invocations are harmless, the channel is
 	// buffered, and there is a fallback timer.
@@ -143,20 +217,24 @@ func (s *state) onUpdate() {
 
 func (s *state) worker() {
 	for {
+		wakeup := s.fsm()
 		select {
 		case <-s.HaltCh():
 			s.log.Debugf("authority: Terminating gracefully.")
+			wakeup.Stop()
 			return
-		case <-s.fsm():
+		case <-wakeup.C:
 			s.log.Debugf("authority: Wakeup due to voting schedule.")
 		}
 	}
 }
 
-func (s *state) fsm() <-chan time.Time {
+func (s *state) fsm() *epochtime.Timer {
 	s.Lock()
 	var sleep time.Duration
-	epoch, elapsed, nextEpoch := epochtime.Now()
+	clock := s.clock()
+	period := clock.Period()
+	epoch, elapsed, nextEpoch := clock.Now()
 	s.log.Debugf("Current epoch %d, remaining time: %s", epoch, nextEpoch)
 
 	switch s.state {
@@ -164,7 +242,7 @@ func (s *state) fsm() <-chan time.Time {
 		s.genesisEpoch = 0
 		s.backgroundFetchConsensus(epoch - 1)
 		s.backgroundFetchConsensus(epoch)
-		if elapsed > MixPublishDeadline {
+		if elapsed > MixPublishDeadlineForPeriod(period) {
 			s.log.Errorf("Too late to vote this round, sleeping until %s", nextEpoch)
 			sleep = nextEpoch
 			s.votingEpoch = epoch + 2
@@ -172,7 +250,7 @@ func (s *state) fsm() <-chan time.Time {
 		} else {
 			s.votingEpoch = epoch + 1
 			s.state = stateAcceptDescriptor
-			sleep = MixPublishDeadline - elapsed
+			sleep = MixPublishDeadlineForPeriod(period) - elapsed
 			if sleep < 0 {
 				sleep = 0
 			}
@@ -191,14 +269,14 @@ func (s *state) fsm() <-chan time.Time {
 			s.log.Errorf("Failed to compute vote for epoch %v: %s", s.votingEpoch, err)
 		}
 		s.state = stateAcceptVote
-		_, nowelapsed, _ := epochtime.Now()
-		sleep = AuthorityVoteDeadline - nowelapsed
+		_, nowelapsed, _ := clock.Now()
+		sleep = AuthorityVoteDeadlineForPeriod(period) - nowelapsed
 	case stateAcceptVote:
 		signed := s.reveal(s.votingEpoch)
 		s.sendRevealToAuthorities(signed, s.votingEpoch)
 		s.state = stateAcceptReveal
-		_, nowelapsed, _ := epochtime.Now()
-		sleep = AuthorityRevealDeadline - nowelapsed
+		_, nowelapsed, _ := clock.Now()
+		sleep = AuthorityRevealDeadlineForPeriod(period) - nowelapsed
 	case stateAcceptReveal:
 		signed, err := s.getCertificate(s.votingEpoch)
 		if err == nil {
@@ -212,8 +290,8 @@ func (s *state) fsm() <-chan time.Time {
 			s.log.Errorf("Failed to compute certificate for epoch %v", s.votingEpoch)
 		}
 		s.state = stateAcceptCert
-		_, nowelapsed, _ := epochtime.Now()
-		sleep = AuthorityCertDeadline - nowelapsed
+		_, nowelapsed, _ := clock.Now()
+		sleep = AuthorityCertDeadlineForPeriod(period) - nowelapsed
 	case stateAcceptCert:
 		doc, err := s.getMyConsensus(s.votingEpoch)
 		if err == nil {
@@ -242,16 +320,16 @@ func (s *state) fsm() <-chan time.Time {
 			s.log.Errorf("Failed to compute our view of consensus for %v with %s", s.votingEpoch, err)
 		}
 		s.state = stateAcceptSignature
-		_, nowelapsed, _ := epochtime.Now()
-		sleep = PublishConsensusDeadline - nowelapsed
+		_, nowelapsed, _ := clock.Now()
+		sleep = PublishConsensusDeadlineForPeriod(period) - nowelapsed
 	case stateAcceptSignature:
 		// combine signatures over a certificate and see if we make a threshold consensus
 		s.log.Noticef("Combining signatures for epoch %v", s.votingEpoch)
 		_, err := s.getThresholdConsensus(s.votingEpoch)
-		_, _, nextEpoch := epochtime.Now()
+		_, _, nextEpoch := clock.Now()
 		if err == nil {
 			s.state = stateAcceptDescriptor
-			sleep = MixPublishDeadline + nextEpoch
+			sleep = MixPublishDeadlineForPeriod(period) + nextEpoch
 			s.votingEpoch++
 		} else {
 			s.log.Error(err.Error())
@@ -264,7 +342,7 @@ func (s *state) fsm() <-chan time.Time {
 	s.pruneDocuments()
 	s.log.Debugf("authority: FSM in state %v until %s", s.state, sleep)
 	s.Unlock()
-	return time.After(sleep)
+	return clock.NewTimer(sleep)
 }
 
 func (s *state) persistDocument(epoch uint64, doc []byte) {
@@ -296,7 +374,7 @@ func (s *state) getVote(epoch uint64) (*pki.Document, error) {
 
 	// vote topology is irrelevent.
 	var zeros [32]byte
-	vote := s.getDocument(descriptors, s.s.cfg.Parameters, zeros[:])
+	vote := s.getDocument(descriptors, s.s.cfg.Parameters, s.loadWeights(descriptors), zeros[:])
 
 	// create our SharedRandom Commit
 	signedCommit, err := s.doCommit(epoch)
@@ -306,6 +384,8 @@ func (s *state) getVote(epoch uint64) (*pki.Document, error) {
 	commits := make(map[[sign.PublicKeyHashSize]byte][]byte)
 	commits[s.identityPubKeyHash()] = signedCommit
 	vote.SharedRandomCommit = commits
+	vote.Authorities = s.proposedAuthorities()
+	vote.Measurements = s.voteMeasurements(epoch)
 
 	_, err = s.doSignDocument(s.s.identityPrivateKey, s.s.identityPublicKey, vote)
 	if err != nil {
@@ -343,7 +423,7 @@ func (s *state) getCertificate(epoch uint64) (*pki.Document, error) {
 		panic("write lock not held in getCertificate(epoch)")
 	}
 
-	mixes, params, err := s.tallyVotes(epoch)
+	mixes, params, weights, err := s.tallyVotes(epoch)
 	if err != nil {
 		s.log.Warningf("No document for epoch %v, aborting!, %v", epoch, err)
 		return nil, err
@@ -351,14 +431,16 @@ func (s *state) getCertificate(epoch uint64) (*pki.Document, error) {
 	s.log.Debug("Mixes tallied, now making a document")
 	var zeros [32]byte
 	srv := zeros[:]
-	certificate := s.getDocument(mixes, params, srv)
+	certificate := s.getDocument(mixes, params, weights, srv)
+	certificate.Authorities = s.tallyAuthorities(epoch)
+	certificate.Measurements = s.tallyMeasurements(epoch)
 	// add the SharedRandomCommit and SharedRandomReveal that we have seen
 	certificate.SharedRandomCommit = s.commits[epoch]
 	certificate.SharedRandomReveal = s.reveals[epoch]
 	// if there are no prior SRV values, copy the current srv twice
 	if len(s.priorSRV) == 0 {
 		s.priorSRV = [][]byte{srv, srv}
-	} else if (s.genesisEpoch-epoch)%weekOfEpochs == 0 {
+	} else if (s.genesisEpoch-epoch)%weekOfEpochs(s.clock().Period()) == 0 {
 		// rotate the weekly epochs if it is time to do so.
 		s.priorSRV = [][]byte{srv, s.priorSRV[0]}
 	}
@@ -415,15 +497,17 @@ func (s *state) getMyConsensus(epoch uint64) (*pki.Document, error) {
 	// if there are no prior SRV values, copy the current srv twice
 	if epoch == s.genesisEpoch {
 		s.priorSRV = [][]byte{srv, srv}
-	} else if (s.genesisEpoch-epoch)%weekOfEpochs == 0 {
+	} else if (s.genesisEpoch-epoch)%weekOfEpochs(s.clock().Period()) == 0 {
 		// rotate the weekly epochs if it is time to do so.
 		s.priorSRV = [][]byte{srv, s.priorSRV[0]}
 	}
-	mixes, params, err := s.tallyVotes(epoch)
+	mixes, params, weights, err := s.tallyVotes(epoch)
 	if err != nil {
 		return nil, err
 	}
-	consensusOfOne := s.getDocument(mixes, params, srv)
+	consensusOfOne := s.getDocument(mixes, params, weights, srv)
+	consensusOfOne.Authorities = s.tallyAuthorities(epoch)
+	consensusOfOne.Measurements = s.tallyMeasurements(epoch)
 	_, err = s.doSignDocument(s.s.identityPrivateKey, s.s.identityPublicKey, consensusOfOne)
 	if err != nil {
 		return nil, err
@@ -470,6 +554,7 @@ func (s *state) getThresholdConsensus(epoch uint64) (*pki.Document, error) {
 		// Persist the document to disk.
 		s.persistDocument(epoch, signedConsensus)
 		s.documents[epoch] = ourConsensus
+		s.followAuthorities(ourConsensus)
 		return ourConsensus, nil
 	} else {
 		s.log.Errorf("VerifyThreshold failed!: %s", err)
@@ -491,7 +576,7 @@ func (s *state) identityPubKeyHash() [publicKeyHashSize]byte {
 	return s.s.identityPublicKey.Sum256()
 }
 
-func (s *state) getDocument(descriptors []*pki.MixDescriptor, params *config.Parameters, srv []byte) *pki.Document {
+func (s *state) getDocument(descriptors []*pki.MixDescriptor, params *config.Parameters, weights map[[publicKeyHashSize]byte]uint8, srv []byte) *pki.Document {
 	// Carve out the descriptors between providers and nodes.
 	var providers []*pki.MixDescriptor
 	var nodes []*pki.MixDescriptor
@@ -541,10 +626,51 @@ func (s *state) getDocument(descriptors []*pki.MixDescriptor, params *config.Par
 		SharedRandomValue:  srv,
 		PriorSharedRandom:  s.priorSRV,
 		SphinxGeometryHash: s.geo.Hash(),
+		LoadWeights:        weights,
+		MinDeliveryRate:    params.MinDeliveryRate,
 	}
 	return doc
 }
 
+// loadWeights returns the load balancing weights advertised by the
+// given descriptors, clamped to the configured MaxLoadWeight.
+func (s *state) loadWeights(descriptors []*pki.MixDescriptor) map[[publicKeyHashSize]byte]uint8 {
+	weights := make(map[[publicKeyHashSize]byte]uint8)
+	for _, desc := range descriptors {
+		w := desc.LoadWeight
+		if w == 0 {
+			w = pki.DefaultLoadWeight
+		}
+		if max := s.s.cfg.Parameters.MaxLoadWeight; max != 0 && w > max {
+			w = max
+		}
+		weights[desc.IdentityKey.Sum256()] = w
+	}
+	return weights
+}
+
+// tallyLoadWeights returns, for every node, the median of the load
+// balancing weights assigned to it by the votes that include it, so that
+// a minority of authorities can not skew the weights.
+func tallyLoadWeights(nodes []*pki.MixDescriptor, votes map[[publicKeyHashSize]byte]*pki.Document) map[[publicKeyHashSize]byte]uint8 {
+	weights := make(map[[publicKeyHashSize]byte]uint8)
+	for _, desc := range nodes {
+		id := desc.IdentityKey.Sum256()
+		ws := []int{}
+		for _, vote := range votes {
+			if w, ok := vote.LoadWeights[id]; ok {
+				ws = append(ws, int(w))
+			}
+		}
+		if len(ws) == 0 {
+			continue
+		}
+		sort.Ints(ws)
+		weights[id] = uint8(ws[(len(ws)-1)/2])
+	}
+	return weights
+}
+
 func (s *state) hasEnoughDescriptors(m map[[publicKeyHashSize]byte]*pki.MixDescriptor) bool {
 	// A Document will be generated iff there are at least:
 	//
@@ -675,7 +801,9 @@ func (s *state) verifyCommits(epoch uint64) (map[[publicKeyHashSize]byte][]byte,
 func (s *state) IsPeerValid(creds *wire.PeerCredentials) bool {
 	var ad [publicKeyHashSize]byte
 	copy(ad[:], creds.AdditionalData[:publicKeyHashSize])
+	s.RLock()
 	_, ok := s.authorizedAuthorities[ad]
+	s.RUnlock()
 	if ok {
 		return true
 	}
@@ -743,7 +871,7 @@ func (s *state) sendCertToAuthorities(cert []byte, epoch uint64) {
 		Payload:   cert,
 	}
 
-	for _, peer := range s.s.cfg.Authorities {
+	for _, peer := range s.authorityPeers() {
 		peer := peer
 		if peer.IdentityPublicKey.Equal(s.s.identityPublicKey) {
 			continue // skip self
@@ -794,7 +922,7 @@ func (s *state) sendVoteToAuthorities(vote []byte, epoch uint64) {
 		Payload:   vote,
 	}
 
-	for _, peer := range s.s.cfg.Authorities {
+	for _, peer := range s.authorityPeers() {
 		peer := peer
 		if peer.IdentityPublicKey.Equal(s.s.identityPublicKey) {
 			continue // skip self
@@ -835,7 +963,7 @@ func (s *state) sendRevealToAuthorities(reveal []byte, epoch uint64) {
 		PublicKey: s.s.IdentityKey(),
 		Payload:   reveal,
 	}
-	for _, peer := range s.s.cfg.Authorities {
+	for _, peer := range s.authorityPeers() {
 		peer := peer
 		if peer.IdentityPublicKey.Equal(s.s.identityPublicKey) {
 			continue // skip self
@@ -885,7 +1013,7 @@ func (s *state) sendSigToAuthorities(sig []byte, epoch uint64) {
 		Payload:   sig,
 	}
 
-	for _, peer := range s.s.cfg.Authorities {
+	for _, peer := range s.authorityPeers() {
 		peer := peer
 		if peer.IdentityPublicKey.Equal(s.s.identityPublicKey) {
 			continue // skip self
@@ -916,17 +1044,17 @@ func (s *state) sendSigToAuthorities(sig []byte, epoch uint64) {
 	}
 }
 
-func (s *state) tallyVotes(epoch uint64) ([]*pki.MixDescriptor, *config.Parameters, error) {
+func (s *state) tallyVotes(epoch uint64) ([]*pki.MixDescriptor, *config.Parameters, map[[publicKeyHashSize]byte]uint8, error) {
 	if s.TryLock() {
 		panic("write lock not held in tallyVotes(epoch)")
 	}
 
 	_, ok := s.votes[epoch]
 	if !ok {
-		return nil, nil, fmt.Errorf("no votes for epoch %v", epoch)
+		return nil, nil, nil, fmt.Errorf("no votes for epoch %v", epoch)
 	}
 	if len(s.votes[epoch]) < s.threshold {
-		return nil, nil, fmt.Errorf("not enough votes for epoch %v", epoch)
+		return nil, nil, nil, fmt.Errorf("not enough votes for epoch %v", epoch)
 	}
 
 	nodes := make([]*pki.MixDescriptor, 0)
@@ -946,6 +1074,7 @@ func (s *state) tallyVotes(epoch uint64) ([]*pki.MixDescriptor, *config.Paramete
 			LambdaDMaxDelay:   vote.LambdaDMaxDelay,
 			LambdaM:           vote.LambdaM,
 			LambdaMMaxDelay:   vote.LambdaMMaxDelay,
+			MinDeliveryRate:   vote.MinDeliveryRate,
 		}
 		b := bytes.Buffer{}
 		e := gob.NewEncoder(&b)
@@ -997,7 +1126,7 @@ func (s *state) tallyVotes(epoch uint64) ([]*pki.MixDescriptor, *config.Paramete
 			desc := new(pki.MixDescriptor)
 			err := desc.UnmarshalBinary([]byte(rawDesc))
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 			// only add nodes we have authorized
 			if s.isDescriptorAuthorized(desc) {
@@ -1015,16 +1144,20 @@ func (s *state) tallyVotes(epoch uint64) ([]*pki.MixDescriptor, *config.Paramete
 		}
 
 		if len(votes) >= s.threshold {
+			// exclude or down-weight the mixes that fail to deliver
+			// the probe loops of the authorities
+			measurements := s.tallyMeasurements(epoch)
+			nodes = s.excludeUnreliable(nodes, measurements, params.MinDeliveryRate)
 			sortNodesByPublicKey(nodes)
 			// successful tally
-			return nodes, params, nil
+			return nodes, params, weighByDeliveryRate(tallyLoadWeights(nodes, s.votes[epoch]), measurements), nil
 		} else if len(votes) >= s.dissenters {
 			s.log.Errorf("tallyVotes: failed threshold with params: %v", params)
 			continue
 		}
 
 	}
-	return nil, nil, errors.New("consensus failure (mixParams empty)")
+	return nil, nil, nil, errors.New("consensus failure (mixParams empty)")
 }
 
 func (s *state) computeSharedRandom(epoch uint64, commits map[[publicKeyHashSize]byte][]byte, reveals map[[publicKeyHashSize]byte][]byte) ([]byte, error) {
@@ -1234,7 +1367,7 @@ func (s *state) pruneDocuments() {
 	// be added.
 	const preserveForPastEpochs = 3
 
-	now, _, _ := epochtime.Now()
+	now, _, _ := s.clock().Now()
 	cmpEpoch := now - preserveForPastEpochs
 
 	for e := range s.documents {
@@ -1262,6 +1395,11 @@ func (s *state) pruneDocuments() {
 			delete(s.myconsensus, e)
 		}
 	}
+	for e := range s.measurements {
+		if e < cmpEpoch {
+			delete(s.measurements, e)
+		}
+	}
 }
 
 func (s *state) isDescriptorAuthorized(desc *pki.MixDescriptor) bool {
@@ -1625,7 +1763,7 @@ func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoc
 }
 
 func (s *state) documentForEpoch(epoch uint64) ([]byte, error) {
-	var generationDeadline = 7 * (epochtime.Period / 8)
+	var generationDeadline = 7 * (s.clock().Period() / 8)
 
 	s.RLock()
 	defer s.RUnlock()
@@ -1637,7 +1775,7 @@ func (s *state) documentForEpoch(epoch uint64) ([]byte, error) {
 	}
 
 	// Otherwise, return an error based on the time.
-	now, elapsed, _ := epochtime.Now()
+	now, elapsed, _ := s.clock().Now()
 	switch epoch {
 	case now:
 		// We missed the deadline to publish a descriptor for the current
@@ -1685,6 +1823,10 @@ func (s *state) restorePersistence() error {
 		if err != nil {
 			return err
 		}
+		measurementsBkt, err := tx.CreateBucketIfNotExists([]byte(measurementsBucket))
+		if err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
@@ -1693,7 +1835,7 @@ func (s *state) restorePersistence() error {
 			}
 
 			// Figure out which epochs to restore for.
-			now, _, _ := epochtime.Now()
+			now, _, _ := s.clock().Now()
 			epochs := []uint64{now - 1, now, now + 1}
 
 			// Restore the documents and descriptors.
@@ -1714,9 +1856,12 @@ func (s *state) restorePersistence() error {
 					} else {
 						s.log.Debugf("Restored Document for epoch %v: %v.", epoch, doc)
 						s.documents[epoch] = doc
+						s.followAuthorities(doc)
 					}
 				}
 
+				s.restoreMeasurements(measurementsBkt, epoch)
+
 				eDescsBkt := descsBkt.Bucket(epochBytes)
 				if eDescsBkt == nil {
 					s.log.Debugf("No persisted Descriptors for epoch: %v.", epoch)
@@ -1772,19 +1917,12 @@ func newState(s *Server) (*state, error) {
 
 	// set voting schedule at runtime
 
-	st.log.Debugf("State initialized with epoch Period: %s", epochtime.Period)
-	st.log.Debugf("State initialized with MixPublishDeadline: %s", MixPublishDeadline)
-	st.log.Debugf("State initialized with AuthorityVoteDeadline: %s", AuthorityVoteDeadline)
-	st.log.Debugf("State initialized with AuthorityRevealDeadline: %s", AuthorityRevealDeadline)
-	st.log.Debugf("State initialized with PublishConsensusDeadline: %s", PublishConsensusDeadline)
-	st.verifiers = make(map[[publicKeyHashSize]byte]cert.Verifier)
-	for _, auth := range s.cfg.Authorities {
-		st.verifiers[auth.IdentityPublicKey.Sum256()] = auth.IdentityPublicKey
-	}
-	st.verifiers[s.IdentityKey().Sum256()] = cert.Verifier(s.IdentityKey())
-	st.threshold = len(st.verifiers)/2 + 1
-	st.dissenters = len(s.cfg.Authorities)/2 - 1
-
+	period := st.clock().Period()
+	st.log.Debugf("State initialized with epoch Period: %s", period)
+	st.log.Debugf("State initialized with MixPublishDeadline: %s", MixPublishDeadlineForPeriod(period))
+	st.log.Debugf("State initialized with AuthorityVoteDeadline: %s", AuthorityVoteDeadlineForPeriod(period))
+	st.log.Debugf("State initialized with AuthorityRevealDeadline: %s", AuthorityRevealDeadlineForPeriod(period))
+	st.log.Debugf("State initialized with PublishConsensusDeadline: %s", PublishConsensusDeadlineForPeriod(period))
 	// Initialize the authorized peer tables.
 	st.reverseHash = make(map[[publicKeyHashSize]byte]sign.PublicKey)
 	st.authorizedMixes = make(map[[publicKeyHashSize]byte]bool)
@@ -1828,19 +1966,10 @@ func newState(s *Server) (*state, error) {
 		st.authorizedProviders[pk] = v.Identifier
 		st.reverseHash[pk] = identityPublicKey
 	}
-	st.authorizedAuthorities = make(map[[publicKeyHashSize]byte]bool)
-	for _, v := range st.s.cfg.Authorities {
-		pk := v.IdentityPublicKey.Sum256()
-		st.authorizedAuthorities[pk] = true
-		st.reverseHash[pk] = v.IdentityPublicKey
-	}
 	st.reverseHash[st.s.identityPublicKey.Sum256()] = st.s.identityPublicKey
 
-	st.authorityLinkKeys = make(map[[publicKeyHashSize]byte]wire.PublicKey)
-	for _, v := range st.s.cfg.Authorities {
-		pk := v.IdentityPublicKey.Sum256()
-		st.authorityLinkKeys[pk] = v.LinkPublicKey
-	}
+	// The configured authority set is used until a consensus names one.
+	st.setAuthorities(st.proposedAuthorities())
 
 	st.documents = make(map[uint64]*pki.Document)
 	st.myconsensus = make(map[uint64]*pki.Document)
@@ -1850,6 +1979,7 @@ func newState(s *Server) (*state, error) {
 	st.reveals = make(map[uint64]map[[publicKeyHashSize]byte][]byte)
 	st.signatures = make(map[uint64]map[[publicKeyHashSize]byte]*cert.Signature)
 	st.commits = make(map[uint64]map[[publicKeyHashSize]byte][]byte)
+	st.measurements = make(map[uint64]map[[publicKeyHashSize]byte]*pki.MixMeasurement)
 	st.priorSRV = make([][]byte, 0)
 
 	// Initialize the persistence store and restore state.
@@ -1877,11 +2007,12 @@ func (s *state) backgroundFetchConsensus(epoch uint64) {
 	// authorities for a consensus.
 	_, ok := s.documents[epoch]
 	if !ok {
+		peers := s.authorityPeers()
 		go func() {
 			cfg := &client.Config{
 				LinkKey:       s.s.linkKey,
 				LogBackend:    s.s.logBackend,
-				Authorities:   s.s.cfg.Authorities,
+				Authorities:   peers,
 				DialContextFn: nil,
 			}
 			c, err := client.New(cfg)
@@ -1902,6 +2033,7 @@ func (s *state) backgroundFetchConsensus(epoch uint64) {
 			// multiple times during bootstrapping
 			if _, ok := s.documents[epoch]; !ok {
 				s.documents[epoch] = doc
+				s.followAuthorities(doc)
 			}
 		}()
 	}
@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	bolt "go.etcd.io/bbolt"
@@ -38,6 +39,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/wire"
 	sConfig "github.com/katzenpost/katzenpost/server/config"
@@ -356,6 +358,141 @@ func TestVote(t *testing.T) {
 	}
 }
 
+func TestFSMFakeClock(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	period := 2 * time.Minute
+	clock := epochtime.NewFakeClockAtEpoch(100, MixPublishDeadlineForPeriod(period)+time.Second, period)
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err)
+
+	st := &state{
+		s:           &Server{clock: clock, fatalErrCh: make(chan error)},
+		log:         logBackend.GetLogger("state"),
+		state:       stateBootstrap,
+		documents:   map[uint64]*pki.Document{99: new(pki.Document), 100: new(pki.Document)},
+		descriptors: map[uint64]map[[sign.PublicKeyHashSize]byte]*pki.MixDescriptor{90: nil, 100: nil},
+		myconsensus: make(map[uint64]*pki.Document),
+	}
+	fired := func(ch <-chan time.Time) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// too late to vote, so sleep until the next epoch
+	ch := st.fsm().C
+	require.Equal(stateBootstrap, st.state)
+	require.Equal(uint64(102), st.votingEpoch)
+	require.NotContains(st.descriptors, uint64(90))
+	require.Contains(st.descriptors, uint64(100))
+	require.False(fired(ch))
+	clock.AdvanceToEpoch(101, 0)
+	require.True(fired(ch))
+
+	// a failed consensus restarts the bootstrap in the next epoch
+	st.state = stateAcceptSignature
+	ch = st.fsm().C
+	require.Equal(stateBootstrap, st.state)
+	require.Equal(uint64(103), st.votingEpoch)
+	clock.Advance(period - time.Second)
+	require.False(fired(ch))
+	clock.Advance(time.Second)
+	require.True(fired(ch))
+
+	// in time to vote, so wait for the descriptors
+	st.documents[101] = new(pki.Document)
+	st.documents[102] = new(pki.Document)
+	ch = st.fsm().C
+	require.Equal(stateAcceptDescriptor, st.state)
+	require.Equal(uint64(103), st.votingEpoch)
+	clock.Advance(MixPublishDeadlineForPeriod(period) - time.Second)
+	require.False(fired(ch))
+	clock.Advance(time.Second)
+	require.True(fired(ch))
+	require.Zero(clock.Timers())
+}
+
+func TestAuthorityMembership(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	authorities := make([]*config.Authority, 5)
+	for i := range authorities {
+		_, idPubKey := cert.Scheme.NewKeypair()
+		_, linkPubKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+		authorities[i] = &config.Authority{
+			Identifier:        fmt.Sprintf("authority-%d", i),
+			IdentityPublicKey: idPubKey,
+			LinkPublicKey:     linkPubKey,
+			Addresses:         []string{fmt.Sprintf("tcp://127.0.0.1:%d", 30000+i)},
+		}
+	}
+	set := func(members ...int) []*pki.AuthorityDescriptor {
+		s := []*pki.AuthorityDescriptor{}
+		for _, i := range members {
+			s = append(s, authorities[i].Descriptor())
+		}
+		return s
+	}
+	key := func(i int) [publicKeyHashSize]byte {
+		return authorities[i].IdentityPublicKey.Sum256()
+	}
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err)
+
+	st := &state{
+		s: &Server{
+			cfg:               &config.Config{Authorities: authorities[:3]},
+			identityPublicKey: authorities[0].IdentityPublicKey,
+		},
+		log:         logBackend.GetLogger("state"),
+		reverseHash: make(map[[publicKeyHashSize]byte]sign.PublicKey),
+		votes:       make(map[uint64]map[[publicKeyHashSize]byte]*pki.Document),
+	}
+	st.Lock()
+	defer st.Unlock()
+	st.setAuthorities(st.proposedAuthorities())
+	require.Equal(2, st.threshold)
+	require.Len(st.authorityPeers(), 3)
+
+	// adding authority 3 takes a threshold of the votes
+	const epoch = 100
+	st.votes[epoch] = map[[publicKeyHashSize]byte]*pki.Document{
+		key(0): {Authorities: set(3, 2, 1, 0)},
+		key(1): {Authorities: set(0, 1, 2)},
+	}
+	require.Len(st.tallyAuthorities(epoch), 3)
+	st.votes[epoch][key(2)] = &pki.Document{Authorities: set(0, 1, 2, 3)}
+	added := st.tallyAuthorities(epoch)
+	require.Len(added, 4)
+
+	st.followAuthorities(&pki.Document{Epoch: epoch, Authorities: added})
+	require.Equal(3, st.threshold)
+	require.True(st.authorizedAuthorities[key(3)])
+	require.Len(st.authorityPeers(), 4)
+
+	// documents older than the current authority set are ignored
+	st.followAuthorities(&pki.Document{Epoch: epoch - 1, Authorities: set(0, 1)})
+	require.Len(st.authorities, 4)
+
+	// authority 3 rotates its key to authority 4
+	st.followAuthorities(&pki.Document{Epoch: epoch + 1, Authorities: set(0, 1, 2, 4)})
+	require.False(st.authorizedAuthorities[key(3)])
+	require.True(st.authorizedAuthorities[key(4)])
+	require.Equal(authorities[4].LinkPublicKey, st.authorityLinkKeys[key(4)])
+
+	// authority 0 is removed
+	st.followAuthorities(&pki.Document{Epoch: epoch + 2, Authorities: set(1, 2, 4)})
+	require.False(st.authorizedAuthorities[key(0)])
+	require.Len(st.verifiers, 3)
+	require.Equal(2, st.threshold)
+}
+
 type peerKeys struct {
 	linkKey  wire.PrivateKey
 	idKey    sign.PrivateKey
@@ -610,3 +747,214 @@ func init() {
 	runtime.SetMutexProfileFraction(1)
 	runtime.SetBlockProfileRate(1)
 }
+
+func TestTallyLoadWeights(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	nodes := make([]*pki.MixDescriptor, 3)
+	for i := range nodes {
+		_, idPub := cert.Scheme.NewKeypair()
+		nodes[i] = &pki.MixDescriptor{IdentityKey: idPub}
+	}
+	id0 := nodes[0].IdentityKey.Sum256()
+	id1 := nodes[1].IdentityKey.Sum256()
+	id2 := nodes[2].IdentityKey.Sum256()
+
+	votes := make(map[[publicKeyHashSize]byte]*pki.Document)
+	for i, w := range [][]uint8{{10, 50}, {20, 50}, {255, 50}} {
+		var k [publicKeyHashSize]byte
+		k[0] = byte(i)
+		votes[k] = &pki.Document{
+			LoadWeights: map[[publicKeyHashSize]byte]uint8{
+				id0: w[0],
+				id1: w[1],
+			},
+		}
+	}
+
+	// A single authority can not inflate a node's weight.
+	weights := tallyLoadWeights(nodes, votes)
+	require.Equal(uint8(20), weights[id0])
+	require.Equal(uint8(50), weights[id1])
+	_, ok := weights[id2]
+	require.False(ok)
+}
+
+func TestMixMeasurements(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err)
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "persistence.db"), 0600, nil)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(measurementsBucket))
+		return err
+	}))
+
+	st := &state{
+		s: &Server{
+			cfg: &config.Config{
+				Debug:       &config.Debug{Layers: 3, MinNodesPerLayer: 2},
+				Measurement: &config.Measurement{MinProbes: 3},
+			},
+		},
+		log:             logBackend.GetLogger("state"),
+		db:              db,
+		authorizedMixes: make(map[[publicKeyHashSize]byte]bool),
+		votes:           make(map[uint64]map[[publicKeyHashSize]byte]*pki.Document),
+		measurements:    make(map[uint64]map[[publicKeyHashSize]byte]*pki.MixMeasurement),
+		threshold:       2,
+	}
+	nodes := make([]*pki.MixDescriptor, 8)
+	ids := make([][publicKeyHashSize]byte, len(nodes))
+	for i := range nodes {
+		_, idPub := cert.Scheme.NewKeypair()
+		nodes[i] = &pki.MixDescriptor{IdentityKey: idPub, Provider: i == len(nodes)-1}
+		ids[i] = idPub.Sum256()
+		st.authorizedMixes[ids[i]] = !nodes[i].Provider
+	}
+
+	// the vote includes the probe loops of the two previous epochs
+	const epoch = 100
+	st.recordProbe(epoch-3, ids[0], true, time.Second)
+	st.recordProbe(epoch-2, ids[0], true, time.Second)
+	st.recordProbe(epoch-2, ids[0], false, 0)
+	st.recordProbe(epoch-1, ids[0], true, 3*time.Second)
+	st.recordProbe(epoch-1, ids[1], true, time.Second)
+	st.flushMeasurements()
+	mine := st.voteMeasurements(epoch)
+	require.Len(mine, 1)
+	require.Equal(&pki.MixMeasurement{Probes: 3, Delivered: 2, Latency: 2 * time.Second}, mine[ids[0]])
+
+	// the measurements are persisted
+	restored := st.measurements
+	st.measurements = make(map[uint64]map[[publicKeyHashSize]byte]*pki.MixMeasurement)
+	require.NoError(db.View(func(tx *bolt.Tx) error {
+		for e := uint64(epoch - 3); e < epoch; e++ {
+			st.restoreMeasurements(tx.Bucket([]byte(measurementsBucket)), e)
+		}
+		return nil
+	}))
+	require.Equal(restored, st.measurements)
+
+	// the measurements which will not be voted anymore are discarded
+	st.recordProbe(epoch, ids[0], true, time.Second)
+	st.flushMeasurements()
+	require.NoError(db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(measurementsBucket))
+		require.Nil(bkt.Bucket(epochToBytes(epoch - 3)))
+		require.NotNil(bkt.Bucket(epochToBytes(epoch - 2)))
+		return nil
+	}))
+
+	st.Lock()
+	defer st.Unlock()
+
+	// a mix is judged by the median of a threshold of measurements
+	bad := &pki.MixMeasurement{Probes: 10, Delivered: 1, Latency: time.Second}
+	good := &pki.MixMeasurement{Probes: 10, Delivered: 9, Latency: time.Second}
+	st.votes[epoch] = map[[publicKeyHashSize]byte]*pki.Document{
+		{0}: {Measurements: map[[publicKeyHashSize]byte]*pki.MixMeasurement{ids[0]: bad, ids[1]: bad, ids[2]: good}},
+		{1}: {Measurements: map[[publicKeyHashSize]byte]*pki.MixMeasurement{ids[0]: bad, ids[2]: good, ids[7]: bad}},
+		{2}: {Measurements: map[[publicKeyHashSize]byte]*pki.MixMeasurement{ids[0]: good, ids[2]: bad}},
+	}
+	measurements := st.tallyMeasurements(epoch)
+	require.Len(measurements, 2)
+	require.Equal(bad, measurements[ids[0]])
+	require.Equal(good, measurements[ids[2]])
+
+	// and relative to the delivery rate of the network
+	reliable := st.excludeUnreliable(nodes, measurements, 0.5)
+	require.Len(reliable, 7)
+	require.NotContains(reliable, nodes[0])
+	require.Contains(reliable, nodes[7])
+
+	weights := weighByDeliveryRate(map[[publicKeyHashSize]byte]uint8{ids[0]: 5, ids[2]: 100, ids[3]: 100}, measurements)
+	require.Equal(uint8(1), weights[ids[0]])
+	require.Equal(uint8(100), weights[ids[2]])
+	require.Equal(uint8(100), weights[ids[3]])
+
+	// losses shared by all the mixes, such as those of a faulty
+	// Provider, are not blamed on the mixes the probe loops were pinned to
+	lossy := &pki.MixMeasurement{Probes: 10, Delivered: 3, Latency: time.Second}
+	shared := map[[publicKeyHashSize]byte]*pki.MixMeasurement{ids[0]: lossy, ids[1]: lossy, ids[2]: bad}
+	reliable = st.excludeUnreliable(nodes, shared, 0.5)
+	require.Len(reliable, 7)
+	require.Contains(reliable, nodes[0])
+	require.NotContains(reliable, nodes[2])
+	weights = weighByDeliveryRate(map[[publicKeyHashSize]byte]uint8{ids[0]: 100, ids[2]: 100}, shared)
+	require.Equal(uint8(100), weights[ids[0]])
+	require.Equal(uint8(42), weights[ids[2]])
+
+	// unless too few mixes would remain to form a topology
+	measurements[ids[1]] = bad
+	require.Len(st.excludeUnreliable(nodes, measurements, 0.5), 8)
+
+	// the forward path of a probe loop goes through the probed mix
+	doc := &pki.Document{Topology: [][]*pki.MixDescriptor{nodes[0:2], nodes[2:4], nodes[4:6]}}
+	pinned := pinLayer(doc, 1, nodes[3])
+	require.Equal([]*pki.MixDescriptor{nodes[3]}, pinned.Topology[1])
+	require.Equal(nodes[2:4], doc.Topology[1])
+}
+
+func TestProbeExpiry(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err)
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "persistence.db"), 0600, nil)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(measurementsBucket))
+		return err
+	}))
+
+	const epoch = 100
+	clock := epochtime.NewFakeClockAtEpoch(epoch, time.Minute, epochtime.Period)
+	s := &Server{clock: clock}
+	s.state = &state{
+		s:            s,
+		log:          logBackend.GetLogger("state"),
+		db:           db,
+		measurements: make(map[uint64]map[[publicKeyHashSize]byte]*pki.MixMeasurement),
+	}
+	p := &prober{
+		s:      s,
+		log:    logBackend.GetLogger("prober"),
+		probes: make(map[[sConstants.SURBIDLength]byte]*probe),
+	}
+	id := [publicKeyHashSize]byte{1}
+	p.probes[[sConstants.SURBIDLength]byte{1}] = &probe{
+		id:       id,
+		epoch:    epoch,
+		sentAt:   clock.Time(),
+		deadline: clock.Time().Add(time.Minute),
+	}
+
+	// the probe loops are lost once their deadline passes on the clock
+	// of the authority
+	p.expireProbes()
+	require.Len(p.probes, 1)
+	clock.Advance(2 * time.Minute)
+	p.expireProbes()
+	require.Empty(p.probes)
+	require.Equal(&pki.MixMeasurement{Probes: 1}, s.state.measurements[epoch][id])
+
+	// the measurements are persisted when flushed
+	require.NoError(db.View(func(tx *bolt.Tx) error {
+		require.Nil(tx.Bucket([]byte(measurementsBucket)).Bucket(epochToBytes(epoch)))
+		return nil
+	}))
+	s.state.flushMeasurements()
+	require.Nil(s.state.unflushedMeasurements)
+	require.NoError(db.View(func(tx *bolt.Tx) error {
+		require.NotNil(tx.Bucket([]byte(measurementsBucket)).Bucket(epochToBytes(epoch)).Get(id[:]))
+		return nil
+	}))
+}
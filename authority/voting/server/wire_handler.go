@@ -24,7 +24,6 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
@@ -119,6 +118,8 @@ func (s *Server) onClient(rAddr net.Addr, cmd commands.Command) commands.Command
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
 		resp = s.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusDiff:
+		resp = s.onGetConsensusDiff(rAddr, c)
 	default:
 		s.log.Debugf("Peer %v: Invalid request: %T", rAddr, c)
 		return nil
@@ -132,6 +133,8 @@ func (s *Server) onMix(rAddr net.Addr, cmd commands.Command, peerIdentityKeyHash
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
 		resp = s.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusDiff:
+		resp = s.onGetConsensusDiff(rAddr, c)
 	case *commands.PostDescriptor:
 		resp = s.onPostDescriptor(rAddr, c, peerIdentityKeyHash)
 	default:
@@ -146,6 +149,8 @@ func (s *Server) onAuthority(rAddr net.Addr, cmd commands.Command) commands.Comm
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
 		resp = s.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusDiff:
+		resp = s.onGetConsensusDiff(rAddr, c)
 	case *commands.Vote:
 		resp = s.state.onVoteUpload(c)
 	case *commands.Cert:
@@ -180,13 +185,44 @@ func (s *Server) onGetConsensus(rAddr net.Addr, cmd *commands.GetConsensus) comm
 	return resp
 }
 
+func (s *Server) onGetConsensusDiff(rAddr net.Addr, cmd *commands.GetConsensusDiff) commands.Command {
+	resp := &commands.ConsensusDiff{}
+	doc, err := s.state.documentForEpoch(cmd.Epoch)
+	if err != nil {
+		s.log.Errorf("Peer %v: Failed to retrieve document for epoch '%v': %v", rAddr, cmd.Epoch, err)
+		switch err {
+		case errGone:
+			resp.ErrorCode = commands.ConsensusGone
+		default:
+			resp.ErrorCode = commands.ConsensusNotFound
+		}
+		return resp
+	}
+
+	// The document is served in full if there is no document for the
+	// previous epoch, or if it is not the peer's.
+	base, _ := s.state.documentForEpoch(cmd.Epoch - 1)
+	p, err := s.consensusEncoder.Encode(doc, base, cmd.BaseHash, cmd.Compress)
+	if err != nil {
+		s.log.Errorf("Peer %v: Failed to encode document for epoch '%v': %v", rAddr, cmd.Epoch, err)
+		resp.ErrorCode = commands.ConsensusNotFound
+		return resp
+	}
+	s.log.Debugf("Peer: %v: Serving document for epoch %v (diff: %v, compressed: %v).", rAddr, cmd.Epoch, p.IsDiff, p.IsCompressed)
+	resp.ErrorCode = commands.ConsensusOk
+	resp.IsDiff = p.IsDiff
+	resp.IsCompressed = p.IsCompressed
+	resp.Payload = p.Payload
+	return resp
+}
+
 func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor, pubKeyHash []byte) commands.Command {
 	resp := &commands.PostDescriptorStatus{
 		ErrorCode: commands.DescriptorInvalid,
 	}
 
 	// Ensure the epoch is somewhat sane.
-	now, _, _ := epochtime.Now()
+	now, _, _ := s.clock.Now()
 	switch cmd.Epoch {
 	case now - 1, now, now + 1:
 		// Nodes will always publish the descriptor for the current epoch on
@@ -264,15 +300,18 @@ func (a *wireAuthenticator) IsPeerValid(creds *wire.PeerCredentials) bool {
 	pk := [sign.PublicKeyHashSize]byte{}
 	copy(pk[:], creds.AdditionalData[:sign.PublicKeyHashSize])
 
+	// The authority set changes with the consensus.
+	a.s.state.RLock()
 	_, isMix := a.s.state.authorizedMixes[pk]
 	_, isProvider := a.s.state.authorizedProviders[pk]
 	_, isAuthority := a.s.state.authorizedAuthorities[pk]
+	linkKey, ok := a.s.state.authorityLinkKeys[pk]
+	a.s.state.RUnlock()
 
 	if isMix || isProvider {
 		a.isMix = true // Providers and mixes are both mixes. :)
 		return true
 	} else if isAuthority {
-		linkKey, ok := a.s.state.authorityLinkKeys[pk]
 		if !ok {
 			a.s.log.Warning("Rejecting authority authentication, no link key entry.")
 			return false
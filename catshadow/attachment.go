@@ -0,0 +1,685 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// attachment.go - file attachments
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/katzenpost/katzenpost/client"
+	cUtils "github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
+	"github.com/katzenpost/katzenpost/memspool/common"
+)
+
+var (
+	ErrInvalidAttachment    = errors.New("Invalid attachment")
+	ErrAttachmentTooLarge   = errors.New("Attachment is too large")
+	ErrAttachmentNotFound   = errors.New("Attachment not found")
+	ErrAttachmentCorrupted  = errors.New("Attachment failed verification")
+	ErrAttachmentIncomplete = errors.New("Attachment spool is missing chunks")
+	ErrDownloadInProgress   = errors.New("Attachment download already in progress")
+	ErrAttachmentDownloaded = errors.New("Attachment already downloaded")
+)
+
+// attachmentReadWindow is the number of range reads of an attachment
+// spool kept in flight while downloading.
+const attachmentReadWindow = 4
+
+// Attachment is a file sent along with a message.  The file is encrypted
+// with a fresh key and uploaded in chunks to a dedicated remote spool,
+// and the message only carries this description, from which the
+// recipient downloads the file.
+type Attachment struct {
+	// Name is the file name.
+	Name string
+
+	// Size is the size of the file in bytes.
+	Size uint64
+
+	// Hash is the BLAKE2b-256 digest of the file.
+	Hash [32]byte
+
+	// Key is the key the chunks are encrypted with.
+	Key [32]byte
+
+	// ChunkSize is the size of the plaintext chunks.
+	ChunkSize uint32
+
+	// Spool is the remote spool holding the chunks.  Its ReadOffset is
+	// the next spool message to download.
+	Spool *memspoolclient.SpoolReadDescriptor
+
+	// Blob is the name of the file of the attachment store holding the
+	// encrypted chunks downloaded so far, at the offsets given by
+	// chunkOffset.
+	Blob string `cbor:",omitempty"`
+
+	// Received is the number of chunks downloaded so far.
+	Received int `cbor:",omitempty"`
+
+	// Downloaded is set once the file is downloaded and verified.
+	Downloaded bool `cbor:",omitempty"`
+}
+
+// chunkCount returns the number of chunks of the file.
+func (a *Attachment) chunkCount() int {
+	return int((a.Size + uint64(a.ChunkSize) - 1) / uint64(a.ChunkSize))
+}
+
+// chunkOffset returns the offset of the encrypted chunk with the given
+// index in the blob of the attachment.
+func (a *Attachment) chunkOffset(index int) int64 {
+	return int64(index) * int64(a.ChunkSize+secretbox.Overhead)
+}
+
+// sealedChunk returns the encrypted chunk of the file with the given index.
+func (a *Attachment) sealedChunk(data []byte, index int) []byte {
+	start := index * int(a.ChunkSize)
+	end := start + int(a.ChunkSize)
+	if end > len(data) {
+		end = len(data)
+	}
+	return sealChunk(&a.Key, index, data[start:end])
+}
+
+// validate checks the description of a received attachment, and resets
+// the download state with a fresh blob name.
+func (a *Attachment) validate() error {
+	if a.Spool == nil || a.Spool.PrivateKey == nil || a.ChunkSize == 0 || a.Size == 0 {
+		return ErrInvalidAttachment
+	}
+	if a.Size > MaxAttachmentSize {
+		return ErrAttachmentTooLarge
+	}
+	blob := make([]byte, 16)
+	if _, err := rand.Reader.Read(blob); err != nil {
+		return err
+	}
+	a.Spool.ReadOffset = 1
+	a.Blob = hex.EncodeToString(blob)
+	a.Received = 0
+	a.Downloaded = false
+	return nil
+}
+
+// addChunks stores the consecutive messages read from the spool starting
+// with messageID which hold the next chunks, and verifies the file once
+// all the chunks are downloaded.  Messages before the ReadOffset, and
+// those which are not the next chunk, such as the duplicates caused by
+// retransmissions, are skipped.  It returns true once the download is
+// complete.
+func (a *Attachment) addChunks(store *attachmentStore, messageID uint32, messages [][]byte) (bool, error) {
+	for i, ciphertext := range messages {
+		if messageID+uint32(i) < a.Spool.ReadOffset {
+			continue
+		}
+		a.Spool.ReadOffset = messageID + uint32(i) + 1
+		if _, ok := openChunk(&a.Key, a.Received, ciphertext); !ok {
+			continue
+		}
+		if err := store.write(a.Blob, a.chunkOffset(a.Received), ciphertext); err != nil {
+			return true, err
+		}
+		a.Received++
+		if a.Received == a.chunkCount() {
+			break
+		}
+	}
+	if a.Received < a.chunkCount() {
+		return false, nil
+	}
+
+	if _, err := a.open(store); err != nil {
+		// start over if the download is retried
+		a.Spool.ReadOffset = 1
+		a.Received = 0
+		store.remove(a.Blob)
+		return true, err
+	}
+	a.Downloaded = true
+	return true, nil
+}
+
+// open returns the file decrypted from the chunks stored in the blob of
+// the attachment, once verified.
+func (a *Attachment) open(store *attachmentStore) ([]byte, error) {
+	blob, err := store.read(a.Blob)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, a.Size)
+	for i := 0; i < a.chunkCount(); i++ {
+		start := a.chunkOffset(i)
+		end := start + int64(a.ChunkSize+secretbox.Overhead)
+		if end > int64(len(blob)) {
+			end = int64(len(blob))
+		}
+		if start > end {
+			return nil, ErrAttachmentCorrupted
+		}
+		chunk, ok := openChunk(&a.Key, i, blob[start:end])
+		if !ok {
+			return nil, ErrAttachmentCorrupted
+		}
+		data = append(data, chunk...)
+	}
+	if uint64(len(data)) != a.Size || blake2b.Sum256(data) != a.Hash {
+		return nil, ErrAttachmentCorrupted
+	}
+	return data, nil
+}
+
+// attachmentStore keeps the downloaded attachments in a directory next to
+// the statefile, which is rewritten whole on every change.  The chunks
+// are stored as they were read from the spool, encrypted with the key of
+// the attachment, which is only kept in the statefile.
+type attachmentStore struct {
+	dir string
+}
+
+func (s *attachmentStore) path(blob string) string {
+	return filepath.Join(s.dir, blob)
+}
+
+// write writes b at offset in the blob, creating it if needed.
+func (s *attachmentStore) write(blob string, offset int64, b []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path(blob), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(b, offset); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *attachmentStore) read(blob string) ([]byte, error) {
+	return os.ReadFile(s.path(blob))
+}
+
+// remove removes the blob, if any.
+func (s *attachmentStore) remove(blob string) error {
+	if blob == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(blob)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func chunkNonce(index int) *[24]byte {
+	nonce := new([24]byte)
+	binary.BigEndian.PutUint32(nonce[:], uint32(index))
+	return nonce
+}
+
+// sealChunk encrypts the chunk with the given index.  The key is only
+// used for one file, so the index is a unique nonce.
+func sealChunk(key *[32]byte, index int, chunk []byte) []byte {
+	return secretbox.Seal(nil, chunk, chunkNonce(index), key)
+}
+
+func openChunk(key *[32]byte, index int, ciphertext []byte) ([]byte, bool) {
+	return secretbox.Open(nil, ciphertext, chunkNonce(index), key)
+}
+
+// attachmentChunkSize returns the size of the chunks which fit in a spool
+// message once encrypted.
+func attachmentChunkSize(geo *geo.Geometry) int {
+	return common.SpoolPayloadLength(geo) - secretbox.Overhead
+}
+
+// newAttachment returns the description of a file to be uploaded.
+func newAttachment(name string, data []byte, chunkSize int) (*Attachment, error) {
+	if len(data) == 0 || chunkSize <= 0 {
+		return nil, ErrInvalidAttachment
+	}
+	if len(data) > MaxAttachmentSize {
+		return nil, ErrAttachmentTooLarge
+	}
+	a := &Attachment{
+		Name:      name,
+		Size:      uint64(len(data)),
+		Hash:      blake2b.Sum256(data),
+		ChunkSize: uint32(chunkSize),
+	}
+	if _, err := rand.Reader.Read(a.Key[:]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SendAttachment sends a file to the contact with the given nickname.  The
+// file is uploaded in the background, with AttachmentUploadProgressEvents,
+// and the message describing it is then sent like any other message.
+func (c *Client) SendAttachment(nickname, name string, data []byte) (MessageID, error) {
+	if len(data) == 0 {
+		return MessageID{}, ErrInvalidAttachment
+	}
+	if len(data) > MaxAttachmentSize {
+		return MessageID{}, ErrAttachmentTooLarge
+	}
+	convoMesgID := MessageID{}
+	if _, err := rand.Reader.Read(convoMesgID[:]); err != nil {
+		return MessageID{}, err
+	}
+	select {
+	case <-c.HaltCh():
+		return MessageID{}, ErrHalted
+	case c.opCh <- &opSendAttachment{
+		id:       convoMesgID,
+		name:     nickname,
+		filename: name,
+		data:     data,
+	}:
+	}
+	return convoMesgID, nil
+}
+
+func (c *Client) doSendAttachment(convoMesgID MessageID, nickname, filename string, data []byte) {
+	notSent := func(err error) {
+		c.log.Errorf("cannot send attachment to %s: %s", nickname, err)
+		c.eventCh.In() <- &MessageNotSentEvent{
+			Nickname:  nickname,
+			MessageID: convoMesgID,
+			Err:       err,
+		}
+	}
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		notSent(ErrContactNotFound)
+		return
+	}
+	if contact.IsPending {
+		notSent(ErrPendingKeyExchange)
+		return
+	}
+
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+	if !c.online || c.session == nil {
+		notSent(ErrNotOnline)
+		return
+	}
+	desc, err := c.session.GetService(common.SpoolServiceName)
+	if err != nil {
+		notSent(err)
+		return
+	}
+	geo := c.client.GetConfig().SphinxGeometry
+	attachment, err := newAttachment(filename, data, attachmentChunkSize(geo))
+	if err != nil {
+		notSent(err)
+		return
+	}
+	session := c.session
+	go func() {
+		// the upload blocks, so we run it in another thread and then
+		// use another workerOp to send the message
+		if err := c.uploadAttachment(session, geo, desc, nickname, convoMesgID, attachment, data); err != nil {
+			notSent(err)
+			return
+		}
+		select {
+		case <-c.HaltCh():
+		case c.opCh <- &opSendAttachmentMessage{id: convoMesgID, name: nickname, attachment: attachment}:
+		}
+	}()
+}
+
+// uploadAttachment creates the remote spool of the attachment and appends
+// the encrypted chunks of the file to it.
+func (c *Client) uploadAttachment(session *client.Session, geo *geo.Geometry, desc *cUtils.ServiceDescriptor, nickname string, convoMesgID MessageID, attachment *Attachment, data []byte) error {
+	spool, err := memspoolclient.NewSpoolReadDescriptor(desc.Name, desc.Provider, session)
+	if err != nil {
+		return err
+	}
+	attachment.Spool = spool
+	writeDesc, err := spool.NewWriteDescriptor()
+	if err != nil {
+		return err
+	}
+	total := attachment.chunkCount()
+	for i := 0; i < total; i++ {
+		cmd, err := writeDesc.AppendCommand(attachment.sealedChunk(data, i), geo)
+		if err != nil {
+			return err
+		}
+		reply, err := session.BlockingSendReliableMessage(spool.Receiver, spool.Provider, cmd)
+		if err != nil {
+			return err
+		}
+		spoolResponse := &common.SpoolResponse{}
+		if err = spoolResponse.Unmarshal(reply); err != nil {
+			return err
+		}
+		if !spoolResponse.IsOK() {
+			return spoolResponse.StatusAsError()
+		}
+		c.eventCh.In() <- &AttachmentUploadProgressEvent{
+			Nickname:  nickname,
+			MessageID: convoMesgID,
+			Chunks:    i + 1,
+			Total:     total,
+		}
+	}
+	return nil
+}
+
+// doSendAttachmentMessage sends the message describing an uploaded
+// attachment.
+func (c *Client) doSendAttachmentMessage(convoMesgID MessageID, nickname string, attachment *Attachment) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			Nickname:  nickname,
+			MessageID: convoMesgID,
+			Err:       ErrContactNotFound,
+		}
+		return
+	}
+	outMessage := Message{
+		Timestamp:  time.Now(),
+		Outbound:   true,
+		ID:         convoMesgID,
+		Attachment: attachment,
+	}
+	serialized, err := cbor.Marshal(outMessage)
+	if err == nil {
+		err = c.enqueueMessage(contact, &queuedSpoolCommand{ID: convoMesgID}, serialized)
+	}
+	if err != nil {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			Nickname:  nickname,
+			MessageID: convoMesgID,
+			Err:       err,
+		}
+		return
+	}
+
+	c.conversationsMutex.Lock()
+	if _, ok := c.conversations[nickname]; !ok {
+		c.conversations[nickname] = make(map[MessageID]*Message)
+	}
+	c.conversations[nickname][convoMesgID] = &outMessage
+	contact.LastMessage = &outMessage
+	c.conversationsMutex.Unlock()
+	c.save()
+}
+
+// DownloadAttachment starts downloading the attachment of the message
+// with the given ID in the conversation with nickname, or resumes an
+// interrupted download.  The download runs in the background, with
+// AttachmentDownloadProgressEvents, until an AttachmentDownloadedEvent
+// or an AttachmentDownloadFailedEvent.
+func (c *Client) DownloadAttachment(nickname string, id MessageID) error {
+	op := &opDownloadAttachment{
+		name:         nickname,
+		id:           id,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-op.responseChan:
+		return err
+	}
+}
+
+// getAttachment returns the attachment of a message.  The caller must hold
+// conversationsMutex.
+func (c *Client) getAttachment(nickname string, id MessageID) *Attachment {
+	if m, ok := c.conversations[nickname][id]; ok {
+		return m.Attachment
+	}
+	return nil
+}
+
+func (c *Client) doDownloadAttachment(nickname string, id MessageID) error {
+	c.conversationsMutex.Lock()
+	attachment := c.getAttachment(nickname, id)
+	if attachment == nil {
+		c.conversationsMutex.Unlock()
+		return ErrAttachmentNotFound
+	}
+	if attachment.Downloaded {
+		c.conversationsMutex.Unlock()
+		return ErrAttachmentDownloaded
+	}
+	spool := *attachment.Spool
+	c.conversationsMutex.Unlock()
+
+	if c.downloads[id] {
+		return ErrDownloadInProgress
+	}
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+	if !c.online || c.session == nil {
+		return ErrNotOnline
+	}
+	c.downloads[id] = true
+	session := c.session
+	go c.downloadAttachment(session, nickname, id, &spool)
+	return nil
+}
+
+// downloadAttachment reads the messages of the attachment spool with
+// range reads, starting at its ReadOffset, and passes them in order to the
+// worker until it reports the download complete.  Up to
+// attachmentReadWindow reads, at consecutive offsets, are kept in flight,
+// as a reply only holds as many messages as fit in its payload.
+func (c *Client) downloadAttachment(session *client.Session, nickname string, id MessageID, spool *memspoolclient.SpoolReadDescriptor) {
+	readRange := func(offset uint32) <-chan *opAttachmentChunk {
+		ch := make(chan *opAttachmentChunk, 1)
+		go func() {
+			op := &opAttachmentChunk{
+				name:         nickname,
+				id:           id,
+				responseChan: make(chan bool, 1),
+			}
+			cmd, err := common.ReadRangeFromSpool(spool.ID, offset, 0, spool.PrivateKey)
+			if err == nil {
+				var reply []byte
+				reply, err = session.BlockingSendReliableMessage(spool.Receiver, spool.Provider, cmd)
+				if err == nil {
+					spoolResponse := &common.SpoolResponse{}
+					if err = spoolResponse.Unmarshal(reply); err == nil && !spoolResponse.IsOK() {
+						err = spoolResponse.StatusAsError()
+					}
+					op.messageID = spoolResponse.MessageID
+					op.messages = spoolResponse.Messages
+					op.highWaterMark = spoolResponse.HighWaterMark
+				}
+			}
+			op.err = err
+			ch <- op
+		}()
+		return ch
+	}
+
+	reads := []<-chan *opAttachmentChunk{}
+	next, highWaterMark := spool.ReadOffset, ^uint32(0)
+	for {
+		// the spool is complete before the attachment is sent, so
+		// there is nothing to read past its high water mark
+		for len(reads) < attachmentReadWindow && next <= highWaterMark {
+			reads = append(reads, readRange(next))
+			next++
+		}
+		if len(reads) == 0 {
+			return
+		}
+		var op *opAttachmentChunk
+		select {
+		case <-c.HaltCh():
+			return
+		case op = <-reads[0]:
+		}
+		reads = reads[1:]
+		if op.err == nil {
+			highWaterMark = op.highWaterMark
+		}
+		select {
+		case <-c.HaltCh():
+			return
+		case c.opCh <- op:
+		}
+		var done bool
+		select {
+		case <-c.HaltCh():
+			return
+		case done = <-op.responseChan:
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// doAttachmentChunks adds the messages read from the attachment spool,
+// starting with messageID, to the attachment, and returns true if the
+// download is over.
+func (c *Client) doAttachmentChunks(nickname string, id MessageID, messageID uint32, messages [][]byte, highWaterMark uint32, err error) bool {
+	failed := func(err error) bool {
+		delete(c.downloads, id)
+		c.eventCh.In() <- &AttachmentDownloadFailedEvent{
+			Nickname:  nickname,
+			MessageID: id,
+			Err:       err,
+		}
+		return true
+	}
+	if err != nil {
+		c.log.Errorf("Failed to download attachment from %s: %s", nickname, err)
+		return failed(err)
+	}
+
+	c.conversationsMutex.Lock()
+	attachment := c.getAttachment(nickname, id)
+	if attachment == nil {
+		c.conversationsMutex.Unlock()
+		return failed(ErrAttachmentNotFound)
+	}
+	done, err := attachment.addChunks(c.attachments, messageID, messages)
+	if !done && attachment.Spool.ReadOffset > highWaterMark {
+		done, err = true, ErrAttachmentIncomplete
+	}
+	received, total := attachment.Received, attachment.chunkCount()
+	spool := attachment.Spool
+	c.conversationsMutex.Unlock()
+	c.save()
+
+	switch {
+	case err != nil:
+		return failed(err)
+	case done:
+		delete(c.downloads, id)
+		// the recipient of an attachment is the only reader of its spool
+		c.connMutex.RLock()
+		c.purgeSpool(spool)
+		c.connMutex.RUnlock()
+		c.eventCh.In() <- &AttachmentDownloadedEvent{
+			Nickname:  nickname,
+			MessageID: id,
+		}
+	default:
+		c.eventCh.In() <- &AttachmentDownloadProgressEvent{
+			Nickname:  nickname,
+			MessageID: id,
+			Chunks:    received,
+			Total:     total,
+		}
+	}
+	return done
+}
+
+// GetAttachment returns the downloaded file attached to the message with
+// the given ID in the conversation with nickname.
+func (c *Client) GetAttachment(nickname string, id MessageID) ([]byte, error) {
+	op := &opGetAttachment{
+		name:         nickname,
+		id:           id,
+		responseChan: make(chan interface{}, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return nil, ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return nil, ErrHalted
+	case v := <-op.responseChan:
+		switch v := v.(type) {
+		case error:
+			return nil, v
+		case []byte:
+			return v, nil
+		default:
+			return nil, errors.New("Unknown")
+		}
+	}
+}
+
+func (c *Client) doGetAttachment(nickname string, id MessageID) interface{} {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	attachment := c.getAttachment(nickname, id)
+	if attachment == nil || !attachment.Downloaded {
+		return ErrAttachmentNotFound
+	}
+	data, err := attachment.open(c.attachments)
+	if err != nil {
+		return err
+	}
+	return data
+}
+
+// removeAttachment removes the downloaded chunks of the attachment of a
+// message which is deleted.
+func (c *Client) removeAttachment(message *Message) {
+	if message.Attachment == nil {
+		return
+	}
+	if err := c.attachments.remove(message.Attachment.Blob); err != nil {
+		c.log.Errorf("Failed to remove attachment: %s", err)
+	}
+}
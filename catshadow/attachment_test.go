@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// attachment_test.go - file attachment tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+// testAttachment returns a received attachment and the spool messages
+// holding its chunks.
+func testAttachment(t *testing.T, size, chunkSize int) (*Attachment, []byte, [][]byte) {
+	require := require.New(t)
+
+	data := make([]byte, size)
+	_, err := rand.Reader.Read(data)
+	require.NoError(err)
+	a, err := newAttachment("file.bin", data, chunkSize)
+	require.NoError(err)
+	a.Spool = testSpool(t, "provider1")
+	chunks := [][]byte{}
+	for i := 0; i < a.chunkCount(); i++ {
+		chunks = append(chunks, a.sealedChunk(data, i))
+	}
+
+	// the description is sent over the ratchet
+	b, err := cbor.Marshal(&Message{Attachment: a})
+	require.NoError(err)
+	m := new(Message)
+	require.NoError(cbor.Unmarshal(b, m))
+	require.NoError(m.Attachment.validate())
+	return m.Attachment, data, chunks
+}
+
+func TestAttachment(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	store := &attachmentStore{dir: t.TempDir()}
+	a, data, chunks := testAttachment(t, 1000, 300)
+	require.Len(chunks, 4)
+	require.Equal(uint32(1), a.Spool.ReadOffset)
+	require.NotEmpty(a.Blob)
+
+	// duplicates and unrelated messages are skipped, as are the messages
+	// before the ReadOffset returned by overlapping range reads
+	spool := [][]byte{chunks[0], chunks[0], []byte("garbage"), chunks[1], chunks[2], chunks[1], chunks[3]}
+	done, err := a.addChunks(store, 1, spool[0:3])
+	require.NoError(err)
+	require.False(done)
+	require.Equal(1, a.Received)
+	require.Equal(uint32(4), a.Spool.ReadOffset)
+	done, err = a.addChunks(store, 2, spool[1:6])
+	require.NoError(err)
+	require.False(done)
+	require.Equal(3, a.Received)
+	require.Equal(uint32(7), a.Spool.ReadOffset)
+	done, err = a.addChunks(store, 7, spool[6:])
+	require.NoError(err)
+	require.True(done)
+	require.True(a.Downloaded)
+	opened, err := a.open(store)
+	require.NoError(err)
+	require.Equal(data, opened)
+
+	_, err = newAttachment("empty", nil, 300)
+	require.ErrorIs(err, ErrInvalidAttachment)
+	_, err = newAttachment("large", make([]byte, MaxAttachmentSize+1), 300)
+	require.ErrorIs(err, ErrAttachmentTooLarge)
+	require.ErrorIs((&Attachment{Size: 1, ChunkSize: 1}).validate(), ErrInvalidAttachment)
+}
+
+func TestAttachmentCorrupted(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	store := &attachmentStore{dir: t.TempDir()}
+	a, _, chunks := testAttachment(t, 100, 60)
+	a.Hash[0] ^= 1
+	done, err := a.addChunks(store, 1, chunks)
+	require.ErrorIs(err, ErrAttachmentCorrupted)
+	require.True(done)
+	require.False(a.Downloaded)
+	require.Zero(a.Received)
+	require.Equal(uint32(1), a.Spool.ReadOffset)
+	_, err = os.Stat(store.path(a.Blob))
+	require.True(os.IsNotExist(err))
+}
+
+func TestAttachmentDownload(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	a, data, chunks := testAttachment(t, 5000, 200)
+	id := MessageID{1}
+	c.conversations["alice"] = map[MessageID]*Message{id: {Attachment: a}}
+
+	require.ErrorIs(c.doDownloadAttachment("alice", MessageID{2}), ErrAttachmentNotFound)
+	require.ErrorIs(c.doDownloadAttachment("alice", id), ErrNotOnline)
+	_, ok := c.doGetAttachment("alice", id).(error)
+	require.True(ok)
+
+	// the download is resumed from the saved state, which does not hold
+	// the chunks
+	highWaterMark := uint32(len(chunks))
+	require.False(c.doAttachmentChunks("alice", id, 1, chunks[:1], highWaterMark, nil))
+	serialized, err := c.marshal()
+	require.NoError(err)
+	require.Less(serialized.Size(), len(data))
+	state := new(State)
+	require.NoError(cbor.Unmarshal(serialized.Bytes(), &state))
+	c2 := newOfflineTestClient(t, state)
+	c2.attachments = c.attachments
+	a2 := c2.conversations["alice"][id].Attachment
+	require.Equal(1, a2.Received)
+	require.Equal(uint32(2), a2.Spool.ReadOffset)
+
+	require.False(c2.doAttachmentChunks("alice", id, 2, chunks[1:3], highWaterMark, nil))
+	require.True(c2.doAttachmentChunks("alice", id, 4, chunks[3:], highWaterMark, nil))
+	require.Equal(data, c2.doGetAttachment("alice", id))
+	require.ErrorIs(c2.doDownloadAttachment("alice", id), ErrAttachmentDownloaded)
+
+	// network errors end the download, as does a spool missing chunks
+	require.True(c.doAttachmentChunks("alice", id, 0, nil, 0, ErrNotOnline))
+	require.True(c.doAttachmentChunks("bob", id, 1, chunks[1:2], highWaterMark, nil))
+	require.True(c.doAttachmentChunks("alice", id, 2, nil, 1, nil))
+
+	// and the chunks are removed with the conversation
+	require.NoError(c2.doWipeConversation("alice"))
+	_, err = os.Stat(c2.attachments.path(a2.Blob))
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// backup.go - account export and import
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// ExportAccount returns a backup of the account, encrypted with a key
+// derived from passphrase, which can be imported on another device with
+// ImportAccount.  The backup contains the remote spool descriptors, the
+// contacts with their double ratchets, the groups and the blobs, but not
+// the conversation history.
+//
+// The account MUST NOT be used anymore on this device once the backup is
+// imported, as both devices would read the same remote spool and their
+// double ratchets would diverge.
+func (c *Client) ExportAccount(passphrase []byte) ([]byte, error) {
+	exportOp := &opExportAccount{
+		passphrase:   passphrase,
+		responseChan: make(chan interface{}, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return nil, ErrHalted
+	case c.opCh <- exportOp:
+	}
+	select {
+	case <-c.HaltCh():
+		return nil, ErrHalted
+	case v := <-exportOp.responseChan:
+		switch v := v.(type) {
+		case error:
+			return nil, v
+		case []byte:
+			return v, nil
+		default:
+			return nil, errors.New("Unknown")
+		}
+	}
+}
+
+func (c *Client) doExportAccount(passphrase []byte) interface{} {
+	contacts := []*Contact{}
+	for _, contact := range c.contacts {
+		contacts = append(contacts, contact)
+	}
+	groups := []*Group{}
+	for _, group := range c.groups {
+		groups = append(groups, group)
+	}
+	c.blobMutex.Lock()
+	s := &State{
+		SpoolReadDescriptor:  c.primarySpool(),
+		SpoolReadDescriptors: c.spoolReadDescriptors,
+		RetiredSpools:        c.retiredSpools,
+		Contacts:             contacts,
+		Groups:               groups,
+		Providers:            c.providers,
+		Blob:                 c.blob,
+	}
+	em, _ := cbor.EncOptions{Time: cbor.TimeUnixDynamic}.EncMode()
+	plaintext, err := em.Marshal(s)
+	c.blobMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	header, err := newStateHeader(backupMagic, &DefaultKDFParams)
+	if err != nil {
+		return err
+	}
+	backup, err := sealState(header, plaintext, header.deriveKey(passphrase))
+	if err != nil {
+		return err
+	}
+	return backup
+}
+
+// ImportAccount decrypts an account backup made by ExportAccount, and
+// creates the statefile encrypted with passphrase, which must not exist
+// yet.  It returns the State and StateWriter to be passed to New.
+func ImportAccount(log *logging.Logger, stateFile string, passphrase, backup, backupPassphrase []byte) (*StateWriter, *State, error) {
+	if _, err := os.Stat(stateFile); err == nil {
+		return nil, nil, ErrStateFileExists
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	header, ciphertext, err := parseStateHeader(backupMagic, backup)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := decryptState(ciphertext, header.deriveKey(backupPassphrase))
+	if err != nil {
+		return nil, nil, err
+	}
+	state := new(State)
+	if err = cbor.Unmarshal(plaintext, &state); err != nil {
+		return nil, nil, err
+	}
+	state.Conversations = make(map[string]map[MessageID]*Message)
+
+	worker, err := NewStateWriter(log, stateFile, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = worker.writeState(plaintext); err != nil {
+		return nil, nil, err
+	}
+	log.Noticef("Imported account with %d contacts.", len(state.Contacts))
+	return worker, state, nil
+}
@@ -63,6 +63,12 @@ var (
 	ErrNoCurrentDocument      = errors.New("No current document")
 	ErrAlreadyHaveKeyExchange = errors.New("Already created KeyExchange with contact")
 	ErrHalted                 = errors.New("Halted")
+	ErrGroupNotFound          = errors.New("Group not found")
+	ErrInvalidGroupName       = errors.New("Invalid group name")
+	ErrNameInUse              = errors.New("Name is already used by a contact or group")
+	ErrAlreadyGroupMember     = errors.New("Contact is already a group member")
+	ErrNotGroupMember         = errors.New("Contact is not a group member")
+	ErrGroupFull              = errors.New("Group has the maximum number of members")
 	pandaBlobSize             = 1000
 )
 
@@ -86,15 +92,23 @@ type Client struct {
 	// messageID -> *SentMessageDescriptor
 	sendMap *sync.Map
 
-	stateWorker         *StateWriter
-	blob                map[string][]byte
-	contacts            map[uint64]*Contact
-	contactNicknames    map[string]*Contact
-	spoolReadDescriptor *memspoolclient.SpoolReadDescriptor
-	conversations       map[string]map[MessageID]*Message
-	conversationsMutex  *sync.Mutex
-	blobMutex           *sync.Mutex
-	connMutex           *sync.RWMutex
+	stateWorker          *StateWriter
+	attachments          *attachmentStore
+	blob                 map[string][]byte
+	contacts             map[uint64]*Contact
+	contactNicknames     map[string]*Contact
+	groups               map[string]*Group
+	groupIDs             map[GroupID]*Group
+	spoolReadDescriptors []*memspoolclient.SpoolReadDescriptor
+	retiredSpools        []*RetiredSpool
+	readSpoolIndex       int
+	seenCiphertexts      map[[32]byte]struct{}
+	seenOrder            [][32]byte
+	downloads            map[MessageID]bool
+	conversations        map[string]map[MessageID]*Message
+	conversationsMutex   *sync.Mutex
+	blobMutex            *sync.Mutex
+	connMutex            *sync.RWMutex
 
 	online     bool
 	connecting bool
@@ -114,6 +128,15 @@ type queuedSpoolCommand struct {
 	Receiver string
 	Command  []byte
 	ID       MessageID
+	Group    string
+
+	// Ciphertext is the encrypted message, which is appended to
+	// whichever remote spool of the contact is healthy when sending.
+	Ciphertext []byte `cbor:",omitempty"`
+
+	// Control is true for control messages, which are not part of
+	// a conversation.
+	Control bool `cbor:",omitempty"`
 }
 
 // NewClientAndRemoteSpool creates and connects a new Client and creates a new
@@ -159,30 +182,46 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 		state.Blob = make(map[string][]byte)
 	}
 	c := &Client{
-		eventCh:             channels.NewInfiniteChannel(),
-		EventSink:           make(chan interface{}),
-		opCh:                make(chan interface{}, 8),
-		reunionChan:         make(chan rClient.ReunionUpdate),
-		pandaChan:           make(chan panda.PandaUpdate),
-		fatalErrCh:          make(chan error),
-		sendMap:             new(sync.Map),
-		contacts:            make(map[uint64]*Contact),
-		contactNicknames:    make(map[string]*Contact),
-		spoolReadDescriptor: state.SpoolReadDescriptor,
-		conversations:       state.Conversations,
-		blob:                state.Blob,
-		blobMutex:           new(sync.Mutex),
-		conversationsMutex:  new(sync.Mutex),
-		connMutex:           new(sync.RWMutex),
-		stateWorker:         stateWorker,
-		client:              mixnetClient,
-		log:                 logBackend.GetLogger("catshadow"),
-		logBackend:          logBackend,
+		eventCh:              channels.NewInfiniteChannel(),
+		EventSink:            make(chan interface{}),
+		opCh:                 make(chan interface{}, 8),
+		reunionChan:          make(chan rClient.ReunionUpdate),
+		pandaChan:            make(chan panda.PandaUpdate),
+		fatalErrCh:           make(chan error),
+		sendMap:              new(sync.Map),
+		contacts:             make(map[uint64]*Contact),
+		contactNicknames:     make(map[string]*Contact),
+		groups:               make(map[string]*Group),
+		groupIDs:             make(map[GroupID]*Group),
+		spoolReadDescriptors: state.SpoolReadDescriptors,
+		retiredSpools:        state.RetiredSpools,
+		seenCiphertexts:      make(map[[32]byte]struct{}),
+		downloads:            make(map[MessageID]bool),
+		conversations:        state.Conversations,
+		blob:                 state.Blob,
+		blobMutex:            new(sync.Mutex),
+		conversationsMutex:   new(sync.Mutex),
+		connMutex:            new(sync.RWMutex),
+		stateWorker:          stateWorker,
+		attachments:          &attachmentStore{dir: stateWorker.stateFile + ".attachments"},
+		client:               mixnetClient,
+		log:                  logBackend.GetLogger("catshadow"),
+		logBackend:           logBackend,
+	}
+	// statefiles written before the redundant spools only have one spool
+	if len(c.spoolReadDescriptors) == 0 && state.SpoolReadDescriptor != nil {
+		c.spoolReadDescriptors = []*memspoolclient.SpoolReadDescriptor{state.SpoolReadDescriptor}
+	}
+	for _, h := range state.SeenCiphertexts {
+		c.markSeen(h)
 	}
 	for _, contact := range state.Contacts {
 		c.contacts[contact.id] = contact
 		c.contactNicknames[contact.Nickname] = contact
 	}
+	for _, group := range state.Groups {
+		c.addGroup(group)
+	}
 	return c, nil
 }
 
@@ -232,10 +271,14 @@ func (c *Client) initKeyExchange(contact *Contact) error {
 	}
 
 	// somehow we are able to add a contact without having created a spool yet
-	if c.spoolReadDescriptor == nil {
+	if len(c.spoolReadDescriptors) == 0 {
 		return errors.New("Unable to create key exchange without a spool")
 	}
-	exchange, err := NewContactExchangeBytes(c.spoolReadDescriptor.GetWriteDescriptor(), signedKeyExchange)
+	descs, err := c.contactSpoolWriteDescriptors(contact)
+	if err != nil {
+		return err
+	}
+	exchange, err := NewContactExchangeBytes(descs, signedKeyExchange)
 	if err != nil {
 		return err
 	}
@@ -252,7 +295,7 @@ func (c *Client) restartKeyExchanges() {
 	if !c.online {
 		return
 	}
-	if c.spoolReadDescriptor == nil {
+	if len(c.spoolReadDescriptors) == 0 {
 		return
 	}
 	c.restartPANDAExchanges()
@@ -317,40 +360,49 @@ func (c *Client) eventSinkWorker() {
 func (c *Client) garbageCollectConversations() {
 	c.conversationsMutex.Lock()
 	defer c.conversationsMutex.Unlock()
-	for nickname, messages := range c.conversations {
-		contact := c.contactNicknames[nickname]
-		// skip contacts with message expiration disabled
-		if contact.messageExpiration == 0 {
+	for name, messages := range c.conversations {
+		var expiration time.Duration
+		var lastMessage **Message
+		if contact, ok := c.contactNicknames[name]; ok {
+			expiration, lastMessage = contact.messageExpiration, &contact.LastMessage
+		} else if group, ok := c.groups[name]; ok {
+			expiration, lastMessage = group.MessageExpiration, &group.LastMessage
+		} else {
+			continue
+		}
+		// skip conversations with message expiration disabled
+		if expiration == 0 {
 			continue
 		}
 		// Now > message + expiration
 		// Now - expiration > message + expiration - expiration
 		// Now - expiration > message
 		// == expiresAt.After(message.Timestamp):
-		expiresAt := time.Now().Add(-contact.messageExpiration)
+		expiresAt := time.Now().Add(-expiration)
 		var lastLive *Message
-		// maintain a stable contact.LastMessage unless it's expired;
-		// that way we only update contact.LastMessage/lastLive in case
+		// maintain a stable LastMessage unless it's expired;
+		// that way we only update LastMessage/lastLive in case
 		// it was wrong or expired:
-		if contact.LastMessage != nil {
-			if expiresAt.After(contact.LastMessage.Timestamp) {
-				contact.LastMessage = nil
+		if *lastMessage != nil {
+			if expiresAt.After((*lastMessage).Timestamp) {
+				*lastMessage = nil
 			} else {
-				lastLive = contact.LastMessage
+				lastLive = *lastMessage
 			}
 		}
 		for mesgID, message := range messages {
 			if expiresAt.After(message.Timestamp) {
-				if contact.LastMessage == message {
-					contact.LastMessage = lastLive
+				if *lastMessage == message {
+					*lastMessage = lastLive
 				}
+				c.removeAttachment(message)
 				delete(messages, mesgID)
 			} else {
 				// since we aren't iterating in sorted order, we
 				// need to compare before assignment:
 				if lastLive == nil || lastLive.Timestamp.Before(message.Timestamp) {
 					lastLive = message
-					contact.LastMessage = lastLive
+					*lastMessage = lastLive
 				}
 			}
 		}
@@ -441,9 +493,12 @@ func (c *Client) doGetSpoolProviders() interface{} {
 	return providerNames
 }
 
-// CreateRemoteSpoolOn creates a remote spool for collecting messages
-// destined to this Client. This method blocks until the reply from
-// the remote spool service is received or the round trip timeout is reached.
+// CreateRemoteSpoolOn creates a remote spool on the given Provider for
+// collecting messages destined to this Client. A Client may have up to
+// MaxRemoteSpools spools on distinct Providers, the additional ones being
+// used by our contacts when the others are unavailable. This method blocks
+// until the reply from the remote spool service is received or the round
+// trip timeout is reached.
 func (c *Client) CreateRemoteSpoolOn(provider string) error {
 	createSpoolOp := &opCreateSpool{
 		provider:     provider,
@@ -462,9 +517,8 @@ func (c *Client) CreateRemoteSpoolOn(provider string) error {
 	}
 }
 
-// CreateRemoteSpool creates a remote spool for collecting messages
-// destined to this Client. This method blocks until the reply from
-// the remote spool service is received or the round trip timeout is reached.
+// CreateRemoteSpool creates a remote spool on a random Provider for
+// collecting messages destined to this Client. See CreateRemoteSpoolOn.
 func (c *Client) CreateRemoteSpool() error {
 	createSpoolOp := &opCreateSpool{
 		responseChan: make(chan error, 1),
@@ -482,64 +536,6 @@ func (c *Client) CreateRemoteSpool() error {
 	}
 }
 
-func (c *Client) doCreateRemoteSpool(provider string, responseChan chan error) {
-	c.connMutex.RLock()
-	defer c.connMutex.RUnlock()
-
-	if c.spoolReadDescriptor != nil {
-		responseChan <- errors.New("Already have a remote spool")
-		return
-	}
-	if !c.online {
-		responseChan <- ErrNotOnline
-		return
-	}
-	var desc *cUtils.ServiceDescriptor
-	var err error
-	// if no provider is specified, pick a random one
-	if provider == "" {
-		desc, err = c.session.GetService(common.SpoolServiceName)
-		if err != nil {
-			responseChan <- err
-			return
-		}
-	} else {
-		// search for the provider by name
-		descs, err := c.session.GetServices(common.SpoolServiceName)
-		if err != nil {
-			responseChan <- err
-			return
-		}
-		for _, d := range descs {
-			if d.Provider == provider {
-				desc = d
-				break
-			}
-		}
-		if desc == nil {
-			responseChan <- ErrProviderNotFound
-			return
-		}
-	}
-	go func() {
-		// NewSpoolReadDescriptor blocks, so we run this in another thread and then use
-		// another workerOp to save the spool descriptor.
-		spool, err := memspoolclient.NewSpoolReadDescriptor(desc.Name, desc.Provider, c.session)
-		if err != nil {
-			select {
-			case <-c.HaltCh():
-				return
-			case responseChan <- err:
-			}
-		}
-		// pass the original caller responseChan
-		select {
-		case <-c.HaltCh():
-		case c.opCh <- &opUpdateSpool{descriptor: spool, responseChan: responseChan}:
-		}
-	}()
-}
-
 // NewContact adds a new contact to the Client's state. This starts
 // the PANDA protocol instance for this contact where intermediate
 // states will be preserved in the encrypted statefile such that
@@ -579,6 +575,9 @@ func (c *Client) createContact(nickname string, sharedSecret []byte) error {
 	if _, ok := c.contactNicknames[nickname]; ok {
 		return fmt.Errorf("Contact with nickname %s, already exists.", nickname)
 	}
+	if _, ok := c.groups[nickname]; ok {
+		return ErrNameInUse
+	}
 	contact, err := NewContact(nickname, c.randID(), sharedSecret)
 	if err != nil {
 		return err
@@ -701,6 +700,7 @@ func (c *Client) doContactRemoval(nickname string) error {
 	contact.haltKeyExchanges()
 	delete(c.contactNicknames, nickname)
 	delete(c.contacts, contact.id)
+	c.removeGroupMemberships(contact)
 	c.doWipeConversation(nickname) // calls c.save()
 	return nil
 }
@@ -716,7 +716,11 @@ func (c *Client) doContactRename(oldname, newname string) error {
 	if _, ok := c.contactNicknames[newname]; ok {
 		return errors.New("Contact already exists")
 	}
+	if _, ok := c.groups[newname]; ok {
+		return ErrNameInUse
+	}
 	contact.Nickname = newname
+	c.renameGroupMemberships(oldname, newname)
 	c.contactNicknames[newname] = contact
 	if _, ok := c.conversations[oldname]; ok {
 		c.conversations[newname] = c.conversations[oldname]
@@ -734,7 +738,7 @@ func (c *Client) doContactRename(oldname, newname string) error {
 	return nil
 }
 
-// GetExpiration returns the message expiration of a contact.
+// GetExpiration returns the message expiration of a contact or group.
 func (c *Client) GetExpiration(name string) (time.Duration, error) {
 	getExpirationOp := &opGetExpiration{
 		name:         name,
@@ -763,7 +767,12 @@ func (c *Client) GetExpiration(name string) (time.Duration, error) {
 func (c *Client) doGetExpiration(name string, responseChan chan interface{}) {
 	c.conversationsMutex.Lock()
 	defer c.conversationsMutex.Unlock()
-	if contact, ok := c.contactNicknames[name]; !ok {
+	if group, ok := c.groups[name]; ok {
+		select {
+		case <-c.HaltCh():
+		case responseChan <- group.MessageExpiration:
+		}
+	} else if contact, ok := c.contactNicknames[name]; !ok {
 		select {
 		case <-c.HaltCh():
 		case responseChan <- ErrContactNotFound:
@@ -777,7 +786,7 @@ func (c *Client) doGetExpiration(name string, responseChan chan interface{}) {
 	}
 }
 
-// ChangeExpiration changes the message history expiration of a contact.
+// ChangeExpiration changes the message history expiration of a contact or group.
 func (c *Client) ChangeExpiration(name string, expiration time.Duration) error {
 	changeExpirationOp := &opChangeExpiration{
 		name:         name,
@@ -798,7 +807,9 @@ func (c *Client) ChangeExpiration(name string, expiration time.Duration) error {
 
 func (c *Client) doChangeExpiration(name string, expiration time.Duration) error {
 	c.conversationsMutex.Lock()
-	if contact, ok := c.contactNicknames[name]; !ok {
+	if group, ok := c.groups[name]; ok {
+		group.MessageExpiration = expiration
+	} else if contact, ok := c.contactNicknames[name]; !ok {
 		c.conversationsMutex.Unlock()
 		return ErrContactNotFound
 	} else {
@@ -827,13 +838,21 @@ func (c *Client) marshal() (*memguard.LockedBuffer, error) {
 	for _, contact := range c.contacts {
 		contacts = append(contacts, contact)
 	}
+	groups := []*Group{}
+	for _, group := range c.groups {
+		groups = append(groups, group)
+	}
 	c.conversationsMutex.Lock()
 	s := &State{
-		SpoolReadDescriptor: c.spoolReadDescriptor,
-		Contacts:            contacts,
-		Conversations:       c.conversations,
-		Providers:           c.providers,
-		Blob:                c.blob,
+		SpoolReadDescriptor:  c.primarySpool(),
+		SpoolReadDescriptors: c.spoolReadDescriptors,
+		RetiredSpools:        c.retiredSpools,
+		SeenCiphertexts:      c.seenOrder,
+		Contacts:             contacts,
+		Groups:               groups,
+		Conversations:        c.conversations,
+		Providers:            c.providers,
+		Blob:                 c.blob,
 	}
 	defer c.conversationsMutex.Unlock()
 	// XXX: shouldn't we also obtain the ratchet locks as well?
@@ -911,6 +930,7 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		Plaintext: message,
 		Timestamp: time.Now(),
 		Outbound:  true,
+		ID:        convoMesgID,
 	}
 
 	serialized, err := cbor.Marshal(outMessage)
@@ -922,11 +942,7 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		}
 		return
 	}
-	contact.ratchetMutex.Lock()
-	ciphertext, err := contact.ratchet.Encrypt(nil, serialized)
-	if err != nil {
-		c.log.Errorf("failed to encrypt: %s", err)
-		contact.ratchetMutex.Unlock()
+	if err := c.enqueueMessage(contact, &queuedSpoolCommand{ID: convoMesgID}, serialized); err != nil {
 		c.eventCh.In() <- &MessageNotSentEvent{
 			Nickname:  nickname,
 			MessageID: convoMesgID,
@@ -934,24 +950,43 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		}
 		return
 	}
+
+	// update the conversation history
+	c.conversationsMutex.Lock()
+	_, ok = c.conversations[nickname]
+	if !ok {
+		c.conversations[nickname] = make(map[MessageID]*Message)
+	}
+	c.conversations[nickname][convoMesgID] = &outMessage
+	c.contactNicknames[nickname].LastMessage = &outMessage
+	c.conversationsMutex.Unlock()
+	c.save()
+}
+
+// enqueueMessage encrypts a serialized Message for the contact, and queues
+// the command appending it to the contact's remote spool.  The item holds
+// the conversation message ID and the group name of group messages.
+func (c *Client) enqueueMessage(contact *Contact, item *queuedSpoolCommand, serialized []byte) error {
+	contact.ratchetMutex.Lock()
+	ciphertext, err := contact.ratchet.Encrypt(nil, serialized)
 	contact.ratchetMutex.Unlock()
+	if err != nil {
+		c.log.Errorf("failed to encrypt: %s", err)
+		return err
+	}
 
 	cfg := c.client.GetConfig()
-	appendCmd, err := common.AppendToSpool(contact.spoolWriteDescriptor.ID, ciphertext, cfg.SphinxGeometry)
+	appendCmd, err := contact.spoolWriteDescriptor.AppendCommand(ciphertext, cfg.SphinxGeometry)
 	if err != nil {
 		c.log.Errorf("failed to compute spool append command: %s", err)
-		c.eventCh.In() <- &MessageNotSentEvent{
-			Nickname:  nickname,
-			MessageID: convoMesgID,
-			Err:       err,
-		}
-		return
+		return err
 	}
 
 	// enqueue the message for sending
-	item := &queuedSpoolCommand{Receiver: contact.spoolWriteDescriptor.Receiver,
-		Provider: contact.spoolWriteDescriptor.Provider,
-		Command:  appendCmd, ID: convoMesgID}
+	item.Receiver = contact.spoolWriteDescriptor.Receiver
+	item.Provider = contact.spoolWriteDescriptor.Provider
+	item.Command = appendCmd
+	item.Ciphertext = ciphertext
 	if _, err := contact.outbound.Peek(); err == ErrQueueEmpty {
 		// no messages already queued, so call sendMessage immediately
 		c.connMutex.RLock()
@@ -962,24 +997,24 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 	}
 	if err := contact.outbound.Push(item); err != nil {
 		c.log.Debugf("Failed to enqueue message!")
-		c.eventCh.In() <- &MessageNotSentEvent{
-			Nickname:  nickname,
-			MessageID: convoMesgID,
-			Err:       err,
-		}
-		return
+		return err
 	}
+	return nil
+}
 
-	// update the conversation history
-	c.conversationsMutex.Lock()
-	_, ok = c.conversations[nickname]
-	if !ok {
-		c.conversations[nickname] = make(map[MessageID]*Message)
+// sendControlMessage sends a Message which is not part of the conversation
+// to the contact, and for which no events are emitted.
+func (c *Client) sendControlMessage(contact *Contact, m *Message) error {
+	m.Timestamp = time.Now()
+	serialized, err := cbor.Marshal(m)
+	if err != nil {
+		return err
 	}
-	c.conversations[nickname][convoMesgID] = &outMessage
-	c.contactNicknames[nickname].LastMessage = &outMessage
-	c.conversationsMutex.Unlock()
-	c.save()
+	item := &queuedSpoolCommand{Control: true}
+	if _, err = rand.Reader.Read(item.ID[:]); err != nil {
+		return err
+	}
+	return c.enqueueMessage(contact, item, serialized)
 }
 
 func (c *Client) sendMessage(contact *Contact) {
@@ -990,8 +1025,25 @@ func (c *Client) sendMessage(contact *Contact) {
 		return
 	}
 
+	receiver, provider, command := cmd.Receiver, cmd.Provider, cmd.Command
+	if cmd.Ciphertext != nil {
+		// append the ciphertext to a remote spool of the contact whose
+		// Provider is available
+		desc := healthySpool(contact, c.session.CurrentDocument())
+		if desc.Provider != contact.spoolWriteDescriptor.Provider {
+			c.log.Warningf("Failing over to the remote spool of %s on %s", contact.Nickname, desc.Provider)
+		}
+		contact.spoolWriteDescriptor = desc
+		command, err = desc.AppendCommand(cmd.Ciphertext, c.client.GetConfig().SphinxGeometry)
+		if err != nil {
+			c.log.Errorf("failed to compute spool append command: %s", err)
+			return
+		}
+		receiver, provider = desc.Receiver, desc.Provider
+	}
+
 	// XXX: unfortunately this command does not tell us when to expect the message delivery to have occurred even though minclient knows it...
-	mesgID, err := c.session.SendReliableMessage(cmd.Receiver, cmd.Provider, cmd.Command)
+	mesgID, err := c.session.SendReliableMessage(receiver, provider, command)
 	if err != nil {
 		c.log.Errorf("failed to send ciphertext to remote spool: %s", err)
 		return
@@ -1000,22 +1052,28 @@ func (c *Client) sendMessage(contact *Contact) {
 	c.sendMap.Store(*mesgID, &SentMessageDescriptor{
 		Nickname:  contact.Nickname,
 		MessageID: cmd.ID,
+		Group:     cmd.Group,
+		Control:   cmd.Control,
 	})
 }
 
 func (c *Client) sendReadInbox() {
 	// apparently never checks to see if the spool has been made first...
-	if c.spoolReadDescriptor == nil {
+	spools := c.readableSpools()
+	if len(spools) == 0 {
 		c.log.Errorf("Should not sendReadInbox before the remote spool was made...")
 		return
 	}
-	sequence := c.spoolReadDescriptor.ReadOffset
-	cmd, err := common.ReadFromSpool(c.spoolReadDescriptor.ID, sequence, c.spoolReadDescriptor.PrivateKey)
+	// read our spools in turn
+	spool := spools[c.readSpoolIndex%len(spools)]
+	c.readSpoolIndex = (c.readSpoolIndex + 1) % len(spools)
+	sequence := spool.ReadOffset
+	cmd, err := common.ReadFromSpool(spool.ID, sequence, spool.PrivateKey)
 	if err != nil {
 		c.fatalErrCh <- errors.New("failed to compose spool read command")
 		return
 	}
-	mesgID, err := c.session.SendUnreliableMessage(c.spoolReadDescriptor.Receiver, c.spoolReadDescriptor.Provider, cmd)
+	mesgID, err := c.session.SendUnreliableMessage(spool.Receiver, spool.Provider, cmd)
 	switch err.(type) {
 	case *minclient.PKIError:
 		c.session.ForceFetchPKI()
@@ -1025,10 +1083,10 @@ func (c *Client) sendReadInbox() {
 		c.log.Errorf("sendReadInbox failure: %v", err)
 		return
 	}
-	c.log.Debug("Message enqueued for reading remote spool %x:%d, message-ID: %x", c.spoolReadDescriptor.ID, sequence, mesgID)
+	c.log.Debug("Message enqueued for reading remote spool %x:%d, message-ID: %x", spool.ID, sequence, mesgID)
 	var a MessageID
 	binary.BigEndian.PutUint32(a[:4], sequence)
-	c.sendMap.Store(*mesgID, &ReadMessageDescriptor{MessageID: a})
+	c.sendMap.Store(*mesgID, &ReadMessageDescriptor{MessageID: a, SpoolID: spool.ID})
 }
 
 func (c *Client) garbageCollectSendMap(gcEvent *client.MessageIDGarbageCollected) {
@@ -1055,10 +1113,9 @@ func (c *Client) handleSent(sentEvent *client.MessageSentEvent) {
 			} else {
 				if sentEvent.Err != nil {
 					c.log.Debugf("message send for %s failed with err: %s", tp.Nickname, sentEvent.Err)
-					c.eventCh.In() <- &MessageNotSentEvent{
-						Nickname:  tp.Nickname,
-						MessageID: tp.MessageID,
-						Err:       sentEvent.Err,
+					c.emitSentMessageEvent(tp, tp.notSentEvent(sentEvent.Err))
+					if c.spoolFailed(contact) {
+						c.sendMessage(contact)
 					}
 					return
 				}
@@ -1067,11 +1124,8 @@ func (c *Client) handleSent(sentEvent *client.MessageSentEvent) {
 			}
 
 			c.log.Debugf("MessageSentEvent for %x", *sentEvent.MessageID)
-			c.setMessageSent(tp.Nickname, tp.MessageID)
-			c.eventCh.In() <- &MessageSentEvent{
-				Nickname:  tp.Nickname,
-				MessageID: tp.MessageID,
-			}
+			c.setMessageSent(tp.conversation(), tp.MessageID)
+			c.emitSentMessageEvent(tp, tp.sentEvent())
 		default:
 			c.fatalErrCh <- errors.New("BUG, sendMap entry has incorrect type")
 		}
@@ -1088,9 +1142,8 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 			err := cbor.Unmarshal(replyEvent.Payload, &spoolResponse)
 			if err != nil {
 				c.log.Errorf("Could not deserialize SpoolResponse to message ID %d: %s", tp.MessageID, err)
-				c.eventCh.In() <- &MessageNotDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID,
-					Err: fmt.Errorf("Invalid spool response: %s", err),
-				}
+				c.emitSentMessageEvent(tp, tp.notDeliveredEvent(fmt.Errorf("Invalid spool response: %s", err)))
+				c.retryOnNextSpool(tp.Nickname, replyEvent.MessageID)
 				return
 			}
 
@@ -1098,9 +1151,8 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 				c.log.Errorf("Spool response ID %d status error: %s for SpoolID %x",
 					spoolResponse.MessageID, spoolResponse.Status, spoolResponse.SpoolID)
 
-				c.eventCh.In() <- &MessageNotDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID,
-					Err: spoolResponse.StatusAsError(),
-				}
+				c.emitSentMessageEvent(tp, tp.notDeliveredEvent(spoolResponse.StatusAsError()))
+				c.retryOnNextSpool(tp.Nickname, replyEvent.MessageID)
 				return
 			}
 			c.log.Debugf("MessageDeliveredEvent for %s MessageID %x", tp.Nickname, *replyEvent.MessageID)
@@ -1119,10 +1171,19 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 					// try to send the next message, if one exists
 					defer c.sendMessage(contact)
 				}
+				contact.spoolFailures = 0
+				if tp.Control {
+					c.save()
+					return
+				}
 				c.log.Debugf("Sending MessageDeliveredEvent for %s", tp.Nickname)
-				c.setMessageDelivered(tp.Nickname, tp.MessageID)
+				if tp.Group != "" {
+					c.setGroupMessageDelivered(tp.Group, tp.Nickname, tp.MessageID)
+				} else {
+					c.setMessageDelivered(tp.Nickname, tp.MessageID)
+				}
 				c.save()
-				c.eventCh.In() <- &MessageDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID}
+				c.eventCh.In() <- tp.deliveredEvent()
 				return
 			}
 		case *ReadMessageDescriptor:
@@ -1140,11 +1201,23 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 
 				return
 			}
+			spool := c.findSpool(tp.SpoolID)
+			if spool == nil {
+				// the spool was retired and purged meanwhile
+				return
+			}
 			// is a valid response to the tip of our spool, so increment the pointer
 			switch {
-			case spoolResponse.MessageID < c.spoolReadDescriptor.ReadOffset:
+			case spoolResponse.MessageID < spool.ReadOffset:
 				return // dup
-			case spoolResponse.MessageID == c.spoolReadDescriptor.ReadOffset:
+			case spoolResponse.MessageID == spool.ReadOffset:
+				if c.seenCiphertext(spoolResponse.Message) {
+					// the message was also written to another of our spools
+					c.log.Debugf("Dropping duplicate message - MessageID: %x", *replyEvent.MessageID)
+					spool.IncrementOffset()
+					c.save()
+					return
+				}
 				c.log.Debugf("Calling decryptMessage(%x, xx)", *replyEvent.MessageID)
 				err := c.decryptMessage(replyEvent.MessageID, spoolResponse.Message)
 				switch err {
@@ -1166,12 +1239,13 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 				case nil:
 					// message was decrypted successfully
 					c.log.Debugf("successfully decrypted tip of spool - MessageID: %x", *replyEvent.MessageID)
+					c.markCiphertextSeen(spoolResponse.Message)
 				default:
 					// received an error, likely due to retransmission
 					c.log.Debugf("failure to decrypt tip of spool - MessageID: %x, err: %s", *replyEvent.MessageID, err.Error())
 				}
 				// in all other cases, advance the spool read descriptor
-				c.spoolReadDescriptor.IncrementOffset()
+				spool.IncrementOffset()
 				c.save()
 			default:
 				panic("received spool response for MessageID not requested yet")
@@ -1212,6 +1286,7 @@ func (c *Client) doWipeConversation(nickname string) error {
 	}
 
 	for k, m := range c.conversations[nickname] {
+		c.removeAttachment(m)
 		utils.ExplicitBzero(m.Plaintext)
 		m.Timestamp = time.Time{}
 		m.Outbound = false
@@ -1224,10 +1299,15 @@ func (c *Client) doWipeConversation(nickname string) error {
 	if contact, ok := c.contactNicknames[nickname]; ok {
 		contact.LastMessage = nil
 	}
+	if group, ok := c.groups[nickname]; ok {
+		group.LastMessage = nil
+	}
 	return nil
 }
 
 // GetSortedConversation returns Messages (a slice of *Message, sorted by Timestamp)
+// of the conversation with a contact or group.  The messages of a group are
+// sorted by sequence number first.
 func (c *Client) GetSortedConversation(nickname string) Messages {
 	getConversationOp := opGetConversation{
 		name:         nickname,
@@ -1293,6 +1373,18 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 
 			}
 			message.Outbound = false
+			message.Sent = false
+			message.Delivered = false
+			message.Acknowledged = false
+			message.Read = false
+			message.Sender = ""
+			message.Recipients = nil
+			if message.Attachment != nil {
+				if err := message.Attachment.validate(); err != nil {
+					c.log.Warningf("Dropping invalid attachment from %s: %s", nickname, err)
+					message.Attachment = nil
+				}
+			}
 			break
 		default:
 			// every other type of error indicates an invalid message
@@ -1300,6 +1392,26 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 			return err
 		}
 	}
+	if decrypted && message.Receipts != nil {
+		c.log.Debugf("Receipts decrypted for %s", nickname)
+		c.handleReceipts(nickname, message.Receipts)
+		return nil
+	}
+	if decrypted && message.SpoolWriteDescriptors != nil {
+		c.log.Debugf("Spool update decrypted for %s", nickname)
+		c.updateContactSpools(nickname, message.SpoolWriteDescriptors)
+		return nil
+	}
+	if decrypted && message.Group != nil && message.GroupMembers != nil {
+		c.log.Debugf("Group members decrypted for %s", nickname)
+		c.receiveGroupMembers(nickname, &message)
+		return nil
+	}
+	if decrypted && message.Group != nil {
+		c.log.Debugf("Group message decrypted for %s", nickname)
+		c.receiveGroupMessage(nickname, &message)
+		return nil
+	}
 	if decrypted {
 		convoMesgID := MessageID{}
 		_, err = rand.Reader.Read(convoMesgID[:])
@@ -1317,11 +1429,23 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 		c.contactNicknames[nickname].LastMessage = &message
 		c.conversationsMutex.Unlock()
 		c.save()
-
+		c.acknowledge(nickname, &message)
+
+		if message.Attachment != nil {
+			c.eventCh.In() <- &AttachmentReceivedEvent{
+				Nickname:  nickname,
+				MessageID: convoMesgID,
+				Name:      message.Attachment.Name,
+				Size:      message.Attachment.Size,
+				Timestamp: message.Timestamp,
+			}
+			return nil
+		}
 		c.eventCh.In() <- &MessageReceivedEvent{
 			Nickname:  nickname,
 			Message:   message.Plaintext,
 			Timestamp: message.Timestamp,
+			MessageID: convoMesgID,
 		}
 		return nil
 	}
@@ -1391,13 +1515,14 @@ func (c *Client) GetBlob(id string) ([]byte, error) {
 	return b, nil
 }
 
-// Online() brings catshadow online or returns an error
-func (c *Client) Online(ctx context.Context) error {
+// Online() brings catshadow online or returns an error, creating the
+// session with the given options.
+func (c *Client) Online(ctx context.Context, opts ...client.SessionOption) error {
 	// XXX: block until connection or error ?
 	r := make(chan error, 1)
 	select {
 	case <-c.HaltCh():
-	case c.opCh <- &opOnline{context: ctx, responseChan: r}:
+	case c.opCh <- &opOnline{context: ctx, options: opts, responseChan: r}:
 	}
 	select {
 	case <-c.HaltCh():
@@ -1408,7 +1533,7 @@ func (c *Client) Online(ctx context.Context) error {
 }
 
 // goOnline is called by worker routine when a goOnline is received. currently only a single session is supported.
-func (c *Client) goOnline(ctx context.Context) error {
+func (c *Client) goOnline(ctx context.Context, opts []client.SessionOption) error {
 	c.connMutex.RLock()
 	if c.online || c.connecting || c.session != nil {
 		c.connMutex.RUnlock()
@@ -1422,7 +1547,7 @@ func (c *Client) goOnline(ctx context.Context) error {
 	c.connMutex.Unlock()
 
 	// try to connect
-	s, err := c.client.NewTOFUSession(ctx)
+	s, err := c.client.NewTOFUSession(ctx, opts...)
 
 	// re-obtain lock
 	c.connMutex.Lock()
@@ -1462,10 +1587,10 @@ func (c *Client) SpoolWriteDescriptor() *memspoolclient.SpoolWriteDescriptor {
 }
 
 func (c *Client) getSpoolWriteDescriptor() *memspoolclient.SpoolWriteDescriptor {
-	if c.spoolReadDescriptor == nil {
+	if spool := c.primarySpool(); spool == nil {
 		return nil
 	} else {
-		return c.spoolReadDescriptor.GetWriteDescriptor()
+		return spool.GetWriteDescriptor()
 	}
 }
 
@@ -43,9 +43,10 @@ func getClientState(c *Client) *State {
 		contacts = append(contacts, contact)
 	}
 	return &State{
-		SpoolReadDescriptor: c.spoolReadDescriptor,
-		Contacts:            contacts,
-		Conversations:       c.conversations,
+		SpoolReadDescriptor:  c.primarySpool(),
+		SpoolReadDescriptors: c.spoolReadDescriptors,
+		Contacts:             contacts,
+		Conversations:        c.conversations,
 	}
 }
 
@@ -83,8 +84,7 @@ func reloadCatshadowState(t *testing.T, stateFile string) *Client {
 	var catShadowClient *Client
 
 	passphrase := []byte("")
-	key := stretchKey(passphrase)
-	state, err := decryptStateFile(stateFile, key)
+	state, err := decryptStateFile(stateFile, passphrase)
 	require.NoError(err)
 
 	logBackend, err := log.New(cfg.Logging.File, cfg.Logging.Level, cfg.Logging.Disable)
@@ -873,3 +873,331 @@ func init() {
 	runtime.SetMutexProfileFraction(1)
 	runtime.SetBlockProfileRate(1)
 }
+
+func TestDockerGroupConversation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	aliceStateFilePath := createRandomStateFile(t)
+	alice := createCatshadowClientWithState(t, aliceStateFilePath)
+	bob := createCatshadowClientWithState(t, createRandomStateFile(t))
+	carol := createCatshadowClientWithState(t, createRandomStateFile(t))
+
+	s1 := [8]byte{}
+	_, err := rand.Reader.Read(s1[:])
+	require.NoError(err)
+	s2 := [8]byte{}
+	_, err = rand.Reader.Read(s2[:])
+	require.NoError(err)
+	s3 := [8]byte{}
+	_, err = rand.Reader.Read(s3[:])
+	require.NoError(err)
+
+	alice.NewContact("bob", s1[:])
+	bob.NewContact("alice", s1[:])
+	alice.NewContact("carol", s2[:])
+	carol.NewContact("alice", s2[:])
+	bob.NewContact("carol", s3[:])
+	carol.NewContact("bob", s3[:])
+
+	// wait for key exchanges to complete
+	for _, c := range []*Client{alice, alice, bob, bob, carol, carol} {
+	kxLoop:
+		for {
+			ev := <-c.EventSink
+			switch event := ev.(type) {
+			case *KeyExchangeCompletedEvent:
+				require.Nil(event.Err)
+				break kxLoop
+			default:
+			}
+		}
+	}
+
+	require.NoError(alice.NewGroup("team"))
+	require.NoError(alice.AddGroupMember("team", "bob"))
+	require.NoError(alice.AddGroupMember("team", "carol"))
+	alice.SendGroupMessage("team", []byte("hello team"))
+
+	// the message is delivered to the spool of every member
+	delivered := make(map[string]bool)
+	for len(delivered) != 2 {
+		ev := <-alice.EventSink
+		switch event := ev.(type) {
+		case *GroupMessageDeliveredEvent:
+			require.Equal("team", event.Group)
+			delivered[event.Nickname] = true
+		case *GroupMessageNotSentEvent:
+			require.NoError(event.Err)
+		default:
+		}
+	}
+
+	// the members create the group upon receiving the invitation, with
+	// every member as a member
+	for _, c := range []*Client{bob, carol} {
+	receiveLoop:
+		for {
+			ev := <-c.EventSink
+			switch event := ev.(type) {
+			case *GroupMessageReceivedEvent:
+				require.Equal("team", event.Group)
+				require.Equal("alice", event.Nickname)
+				require.Equal([]byte("hello team"), event.Message)
+				break receiveLoop
+			default:
+			}
+		}
+	}
+	require.ElementsMatch([]string{"alice", "carol"}, bob.GetGroups()["team"].Members)
+	require.ElementsMatch([]string{"alice", "bob"}, carol.GetGroups()["team"].Members)
+
+	// replies reach every member, and are ordered after the message they
+	// reply to
+	bob.SendGroupMessage("team", []byte("hello alice"))
+	for _, c := range []*Client{alice, carol} {
+	replyLoop:
+		for {
+			ev := <-c.EventSink
+			switch event := ev.(type) {
+			case *GroupMessageReceivedEvent:
+				require.Equal("team", event.Group)
+				require.Equal("bob", event.Nickname)
+				break replyLoop
+			default:
+			}
+		}
+	}
+	require.Len(carol.GetSortedConversation("team"), 2)
+	messages := alice.GetSortedConversation("team")
+	require.Len(messages, 2)
+	require.Equal([]byte("hello team"), messages[0].Plaintext)
+	require.True(messages[0].Delivered)
+	require.Equal([]byte("hello alice"), messages[1].Plaintext)
+	require.Equal("bob", messages[1].Sender)
+
+	// groups survive restarts
+	alice.Shutdown()
+	newAlice := reloadCatshadowState(t, aliceStateFilePath)
+	require.Equal([]string{"bob", "carol"}, newAlice.GetGroups()["team"].Members)
+	require.Len(newAlice.GetSortedConversation("team"), 2)
+
+	newAlice.Shutdown()
+	bob.Shutdown()
+	carol.Shutdown()
+}
+
+func TestDockerSpoolMigration(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	alice := createCatshadowClientWithState(t, createRandomStateFile(t))
+	bob := createCatshadowClientWithState(t, createRandomStateFile(t))
+
+	providers, err := alice.GetSpoolProviders()
+	require.NoError(err)
+	if len(providers) < 2 {
+		t.Skip("spool migration needs two spool providers")
+	}
+
+	sharedSecret := [8]byte{}
+	_, err = rand.Reader.Read(sharedSecret[:])
+	require.NoError(err)
+	alice.NewContact("bob", sharedSecret[:])
+	bob.NewContact("alice", sharedSecret[:])
+	for _, c := range []*Client{alice, bob} {
+	kxLoop:
+		for {
+			ev := <-c.EventSink
+			switch event := ev.(type) {
+			case *KeyExchangeCompletedEvent:
+				require.Nil(event.Err)
+				break kxLoop
+			default:
+			}
+		}
+	}
+
+	oldProvider := alice.SpoolWriteDescriptor().Provider
+	newProvider := providers[0]
+	if newProvider == oldProvider {
+		newProvider = providers[1]
+	}
+	require.NoError(alice.MigrateSpool(oldProvider, newProvider))
+	descs := alice.SpoolWriteDescriptors()
+	require.Len(descs, 1)
+	require.Equal(newProvider, descs[0].Provider)
+
+	// bob learns about the new spool over the ratchet
+updateLoop:
+	for {
+		ev := <-bob.EventSink
+		switch event := ev.(type) {
+		case *ContactSpoolsUpdatedEvent:
+			require.Equal("alice", event.Nickname)
+			break updateLoop
+		default:
+		}
+	}
+
+	bob.SendMessage("alice", []byte("hello on the new spool"))
+receiveLoop:
+	for {
+		ev := <-alice.EventSink
+		switch event := ev.(type) {
+		case *MessageReceivedEvent:
+			require.Equal("bob", event.Nickname)
+			require.Equal([]byte("hello on the new spool"), event.Message)
+			break receiveLoop
+		default:
+		}
+	}
+
+	alice.Shutdown()
+	bob.Shutdown()
+}
+
+func TestDockerAttachment(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	alice := createCatshadowClientWithState(t, createRandomStateFile(t))
+	bob := createCatshadowClientWithState(t, createRandomStateFile(t))
+
+	sharedSecret := [8]byte{}
+	_, err := rand.Reader.Read(sharedSecret[:])
+	require.NoError(err)
+	alice.NewContact("bob", sharedSecret[:])
+	bob.NewContact("alice", sharedSecret[:])
+	for _, c := range []*Client{alice, bob} {
+	kxLoop:
+		for {
+			ev := <-c.EventSink
+			switch event := ev.(type) {
+			case *KeyExchangeCompletedEvent:
+				require.Nil(event.Err)
+				break kxLoop
+			default:
+			}
+		}
+	}
+
+	data := make([]byte, 10000)
+	_, err = rand.Reader.Read(data)
+	require.NoError(err)
+	_, err = alice.SendAttachment("bob", "file.bin", data)
+	require.NoError(err)
+
+	var id MessageID
+receiveLoop:
+	for {
+		ev := <-bob.EventSink
+		switch event := ev.(type) {
+		case *AttachmentReceivedEvent:
+			require.Equal("alice", event.Nickname)
+			require.Equal("file.bin", event.Name)
+			require.Equal(uint64(len(data)), event.Size)
+			id = event.MessageID
+			break receiveLoop
+		default:
+		}
+	}
+
+	require.NoError(bob.DownloadAttachment("alice", id))
+downloadLoop:
+	for {
+		ev := <-bob.EventSink
+		switch event := ev.(type) {
+		case *AttachmentDownloadedEvent:
+			require.Equal(id, event.MessageID)
+			break downloadLoop
+		case *AttachmentDownloadFailedEvent:
+			require.NoError(event.Err)
+		default:
+		}
+	}
+	received, err := bob.GetAttachment("alice", id)
+	require.NoError(err)
+	require.Equal(data, received)
+
+	alice.Shutdown()
+	bob.Shutdown()
+}
+
+func TestDockerReadReceipts(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	alice := createCatshadowClientWithState(t, createRandomStateFile(t))
+	bob := createCatshadowClientWithState(t, createRandomStateFile(t))
+
+	sharedSecret := [8]byte{}
+	_, err := rand.Reader.Read(sharedSecret[:])
+	require.NoError(err)
+	alice.NewContact("bob", sharedSecret[:])
+	bob.NewContact("alice", sharedSecret[:])
+	for _, c := range []*Client{alice, bob} {
+	kxLoop:
+		for {
+			ev := <-c.EventSink
+			switch event := ev.(type) {
+			case *KeyExchangeCompletedEvent:
+				require.Nil(event.Err)
+				break kxLoop
+			default:
+			}
+		}
+	}
+	require.NoError(bob.SetReadReceipts("alice", true))
+
+	sentID := alice.SendMessage("bob", []byte("hello bob"))
+	var receivedID MessageID
+receiveLoop:
+	for {
+		ev := <-bob.EventSink
+		switch event := ev.(type) {
+		case *MessageReceivedEvent:
+			require.Equal([]byte("hello bob"), event.Message)
+			receivedID = event.MessageID
+			break receiveLoop
+		default:
+		}
+	}
+	require.NoError(bob.MarkRead("alice", receivedID))
+
+	// bob acknowledges the message, and then reads it
+	for _, expected := range []string{"ack", "read"} {
+	receiptLoop:
+		for {
+			ev := <-alice.EventSink
+			switch event := ev.(type) {
+			case *MessageAcknowledgedEvent:
+				require.Equal("ack", expected)
+				require.Equal(sentID, event.MessageID)
+				break receiptLoop
+			case *MessageReadEvent:
+				require.Equal("read", expected)
+				require.Equal(sentID, event.MessageID)
+				break receiptLoop
+			default:
+			}
+		}
+	}
+
+	require.NoError(alice.DeleteMessage("bob", sentID, true))
+	require.Empty(alice.GetSortedConversation("bob"))
+deleteLoop:
+	for {
+		ev := <-bob.EventSink
+		switch event := ev.(type) {
+		case *MessageDeletedEvent:
+			require.Equal(receivedID, event.MessageID)
+			break deleteLoop
+		default:
+		}
+	}
+	require.Empty(bob.GetSortedConversation("alice"))
+
+	alice.Shutdown()
+	bob.Shutdown()
+}
@@ -30,6 +30,31 @@ const (
 	// to reference individual messages of a conversation.
 	MessageIDLen = 4
 
+	// MaxRemoteSpools is the maximum number of remote spools of a Client,
+	// and that we accept from a contact.
+	MaxRemoteSpools = 4
+
+	// SpoolRetirementDuration is the duration during which a remote spool
+	// replaced by MigrateSpool is still read, while our contacts learn
+	// about its replacement.
+	SpoolRetirementDuration = MessageExpirationDuration
+
+	// MaxSeenCiphertexts is the number of hashes of received ciphertexts
+	// kept to detect the duplicates written to several of our spools.
+	MaxSeenCiphertexts = 1024
+
+	// MaxAttachmentSize is the maximum size in bytes of the files sent
+	// with SendAttachment.
+	MaxAttachmentSize = 1 << 20
+
+	// GroupIDLen is the length of the group IDs which are shared by the
+	// members of a group conversation.
+	GroupIDLen = 16
+
+	// MaxGroupMembers is the maximum number of members of a group, such
+	// that its member list fits in a message.
+	MaxGroupMembers = 16
+
 	// GarbageCollectionInterval is the time interval between garbage collecting
 	// old messages.
 	GarbageCollectionInterval = 120 * time.Minute
@@ -23,22 +23,33 @@ import (
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
-	ratchet "github.com/katzenpost/katzenpost/doubleratchet"
 	cConstants "github.com/katzenpost/katzenpost/client/constants"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	ratchet "github.com/katzenpost/katzenpost/doubleratchet"
 	memspoolClient "github.com/katzenpost/katzenpost/memspool/client"
+	"github.com/katzenpost/katzenpost/memspool/common"
 )
 
 type contactExchange struct {
 	SpoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
 	KeyExchange          []byte
+
+	// BackupSpoolWriteDescriptors describe our redundant remote spools,
+	// in addition to SpoolWriteDescriptor.
+	BackupSpoolWriteDescriptors []*memspoolClient.SpoolWriteDescriptor `cbor:",omitempty"`
 }
 
-// NewContactExchangeBytes returns serialized contact exchange information.
-func NewContactExchangeBytes(spoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor, keyExchange []byte) ([]byte, error) {
+// NewContactExchangeBytes returns serialized contact exchange information,
+// given the write descriptors of all our remote spools, the first one
+// being the preferred one.
+func NewContactExchangeBytes(spoolWriteDescriptors []*memspoolClient.SpoolWriteDescriptor, keyExchange []byte) ([]byte, error) {
+	if len(spoolWriteDescriptors) == 0 {
+		return nil, ErrNoSpool
+	}
 	exchange := contactExchange{
-		SpoolWriteDescriptor: spoolWriteDescriptor,
-		KeyExchange:          keyExchange,
+		SpoolWriteDescriptor:        spoolWriteDescriptors[0],
+		KeyExchange:                 keyExchange,
+		BackupSpoolWriteDescriptors: spoolWriteDescriptors[1:],
 	}
 	return cbor.Marshal(exchange)
 }
@@ -48,9 +59,23 @@ func parseContactExchangeBytes(contactExchangeBytes []byte) (*contactExchange, e
 	if err := cbor.Unmarshal(contactExchangeBytes, &exchange); err != nil {
 		return nil, err
 	}
+	if exchange.SpoolWriteDescriptor == nil {
+		return nil, ErrNoSpool
+	}
 	return exchange, nil
 }
 
+// spoolWriteDescriptors returns the write descriptors of all the remote
+// spools in the exchange.
+func (e *contactExchange) spoolWriteDescriptors() []*memspoolClient.SpoolWriteDescriptor {
+	descs := []*memspoolClient.SpoolWriteDescriptor{e.SpoolWriteDescriptor}
+	descs = append(descs, e.BackupSpoolWriteDescriptors...)
+	if len(descs) > MaxRemoteSpools {
+		descs = descs[:MaxRemoteSpools]
+	}
+	return descs
+}
+
 type serializedContact struct {
 	ID                   uint64
 	Nickname             string
@@ -65,6 +90,12 @@ type serializedContact struct {
 	SharedSecret         []byte
 	SpoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
 	MessageExpiration    time.Duration
+
+	SpoolWriteDescriptors []*memspoolClient.SpoolWriteDescriptor
+	ReadReceipts          bool
+
+	WriteCapabilities map[[common.SpoolIDSize]byte]*common.WriteCapability `cbor:",omitempty"`
+	WriteRevoked      bool                                                 `cbor:",omitempty"`
 }
 
 type boundExchange struct {
@@ -119,6 +150,26 @@ type Contact struct {
 	// which we must write to in order to send this contact a message.
 	spoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
 
+	// spoolWriteDescriptors describe all the remote spools of this
+	// contact, any of which can be used if spoolWriteDescriptor fails.
+	spoolWriteDescriptors []*memspoolClient.SpoolWriteDescriptor
+
+	// writeCapabilities are the write capabilities to our remote spools
+	// which we gave this contact, by spool ID.
+	writeCapabilities map[[common.SpoolIDSize]byte]*common.WriteCapability
+
+	// writeRevoked is true if the contact's write capabilities to our
+	// remote spools were revoked.
+	writeRevoked bool
+
+	// spoolFailures is the number of consecutive failures to write to
+	// the contact's remote spools.
+	spoolFailures int
+
+	// readReceipts is true if we send delivery acknowledgements and
+	// read receipts to this contact.
+	readReceipts bool
+
 	// sharedSecret is the passphrase used to add the contact.
 	sharedSecret []byte
 
@@ -159,6 +210,12 @@ func (c *Contact) ID() uint64 {
 	return c.id
 }
 
+// ReadReceipts returns true if we send delivery acknowledgements and read
+// receipts to this contact.
+func (c *Contact) ReadReceipts() bool {
+	return c.readReceipts
+}
+
 // MarshalBinary does what you expect and returns
 // a serialized Contact.
 func (c *Contact) MarshalBinary() ([]byte, error) {
@@ -183,6 +240,12 @@ func (c *Contact) MarshalBinary() ([]byte, error) {
 		SpoolWriteDescriptor: c.spoolWriteDescriptor,
 		Outbound:             c.outbound,
 		MessageExpiration:    c.messageExpiration,
+
+		SpoolWriteDescriptors: c.spoolWriteDescriptors,
+		ReadReceipts:          c.readReceipts,
+
+		WriteCapabilities: c.writeCapabilities,
+		WriteRevoked:      c.writeRevoked,
 	}
 	return cbor.Marshal(s)
 }
@@ -213,8 +276,15 @@ func (c *Contact) UnmarshalBinary(data []byte) error {
 	c.ratchet = r
 	c.sharedSecret = s.SharedSecret
 	c.spoolWriteDescriptor = s.SpoolWriteDescriptor
+	c.spoolWriteDescriptors = s.SpoolWriteDescriptors
+	if len(c.spoolWriteDescriptors) == 0 && c.spoolWriteDescriptor != nil {
+		c.spoolWriteDescriptors = []*memspoolClient.SpoolWriteDescriptor{c.spoolWriteDescriptor}
+	}
 	c.outbound = s.Outbound
 	c.messageExpiration = s.MessageExpiration
+	c.readReceipts = s.ReadReceipts
+	c.writeCapabilities = s.WriteCapabilities
+	c.writeRevoked = s.WriteRevoked
 	if c.IsPending {
 		c.pandaShutdownChan = make(chan interface{})
 		c.reunionShutdownChan = make(chan struct{})
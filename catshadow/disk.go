@@ -19,10 +19,13 @@
 package catshadow
 
 import (
+	"crypto/hmac"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/awnumar/memguard"
 	"github.com/fxamacker/cbor/v2"
@@ -38,20 +41,151 @@ import (
 const (
 	keySize   = 32
 	nonceSize = 24
+	saltSize  = 32
+	magicSize = 8
+
+	// headerSize is the size of the serialized stateHeader.
+	headerSize = magicSize + 2 + 4 + 4 + 1 + saltSize
+
+	// StateFileVersion is the version of the state file and account
+	// backup format written by this package.  Version 0 is the legacy
+	// state file, without a header.
+	StateFileVersion = 1
+
+	// maxKDFMemory and maxKDFTime bound the KDF parameters read from
+	// a file, in KiB and iterations.
+	maxKDFMemory = 4 * 1024 * 1024
+	maxKDFTime   = 64
 )
 
 var (
-	DecryptStateFailed = errors.New("failed to decrypted statefile")
+	DecryptStateFailed    = errors.New("failed to decrypted statefile")
+	ErrInvalidStateFile   = errors.New("invalid statefile header")
+	ErrUnsupportedVersion = errors.New("unsupported statefile version")
+	ErrInvalidKDFParams   = errors.New("invalid KDF parameters")
+	ErrWrongPassphrase    = errors.New("wrong passphrase")
+	ErrStateFileExists    = errors.New("statefile already exists")
+
+	stateFileMagic = [magicSize]byte{'c', 'a', 't', 's', 't', 'a', 't', 'e'}
+	backupMagic    = [magicSize]byte{'c', 'a', 't', 'b', 'a', 'c', 'k', 'p'}
+
+	// legacyKDFParams are the argon2i parameters of the version 0 state
+	// file, which used no salt.
+	legacyKDFParams = KDFParams{Time: 3, Memory: 32 * 1024, Threads: 4}
 )
 
+// KDFParams are the argon2id parameters used to derive the encryption
+// key of the state file from the passphrase.
+type KDFParams struct {
+	// Time is the number of iterations.
+	Time uint32
+	// Memory is the memory usage in KiB.
+	Memory uint32
+	// Threads is the degree of parallelism.
+	Threads uint8
+}
+
+// DefaultKDFParams are the KDF parameters used for new state files and
+// account backups.
+var DefaultKDFParams = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+func (p *KDFParams) validate() error {
+	if p.Time == 0 || p.Time > maxKDFTime || p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory || p.Threads == 0 {
+		return ErrInvalidKDFParams
+	}
+	return nil
+}
+
 // State is the struct type representing the Client's state
 // which is encrypted and persisted to disk.
 type State struct {
+	// SpoolReadDescriptor is our preferred remote spool, kept for the
+	// older versions which had only one.
 	SpoolReadDescriptor *client.SpoolReadDescriptor
 	Contacts            []*Contact
+	Groups              []*Group
 	Providers           []*pki.MixDescriptor
 	Conversations       map[string]map[MessageID]*Message
 	Blob                map[string][]byte
+
+	// SpoolReadDescriptors are all our remote spools, the first one being
+	// the preferred one.
+	SpoolReadDescriptors []*client.SpoolReadDescriptor `cbor:",omitempty"`
+
+	// RetiredSpools are the spools replaced by MigrateSpool.
+	RetiredSpools []*RetiredSpool `cbor:",omitempty"`
+
+	// SeenCiphertexts are the hashes of the last received ciphertexts.
+	SeenCiphertexts [][32]byte `cbor:",omitempty"`
+}
+
+// stateHeader prefixes the ciphertext of the state file and of account
+// backups, and contains everything needed to derive the key from the
+// passphrase.  It is not authenticated, but any modification results
+// in a different key.
+type stateHeader struct {
+	Magic   [magicSize]byte
+	Version uint16
+	KDF     KDFParams
+	Salt    [saltSize]byte
+}
+
+func newStateHeader(magic [magicSize]byte, params *KDFParams) (*stateHeader, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	h := &stateHeader{
+		Magic:   magic,
+		Version: StateFileVersion,
+		KDF:     *params,
+	}
+	if _, err := rand.Reader.Read(h.Salt[:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *stateHeader) Bytes() []byte {
+	b := make([]byte, headerSize)
+	copy(b, h.Magic[:])
+	binary.BigEndian.PutUint16(b[magicSize:], h.Version)
+	binary.BigEndian.PutUint32(b[magicSize+2:], h.KDF.Time)
+	binary.BigEndian.PutUint32(b[magicSize+6:], h.KDF.Memory)
+	b[magicSize+10] = h.KDF.Threads
+	copy(b[magicSize+11:], h.Salt[:])
+	return b
+}
+
+// parseStateHeader parses the header of b, which must start with magic,
+// and returns the header and the ciphertext following it.
+func parseStateHeader(magic [magicSize]byte, b []byte) (*stateHeader, []byte, error) {
+	if len(b) < headerSize || !hmac.Equal(b[:magicSize], magic[:]) {
+		return nil, nil, ErrInvalidStateFile
+	}
+	h := &stateHeader{
+		Magic:   magic,
+		Version: binary.BigEndian.Uint16(b[magicSize:]),
+	}
+	if h.Version != StateFileVersion {
+		return nil, nil, ErrUnsupportedVersion
+	}
+	h.KDF.Time = binary.BigEndian.Uint32(b[magicSize+2:])
+	h.KDF.Memory = binary.BigEndian.Uint32(b[magicSize+6:])
+	h.KDF.Threads = b[magicSize+10]
+	if err := h.KDF.validate(); err != nil {
+		return nil, nil, err
+	}
+	copy(h.Salt[:], b[magicSize+11:headerSize])
+	return h, b[headerSize:], nil
+}
+
+// deriveKey derives the key from the passphrase with the salt and KDF
+// parameters of the header.
+func (h *stateHeader) deriveKey(passphrase []byte) *[keySize]byte {
+	secret := argon2.IDKey(passphrase, h.Salt[:], h.KDF.Time, h.KDF.Memory, h.KDF.Threads, keySize)
+	key := [keySize]byte{}
+	copy(key[:], secret)
+	return &key
 }
 
 // StateWriter takes ownership of the Client's encrypted statefile
@@ -64,6 +198,9 @@ type StateWriter struct {
 	stateCh   chan *memguard.LockedBuffer
 	stateFile string
 
+	// keyLock protects header and key, which change with the passphrase.
+	keyLock sync.Mutex
+	header  *stateHeader
 	// TODO: memguard.LockedBuffer
 	key *[32]byte
 }
@@ -80,6 +217,9 @@ func encryptState(state []byte, key *[32]byte) ([]byte, error) {
 }
 
 func decryptState(ciphertext []byte, key *[32]byte) ([]byte, error) {
+	if len(ciphertext) < nonceSize {
+		return nil, DecryptStateFailed
+	}
 	nonce := [nonceSize]byte{}
 	copy(nonce[:], ciphertext[:nonceSize])
 	ciphertext = ciphertext[nonceSize:]
@@ -90,19 +230,55 @@ func decryptState(ciphertext []byte, key *[32]byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// stretchKey derives the key of a version 0 state file.
 func stretchKey(passphrase []byte) *[32]byte {
-	secret := argon2.Key(passphrase, nil, 3, 32*1024, 4, keySize)
+	secret := argon2.Key(passphrase, nil, legacyKDFParams.Time, legacyKDFParams.Memory, legacyKDFParams.Threads, keySize)
 	key := [keySize]byte{}
 	copy(key[:], secret)
 	return &key
 }
 
-func decryptStateFile(stateFile string, key *[32]byte) (*State, error) {
-	rawFile, err := os.ReadFile(stateFile)
+// sealState encrypts the plaintext with a key derived from the
+// passphrase, and prefixes the header.
+func sealState(header *stateHeader, plaintext []byte, key *[32]byte) ([]byte, error) {
+	ciphertext, err := encryptState(plaintext, key)
 	if err != nil {
 		return nil, err
 	}
-	plaintext, err := decryptState(rawFile, key)
+	return append(header.Bytes(), ciphertext...), nil
+}
+
+// readStateFile decrypts the state file, and returns the plaintext along
+// with the header and key.  The returned header is nil if the state file
+// is in the legacy format.
+func readStateFile(stateFile string, passphrase []byte) ([]byte, *stateHeader, *[32]byte, error) {
+	rawFile, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header, ciphertext, err := parseStateHeader(stateFileMagic, rawFile)
+	switch err {
+	case nil:
+		key := header.deriveKey(passphrase)
+		plaintext, err := decryptState(ciphertext, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return plaintext, header, key, nil
+	case ErrInvalidStateFile:
+		key := stretchKey(passphrase)
+		plaintext, err := decryptState(rawFile, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return plaintext, nil, key, nil
+	default:
+		return nil, nil, nil, err
+	}
+}
+
+func decryptStateFile(stateFile string, passphrase []byte) (*State, error) {
+	plaintext, _, _, err := readStateFile(stateFile, passphrase)
 	if err != nil {
 		return nil, err
 	}
@@ -113,11 +289,11 @@ func decryptStateFile(stateFile string, key *[32]byte) (*State, error) {
 	return state, nil
 }
 
-func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
+func encryptStateFile(stateFile string, header *stateHeader, state []byte, key *[32]byte) error {
 	outFn := stateFile
 	tmpFn := fmt.Sprintf("%s.tmp", stateFile)
 	backupFn := fmt.Sprintf("%s~", stateFile)
-	ciphertext, err := encryptState(state, key)
+	ciphertext, err := sealState(header, state, key)
 	if err != nil {
 		return err
 	}
@@ -154,18 +330,33 @@ func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
 }
 
 // LoadStateWriter decrypts the given stateFile and returns the State
-// as well as a new StateWriter.
+// as well as a new StateWriter.  A legacy stateFile is rewritten in the
+// current format.
 func LoadStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, *State, error) {
 	worker := &StateWriter{
 		log:       log,
 		stateCh:   make(chan *memguard.LockedBuffer),
 		stateFile: stateFile,
 	}
-	key := stretchKey(passphrase)
-	state, err := decryptStateFile(stateFile, key)
+	plaintext, header, key, err := readStateFile(stateFile, passphrase)
 	if err != nil {
 		return nil, nil, err
 	}
+	state := new(State)
+	if err = cbor.Unmarshal(plaintext, &state); err != nil {
+		return nil, nil, err
+	}
+	if header == nil {
+		log.Noticef("Migrating statefile to version %d.", StateFileVersion)
+		if header, err = newStateHeader(stateFileMagic, &DefaultKDFParams); err != nil {
+			return nil, nil, err
+		}
+		key = header.deriveKey(passphrase)
+		if err = encryptStateFile(stateFile, header, plaintext, key); err != nil {
+			return nil, nil, err
+		}
+	}
+	worker.header = header
 	worker.key = key
 	return worker, state, nil
 }
@@ -173,16 +364,60 @@ func LoadStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (
 // NewStateWriter is a constructor for StateWriter which is to be used when creating
 // the statefile for the first time.
 func NewStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, error) {
-	key := stretchKey(passphrase)
+	header, err := newStateHeader(stateFileMagic, &DefaultKDFParams)
+	if err != nil {
+		return nil, err
+	}
 	worker := &StateWriter{
 		log:       log,
 		stateCh:   make(chan *memguard.LockedBuffer),
 		stateFile: stateFile,
-		key:       key,
+		header:    header,
+		key:       header.deriveKey(passphrase),
 	}
 	return worker, nil
 }
 
+// ChangePassphrase re-encrypts the statefile with a key derived from
+// newPassphrase, with a new salt and the provided KDF parameters, or the
+// current KDF parameters if params is nil.  The backup of the previous
+// statefile, which is encrypted with the old passphrase, is removed.
+func (w *StateWriter) ChangePassphrase(oldPassphrase, newPassphrase []byte, params *KDFParams) error {
+	w.keyLock.Lock()
+	defer w.keyLock.Unlock()
+
+	if !hmac.Equal(w.header.deriveKey(oldPassphrase)[:], w.key[:]) {
+		return ErrWrongPassphrase
+	}
+	if params == nil {
+		params = &w.header.KDF
+	}
+	header, err := newStateHeader(stateFileMagic, params)
+	if err != nil {
+		return err
+	}
+	key := header.deriveKey(newPassphrase)
+
+	plaintext, _, _, err := readStateFile(w.stateFile, oldPassphrase)
+	switch {
+	case err == nil:
+		if err = encryptStateFile(w.stateFile, header, plaintext, key); err != nil {
+			return err
+		}
+		if err = os.Remove(fmt.Sprintf("%s~", w.stateFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	case os.IsNotExist(err):
+		// nothing was written yet
+	default:
+		return err
+	}
+	w.header = header
+	w.key = key
+	w.log.Notice("Statefile passphrase changed.")
+	return nil
+}
+
 // Start starts the StateWriter's worker goroutine.
 func (w *StateWriter) Start() {
 	w.log.Debug("StateWriter starting worker")
@@ -190,7 +425,9 @@ func (w *StateWriter) Start() {
 }
 
 func (w *StateWriter) writeState(payload []byte) error {
-	return encryptStateFile(w.stateFile, payload, w.key)
+	w.keyLock.Lock()
+	defer w.keyLock.Unlock()
+	return encryptStateFile(w.stateFile, w.header, payload, w.key)
 }
 
 func (w *StateWriter) worker() {
@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// disk_test.go - statefile and account backup tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+func testLogger(t *testing.T) *logging.Logger {
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(t, err)
+	return logBackend.GetLogger("catshadow_state")
+}
+
+func testState(t *testing.T) []byte {
+	state := &State{
+		Blob: map[string][]byte{"foo": []byte("bar")},
+	}
+	serialized, err := cbor.Marshal(state)
+	require.NoError(t, err)
+	return serialized
+}
+
+func TestStateFile(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	stateFile := createRandomStateFile(t)
+	w, err := NewStateWriter(testLogger(t), stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.NoError(w.writeState(testState(t)))
+
+	raw, err := os.ReadFile(stateFile)
+	require.NoError(err)
+	require.Equal(stateFileMagic[:], raw[:magicSize])
+	require.Equal(uint16(StateFileVersion), binary.BigEndian.Uint16(raw[magicSize:]))
+
+	_, state, err := LoadStateWriter(testLogger(t), stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), state.Blob["foo"])
+
+	_, _, err = LoadStateWriter(testLogger(t), stateFile, []byte("wrong"))
+	require.ErrorIs(err, DecryptStateFailed)
+
+	// Another statefile with the same passphrase uses a different salt.
+	w2, err := NewStateWriter(testLogger(t), createRandomStateFile(t), []byte("passphrase"))
+	require.NoError(err)
+	require.NotEqual(w.header.Salt, w2.header.Salt)
+	require.NotEqual(w.key, w2.key)
+}
+
+func TestStateFileMigration(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	stateFile := createRandomStateFile(t)
+	ciphertext, err := encryptState(testState(t), stretchKey([]byte("passphrase")))
+	require.NoError(err)
+	require.NoError(os.WriteFile(stateFile, ciphertext, 0600))
+
+	w, state, err := LoadStateWriter(testLogger(t), stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), state.Blob["foo"])
+	require.Equal(DefaultKDFParams, w.header.KDF)
+
+	raw, err := os.ReadFile(stateFile)
+	require.NoError(err)
+	_, _, err = parseStateHeader(stateFileMagic, raw)
+	require.NoError(err)
+	_, state, err = LoadStateWriter(testLogger(t), stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), state.Blob["foo"])
+}
+
+func TestStateFileHeader(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	header, err := newStateHeader(stateFileMagic, &DefaultKDFParams)
+	require.NoError(err)
+	b := header.Bytes()
+	require.Len(b, headerSize)
+	parsed, rest, err := parseStateHeader(stateFileMagic, append(b, 1, 2, 3))
+	require.NoError(err)
+	require.Equal(header, parsed)
+	require.Equal([]byte{1, 2, 3}, rest)
+
+	_, _, err = parseStateHeader(backupMagic, b)
+	require.ErrorIs(err, ErrInvalidStateFile)
+	_, _, err = parseStateHeader(stateFileMagic, b[:headerSize-1])
+	require.ErrorIs(err, ErrInvalidStateFile)
+
+	header.Version = StateFileVersion + 1
+	_, _, err = parseStateHeader(stateFileMagic, header.Bytes())
+	require.ErrorIs(err, ErrUnsupportedVersion)
+
+	header.Version = StateFileVersion
+	header.KDF.Memory = maxKDFMemory + 1
+	_, _, err = parseStateHeader(stateFileMagic, header.Bytes())
+	require.ErrorIs(err, ErrInvalidKDFParams)
+
+	_, err = newStateHeader(stateFileMagic, &KDFParams{Time: 1, Memory: 1024, Threads: 0})
+	require.ErrorIs(err, ErrInvalidKDFParams)
+}
+
+func TestChangePassphrase(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	stateFile := createRandomStateFile(t)
+	w, err := NewStateWriter(testLogger(t), stateFile, []byte("old"))
+	require.NoError(err)
+
+	// Changing the passphrase before the first write only changes the key.
+	require.NoError(w.ChangePassphrase([]byte("old"), []byte("older"), nil))
+	require.NoError(w.writeState(testState(t)))
+	require.NoError(w.writeState(testState(t)))
+	_, err = os.Stat(fmt.Sprintf("%s~", stateFile))
+	require.NoError(err)
+
+	require.ErrorIs(w.ChangePassphrase([]byte("old"), []byte("new"), nil), ErrWrongPassphrase)
+	require.ErrorIs(w.ChangePassphrase([]byte("older"), []byte("new"), &KDFParams{}), ErrInvalidKDFParams)
+
+	params := &KDFParams{Time: 1, Memory: 16 * 1024, Threads: 1}
+	require.NoError(w.ChangePassphrase([]byte("older"), []byte("new"), params))
+	_, err = os.Stat(fmt.Sprintf("%s~", stateFile))
+	require.True(os.IsNotExist(err))
+
+	_, _, err = LoadStateWriter(testLogger(t), stateFile, []byte("older"))
+	require.ErrorIs(err, DecryptStateFailed)
+	w2, state, err := LoadStateWriter(testLogger(t), stateFile, []byte("new"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), state.Blob["foo"])
+	require.Equal(*params, w2.header.KDF)
+
+	// Later writes use the new passphrase.
+	require.NoError(w.writeState(testState(t)))
+	_, _, err = LoadStateWriter(testLogger(t), stateFile, []byte("new"))
+	require.NoError(err)
+}
+
+func TestExportImportAccount(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	require.NoError(c.doNewGroup("team"))
+	require.NoError(c.doAddGroupMember("team", "alice"))
+	c.blob["foo"] = []byte("bar")
+	c.conversations["alice"] = map[MessageID]*Message{{1}: {Plaintext: []byte("hello")}}
+
+	v := c.doExportAccount([]byte("backup"))
+	backup, ok := v.([]byte)
+	require.True(ok, "doExportAccount() returned %v", v)
+	require.Equal(backupMagic[:], backup[:magicSize])
+
+	stateFile := createRandomStateFile(t)
+	_, _, err := ImportAccount(testLogger(t), stateFile, []byte("passphrase"), backup, []byte("wrong"))
+	require.ErrorIs(err, DecryptStateFailed)
+	_, _, err = ImportAccount(testLogger(t), stateFile, []byte("passphrase"), backup[:headerSize], []byte("backup"))
+	require.ErrorIs(err, DecryptStateFailed)
+
+	_, state, err := ImportAccount(testLogger(t), stateFile, []byte("passphrase"), backup, []byte("backup"))
+	require.NoError(err)
+	require.Len(state.Contacts, 1)
+	require.Equal("alice", state.Contacts[0].Nickname)
+	require.Equal(c.contactNicknames["alice"].ID(), state.Contacts[0].ID())
+	require.Len(state.Groups, 1)
+	require.Equal([]string{"alice"}, state.Groups[0].Members)
+	require.Equal([]byte("bar"), state.Blob["foo"])
+	require.Empty(state.Conversations)
+
+	_, _, err = ImportAccount(testLogger(t), stateFile, []byte("passphrase"), backup, []byte("backup"))
+	require.ErrorIs(err, ErrStateFileExists)
+
+	_, state, err = LoadStateWriter(testLogger(t), stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Len(state.Contacts, 1)
+	c2 := newOfflineTestClient(t, state)
+	require.Contains(c2.contactNicknames, "alice")
+	require.Contains(c2.groups, "team")
+}
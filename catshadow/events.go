@@ -86,4 +86,214 @@ type MessageReceivedEvent struct {
 	Message []byte
 	// Timestamp is the time the message was received.
 	Timestamp time.Time
+	// MessageID is the key in the conversation map referencing the message.
+	MessageID MessageID
+}
+
+// MessageAcknowledgedEvent is the event signaling that the contact's
+// client received a message.
+type MessageAcknowledgedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// MessageReadEvent is the event signaling that the contact read a message.
+type MessageReadEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// MessageDeletedEvent is the event signaling that the contact deleted one
+// of its messages for everyone, and that it was removed from the
+// conversation.
+type MessageDeletedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// GroupCreatedEvent is the event signaling that a group was created
+// upon receiving an invitation to it from a contact.
+type GroupCreatedEvent struct {
+	// Group is the name of the new group.
+	Group string
+	// Nickname is the nickname of the contact who sent the invitation.
+	Nickname string
+}
+
+// GroupMemberAddedEvent is the event signaling that a contact was added
+// to a group.
+type GroupMemberAddedEvent struct {
+	// Group is the name of the group.
+	Group string
+	// Nickname is the nickname of the added contact.
+	Nickname string
+}
+
+// GroupMemberRemovedEvent is the event signaling that a contact was
+// removed from a group.
+type GroupMemberRemovedEvent struct {
+	// Group is the name of the group.
+	Group string
+	// Nickname is the nickname of the removed contact.
+	Nickname string
+}
+
+// GroupMessageNotSentEvent is an event signalling that the copy of a group
+// message for one of the members was not sent.
+type GroupMessageNotSentEvent struct {
+	// Group is the name of the group the message was sent to.
+	Group string
+
+	// Nickname is the nickname of the member, or is empty if the message
+	// was not sent to any member.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+
+	// Err is an error with reason for failure
+	Err error
+}
+
+// GroupMessageSentEvent is an event signaling that the copy of a group
+// message for one of the members was sent.
+type GroupMessageSentEvent struct {
+	// Group is the name of the group the message was sent to.
+	Group string
+
+	// Nickname is the nickname of the member.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// GroupMessageDeliveredEvent is an event signaling that the copy of a
+// group message for one of the members has been delivered to the member's
+// remote spool.
+type GroupMessageDeliveredEvent struct {
+	// Group is the name of the group the message was sent to.
+	Group string
+
+	// Nickname is the nickname of the member.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// GroupMessageNotDeliveredEvent is an event signaling that the copy of a
+// group message for one of the members has NOT been delivered to the
+// member's remote spool, with Err.
+type GroupMessageNotDeliveredEvent struct {
+	// Group is the name of the group the message was sent to.
+	Group string
+
+	// Nickname is the nickname of the member.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+
+	// Err is an error with reason for failure
+	Err error
+}
+
+// AttachmentUploadProgressEvent is the event signaling the progress of
+// the upload of a file sent with SendAttachment.
+type AttachmentUploadProgressEvent struct {
+	// Nickname is the contact the file is sent to.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+
+	// Chunks is the number of chunks uploaded, out of Total.
+	Chunks int
+	Total  int
+}
+
+// AttachmentReceivedEvent is the event signaling that a message with an
+// attachment was received.  The file is downloaded with DownloadAttachment.
+type AttachmentReceivedEvent struct {
+	// Nickname is the nickname from whom we received the message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+
+	// Name is the file name.
+	Name string
+
+	// Size is the size of the file in bytes.
+	Size uint64
+
+	// Timestamp is the time the message was sent.
+	Timestamp time.Time
+}
+
+// AttachmentDownloadProgressEvent is the event signaling the progress of
+// the download of an attachment.
+type AttachmentDownloadProgressEvent struct {
+	// Nickname is the nickname from whom we received the message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+
+	// Chunks is the number of chunks downloaded, out of Total.
+	Chunks int
+	Total  int
+}
+
+// AttachmentDownloadedEvent is the event signaling that an attachment was
+// downloaded and verified, and can be retrieved with GetAttachment.
+type AttachmentDownloadedEvent struct {
+	// Nickname is the nickname from whom we received the message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// AttachmentDownloadFailedEvent is the event signaling that the download of
+// an attachment failed with Err.  It is resumed by DownloadAttachment.
+type AttachmentDownloadFailedEvent struct {
+	// Nickname is the nickname from whom we received the message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+
+	// Err is an error with reason for failure
+	Err error
+}
+
+// ContactSpoolsUpdatedEvent is the event signaling that a contact moved
+// its remote spools, and that we now write to the new ones.
+type ContactSpoolsUpdatedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+}
+
+// GroupMessageReceivedEvent is the event signaling that a group message
+// was received.
+type GroupMessageReceivedEvent struct {
+	// Group is the name of the group the message was sent to.
+	Group string
+	// Nickname is the nickname from whom we received a message.
+	Nickname string
+	// Message is the message content which was received.
+	Message []byte
+	// Timestamp is the time the message was sent.
+	Timestamp time.Time
 }
@@ -0,0 +1,827 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// group.go - group conversations
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/memspool/common"
+)
+
+// GroupID is the identifier of a group conversation, which is shared
+// by all the members.
+type GroupID [GroupIDLen]byte
+
+// GroupHeader is sent with every group message, and identifies the group
+// conversation the message belongs to.
+type GroupHeader struct {
+	// ID is the group identifier.
+	ID GroupID
+
+	// Name is the sender's name of the group, used by recipients who do
+	// not know the group yet.
+	Name string
+
+	// Sequence is the sender's logical clock for the group, used to order
+	// the messages of the group conversation.
+	Sequence uint64
+
+	// Invitation is set on the first member list sent to a member,
+	// which is the only message accepted from a contact for a group the
+	// recipient does not know yet.
+	Invitation bool `cbor:",omitempty"`
+}
+
+// GroupMember identifies a member of a group to the other members, who
+// each know it under their own nickname, by the IDs of its remote spools.
+type GroupMember struct {
+	// Spools are the IDs of the member's remote spools.
+	Spools [][common.SpoolIDSize]byte
+}
+
+// is returns true if the member has one of the given remote spools.
+func (m *GroupMember) is(spools [][common.SpoolIDSize]byte) bool {
+	for _, a := range m.Spools {
+		for _, b := range spools {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// membersDigest returns the digest of a member list, which orders the
+// lists of concurrent membership changes.
+func membersDigest(members []*GroupMember) []byte {
+	b, err := cbor.Marshal(members)
+	if err != nil {
+		panic(err)
+	}
+	digest := sha256.Sum256(b)
+	return digest[:]
+}
+
+// Group is a conversation with a set of contacts.  A message sent to the
+// group is encrypted separately with the double ratchet of each member,
+// and appended to the remote spool of each member.
+//
+// Every change of the members is sent to all of them, as a member list
+// which identifies each member by its remote spools, and which is ordered
+// by the group's logical clock.  The first member list sent to a member
+// is an invitation, which creates the group on the member's side if it
+// does not know it yet.  Every member sends its messages to, and accepts
+// messages from, the members who are among its contacts, so that a group
+// conversation reaches every member who is a contact of every other one.
+type Group struct {
+	// ID is the group identifier.
+	ID GroupID
+
+	// Name is unique locally, among the groups and the contact nicknames.
+	Name string
+
+	// Members are the nicknames of the member contacts.
+	Members []string
+
+	// Others are the members who are not among our contacts, which we
+	// can not send messages to, but who are part of the member list we
+	// send to the other members.
+	Others []*GroupMember `cbor:",omitempty"`
+
+	// MembersSequence is the sequence number of the last change of the
+	// members, and MembersDigest the digest of the member list sent with
+	// it, which breaks ties between concurrent changes.
+	MembersSequence uint64 `cbor:",omitempty"`
+	MembersDigest   []byte `cbor:",omitempty"`
+
+	// Invited are the nicknames of the members who were sent an
+	// invitation.
+	Invited map[string]bool `cbor:",omitempty"`
+
+	// Sequence is the logical clock of the group, which is larger than
+	// the sequence number of every message of the group we sent or
+	// received.
+	Sequence uint64
+
+	// MessageExpiration is the duration after which conversation history
+	// is cleared.
+	MessageExpiration time.Duration
+
+	LastMessage *Message `cbor:"-"`
+}
+
+func newGroup(name string) (*Group, error) {
+	g := &Group{
+		Name:              name,
+		Members:           make([]string, 0),
+		MessageExpiration: MessageExpirationDuration,
+	}
+	if _, err := rand.Reader.Read(g.ID[:]); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Group) isMember(nickname string) bool {
+	for _, m := range g.Members {
+		if m == nickname {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Group) removeMember(nickname string) bool {
+	for i, m := range g.Members {
+		if m == nickname {
+			g.Members = append(g.Members[:i], g.Members[i+1:]...)
+			delete(g.Invited, nickname)
+			return true
+		}
+	}
+	return false
+}
+
+// copy returns a copy of the Group which is safe to hand out to callers.
+func (g *Group) copy() *Group {
+	group := *g
+	group.Members = append([]string{}, g.Members...)
+	group.Others = append([]*GroupMember(nil), g.Others...)
+	if g.Invited != nil {
+		group.Invited = make(map[string]bool)
+		for nickname, invited := range g.Invited {
+			group.Invited[nickname] = invited
+		}
+	}
+	return &group
+}
+
+func (d *SentMessageDescriptor) conversation() string {
+	if d.Group != "" {
+		return d.Group
+	}
+	return d.Nickname
+}
+
+func (d *SentMessageDescriptor) notSentEvent(err error) interface{} {
+	if d.Group != "" {
+		return &GroupMessageNotSentEvent{Group: d.Group, Nickname: d.Nickname, MessageID: d.MessageID, Err: err}
+	}
+	return &MessageNotSentEvent{Nickname: d.Nickname, MessageID: d.MessageID, Err: err}
+}
+
+func (d *SentMessageDescriptor) sentEvent() interface{} {
+	if d.Group != "" {
+		return &GroupMessageSentEvent{Group: d.Group, Nickname: d.Nickname, MessageID: d.MessageID}
+	}
+	return &MessageSentEvent{Nickname: d.Nickname, MessageID: d.MessageID}
+}
+
+func (d *SentMessageDescriptor) notDeliveredEvent(err error) interface{} {
+	if d.Group != "" {
+		return &GroupMessageNotDeliveredEvent{Group: d.Group, Nickname: d.Nickname, MessageID: d.MessageID, Err: err}
+	}
+	return &MessageNotDeliveredEvent{Nickname: d.Nickname, MessageID: d.MessageID, Err: err}
+}
+
+func (d *SentMessageDescriptor) deliveredEvent() interface{} {
+	if d.Group != "" {
+		return &GroupMessageDeliveredEvent{Group: d.Group, Nickname: d.Nickname, MessageID: d.MessageID}
+	}
+	return &MessageDeliveredEvent{Nickname: d.Nickname, MessageID: d.MessageID}
+}
+
+// doGroupOp passes op to the worker and returns the response.
+func (c *Client) doGroupOp(op interface{}, responseChan chan error) error {
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case r := <-responseChan:
+		return r
+	}
+}
+
+// NewGroup creates a new group conversation without any members.
+func (c *Client) NewGroup(name string) error {
+	op := &opNewGroup{
+		name:         name,
+		responseChan: make(chan error, 1),
+	}
+	return c.doGroupOp(op, op.responseChan)
+}
+
+// RemoveGroup removes a group and its conversation history.
+func (c *Client) RemoveGroup(name string) error {
+	op := &opRemoveGroup{
+		name:         name,
+		responseChan: make(chan error, 1),
+	}
+	return c.doGroupOp(op, op.responseChan)
+}
+
+// AddGroupMember adds a contact to a group, such that the messages sent
+// to the group from now on are sent to the contact, and sends the new
+// member list to every member.
+func (c *Client) AddGroupMember(group, nickname string) error {
+	op := &opAddGroupMember{
+		group:        group,
+		nickname:     nickname,
+		responseChan: make(chan error, 1),
+	}
+	return c.doGroupOp(op, op.responseChan)
+}
+
+// RemoveGroupMember removes a contact from a group, and sends the new
+// member list to every member, and to the contact.
+func (c *Client) RemoveGroupMember(group, nickname string) error {
+	op := &opRemoveGroupMember{
+		group:        group,
+		nickname:     nickname,
+		responseChan: make(chan error, 1),
+	}
+	return c.doGroupOp(op, op.responseChan)
+}
+
+// GetGroups returns a copy of the groups, indexed by name.
+func (c *Client) GetGroups() map[string]*Group {
+	op := &opGetGroups{
+		responseChan: make(chan map[string]*Group, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return nil
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return nil
+	case r := <-op.responseChan:
+		return r
+	}
+}
+
+// SendGroupMessage sends a message to every member of the group with the
+// given name.  The message is added to the group conversation, which is
+// retrieved with GetSortedConversation.
+func (c *Client) SendGroupMessage(name string, message []byte) MessageID {
+	cfg := c.client.GetConfig()
+
+	if len(message)+4+groupHeaderLength(name) > DoubleRatchetPayloadLength(cfg.SphinxGeometry) {
+		return MessageID{}
+	}
+	convoMesgID := MessageID{}
+	_, err := rand.Reader.Read(convoMesgID[:])
+	if err != nil {
+		c.fatalErrCh <- err
+	}
+
+	select {
+	case <-c.HaltCh():
+	case c.opCh <- &opSendGroupMessage{
+		id:      convoMesgID,
+		name:    name,
+		payload: message,
+	}:
+	}
+
+	return convoMesgID
+}
+
+// groupHeaderLength returns the largest length of the GroupHeader of a
+// message sent to the group with the given name, once encoded.
+func groupHeaderLength(name string) int {
+	header := &GroupHeader{
+		Name:       name,
+		Sequence:   math.MaxUint64,
+		Invitation: true,
+	}
+	withHeader, err := cbor.Marshal(&Message{Group: header})
+	if err != nil {
+		panic(err)
+	}
+	withoutHeader, err := cbor.Marshal(&Message{})
+	if err != nil {
+		panic(err)
+	}
+	return len(withHeader) - len(withoutHeader)
+}
+
+// nameInUse returns true if name is the nickname of a contact or the
+// name of a group, as both share the conversation namespace.
+func (c *Client) nameInUse(name string) bool {
+	if _, ok := c.contactNicknames[name]; ok {
+		return true
+	}
+	_, ok := c.groups[name]
+	return ok
+}
+
+func (c *Client) addGroup(group *Group) {
+	c.groups[group.Name] = group
+	c.groupIDs[group.ID] = group
+}
+
+func (c *Client) doNewGroup(name string) error {
+	if name == "" {
+		return ErrInvalidGroupName
+	}
+	if c.nameInUse(name) {
+		return ErrNameInUse
+	}
+	group, err := newGroup(name)
+	if err != nil {
+		return err
+	}
+	c.addGroup(group)
+	c.save()
+	return nil
+}
+
+func (c *Client) doRemoveGroup(name string) error {
+	group, ok := c.groups[name]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	delete(c.groups, name)
+	delete(c.groupIDs, group.ID)
+	c.doWipeConversation(name) // calls c.save()
+	return nil
+}
+
+func (c *Client) doAddGroupMember(name, nickname string) error {
+	group, ok := c.groups[name]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if _, ok := c.contactNicknames[nickname]; !ok {
+		return ErrContactNotFound
+	}
+	if group.isMember(nickname) {
+		return ErrAlreadyGroupMember
+	}
+	if len(group.Members)+len(group.Others) >= MaxGroupMembers {
+		return ErrGroupFull
+	}
+	group.Members = append(group.Members, nickname)
+	c.updateGroupMembers(group)
+	c.save()
+	c.eventCh.In() <- &GroupMemberAddedEvent{Group: name, Nickname: nickname}
+	return nil
+}
+
+func (c *Client) doRemoveGroupMember(name, nickname string) error {
+	group, ok := c.groups[name]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if !group.removeMember(nickname) {
+		return ErrNotGroupMember
+	}
+	c.updateGroupMembers(group, nickname)
+	c.save()
+	c.eventCh.In() <- &GroupMemberRemovedEvent{Group: name, Nickname: nickname}
+	return nil
+}
+
+func (c *Client) doGetGroups() map[string]*Group {
+	groups := make(map[string]*Group)
+	for name, group := range c.groups {
+		groups[name] = group.copy()
+	}
+	return groups
+}
+
+// removeGroupMemberships removes a contact from the members of every
+// group, called upon contact removal.  The contact remains one of the
+// Others, as it is still a member for the other members.
+func (c *Client) removeGroupMemberships(contact *Contact) {
+	spools := contactSpoolIDs(contact)
+	for name, group := range c.groups {
+		if group.removeMember(contact.Nickname) {
+			if len(spools) != 0 {
+				group.Others = append(group.Others, &GroupMember{Spools: spools})
+			}
+			c.eventCh.In() <- &GroupMemberRemovedEvent{Group: name, Nickname: contact.Nickname}
+		}
+	}
+}
+
+// renameGroupMemberships renames a contact in every group, called upon
+// contact rename.
+func (c *Client) renameGroupMemberships(oldname, newname string) {
+	for _, group := range c.groups {
+		for i, m := range group.Members {
+			if m == oldname {
+				group.Members[i] = newname
+			}
+		}
+		if group.Invited[oldname] {
+			delete(group.Invited, oldname)
+			group.Invited[newname] = true
+		}
+	}
+}
+
+func (c *Client) doSendGroupMessage(convoMesgID MessageID, name string, message []byte) {
+	group, ok := c.groups[name]
+	if !ok {
+		c.log.Errorf("group %s not found", name)
+		c.eventCh.In() <- &GroupMessageNotSentEvent{
+			Group:     name,
+			MessageID: convoMesgID,
+			Err:       ErrGroupNotFound,
+		}
+		return
+	}
+
+	group.Sequence++
+	outMessage := Message{
+		Plaintext: message,
+		Timestamp: time.Now(),
+		Outbound:  true,
+		Group: &GroupHeader{
+			ID:       group.ID,
+			Name:     group.Name,
+			Sequence: group.Sequence,
+		},
+	}
+	serialized, err := cbor.Marshal(outMessage)
+	if err != nil {
+		c.eventCh.In() <- &GroupMessageNotSentEvent{
+			Group:     name,
+			MessageID: convoMesgID,
+			Err:       err,
+		}
+		return
+	}
+
+	// fan out a copy of the message to the remote spool of every member,
+	// preceded by the member list for the members not invited yet
+	c.resolveGroupMembers(group)
+	members := c.groupMembers(group)
+	outMessage.Recipients = make(map[string]bool)
+	for _, nickname := range group.Members {
+		contact, ok := c.contactNicknames[nickname]
+		if !ok {
+			continue
+		}
+		if contact.IsPending {
+			c.log.Errorf("cannot send group message, contact %s is pending a key exchange", nickname)
+			c.eventCh.In() <- &GroupMessageNotSentEvent{
+				Group:     name,
+				Nickname:  nickname,
+				MessageID: convoMesgID,
+				Err:       ErrPendingKeyExchange,
+			}
+			continue
+		}
+		if !group.Invited[nickname] {
+			c.sendGroupMembers(group, members, nickname)
+		}
+		if err := c.enqueueMessage(contact, &queuedSpoolCommand{ID: convoMesgID, Group: name}, serialized); err != nil {
+			c.eventCh.In() <- &GroupMessageNotSentEvent{
+				Group:     name,
+				Nickname:  nickname,
+				MessageID: convoMesgID,
+				Err:       err,
+			}
+			continue
+		}
+		outMessage.Recipients[nickname] = false
+	}
+
+	// update the conversation history
+	c.conversationsMutex.Lock()
+	if _, ok := c.conversations[name]; !ok {
+		c.conversations[name] = make(map[MessageID]*Message)
+	}
+	c.conversations[name][convoMesgID] = &outMessage
+	group.LastMessage = &outMessage
+	c.conversationsMutex.Unlock()
+	c.save()
+}
+
+// receiveGroupMessage adds a message received from a group member to the
+// conversation of its group, or creates the group upon an invitation for
+// a group we don't know yet.  Other messages are dropped.
+func (c *Client) receiveGroupMessage(nickname string, message *Message) {
+	group, ok := c.senderGroup(nickname, message.Group)
+	if !ok {
+		return
+	}
+	message.Sender = nickname
+	message.Recipients = nil
+
+	convoMesgID := MessageID{}
+	if _, err := rand.Reader.Read(convoMesgID[:]); err != nil {
+		c.fatalErrCh <- err
+		return
+	}
+	c.conversationsMutex.Lock()
+	if _, ok := c.conversations[group.Name]; !ok {
+		c.conversations[group.Name] = make(map[MessageID]*Message)
+	}
+	c.conversations[group.Name][convoMesgID] = message
+	group.LastMessage = message
+	c.conversationsMutex.Unlock()
+	c.save()
+
+	c.eventCh.In() <- &GroupMessageReceivedEvent{
+		Group:     group.Name,
+		Nickname:  nickname,
+		Message:   message.Plaintext,
+		Timestamp: message.Timestamp,
+	}
+}
+
+// senderGroup returns the group of a message received from a contact,
+// which must be a member of the group, or creates the group if the
+// message is an invitation to a group we don't know yet.  It also
+// advances the logical clock of the group.
+func (c *Client) senderGroup(nickname string, header *GroupHeader) (*Group, bool) {
+	group, ok := c.groupIDs[header.ID]
+	if ok && !group.isMember(nickname) {
+		// the sender may be one of the Others who became a contact
+		c.resolveGroupMembers(group)
+	}
+	switch {
+	case ok && !group.isMember(nickname):
+		c.log.Warningf("Dropping message for group %s from non-member %s", group.Name, nickname)
+		return nil, false
+	case !ok && !header.Invitation:
+		c.log.Warningf("Dropping message for an unknown group from %s", nickname)
+		return nil, false
+	case !ok:
+		var err error
+		group, err = newGroup(c.uniqueGroupName(header.Name))
+		if err != nil {
+			c.fatalErrCh <- err
+			return nil, false
+		}
+		group.ID = header.ID
+		group.Members = append(group.Members, nickname)
+		c.addGroup(group)
+		c.log.Debugf("Group %s created by invitation from %s", group.Name, nickname)
+		c.eventCh.In() <- &GroupCreatedEvent{Group: group.Name, Nickname: nickname}
+	}
+	if header.Sequence > group.Sequence {
+		group.Sequence = header.Sequence
+	}
+	return group, true
+}
+
+// receiveGroupMembers applies a member list received from a group
+// member, unless it is older than the current one.  The list received
+// upon an invitation creates the group.
+func (c *Client) receiveGroupMembers(nickname string, message *Message) {
+	group, ok := c.senderGroup(nickname, message.Group)
+	if !ok {
+		return
+	}
+	defer c.save()
+	digest := membersDigest(message.GroupMembers)
+	if message.Group.Sequence < group.MembersSequence ||
+		(message.Group.Sequence == group.MembersSequence && bytes.Compare(digest, group.MembersDigest) <= 0) {
+		c.log.Debugf("Ignoring outdated members of group %s from %s", group.Name, nickname)
+		return
+	}
+	group.MembersSequence = message.Group.Sequence
+	group.MembersDigest = digest
+
+	// the members are our contacts, or Others, except for ourselves;
+	// a member list without us means we were removed
+	own := c.ownSpoolIDs()
+	members := []string{nickname}
+	var others []*GroupMember
+	removed := true
+	for _, m := range message.GroupMembers {
+		if m == nil {
+			continue
+		}
+		if m.is(own) {
+			removed = false
+			continue
+		}
+		contact, ok := c.memberContact(m)
+		switch {
+		case !ok:
+			others = append(others, m)
+		case contact.Nickname != nickname:
+			members = append(members, contact.Nickname)
+		}
+	}
+	if removed {
+		c.log.Debugf("Removed from group %s by %s", group.Name, nickname)
+		members, others = nil, nil
+	}
+
+	old := group.Members
+	group.Members = nil
+	for _, m := range members {
+		if !group.isMember(m) {
+			group.Members = append(group.Members, m)
+		}
+	}
+	group.Others = others
+	for _, m := range old {
+		if !group.isMember(m) {
+			delete(group.Invited, m)
+			c.eventCh.In() <- &GroupMemberRemovedEvent{Group: group.Name, Nickname: m}
+		}
+	}
+	for _, m := range group.Members {
+		if !contains(old, m) {
+			c.eventCh.In() <- &GroupMemberAddedEvent{Group: group.Name, Nickname: m}
+		}
+	}
+}
+
+// updateGroupMembers records a change of the members of the group, and
+// sends the new member list to every member, and to the removed ones.
+func (c *Client) updateGroupMembers(group *Group, removed ...string) {
+	members := c.newGroupMembers(group)
+	for _, nickname := range group.Members {
+		c.sendGroupMembers(group, members, nickname)
+	}
+	for _, nickname := range removed {
+		c.sendGroupMembers(group, members, nickname)
+	}
+}
+
+// newGroupMembers returns the member list of the group, as a new change
+// of the members.
+func (c *Client) newGroupMembers(group *Group) []*GroupMember {
+	group.Sequence++
+	group.MembersSequence = group.Sequence
+	members := c.groupMembers(group)
+	group.MembersDigest = membersDigest(members)
+	return members
+}
+
+// sendGroupMembers sends the member list of the group to a contact, as an
+// invitation if the contact is a member who was not invited yet.
+func (c *Client) sendGroupMembers(group *Group, members []*GroupMember, nickname string) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok || contact.IsPending || len(members) == 0 {
+		return
+	}
+	invitation := group.isMember(nickname) && !group.Invited[nickname]
+	header := &GroupHeader{
+		ID:         group.ID,
+		Name:       group.Name,
+		Sequence:   group.MembersSequence,
+		Invitation: invitation,
+	}
+	if err := c.sendControlMessage(contact, &Message{Group: header, GroupMembers: members}); err != nil {
+		c.log.Errorf("Failed to send the members of group %s to %s: %s", group.Name, nickname, err)
+		return
+	}
+	if invitation {
+		if group.Invited == nil {
+			group.Invited = make(map[string]bool)
+		}
+		group.Invited[nickname] = true
+	}
+}
+
+// groupMembers returns the member list of the group, including
+// ourselves, or nil if we have no remote spool to be identified by.
+func (c *Client) groupMembers(group *Group) []*GroupMember {
+	own := c.ownSpoolIDs()
+	if len(own) == 0 {
+		return nil
+	}
+	members := []*GroupMember{{Spools: own}}
+	for _, nickname := range group.Members {
+		contact, ok := c.contactNicknames[nickname]
+		if !ok {
+			continue
+		}
+		if spools := contactSpoolIDs(contact); len(spools) != 0 {
+			members = append(members, &GroupMember{Spools: spools})
+		}
+	}
+	return append(members, group.Others...)
+}
+
+// resolveGroupMembers moves the Others who became contacts to the
+// members of the group.
+func (c *Client) resolveGroupMembers(group *Group) {
+	others := group.Others[:0]
+	for _, m := range group.Others {
+		contact, ok := c.memberContact(m)
+		if !ok {
+			others = append(others, m)
+			continue
+		}
+		if !group.isMember(contact.Nickname) {
+			group.Members = append(group.Members, contact.Nickname)
+			c.eventCh.In() <- &GroupMemberAddedEvent{Group: group.Name, Nickname: contact.Nickname}
+		}
+	}
+	group.Others = others
+}
+
+// memberContact returns the contact who is the given group member.
+func (c *Client) memberContact(m *GroupMember) (*Contact, bool) {
+	for _, contact := range c.contactNicknames {
+		if !contact.IsPending && m.is(contactSpoolIDs(contact)) {
+			return contact, true
+		}
+	}
+	return nil, false
+}
+
+// ownSpoolIDs returns the IDs of our remote spools.
+func (c *Client) ownSpoolIDs() [][common.SpoolIDSize]byte {
+	spools := [][common.SpoolIDSize]byte{}
+	for _, desc := range c.spoolReadDescriptors {
+		spools = append(spools, desc.ID)
+	}
+	return spools
+}
+
+// contactSpoolIDs returns the IDs of the remote spools of a contact.
+func contactSpoolIDs(contact *Contact) [][common.SpoolIDSize]byte {
+	spools := [][common.SpoolIDSize]byte{}
+	for _, desc := range contact.spoolWriteDescriptors {
+		spools = append(spools, desc.ID)
+	}
+	if len(spools) == 0 && contact.spoolWriteDescriptor != nil {
+		spools = append(spools, contact.spoolWriteDescriptor.ID)
+	}
+	return spools
+}
+
+func contains(nicknames []string, nickname string) bool {
+	for _, n := range nicknames {
+		if n == nickname {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueGroupName returns the provided name, or a variant of it which
+// is not in use.
+func (c *Client) uniqueGroupName(name string) string {
+	if name == "" {
+		name = "group"
+	}
+	candidate := name
+	for i := 2; c.nameInUse(candidate); i++ {
+		candidate = fmt.Sprintf("%s (%d)", name, i)
+	}
+	return candidate
+}
+
+// setGroupMessageDelivered records the delivery of a group message to
+// a member, and sets Delivered = true once it was delivered to every
+// member.  It returns true on success.
+func (c *Client) setGroupMessageDelivered(name, nickname string, msgId MessageID) bool {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	ch, ok := c.conversations[name]
+	if !ok {
+		return false
+	}
+	m, ok := ch[msgId]
+	if !ok {
+		return false
+	}
+	if m.Recipients == nil {
+		m.Recipients = make(map[string]bool)
+	}
+	m.Recipients[nickname] = true
+	m.Delivered = true
+	for _, delivered := range m.Recipients {
+		m.Delivered = m.Delivered && delivered
+	}
+	return true
+}
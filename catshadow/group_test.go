@@ -0,0 +1,409 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// group_test.go - group conversation tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+func newOfflineTestClient(t *testing.T, state *State) *Client {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err)
+	stateWorker, err := NewStateWriter(logBackend.GetLogger("catshadow_state"), createRandomStateFile(t), []byte(""))
+	require.NoError(err)
+	stateWorker.Start()
+	t.Cleanup(stateWorker.Halt)
+
+	c, err := New(logBackend, nil, stateWorker, state)
+	require.NoError(err)
+	return c
+}
+
+func getSortedConversation(c *Client, name string) Messages {
+	responseChan := make(chan Messages, 1)
+	c.doGetConversation(name, responseChan)
+	return <-responseChan
+}
+
+func TestGroupMembership(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	require.NoError(c.createContact("bob", []byte("secret")))
+
+	require.NoError(c.doNewGroup("team"))
+	require.ErrorIs(c.doNewGroup("team"), ErrNameInUse)
+	require.ErrorIs(c.doNewGroup("alice"), ErrNameInUse)
+	require.ErrorIs(c.doNewGroup(""), ErrInvalidGroupName)
+	require.ErrorIs(c.createContact("team", []byte("secret")), ErrNameInUse)
+
+	require.NoError(c.doAddGroupMember("team", "alice"))
+	require.NoError(c.doAddGroupMember("team", "bob"))
+	require.ErrorIs(c.doAddGroupMember("team", "bob"), ErrAlreadyGroupMember)
+	require.ErrorIs(c.doAddGroupMember("team", "carol"), ErrContactNotFound)
+	require.ErrorIs(c.doAddGroupMember("nonexistent", "bob"), ErrGroupNotFound)
+	require.Equal([]string{"alice", "bob"}, c.doGetGroups()["team"].Members)
+
+	require.NoError(c.doRemoveGroupMember("team", "alice"))
+	require.ErrorIs(c.doRemoveGroupMember("team", "alice"), ErrNotGroupMember)
+	require.Equal([]string{"bob"}, c.doGetGroups()["team"].Members)
+
+	// Contact renames and removals are reflected in the memberships.
+	require.NoError(c.doContactRename("bob", "robert"))
+	require.Equal([]string{"robert"}, c.doGetGroups()["team"].Members)
+	require.ErrorIs(c.doContactRename("robert", "team"), ErrNameInUse)
+	require.NoError(c.doContactRemoval("robert"))
+	require.Empty(c.doGetGroups()["team"].Members)
+
+	require.NoError(c.doRemoveGroup("team"))
+	require.ErrorIs(c.doRemoveGroup("team"), ErrGroupNotFound)
+	require.Empty(c.doGetGroups())
+}
+
+func TestGroupConversation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	require.NoError(c.createContact("bob", []byte("secret")))
+	require.NoError(c.createContact("team", []byte("secret")))
+
+	// An invitation to an unknown group creates the group, and the name
+	// does not collide with the contact nicknames.
+	id := GroupID{1, 2, 3}
+	now := time.Now()
+	c.receiveGroupMessage("alice", &Message{
+		Plaintext: []byte("second"),
+		Timestamp: now,
+		Group:     &GroupHeader{ID: id, Name: "team", Sequence: 2, Invitation: true},
+	})
+	groups := c.doGetGroups()
+	require.Len(groups, 1)
+	group, ok := groups["team (2)"]
+	require.True(ok)
+	require.Equal(id, group.ID)
+	require.Equal([]string{"alice"}, group.Members)
+	require.Equal(uint64(2), group.Sequence)
+	require.NoError(c.doAddGroupMember("team (2)", "bob"))
+
+	// Group messages are ordered by sequence number, regardless of the
+	// clocks of the senders.
+	c.receiveGroupMessage("bob", &Message{
+		Plaintext: []byte("first"),
+		Timestamp: now.Add(time.Minute),
+		Group:     &GroupHeader{ID: id, Name: "bob's team", Sequence: 1},
+	})
+	c.receiveGroupMessage("bob", &Message{
+		Plaintext: []byte("third"),
+		Timestamp: now.Add(-time.Minute),
+		Group:     &GroupHeader{ID: id, Name: "bob's team", Sequence: 3},
+	})
+	require.Len(c.doGetGroups(), 1)
+	require.Equal(uint64(3), c.groups["team (2)"].Sequence)
+
+	messages := getSortedConversation(c, "team (2)")
+	require.Len(messages, 3)
+	for i, expected := range []struct{ plaintext, sender string }{{"first", "bob"}, {"second", "alice"}, {"third", "bob"}} {
+		require.Equal(expected.plaintext, string(messages[i].Plaintext))
+		require.Equal(expected.sender, messages[i].Sender)
+	}
+	require.Equal("third", string(c.groups["team (2)"].LastMessage.Plaintext))
+
+	// Delivery is complete once every member has the message.
+	convoMesgID := MessageID{4}
+	c.conversations["team (2)"][convoMesgID] = &Message{
+		Outbound:   true,
+		Recipients: map[string]bool{"alice": false, "bob": false},
+	}
+	require.True(c.setGroupMessageDelivered("team (2)", "alice", convoMesgID))
+	require.False(c.conversations["team (2)"][convoMesgID].Delivered)
+	require.True(c.setGroupMessageDelivered("team (2)", "bob", convoMesgID))
+	require.True(c.conversations["team (2)"][convoMesgID].Delivered)
+}
+
+func TestGroupState(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	require.NoError(c.doNewGroup("team"))
+	require.NoError(c.doAddGroupMember("team", "alice"))
+	c.receiveGroupMessage("alice", &Message{
+		Plaintext: []byte("hello"),
+		Timestamp: time.Now(),
+		Group:     &GroupHeader{ID: c.groups["team"].ID, Sequence: 7},
+	})
+
+	serialized, err := c.marshal()
+	require.NoError(err)
+	state := new(State)
+	require.NoError(cbor.Unmarshal(serialized.Bytes(), &state))
+
+	c2 := newOfflineTestClient(t, state)
+	c2.garbageCollectConversations()
+	groups := c2.doGetGroups()
+	require.Len(groups, 1)
+	require.Equal(c.groups["team"].ID, groups["team"].ID)
+	require.Equal([]string{"alice"}, groups["team"].Members)
+	require.Equal(uint64(7), groups["team"].Sequence)
+	require.Equal(MessageExpirationDuration, groups["team"].MessageExpiration)
+	require.Equal(groups["team"], c2.groupIDs[groups["team"].ID])
+
+	messages := getSortedConversation(c2, "team")
+	require.Len(messages, 1)
+	require.Equal("hello", string(messages[0].Plaintext))
+	require.Equal("alice", messages[0].Sender)
+	require.Equal(messages[0], c2.groups["team"].LastMessage)
+}
+
+func TestMessagesOrdering(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	now := time.Now()
+	messages := Messages{
+		{Plaintext: []byte("3"), Timestamp: now, Group: &GroupHeader{Sequence: 2}},
+		{Plaintext: []byte("2"), Timestamp: now.Add(time.Second), Group: &GroupHeader{Sequence: 1}},
+		{Plaintext: []byte("1"), Timestamp: now, Group: &GroupHeader{Sequence: 1}},
+	}
+	sort.Sort(messages)
+	for i, m := range messages {
+		require.Equal([]byte{byte('1' + i)}, m.Plaintext)
+	}
+}
+
+func TestGroupMessageMembership(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	require.NoError(c.createContact("mallory", []byte("secret")))
+
+	// A message for an unknown group which is not an invitation does not
+	// create the group.
+	id := GroupID{1, 2, 3}
+	c.receiveGroupMessage("mallory", &Message{
+		Plaintext: []byte("hello"),
+		Timestamp: time.Now(),
+		Group:     &GroupHeader{ID: id, Name: "team", Sequence: 1},
+	})
+	require.Empty(c.doGetGroups())
+
+	c.receiveGroupMessage("alice", &Message{
+		Plaintext: []byte("welcome"),
+		Timestamp: time.Now(),
+		Group:     &GroupHeader{ID: id, Name: "team", Sequence: 1, Invitation: true},
+	})
+	require.Equal([]string{"alice"}, c.doGetGroups()["team"].Members)
+
+	// Messages from contacts who are not members are dropped, even if
+	// they are invitations.
+	for _, invitation := range []bool{false, true} {
+		c.receiveGroupMessage("mallory", &Message{
+			Plaintext: []byte("spoofed"),
+			Timestamp: time.Now(),
+			Group:     &GroupHeader{ID: id, Name: "team", Sequence: 2, Invitation: invitation},
+		})
+	}
+	require.Equal([]string{"alice"}, c.doGetGroups()["team"].Members)
+	messages := getSortedConversation(c, "team")
+	require.Len(messages, 1)
+	require.Equal("welcome", string(messages[0].Plaintext))
+
+	// Messages from removed members are dropped.
+	require.NoError(c.doRemoveGroupMember("team", "alice"))
+	c.receiveGroupMessage("alice", &Message{
+		Plaintext: []byte("still there?"),
+		Timestamp: time.Now(),
+		Group:     &GroupHeader{ID: id, Name: "team", Sequence: 3},
+	})
+	require.Len(getSortedConversation(c, "team"), 1)
+}
+
+func TestGroupHeaderLength(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// The header length accounts for the encoded GroupHeader of every
+	// message sent to the group.
+	name := "a rather long group name"
+	message := Message{
+		Plaintext: []byte("hello"),
+		Timestamp: time.Now(),
+		Outbound:  true,
+	}
+	withoutHeader, err := cbor.Marshal(message)
+	require.NoError(err)
+	message.Group = &GroupHeader{ID: GroupID{1, 2, 3}, Name: name, Sequence: 1 << 40, Invitation: true}
+	withHeader, err := cbor.Marshal(message)
+	require.NoError(err)
+	require.GreaterOrEqual(groupHeaderLength(name), len(withHeader)-len(withoutHeader))
+	require.Greater(groupHeaderLength(name), len(name)+GroupIDLen)
+}
+
+// newOnlineTestClients returns offline test clients with a remote spool
+// each, and who are contacts of each other.
+func newOnlineTestClients(t *testing.T, nicknames ...string) map[string]*Client {
+	require := require.New(t)
+
+	clients := make(map[string]*Client)
+	for _, nickname := range nicknames {
+		c := newOfflineTestClient(t, nil)
+		c.spoolReadDescriptors = append(c.spoolReadDescriptors, testSpool(t, "provider"))
+		clients[nickname] = c
+	}
+	for _, nickname := range nicknames {
+		for _, other := range nicknames {
+			if other != nickname {
+				addTestContact(t, clients[nickname], other, clients[other])
+			}
+		}
+	}
+	require.Len(clients, len(nicknames))
+	return clients
+}
+
+// addTestContact adds other as a contact of c, as if the key exchange
+// had completed.
+func addTestContact(t *testing.T, c *Client, nickname string, other *Client) {
+	require.NoError(t, c.createContact(nickname, []byte("secret")))
+	contact := c.contactNicknames[nickname]
+	contact.IsPending = false
+	contact.spoolWriteDescriptor = other.spoolReadDescriptors[0].GetWriteDescriptor()
+	contact.spoolWriteDescriptors = append(contact.spoolWriteDescriptors, contact.spoolWriteDescriptor)
+}
+
+// membersMessage returns the member list a client sends upon a change of
+// the members of a group.
+func membersMessage(c *Client, name string, invitation bool) *Message {
+	group := c.groups[name]
+	members := c.newGroupMembers(group)
+	return &Message{
+		Timestamp:    time.Now(),
+		Group:        &GroupHeader{ID: group.ID, Name: group.Name, Sequence: group.MembersSequence, Invitation: invitation},
+		GroupMembers: members,
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	clients := newOnlineTestClients(t, "alice", "bob", "carol")
+	alice, bob, carol := clients["alice"], clients["bob"], clients["carol"]
+
+	// Alice invites Bob and Carol, who learn about each other.
+	require.NoError(alice.doNewGroup("team"))
+	alice.groups["team"].Members = []string{"bob", "carol"}
+	invitation := membersMessage(alice, "team", true)
+	bob.receiveGroupMembers("alice", invitation)
+	carol.receiveGroupMembers("alice", invitation)
+	require.ElementsMatch([]string{"alice", "carol"}, bob.doGetGroups()["team"].Members)
+	require.ElementsMatch([]string{"alice", "bob"}, carol.doGetGroups()["team"].Members)
+
+	// The message of every member reaches every other member.
+	id := alice.groups["team"].ID
+	for sender, c := range clients {
+		for recipient, r := range clients {
+			if recipient == sender {
+				continue
+			}
+			r.receiveGroupMessage(sender, &Message{
+				Plaintext: []byte("hello from " + sender),
+				Timestamp: time.Now(),
+				Group:     &GroupHeader{ID: id, Sequence: c.groups["team"].Sequence + 1},
+			})
+		}
+	}
+	for _, c := range clients {
+		require.Len(getSortedConversation(c, "team"), 2)
+	}
+
+	// A member who is not a contact of every member remains in the
+	// member list sent by the others, and becomes a member once it is a
+	// contact.
+	dave := newOnlineTestClients(t, "dave")["dave"]
+	addTestContact(t, alice, "dave", dave)
+	addTestContact(t, dave, "alice", alice)
+	alice.groups["team"].Members = append(alice.groups["team"].Members, "dave")
+	bob.receiveGroupMembers("alice", membersMessage(alice, "team", false))
+	require.ElementsMatch([]string{"alice", "carol"}, bob.doGetGroups()["team"].Members)
+	require.Len(bob.doGetGroups()["team"].Others, 1)
+	dave.receiveGroupMembers("alice", membersMessage(alice, "team", true))
+	require.Equal([]string{"alice"}, dave.doGetGroups()["team"].Members)
+	require.Len(dave.doGetGroups()["team"].Others, 2)
+
+	addTestContact(t, bob, "dave", dave)
+	addTestContact(t, dave, "bob", bob)
+	bob.receiveGroupMessage("dave", &Message{
+		Plaintext: []byte("hello from dave"),
+		Timestamp: time.Now(),
+		Group:     &GroupHeader{ID: id, Sequence: dave.groups["team"].Sequence + 1},
+	})
+	require.ElementsMatch([]string{"alice", "carol", "dave"}, bob.doGetGroups()["team"].Members)
+	require.Empty(bob.doGetGroups()["team"].Others)
+	require.Len(getSortedConversation(bob, "team"), 3)
+
+	// The removal of a member is applied by every member, and by the
+	// removed member, whose messages are dropped from then on.
+	alice.groups["team"].removeMember("carol")
+	removal := membersMessage(alice, "team", false)
+	bob.receiveGroupMembers("alice", removal)
+	carol.receiveGroupMembers("alice", removal)
+	require.ElementsMatch([]string{"alice", "dave"}, bob.doGetGroups()["team"].Members)
+	require.Empty(carol.doGetGroups()["team"].Members)
+	bob.receiveGroupMessage("carol", &Message{
+		Plaintext: []byte("still there?"),
+		Timestamp: time.Now(),
+		Group:     &GroupHeader{ID: id, Sequence: carol.groups["team"].Sequence + 1},
+	})
+	require.Len(getSortedConversation(bob, "team"), 3)
+
+	// A member list older than the current one is ignored.
+	bob.receiveGroupMembers("alice", invitation)
+	require.ElementsMatch([]string{"alice", "dave"}, bob.doGetGroups()["team"].Members)
+
+	// Concurrent changes with the same sequence number are ordered the
+	// same way by every member.
+	sequence := alice.groups["team"].Sequence
+	first := membersMessage(alice, "team", false)
+	alice.groups["team"].Members = append(alice.groups["team"].Members, "carol")
+	alice.groups["team"].Sequence = sequence
+	second := membersMessage(alice, "team", false)
+	require.Equal(first.Group.Sequence, second.Group.Sequence)
+	dave.receiveGroupMembers("alice", first)
+	dave.receiveGroupMembers("alice", second)
+	bob.receiveGroupMembers("alice", second)
+	bob.receiveGroupMembers("alice", first)
+	require.Equal(dave.groups["team"].MembersDigest, bob.groups["team"].MembersDigest)
+	require.Equal(dave.groups["team"].MembersSequence, bob.groups["team"].MembersSequence)
+}
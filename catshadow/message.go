@@ -20,6 +20,9 @@ package catshadow
 
 import (
 	"time"
+
+	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
+	"github.com/katzenpost/katzenpost/memspool/common"
 )
 
 // SentMessageDescriptor is used to track Spool Write Responses
@@ -29,12 +32,22 @@ type SentMessageDescriptor struct {
 
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
+
+	// Group is the name of the group the message was sent to, if any.
+	Group string
+
+	// Control is true for control messages, which are not part of a
+	// conversation.
+	Control bool
 }
 
 // ReadMessageDescriptor is used to track Spool Read Responses
 type ReadMessageDescriptor struct {
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
+
+	// SpoolID is the ID of the remote spool which was read.
+	SpoolID [common.SpoolIDSize]byte
 }
 
 // Message encapsulates message that is sent or received.
@@ -44,6 +57,44 @@ type Message struct {
 	Outbound  bool
 	Sent      bool
 	Delivered bool
+
+	// ID is the conversation MessageID assigned by the sender, which
+	// receipts refer to.
+	ID MessageID
+
+	// Acknowledged is true once an outbound message was received by
+	// the contact's client.
+	Acknowledged bool `cbor:",omitempty"`
+
+	// Read is true once an outbound message was read by the contact,
+	// or once a received message was marked read.
+	Read bool `cbor:",omitempty"`
+
+	// Group identifies the group conversation of a group message.
+	Group *GroupHeader `cbor:",omitempty"`
+
+	// Sender is the nickname of the contact who sent a received group
+	// message.
+	Sender string `cbor:",omitempty"`
+
+	// Recipients is the delivery status of an outbound group message,
+	// indexed by member nickname.
+	Recipients map[string]bool `cbor:",omitempty"`
+
+	// Attachment describes the file attached to the message.
+	Attachment *Attachment `cbor:",omitempty"`
+
+	// Receipts refer to messages previously exchanged, in a control
+	// message.
+	Receipts *Receipts `cbor:",omitempty"`
+
+	// SpoolWriteDescriptors replaces the remote spools of the sender in
+	// a control message.
+	SpoolWriteDescriptors []*memspoolclient.SpoolWriteDescriptor `cbor:",omitempty"`
+
+	// GroupMembers replaces the members of the group identified by
+	// Group in a control message.
+	GroupMembers []*GroupMember `cbor:",omitempty"`
 }
 
 type Messages []*Message
@@ -60,5 +111,10 @@ func (d Messages) Swap(i, j int) {
 
 // Less is part of sort.Interface.
 func (d Messages) Less(i, j int) bool {
+	// group messages are ordered by sequence number first, as their
+	// timestamps come from the clocks of the different members.
+	if d[i].Group != nil && d[j].Group != nil && d[i].Group.Sequence != d[j].Group.Sequence {
+		return d[i].Group.Sequence < d[j].Group.Sequence
+	}
 	return d[i].Timestamp.Before(d[j].Timestamp)
 }
@@ -22,11 +22,13 @@ import (
 	"context"
 	"time"
 
+	cc "github.com/katzenpost/katzenpost/client"
 	"github.com/katzenpost/katzenpost/memspool/client"
 )
 
 type opOnline struct {
 	context context.Context
+	options []cc.SessionOption
 	responseChan chan error
 }
 
@@ -36,11 +38,13 @@ type opOffline struct {
 
 type opCreateSpool struct {
 	provider     string
+	replace      string
 	responseChan chan error
 }
 
 type opUpdateSpool struct {
 	descriptor   *client.SpoolReadDescriptor
+	replace      string
 	responseChan chan error
 }
 
@@ -106,3 +110,103 @@ type opGetSpoolProviders struct {
 type opSpoolWriteDescriptor struct {
 	responseChan chan *client.SpoolWriteDescriptor
 }
+
+type opSendAttachment struct {
+	id       MessageID
+	name     string
+	filename string
+	data     []byte
+}
+
+type opSendAttachmentMessage struct {
+	id         MessageID
+	name       string
+	attachment *Attachment
+}
+
+type opDownloadAttachment struct {
+	name         string
+	id           MessageID
+	responseChan chan error
+}
+
+type opAttachmentChunk struct {
+	name          string
+	id            MessageID
+	messageID     uint32
+	messages      [][]byte
+	highWaterMark uint32
+	err           error
+	responseChan  chan bool
+}
+
+type opGetAttachment struct {
+	name         string
+	id           MessageID
+	responseChan chan interface{}
+}
+
+type opSetReadReceipts struct {
+	name         string
+	enabled      bool
+	responseChan chan error
+}
+
+type opMarkRead struct {
+	name         string
+	ids          []MessageID
+	responseChan chan error
+}
+
+type opDeleteMessage struct {
+	name         string
+	id           MessageID
+	forEveryone  bool
+	responseChan chan error
+}
+
+type opSpoolWriteDescriptors struct {
+	responseChan chan []*client.SpoolWriteDescriptor
+}
+
+type opRevokeContactWrite struct {
+	name         string
+	responseChan chan error
+}
+
+type opNewGroup struct {
+	name         string
+	responseChan chan error
+}
+
+type opRemoveGroup struct {
+	name         string
+	responseChan chan error
+}
+
+type opAddGroupMember struct {
+	group        string
+	nickname     string
+	responseChan chan error
+}
+
+type opRemoveGroupMember struct {
+	group        string
+	nickname     string
+	responseChan chan error
+}
+
+type opGetGroups struct {
+	responseChan chan map[string]*Group
+}
+
+type opSendGroupMessage struct {
+	id      MessageID
+	name    string
+	payload []byte
+}
+
+type opExportAccount struct {
+	passphrase   []byte
+	responseChan chan interface{}
+}
@@ -52,7 +52,7 @@ func (c *Client) doPANDAExchange(contact *Contact) error {
 		}
 		kx.SetSharedRandom(sharedRandom)
 	} else {
-		if c.spoolReadDescriptor == nil {
+		if len(c.spoolReadDescriptors) == 0 {
 			return ErrNoSpool
 		}
 
@@ -146,12 +146,14 @@ func (c *Client) processPANDAUpdate(update *panda.PandaUpdate) {
 			return
 		}
 		contact.spoolWriteDescriptor = exchange.SpoolWriteDescriptor
+		contact.spoolWriteDescriptors = exchange.spoolWriteDescriptors()
 		contact.IsPending = false
 		c.log.Info("Double ratchet key exchange completed!")
 		contact.sharedSecret = nil
 		c.eventCh.In() <- &KeyExchangeCompletedEvent{
 			Nickname: contact.Nickname,
 		}
+		c.keyExchangeCompleted(contact)
 	}
 	c.save()
 }
@@ -0,0 +1,255 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// receipts.go - read receipts and message deletion
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+)
+
+var (
+	ErrMessageNotFound = errors.New("Message not found")
+	ErrNotOutbound     = errors.New("Only our own messages can be deleted for everyone")
+)
+
+// Receipts is a control message about messages previously exchanged with
+// a contact, which are referred to by their Message.ID.
+type Receipts struct {
+	// Acknowledged are the messages of the contact which we received.
+	Acknowledged []MessageID `cbor:",omitempty"`
+
+	// Read are the messages of the contact which we read.
+	Read []MessageID `cbor:",omitempty"`
+
+	// Deleted are our messages which the contact must delete.
+	Deleted []MessageID `cbor:",omitempty"`
+}
+
+// SetReadReceipts enables or disables sending delivery acknowledgements
+// and read receipts to the contact with the given nickname.  They are
+// disabled by default, as they reveal when we are online.
+func (c *Client) SetReadReceipts(nickname string, enabled bool) error {
+	op := &opSetReadReceipts{
+		name:         nickname,
+		enabled:      enabled,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-op.responseChan:
+		return err
+	}
+}
+
+func (c *Client) doSetReadReceipts(nickname string, enabled bool) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	contact.readReceipts = enabled
+	c.save()
+	return nil
+}
+
+// MarkRead marks the received messages with the given IDs in the
+// conversation with nickname as read, and sends read receipts if they are
+// enabled for the contact.
+func (c *Client) MarkRead(nickname string, ids ...MessageID) error {
+	op := &opMarkRead{
+		name:         nickname,
+		ids:          ids,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-op.responseChan:
+		return err
+	}
+}
+
+func (c *Client) doMarkRead(nickname string, ids []MessageID) error {
+	read := []MessageID{}
+	c.conversationsMutex.Lock()
+	for _, id := range ids {
+		m, ok := c.conversations[nickname][id]
+		if !ok {
+			c.conversationsMutex.Unlock()
+			return ErrMessageNotFound
+		}
+		if m.Outbound || m.Read {
+			continue
+		}
+		m.Read = true
+		if m.ID != (MessageID{}) {
+			read = append(read, m.ID)
+		}
+	}
+	c.conversationsMutex.Unlock()
+	c.save()
+
+	contact, ok := c.contactNicknames[nickname]
+	if !ok || !contact.readReceipts || len(read) == 0 {
+		return nil
+	}
+	return c.sendControlMessage(contact, &Message{Receipts: &Receipts{Read: read}})
+}
+
+// DeleteMessage deletes the message with the given ID from the
+// conversation with nickname.  If forEveryone is true, the message must be
+// one of ours, and the contact's client is asked to delete it as well.
+func (c *Client) DeleteMessage(nickname string, id MessageID, forEveryone bool) error {
+	op := &opDeleteMessage{
+		name:         nickname,
+		id:           id,
+		forEveryone:  forEveryone,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-op.responseChan:
+		return err
+	}
+}
+
+func (c *Client) doDeleteMessage(nickname string, id MessageID, forEveryone bool) error {
+	c.conversationsMutex.Lock()
+	m, ok := c.conversations[nickname][id]
+	c.conversationsMutex.Unlock()
+	if !ok {
+		return ErrMessageNotFound
+	}
+	if forEveryone {
+		if !m.Outbound {
+			return ErrNotOutbound
+		}
+		contact, ok := c.contactNicknames[nickname]
+		if !ok {
+			return ErrContactNotFound
+		}
+		if err := c.sendControlMessage(contact, &Message{Receipts: &Receipts{Deleted: []MessageID{m.ID}}}); err != nil {
+			return err
+		}
+	}
+	c.removeMessage(nickname, id)
+	c.save()
+	return nil
+}
+
+// removeMessage removes a message from a conversation, and updates the
+// LastMessage of the contact or group.
+func (c *Client) removeMessage(name string, id MessageID) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	messages := c.conversations[name]
+	m, ok := messages[id]
+	if !ok {
+		return
+	}
+	delete(messages, id)
+
+	var lastMessage **Message
+	if contact, ok := c.contactNicknames[name]; ok {
+		lastMessage = &contact.LastMessage
+	} else if group, ok := c.groups[name]; ok {
+		lastMessage = &group.LastMessage
+	} else {
+		return
+	}
+	if *lastMessage != m {
+		return
+	}
+	*lastMessage = nil
+	for _, message := range messages {
+		if *lastMessage == nil || (*lastMessage).Timestamp.Before(message.Timestamp) {
+			*lastMessage = message
+		}
+	}
+}
+
+// acknowledge sends a delivery acknowledgement for a received message, if
+// read receipts are enabled for the contact.
+func (c *Client) acknowledge(nickname string, m *Message) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok || !contact.readReceipts || m.ID == (MessageID{}) {
+		return
+	}
+	if err := c.sendControlMessage(contact, &Message{Receipts: &Receipts{Acknowledged: []MessageID{m.ID}}}); err != nil {
+		c.log.Errorf("failed to acknowledge message from %s: %s", nickname, err)
+	}
+}
+
+// handleReceipts applies the receipts received from a contact to the
+// conversation with the contact.
+func (c *Client) handleReceipts(nickname string, receipts *Receipts) {
+	events := []interface{}{}
+	c.conversationsMutex.Lock()
+	messages := c.conversations[nickname]
+	for _, id := range receipts.Acknowledged {
+		if m, ok := messages[id]; ok && m.Outbound && !m.Acknowledged {
+			m.Acknowledged = true
+			events = append(events, &MessageAcknowledgedEvent{Nickname: nickname, MessageID: id})
+		}
+	}
+	for _, id := range receipts.Read {
+		if m, ok := messages[id]; ok && m.Outbound && !m.Read {
+			m.Acknowledged = true
+			m.Read = true
+			events = append(events, &MessageReadEvent{Nickname: nickname, MessageID: id})
+		}
+	}
+	deleted := []MessageID{}
+	for _, id := range receipts.Deleted {
+		if id == (MessageID{}) {
+			continue
+		}
+		// the contact refers to its messages by the IDs it assigned
+		for convoMesgID, m := range messages {
+			if !m.Outbound && m.ID == id {
+				deleted = append(deleted, convoMesgID)
+			}
+		}
+	}
+	c.conversationsMutex.Unlock()
+
+	for _, convoMesgID := range deleted {
+		c.removeMessage(nickname, convoMesgID)
+		c.log.Debugf("Message %x deleted by %s", convoMesgID, nickname)
+		events = append(events, &MessageDeletedEvent{Nickname: nickname, MessageID: convoMesgID})
+	}
+	c.save()
+	for _, event := range events {
+		c.eventCh.In() <- event
+	}
+}
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// receipts_test.go - read receipt and message deletion tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceipts(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	sent1, sent2 := &Message{ID: MessageID{1}, Outbound: true}, &Message{ID: MessageID{2}, Outbound: true}
+	c.conversations["alice"] = map[MessageID]*Message{{1}: sent1, {2}: sent2}
+
+	c.handleReceipts("alice", &Receipts{Acknowledged: []MessageID{{1}, {2}, {3}}})
+	require.True(sent1.Acknowledged)
+	require.True(sent2.Acknowledged)
+	require.False(sent1.Read)
+	c.handleReceipts("alice", &Receipts{Read: []MessageID{{2}}})
+	require.False(sent1.Read)
+	require.True(sent2.Read)
+
+	// received messages are not marked by the receipts of the contact
+	received := &Message{ID: MessageID{1}}
+	c.conversations["alice"][MessageID{5}] = received
+	c.handleReceipts("alice", &Receipts{Read: []MessageID{{5}}})
+	require.False(received.Read)
+
+	// read receipts are opt-in
+	require.False(c.contactNicknames["alice"].ReadReceipts())
+	require.NoError(c.doMarkRead("alice", []MessageID{{5}}))
+	require.True(received.Read)
+	require.ErrorIs(c.doMarkRead("alice", []MessageID{{6}}), ErrMessageNotFound)
+	require.ErrorIs(c.doSetReadReceipts("bob", true), ErrContactNotFound)
+	require.NoError(c.doSetReadReceipts("alice", true))
+
+	b, err := c.contactNicknames["alice"].MarshalBinary()
+	require.NoError(err)
+	contact := new(Contact)
+	require.NoError(contact.UnmarshalBinary(b))
+	require.True(contact.ReadReceipts())
+}
+
+func TestDeleteMessage(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	now := time.Now()
+	first := &Message{ID: MessageID{1}, Timestamp: now}
+	last := &Message{ID: MessageID{2}, Timestamp: now.Add(time.Second)}
+	ours := &Message{ID: MessageID{2}, Timestamp: now.Add(-time.Second), Outbound: true}
+	c.conversations["alice"] = map[MessageID]*Message{{7}: first, {8}: last, {2}: ours}
+	c.contactNicknames["alice"].LastMessage = last
+
+	// the contact deletes its messages by the IDs it assigned
+	c.handleReceipts("alice", &Receipts{Deleted: []MessageID{{2}, {}}})
+	require.Len(c.conversations["alice"], 2)
+	require.NotContains(c.conversations["alice"], MessageID{8})
+	require.Contains(c.conversations["alice"], MessageID{2})
+	require.Equal(first, c.contactNicknames["alice"].LastMessage)
+
+	require.ErrorIs(c.doDeleteMessage("alice", MessageID{7}, true), ErrNotOutbound)
+	require.ErrorIs(c.doDeleteMessage("alice", MessageID{9}, false), ErrMessageNotFound)
+	require.NoError(c.doDeleteMessage("alice", MessageID{7}, false))
+	require.Len(c.conversations["alice"], 1)
+	require.Equal(ours, c.contactNicknames["alice"].LastMessage)
+}
@@ -85,6 +85,7 @@ func (c *Client) processReunionUpdate(update *rClient.ReunionUpdate) {
 			return
 		}
 		contact.spoolWriteDescriptor = exchange.SpoolWriteDescriptor
+		contact.spoolWriteDescriptors = exchange.spoolWriteDescriptors()
 		contact.ratchetMutex.Lock()
 		err = contact.ratchet.ProcessKeyExchange(exchange.KeyExchange)
 		contact.ratchetMutex.Unlock()
@@ -106,6 +107,7 @@ func (c *Client) processReunionUpdate(update *rClient.ReunionUpdate) {
 		c.eventCh.In() <- &KeyExchangeCompletedEvent{
 			Nickname: contact.Nickname,
 		}
+		c.keyExchangeCompleted(contact)
 	}
 	c.save()
 }
@@ -0,0 +1,511 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// spool.go - redundant remote spools
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	cUtils "github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/pki"
+	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
+	"github.com/katzenpost/katzenpost/memspool/common"
+)
+
+var (
+	ErrTooManySpools = errors.New("Too many remote spools")
+	ErrSpoolExists   = errors.New("Already have a remote spool on this provider")
+)
+
+// RetiredSpool is a remote spool replaced by MigrateSpool, which is still
+// read until our contacts have learned about its replacement.
+type RetiredSpool struct {
+	Descriptor *memspoolclient.SpoolReadDescriptor
+
+	// Until is the time after which the spool is purged.
+	Until time.Time
+}
+
+// MigrateSpool replaces our remote spool on the Provider oldProvider with
+// a new remote spool on newProvider, or on a random spool Provider if
+// newProvider is empty, and notifies our contacts of the change.  The old
+// spool is still read for SpoolRetirementDuration and purged afterwards.
+// This method blocks until the new remote spool is created.
+func (c *Client) MigrateSpool(oldProvider, newProvider string) error {
+	createSpoolOp := &opCreateSpool{
+		provider:     newProvider,
+		replace:      oldProvider,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- createSpoolOp:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case r := <-createSpoolOp.responseChan:
+		return r
+	}
+}
+
+// SpoolWriteDescriptors returns the SpoolWriteDescriptors of all the
+// remote spools of this client, the first one being the preferred one.
+func (c *Client) SpoolWriteDescriptors() []*memspoolclient.SpoolWriteDescriptor {
+	r := make(chan []*memspoolclient.SpoolWriteDescriptor, 1)
+	select {
+	case c.opCh <- &opSpoolWriteDescriptors{responseChan: r}:
+	case <-c.HaltCh():
+		return nil
+	}
+	return <-r
+}
+
+func (c *Client) doCreateRemoteSpool(provider, replace string, responseChan chan error) {
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+
+	if replace != "" && c.spoolIndex(replace) < 0 {
+		responseChan <- ErrNoSpool
+		return
+	}
+	if replace == "" && len(c.spoolReadDescriptors) >= MaxRemoteSpools {
+		responseChan <- ErrTooManySpools
+		return
+	}
+	if !c.online {
+		responseChan <- ErrNotOnline
+		return
+	}
+	descs, err := c.session.GetServices(common.SpoolServiceName)
+	if err != nil {
+		responseChan <- err
+		return
+	}
+	desc, err := pickSpoolService(descs, provider, c.spoolProviders())
+	if err != nil {
+		responseChan <- err
+		return
+	}
+	go func() {
+		// NewSpoolReadDescriptor blocks, so we run this in another thread and then use
+		// another workerOp to save the spool descriptor.
+		spool, err := memspoolclient.NewSpoolReadDescriptor(desc.Name, desc.Provider, c.session)
+		if err != nil {
+			select {
+			case <-c.HaltCh():
+			case responseChan <- err:
+			}
+			return
+		}
+		// pass the original caller responseChan
+		select {
+		case <-c.HaltCh():
+		case c.opCh <- &opUpdateSpool{descriptor: spool, replace: replace, responseChan: responseChan}:
+		}
+	}()
+}
+
+// pickSpoolService returns the spool service on provider, or on a random
+// Provider if provider is empty, which does not host one of our spools.
+func pickSpoolService(descs []*cUtils.ServiceDescriptor, provider string, used map[string]bool) (*cUtils.ServiceDescriptor, error) {
+	if used[provider] {
+		return nil, ErrSpoolExists
+	}
+	candidates := []*cUtils.ServiceDescriptor{}
+	for _, d := range descs {
+		if used[d.Provider] {
+			continue
+		}
+		if provider == "" || d.Provider == provider {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrProviderNotFound
+	}
+	return candidates[rand.NewMath().Intn(len(candidates))], nil
+}
+
+// spoolProviders returns the Providers hosting our active and retired spools.
+func (c *Client) spoolProviders() map[string]bool {
+	providers := make(map[string]bool)
+	for _, spool := range c.readableSpools() {
+		providers[spool.Provider] = true
+	}
+	return providers
+}
+
+// spoolIndex returns the index of our active spool on provider, or -1.
+func (c *Client) spoolIndex(provider string) int {
+	for i, spool := range c.spoolReadDescriptors {
+		if spool.Provider == provider {
+			return i
+		}
+	}
+	return -1
+}
+
+// primarySpool returns our preferred spool, or nil if we have none.
+func (c *Client) primarySpool() *memspoolclient.SpoolReadDescriptor {
+	if len(c.spoolReadDescriptors) == 0 {
+		return nil
+	}
+	return c.spoolReadDescriptors[0]
+}
+
+// readableSpools returns our active and retired spools.
+func (c *Client) readableSpools() []*memspoolclient.SpoolReadDescriptor {
+	spools := append([]*memspoolclient.SpoolReadDescriptor{}, c.spoolReadDescriptors...)
+	for _, retired := range c.retiredSpools {
+		spools = append(spools, retired.Descriptor)
+	}
+	return spools
+}
+
+// findSpool returns our active or retired spool with the given ID, or nil.
+func (c *Client) findSpool(id [common.SpoolIDSize]byte) *memspoolclient.SpoolReadDescriptor {
+	for _, spool := range c.readableSpools() {
+		if spool.ID == id {
+			return spool
+		}
+	}
+	return nil
+}
+
+// doUpdateSpool adds a newly created remote spool, or replaces the spool
+// on the Provider replace with it, and lets our contacts know.
+func (c *Client) doUpdateSpool(descriptor *memspoolclient.SpoolReadDescriptor, replace string) error {
+	if descriptor == nil {
+		return errors.New("Nil spool descriptor")
+	}
+	if replace == "" {
+		c.spoolReadDescriptors = append(c.spoolReadDescriptors, descriptor)
+	} else {
+		i := c.spoolIndex(replace)
+		if i < 0 {
+			return ErrNoSpool
+		}
+		c.retiredSpools = append(c.retiredSpools, &RetiredSpool{
+			Descriptor: c.spoolReadDescriptors[i],
+			Until:      time.Now().Add(SpoolRetirementDuration),
+		})
+		c.spoolReadDescriptors[i] = descriptor
+		c.log.Noticef("Migrated remote spool from %s to %s", replace, descriptor.Provider)
+	}
+	c.save()
+
+	if replace == "" && len(c.spoolReadDescriptors) == 1 {
+		// our first spool, which is needed by the key exchanges
+		c.restartKeyExchanges()
+	} else {
+		c.notifySpoolUpdate()
+	}
+	return nil
+}
+
+// getSpoolWriteDescriptors returns the write descriptors of our active spools.
+func (c *Client) getSpoolWriteDescriptors() []*memspoolclient.SpoolWriteDescriptor {
+	descs := make([]*memspoolclient.SpoolWriteDescriptor, len(c.spoolReadDescriptors))
+	for i, spool := range c.spoolReadDescriptors {
+		descs[i] = spool.GetWriteDescriptor()
+	}
+	return descs
+}
+
+// notifySpoolUpdate sends the write descriptors of our active spools to
+// all our contacts.
+func (c *Client) notifySpoolUpdate() {
+	for _, contact := range c.contacts {
+		if !contact.IsPending {
+			c.sendSpoolUpdate(contact)
+		}
+	}
+}
+
+// sendSpoolUpdate sends the write descriptors of our active spools to a
+// contact, in a control message which is not part of the conversation.
+func (c *Client) sendSpoolUpdate(contact *Contact) {
+	if contact.writeRevoked {
+		return
+	}
+	descs, err := c.contactSpoolWriteDescriptors(contact)
+	if err != nil {
+		c.log.Errorf("failed to send spool update to %s: %s", contact.Nickname, err)
+		return
+	}
+	m := &Message{SpoolWriteDescriptors: descs}
+	if err := c.sendControlMessage(contact, m); err != nil {
+		c.log.Errorf("failed to send spool update to %s: %s", contact.Nickname, err)
+	}
+}
+
+// contactSpoolWriteDescriptors returns the write descriptors of our active
+// spools for a contact, each carrying the write capability of the contact,
+// which is minted the first time and can be revoked with RevokeContactWrite.
+func (c *Client) contactSpoolWriteDescriptors(contact *Contact) ([]*memspoolclient.SpoolWriteDescriptor, error) {
+	if contact.writeCapabilities == nil {
+		contact.writeCapabilities = make(map[[common.SpoolIDSize]byte]*common.WriteCapability)
+	}
+	descs := make([]*memspoolclient.SpoolWriteDescriptor, len(c.spoolReadDescriptors))
+	for i, spool := range c.spoolReadDescriptors {
+		desc := spool.GetWriteDescriptor()
+		if capability, ok := contact.writeCapabilities[spool.ID]; ok {
+			desc.Capability = capability
+		} else {
+			var err error
+			if desc, err = spool.NewWriteDescriptor(); err != nil {
+				return nil, err
+			}
+			contact.writeCapabilities[spool.ID] = desc.Capability
+		}
+		descs[i] = desc
+	}
+	return descs, nil
+}
+
+// RevokeContactWrite revokes the write capabilities to our remote spools
+// which we gave the contact, so that it can no longer write to them, and
+// stops sending it our new spools.  This method blocks until the spool
+// services have acknowledged the revocations.
+func (c *Client) RevokeContactWrite(nickname string) error {
+	r := make(chan error, 1)
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- &opRevokeContactWrite{name: nickname, responseChan: r}:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-r:
+		return err
+	}
+}
+
+func (c *Client) doRevokeContactWrite(nickname string, responseChan chan error) {
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		responseChan <- ErrContactNotFound
+		return
+	}
+	if !c.online {
+		responseChan <- ErrNotOnline
+		return
+	}
+	contact.writeRevoked = true
+	c.save()
+
+	type revocation struct {
+		spool *memspoolclient.SpoolReadDescriptor
+		desc  *memspoolclient.SpoolWriteDescriptor
+	}
+	revocations := []revocation{}
+	for _, spool := range c.readableSpools() {
+		if capability, ok := contact.writeCapabilities[spool.ID]; ok {
+			desc := spool.GetWriteDescriptor()
+			desc.Capability = capability
+			revocations = append(revocations, revocation{spool, desc})
+		}
+	}
+	session := c.session
+	go func() {
+		// RevokeCapability blocks, so we run this in another thread.
+		var err error
+		for _, r := range revocations {
+			if e := r.spool.RevokeCapability(r.desc, session); e != nil {
+				c.log.Errorf("failed to revoke the write capability of %s on %s: %s", nickname, r.spool.Provider, e)
+				err = e
+			}
+		}
+		responseChan <- err
+	}()
+}
+
+// keyExchangeCompleted sends our spools to a new contact if they may
+// have changed since our key exchange was created.
+func (c *Client) keyExchangeCompleted(contact *Contact) {
+	if len(c.spoolReadDescriptors) > 1 || len(c.retiredSpools) > 0 {
+		c.sendSpoolUpdate(contact)
+	}
+}
+
+// emitSentMessageEvent emits an event about a sent message, unless it is
+// a control message.
+func (c *Client) emitSentMessageEvent(tp *SentMessageDescriptor, event interface{}) {
+	if !tp.Control {
+		c.eventCh.In() <- event
+	}
+}
+
+// updateContactSpools replaces the remote spools of a contact with the
+// ones received in a control message.
+func (c *Client) updateContactSpools(nickname string, descs []*memspoolclient.SpoolWriteDescriptor) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return
+	}
+	spools := []*memspoolclient.SpoolWriteDescriptor{}
+	for _, desc := range descs {
+		if desc != nil && len(spools) < MaxRemoteSpools {
+			spools = append(spools, desc)
+		}
+	}
+	if len(spools) == 0 {
+		c.log.Warningf("Ignoring empty spool update from %s", nickname)
+		return
+	}
+	contact.spoolWriteDescriptors = spools
+	contact.spoolWriteDescriptor = spools[0]
+	contact.spoolFailures = 0
+	c.log.Noticef("Updated the remote spools of %s", nickname)
+	c.save()
+	c.eventCh.In() <- &ContactSpoolsUpdatedEvent{Nickname: nickname}
+}
+
+// healthySpool returns the write descriptor of the contact's spool to
+// write to: the current one if its Provider is in the PKI document, or
+// else the next one which is.
+func healthySpool(contact *Contact, doc *pki.Document) *memspoolclient.SpoolWriteDescriptor {
+	descs := contact.spoolWriteDescriptors
+	start := writeDescriptorIndex(descs, contact.spoolWriteDescriptor)
+	for i := range descs {
+		desc := descs[(start+i)%len(descs)]
+		if doc == nil {
+			return desc
+		}
+		if _, err := doc.GetProvider(desc.Provider); err == nil {
+			return desc
+		}
+	}
+	return contact.spoolWriteDescriptor
+}
+
+// writeDescriptorIndex returns the index of desc in descs, or 0.
+func writeDescriptorIndex(descs []*memspoolclient.SpoolWriteDescriptor, desc *memspoolclient.SpoolWriteDescriptor) int {
+	if desc == nil {
+		return 0
+	}
+	for i, d := range descs {
+		if d.ID == desc.ID && d.Provider == desc.Provider {
+			return i
+		}
+	}
+	return 0
+}
+
+// spoolFailed records a failure to write to the current spool of the
+// contact and switches to the next one.  It returns true if the message
+// should be retried on that spool.
+func (c *Client) spoolFailed(contact *Contact) bool {
+	contact.spoolFailures++
+	descs := contact.spoolWriteDescriptors
+	if len(descs) < 2 {
+		return false
+	}
+	i := writeDescriptorIndex(descs, contact.spoolWriteDescriptor)
+	contact.spoolWriteDescriptor = descs[(i+1)%len(descs)]
+	c.log.Warningf("Failing over to the remote spool of %s on %s", contact.Nickname, contact.spoolWriteDescriptor.Provider)
+	return contact.spoolFailures < len(descs)
+}
+
+// retryOnNextSpool resends the message at the tip of the queue of the
+// contact on its next spool, after the message with ID mesgID failed.
+func (c *Client) retryOnNextSpool(nickname string, mesgID *[cConstants.MessageIDLength]byte) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok || contact.ackID != *mesgID {
+		return
+	}
+	if c.spoolFailed(contact) {
+		c.sendMessage(contact)
+	}
+}
+
+// seenCiphertext returns true if the ciphertext was already received,
+// possibly from another of our spools.
+func (c *Client) seenCiphertext(ciphertext []byte) bool {
+	_, ok := c.seenCiphertexts[blake2b.Sum256(ciphertext)]
+	return ok
+}
+
+// markCiphertextSeen records a received ciphertext.
+func (c *Client) markCiphertextSeen(ciphertext []byte) {
+	c.markSeen(blake2b.Sum256(ciphertext))
+}
+
+// markSeen records the hash of a received ciphertext, forgetting the
+// oldest one beyond MaxSeenCiphertexts.
+func (c *Client) markSeen(h [32]byte) {
+	if _, ok := c.seenCiphertexts[h]; ok {
+		return
+	}
+	c.seenCiphertexts[h] = struct{}{}
+	c.seenOrder = append(c.seenOrder, h)
+	if len(c.seenOrder) > MaxSeenCiphertexts {
+		delete(c.seenCiphertexts, c.seenOrder[0])
+		c.seenOrder = c.seenOrder[1:]
+	}
+}
+
+// garbageCollectSpools purges the retired spools past their retirement.
+// A retired spool is kept until we are online to purge it.
+func (c *Client) garbageCollectSpools() {
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+
+	if !c.online || c.session == nil {
+		return
+	}
+	now := time.Now()
+	live := []*RetiredSpool{}
+	for _, retired := range c.retiredSpools {
+		if now.Before(retired.Until) {
+			live = append(live, retired)
+			continue
+		}
+		c.log.Noticef("Purging retired remote spool on %s", retired.Descriptor.Provider)
+		c.purgeSpool(retired.Descriptor)
+	}
+	if len(live) != len(c.retiredSpools) {
+		c.retiredSpools = live
+		c.save()
+	}
+}
+
+// purgeSpool sends a request to purge a remote spool, without waiting for
+// the reply.  The caller must hold connMutex.
+func (c *Client) purgeSpool(spool *memspoolclient.SpoolReadDescriptor) {
+	if !c.online || c.session == nil {
+		return
+	}
+	cmd, err := common.PurgeSpool(spool.ID, spool.PrivateKey)
+	if err == nil {
+		_, err = c.session.SendUnreliableMessage(spool.Receiver, spool.Provider, cmd)
+	}
+	if err != nil {
+		c.log.Warningf("Failed to purge remote spool on %s: %s", spool.Provider, err)
+	}
+}
@@ -0,0 +1,284 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// spool_test.go - redundant remote spool tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	cUtils "github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/pki"
+	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
+)
+
+func testSpool(t *testing.T, provider string) *memspoolclient.SpoolReadDescriptor {
+	privKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(t, err)
+	spool := &memspoolclient.SpoolReadDescriptor{
+		PrivateKey: privKey,
+		Receiver:   "spool",
+		Provider:   provider,
+	}
+	_, err = rand.Reader.Read(spool.ID[:])
+	require.NoError(t, err)
+	return spool
+}
+
+func testWriteDescriptors(t *testing.T, providers ...string) []*memspoolclient.SpoolWriteDescriptor {
+	descs := []*memspoolclient.SpoolWriteDescriptor{}
+	for _, provider := range providers {
+		descs = append(descs, testSpool(t, provider).GetWriteDescriptor())
+	}
+	return descs
+}
+
+func TestContactExchangeSpools(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	descs := testWriteDescriptors(t, "provider1", "provider2")
+	b, err := NewContactExchangeBytes(descs, []byte("kx"))
+	require.NoError(err)
+	exchange, err := parseContactExchangeBytes(b)
+	require.NoError(err)
+	require.Equal(descs, exchange.spoolWriteDescriptors())
+	require.Equal([]byte("kx"), exchange.KeyExchange)
+
+	// exchanges of older clients have a single spool
+	b, err = cbor.Marshal(struct {
+		SpoolWriteDescriptor *memspoolclient.SpoolWriteDescriptor
+		KeyExchange          []byte
+	}{descs[0], []byte("kx")})
+	require.NoError(err)
+	exchange, err = parseContactExchangeBytes(b)
+	require.NoError(err)
+	require.Equal(descs[:1], exchange.spoolWriteDescriptors())
+
+	// and so does an exchange of ours with a single spool
+	b, err = NewContactExchangeBytes(descs[:1], []byte("kx"))
+	require.NoError(err)
+	legacy := &struct {
+		SpoolWriteDescriptor *memspoolclient.SpoolWriteDescriptor
+		KeyExchange          []byte
+	}{}
+	require.NoError(cbor.Unmarshal(b, legacy))
+	require.Equal(descs[0], legacy.SpoolWriteDescriptor)
+
+	_, err = NewContactExchangeBytes(nil, []byte("kx"))
+	require.ErrorIs(err, ErrNoSpool)
+	b, err = cbor.Marshal(&contactExchange{KeyExchange: []byte("kx")})
+	require.NoError(err)
+	_, err = parseContactExchangeBytes(b)
+	require.ErrorIs(err, ErrNoSpool)
+
+	descs = testWriteDescriptors(t, "p1", "p2", "p3", "p4", "p5")
+	b, err = NewContactExchangeBytes(descs, []byte("kx"))
+	require.NoError(err)
+	exchange, err = parseContactExchangeBytes(b)
+	require.NoError(err)
+	require.Len(exchange.spoolWriteDescriptors(), MaxRemoteSpools)
+}
+
+func TestContactSpoolFailover(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.NoError(c.createContact("alice", []byte("secret")))
+	contact := c.contactNicknames["alice"]
+	descs := testWriteDescriptors(t, "provider1", "provider2", "provider3")
+	contact.spoolWriteDescriptors = descs
+	contact.spoolWriteDescriptor = descs[0]
+
+	// the current spool is used while its Provider is in the document
+	doc := &pki.Document{Providers: []*pki.MixDescriptor{{Name: "provider1"}, {Name: "provider3"}}}
+	require.Equal(descs[0], healthySpool(contact, doc))
+	require.Equal(descs[0], healthySpool(contact, nil))
+	contact.spoolWriteDescriptor = descs[1]
+	require.Equal(descs[2], healthySpool(contact, doc))
+	require.Equal(descs[1], healthySpool(contact, &pki.Document{}))
+
+	// failures rotate over the spools, once
+	contact.spoolWriteDescriptor = descs[0]
+	require.True(c.spoolFailed(contact))
+	require.Equal(descs[1], contact.spoolWriteDescriptor)
+	require.True(c.spoolFailed(contact))
+	require.Equal(descs[2], contact.spoolWriteDescriptor)
+	require.False(c.spoolFailed(contact))
+	require.Equal(descs[0], contact.spoolWriteDescriptor)
+
+	// the spools survive serialization, and the current one is found
+	// by value
+	b, err := contact.MarshalBinary()
+	require.NoError(err)
+	contact2 := new(Contact)
+	require.NoError(contact2.UnmarshalBinary(b))
+	require.Equal(descs, contact2.spoolWriteDescriptors)
+	contact2.spoolWriteDescriptor = descs[1]
+	require.Equal(descs[2], healthySpool(contact2, doc))
+
+	// a spool update from the contact replaces the spools
+	update := testWriteDescriptors(t, "provider4")
+	c.updateContactSpools("alice", update)
+	require.Equal(update, contact.spoolWriteDescriptors)
+	require.Equal(update[0], contact.spoolWriteDescriptor)
+	require.Zero(contact.spoolFailures)
+	c.updateContactSpools("alice", []*memspoolclient.SpoolWriteDescriptor{nil})
+	require.Equal(update, contact.spoolWriteDescriptors)
+}
+
+func TestPickSpoolService(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	descs := []*cUtils.ServiceDescriptor{
+		{Name: "spool", Provider: "provider1"},
+		{Name: "spool", Provider: "provider2"},
+	}
+	used := map[string]bool{"provider1": true}
+	desc, err := pickSpoolService(descs, "", used)
+	require.NoError(err)
+	require.Equal("provider2", desc.Provider)
+	desc, err = pickSpoolService(descs, "provider2", used)
+	require.NoError(err)
+	require.Equal("provider2", desc.Provider)
+	_, err = pickSpoolService(descs, "provider1", used)
+	require.ErrorIs(err, ErrSpoolExists)
+	_, err = pickSpoolService(descs, "provider3", used)
+	require.ErrorIs(err, ErrProviderNotFound)
+	used["provider2"] = true
+	_, err = pickSpoolService(descs, "", used)
+	require.ErrorIs(err, ErrProviderNotFound)
+}
+
+func TestSpoolMigration(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	spool1, spool2, spool3 := testSpool(t, "provider1"), testSpool(t, "provider2"), testSpool(t, "provider3")
+	require.NoError(c.doUpdateSpool(spool1, ""))
+	require.NoError(c.doUpdateSpool(spool2, ""))
+	require.Equal(spool1.GetWriteDescriptor(), c.getSpoolWriteDescriptor())
+	require.Len(c.getSpoolWriteDescriptors(), 2)
+
+	require.ErrorIs(c.doUpdateSpool(spool3, "provider3"), ErrNoSpool)
+	require.NoError(c.doUpdateSpool(spool3, "provider1"))
+	require.Equal(spool3.GetWriteDescriptor(), c.getSpoolWriteDescriptor())
+	require.Len(c.retiredSpools, 1)
+	require.Equal(spool1, c.retiredSpools[0].Descriptor)
+	require.Equal(map[string]bool{"provider1": true, "provider2": true, "provider3": true}, c.spoolProviders())
+
+	// retired spools are still read
+	require.Equal(spool1, c.findSpool(spool1.ID))
+	require.Len(c.readableSpools(), 3)
+
+	serialized, err := c.marshal()
+	require.NoError(err)
+	state := new(State)
+	require.NoError(cbor.Unmarshal(serialized.Bytes(), &state))
+	require.Equal(spool3.ID, state.SpoolReadDescriptor.ID)
+	c2 := newOfflineTestClient(t, state)
+	require.Len(c2.spoolReadDescriptors, 2)
+	require.Len(c2.retiredSpools, 1)
+	require.Equal(spool1.ID, c2.retiredSpools[0].Descriptor.ID)
+
+	// statefiles of older clients have a single spool
+	c3 := newOfflineTestClient(t, &State{SpoolReadDescriptor: spool1})
+	require.Equal([]*memspoolclient.SpoolReadDescriptor{spool1}, c3.spoolReadDescriptors)
+}
+
+func TestSeenCiphertexts(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	require.False(c.seenCiphertext([]byte("first")))
+	c.markCiphertextSeen([]byte("first"))
+	c.markCiphertextSeen([]byte("first"))
+	require.True(c.seenCiphertext([]byte("first")))
+	require.Len(c.seenOrder, 1)
+
+	for i := 0; i < MaxSeenCiphertexts; i++ {
+		c.markCiphertextSeen([]byte{byte(i), byte(i >> 8)})
+	}
+	require.False(c.seenCiphertext([]byte("first")))
+	require.Len(c.seenOrder, MaxSeenCiphertexts)
+	require.Len(c.seenCiphertexts, MaxSeenCiphertexts)
+
+	serialized, err := c.marshal()
+	require.NoError(err)
+	state := new(State)
+	require.NoError(cbor.Unmarshal(serialized.Bytes(), &state))
+	c2 := newOfflineTestClient(t, state)
+	require.True(c2.seenCiphertext([]byte{1, 0}))
+	require.Equal(c.seenOrder, c2.seenOrder)
+}
+
+func TestContactWriteCapabilities(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newOfflineTestClient(t, nil)
+	spool1, spool2 := testSpool(t, "provider1"), testSpool(t, "provider2")
+	require.NoError(c.doUpdateSpool(spool1, ""))
+	require.NoError(c.doUpdateSpool(spool2, ""))
+	require.NoError(c.createContact("alice", []byte("secret")))
+	require.NoError(c.createContact("bob", []byte("secret")))
+	alice, bob := c.contactNicknames["alice"], c.contactNicknames["bob"]
+
+	// each contact is given its own capability to each of our spools
+	require.NoError(c.initKeyExchange(alice))
+	exchange, err := parseContactExchangeBytes(alice.keyExchange)
+	require.NoError(err)
+	aliceDescs := exchange.spoolWriteDescriptors()
+	require.Len(aliceDescs, 2)
+	bobDescs, err := c.contactSpoolWriteDescriptors(bob)
+	require.NoError(err)
+	for i, spool := range []*memspoolclient.SpoolReadDescriptor{spool1, spool2} {
+		require.Equal(spool.ID, aliceDescs[i].ID)
+		require.NotNil(aliceDescs[i].Capability)
+		require.True(aliceDescs[i].Capability.Verify(spool.ID, spool.PrivateKey.PublicKey()))
+		require.True(bobDescs[i].Capability.Verify(spool.ID, spool.PrivateKey.PublicKey()))
+		require.NotEqual(aliceDescs[i].Capability.ID, bobDescs[i].Capability.ID)
+	}
+
+	// and keeps it across spool updates and restarts
+	descs, err := c.contactSpoolWriteDescriptors(alice)
+	require.NoError(err)
+	require.Equal(aliceDescs, descs)
+	b, err := alice.MarshalBinary()
+	require.NoError(err)
+	restored := new(Contact)
+	require.NoError(restored.UnmarshalBinary(b))
+	descs, err = c.contactSpoolWriteDescriptors(restored)
+	require.NoError(err)
+	require.Equal(aliceDescs, descs)
+
+	// revocation needs the spool services
+	responseChan := make(chan error, 1)
+	c.doRevokeContactWrite("carol", responseChan)
+	require.ErrorIs(<-responseChan, ErrContactNotFound)
+	c.doRevokeContactWrite("alice", responseChan)
+	require.ErrorIs(<-responseChan, ErrNotOnline)
+	require.False(alice.writeRevoked)
+}
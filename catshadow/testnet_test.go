@@ -0,0 +1,179 @@
+// testnet_test.go - catshadow tests on the in-process test network.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/memspool/common"
+	pCommon "github.com/katzenpost/katzenpost/panda/common"
+	sConfig "github.com/katzenpost/katzenpost/server/config"
+	"github.com/katzenpost/katzenpost/testnet"
+)
+
+// newTestnet starts a test network with the spool and PANDA services,
+// and waits for its consensus.  It has a single Provider, as the clients
+// pick the PANDA service of a random Provider and only meet on the same.
+func newTestnet(ctx context.Context, t *testing.T) *testnet.Network {
+	require := require.New(t)
+
+	memspool, err := testnet.BuildPlugin("github.com/katzenpost/katzenpost/memspool/server/cmd/memspool", t.TempDir())
+	require.NoError(err)
+	panda, err := testnet.BuildPlugin("github.com/katzenpost/katzenpost/panda/server/cmd/panda_server", t.TempDir())
+	require.NoError(err)
+
+	n, err := testnet.New(&testnet.Config{
+		DataDir:   t.TempDir(),
+		Providers: 1,
+		LogLevel:  "INFO",
+		CBORPluginKaetzchen: []*sConfig.CBORPluginKaetzchen{
+			&sConfig.CBORPluginKaetzchen{
+				Capability:     common.SpoolServiceName,
+				Endpoint:       "+spool",
+				Command:        memspool,
+				MaxConcurrency: 1,
+				Config: map[string]interface{}{
+					"data_store": "$DATA_DIR/memspool.storage",
+				},
+			},
+			&sConfig.CBORPluginKaetzchen{
+				Capability:     pCommon.PandaCapability,
+				Endpoint:       "+panda",
+				Command:        panda,
+				MaxConcurrency: 1,
+				Config: map[string]interface{}{
+					"fileStore": "$DATA_DIR/panda.storage",
+				},
+			},
+		},
+	})
+	require.NoError(err)
+	require.NoError(n.Start())
+	t.Cleanup(n.Shutdown)
+
+	_, err = n.WaitForConsensus(ctx)
+	require.NoError(err)
+	return n
+}
+
+// newTestnetClient returns a Client connected to the test network, with a
+// remote spool.
+func newTestnetClient(ctx context.Context, t *testing.T, n *testnet.Network) *Client {
+	require := require.New(t)
+
+	cfg, err := n.ClientConfig()
+	require.NoError(err)
+	mixnetClient, err := client.New(cfg)
+	require.NoError(err)
+	logBackend, err := log.New("", "INFO", false)
+	require.NoError(err)
+	stateWorker, err := NewStateWriter(logBackend.GetLogger("catshadow_state"), createRandomStateFile(t), []byte(""))
+	require.NoError(err)
+	stateWorker.Start()
+
+	c, err := New(logBackend, mixnetClient, stateWorker, nil)
+	require.NoError(err)
+	c.Start()
+	t.Cleanup(c.Shutdown)
+	require.NoError(c.Online(ctx, client.WithClock(n.Clock())))
+	require.NoError(c.CreateRemoteSpool())
+	return c
+}
+
+// waitForEvent returns the first event of the client accepted by match.
+func waitForEvent(t *testing.T, c *Client, match func(interface{}) bool) interface{} {
+	timeout := time.After(5 * time.Minute)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+		case ev := <-c.EventSink:
+			if match(ev) {
+				return ev
+			}
+		}
+	}
+}
+
+func TestTestnetConversation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	n := newTestnet(ctx, t)
+	alice := newTestnetClient(ctx, t, n)
+	bob := newTestnetClient(ctx, t, n)
+
+	// exchange keys with PANDA
+	secret := make([]byte, 8)
+	_, err := rand.Reader.Read(secret)
+	require.NoError(err)
+	alice.NewContact("bob", secret)
+	bob.NewContact("alice", secret)
+	for _, c := range []*Client{alice, bob} {
+		ev := waitForEvent(t, c, func(ev interface{}) bool {
+			_, ok := ev.(*KeyExchangeCompletedEvent)
+			return ok
+		})
+		require.NoError(ev.(*KeyExchangeCompletedEvent).Err)
+	}
+
+	// and send a message each way
+	for _, m := range []struct {
+		from, to *Client
+		sender   string
+		receiver string
+	}{{alice, bob, "alice", "bob"}, {bob, alice, "bob", "alice"}} {
+		m.from.SendMessage(m.receiver, []byte("hello from "+m.sender))
+		ev := waitForEvent(t, m.to, func(ev interface{}) bool {
+			_, ok := ev.(*MessageReceivedEvent)
+			return ok
+		}).(*MessageReceivedEvent)
+		require.Equal(m.sender, ev.Nickname)
+		require.Equal([]byte("hello from "+m.sender), ev.Message)
+	}
+
+	// and a file spanning several spool messages
+	data := make([]byte, 5*attachmentChunkSize(alice.client.GetConfig().SphinxGeometry)/2)
+	_, err = rand.Reader.Read(data)
+	require.NoError(err)
+	_, err = alice.SendAttachment("bob", "file.bin", data)
+	require.NoError(err)
+	received := waitForEvent(t, bob, func(ev interface{}) bool {
+		_, ok := ev.(*AttachmentReceivedEvent)
+		return ok
+	}).(*AttachmentReceivedEvent)
+	require.NoError(bob.DownloadAttachment("alice", received.MessageID))
+	ev := waitForEvent(t, bob, func(ev interface{}) bool {
+		switch ev.(type) {
+		case *AttachmentDownloadedEvent, *AttachmentDownloadFailedEvent:
+			return true
+		}
+		return false
+	})
+	require.IsType(&AttachmentDownloadedEvent{}, ev)
+	file, err := bob.GetAttachment("alice", received.MessageID)
+	require.NoError(err)
+	require.Equal(data, file)
+}
@@ -63,6 +63,7 @@ func (c *Client) worker() {
 			return
 		case <-gcMessagestimer.C:
 			c.garbageCollectConversations()
+			c.garbageCollectSpools()
 			gcMessagestimer.Reset(GarbageCollectionInterval)
 		case <-readInboxTimer.C:
 			if isConnected {
@@ -76,22 +77,15 @@ func (c *Client) worker() {
 			switch op := qo.(type) {
 			case *opOnline:
 				// this operation is run in another goroutine, and is thread safe
-				go func() { op.responseChan <- c.goOnline(op.context) }()
+				go func() { op.responseChan <- c.goOnline(op.context, op.options) }()
 			case *opOffline:
 				op.responseChan <- c.goOffline()
 				isConnected = false
 				c.haltKeyExchanges()
 			case *opCreateSpool:
-				c.doCreateRemoteSpool(op.provider, op.responseChan)
+				c.doCreateRemoteSpool(op.provider, op.replace, op.responseChan)
 			case *opUpdateSpool:
-				if op.descriptor != nil {
-					c.spoolReadDescriptor = op.descriptor
-					c.save()
-					op.responseChan <- nil
-					c.restartKeyExchanges()
-				} else {
-					op.responseChan <- errors.New("Nil spool descriptor")
-				}
+				op.responseChan <- c.doUpdateSpool(op.descriptor, op.replace)
 			case *opAddContact:
 				err := c.createContact(op.name, op.sharedSecret)
 				if err != nil {
@@ -121,6 +115,40 @@ func (c *Client) worker() {
 				op.responseChan <- c.doGetSpoolProviders()
 			case *opSpoolWriteDescriptor:
 				op.responseChan <- c.getSpoolWriteDescriptor()
+			case *opSpoolWriteDescriptors:
+				op.responseChan <- c.getSpoolWriteDescriptors()
+			case *opRevokeContactWrite:
+				c.doRevokeContactWrite(op.name, op.responseChan)
+			case *opNewGroup:
+				op.responseChan <- c.doNewGroup(op.name)
+			case *opRemoveGroup:
+				op.responseChan <- c.doRemoveGroup(op.name)
+			case *opAddGroupMember:
+				op.responseChan <- c.doAddGroupMember(op.group, op.nickname)
+			case *opRemoveGroupMember:
+				op.responseChan <- c.doRemoveGroupMember(op.group, op.nickname)
+			case *opGetGroups:
+				op.responseChan <- c.doGetGroups()
+			case *opSendGroupMessage:
+				c.doSendGroupMessage(op.id, op.name, op.payload)
+			case *opSendAttachment:
+				c.doSendAttachment(op.id, op.name, op.filename, op.data)
+			case *opSendAttachmentMessage:
+				c.doSendAttachmentMessage(op.id, op.name, op.attachment)
+			case *opDownloadAttachment:
+				op.responseChan <- c.doDownloadAttachment(op.name, op.id)
+			case *opAttachmentChunk:
+				op.responseChan <- c.doAttachmentChunks(op.name, op.id, op.messageID, op.messages, op.highWaterMark, op.err)
+			case *opGetAttachment:
+				op.responseChan <- c.doGetAttachment(op.name, op.id)
+			case *opSetReadReceipts:
+				op.responseChan <- c.doSetReadReceipts(op.name, op.enabled)
+			case *opMarkRead:
+				op.responseChan <- c.doMarkRead(op.name, op.ids)
+			case *opDeleteMessage:
+				op.responseChan <- c.doDeleteMessage(op.name, op.id, op.forEveryone)
+			case *opExportAccount:
+				op.responseChan <- c.doExportAccount(op.passphrase)
 			default:
 				c.fatalErrCh <- errors.New("BUG, unknown operation type.")
 
@@ -167,6 +195,9 @@ func (c *Client) worker() {
 				c.log.Debug("NewDocumentEvent: Setting readInboxTimer to %s", readInboxInterval)
 				readInboxTimer.Reset(readInboxInterval)
 				continue
+			case *client.TrafficPolicyEvent:
+				c.log.Infof("Traffic policy change: %v", event)
+				c.eventCh.In() <- event
 			default:
 				c.fatalErrCh <- fmt.Errorf("bug, received unknown event from client EventSink: %v", event)
 				return
@@ -56,12 +56,17 @@ func (c *Client) GetConfig() *config.Config {
 
 // PKIBootstrap returns a pkiClient and fetches a consensus.
 func PKIBootstrap(ctx context.Context, c *Client, linkKey wire.PrivateKey) (pki.Client, *pki.Document, error) {
+	return pkiBootstrap(ctx, c, linkKey, epochtime.WallClock)
+}
+
+// pkiBootstrap fetches the consensus of the current epoch of the clock.
+func pkiBootstrap(ctx context.Context, c *Client, linkKey wire.PrivateKey, clock epochtime.Clock) (pki.Client, *pki.Document, error) {
 	// Retrieve a copy of the PKI consensus document.
 	pkiClient, err := c.cfg.NewPKIClient(c.logBackend, c.cfg.UpstreamProxyConfig(), linkKey, c.cfg.Debug.PreferedTransports)
 	if err != nil {
 		return nil, nil, err
 	}
-	currentEpoch, _, _ := epochtime.FromUnix(time.Now().Unix())
+	currentEpoch, _, _ := clock.Now()
 	doc, _, err := pkiClient.Get(ctx, currentEpoch)
 	if err != nil {
 		return nil, nil, err
@@ -158,7 +163,7 @@ func (c *Client) halt() {
 }
 
 // NewTOFUSession creates and returns a new ephemeral session or an error.
-func (c *Client) NewTOFUSession(ctx context.Context) (*Session, error) {
+func (c *Client) NewTOFUSession(ctx context.Context, opts ...SessionOption) (*Session, error) {
 	var (
 		err      error
 		doc      *pki.Document
@@ -170,7 +175,7 @@ func (c *Client) NewTOFUSession(ctx context.Context) (*Session, error) {
 	linkKey, _ = wire.DefaultScheme.GenerateKeypair(rand.Reader)
 
 	// fetch a pki.Document
-	pkiclient, doc, err := PKIBootstrap(ctx, c, linkKey)
+	pkiclient, doc, err := pkiBootstrap(ctx, c, linkKey, sessionClock(opts))
 	if err != nil {
 		return nil, err
 	}
@@ -179,6 +184,6 @@ func (c *Client) NewTOFUSession(ctx context.Context) (*Session, error) {
 		return nil, err
 	}
 
-	c.session, err = NewSession(ctx, pkiclient, doc, c.fatalErrCh, c.logBackend, c.cfg, linkKey, provider)
+	c.session, err = NewSession(ctx, pkiclient, doc, c.fatalErrCh, c.logBackend, c.cfg, linkKey, provider, opts...)
 	return c.session, err
 }
@@ -39,6 +39,20 @@ const (
 	defaultPollingInterval             = 10
 	defaultInitialMaxPKIRetrievalDelay = 30
 	defaultSessionDialTimeout          = 30
+	defaultBackgroundFactor            = 4.0
+	defaultBurstFactor                 = 4.0
+
+	// TrafficPolicyLoopix is the traffic policy that sends at the rates
+	// specified by the PKI document.
+	TrafficPolicyLoopix = "loopix"
+
+	// TrafficPolicyMobile is the traffic policy that reduces the decoy
+	// loop and drop rates while the application is backgrounded.
+	TrafficPolicyMobile = "mobile"
+
+	// TrafficPolicyBursty is the traffic policy that drains the egress
+	// queue faster while the user is active.
+	TrafficPolicyBursty = "bursty"
 )
 
 var defaultLogging = Logging{
@@ -108,9 +122,54 @@ func (d *Debug) fixup() {
 	}
 }
 
+// Traffic is the traffic shaping configuration.
+type Traffic struct {
+	// Policy is the name of the traffic policy, one of "loopix" (the
+	// default), "mobile" or "bursty".
+	Policy string
+
+	// BackgroundFactor is the factor by which the "mobile" policy divides
+	// the egress queue send rate, and the decoy loop and drop rates, while
+	// the application is backgrounded.
+	BackgroundFactor float64
+
+	// BurstFactor is the factor by which the "bursty" policy multiplies the
+	// egress queue send rate while the user is active, up to the send rate
+	// limit specified by the PKI document.
+	BurstFactor float64
+}
+
+func (t *Traffic) validate() error {
+	switch t.Policy {
+	case "":
+		t.Policy = TrafficPolicyLoopix
+	case TrafficPolicyLoopix, TrafficPolicyMobile, TrafficPolicyBursty:
+	default:
+		return fmt.Errorf("config: Traffic: Policy '%v' is invalid", t.Policy)
+	}
+	if t.BackgroundFactor == 0 {
+		t.BackgroundFactor = defaultBackgroundFactor
+	}
+	if t.BackgroundFactor < 1 {
+		return fmt.Errorf("config: Traffic: BackgroundFactor %v is invalid", t.BackgroundFactor)
+	}
+	if t.BurstFactor == 0 {
+		t.BurstFactor = defaultBurstFactor
+	}
+	if t.BurstFactor < 1 {
+		return fmt.Errorf("config: Traffic: BurstFactor %v is invalid", t.BurstFactor)
+	}
+	return nil
+}
+
 // VotingAuthority is a voting authority configuration.
 type VotingAuthority struct {
 	Peers []*vServerConfig.Authority
+
+	// Caches are the optional directory caches, which are asked for the
+	// consensus documents before the Peers. The documents are verified
+	// against the keys of the Peers.
+	Caches []*vServerConfig.Authority
 }
 
 // New constructs a pki.Client with the specified voting authority config.
@@ -119,6 +178,7 @@ func (vACfg *VotingAuthority) New(l *log.Backend, pCfg *proxy.Config, linkKey wi
 		LinkKey:            linkKey,
 		LogBackend:         l,
 		Authorities:        vACfg.Peers,
+		Caches:             vACfg.Caches,
 		PreferedTransports: transports,
 		DialContextFn:      pCfg.ToDialContext(fmt.Sprintf("voting: %x", linkKey.PublicKey().Sum256())),
 	}
@@ -134,6 +194,11 @@ func (vACfg *VotingAuthority) validate() error {
 			return errors.New("invalid voting authority peer")
 		}
 	}
+	for _, cache := range vACfg.Caches {
+		if cache.IdentityPublicKey == nil || cache.LinkPublicKey == nil || len(cache.Addresses) == 0 {
+			return errors.New("invalid directory cache")
+		}
+	}
 	return nil
 }
 
@@ -186,6 +251,7 @@ type Config struct {
 	Logging         *Logging
 	UpstreamProxy   *UpstreamProxy
 	Debug           *Debug
+	Traffic         *Traffic
 	VotingAuthority *VotingAuthority
 	upstreamProxy   *proxy.Config
 }
@@ -219,10 +285,17 @@ func (c *Config) FixupAndValidate() error {
 		c.Debug.fixup()
 	}
 
+	if c.Traffic == nil {
+		c.Traffic = &Traffic{}
+	}
+
 	// Validate/fixup the various sections.
 	if err := c.Logging.validate(); err != nil {
 		return err
 	}
+	if err := c.Traffic.validate(); err != nil {
+		return err
+	}
 	if uCfg, err := c.UpstreamProxy.toProxyConfig(); err == nil {
 		c.upstreamProxy = uCfg
 	} else {
@@ -116,3 +116,21 @@ type NewDocumentEvent struct {
 func (e *NewDocumentEvent) String() string {
 	return fmt.Sprintf("PKI Document for epoch %d", e.Document.Epoch)
 }
+
+// TrafficPolicyEvent is the event sent when the traffic policy changes
+// the rates at which the client sends.
+type TrafficPolicyEvent struct {
+	// Policy is the name of the traffic policy in use.
+	Policy string
+
+	// State is the application state the rates were chosen for.
+	State TrafficState
+
+	// Rates are the rates in use.
+	Rates TrafficRates
+}
+
+// String returns a string representation of a TrafficPolicyEvent.
+func (e *TrafficPolicyEvent) String() string {
+	return fmt.Sprintf("TrafficPolicy: %v LambdaP: %v LambdaL: %v LambdaD: %v", e.Policy, e.Rates.LambdaP, e.Rates.LambdaL, e.Rates.LambdaD)
+}
@@ -0,0 +1,204 @@
+// fragment.go - Message fragmentation and reassembly.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package fragment implements splitting messages that are larger than a
+// single Sphinx payload into numbered fragments, and reassembling them
+// on the receiving side.
+//
+// Every fragment carries the BLAKE2b-256 digest of the whole message,
+// which is verified upon reassembly. The digest is an integrity check
+// against lost, mixed up or corrupted fragments; it is not keyed, and
+// does not authenticate the sender.
+package fragment
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// Version is the fragment format version.
+	Version = 0
+
+	// MessageIDLength is the length of a fragmented message identifier.
+	MessageIDLength = 16
+
+	// DigestLength is the length of the message digest carried
+	// in each fragment.
+	DigestLength = blake2b.Size256
+
+	// HeaderLength is the length of the fragment header.
+	HeaderLength = 1 + MessageIDLength + DigestLength + 4 + 4 + 4
+
+	// ReplyHeaderLength is the length of the fragment reply header.
+	ReplyHeaderLength = 1 + 4
+
+	// MaxFragments is the maximum number of fragments of a message.
+	MaxFragments = 1024
+)
+
+var (
+	// ErrInvalidFragment is the error returned when a fragment
+	// fails to decode.
+	ErrInvalidFragment = errors.New("fragment: invalid fragment")
+
+	// ErrDigestMismatch is the error returned when a reassembled
+	// message does not match the digest carried by its fragments.
+	ErrDigestMismatch = errors.New("fragment: reassembled message digest mismatch")
+
+	// ErrPayloadTooSmall is the error returned when the payload size
+	// can not accommodate a fragment header.
+	ErrPayloadTooSmall = errors.New("fragment: payload length too small")
+)
+
+// Fragment is a single numbered piece of a larger message.
+type Fragment struct {
+	// MessageID identifies the message this fragment belongs to.
+	MessageID [MessageIDLength]byte
+
+	// Digest is the BLAKE2b-256 digest of the whole message.
+	Digest [DigestLength]byte
+
+	// Index is the zero based index of this fragment.
+	Index uint32
+
+	// Count is the total number of fragments in the message.
+	Count uint32
+
+	// Data is the fragment's portion of the message.
+	Data []byte
+}
+
+// MaxDataLength returns the maximum amount of message data that fits in
+// a fragment for the given payload length.
+func MaxDataLength(payloadLength int) int {
+	return payloadLength - HeaderLength
+}
+
+// Split splits message into fragments that each fit in payloadLength
+// bytes once encoded.
+func Split(id *[MessageIDLength]byte, message []byte, payloadLength int) ([]*Fragment, error) {
+	dataLength := MaxDataLength(payloadLength)
+	if dataLength <= 0 {
+		return nil, ErrPayloadTooSmall
+	}
+	count := (len(message) + dataLength - 1) / dataLength
+	if count == 0 {
+		count = 1
+	}
+	if count > MaxFragments {
+		return nil, ErrMessageTooLarge
+	}
+	digest := blake2b.Sum256(message)
+	fragments := make([]*Fragment, count)
+	for i := 0; i < count; i++ {
+		start := i * dataLength
+		end := start + dataLength
+		if end > len(message) {
+			end = len(message)
+		}
+		fragments[i] = &Fragment{
+			MessageID: *id,
+			Digest:    digest,
+			Index:     uint32(i),
+			Count:     uint32(count),
+			Data:      message[start:end],
+		}
+	}
+	return fragments, nil
+}
+
+// Bytes serializes the fragment.
+func (f *Fragment) Bytes() []byte {
+	out := make([]byte, HeaderLength, HeaderLength+len(f.Data))
+	out[0] = Version
+	off := 1
+	copy(out[off:], f.MessageID[:])
+	off += MessageIDLength
+	copy(out[off:], f.Digest[:])
+	off += DigestLength
+	binary.BigEndian.PutUint32(out[off:], f.Index)
+	binary.BigEndian.PutUint32(out[off+4:], f.Count)
+	binary.BigEndian.PutUint32(out[off+8:], uint32(len(f.Data)))
+	return append(out, f.Data...)
+}
+
+// FromBytes deserializes a fragment, ignoring any trailing padding.
+func FromBytes(b []byte) (*Fragment, error) {
+	if len(b) < HeaderLength || b[0] != Version {
+		return nil, ErrInvalidFragment
+	}
+	f := new(Fragment)
+	off := 1
+	copy(f.MessageID[:], b[off:])
+	off += MessageIDLength
+	copy(f.Digest[:], b[off:])
+	off += DigestLength
+	f.Index = binary.BigEndian.Uint32(b[off:])
+	f.Count = binary.BigEndian.Uint32(b[off+4:])
+	dataLength := binary.BigEndian.Uint32(b[off+8:])
+	if f.Count == 0 || f.Index >= f.Count || uint64(dataLength) > uint64(len(b)-HeaderLength) {
+		return nil, ErrInvalidFragment
+	}
+	f.Data = b[HeaderLength : HeaderLength+int(dataLength)]
+	return f, nil
+}
+
+func (f *Fragment) verify(message []byte) error {
+	digest := blake2b.Sum256(message)
+	if !hmac.Equal(digest[:], f.Digest[:]) {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+// Reply is the reply sent by the receiving side for every fragment.
+type Reply struct {
+	// Complete is true iff the fragment completed the message.
+	Complete bool
+
+	// Payload is the application reply, only set when
+	// Complete is true.
+	Payload []byte
+}
+
+// Bytes serializes the reply.
+func (r *Reply) Bytes() []byte {
+	out := make([]byte, ReplyHeaderLength, ReplyHeaderLength+len(r.Payload))
+	if r.Complete {
+		out[0] = 1
+	}
+	binary.BigEndian.PutUint32(out[1:], uint32(len(r.Payload)))
+	return append(out, r.Payload...)
+}
+
+// ReplyFromBytes deserializes a reply, ignoring any trailing padding.
+func ReplyFromBytes(b []byte) (*Reply, error) {
+	if len(b) < ReplyHeaderLength || b[0] > 1 {
+		return nil, fmt.Errorf("fragment: invalid reply")
+	}
+	payloadLength := binary.BigEndian.Uint32(b[1:])
+	if uint64(payloadLength) > uint64(len(b)-ReplyHeaderLength) {
+		return nil, fmt.Errorf("fragment: invalid reply length %d", payloadLength)
+	}
+	return &Reply{
+		Complete: b[0] == 1,
+		Payload:  b[ReplyHeaderLength : ReplyHeaderLength+int(payloadLength)],
+	}, nil
+}
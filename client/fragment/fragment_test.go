@@ -0,0 +1,206 @@
+// fragment_test.go - Message fragmentation and reassembly tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fragment
+
+import (
+	"io"
+	mrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+const testPayloadLength = 2000
+
+func testMessage(t *testing.T, size int) (*[MessageIDLength]byte, []byte) {
+	id := new([MessageIDLength]byte)
+	_, err := io.ReadFull(rand.Reader, id[:])
+	require.NoError(t, err)
+	message := make([]byte, size)
+	_, err = io.ReadFull(rand.Reader, message)
+	require.NoError(t, err)
+	return id, message
+}
+
+func TestSplitReassemble(t *testing.T) {
+	require := require.New(t)
+
+	id, message := testMessage(t, 10*testPayloadLength+123)
+	fragments, err := Split(id, message, testPayloadLength)
+	require.NoError(err)
+	require.Len(fragments, 11)
+
+	payloads := make([][]byte, len(fragments))
+	for i, f := range fragments {
+		b := f.Bytes()
+		require.True(len(b) <= testPayloadLength)
+		// Pad like Session.composeMessage does.
+		payloads[i] = make([]byte, testPayloadLength)
+		copy(payloads[i], b)
+	}
+	mrand.Shuffle(len(payloads), func(i, j int) {
+		payloads[i], payloads[j] = payloads[j], payloads[i]
+	})
+
+	r := NewReassembler(time.Minute, len(message), 10)
+	for i, p := range payloads {
+		rID, out, err := r.Add(p)
+		require.NoError(err)
+		if i < len(payloads)-1 {
+			require.Nil(out)
+			require.Equal(1, r.Pending())
+			// Retransmitted fragments are ignored.
+			_, out, err = r.Add(p)
+			require.NoError(err)
+			require.Nil(out)
+			continue
+		}
+		require.Equal(id, rID)
+		require.Equal(message, out)
+	}
+	require.Equal(0, r.Pending())
+}
+
+func TestSingleFragment(t *testing.T) {
+	require := require.New(t)
+
+	id, message := testMessage(t, 10)
+	fragments, err := Split(id, message, testPayloadLength)
+	require.NoError(err)
+	require.Len(fragments, 1)
+
+	r := NewReassembler(time.Minute, testPayloadLength, 1)
+	rID, out, err := r.Add(fragments[0].Bytes())
+	require.NoError(err)
+	require.Equal(id, rID)
+	require.Equal(message, out)
+}
+
+func TestReassembleTampered(t *testing.T) {
+	require := require.New(t)
+
+	id, message := testMessage(t, 3*testPayloadLength)
+	fragments, err := Split(id, message, testPayloadLength)
+	require.NoError(err)
+
+	r := NewReassembler(time.Minute, len(message), 10)
+	for i, f := range fragments {
+		if i == 1 {
+			f.Data = append([]byte{}, f.Data...)
+			f.Data[0] ^= 0xff
+		}
+		_, out, err := r.AddFragment(f)
+		if i == len(fragments)-1 {
+			require.Equal(ErrDigestMismatch, err)
+			require.Nil(out)
+		}
+	}
+	require.Equal(0, r.Pending())
+
+	_, err = FromBytes([]byte{Version, 1, 2, 3})
+	require.Equal(ErrInvalidFragment, err)
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	require := require.New(t)
+
+	id, message := testMessage(t, 3*testPayloadLength)
+	fragments, err := Split(id, message, testPayloadLength)
+	require.NoError(err)
+
+	r := NewReassembler(time.Minute, testPayloadLength, 1)
+	_, _, err = r.AddFragment(fragments[0])
+	require.NoError(err)
+	_, _, err = r.AddFragment(fragments[1])
+	require.Equal(ErrMessageTooLarge, err)
+
+	r = NewReassembler(time.Minute, len(message), 1)
+	_, _, err = r.AddFragment(fragments[0])
+	require.NoError(err)
+	id2, message2 := testMessage(t, 3*testPayloadLength)
+	fragments2, err := Split(id2, message2, testPayloadLength)
+	require.NoError(err)
+	_, _, err = r.AddFragment(fragments2[0])
+	require.Equal(ErrTooManyPending, err)
+
+	// the fragment count is bounded by the size limit
+	r = NewReassembler(time.Minute, len(message), 1)
+	forged := *fragments[0]
+	forged.Count = 0xffffffff
+	_, _, err = r.Add(forged.Bytes())
+	require.Equal(ErrMessageTooLarge, err)
+	forged.Count = uint32(len(message)) + 1
+	_, _, err = r.Add(forged.Bytes())
+	require.Equal(ErrMessageTooLarge, err)
+	require.Equal(0, r.Pending())
+
+	r = NewReassembler(time.Millisecond, len(message), 1)
+	_, _, err = r.AddFragment(fragments[0])
+	require.NoError(err)
+	time.Sleep(5 * time.Millisecond)
+	r.Prune()
+	require.Equal(0, r.Pending())
+}
+
+func TestHandle(t *testing.T) {
+	require := require.New(t)
+
+	id, message := testMessage(t, 2*testPayloadLength)
+	fragments, err := Split(id, message, testPayloadLength)
+	require.NoError(err)
+
+	r := NewReassembler(time.Minute, len(message), 1)
+	handled := 0
+	fn := func(rID *[MessageIDLength]byte, out []byte) []byte {
+		handled++
+		require.Equal(id, rID)
+		require.Equal(message, out)
+		return []byte("ok")
+	}
+	for i, f := range fragments {
+		b, err := r.Handle(f.Bytes(), fn)
+		require.NoError(err)
+		reply, err := ReplyFromBytes(b)
+		require.NoError(err)
+		require.Equal(i == len(fragments)-1, reply.Complete)
+	}
+	require.Equal(1, handled)
+}
+
+func TestReply(t *testing.T) {
+	require := require.New(t)
+
+	reply := &Reply{
+		Complete: true,
+		Payload:  []byte("thanks"),
+	}
+	b := make([]byte, testPayloadLength)
+	copy(b, reply.Bytes())
+	out, err := ReplyFromBytes(b)
+	require.NoError(err)
+	require.Equal(reply, out)
+
+	out, err = ReplyFromBytes((&Reply{}).Bytes())
+	require.NoError(err)
+	require.False(out.Complete)
+	require.Len(out.Payload, 0)
+
+	_, err = ReplyFromBytes([]byte{2, 0, 0, 0, 0})
+	require.Error(err)
+}
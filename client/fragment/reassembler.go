@@ -0,0 +1,191 @@
+// reassembler.go - Message reassembly.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fragment
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMessageTooLarge is the error returned when a fragment claims
+	// a message that exceeds the Reassembler's size limit.
+	ErrMessageTooLarge = errors.New("fragment: message too large")
+
+	// ErrTooManyPending is the error returned when the Reassembler
+	// is already tracking the maximum number of incomplete messages.
+	ErrTooManyPending = errors.New("fragment: too many pending messages")
+
+	// ErrFragmentMismatch is the error returned when a fragment
+	// disagrees with previously received fragments of the same message.
+	ErrFragmentMismatch = errors.New("fragment: fragment count mismatch")
+)
+
+type pendingKey struct {
+	id     [MessageIDLength]byte
+	digest [DigestLength]byte
+}
+
+type pendingMessage struct {
+	fragments [][]byte
+	received  uint32
+	size      int
+	expiresAt time.Time
+}
+
+// Reassembler collects fragments and returns complete messages.
+// Incomplete messages are discarded once their timeout expires.
+type Reassembler struct {
+	sync.Mutex
+
+	timeout        time.Duration
+	maxMessageSize int
+	maxPending     int
+
+	pending map[pendingKey]*pendingMessage
+}
+
+// NewReassembler returns a new Reassembler which discards incomplete
+// messages after timeout, rejects messages larger than maxMessageSize
+// bytes, and tracks at most maxPending incomplete messages.
+func NewReassembler(timeout time.Duration, maxMessageSize, maxPending int) *Reassembler {
+	return &Reassembler{
+		timeout:        timeout,
+		maxMessageSize: maxMessageSize,
+		maxPending:     maxPending,
+		pending:        make(map[pendingKey]*pendingMessage),
+	}
+}
+
+// Add adds a serialized fragment to the Reassembler. If the fragment
+// completes its message, the message ID and the reassembled message are
+// returned, otherwise the returned message is nil.
+func (r *Reassembler) Add(b []byte) (*[MessageIDLength]byte, []byte, error) {
+	f, err := FromBytes(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.AddFragment(f)
+}
+
+// AddFragment is like Add but takes a decoded Fragment.
+func (r *Reassembler) AddFragment(f *Fragment) (*[MessageIDLength]byte, []byte, error) {
+	now := time.Now()
+	id := f.MessageID
+
+	if f.Count == 1 {
+		if err := f.verify(f.Data); err != nil {
+			return nil, nil, err
+		}
+		return &id, f.Data, nil
+	}
+
+	// The fragments of a message each carry some of it, which bounds
+	// their count by the size limit, checked before anything is allocated
+	// for them.
+	if f.Count > MaxFragments || uint64(f.Count) > uint64(r.maxMessageSize) {
+		return nil, nil, ErrMessageTooLarge
+	}
+	if len(f.Data) == 0 {
+		return nil, nil, ErrInvalidFragment
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.prune(now)
+
+	k := pendingKey{id: f.MessageID, digest: f.Digest}
+	p, ok := r.pending[k]
+	if !ok {
+		if len(r.pending) >= r.maxPending {
+			return nil, nil, ErrTooManyPending
+		}
+		p = &pendingMessage{
+			fragments: make([][]byte, f.Count),
+			expiresAt: now.Add(r.timeout),
+		}
+		r.pending[k] = p
+	}
+	if uint32(len(p.fragments)) != f.Count {
+		return nil, nil, ErrFragmentMismatch
+	}
+	if p.fragments[f.Index] != nil {
+		// Duplicate, most likely a retransmission.
+		return nil, nil, nil
+	}
+	if p.size+len(f.Data) > r.maxMessageSize {
+		delete(r.pending, k)
+		return nil, nil, ErrMessageTooLarge
+	}
+	p.fragments[f.Index] = append([]byte{}, f.Data...)
+	p.size += len(f.Data)
+	p.received++
+	if p.received != f.Count {
+		return nil, nil, nil
+	}
+
+	delete(r.pending, k)
+	message := make([]byte, 0, p.size)
+	for _, data := range p.fragments {
+		message = append(message, data...)
+	}
+	if err := f.verify(message); err != nil {
+		return nil, nil, err
+	}
+	return &id, message, nil
+}
+
+// Handle is a convenience for Kaetzchen services: it adds the request
+// fragment and returns the serialized Reply for it. The handler fn is
+// called with the reassembled message once the request completes it, and
+// its result is carried in the Reply.
+func (r *Reassembler) Handle(request []byte, fn func(id *[MessageIDLength]byte, message []byte) []byte) ([]byte, error) {
+	id, message, err := r.Add(request)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return (&Reply{}).Bytes(), nil
+	}
+	reply := &Reply{
+		Complete: true,
+		Payload:  fn(id, message),
+	}
+	return reply.Bytes(), nil
+}
+
+// Prune discards incomplete messages whose timeout has expired.
+func (r *Reassembler) Prune() {
+	r.Lock()
+	defer r.Unlock()
+	r.prune(time.Now())
+}
+
+func (r *Reassembler) prune(now time.Time) {
+	for k, p := range r.pending {
+		if now.After(p.expiresAt) {
+			delete(r.pending, k)
+		}
+	}
+}
+
+// Pending returns the number of incomplete messages.
+func (r *Reassembler) Pending() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.pending)
+}
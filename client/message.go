@@ -73,6 +73,10 @@ type Message struct {
 
 	// Retransmissions counts the number of times the message has been retransmitted.
 	Retransmissions uint32
+
+	// LargeMessageID is the ID of the message sent with SendLargeMessage
+	// that this message is a fragment of, if any.
+	LargeMessageID *[cConstants.MessageIDLength]byte
 }
 
 func (m *Message) Priority() uint64 {
@@ -0,0 +1,532 @@
+// persistent_queue.go - Client crash-safe egress queue.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+)
+
+const (
+	persistentQueueVersion = 0
+
+	metadataBucket = "metadata"
+	egressBucket   = "egress"
+	inflightBucket = "inflight"
+	largeBucket    = "large"
+	versionKey     = "version"
+
+	// PersistentQueueKeySize is the size of the key used to encrypt
+	// queue entries at rest.
+	PersistentQueueKeySize = 32
+
+	persistentQueueNonceSize = 24
+)
+
+// ErrDecryptQueueEntry is the error issued when a persisted queue
+// entry fails to decrypt, usually because the wrong key was supplied.
+var ErrDecryptQueueEntry = errors.New("failed to decrypt persistent queue entry")
+
+// diskMessage is the serialized form of a Message.
+type diskMessage struct {
+	ID              []byte
+	Recipient       string
+	Provider        string
+	Payload         []byte
+	SentAt          int64
+	ReplyETA        int64
+	SURBID          []byte
+	Key             []byte
+	WithSURB        bool
+	Reliable        bool
+	Retransmissions uint32
+	QueuePriority   uint64
+	LargeMessageID  []byte
+}
+
+func toDiskMessage(m *Message) *diskMessage {
+	m.Lock()
+	defer m.Unlock()
+	d := &diskMessage{
+		ID:              m.ID[:],
+		Recipient:       m.Recipient,
+		Provider:        m.Provider,
+		Payload:         m.Payload,
+		ReplyETA:        int64(m.ReplyETA),
+		Key:             m.Key,
+		WithSURB:        m.WithSURB,
+		Reliable:        m.Reliable,
+		Retransmissions: m.Retransmissions,
+		QueuePriority:   m.QueuePriority,
+	}
+	if !m.SentAt.IsZero() {
+		d.SentAt = m.SentAt.UnixNano()
+	}
+	if m.SURBID != nil {
+		d.SURBID = m.SURBID[:]
+	}
+	if m.LargeMessageID != nil {
+		d.LargeMessageID = m.LargeMessageID[:]
+	}
+	return d
+}
+
+func (d *diskMessage) toMessage() (*Message, error) {
+	if len(d.ID) != cConstants.MessageIDLength {
+		return nil, fmt.Errorf("persistent queue: invalid message ID length: %d", len(d.ID))
+	}
+	m := &Message{
+		ID:              new([cConstants.MessageIDLength]byte),
+		Recipient:       d.Recipient,
+		Provider:        d.Provider,
+		Payload:         d.Payload,
+		ReplyETA:        time.Duration(d.ReplyETA),
+		Key:             d.Key,
+		WithSURB:        d.WithSURB,
+		Reliable:        d.Reliable,
+		Retransmissions: d.Retransmissions,
+		QueuePriority:   d.QueuePriority,
+	}
+	copy(m.ID[:], d.ID)
+	if d.SentAt != 0 {
+		m.SentAt = time.Unix(0, d.SentAt)
+	}
+	if d.SURBID != nil {
+		if len(d.SURBID) != sConstants.SURBIDLength {
+			return nil, fmt.Errorf("persistent queue: invalid SURB ID length: %d", len(d.SURBID))
+		}
+		m.SURBID = new([sConstants.SURBIDLength]byte)
+		copy(m.SURBID[:], d.SURBID)
+	}
+	if d.LargeMessageID != nil {
+		if len(d.LargeMessageID) != cConstants.MessageIDLength {
+			return nil, fmt.Errorf("persistent queue: invalid large message ID length: %d", len(d.LargeMessageID))
+		}
+		m.LargeMessageID = new([cConstants.MessageIDLength]byte)
+		copy(m.LargeMessageID[:], d.LargeMessageID)
+	}
+	return m, nil
+}
+
+// diskLargeMessage is the serialized form of a largeMessage.
+type diskLargeMessage struct {
+	ID        []byte
+	Fragments int
+	Sent      int
+	Replied   [][]byte
+	Failed    bool
+	SentAt    int64
+	ReplyETA  int64
+	Reply     []byte
+}
+
+// toDiskLargeMessage serializes lm, which must be locked by the caller.
+func toDiskLargeMessage(lm *largeMessage) *diskLargeMessage {
+	d := &diskLargeMessage{
+		ID:        lm.id[:],
+		Fragments: lm.fragments,
+		Sent:      lm.sent,
+		Replied:   make([][]byte, 0, len(lm.replied)),
+		Failed:    lm.failed,
+		ReplyETA:  int64(lm.replyETA),
+		Reply:     lm.reply,
+	}
+	for id := range lm.replied {
+		d.Replied = append(d.Replied, append([]byte{}, id[:]...))
+	}
+	if !lm.sentAt.IsZero() {
+		d.SentAt = lm.sentAt.UnixNano()
+	}
+	return d
+}
+
+func (d *diskLargeMessage) toLargeMessage() (*largeMessage, error) {
+	if len(d.ID) != cConstants.MessageIDLength {
+		return nil, fmt.Errorf("persistent queue: invalid large message ID length: %d", len(d.ID))
+	}
+	lm := &largeMessage{
+		id:        new([cConstants.MessageIDLength]byte),
+		fragments: d.Fragments,
+		sent:      d.Sent,
+		replied:   make(map[[cConstants.MessageIDLength]byte]bool),
+		failed:    d.Failed,
+		replyETA:  time.Duration(d.ReplyETA),
+		reply:     d.Reply,
+	}
+	copy(lm.id[:], d.ID)
+	for _, b := range d.Replied {
+		if len(b) != cConstants.MessageIDLength {
+			return nil, fmt.Errorf("persistent queue: invalid fragment ID length: %d", len(b))
+		}
+		var id [cConstants.MessageIDLength]byte
+		copy(id[:], b)
+		lm.replied[id] = true
+	}
+	if d.SentAt != 0 {
+		lm.sentAt = time.Unix(0, d.SentAt)
+	}
+	return lm, nil
+}
+
+// PersistentQueue is a bbolt backed implementation of EgressQueue whose
+// entries are encrypted at rest. In addition to the egress FIFO it keeps
+// track of reliable messages that were sent and are still awaiting a
+// SURB-ACK, and of the progress of the messages sent with
+// SendLargeMessage, so that a Session may resume retransmitting them
+// after a restart.
+type PersistentQueue struct {
+	sync.Mutex
+
+	db  *bolt.DB
+	key *[PersistentQueueKeySize]byte
+}
+
+// NewPersistentQueue creates (or loads) a persistent queue with the given
+// file name f. Entries are encrypted with key.
+func NewPersistentQueue(f string, key *[PersistentQueueKeySize]byte) (*PersistentQueue, error) {
+	db, err := bolt.Open(f, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := &PersistentQueue{
+		db:  db,
+		key: key,
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(egressBucket)); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(inflightBucket)); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(largeBucket)); err != nil {
+			return err
+		}
+		if b := bkt.Get([]byte(versionKey)); b != nil {
+			if len(b) != 1 || b[0] != persistentQueueVersion {
+				return fmt.Errorf("persistent queue: incompatible version: %d", uint(b[0]))
+			}
+			return nil
+		}
+		return bkt.Put([]byte(versionKey), []byte{persistentQueueVersion})
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *PersistentQueue) seal(v interface{}) ([]byte, error) {
+	plaintext, err := cbor.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	nonce := [persistentQueueNonceSize]byte{}
+	if _, err = rand.Reader.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plaintext, &nonce, q.key), nil
+}
+
+func (q *PersistentQueue) open(ciphertext []byte, v interface{}) error {
+	if len(ciphertext) < persistentQueueNonceSize {
+		return ErrDecryptQueueEntry
+	}
+	nonce := [persistentQueueNonceSize]byte{}
+	copy(nonce[:], ciphertext[:persistentQueueNonceSize])
+	plaintext, ok := secretbox.Open(nil, ciphertext[persistentQueueNonceSize:], &nonce, q.key)
+	if !ok {
+		return ErrDecryptQueueEntry
+	}
+	return cbor.Unmarshal(plaintext, v)
+}
+
+func (q *PersistentQueue) openMessage(ciphertext []byte) (*Message, error) {
+	d := new(diskMessage)
+	if err := q.open(ciphertext, d); err != nil {
+		return nil, err
+	}
+	return d.toMessage()
+}
+
+// Push pushes the given message onto the queue and returns nil
+// on success, otherwise an error is returned.
+func (q *PersistentQueue) Push(e Item) error {
+	return q.PushAll([]Item{e})
+}
+
+// PushAll pushes the given messages onto the queue and returns nil
+// on success, otherwise an error is returned and none of them are
+// pushed.
+func (q *PersistentQueue) PushAll(items []Item) error {
+	ciphertexts, err := q.sealItems(items)
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return pushEgress(tx, ciphertexts)
+	})
+}
+
+// pushLarge pushes the fragments of lm onto the queue, and records lm
+// in the same transaction.
+func (q *PersistentQueue) pushLarge(lm *largeMessage, items []Item) error {
+	ciphertexts, err := q.sealItems(items)
+	if err != nil {
+		return err
+	}
+	lmCiphertext, err := q.seal(toDiskLargeMessage(lm))
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if err := pushEgress(tx, ciphertexts); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(largeBucket)).Put(lm.id[:], lmCiphertext)
+	})
+}
+
+func (q *PersistentQueue) sealItems(items []Item) ([][]byte, error) {
+	ciphertexts := make([][]byte, 0, len(items))
+	for _, e := range items {
+		m, ok := e.(*Message)
+		if !ok {
+			return nil, errors.New("persistent queue: Not Implemented for non-Message types")
+		}
+		ciphertext, err := q.seal(toDiskMessage(m))
+		if err != nil {
+			return nil, err
+		}
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+	return ciphertexts, nil
+}
+
+func pushEgress(tx *bolt.Tx, ciphertexts [][]byte) error {
+	bkt := tx.Bucket([]byte(egressBucket))
+	if bkt.Stats().KeyN+len(ciphertexts) > cConstants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	for _, ciphertext := range ciphertexts {
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], seq)
+		if err = bkt.Put(k[:], ciphertext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Requeue pushes a tracked reliable message back onto the queue for
+// retransmission, and stops tracking it in the same transaction, so
+// that it is not also resumed after a restart.
+func (q *PersistentQueue) Requeue(m *Message) error {
+	ciphertext, err := q.seal(toDiskMessage(m))
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if err := pushEgress(tx, [][]byte{ciphertext}); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(inflightBucket)).Delete(m.ID[:])
+	})
+}
+
+// Pop pops the next message off the queue and returns nil
+// upon success, otherwise an error is returned.
+func (q *PersistentQueue) Pop() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	var m *Message
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte(egressBucket)).Cursor()
+		k, v := cur.First()
+		if k == nil {
+			return ErrQueueEmpty
+		}
+		var err error
+		if m, err = q.openMessage(v); err != nil {
+			return err
+		}
+		return cur.Delete()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Peek returns the next message from the queue without
+// modifying the queue.
+func (q *PersistentQueue) Peek() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	var m *Message
+	err := q.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket([]byte(egressBucket)).Cursor().First()
+		if k == nil {
+			return ErrQueueEmpty
+		}
+		var err error
+		m, err = q.openMessage(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Len returns the number of messages in the egress queue.
+func (q *PersistentQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	n := 0
+	q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket([]byte(egressBucket)).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// Track records a sent reliable message which is awaiting a SURB-ACK,
+// replacing any previous record for the same message ID.
+func (q *PersistentQueue) Track(m *Message) error {
+	ciphertext, err := q.seal(toDiskMessage(m))
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(inflightBucket)).Put(m.ID[:], ciphertext)
+	})
+}
+
+// Untrack removes the record of a reliable message, typically
+// because its SURB-ACK was received.
+func (q *PersistentQueue) Untrack(id *[cConstants.MessageIDLength]byte) error {
+	q.Lock()
+	defer q.Unlock()
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(inflightBucket)).Delete(id[:])
+	})
+}
+
+// Inflight returns all of the tracked reliable messages.
+func (q *PersistentQueue) Inflight() ([]*Message, error) {
+	q.Lock()
+	defer q.Unlock()
+	msgs := []*Message{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(inflightBucket)).ForEach(func(k, v []byte) error {
+			m, err := q.openMessage(v)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, m)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// trackLarge records the progress of lm, which must be locked by the
+// caller.
+func (q *PersistentQueue) trackLarge(lm *largeMessage) error {
+	ciphertext, err := q.seal(toDiskLargeMessage(lm))
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(largeBucket)).Put(lm.id[:], ciphertext)
+	})
+}
+
+// untrackLarge removes the record of a large message, typically because
+// all of its fragments were acknowledged.
+func (q *PersistentQueue) untrackLarge(id *[cConstants.MessageIDLength]byte) error {
+	q.Lock()
+	defer q.Unlock()
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(largeBucket)).Delete(id[:])
+	})
+}
+
+// largeMessages returns all of the tracked large messages.
+func (q *PersistentQueue) largeMessages() ([]*largeMessage, error) {
+	q.Lock()
+	defer q.Unlock()
+	lms := []*largeMessage{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(largeBucket)).ForEach(func(k, v []byte) error {
+			d := new(diskLargeMessage)
+			if err := q.open(v, d); err != nil {
+				return err
+			}
+			lm, err := d.toLargeMessage()
+			if err != nil {
+				return err
+			}
+			lms = append(lms, lm)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lms, nil
+}
+
+// Close closes the underlying database.
+func (q *PersistentQueue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+	q.db.Sync()
+	return q.db.Close()
+}
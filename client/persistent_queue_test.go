@@ -0,0 +1,154 @@
+// persistent_queue_test.go - Client crash-safe egress queue tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+)
+
+func newTestMessage(t *testing.T) *Message {
+	id := [constants.MessageIDLength]byte{}
+	_, err := io.ReadFull(rand.Reader, id[:])
+	require.NoError(t, err)
+	return &Message{
+		ID:        &id,
+		Recipient: "alice",
+		Provider:  "acme.com",
+		Payload:   []byte("hello"),
+		WithSURB:  true,
+		Reliable:  true,
+	}
+}
+
+func TestPersistentQueue(t *testing.T) {
+	require := require.New(t)
+
+	f := filepath.Join(t.TempDir(), "queue.db")
+	key := new([PersistentQueueKeySize]byte)
+	_, err := io.ReadFull(rand.Reader, key[:])
+	require.NoError(err)
+
+	q, err := NewPersistentQueue(f, key)
+	require.NoError(err)
+
+	_, err = q.Peek()
+	require.Equal(ErrQueueEmpty, err)
+	require.Error(q.Push(foo{"hello"}))
+
+	msgs := make([]*Message, constants.MaxEgressQueueSize)
+	for i := range msgs {
+		msgs[i] = newTestMessage(t)
+		require.NoError(q.Push(msgs[i]))
+	}
+	require.Equal(ErrQueueFull, q.Push(newTestMessage(t)))
+	require.Equal(constants.MaxEgressQueueSize, q.Len())
+
+	m, err := q.Peek()
+	require.NoError(err)
+	require.Equal(msgs[0].ID, m.(*Message).ID)
+	m, err = q.Pop()
+	require.NoError(err)
+	require.Equal(msgs[0].ID, m.(*Message).ID)
+	require.NoError(q.Close())
+
+	// The queue survives reopening, in order.
+	q, err = NewPersistentQueue(f, key)
+	require.NoError(err)
+	for i := 1; i < len(msgs); i++ {
+		m, err := q.Pop()
+		require.NoError(err)
+		require.Equal(msgs[i].ID, m.(*Message).ID)
+		require.Equal(msgs[i].Payload, m.(*Message).Payload)
+	}
+	_, err = q.Pop()
+	require.Equal(ErrQueueEmpty, err)
+
+	// Items pushed together are queued all or none.
+	batch := make([]Item, constants.MaxEgressQueueSize+1)
+	for i := range batch {
+		batch[i] = newTestMessage(t)
+	}
+	require.Equal(ErrQueueFull, q.PushAll(batch))
+	require.Equal(0, q.Len())
+	require.NoError(q.PushAll(batch[1:]))
+	require.Equal(constants.MaxEgressQueueSize, q.Len())
+	require.NoError(q.Close())
+}
+
+func TestPersistentQueueInflight(t *testing.T) {
+	require := require.New(t)
+
+	f := filepath.Join(t.TempDir(), "queue.db")
+	key := new([PersistentQueueKeySize]byte)
+	_, err := io.ReadFull(rand.Reader, key[:])
+	require.NoError(err)
+
+	q, err := NewPersistentQueue(f, key)
+	require.NoError(err)
+
+	msg := newTestMessage(t)
+	msg.SURBID = new([sConstants.SURBIDLength]byte)
+	_, err = io.ReadFull(rand.Reader, msg.SURBID[:])
+	require.NoError(err)
+	msg.Key = []byte("surb decryption keys")
+	msg.SentAt = time.Now()
+	msg.ReplyETA = 3 * time.Second
+	msg.Retransmissions = 2
+	msg.QueuePriority = uint64(msg.SentAt.UnixNano())
+	require.NoError(q.Track(msg))
+	require.NoError(q.Track(newTestMessage(t)))
+	require.NoError(q.Close())
+
+	// A different key can not read the entries.
+	badKey := new([PersistentQueueKeySize]byte)
+	q, err = NewPersistentQueue(f, badKey)
+	require.NoError(err)
+	_, err = q.Inflight()
+	require.Equal(ErrDecryptQueueEntry, err)
+	require.NoError(q.Close())
+
+	q, err = NewPersistentQueue(f, key)
+	require.NoError(err)
+	inflight, err := q.Inflight()
+	require.NoError(err)
+	require.Len(inflight, 2)
+
+	require.NoError(q.Untrack(inflight[1].ID))
+	require.NoError(q.Untrack(inflight[0].ID))
+	require.NoError(q.Track(msg))
+	inflight, err = q.Inflight()
+	require.NoError(err)
+	require.Len(inflight, 1)
+	m := inflight[0]
+	require.Equal(msg.ID, m.ID)
+	require.Equal(msg.SURBID, m.SURBID)
+	require.Equal(msg.Key, m.Key)
+	require.Equal(msg.ReplyETA, m.ReplyETA)
+	require.Equal(msg.Retransmissions, m.Retransmissions)
+	require.Equal(msg.QueuePriority, m.Priority())
+	require.True(msg.SentAt.Equal(m.SentAt))
+	require.True(m.Reliable)
+	require.NoError(q.Close())
+}
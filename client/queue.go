@@ -40,6 +40,10 @@ type EgressQueue interface {
 
 	// Push pushes the item onto the queue.
 	Push(Item) error
+
+	// PushAll pushes all of the items onto the queue, or none of them
+	// if they do not all fit.
+	PushAll([]Item) error
 }
 
 // Queue is our in-memory queue implementation used as our egress FIFO queue
@@ -66,6 +70,23 @@ func (q *Queue) Push(e Item) error {
 	return nil
 }
 
+// PushAll pushes the given message refs onto the queue and returns nil
+// on success, otherwise an error is returned and none of them are
+// pushed.
+func (q *Queue) PushAll(items []Item) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.len+len(items) > constants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	for _, e := range items {
+		q.content[q.writeHead] = e
+		q.writeHead = (q.writeHead + 1) % constants.MaxEgressQueueSize
+		q.len++
+	}
+	return nil
+}
+
 // Pop pops the next message ref off the queue and returns nil
 // upon success, otherwise an error is returned.
 func (q *Queue) Pop() (Item, error) {
@@ -28,7 +28,6 @@ import (
 	cConstants "github.com/katzenpost/katzenpost/client/constants"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
-	"github.com/katzenpost/katzenpost/core/epochtime"
 )
 
 var ErrReplyTimeout = errors.New("failure waiting for reply, timeout reached")
@@ -57,7 +56,15 @@ func (s *Session) doRetransmit(msg *Message) {
 	msg.Retransmissions++
 	msgIdStr := fmt.Sprintf("[%v]", hex.EncodeToString(msg.ID[:]))
 	s.log.Debugf("doRetransmit: %d for %s", msg.Retransmissions, msgIdStr)
-	s.egressQueue.Push(msg)
+	if s.persistentQueue == nil {
+		s.egressQueue.Push(msg)
+		return
+	}
+	// The message is persisted in the queue again until it is resent,
+	// and not as inflight, which would resend it twice after a restart.
+	if err := s.persistentQueue.Requeue(msg); err != nil {
+		s.log.Errorf("Failed to requeue reliable message %s: %s", msgIdStr, err)
+	}
 }
 
 func (s *Session) doSend(msg *Message) {
@@ -82,7 +89,7 @@ func (s *Session) doSend(msg *Message) {
 
 	// message was sent
 	if err == nil {
-		msg.SentAt = time.Now()
+		msg.SentAt = s.clock.Time()
 	}
 	// expect a reply
 	if msg.WithSURB {
@@ -95,8 +102,10 @@ func (s *Session) doSend(msg *Message) {
 			if msg.Reliable {
 				s.log.Debugf("Sending reliable message with retransmissions")
 				timeSlop := eta // add a round-trip worth of delay before timing out
-				msg.SetPriority(uint64(msg.SentAt.Add(msg.ReplyETA).Add(timeSlop).UnixNano()))
+				// the timer queue runs on the wall clock, not the session's
+				msg.SetPriority(uint64(time.Now().Add(msg.ReplyETA).Add(timeSlop).UnixNano()))
 				s.timerQ.Push(msg)
+				s.trackReliable(msg)
 			}
 		}
 		// write to waiting channel or close channel if message failed to send
@@ -119,6 +128,9 @@ func (s *Session) doSend(msg *Message) {
 			return
 		}
 	}
+	if s.onFragmentSent(msg, err) {
+		return
+	}
 	s.eventCh.In() <- &MessageSentEvent{
 		MessageID: msg.ID,
 		Err:       err,
@@ -201,6 +213,7 @@ func (s *Session) SendReliableMessage(recipient, provider string, message []byte
 	if err != nil {
 		return nil, err
 	}
+	s.onQueued()
 	return msg.ID, nil
 }
 
@@ -214,11 +227,12 @@ func (s *Session) SendUnreliableMessage(recipient, provider string, message []by
 	if err != nil {
 		return nil, err
 	}
+	s.onQueued()
 	return msg.ID, nil
 }
 
 func (s *Session) BlockingSendUnreliableMessage(recipient, provider string, message []byte) ([]byte, error) {
-	ctx, cancelFn := context.WithTimeout(context.Background(), epochtime.Period/32)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s.clock.Period()/32)
 	defer cancelFn()
 	return s.BlockingSendUnreliableMessageWithContext(ctx, recipient, provider, message)
 }
@@ -240,6 +254,7 @@ func (s *Session) BlockingSendUnreliableMessageWithContext(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
+	s.onQueued()
 
 	// wait until sent so that we know the ReplyETA for the waiting below
 	sentMessage := <-sentWaitChan
@@ -280,6 +295,7 @@ func (s *Session) BlockingSendReliableMessage(recipient, provider string, messag
 	if err != nil {
 		return nil, err
 	}
+	s.onQueued()
 
 	// wait until sent so that we know the ReplyETA for the waiting below
 	sentMessage := <-sentWaitChan
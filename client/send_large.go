@@ -0,0 +1,212 @@
+// send_large.go - mixnet client fragmented message send
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/client/fragment"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+// largeMessage tracks the fragments of a message sent with SendLargeMessage.
+type largeMessage struct {
+	sync.Mutex
+
+	id        *[cConstants.MessageIDLength]byte
+	fragments int
+	sent      int
+	replied   map[[cConstants.MessageIDLength]byte]bool
+	failed    bool
+	sentAt    time.Time
+	replyETA  time.Duration
+	reply     []byte
+}
+
+// MaxLargeMessageLength returns the largest message that may be sent
+// with SendLargeMessage.
+func (s *Session) MaxLargeMessageLength() int {
+	return cConstants.MaxEgressQueueSize * fragment.MaxDataLength(s.geo.UserForwardPayloadLength)
+}
+
+// SendLargeMessage asynchronously sends a message which may be larger
+// than a single Sphinx payload. The message is split into fragments
+// carrying a digest of the whole message, which are each sent with
+// automatic retransmissions. The recipient is expected to reassemble the
+// fragments with a fragment.Reassembler and to answer every fragment with
+// a fragment.Reply, as the Provider's Kaetzchen configured with the
+// "fragments" parameter do.
+//
+// A single MessageSentEvent is emitted once every fragment has been
+// sent, and a single MessageReplyEvent once every fragment has been
+// acknowledged, carrying the reply to the fragment that completed the
+// message.
+func (s *Session) SendLargeMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	if len(message) > s.MaxLargeMessageLength() {
+		return nil, fmt.Errorf("message too large: %v > %v", len(message), s.MaxLargeMessageLength())
+	}
+	id := [cConstants.MessageIDLength]byte{}
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	fragments, err := fragment.Split(&id, message, s.geo.UserForwardPayloadLength)
+	if err != nil {
+		return nil, err
+	}
+	lm := &largeMessage{
+		id:        &id,
+		fragments: len(fragments),
+		replied:   make(map[[cConstants.MessageIDLength]byte]bool),
+	}
+	// The fragments are queued all at once, so that a full queue does
+	// not leave some of them queued without being tracked.
+	msgs := make([]Item, len(fragments))
+	for i, f := range fragments {
+		msg, err := s.composeMessage(recipient, provider, f.Bytes(), false)
+		if err != nil {
+			return nil, err
+		}
+		msg.Reliable = true
+		msg.LargeMessageID = &id
+		msgs[i] = msg
+	}
+	s.fragmentMap.Store(id, lm)
+	if s.persistentQueue != nil {
+		err = s.persistentQueue.pushLarge(lm, msgs)
+	} else {
+		err = s.egressQueue.PushAll(msgs)
+	}
+	if err != nil {
+		s.fragmentMap.Delete(id)
+		return nil, err
+	}
+	s.onQueued()
+	return &id, nil
+}
+
+// largeMessage returns the large message that msg is a fragment of,
+// if any.
+func (s *Session) largeMessage(msg *Message) (*largeMessage, bool) {
+	if msg.LargeMessageID == nil {
+		return nil, false
+	}
+	rawLargeMessage, ok := s.fragmentMap.Load(*msg.LargeMessageID)
+	if !ok {
+		return nil, false
+	}
+	return rawLargeMessage.(*largeMessage), true
+}
+
+// trackLarge persists the progress of lm, which must be locked by the
+// caller, if the Session is configured with a PersistentQueue.
+func (s *Session) trackLarge(lm *largeMessage) {
+	if s.persistentQueue == nil {
+		return
+	}
+	if err := s.persistentQueue.trackLarge(lm); err != nil {
+		s.log.Errorf("Failed to persist large message %x: %s", *lm.id, err)
+	}
+}
+
+// untrackLarge removes a persisted large message once all of its
+// fragments have been ACKed.
+func (s *Session) untrackLarge(lm *largeMessage) {
+	if s.persistentQueue == nil {
+		return
+	}
+	if err := s.persistentQueue.untrackLarge(lm.id); err != nil {
+		s.log.Errorf("Failed to remove persisted large message %x: %s", *lm.id, err)
+	}
+}
+
+// onFragmentSent accounts for a sent fragment and reports whether the
+// message was a fragment.
+func (s *Session) onFragmentSent(msg *Message, err error) bool {
+	lm, ok := s.largeMessage(msg)
+	if !ok {
+		return msg.LargeMessageID != nil
+	}
+	lm.Lock()
+	defer lm.Unlock()
+	if lm.failed {
+		return true
+	}
+	if err != nil {
+		lm.failed = true
+		s.trackLarge(lm)
+		s.eventCh.In() <- &MessageSentEvent{
+			MessageID: lm.id,
+			Err:       err,
+		}
+		return true
+	}
+	if msg.Retransmissions > 0 {
+		return true
+	}
+	lm.sent++
+	if msg.SentAt.After(lm.sentAt) {
+		lm.sentAt = msg.SentAt
+	}
+	if msg.ReplyETA > lm.replyETA {
+		lm.replyETA = msg.ReplyETA
+	}
+	s.trackLarge(lm)
+	if lm.sent == lm.fragments {
+		s.eventCh.In() <- &MessageSentEvent{
+			MessageID: lm.id,
+			SentAt:    lm.sentAt,
+			ReplyETA:  lm.replyETA,
+		}
+	}
+	return true
+}
+
+// onFragmentReply accounts for a fragment reply and reports whether the
+// message was a fragment.
+func (s *Session) onFragmentReply(msg *Message, plaintext []byte) bool {
+	lm, ok := s.largeMessage(msg)
+	if !ok {
+		return msg.LargeMessageID != nil
+	}
+	lm.Lock()
+	defer lm.Unlock()
+	// A fragment resent after a restart may be acknowledged twice.
+	if lm.replied[*msg.ID] {
+		return true
+	}
+	reply, err := fragment.ReplyFromBytes(plaintext)
+	if err != nil {
+		s.log.Warningf("Discarding invalid fragment reply for %x: %s", *lm.id, err)
+	} else if reply.Complete {
+		lm.reply = reply.Payload
+	}
+	lm.replied[*msg.ID] = true
+	if len(lm.replied) < lm.fragments {
+		s.trackLarge(lm)
+	} else {
+		s.fragmentMap.Delete(*lm.id)
+		s.untrackLarge(lm)
+		s.eventCh.In() <- &MessageReplyEvent{
+			MessageID: lm.id,
+			Payload:   lm.reply,
+		}
+	}
+	return true
+}
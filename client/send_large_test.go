@@ -0,0 +1,66 @@
+// send_large_test.go - Large message sending tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+)
+
+func TestSendLargeMessageQueueFull(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	q := new(Queue)
+	s := &Session{
+		geo:         geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 1000, true, 5),
+		log:         logBackend.GetLogger("session"),
+		egressQueue: q,
+	}
+
+	// The queue has room for a single fragment.
+	for i := 0; i < constants.MaxEgressQueueSize-1; i++ {
+		require.NoError(q.Push(foo{"hello"}))
+	}
+	message := make([]byte, 2*s.geo.UserForwardPayloadLength)
+	_, err = s.SendLargeMessage("alice", "acme.com", message)
+	require.Equal(ErrQueueFull, err)
+
+	// None of the fragments were queued or are tracked.
+	require.Equal(constants.MaxEgressQueueSize-1, q.len)
+	s.fragmentMap.Range(func(k, v interface{}) bool {
+		t.Errorf("fragment %x is still tracked", k)
+		return true
+	})
+
+	// Once the queue drains, the whole message is queued.
+	for i := 0; i < constants.MaxEgressQueueSize-1; i++ {
+		_, err = q.Pop()
+		require.NoError(err)
+	}
+	id, err := s.SendLargeMessage("alice", "acme.com", message)
+	require.NoError(err)
+	require.NotNil(id)
+	require.True(q.len > 1)
+}
@@ -30,6 +30,7 @@ import (
 	cConstants "github.com/katzenpost/katzenpost/client/constants"
 	"github.com/katzenpost/katzenpost/client/utils"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx"
@@ -67,16 +68,62 @@ type Session struct {
 	hasPKIDoc bool
 	newPKIDoc chan bool
 
-	egressQueue EgressQueue
-	timerQ      *TimerQueue
+	egressQueue     EgressQueue
+	persistentQueue *PersistentQueue
+	timerQ          *TimerQueue
+
+	trafficPolicy TrafficPolicy
+
+	clock epochtime.Clock
 
 	surbIDMap        sync.Map // [sConstants.SURBIDLength]byte -> *Message
 	sentWaitChanMap  sync.Map // MessageID -> chan *Message
 	replyWaitChanMap sync.Map // MessageID -> chan []byte
+	fragmentMap      sync.Map // LargeMessageID -> *largeMessage
 
 	decoyLoopTally uint64
 }
 
+// SessionOption is an optional setting passed to NewSession.
+type SessionOption func(*Session)
+
+// WithPersistentQueue configures the Session to use the given
+// PersistentQueue as its egress queue. Any messages left in the queue
+// by a previous Session are sent, and reliable messages that were still
+// awaiting a SURB-ACK are scheduled for retransmission.
+func WithPersistentQueue(q *PersistentQueue) SessionOption {
+	return func(s *Session) {
+		s.egressQueue = q
+		s.persistentQueue = q
+	}
+}
+
+// WithTrafficPolicy configures the Session to use the given TrafficPolicy
+// instead of the one selected by the client configuration.
+func WithTrafficPolicy(p TrafficPolicy) SessionOption {
+	return func(s *Session) {
+		s.trafficPolicy = p
+	}
+}
+
+// WithClock configures the Session and its minclient to use the given
+// Clock instead of the system time, so that tests can simulate epochs.
+func WithClock(clock epochtime.Clock) SessionOption {
+	return func(s *Session) {
+		s.clock = clock
+	}
+}
+
+// sessionClock returns the Clock that the options configure a Session
+// with.
+func sessionClock(opts []SessionOption) epochtime.Clock {
+	s := &Session{clock: epochtime.WallClock}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s.clock
+}
+
 // New establishes a session with provider using key.
 // This method will block until session is connected to the Provider.
 func NewSession(
@@ -87,7 +134,8 @@ func NewSession(
 	logBackend *log.Backend,
 	cfg *config.Config,
 	linkKey wire.PrivateKey,
-	provider *pki.MixDescriptor) (*Session, error) {
+	provider *pki.MixDescriptor,
+	opts ...SessionOption) (*Session, error) {
 
 	clientLog := logBackend.GetLogger(fmt.Sprintf("%s_client", provider.Name))
 
@@ -111,9 +159,26 @@ func NewSession(
 		EventSink:   make(chan Event),
 		opCh:        make(chan workerOp, 8),
 		egressQueue: new(Queue),
+		clock:       epochtime.WallClock,
+	}
+	if cfg.Traffic != nil {
+		s.trafficPolicy, err = NewTrafficPolicy(cfg.Traffic)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.trafficPolicy = new(LoopixPolicy)
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 	// Configure the timerQ instance
 	s.timerQ = NewTimerQueue(s)
+	if s.persistentQueue != nil {
+		if err := s.resumeInflight(); err != nil {
+			return nil, err
+		}
+	}
 	// Configure and bring up the minclient instance.
 	idHash := s.linkKey.PublicKey().Sum256()
 	// A per-connection tag (for Tor SOCKS5 stream isloation)
@@ -135,6 +200,7 @@ func NewSession(
 		PreferedTransports:  cfg.Debug.PreferedTransports,
 		MessagePollInterval: time.Duration(cfg.Debug.PollingInterval) * time.Millisecond,
 		EnableTimeSync:      false, // Be explicit about it.
+		Clock:               s.clock,
 	}
 
 	s.timerQ.Go(s.timerQ.worker)
@@ -205,7 +271,7 @@ func (s *Session) garbageCollect() {
 	surbIDMapRange := func(rawSurbID, rawMessage interface{}) bool {
 		surbID := rawSurbID.([sConstants.SURBIDLength]byte)
 		message := rawMessage.(*Message)
-		if time.Now().After(message.SentAt.Add(message.ReplyETA).Add(cConstants.RoundTripTimeSlop)) {
+		if s.clock.Time().After(message.SentAt.Add(message.ReplyETA).Add(cConstants.RoundTripTimeSlop)) {
 			s.log.Debug("Garbage collecting SURB ID Map entry for Message ID %x", message.ID)
 			s.surbIDMap.Delete(surbID)
 			s.eventCh.In() <- &MessageIDGarbageCollected{
@@ -302,6 +368,9 @@ func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte
 		s.decrementDecoyLoopTally()
 		return nil
 	}
+	// The message is only forgotten once the reply was handled, so that
+	// a fragment's reply is recorded before it is.
+	defer s.untrackReliable(msg)
 
 	if msg.IsBlocking {
 		replyWaitChanRaw, ok := s.replyWaitChanMap.Load(*msg.ID)
@@ -319,7 +388,7 @@ func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte
 			s.log.Warningf("Failed to respond to a blocking message")
 			close(replyWaitChan)
 		}
-	} else {
+	} else if !s.onFragmentReply(msg, plaintext) {
 		s.eventCh.In() <- &MessageReplyEvent{
 			MessageID: msg.ID,
 			Payload:   plaintext,
@@ -354,6 +423,33 @@ func (s *Session) onDocument(doc *pki.Document) {
 	}
 }
 
+// SetBackgrounded informs the TrafficPolicy whether or not the
+// application is in the background.
+func (s *Session) SetBackgrounded(backgrounded bool) {
+	select {
+	case <-s.HaltCh():
+	case s.opCh <- opBackgrounded{backgrounded: backgrounded}:
+	}
+}
+
+// SetUserActive informs the TrafficPolicy whether or not the user
+// is actively using the application.
+func (s *Session) SetUserActive(active bool) {
+	select {
+	case <-s.HaltCh():
+	case s.opCh <- opUserActive{active: active}:
+	}
+}
+
+// onQueued informs the TrafficPolicy that messages were queued, without
+// waiting for the worker, which updates the rates after every op anyway.
+func (s *Session) onQueued() {
+	select {
+	case s.opCh <- opQueued{}:
+	default:
+	}
+}
+
 func (s *Session) CurrentDocument() *pki.Document {
 	return s.minclient.CurrentDocument()
 }
@@ -373,6 +469,56 @@ func (s *Session) Push(i Item) error {
 	return nil
 }
 
+// resumeInflight restores the reliable messages persisted by a previous
+// Session so that SURB-ACKs for them are still recognized and, failing
+// that, they are retransmitted, along with the progress of the large
+// messages they are fragments of.
+func (s *Session) resumeInflight() error {
+	lms, err := s.persistentQueue.largeMessages()
+	if err != nil {
+		return err
+	}
+	for _, lm := range lms {
+		s.log.Debugf("Resuming large message %x with %d of %d fragments acknowledged", *lm.id, len(lm.replied), lm.fragments)
+		s.fragmentMap.Store(*lm.id, lm)
+	}
+	msgs, err := s.persistentQueue.Inflight()
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if msg.SURBID == nil {
+			continue
+		}
+		s.log.Debugf("Resuming reliable message %x with %d retransmissions", *msg.ID, msg.Retransmissions)
+		s.surbIDMap.Store(*msg.SURBID, msg)
+		s.timerQ.Push(msg)
+	}
+	return nil
+}
+
+// trackReliable persists a sent reliable message, if the Session is
+// configured with a PersistentQueue.
+func (s *Session) trackReliable(msg *Message) {
+	if s.persistentQueue == nil || !msg.Reliable || msg.IsBlocking {
+		return
+	}
+	if err := s.persistentQueue.Track(msg); err != nil {
+		s.log.Errorf("Failed to persist reliable message %x: %s", *msg.ID, err)
+	}
+}
+
+// untrackReliable removes a persisted reliable message once it has
+// been ACKed.
+func (s *Session) untrackReliable(msg *Message) {
+	if s.persistentQueue == nil || !msg.Reliable || msg.IsBlocking {
+		return
+	}
+	if err := s.persistentQueue.Untrack(msg.ID); err != nil {
+		s.log.Errorf("Failed to remove persisted reliable message %x: %s", *msg.ID, err)
+	}
+}
+
 func (s *Session) GetLogger(component string) *logging.Logger {
 	return s.logBackend.GetLogger(component)
 }
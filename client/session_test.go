@@ -0,0 +1,156 @@
+// session_test.go - Session restart tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+
+	"github.com/katzenpost/katzenpost/client/fragment"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+)
+
+// openTestSession opens the persistent queue f and resumes a Session
+// from it the way NewSession does, without connecting to a Provider.
+func openTestSession(t *testing.T, f string, key *[PersistentQueueKeySize]byte) *Session {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	q, err := NewPersistentQueue(f, key)
+	require.NoError(t, err)
+	s := &Session{
+		geo:     geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 1000, true, 5),
+		log:     logBackend.GetLogger("session"),
+		eventCh: channels.NewInfiniteChannel(),
+	}
+	WithPersistentQueue(q)(s)
+	s.timerQ = NewTimerQueue(s)
+	require.NoError(t, s.resumeInflight())
+	return s
+}
+
+// testSend does what doSend does for a reliable message which was
+// sent, without sending it.
+func testSend(t *testing.T, s *Session, msg *Message) {
+	msg.SURBID = new([sConstants.SURBIDLength]byte)
+	_, err := io.ReadFull(rand.Reader, msg.SURBID[:])
+	require.NoError(t, err)
+	msg.SentAt = time.Now()
+	s.surbIDMap.Store(*msg.SURBID, msg)
+	s.trackReliable(msg)
+	s.onFragmentSent(msg, nil)
+}
+
+// pending returns the number of messages the Session would send.
+func pending(s *Session) int {
+	return s.egressQueue.(*PersistentQueue).Len() + s.timerQ.priq.Len()
+}
+
+func TestSessionRestartRetransmit(t *testing.T) {
+	require := require.New(t)
+
+	f := filepath.Join(t.TempDir(), "queue.db")
+	key := new([PersistentQueueKeySize]byte)
+	_, err := io.ReadFull(rand.Reader, key[:])
+	require.NoError(err)
+
+	s := openTestSession(t, f, key)
+	msg := newTestMessage(t)
+	testSend(t, s, msg)
+	require.NoError(s.persistentQueue.Close())
+
+	// A message that was sent is resumed once.
+	s = openTestSession(t, f, key)
+	require.Equal(1, pending(s))
+
+	// As is a message which was queued for retransmission.
+	inflight, err := s.persistentQueue.Inflight()
+	require.NoError(err)
+	require.Len(inflight, 1)
+	s.doRetransmit(inflight[0])
+	require.NoError(s.persistentQueue.Close())
+	s = openTestSession(t, f, key)
+	defer s.persistentQueue.Close()
+	require.Equal(1, pending(s))
+	m, err := s.egressQueue.Peek()
+	require.NoError(err)
+	require.Equal(msg.ID, m.(*Message).ID)
+	require.EqualValues(1, m.(*Message).Retransmissions)
+}
+
+func TestSessionRestartLargeMessage(t *testing.T) {
+	require := require.New(t)
+
+	f := filepath.Join(t.TempDir(), "queue.db")
+	key := new([PersistentQueueKeySize]byte)
+	_, err := io.ReadFull(rand.Reader, key[:])
+	require.NoError(err)
+
+	s := openTestSession(t, f, key)
+	message := make([]byte, 2*s.geo.UserForwardPayloadLength)
+	id, err := s.SendLargeMessage("alice", "acme.com", message)
+	require.NoError(err)
+	fragments := s.egressQueue.(*PersistentQueue).Len()
+	require.Equal(3, fragments)
+	for i := 0; i < fragments; i++ {
+		m, err := s.egressQueue.Pop()
+		require.NoError(err)
+		testSend(t, s, m.(*Message))
+	}
+	sent := (<-s.eventCh.Out()).(*MessageSentEvent)
+	require.Equal(id, sent.MessageID)
+
+	// The first fragment is acknowledged before the restart.
+	inflight, err := s.persistentQueue.Inflight()
+	require.NoError(err)
+	first := inflight[0]
+	require.True(s.onFragmentReply(first, (&fragment.Reply{}).Bytes()))
+	s.untrackReliable(first)
+	require.NoError(s.persistentQueue.Close())
+
+	// The replies to the remaining fragments, and a stray reply to the
+	// first one, complete the message after the restart.
+	s = openTestSession(t, f, key)
+	defer s.persistentQueue.Close()
+	inflight, err = s.persistentQueue.Inflight()
+	require.NoError(err)
+	require.Len(inflight, fragments-1)
+	require.True(s.onFragmentReply(first, (&fragment.Reply{}).Bytes()))
+	for i, m := range inflight {
+		reply := &fragment.Reply{Complete: i == len(inflight)-1, Payload: []byte("ok")}
+		require.True(s.onFragmentReply(m, reply.Bytes()))
+	}
+	select {
+	case e := <-s.eventCh.Out():
+		event := e.(*MessageReplyEvent)
+		require.Equal(id, event.MessageID)
+		require.Equal([]byte("ok"), event.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("no MessageReplyEvent")
+	}
+	require.Zero(s.eventCh.Len())
+	lms, err := s.persistentQueue.largeMessages()
+	require.NoError(err)
+	require.Empty(lms)
+}
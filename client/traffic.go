@@ -0,0 +1,152 @@
+// traffic.go - mixnet client traffic shaping policies
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+// TrafficState is the application state consulted by a TrafficPolicy.
+type TrafficState struct {
+	// Backgrounded is true iff the application is in the background.
+	Backgrounded bool
+
+	// UserActive is true iff the user is actively using the application.
+	UserActive bool
+
+	// HasQueuedMessages is true iff the egress queue is not empty.
+	HasQueuedMessages bool
+}
+
+// TrafficRates are the Poisson rates and maximum delays, in milliseconds,
+// used by the Session worker's send timers.
+type TrafficRates struct {
+	LambdaP         float64
+	LambdaPMaxDelay uint64
+	LambdaL         float64
+	LambdaLMaxDelay uint64
+	LambdaD         float64
+	LambdaDMaxDelay uint64
+}
+
+// TrafficPolicy decides the rates at which the Session worker sends
+// messages from the egress queue, loop decoys and drop decoys.
+type TrafficPolicy interface {
+	// Name returns the name of the policy.
+	Name() string
+
+	// Rates returns the rates to use given the current PKI document
+	// and application state.
+	Rates(doc *pki.Document, state *TrafficState) *TrafficRates
+}
+
+// NewTrafficPolicy returns the TrafficPolicy selected by the given
+// traffic configuration.
+func NewTrafficPolicy(cfg *config.Traffic) (TrafficPolicy, error) {
+	switch cfg.Policy {
+	case config.TrafficPolicyLoopix, "":
+		return new(LoopixPolicy), nil
+	case config.TrafficPolicyMobile:
+		return &MobilePolicy{BackgroundFactor: cfg.BackgroundFactor}, nil
+	case config.TrafficPolicyBursty:
+		return &BurstyPolicy{BurstFactor: cfg.BurstFactor}, nil
+	}
+	return nil, fmt.Errorf("unknown traffic policy: %v", cfg.Policy)
+}
+
+func documentRates(doc *pki.Document) *TrafficRates {
+	return &TrafficRates{
+		LambdaP:         doc.LambdaP,
+		LambdaPMaxDelay: doc.LambdaPMaxDelay,
+		LambdaL:         doc.LambdaL,
+		LambdaLMaxDelay: doc.LambdaLMaxDelay,
+		LambdaD:         doc.LambdaD,
+		LambdaDMaxDelay: doc.LambdaDMaxDelay,
+	}
+}
+
+// LoopixPolicy sends at the rates specified by the PKI document.
+type LoopixPolicy struct{}
+
+// Name returns the name of the policy.
+func (p *LoopixPolicy) Name() string {
+	return config.TrafficPolicyLoopix
+}
+
+// Rates returns the rates specified by the PKI document.
+func (p *LoopixPolicy) Rates(doc *pki.Document, state *TrafficState) *TrafficRates {
+	return documentRates(doc)
+}
+
+// MobilePolicy reduces the egress queue send rate, and the decoy loop and
+// drop rates, by BackgroundFactor while the application is backgrounded.
+// The send intervals remain capped by the maximum delays specified in the
+// PKI document, so that queued messages are still sent within
+// LambdaPMaxDelay.
+type MobilePolicy struct {
+	BackgroundFactor float64
+}
+
+// Name returns the name of the policy.
+func (p *MobilePolicy) Name() string {
+	return config.TrafficPolicyMobile
+}
+
+// Rates returns the rates to use given the application state.
+func (p *MobilePolicy) Rates(doc *pki.Document, state *TrafficState) *TrafficRates {
+	rates := documentRates(doc)
+	if state.Backgrounded && p.BackgroundFactor > 1 {
+		rates.LambdaP /= p.BackgroundFactor
+		rates.LambdaL /= p.BackgroundFactor
+		rates.LambdaD /= p.BackgroundFactor
+	}
+	return rates
+}
+
+// BurstyPolicy multiplies the egress queue send rate by BurstFactor while
+// the user is active and there are queued messages. The total send rate
+// never exceeds the SendRatePerMinute specified in the PKI document.
+type BurstyPolicy struct {
+	BurstFactor float64
+}
+
+// Name returns the name of the policy.
+func (p *BurstyPolicy) Name() string {
+	return config.TrafficPolicyBursty
+}
+
+// Rates returns the rates to use given the application state.
+func (p *BurstyPolicy) Rates(doc *pki.Document, state *TrafficState) *TrafficRates {
+	rates := documentRates(doc)
+	if !state.UserActive || !state.HasQueuedMessages || p.BurstFactor <= 1 {
+		return rates
+	}
+	lambdaP := rates.LambdaP * p.BurstFactor
+	if doc.SendRatePerMinute != 0 {
+		// Rates are per millisecond.
+		maxLambdaP := float64(doc.SendRatePerMinute)/60000 - rates.LambdaL - rates.LambdaD
+		if lambdaP > maxLambdaP {
+			lambdaP = maxLambdaP
+		}
+	}
+	if lambdaP > rates.LambdaP {
+		rates.LambdaP = lambdaP
+	}
+	return rates
+}
@@ -0,0 +1,94 @@
+// traffic_test.go - mixnet client traffic shaping policy tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+func testTrafficDocument() *pki.Document {
+	return &pki.Document{
+		SendRatePerMinute: 600,
+		LambdaP:           0.001,
+		LambdaPMaxDelay:   3000,
+		LambdaL:           0.0005,
+		LambdaLMaxDelay:   9000,
+		LambdaD:           0.0005,
+		LambdaDMaxDelay:   9000,
+	}
+}
+
+func TestNewTrafficPolicy(t *testing.T) {
+	require := require.New(t)
+
+	for _, name := range []string{config.TrafficPolicyLoopix, config.TrafficPolicyMobile, config.TrafficPolicyBursty} {
+		p, err := NewTrafficPolicy(&config.Traffic{Policy: name})
+		require.NoError(err)
+		require.Equal(name, p.Name())
+	}
+	_, err := NewTrafficPolicy(&config.Traffic{Policy: "turbo"})
+	require.Error(err)
+}
+
+func TestLoopixPolicy(t *testing.T) {
+	require := require.New(t)
+
+	doc := testTrafficDocument()
+	p := new(LoopixPolicy)
+	state := &TrafficState{Backgrounded: true, UserActive: true, HasQueuedMessages: true}
+	require.Equal(documentRates(doc), p.Rates(doc, state))
+}
+
+func TestMobilePolicy(t *testing.T) {
+	require := require.New(t)
+
+	doc := testTrafficDocument()
+	p := &MobilePolicy{BackgroundFactor: 4}
+	require.Equal(documentRates(doc), p.Rates(doc, &TrafficState{}))
+
+	rates := p.Rates(doc, &TrafficState{Backgrounded: true})
+	require.Equal(doc.LambdaP/4, rates.LambdaP)
+	require.Equal(doc.LambdaL/4, rates.LambdaL)
+	require.Equal(doc.LambdaD/4, rates.LambdaD)
+	// The maximum delays of the consensus still apply.
+	require.Equal(doc.LambdaPMaxDelay, rates.LambdaPMaxDelay)
+	require.Equal(doc.LambdaLMaxDelay, rates.LambdaLMaxDelay)
+	require.Equal(doc.LambdaDMaxDelay, rates.LambdaDMaxDelay)
+}
+
+func TestBurstyPolicy(t *testing.T) {
+	require := require.New(t)
+
+	doc := testTrafficDocument()
+	p := &BurstyPolicy{BurstFactor: 1000}
+	require.Equal(documentRates(doc), p.Rates(doc, &TrafficState{UserActive: true}))
+	require.Equal(documentRates(doc), p.Rates(doc, &TrafficState{HasQueuedMessages: true}))
+
+	// The burst is limited by the send rate limit.
+	rates := p.Rates(doc, &TrafficState{UserActive: true, HasQueuedMessages: true})
+	maxRate := float64(doc.SendRatePerMinute) / 60000
+	require.InDelta(maxRate, rates.LambdaP+rates.LambdaL+rates.LambdaD, 1e-12)
+
+	p = &BurstyPolicy{BurstFactor: 2}
+	rates = p.Rates(doc, &TrafficState{UserActive: true, HasQueuedMessages: true})
+	require.Equal(doc.LambdaP*2, rates.LambdaP)
+	require.Equal(doc.LambdaL, rates.LambdaL)
+}
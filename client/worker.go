@@ -43,6 +43,16 @@ type opRetransmit struct {
 	msg *Message
 }
 
+type opBackgrounded struct {
+	backgrounded bool
+}
+
+type opUserActive struct {
+	active bool
+}
+
+type opQueued struct{}
+
 func (s *Session) connStatusChange(op opConnStatusChanged) bool {
 	isConnected := op.isConnected
 	if isConnected {
@@ -77,9 +87,9 @@ func (s *Session) worker() {
 	var (
 		doc             *pki.Document
 		loopServices    []utils.ServiceDescriptor
-		lambdaP         float64
-		lambdaL         float64
-		lambdaD         float64
+		trafficState    TrafficState
+		rates           *TrafficRates
+		lastRates       TrafficRates
 		lambdaPMsec     uint64
 		lambdaLMsec     uint64
 		lambdaDMsec     uint64
@@ -89,9 +99,6 @@ func (s *Session) worker() {
 		lambdaPInterval = time.Duration(maxDuration)
 		lambdaLInterval = time.Duration(maxDuration)
 		lambdaDInterval = time.Duration(maxDuration)
-		lambdaPMaxDelay = uint64(maxDuration)
-		lambdaLMaxDelay = uint64(maxDuration)
-		lambdaDMaxDelay = uint64(maxDuration)
 	)
 
 	defer s.log.Debug("session worker halted")
@@ -129,6 +136,14 @@ func (s *Session) worker() {
 				newConnectedStatus := s.connStatusChange(op)
 				isConnected = newConnectedStatus
 				mustResetAllTimers = true
+			case opBackgrounded:
+				trafficState.Backgrounded = op.backgrounded
+				mustResetAllTimers = true
+			case opUserActive:
+				trafficState.UserActive = op.active
+				mustResetAllTimers = true
+			case opQueued:
+				// the rates are updated below
 			case opNewDocument:
 				err := s.isDocValid(op.doc)
 				if err != nil {
@@ -136,9 +151,6 @@ func (s *Session) worker() {
 				}
 
 				doc = op.doc
-				lambdaP = doc.LambdaP
-				lambdaL = doc.LambdaL
-				lambdaD = doc.LambdaD
 
 				// update the loop service descriptors
 				loopServices = utils.FindServices(cConstants.LoopService, doc)
@@ -167,19 +179,34 @@ func (s *Session) worker() {
 			}
 		}
 		if isConnected && doc != nil {
-			lambdaPMsec = uint64(rand.Exp(mRng, lambdaP))
-			if lambdaPMsec > lambdaPMaxDelay {
-				lambdaPMsec = lambdaPMaxDelay
+			_, err := s.egressQueue.Peek()
+			trafficState.HasQueuedMessages = err == nil
+			rates = s.trafficPolicy.Rates(doc, &trafficState)
+			if *rates != lastRates {
+				// reschedule the timers, or the new rates would only
+				// apply once they fire
+				mustResetAllTimers = true
+				lastRates = *rates
+				s.eventCh.In() <- &TrafficPolicyEvent{
+					Policy: s.trafficPolicy.Name(),
+					State:  trafficState,
+					Rates:  lastRates,
+				}
+			}
+
+			lambdaPMsec = uint64(rand.Exp(mRng, rates.LambdaP))
+			if rates.LambdaPMaxDelay != 0 && lambdaPMsec > rates.LambdaPMaxDelay {
+				lambdaPMsec = rates.LambdaPMaxDelay
 			}
 			lambdaPInterval = time.Duration(lambdaPMsec) * time.Millisecond
-			lambdaLMsec = uint64(rand.Exp(mRng, lambdaL))
-			if lambdaLMsec > lambdaLMaxDelay {
-				lambdaLMsec = lambdaLMaxDelay
+			lambdaLMsec = uint64(rand.Exp(mRng, rates.LambdaL))
+			if rates.LambdaLMaxDelay != 0 && lambdaLMsec > rates.LambdaLMaxDelay {
+				lambdaLMsec = rates.LambdaLMaxDelay
 			}
 			lambdaLInterval = time.Duration(lambdaLMsec) * time.Millisecond
-			lambdaDMsec = uint64(rand.Exp(mRng, lambdaD))
-			if lambdaDMsec > lambdaDMaxDelay {
-				lambdaDMsec = lambdaDMaxDelay
+			lambdaDMsec = uint64(rand.Exp(mRng, rates.LambdaD))
+			if rates.LambdaDMaxDelay != 0 && lambdaDMsec > rates.LambdaDMaxDelay {
+				lambdaDMsec = rates.LambdaDMaxDelay
 			}
 			lambdaDInterval = time.Duration(lambdaDMsec) * time.Millisecond
 		} else {
@@ -0,0 +1,221 @@
+// clock.go - Katzenpost epoch clocks.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package epochtime
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time and Katzenpost epochs, which may be replaced
+// with a FakeClock to exercise epoch transitions in tests.
+type Clock interface {
+	// Now returns the current epoch, time since the start of the
+	// current epoch, and time till the next epoch.
+	Now() (current uint64, elapsed, till time.Duration)
+
+	// Time returns the current time.
+	Time() time.Time
+
+	// Period returns the duration of an epoch.
+	Period() time.Duration
+
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer returns a Timer which sends the current time on its
+	// channel once the duration elapses, and which the caller must stop
+	// if it stops waiting for it.
+	NewTimer(d time.Duration) *Timer
+}
+
+// Timer is a single event of a Clock, like a time.Timer.
+type Timer struct {
+	// C receives the time once the duration of the Timer elapses.
+	C <-chan time.Time
+
+	stop func() bool
+}
+
+// Stop prevents the Timer from firing, and returns false if it already
+// fired or was stopped.
+func (t *Timer) Stop() bool {
+	return t.stop()
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() (current uint64, elapsed, till time.Duration) {
+	return Now()
+}
+
+func (wallClock) Time() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Period() time.Duration {
+	return Period
+}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (wallClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{C: t.C, stop: t.Stop}
+}
+
+// WallClock is the Clock of the system time, with epochs of Period.
+var WallClock Clock = wallClock{}
+
+// OrWallClock returns clock, or WallClock if clock is nil.
+func OrWallClock(clock Clock) Clock {
+	if clock == nil {
+		return WallClock
+	}
+	return clock
+}
+
+// At returns the epoch of the time t, time since the start of that epoch
+// and time till the next epoch, with epochs of the clock's period.
+func At(clock Clock, t time.Time) (current uint64, elapsed, till time.Duration) {
+	return getEpochWithPeriod(t, clock.Period())
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// FakeClock is a Clock whose time only changes when it is advanced.
+type FakeClock struct {
+	sync.Mutex
+
+	now    time.Time
+	period time.Duration
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock set to now, with epochs of period.
+func NewFakeClock(now time.Time, period time.Duration) *FakeClock {
+	return &FakeClock{
+		now:    now,
+		period: period,
+	}
+}
+
+// NewFakeClockAtEpoch returns a FakeClock set to the given time into an
+// epoch, with epochs of period.
+func NewFakeClockAtEpoch(epoch uint64, elapsed, period time.Duration) *FakeClock {
+	return NewFakeClock(Epoch.Add(time.Duration(epoch)*period+elapsed), period)
+}
+
+// Now returns the current epoch, time since the start of the current
+// epoch, and time till the next epoch.
+func (c *FakeClock) Now() (current uint64, elapsed, till time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	return getEpochWithPeriod(c.now, c.period)
+}
+
+// Time returns the current time.
+func (c *FakeClock) Time() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Period returns the duration of an epoch.
+func (c *FakeClock) Period() time.Duration {
+	return c.period
+}
+
+// After returns a channel which receives the time once the clock is
+// advanced by d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C
+}
+
+// NewTimer returns a Timer which fires once the clock is advanced by d,
+// and which is forgotten once stopped.
+func (c *FakeClock) NewTimer(d time.Duration) *Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{
+		deadline: c.now.Add(d),
+		ch:       make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.ch <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return &Timer{C: t.ch, stop: func() bool { return c.stop(t) }}
+}
+
+// stop removes a timer which did not fire yet.
+func (c *FakeClock) stop(t *fakeTimer) bool {
+	c.Lock()
+	defer c.Unlock()
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, and fires the timers which
+// expire meanwhile.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = timers
+}
+
+// AdvanceToEpoch moves the clock forward to the given time into an
+// epoch, which must not be in the past.
+func (c *FakeClock) AdvanceToEpoch(epoch uint64, elapsed time.Duration) {
+	c.Lock()
+	d := Epoch.Add(time.Duration(epoch)*c.period + elapsed).Sub(c.now)
+	c.Unlock()
+	if d < 0 {
+		panic("epochtime: BUG: FakeClock moved backwards")
+	}
+	c.Advance(d)
+}
+
+// Timers returns the number of pending timers, so that tests can wait
+// for a worker to go to sleep before advancing the clock.  The timers
+// which are stopped are not counted, so the workers which may stop
+// waiting for a timer must create it with NewTimer and stop it.
+func (c *FakeClock) Timers() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
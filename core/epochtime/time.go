@@ -58,16 +58,20 @@ func FromUnix(t int64) (current uint64, elapsed, till time.Duration) {
 }
 
 func getEpoch(t time.Time) (current uint64, elapsed, till time.Duration) {
+	return getEpochWithPeriod(t, Period)
+}
+
+func getEpochWithPeriod(t time.Time, period time.Duration) (current uint64, elapsed, till time.Duration) {
 	fromEpoch := t.Sub(Epoch)
 	if fromEpoch < 0 {
 		panic("epochtime: BUG: time appears to predate the epoch")
 	}
 
-	current = uint64(fromEpoch / Period)
+	current = uint64(fromEpoch / period)
 
-	base := Epoch.Add(time.Duration(current) * Period)
+	base := Epoch.Add(time.Duration(current) * period)
 	elapsed = t.Sub(base)
-	till = base.Add(Period).Sub(t)
+	till = base.Add(period).Sub(t)
 	return
 }
 
@@ -46,3 +46,62 @@ func TestIsInEpoch(t *testing.T) {
 	prevNow := now - 3*60*60
 	assert.False(IsInEpoch(e, prevNow), "IsInEpoch(e, now-3h)")
 }
+
+func TestFakeClock(t *testing.T) {
+	require := require.New(t)
+
+	period := time.Minute
+	clock := NewFakeClockAtEpoch(100, 10*time.Second, period)
+	epoch, elapsed, till := clock.Now()
+	require.Equal(uint64(100), epoch)
+	require.Equal(10*time.Second, elapsed)
+	require.Equal(50*time.Second, till)
+	require.Equal(period, clock.Period())
+
+	soon := clock.After(20 * time.Second)
+	later := clock.After(period)
+	require.Equal(2, clock.Timers())
+	clock.Advance(30 * time.Second)
+	select {
+	case now := <-soon:
+		require.Equal(clock.Time(), now)
+	default:
+		t.Fatal("timer did not fire")
+	}
+	select {
+	case <-later:
+		t.Fatal("timer fired early")
+	default:
+	}
+	require.Equal(1, clock.Timers())
+
+	clock.AdvanceToEpoch(102, 0)
+	<-later
+	epoch, elapsed, _ = clock.Now()
+	require.Equal(uint64(102), epoch)
+	require.Zero(elapsed)
+	require.Panics(func() { clock.AdvanceToEpoch(101, 0) })
+
+	// expired timers fire right away
+	<-clock.After(0)
+
+	// stopped timers are forgotten, and do not fire
+	timer := clock.NewTimer(time.Second)
+	require.Equal(1, clock.Timers())
+	require.True(timer.Stop())
+	require.Zero(clock.Timers())
+	require.False(timer.Stop())
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C:
+		t.Fatal("stopped timer fired")
+	default:
+	}
+	timer = clock.NewTimer(time.Second)
+	clock.Advance(time.Second)
+	require.False(timer.Stop())
+	<-timer.C
+
+	require.Equal(Period, OrWallClock(nil).Period())
+	require.Equal(clock, OrWallClock(clock))
+}
@@ -143,6 +143,21 @@ func (b *Backend) Rotate() error {
 	return err
 }
 
+// SetDefaultLevel changes the logging level of every module to the
+// provided level, as used by New.
+func (b *Backend) SetDefaultLevel(level string) error {
+	lvl, err := logLevelFromString(level)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.level = level
+	b._backend.SetLevel(lvl, "")
+	return nil
+}
+
 func (b *Backend) newBackend() error {
 	lvl, err := logLevelFromString(b.level)
 	if err != nil {
@@ -0,0 +1,83 @@
+// metrics.go - Prometheus metrics helpers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package metrics provides the Prometheus metrics registration and
+// listener shared by the Katzenpost servers.
+package metrics
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// Register registers the collectors with the default registry.  A
+// collector which is already registered is skipped, as several server
+// instances may run in one process when testing.
+func Register(collectors ...prometheus.Collector) {
+	for _, c := range collectors {
+		err := prometheus.Register(c)
+		var are prometheus.AlreadyRegisteredError
+		if err != nil && !errors.As(err, &are) {
+			panic(err)
+		}
+	}
+}
+
+// Listener serves the metrics of the default registry over HTTP.
+type Listener struct {
+	l   net.Listener
+	srv *http.Server
+}
+
+// Addr returns the address the Listener is bound to.
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// Halt stops the Listener.
+func (l *Listener) Halt() {
+	l.srv.Close()
+}
+
+// StartListener serves the metrics on the address at /metrics.  Serve
+// failures are logged.
+func StartListener(address string, log *logging.Logger) (*Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	l := &Listener{
+		l: ln,
+		srv: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	log.Noticef("Serving metrics on: %v", ln.Addr())
+	go func() {
+		if err := l.srv.Serve(ln); err != http.ErrServerClosed {
+			log.Errorf("Metrics listener failure: %v", err)
+		}
+	}()
+	return l, nil
+}
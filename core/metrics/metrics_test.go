@@ -0,0 +1,58 @@
+// metrics_test.go - Prometheus metrics helpers tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+func TestListener(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "katzenpost_metrics_test_total",
+		Help: "Test counter",
+	})
+	Register(counter)
+	Register(counter)
+	counter.Inc()
+
+	l, err := StartListener("127.0.0.1:0", logBackend.GetLogger("metrics"))
+	require.NoError(err)
+	defer l.Halt()
+
+	resp, err := http.Get(fmt.Sprintf("http://%v/metrics", l.Addr()))
+	require.NoError(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(err)
+	require.Contains(string(body), "katzenpost_metrics_test_total 1")
+
+	// Listening on an address in use fails.
+	_, err = StartListener(l.Addr().String(), logBackend.GetLogger("metrics"))
+	require.Error(err)
+}
@@ -0,0 +1,150 @@
+// authority.go - Directory Authority descriptors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+var (
+	// ErrNoAuthorities is the error returned when verifying a Document
+	// against a Document which does not name the authorities that sign
+	// its successor.
+	ErrNoAuthorities = errors.New("pki: document does not name its successor authorities")
+
+	// ErrBrokenChain is the error returned when verifying a Document
+	// against a Document which is not for the previous epoch.
+	ErrBrokenChain = errors.New("pki: document does not follow the previous document")
+)
+
+// AuthorityDescriptor is a description of a Directory Authority.
+type AuthorityDescriptor struct {
+	// Identifier is the human readable identifier for the authority.
+	Identifier string
+
+	// IdentityKey is the authority's identity (signing) key.
+	IdentityKey sign.PublicKey
+
+	// LinkKey is the authority's wire protocol public key.
+	LinkKey wire.PublicKey
+
+	// Addresses are the URLs of the authority's Directory Authority service.
+	Addresses []string
+}
+
+type authorityDescriptor AuthorityDescriptor
+
+// String returns a human readable AuthorityDescriptor suitable for terse
+// logging.
+func (d *AuthorityDescriptor) String() string {
+	id := d.IdentityKey.Sum256()
+	return fmt.Sprintf("{%s %x %v}", d.Identifier, id, d.Addresses)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler interface.
+func (d *AuthorityDescriptor) MarshalBinary() ([]byte, error) {
+	return ccbor.Marshal((*authorityDescriptor)(d))
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler interface.
+func (d *AuthorityDescriptor) UnmarshalBinary(data []byte) error {
+	// Instantiate concrete instances so we deserialize into the right types
+	d.IdentityKey = cert.Scheme.NewEmptyPublicKey()
+	d.LinkKey = wire.DefaultScheme.NewEmptyPublicKey()
+	return cbor.Unmarshal(data, (*authorityDescriptor)(d))
+}
+
+// SortAuthorities sorts the authorities by the hash of their identity key,
+// so that the authority sets voted by the authorities can be compared.
+func SortAuthorities(authorities []*AuthorityDescriptor) {
+	sort.Slice(authorities, func(i, j int) bool {
+		a, b := authorities[i].IdentityKey.Sum256(), authorities[j].IdentityKey.Sum256()
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
+
+// AuthorityThreshold returns the number of signatures of a set of n
+// authorities needed to make a consensus.
+func AuthorityThreshold(n int) int {
+	return n/2 + 1
+}
+
+// IsAuthoritySetWellFormed validates a set of authorities and returns a
+// descriptive error iff there are any problems that make it unusable.
+func IsAuthoritySetWellFormed(authorities []*AuthorityDescriptor) error {
+	if len(authorities) == 0 {
+		return errors.New("authority set is empty")
+	}
+	ids := make(map[[PublicKeyHashSize]byte]bool)
+	for _, a := range authorities {
+		if a.IdentityKey == nil {
+			return fmt.Errorf("authority %s is missing IdentityKey", a.Identifier)
+		}
+		if a.LinkKey == nil {
+			return fmt.Errorf("authority %s is missing LinkKey", a.Identifier)
+		}
+		if len(a.Addresses) == 0 {
+			return fmt.Errorf("authority %s has no Addresses", a.Identifier)
+		}
+		id := a.IdentityKey.Sum256()
+		if ids[id] {
+			return fmt.Errorf("authority set contains multiple entries for %x", id)
+		}
+		ids[id] = true
+	}
+	return nil
+}
+
+// AuthorityVerifiers returns the verifiers of the authorities which sign
+// the Document for the next epoch.
+func (d *Document) AuthorityVerifiers() []cert.Verifier {
+	verifiers := make([]cert.Verifier, 0, len(d.Authorities))
+	for _, a := range d.Authorities {
+		verifiers = append(verifiers, a.IdentityKey)
+	}
+	return verifiers
+}
+
+// VerifyNextDocument verifies that the serialized Document for the epoch
+// following prev is signed by a threshold of the authorities named in
+// prev, and returns the Document.
+func VerifyNextDocument(prev *Document, raw []byte) (*Document, error) {
+	if len(prev.Authorities) == 0 {
+		return nil, ErrNoAuthorities
+	}
+	verifiers := prev.AuthorityVerifiers()
+	_, _, _, err := cert.VerifyThreshold(verifiers, AuthorityThreshold(len(verifiers)), raw)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := ParseDocument(raw)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Epoch != prev.Epoch+1 {
+		return nil, ErrBrokenChain
+	}
+	return doc, nil
+}
@@ -0,0 +1,97 @@
+// authority_test.go - Directory Authority descriptor tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+func TestVerifyNextDocument(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	privKeys := make([]sign.PrivateKey, 4)
+	authorities := make([]*AuthorityDescriptor, 4)
+	for i := range authorities {
+		privKey, pubKey := cert.Scheme.NewKeypair()
+		_, linkKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+		privKeys[i] = privKey
+		authorities[i] = &AuthorityDescriptor{
+			Identifier:  fmt.Sprintf("authority-%d", i),
+			IdentityKey: pubKey,
+			LinkKey:     linkKey,
+			Addresses:   []string{fmt.Sprintf("tcp://127.0.0.1:%d", 30000+i)},
+		}
+	}
+	signed := func(doc *Document, signers ...int) []byte {
+		var raw []byte
+		var err error
+		for _, i := range signers {
+			raw, err = SignDocument(privKeys[i], authorities[i].IdentityKey, doc)
+			require.NoError(err)
+		}
+		return raw
+	}
+
+	// the authority set survives serialization
+	epoch, _, _ := epochtime.Now()
+	prev := &Document{Epoch: epoch, Authorities: []*AuthorityDescriptor{authorities[2], authorities[0], authorities[1]}}
+	SortAuthorities(prev.Authorities)
+	prev, err := ParseDocument(signed(prev, 0))
+	require.NoError(err)
+	require.Len(prev.Authorities, 3)
+	require.NoError(IsAuthoritySetWellFormed(prev.Authorities))
+	for i, a := range prev.Authorities {
+		if i > 0 {
+			x, y := prev.Authorities[i-1].IdentityKey.Sum256(), a.IdentityKey.Sum256()
+			require.Less(string(x[:]), string(y[:]))
+		}
+		require.Len(a.Addresses, 1)
+	}
+
+	// the next document needs a threshold of the authorities of prev
+	next := &Document{Epoch: epoch + 1, Authorities: authorities[1:]}
+	_, err = VerifyNextDocument(prev, signed(next, 3, 0))
+	require.Error(err)
+	doc, err := VerifyNextDocument(prev, signed(next, 1))
+	require.NoError(err)
+	require.Len(doc.Authorities, 3)
+
+	// authority 0 was removed and authority 3 added
+	_, err = VerifyNextDocument(doc, signed(&Document{Epoch: epoch + 2}, 0, 1))
+	require.Error(err)
+	_, err = VerifyNextDocument(doc, signed(&Document{Epoch: epoch + 2}, 2, 3))
+	require.NoError(err)
+
+	// documents must follow each other
+	_, err = VerifyNextDocument(doc, signed(&Document{Epoch: epoch + 3}, 2, 3))
+	require.ErrorIs(err, ErrBrokenChain)
+	_, err = VerifyNextDocument(&Document{Epoch: epoch + 1}, signed(&Document{Epoch: epoch + 2}, 2, 3))
+	require.ErrorIs(err, ErrNoAuthorities)
+
+	// duplicate authorities are not allowed
+	require.Error(IsAuthoritySetWellFormed([]*AuthorityDescriptor{authorities[0], authorities[0]}))
+	require.Error(IsAuthoritySetWellFormed(nil))
+}
@@ -17,3 +17,14 @@ type Client interface {
 	// Deserialize returns PKI document given the raw bytes.
 	Deserialize(raw []byte) (*Document, error)
 }
+
+// DiffClient is a Client which can fetch a document as a diff against the
+// document of the previous epoch.
+type DiffClient interface {
+	Client
+
+	// GetDiff returns the PKI document along with the raw serialized form
+	// for the provided epoch, fetched as a diff against the raw serialized
+	// document of the previous epoch.
+	GetDiff(ctx context.Context, epoch uint64, base []byte) (*Document, []byte, error)
+}
@@ -41,6 +41,10 @@ import (
 
 const (
 	DescriptorVersion = "v0"
+
+	// DefaultLoadWeight is the load balancing weight of nodes that do
+	// not advertise one, or that are missing from a Document's LoadWeights.
+	DefaultLoadWeight uint8 = 100
 )
 
 var (
@@ -80,12 +84,18 @@ type MixDescriptor struct {
 	// Provider indicates that this Mix is a Provider
 	Provider bool
 
-	// LoadWeight is the node's load balancing weight (unused).
+	// LoadWeight is the node's advertised load balancing weight, zero
+	// meaning DefaultLoadWeight. The weight used for path selection is
+	// the one assigned by the authorities in Document.LoadWeights.
 	LoadWeight uint8
 
 	// AuthenticationType is the authentication mechanism required
 	AuthenticationType string
 
+	// ConsensusDiff indicates that the Provider serves the documents
+	// as diffs with the GetConsensusDiff command.
+	ConsensusDiff bool
+
 	// Version uniquely identifies the descriptor format as being for the
 	// specified version so that it can be rejected if the format changes.
 	Version string
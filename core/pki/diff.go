@@ -0,0 +1,357 @@
+// diff.go - Consensus document diffs and compression.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+)
+
+const (
+	// DiffBaseHashSize is the size of the hash identifying the document
+	// a diff is against.
+	DiffBaseHashSize = 32
+
+	// MaxDocumentSize is the maximum size of a signed document rebuilt
+	// from a diff or decompressed, which is the maximum size of a wire
+	// protocol message.
+	MaxDocumentSize = 1300000
+
+	// diffBlockSize is the size of the blocks of the base document that
+	// a diff copies from.
+	diffBlockSize = 32
+
+	// diffHashPrime is the multiplier of the rolling block hash.
+	diffHashPrime = 1099511628211
+
+	// maxCachedPayloads is the maximum number of payloads cached by a
+	// ConsensusEncoder.
+	maxCachedPayloads = 16
+)
+
+var (
+	// ErrDiffBaseMismatch is the error returned when applying a diff to a
+	// document other than the one it is against.
+	ErrDiffBaseMismatch = errors.New("pki: diff is not against the base document")
+
+	// ErrDiffHashMismatch is the error returned when the document rebuilt
+	// from a diff does not have the hash of the signed document.
+	ErrDiffHashMismatch = errors.New("pki: document rebuilt from diff does not match its hash")
+
+	errDocumentTooLarge = errors.New("pki: document exceeds the maximum size")
+)
+
+// diffOp either copies Length bytes at Offset of the base document, or
+// inserts Data.
+type diffOp struct {
+	_ struct{} `cbor:",toarray"`
+
+	Offset uint32
+	Length uint32
+	Data   []byte
+}
+
+// documentDiff is the serialized diff of a signed document against the
+// certified payload of the document of a previous epoch.
+type documentDiff struct {
+	// BaseHash is the diff base hash of the previous document.
+	BaseHash [DiffBaseHashSize]byte
+
+	// Hash is the hash of the signed document.
+	Hash [32]byte
+
+	Ops []diffOp
+}
+
+// DiffBaseHash returns the hash identifying the signed document as the
+// base of diffs. It only covers the certified payload, so that the same
+// document with a different set of signatures is the same base.
+func DiffBaseHash(raw []byte) ([DiffBaseHashSize]byte, error) {
+	certified, err := cert.GetCertified(raw)
+	if err != nil {
+		return [DiffBaseHashSize]byte{}, err
+	}
+	return blake2b.Sum256(certified), nil
+}
+
+// DiffDocument returns the diff of the signed document raw against the
+// signed document base.
+func DiffDocument(base, raw []byte) ([]byte, error) {
+	src, err := cert.GetCertified(base)
+	if err != nil {
+		return nil, err
+	}
+	d := &documentDiff{
+		BaseHash: blake2b.Sum256(src),
+		Hash:     blake2b.Sum256(raw),
+		Ops:      diffOps(src, raw),
+	}
+	return ccbor.Marshal(d)
+}
+
+// PatchDocument applies the diff to the signed document base, and returns
+// the signed document, whose signatures remain to be verified.
+func PatchDocument(base, diff []byte) ([]byte, error) {
+	d := new(documentDiff)
+	if err := cbor.Unmarshal(diff, d); err != nil {
+		return nil, err
+	}
+	src, err := cert.GetCertified(base)
+	if err != nil {
+		return nil, err
+	}
+	if blake2b.Sum256(src) != d.BaseHash {
+		return nil, ErrDiffBaseMismatch
+	}
+
+	raw := []byte{}
+	for _, op := range d.Ops {
+		switch {
+		case len(op.Data) > 0:
+			if op.Offset != 0 || op.Length != 0 {
+				return nil, errors.New("pki: diff insert with an offset")
+			}
+			if len(raw)+len(op.Data) > MaxDocumentSize {
+				return nil, errDocumentTooLarge
+			}
+			raw = append(raw, op.Data...)
+		case op.Length > 0:
+			end := uint64(op.Offset) + uint64(op.Length)
+			if end > uint64(len(src)) {
+				return nil, fmt.Errorf("pki: diff copy out of bounds: %d > %d", end, len(src))
+			}
+			if len(raw)+int(op.Length) > MaxDocumentSize {
+				return nil, errDocumentTooLarge
+			}
+			raw = append(raw, src[op.Offset:end]...)
+		default:
+			return nil, errors.New("pki: empty diff operation")
+		}
+	}
+	if blake2b.Sum256(raw) != d.Hash {
+		return nil, ErrDiffHashMismatch
+	}
+	return raw, nil
+}
+
+// diffOps returns the operations rebuilding dst from src, copying the
+// blocks of src found in dst and inserting the rest.
+func diffOps(src, dst []byte) []diffOp {
+	ops := []diffOp{}
+	lit := 0
+	insert := func(end int) {
+		if end > lit {
+			ops = append(ops, diffOp{Data: dst[lit:end]})
+		}
+	}
+
+	if len(src) >= diffBlockSize && len(dst) >= diffBlockSize {
+		index := make(map[uint64]int)
+		for off := 0; off+diffBlockSize <= len(src); off += diffBlockSize {
+			h := blockHash(src[off : off+diffBlockSize])
+			if _, ok := index[h]; !ok {
+				index[h] = off
+			}
+		}
+
+		// The multiplier of the byte leaving the rolling hash.
+		var top uint64 = 1
+		for i := 1; i < diffBlockSize; i++ {
+			top *= diffHashPrime
+		}
+
+		i := 0
+		h := blockHash(dst[:diffBlockSize])
+		for {
+			if off, ok := index[h]; ok && bytes.Equal(src[off:off+diffBlockSize], dst[i:i+diffBlockSize]) {
+				// Extend the match in both directions.
+				s, d := off, i
+				for s > 0 && d > lit && src[s-1] == dst[d-1] {
+					s--
+					d--
+				}
+				se, e := off+diffBlockSize, i+diffBlockSize
+				for se < len(src) && e < len(dst) && src[se] == dst[e] {
+					se++
+					e++
+				}
+				insert(d)
+				ops = append(ops, diffOp{Offset: uint32(s), Length: uint32(e - d)})
+				lit, i = e, e
+				if i+diffBlockSize > len(dst) {
+					break
+				}
+				h = blockHash(dst[i : i+diffBlockSize])
+				continue
+			}
+			if i+diffBlockSize >= len(dst) {
+				break
+			}
+			h = (h-uint64(dst[i])*top)*diffHashPrime + uint64(dst[i+diffBlockSize])
+			i++
+		}
+	}
+	insert(len(dst))
+	return ops
+}
+
+func blockHash(b []byte) uint64 {
+	var h uint64
+	for _, c := range b {
+		h = h*diffHashPrime + uint64(c)
+	}
+	return h
+}
+
+// CompressDocument returns the compressed signed document.
+func CompressDocument(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecompressDocument returns the signed document decompressed from b.
+func DecompressDocument(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	raw, err := io.ReadAll(io.LimitReader(r, MaxDocumentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > MaxDocumentSize {
+		return nil, errDocumentTooLarge
+	}
+	return raw, nil
+}
+
+// ConsensusPayload is a signed document as served in response to a
+// request for a diff, either as a diff or in full, and optionally
+// compressed.
+type ConsensusPayload struct {
+	Payload      []byte
+	IsDiff       bool
+	IsCompressed bool
+}
+
+// Decode returns the signed document, applying the diff to base if the
+// payload is a diff.
+func (p *ConsensusPayload) Decode(base []byte) ([]byte, error) {
+	raw := p.Payload
+	var err error
+	if p.IsCompressed {
+		if raw, err = DecompressDocument(raw); err != nil {
+			return nil, err
+		}
+	}
+	if !p.IsDiff {
+		return raw, nil
+	}
+	if base == nil {
+		return nil, ErrDiffBaseMismatch
+	}
+	return PatchDocument(base, raw)
+}
+
+type consensusPayloadKey struct {
+	hash     [32]byte
+	baseHash [DiffBaseHashSize]byte
+	compress bool
+}
+
+// ConsensusEncoder encodes the signed documents served in response to
+// the requests for diffs, caching the payloads so that each diff and
+// compression is only computed once.
+type ConsensusEncoder struct {
+	sync.Mutex
+
+	cache map[consensusPayloadKey]*ConsensusPayload
+}
+
+// Encode returns the payload serving the signed document raw to a peer
+// holding the document with the diff base hash baseHash. It is a diff
+// against base iff base has that hash and the diff is smaller than the
+// document, and is compressed iff compress is set and that makes it
+// smaller. base may be nil.
+func (e *ConsensusEncoder) Encode(raw, base []byte, baseHash [DiffBaseHashSize]byte, compress bool) (*ConsensusPayload, error) {
+	key := consensusPayloadKey{hash: blake2b.Sum256(raw), compress: compress}
+	if base != nil {
+		if h, err := DiffBaseHash(base); err == nil && h == baseHash {
+			key.baseHash = baseHash
+		} else {
+			base = nil
+		}
+	}
+
+	e.Lock()
+	p, ok := e.cache[key]
+	e.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	p = &ConsensusPayload{Payload: raw}
+	if base != nil {
+		diff, err := DiffDocument(base, raw)
+		if err != nil {
+			return nil, err
+		}
+		if len(diff) < len(p.Payload) {
+			p.Payload, p.IsDiff = diff, true
+		}
+	}
+	if compress {
+		compressed, err := CompressDocument(p.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(p.Payload) {
+			p.Payload, p.IsCompressed = compressed, true
+		}
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if len(e.cache) >= maxCachedPayloads {
+		e.cache = make(map[consensusPayloadKey]*ConsensusPayload)
+	}
+	e.cache[key] = p
+	return p, nil
+}
+
+// NewConsensusEncoder returns a new ConsensusEncoder.
+func NewConsensusEncoder() *ConsensusEncoder {
+	return &ConsensusEncoder{
+		cache: make(map[consensusPayloadKey]*ConsensusPayload),
+	}
+}
@@ -0,0 +1,127 @@
+// diff_test.go - Consensus document diff tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+)
+
+func TestDocumentDiff(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	k, idPub := cert.Scheme.NewKeypair()
+	genDocument := func(epoch uint64, providers []*MixDescriptor) []byte {
+		doc := &Document{
+			Epoch:              epoch,
+			GenesisEpoch:       debugTestEpoch,
+			SendRatePerMinute:  3,
+			Topology:           make([][]*MixDescriptor, 1),
+			SharedRandomCommit: make(map[[PublicKeyHashSize]byte][]byte),
+			SharedRandomReveal: make(map[[PublicKeyHashSize]byte][]byte),
+			SharedRandomValue:  make([]byte, SharedRandomValueLength),
+			Providers:          providers,
+		}
+		signed, err := SignDocument(k, idPub, doc)
+		require.NoError(err, "SignDocument()")
+		return signed
+	}
+	providers := []*MixDescriptor{}
+	for i := 0; i < 4; i++ {
+		desc, _ := genDescriptor(require, i, true)
+		providers = append(providers, desc)
+	}
+	base := genDocument(debugTestEpoch, providers)
+	desc, _ := genDescriptor(require, 4, true)
+	raw := genDocument(debugTestEpoch+1, append(providers[1:], desc))
+
+	// The diff rebuilds the signed document, and is smaller.
+	diff, err := DiffDocument(base, raw)
+	require.NoError(err, "DiffDocument()")
+	require.Less(len(diff), len(raw)/2)
+	patched, err := PatchDocument(base, diff)
+	require.NoError(err, "PatchDocument()")
+	require.Equal(raw, patched)
+	_, err = cert.Verify(idPub, patched)
+	require.NoError(err)
+
+	// The diff base does not depend on the signatures.
+	baseHash, err := DiffBaseHash(base)
+	require.NoError(err)
+	rawHash, err := DiffBaseHash(raw)
+	require.NoError(err)
+	require.NotEqual(baseHash, rawHash)
+	ddoc, err := ParseDocument(base)
+	require.NoError(err)
+	ddoc.Signatures = nil
+	resigned, err := SignDocument(k, idPub, ddoc)
+	require.NoError(err)
+	h, err := DiffBaseHash(resigned)
+	require.NoError(err)
+	require.Equal(baseHash, h)
+
+	// A diff only applies to its base, and to the signed document.
+	_, err = PatchDocument(raw, diff)
+	require.Equal(ErrDiffBaseMismatch, err)
+	diff[len(diff)-1] ^= 0xff
+	_, err = PatchDocument(base, diff)
+	require.Error(err)
+
+	// A diff of an empty or unrelated document only inserts.
+	require.Equal([]diffOp{{Data: raw}}, diffOps(nil, raw))
+	require.Equal([]diffOp{{Offset: 0, Length: uint32(len(raw))}}, diffOps(raw, raw))
+
+	// Compression round trips.
+	compressed, err := CompressDocument(raw)
+	require.NoError(err, "CompressDocument()")
+	decompressed, err := DecompressDocument(compressed)
+	require.NoError(err, "DecompressDocument()")
+	require.Equal(raw, decompressed)
+	bomb, err := CompressDocument(make([]byte, MaxDocumentSize+1))
+	require.NoError(err)
+	_, err = DecompressDocument(bomb)
+	require.Equal(errDocumentTooLarge, err)
+
+	// The encoder only diffs against the base the peer holds.
+	e := NewConsensusEncoder()
+	p, err := e.Encode(raw, base, baseHash, true)
+	require.NoError(err, "Encode()")
+	require.True(p.IsDiff)
+	require.LessOrEqual(len(p.Payload), len(diff))
+	decoded, err := p.Decode(base)
+	require.NoError(err, "Decode()")
+	require.Equal(raw, decoded)
+	_, err = p.Decode(nil)
+	require.Equal(ErrDiffBaseMismatch, err)
+	cached, err := e.Encode(raw, base, baseHash, true)
+	require.NoError(err)
+	require.True(p == cached)
+
+	p, err = e.Encode(raw, base, rawHash, false)
+	require.NoError(err)
+	require.Equal(&ConsensusPayload{Payload: raw}, p)
+	p, err = e.Encode(raw, nil, baseHash, true)
+	require.NoError(err)
+	require.False(p.IsDiff)
+	require.True(p.IsCompressed)
+	decoded, err = p.Decode(nil)
+	require.NoError(err)
+	require.Equal(raw, decoded)
+}
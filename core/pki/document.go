@@ -146,6 +146,26 @@ type Document struct {
 	// Sphinx Geometry.
 	SphinxGeometryHash []byte
 
+	// LoadWeights maps node identity key hashes to the load balancing
+	// weights assigned by the authorities, used for weighted path selection.
+	LoadWeights map[[PublicKeyHashSize]byte]uint8
+
+	// MinDeliveryRate is the fraction of the network-wide delivery rate
+	// of the probe loops that a mix must deliver to be included in the
+	// Topology, zero disabling exclusion.
+	MinDeliveryRate float64
+
+	// Measurements maps node identity key hashes to the delivery rate and
+	// latency of the probe loops sent through the nodes. In a consensus,
+	// it is the median of the measurements voted by the authorities; in
+	// a vote, the measurements of the voting authority.
+	Measurements map[[PublicKeyHashSize]byte]*MixMeasurement
+
+	// Authorities is the set of Directory Authorities whose threshold
+	// signs the Document for the next epoch, sorted by identity key hash.
+	// In a vote, it is the set proposed by the voting authority.
+	Authorities []*AuthorityDescriptor
+
 	// Version uniquely identifies the document format as being for the
 	// specified version so that it can be rejected if the format changes.
 	Version string
@@ -176,6 +196,10 @@ func (d *Document) String() string {
 	s += "}\n"
 	s += fmt.Sprintf("Providers:[]{%v}", d.Providers)
 	s += "}}\n"
+	s += fmt.Sprintf("Authorities: %v\n", d.Authorities)
+	for id, m := range d.Measurements {
+		s += fmt.Sprintf("  Measurement: %x, %v\n", id, m)
+	}
 
 	for id, signedCommit := range d.SharedRandomCommit {
 		commit, err := cert.GetCertified(signedCommit)
@@ -222,6 +246,15 @@ func (d *Document) GetProviderByKeyHash(keyhash *[32]byte) (*MixDescriptor, erro
 	return nil, fmt.Errorf("pki: provider not found")
 }
 
+// GetLoadWeight returns the load balancing weight of the given node,
+// falling back to DefaultLoadWeight if the Document does not specify one.
+func (d *Document) GetLoadWeight(desc *MixDescriptor) uint8 {
+	if w, ok := d.LoadWeights[desc.IdentityKey.Sum256()]; ok && w != 0 {
+		return w
+	}
+	return DefaultLoadWeight
+}
+
 // GetMix returns the MixDescriptor for the given mix Name.
 func (d *Document) GetMix(name string) (*MixDescriptor, error) {
 	for _, l := range d.Topology {
@@ -510,6 +543,19 @@ func IsDocumentWellFormed(d *Document, verifiers []cert.Verifier) error {
 		}
 		pks[pk] = true
 	}
+	if len(d.Authorities) != 0 {
+		if err := IsAuthoritySetWellFormed(d.Authorities); err != nil {
+			return fmt.Errorf("Document has invalid Authorities: %v", err)
+		}
+	}
+	if d.MinDeliveryRate < 0 || d.MinDeliveryRate > 1 {
+		return fmt.Errorf("Document has invalid MinDeliveryRate %v", d.MinDeliveryRate)
+	}
+	for id, m := range d.Measurements {
+		if err := IsMeasurementWellFormed(m); err != nil {
+			return fmt.Errorf("Document has invalid Measurement for %x: %v", id, err)
+		}
+	}
 
 	return nil
 }
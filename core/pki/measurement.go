@@ -0,0 +1,130 @@
+// measurement.go - Mix liveness and performance measurements.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// MixMeasurement is the result of the probe loops sent through a mix by
+// the Directory Authorities.
+type MixMeasurement struct {
+	// Probes is the number of probe loops sent through the mix which
+	// either returned or timed out.
+	Probes uint32
+
+	// Delivered is the number of probe loops that returned.
+	Delivered uint32
+
+	// Latency is the mean round trip time of the probe loops that
+	// returned.
+	Latency time.Duration
+}
+
+type mixMeasurement MixMeasurement
+
+// String returns a human readable MixMeasurement suitable for terse
+// logging.
+func (m *MixMeasurement) String() string {
+	return fmt.Sprintf("{%d/%d %v}", m.Delivered, m.Probes, m.Latency)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler interface.
+func (m *MixMeasurement) MarshalBinary() ([]byte, error) {
+	return ccbor.Marshal((*mixMeasurement)(m))
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler interface.
+func (m *MixMeasurement) UnmarshalBinary(data []byte) error {
+	return cbor.Unmarshal(data, (*mixMeasurement)(m))
+}
+
+// DeliveryRate returns the fraction of the probe loops that returned.
+func (m *MixMeasurement) DeliveryRate() float64 {
+	if m.Probes == 0 {
+		return 0
+	}
+	return float64(m.Delivered) / float64(m.Probes)
+}
+
+// Add adds the probe loops of another measurement of the same mix.
+func (m *MixMeasurement) Add(o *MixMeasurement) {
+	if delivered := m.Delivered + o.Delivered; delivered != 0 {
+		m.Latency = (m.Latency*time.Duration(m.Delivered) + o.Latency*time.Duration(o.Delivered)) / time.Duration(delivered)
+	}
+	m.Probes += o.Probes
+	m.Delivered += o.Delivered
+}
+
+// Record records the result of a single probe loop.
+func (m *MixMeasurement) Record(delivered bool, rtt time.Duration) {
+	r := &MixMeasurement{Probes: 1}
+	if delivered {
+		r.Delivered = 1
+		r.Latency = rtt
+	}
+	m.Add(r)
+}
+
+// MedianMeasurement returns the median of the measurements of a mix
+// ordered by delivery rate, so that a minority of authorities can not
+// skew the measurement. Ties are broken by the other fields so that
+// every authority picks the same measurement.
+func MedianMeasurement(measurements []*MixMeasurement) *MixMeasurement {
+	if len(measurements) == 0 {
+		return nil
+	}
+	sorted := make([]*MixMeasurement, len(measurements))
+	copy(sorted, measurements)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		// Compare the delivery rates without rounding.
+		x, y := uint64(a.Delivered)*uint64(b.Probes), uint64(b.Delivered)*uint64(a.Probes)
+		if x != y {
+			return x < y
+		}
+		if a.Latency != b.Latency {
+			return a.Latency > b.Latency
+		}
+		if a.Probes != b.Probes {
+			return a.Probes < b.Probes
+		}
+		return a.Delivered < b.Delivered
+	})
+	return sorted[(len(sorted)-1)/2]
+}
+
+// IsMeasurementWellFormed validates a measurement and returns a descriptive
+// error iff there are any problems that make it unusable.
+func IsMeasurementWellFormed(m *MixMeasurement) error {
+	if m == nil {
+		return fmt.Errorf("measurement is missing")
+	}
+	if m.Probes == 0 {
+		return fmt.Errorf("measurement has no Probes")
+	}
+	if m.Delivered > m.Probes {
+		return fmt.Errorf("measurement has more Delivered than Probes")
+	}
+	if m.Latency < 0 {
+		return fmt.Errorf("measurement has negative Latency")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// measurement_test.go - Mix measurement tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMixMeasurement(t *testing.T) {
+	require := require.New(t)
+
+	m := new(MixMeasurement)
+	m.Record(true, time.Second)
+	m.Record(false, 0)
+	m.Record(true, 2*time.Second)
+	require.Equal(&MixMeasurement{Probes: 3, Delivered: 2, Latency: 1500 * time.Millisecond}, m)
+	require.InDelta(2.0/3.0, m.DeliveryRate(), 0.0001)
+	require.NoError(IsMeasurementWellFormed(m))
+
+	raw, err := m.MarshalBinary()
+	require.NoError(err)
+	m2 := new(MixMeasurement)
+	require.NoError(m2.UnmarshalBinary(raw))
+	require.Equal(m, m2)
+
+	require.Error(IsMeasurementWellFormed(&MixMeasurement{}))
+	require.Error(IsMeasurementWellFormed(&MixMeasurement{Probes: 1, Delivered: 2}))
+
+	// the median does not depend on the order of the measurements, and
+	// the slower of equally reliable mixes ranks lower
+	a := &MixMeasurement{Probes: 10, Delivered: 5, Latency: time.Second}
+	b := &MixMeasurement{Probes: 20, Delivered: 10, Latency: 2 * time.Second}
+	c := &MixMeasurement{Probes: 10, Delivered: 9, Latency: time.Second}
+	require.Equal(a, MedianMeasurement([]*MixMeasurement{a, b, c}))
+	require.Equal(a, MedianMeasurement([]*MixMeasurement{c, a, b}))
+	require.Equal(a, MedianMeasurement([]*MixMeasurement{a, b, c, a}))
+	require.Equal(b, MedianMeasurement([]*MixMeasurement{c, b, a, b}))
+	require.Nil(MedianMeasurement(nil))
+}
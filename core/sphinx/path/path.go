@@ -51,6 +51,21 @@ func New(rng *mRand.Rand,
 	baseTime time.Time,
 	isFromClient,
 	isForward bool) ([]*sphinx.PathHop, time.Time, error) {
+	return NewWithClock(epochtime.WallClock, rng, sphinxGeometry, doc, recipient, src, dst, surbID, baseTime, isFromClient, isForward)
+}
+
+// NewWithClock is New for a baseTime taken from clock, the epochs of which
+// select the mix keys of the hops.
+func NewWithClock(clock epochtime.Clock,
+	rng *mRand.Rand,
+	sphinxGeometry *geo.Geometry,
+	doc *pki.Document,
+	recipient []byte,
+	src, dst *pki.MixDescriptor,
+	surbID *[constants.SURBIDLength]byte,
+	baseTime time.Time,
+	isFromClient,
+	isForward bool) ([]*sphinx.PathHop, time.Time, error) {
 
 	var then time.Time
 	var path []*sphinx.PathHop
@@ -67,7 +82,7 @@ selectLoop:
 			h := &sphinx.PathHop{}
 			idHash := desc.IdentityKey.Sum256()
 			copy(h.ID[:], idHash[:])
-			epoch, _, _ := epochtime.FromUnix(then.Unix())
+			epoch, _, _ := epochtime.At(clock, then)
 			if _, ok := desc.MixKeys[epoch]; !ok {
 				continue selectLoop
 			} else {
@@ -184,13 +199,30 @@ func selectHops(rng *mRand.Rand, doc *pki.Document, src, dst *pki.MixDescriptor,
 		if len(nodes) == 0 {
 			return nil, fmt.Errorf("path: layer %v has no nodes", i)
 		}
-		hops = append(hops, nodes[rng.Intn(len(nodes))])
+		hops = append(hops, selectWeighted(rng, doc, nodes))
 	}
 	hops = append(hops, dst)
 
 	return hops, nil
 }
 
+// selectWeighted picks one of nodes with a probability proportional to
+// its load balancing weight in the Document.
+func selectWeighted(rng *mRand.Rand, doc *pki.Document, nodes []*pki.MixDescriptor) *pki.MixDescriptor {
+	total := 0
+	for _, n := range nodes {
+		total += int(doc.GetLoadWeight(n))
+	}
+	r := rng.Intn(total)
+	for _, n := range nodes {
+		r -= int(doc.GetLoadWeight(n))
+		if r < 0 {
+			return n
+		}
+	}
+	panic("BUG: path: weighted selection failed")
+}
+
 // ToString returns a slice of strings representing the "useful" component of
 // each PathHop, suitable for debugging.
 func ToString(doc *pki.Document, p []*sphinx.PathHop) ([]string, error) {
@@ -0,0 +1,95 @@
+// path_test.go - Path selection tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package path
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+func TestSelectWeighted(t *testing.T) {
+	require := require.New(t)
+
+	weights := []uint8{10, 20, 70, 0}
+	doc := &pki.Document{
+		LoadWeights: make(map[[pki.PublicKeyHashSize]byte]uint8),
+	}
+	nodes := make([]*pki.MixDescriptor, len(weights))
+	for i, w := range weights {
+		_, idPub := cert.Scheme.NewKeypair()
+		nodes[i] = &pki.MixDescriptor{
+			Name:        fmt.Sprintf("mix%d", i),
+			IdentityKey: idPub,
+		}
+		if w != 0 {
+			doc.LoadWeights[idPub.Sum256()] = w
+		}
+	}
+
+	// The node without a weight gets the default weight.
+	total := 0.0
+	expected := make([]float64, len(nodes))
+	for i, n := range nodes {
+		expected[i] = float64(doc.GetLoadWeight(n))
+		total += expected[i]
+	}
+	require.Equal(float64(pki.DefaultLoadWeight), expected[3])
+
+	const samples = 100000
+	counts := make(map[string]int)
+	rng := rand.NewMath()
+	for i := 0; i < samples; i++ {
+		counts[selectWeighted(rng, doc, nodes).Name]++
+	}
+	for i, n := range nodes {
+		want := expected[i] / total
+		got := float64(counts[n.Name]) / samples
+		require.True(math.Abs(want-got) < 0.01, "%s: expected frequency %v, got %v", n.Name, want, got)
+	}
+}
+
+func TestSelectWeightedUniform(t *testing.T) {
+	require := require.New(t)
+
+	// Documents without LoadWeights select uniformly.
+	doc := &pki.Document{}
+	nodes := make([]*pki.MixDescriptor, 4)
+	for i := range nodes {
+		_, idPub := cert.Scheme.NewKeypair()
+		nodes[i] = &pki.MixDescriptor{
+			Name:        fmt.Sprintf("mix%d", i),
+			IdentityKey: idPub,
+			LoadWeight:  uint8(i * 50),
+		}
+	}
+	const samples = 100000
+	counts := make(map[string]int)
+	rng := rand.NewMath()
+	for i := 0; i < samples; i++ {
+		counts[selectWeighted(rng, doc, nodes).Name]++
+	}
+	for _, n := range nodes {
+		got := float64(counts[n.Name]) / samples
+		require.True(math.Abs(0.25-got) < 0.01, "%s: expected frequency 0.25, got %v", n.Name, got)
+	}
+}
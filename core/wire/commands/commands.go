@@ -36,6 +36,16 @@ const (
 	getConsensusLength  = 8
 	consensusBaseLength = 1
 
+	getConsensusDiffLength  = 8 + ConsensusBaseHashLength + 1
+	consensusDiffBaseLength = 1 + 1
+
+	consensusDiffFlagDiff       = 1 << 0
+	consensusDiffFlagCompressed = 1 << 1
+
+	// ConsensusBaseHashLength is the length of the hash identifying the
+	// document a consensus diff is against.
+	ConsensusBaseHashLength = 32
+
 	postDescriptorStatusLength = 1
 	postDescriptorLength       = 8
 
@@ -69,6 +79,8 @@ const (
 	sigStatus            commandID = 28
 	certificate          commandID = 29
 	certStatus           commandID = 30
+	getConsensusDiff     commandID = 31
+	consensusDiff        commandID = 32
 
 	// ConsensusOk signifies that the GetConsensus request has completed
 	// successfully.
@@ -334,6 +346,105 @@ func consensusFromBytes(b []byte) (Command, error) {
 	return r, nil
 }
 
+// GetConsensusDiff is a de-serialized get_consensus_diff command, which
+// requests the document for Epoch as a diff against the document of the
+// previous epoch held by the peer, and optionally compressed.
+type GetConsensusDiff struct {
+	Epoch uint64
+
+	// BaseHash is the diff base hash of the peer's document for the
+	// previous epoch, or all zeros if it has none.
+	BaseHash [ConsensusBaseHashLength]byte
+
+	// Compress requests a compressed payload.
+	Compress bool
+}
+
+// ToBytes serializes the GetConsensusDiff and returns the resulting byte
+// slice.
+func (c *GetConsensusDiff) ToBytes() []byte {
+	out := make([]byte, cmdOverhead+getConsensusDiffLength)
+	out[0] = byte(getConsensusDiff)
+	binary.BigEndian.PutUint32(out[2:6], getConsensusDiffLength)
+	binary.BigEndian.PutUint64(out[6:14], c.Epoch)
+	copy(out[14:14+ConsensusBaseHashLength], c.BaseHash[:])
+	if c.Compress {
+		out[14+ConsensusBaseHashLength] = 1
+	}
+	return out
+}
+
+func getConsensusDiffFromBytes(b []byte) (Command, error) {
+	if len(b) != getConsensusDiffLength {
+		return nil, errInvalidCommand
+	}
+
+	r := new(GetConsensusDiff)
+	r.Epoch = binary.BigEndian.Uint64(b[0:8])
+	copy(r.BaseHash[:], b[8:8+ConsensusBaseHashLength])
+	switch b[8+ConsensusBaseHashLength] {
+	case 0:
+	case 1:
+		r.Compress = true
+	default:
+		return nil, errInvalidCommand
+	}
+	return r, nil
+}
+
+// ConsensusDiff is a de-serialized consensus_diff command, the response
+// to a get_consensus_diff command.
+type ConsensusDiff struct {
+	ErrorCode uint8
+
+	// IsDiff is set iff the Payload is a diff against the document of
+	// the previous epoch rather than the full document.
+	IsDiff bool
+
+	// IsCompressed is set iff the Payload is compressed.
+	IsCompressed bool
+
+	Payload []byte
+}
+
+// ToBytes serializes the ConsensusDiff and returns the resulting byte
+// slice.
+func (c *ConsensusDiff) ToBytes() []byte {
+	consensusDiffLength := uint32(consensusDiffBaseLength + len(c.Payload))
+	out := make([]byte, cmdOverhead+consensusDiffBaseLength, cmdOverhead+consensusDiffLength)
+	out[0] = byte(consensusDiff)
+	binary.BigEndian.PutUint32(out[2:6], consensusDiffLength)
+	out[6] = c.ErrorCode
+	if c.IsDiff {
+		out[7] |= consensusDiffFlagDiff
+	}
+	if c.IsCompressed {
+		out[7] |= consensusDiffFlagCompressed
+	}
+	out = append(out, c.Payload...)
+	return out
+}
+
+func consensusDiffFromBytes(b []byte) (Command, error) {
+	if len(b) < consensusDiffBaseLength {
+		return nil, errInvalidCommand
+	}
+	flags := b[1]
+	if flags&^(consensusDiffFlagDiff|consensusDiffFlagCompressed) != 0 {
+		return nil, errInvalidCommand
+	}
+
+	r := new(ConsensusDiff)
+	r.ErrorCode = b[0]
+	r.IsDiff = flags&consensusDiffFlagDiff != 0
+	r.IsCompressed = flags&consensusDiffFlagCompressed != 0
+	if payloadLength := len(b) - consensusDiffBaseLength; payloadLength > 0 {
+		r.Payload = make([]byte, 0, payloadLength)
+		r.Payload = append(r.Payload, b[consensusDiffBaseLength:]...)
+	}
+	return r, nil
+}
+
 // PostDescriptor is a de-serialized post_descriptor command.
 type PostDescriptor struct {
 	Epoch   uint64
@@ -859,6 +970,10 @@ func (c *Commands) FromBytes(b []byte) (Command, error) {
 		return getConsensusFromBytes(b)
 	case consensus:
 		return consensusFromBytes(b)
+	case getConsensusDiff:
+		return getConsensusDiffFromBytes(b)
+	case consensusDiff:
+		return consensusDiffFromBytes(b)
 	case postDescriptor:
 		return postDescriptorFromBytes(b)
 	case postDescriptorStatus:
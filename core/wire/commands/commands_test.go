@@ -283,6 +283,50 @@ func TestConsensus(t *testing.T) {
 	require.Equal(d.ErrorCode, cmd.ErrorCode)
 }
 
+func TestConsensusDiff(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	cmds := NewPKICommands()
+
+	getCmd := &GetConsensusDiff{
+		Epoch:    123,
+		Compress: true,
+	}
+	getCmd.BaseHash[0] = 0xaa
+	b := getCmd.ToBytes()
+	require.Len(b, getConsensusDiffLength+cmdOverhead, "GetConsensusDiff: ToBytes() length")
+	c, err := cmds.FromBytes(b)
+	require.NoError(err, "GetConsensusDiff: FromBytes() failed")
+	require.Equal(getCmd, c)
+
+	b[len(b)-1] = 2
+	_, err = cmds.FromBytes(b)
+	require.Error(err, "GetConsensusDiff: FromBytes() accepted an invalid flag")
+
+	cmd := &ConsensusDiff{
+		ErrorCode:    ConsensusOk,
+		IsDiff:       true,
+		IsCompressed: true,
+		Payload:      []byte("TANSTAFL: There's ain't no such thing as a free lunch."),
+	}
+	b = cmd.ToBytes()
+	require.Len(b, consensusDiffBaseLength+len(cmd.Payload)+cmdOverhead, "ConsensusDiff: ToBytes() length")
+	c, err = cmds.FromBytes(b)
+	require.NoError(err, "ConsensusDiff: FromBytes() failed")
+	require.Equal(cmd, c)
+
+	cmd = &ConsensusDiff{ErrorCode: ConsensusNotFound}
+	c, err = cmds.FromBytes(cmd.ToBytes())
+	require.NoError(err, "ConsensusDiff: FromBytes() failed")
+	require.Equal(cmd, c)
+
+	b = cmd.ToBytes()
+	b[cmdOverhead+1] = 0x80
+	_, err = cmds.FromBytes(b)
+	require.Error(err, "ConsensusDiff: FromBytes() accepted unknown flags")
+}
+
 func TestPostDescriptor(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -213,9 +213,10 @@ func (s *katzenpost) genNodeConfig(isProvider bool, isVoting bool, transports []
 					Command:        s.baseDir + "/proxy_server" + s.binSuffix,
 					MaxConcurrency: 1,
 					Config: map[string]interface{}{
-						"host":      "127.0.0.1:3338",
-						"log_dir":   s.baseDir + "/" + cfg.Server.Identifier,
-						"log_level": s.logLevel,
+						"host":        "127.0.0.1:3338",
+						"log_dir":     s.baseDir + "/" + cfg.Server.Identifier,
+						"log_level":   s.logLevel,
+						"max_payload": fmt.Sprint(s.sphinxGeometry.UserForwardPayloadLength),
 					},
 				}
 				cfg.Provider.CBORPluginKaetzchen = append(cfg.Provider.CBORPluginKaetzchen, proxyCfg)
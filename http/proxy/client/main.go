@@ -20,21 +20,20 @@ import (
 	cbor "github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/katzenpost/client"
 	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/client/utils"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/http/proxy/common"
 	"gopkg.in/op/go-logging.v1"
 
-	"bufio"
-	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"time"
 )
 
@@ -86,6 +85,27 @@ type kttp struct {
 	log     *logging.Logger
 }
 
+// fetch sends a proxy request and decodes the proxy response.
+func (k *kttp) fetch(d *utils.ServiceDescriptor, req *common.Request) (*common.Response, error) {
+	req.MaxPayload = k.session.SphinxGeometry().UserForwardPayloadLength
+	serialized, err := cbor.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := k.session.BlockingSendUnreliableMessage(d.Name, d.Provider, serialized)
+	if err != nil {
+		return nil, err
+	}
+	proxyResponse := &common.Response{}
+	if err = common.Decode(response, proxyResponse); err != nil {
+		return nil, err
+	}
+	if proxyResponse.Error != "" {
+		return nil, errors.New(proxyResponse.Error)
+	}
+	return proxyResponse, nil
+}
+
 func (k *kttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d, err := k.session.GetService(*epName)
 	if err != nil {
@@ -96,42 +116,51 @@ func (k *kttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// serialize the http request
 	buf, err := httputil.DumpRequest(r, true)
-	// send the http request
-	response, err := k.session.BlockingSendUnreliableMessage(d.Name, d.Provider, buf)
 	if err != nil {
-		// send http error response
-		k.log.Errorf("Err sending proxy request: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		k.log.Errorf("Err serializing request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	// decode payload from response
-	proxyResponse := &common.Response{}
-	err = cbor.Unmarshal(response, proxyResponse)
+	// send the http request
+	resp, err := k.fetch(d, &common.Request{Payload: buf})
 	if err != nil {
 		// send http error response
-		k.log.Errorf("Err unmarshalling kaetzchen response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		k.log.Errorf("Err sending proxy request: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
 
-	// return the http response
-	responseReader := bufio.NewReader(bytes.NewBuffer(proxyResponse.Payload))
-	resp, err := http.ReadResponse(responseReader, r)
-	if err != nil {
-		// send http error response
-		k.log.Errorf("Err parsing http response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	// return the http response status and headers
+	for key, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
 	}
+	w.Header().Set("Content-Length", strconv.FormatUint(resp.Length, 10))
+	w.WriteHeader(resp.StatusCode)
 
-	defer resp.Body.Close()
-	_, err = io.Copy(w, resp.Body)
-	// log err
-	if err != nil {
-		k.log.Errorf("Err proxying: %v", err)
+	// stream the body, fetching the remaining pages
+	offset := uint64(0)
+	for {
+		if resp.Offset != offset {
+			k.log.Errorf("Err proxying: unexpected offset %d, wanted %d", resp.Offset, offset)
+			return
+		}
+		if _, err = w.Write(resp.Payload); err != nil {
+			k.log.Errorf("Err proxying: %v", err)
+			return
+		}
+		offset += uint64(len(resp.Payload))
+		if resp.Token == nil {
+			return
+		}
+		resp, err = k.fetch(d, &common.Request{Token: resp.Token, Offset: offset})
+		if err != nil {
+			// the status was already sent, all we can do is truncate the body
+			k.log.Errorf("Err fetching response page: %v", err)
+			return
+		}
 	}
-	return
 }
 
 func main() {
@@ -16,7 +16,59 @@
 
 package common
 
-// Request just wraps a Payload
+import (
+	"bytes"
+
+	cbor "github.com/fxamacker/cbor/v2"
+)
+
+// TokenLength is the length of a continuation token.
+const TokenLength = 16
+
+// Request is sent by the client, either to proxy a new HTTP request or
+// to fetch the next page of a previous response.
+type Request struct {
+	// Payload is the HTTP/1.1 wire-format request, empty for continuations.
+	Payload []byte
+
+	// Token is the continuation token of the response being paged.
+	Token []byte
+
+	// Offset is the offset into the response body to resume from.
+	Offset uint64
+
+	// MaxPayload is the maximum size of a serialized Response that fits
+	// in the client's SURB reply.
+	MaxPayload int
+}
+
+// Response carries the status, headers and one page of the body of an
+// HTTP response.
 type Response struct {
+	// Error is set if the request could not be proxied.
+	Error string
+
+	// StatusCode is the HTTP status code.
+	StatusCode int
+
+	// Header is the HTTP response header.
+	Header map[string][]string
+
+	// Length is the total length of the response body.
+	Length uint64
+
+	// Offset is the offset of Payload into the response body.
+	Offset uint64
+
+	// Payload is a page of the response body.
 	Payload []byte
+
+	// Token is the continuation token used to fetch the next page, or nil
+	// if Payload is the last page.
+	Token []byte
+}
+
+// Decode deserializes v from b, ignoring any trailing padding.
+func Decode(b []byte, v interface{}) error {
+	return cbor.NewDecoder(bytes.NewReader(b)).Decode(v)
 }
@@ -22,12 +22,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
 	cbor "github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/katzenpost/core/log"
@@ -38,51 +41,30 @@ import (
 )
 
 type proxy struct {
-	write       func(cborplugin.Command)
-	allowedHost map[string]struct{}
-	log         *logging.Logger
+	write           func(cborplugin.Command)
+	allowedHost     map[string]struct{}
+	maxResponseSize int
+	maxPayload      int
+	responses       *responseStore
+	log             *logging.Logger
 }
 
 func (p *proxy) OnCommand(cmd cborplugin.Command) error {
 	switch r := cmd.(type) {
 	case *cborplugin.Request:
-		// deserialize the HTTP/1.1 wire-format request from the kaetzchen payload
-		req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(r.Payload)))
-		if err != nil {
-			p.log.Errorf("http.ReadRequest: %s", err)
-			return err
-		}
-		p.log.Debugf("got request for %s", req.URL)
-		// make the request
-		if _, ok := p.allowedHost[req.URL.Host]; !ok {
-			if _, ok := p.allowedHost["*"]; !ok {
-				// ignore request or send a http.Response
-				p.log.Errorf("invalid AllowedHost: %s", req.Host)
-				return errors.New("requested host invalid")
+		var resp interface{}
+		req := new(common.Request)
+		if err := common.Decode(r.Payload, req); err != nil || (req.Payload == nil && req.Token == nil) {
+			// clients that predate paging send the raw request
+			rawResp, err := p.legacyRoundTrip(r.Payload)
+			if err != nil {
+				return err
 			}
+			resp = &common.Response{Payload: rawResp}
+		} else {
+			resp = p.handle(req)
 		}
-		p.log.Debugf("doing round trip with %s", req.URL)
-		resp, err := http.DefaultTransport.RoundTrip(req)
-		if err != nil {
-			p.log.Errorf("http.Request: %v", req)
-			p.log.Errorf("DefaultTransport: %s", err)
-			return err
-		}
-		p.log.Debugf("writing raw response")
-		rawResp, err := httputil.DumpResponse(resp, true)
-		if err != nil {
-			return err
-		}
-
-		/*
-			if len(rawResp) > 10240 {// where do we learn our maximum payload size ?
-				return nil, errors.New("Response is too long")
-			}
-		*/
-
-		// wrap response in common.Response to indicate length to client
-		cr := &common.Response{Payload: rawResp}
-		serialized, err := cbor.Marshal(cr)
+		serialized, err := cbor.Marshal(resp)
 		if err != nil {
 			return err
 		}
@@ -94,13 +76,116 @@ func (p *proxy) OnCommand(cmd cborplugin.Command) error {
 	}
 }
 
+// handle serves a paged request, reporting failures in the Response.
+func (p *proxy) handle(req *common.Request) *common.Response {
+	var (
+		resp *common.Response
+		err  error
+	)
+	if req.Token != nil {
+		resp, err = p.responses.next(req.Token, req.Offset, p.pageSize(req))
+	} else {
+		resp, err = p.roundTrip(req)
+	}
+	if err != nil {
+		p.log.Errorf("proxy request failed: %s", err)
+		return &common.Response{Error: err.Error()}
+	}
+	return resp
+}
+
+// pageSize returns the maximum size of a serialized Response to req,
+// which the client may lower, but not raise above max_payload.
+func (p *proxy) pageSize(req *common.Request) int {
+	if req.MaxPayload < p.maxPayload {
+		return req.MaxPayload
+	}
+	return p.maxPayload
+}
+
+func (p *proxy) isAllowed(req *http.Request) bool {
+	if _, ok := p.allowedHost[req.URL.Host]; ok {
+		return true
+	}
+	_, ok := p.allowedHost["*"]
+	return ok
+}
+
+func (p *proxy) doRoundTrip(rawReq []byte) (*http.Response, error) {
+	// deserialize the HTTP/1.1 wire-format request from the kaetzchen payload
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(rawReq)))
+	if err != nil {
+		p.log.Errorf("http.ReadRequest: %s", err)
+		return nil, err
+	}
+	p.log.Debugf("got request for %s", req.URL)
+	if !p.isAllowed(req) {
+		p.log.Errorf("invalid AllowedHost: %s", req.Host)
+		return nil, errors.New("requested host invalid")
+	}
+	p.log.Debugf("doing round trip with %s", req.URL)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		p.log.Errorf("http.Request: %v", req)
+		p.log.Errorf("DefaultTransport: %s", err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readBody reads the body of resp, up to max_response_size.
+func (p *proxy) readBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(p.maxResponseSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > p.maxResponseSize {
+		return nil, fmt.Errorf("response exceeds maximum size of %d bytes", p.maxResponseSize)
+	}
+	return body, nil
+}
+
+func (p *proxy) roundTrip(req *common.Request) (*common.Response, error) {
+	resp, err := p.doRoundTrip(req.Payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := p.readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	return p.responses.first(resp.StatusCode, resp.Header, body, p.pageSize(req))
+}
+
+func (p *proxy) legacyRoundTrip(rawReq []byte) ([]byte, error) {
+	resp, err := p.doRoundTrip(rawReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := p.readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	p.log.Debugf("writing raw response")
+	return httputil.DumpResponse(resp, true)
+}
+
 func main() {
 	var logLevel string
 	var logDir string
 	var host string
+	var maxResponseSize int
+	var maxPayload int
+	var responseTTL int
 	flag.StringVar(&logDir, "log_dir", "", "logging directory")
 	flag.StringVar(&logLevel, "log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
-	flag.StringVar(&host, "host", "*", "wildcard allow proxy to any http.Request.Host")
+	flag.StringVar(&host, "host", "*", "comma separated list of allowed http.Request.Host, or wildcard allow proxy to any")
+	flag.IntVar(&maxResponseSize, "max_response_size", 10*1024*1024, "maximum size in bytes of a proxied response body")
+	flag.IntVar(&maxPayload, "max_payload", 2000, "maximum size in bytes of a reply, usually the mixnet's UserForwardPayloadLength")
+	flag.IntVar(&responseTTL, "response_ttl", 300, "time in seconds that a paged response is kept for the client")
 	flag.Parse()
 
 	// Ensure that the log directory exists.
@@ -129,9 +214,18 @@ func main() {
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.http_proxy.socket", os.Getpid()))
 
-	p := &proxy{allowedHost: make(map[string]struct{}), log: serverLog}
-	// TODO: support csv host arg
-	p.allowedHost[host] = struct{}{}
+	p := &proxy{
+		allowedHost:     make(map[string]struct{}),
+		maxResponseSize: maxResponseSize,
+		maxPayload:      maxPayload,
+		responses:       newResponseStore(time.Duration(responseTTL)*time.Second, 10*maxResponseSize),
+		log:             serverLog,
+	}
+	for _, h := range strings.Split(host, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			p.allowedHost[h] = struct{}{}
+		}
+	}
 
 	cmdBuilder := new(cborplugin.RequestFactory)
 	server := cborplugin.NewServer(serverLog, socketFile, cmdBuilder, p)
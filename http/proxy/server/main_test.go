@@ -0,0 +1,80 @@
+// main_test.go - http proxy round trip tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cbor "github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/http/proxy/common"
+)
+
+func newTestProxy(t *testing.T, maxResponseSize, maxPayload int) *proxy {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	return &proxy{
+		allowedHost:     map[string]struct{}{"*": {}},
+		maxResponseSize: maxResponseSize,
+		maxPayload:      maxPayload,
+		responses:       newResponseStore(time.Minute, 10*maxResponseSize),
+		log:             logBackend.GetLogger("http_proxy"),
+	}
+}
+
+func TestProxyLimits(t *testing.T) {
+	require := require.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 5000))
+	}))
+	defer srv.Close()
+	rawReq := []byte(fmt.Sprintf("GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", srv.URL, srv.Listener.Addr()))
+
+	// responses larger than max_response_size are rejected, also for
+	// clients that predate paging
+	p := newTestProxy(t, 4999, 2000)
+	_, err := p.legacyRoundTrip(rawReq)
+	require.Error(err)
+	_, err = p.roundTrip(&common.Request{Payload: rawReq, MaxPayload: 2000})
+	require.Error(err)
+
+	p = newTestProxy(t, 5000, 2000)
+	raw, err := p.legacyRoundTrip(rawReq)
+	require.NoError(err)
+	require.Greater(len(raw), 5000)
+
+	// the page size is bounded by max_payload, whatever the client asks
+	resp, err := p.roundTrip(&common.Request{Payload: rawReq, MaxPayload: 1 << 20})
+	require.NoError(err)
+	require.NotNil(resp.Token)
+	serialized, err := cbor.Marshal(resp)
+	require.NoError(err)
+	require.LessOrEqual(len(serialized), 2000)
+
+	// but may be lowered by the client
+	resp, err = p.roundTrip(&common.Request{Payload: rawReq, MaxPayload: 1000})
+	require.NoError(err)
+	serialized, err = cbor.Marshal(resp)
+	require.NoError(err)
+	require.LessOrEqual(len(serialized), 1000)
+}
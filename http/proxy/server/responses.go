@@ -0,0 +1,173 @@
+// responses.go - paged http responses
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	cbor "github.com/fxamacker/cbor/v2"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/http/proxy/common"
+)
+
+// cborBytesHeaderLength is the maximum size of the CBOR header that
+// precedes a byte string.
+const cborBytesHeaderLength = 9
+
+var (
+	errUnknownToken    = errors.New("unknown or expired continuation token")
+	errInvalidOffset   = errors.New("invalid continuation offset")
+	errPayloadTooSmall = errors.New("MaxPayload too small")
+	errStoreFull       = errors.New("too many pending responses")
+)
+
+type pendingResponse struct {
+	statusCode int
+	header     map[string][]string
+	body       []byte
+	expiresAt  time.Time
+}
+
+// responseStore holds the bodies of responses that do not fit in a
+// single reply until the client has fetched all of their pages.
+type responseStore struct {
+	sync.Mutex
+
+	ttl      time.Duration
+	maxBytes int
+	size     int
+
+	pending map[[common.TokenLength]byte]*pendingResponse
+}
+
+func newResponseStore(ttl time.Duration, maxBytes int) *responseStore {
+	return &responseStore{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		pending:  make(map[[common.TokenLength]byte]*pendingResponse),
+	}
+}
+
+func (s *responseStore) prune(now time.Time) {
+	for k, r := range s.pending {
+		if now.After(r.expiresAt) {
+			s.size -= len(r.body)
+			delete(s.pending, k)
+		}
+	}
+}
+
+// first returns the first page of a response, storing the remainder
+// of the body if it does not fit.
+func (s *responseStore) first(statusCode int, header map[string][]string, body []byte, maxPayload int) (*common.Response, error) {
+	resp := &common.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Length:     uint64(len(body)),
+	}
+	n, err := pageLength(resp, maxPayload)
+	if err != nil {
+		return nil, err
+	}
+	if n >= len(body) {
+		resp.Payload = body
+		return resp, nil
+	}
+
+	token := [common.TokenLength]byte{}
+	if _, err := io.ReadFull(rand.Reader, token[:]); err != nil {
+		return nil, err
+	}
+	// the token is part of the page, so measure again before storing
+	// the response.
+	resp.Token = token[:]
+	if n, err = pageLength(resp, maxPayload); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.prune(time.Now())
+	if s.size+len(body) > s.maxBytes {
+		return nil, errStoreFull
+	}
+	s.pending[token] = &pendingResponse{
+		statusCode: statusCode,
+		header:     header,
+		body:       body,
+		expiresAt:  time.Now().Add(s.ttl),
+	}
+	s.size += len(body)
+	resp.Payload = body[:n]
+	return resp, nil
+}
+
+// next returns the page of a stored response starting at offset.
+func (s *responseStore) next(token []byte, offset uint64, maxPayload int) (*common.Response, error) {
+	if len(token) != common.TokenLength {
+		return nil, errUnknownToken
+	}
+	k := [common.TokenLength]byte{}
+	copy(k[:], token)
+
+	s.Lock()
+	defer s.Unlock()
+	s.prune(time.Now())
+	r, ok := s.pending[k]
+	if !ok {
+		return nil, errUnknownToken
+	}
+	if offset > uint64(len(r.body)) {
+		return nil, errInvalidOffset
+	}
+	resp := &common.Response{
+		StatusCode: r.statusCode,
+		Length:     uint64(len(r.body)),
+		Offset:     offset,
+		Token:      token,
+	}
+	n, err := pageLength(resp, maxPayload)
+	if err != nil {
+		return nil, err
+	}
+	rest := r.body[offset:]
+	if n >= len(rest) {
+		// last page, forget the response.
+		s.size -= len(r.body)
+		delete(s.pending, k)
+		resp.Token = nil
+		resp.Payload = rest
+		return resp, nil
+	}
+	resp.Payload = rest[:n]
+	return resp, nil
+}
+
+// pageLength returns how many body bytes fit in resp given maxPayload.
+func pageLength(resp *common.Response, maxPayload int) (int, error) {
+	empty, err := cbor.Marshal(resp)
+	if err != nil {
+		return 0, err
+	}
+	n := maxPayload - len(empty) - cborBytesHeaderLength
+	if n <= 0 {
+		return 0, errPayloadTooSmall
+	}
+	return n, nil
+}
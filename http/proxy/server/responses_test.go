@@ -0,0 +1,113 @@
+// responses_test.go - paged http response tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	cbor "github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/http/proxy/common"
+)
+
+func TestResponsePaging(t *testing.T) {
+	require := require.New(t)
+
+	const maxPayload = 2000
+	body := make([]byte, 10*maxPayload)
+	_, err := io.ReadFull(rand.Reader, body)
+	require.NoError(err)
+	header := map[string][]string{"Content-Type": {"application/octet-stream"}}
+
+	s := newResponseStore(time.Minute, len(body))
+	resp, err := s.first(200, header, body, maxPayload)
+	require.NoError(err)
+	require.Equal(200, resp.StatusCode)
+	require.Equal(header, resp.Header)
+	require.Equal(uint64(len(body)), resp.Length)
+	require.NotNil(resp.Token)
+
+	out := []byte{}
+	pages := 0
+	for {
+		serialized, err := cbor.Marshal(resp)
+		require.NoError(err)
+		require.True(len(serialized) <= maxPayload, "page of %d bytes exceeds %d", len(serialized), maxPayload)
+		require.Equal(uint64(len(out)), resp.Offset)
+		out = append(out, resp.Payload...)
+		pages++
+		if resp.Token == nil {
+			break
+		}
+		resp, err = s.next(resp.Token, uint64(len(out)), maxPayload)
+		require.NoError(err)
+	}
+	require.True(bytes.Equal(body, out))
+	require.True(pages > 10)
+
+	// The response is forgotten after its last page.
+	require.Len(s.pending, 0)
+	require.Equal(0, s.size)
+}
+
+func TestResponseSinglePage(t *testing.T) {
+	require := require.New(t)
+
+	s := newResponseStore(time.Minute, 0)
+	resp, err := s.first(404, nil, []byte("not found"), 2000)
+	require.NoError(err)
+	require.Nil(resp.Token)
+	require.Equal([]byte("not found"), resp.Payload)
+
+	_, err = s.first(200, nil, make([]byte, 4000), 2000)
+	require.Equal(errStoreFull, err)
+
+	_, err = s.first(200, nil, nil, 10)
+	require.Equal(errPayloadTooSmall, err)
+}
+
+func TestResponseExpiry(t *testing.T) {
+	require := require.New(t)
+
+	s := newResponseStore(time.Millisecond, 10000)
+	resp, err := s.first(200, nil, make([]byte, 4000), 2000)
+	require.NoError(err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = s.next(resp.Token, uint64(len(resp.Payload)), 2000)
+	require.Equal(errUnknownToken, err)
+	require.Equal(0, s.size)
+}
+
+func TestResponseTokenTooLarge(t *testing.T) {
+	require := require.New(t)
+
+	// The first page fits without the token, but not with it.
+	resp := &common.Response{StatusCode: 200, Length: 4000}
+	empty, err := cbor.Marshal(resp)
+	require.NoError(err)
+	maxPayload := len(empty) + cborBytesHeaderLength + 1
+
+	s := newResponseStore(time.Minute, 10000)
+	_, err = s.first(200, nil, make([]byte, 4000), maxPayload)
+	require.Equal(errPayloadTooSmall, err)
+	require.Equal(0, s.size)
+	require.Empty(s.pending)
+}
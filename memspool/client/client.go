@@ -17,9 +17,12 @@
 package client
 
 import (
+	"errors"
+
 	"github.com/katzenpost/katzenpost/client"
 	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/memspool/common"
 )
 
@@ -33,6 +36,14 @@ type SpoolWriteDescriptor struct {
 
 	// Provider is the name of the Provider hosting the spool.
 	Provider string
+
+	// Capability authorizes appending to the spool, if set.
+	Capability *common.WriteCapability `cbor:",omitempty"`
+}
+
+// AppendCommand returns the command appending message to the spool.
+func (w *SpoolWriteDescriptor) AppendCommand(message []byte, geo *geo.Geometry) ([]byte, error) {
+	return common.AppendToSpoolWithCapability(w.ID, w.Capability, message, geo)
 }
 
 // SpoolReadDescriptor describes a remotely readable spool.
@@ -69,6 +80,44 @@ func (r *SpoolReadDescriptor) GetWriteDescriptor() *SpoolWriteDescriptor {
 	}
 }
 
+// NewWriteDescriptor returns a SpoolWriteDescriptor with a new write
+// capability, which can be revoked with RevokeCapability without
+// affecting the other write descriptors.
+func (r *SpoolReadDescriptor) NewWriteDescriptor() (*SpoolWriteDescriptor, error) {
+	capability, err := common.NewWriteCapability(r.ID, r.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	desc := r.GetWriteDescriptor()
+	desc.Capability = capability
+	return desc, nil
+}
+
+// RevokeCapability blocks until the write capability of the given
+// SpoolWriteDescriptor is revoked or the round trip timeout is reached.
+func (r *SpoolReadDescriptor) RevokeCapability(desc *SpoolWriteDescriptor, session *client.Session) error {
+	if desc.Capability == nil {
+		return errors.New("write descriptor has no capability")
+	}
+	revokeCmd, err := common.RevokeCapability(r.ID, desc.Capability, r.PrivateKey)
+	if err != nil {
+		return err
+	}
+	reply, err := session.BlockingSendReliableMessage(r.Receiver, r.Provider, revokeCmd)
+	if err != nil {
+		return err
+	}
+	spoolResponse := &common.SpoolResponse{}
+	err = spoolResponse.Unmarshal(reply)
+	if err != nil {
+		return err
+	}
+	if !spoolResponse.IsOK() {
+		return spoolResponse.StatusAsError()
+	}
+	return nil
+}
+
 // NewSpoolReadDescriptor blocks until the remote spool is created
 // or the round trip timeout is reached.
 func NewSpoolReadDescriptor(receiver, provider string, session *client.Session) (*SpoolReadDescriptor, error) {
@@ -0,0 +1,130 @@
+// client_test.go - memspool client tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	cc "github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/memspool/common"
+	sConfig "github.com/katzenpost/katzenpost/server/config"
+	"github.com/katzenpost/katzenpost/testnet"
+)
+
+func TestUnreliableSpoolService(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	memspool, err := testnet.BuildPlugin("github.com/katzenpost/katzenpost/memspool/server/cmd/memspool", t.TempDir())
+	require.NoError(err)
+
+	n, err := testnet.New(&testnet.Config{
+		DataDir:  t.TempDir(),
+		LogLevel: "INFO",
+		CBORPluginKaetzchen: []*sConfig.CBORPluginKaetzchen{
+			&sConfig.CBORPluginKaetzchen{
+				Capability:     common.SpoolServiceName,
+				Endpoint:       "+spool",
+				Command:        memspool,
+				MaxConcurrency: 1,
+				Config: map[string]interface{}{
+					"data_store": "$DATA_DIR/memspool.storage",
+				},
+			},
+		},
+	})
+	require.NoError(err)
+	require.NoError(n.Start())
+	defer n.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	_, err = n.WaitForConsensus(ctx)
+	require.NoError(err)
+
+	cfg, err := n.ClientConfig()
+	require.NoError(err)
+	client, err := cc.New(cfg)
+	require.NoError(err)
+	defer func() {
+		client.Shutdown()
+		client.Wait()
+	}()
+
+	s, err := client.NewTOFUSession(ctx, cc.WithClock(n.Clock()))
+	require.NoError(err)
+
+	s.WaitForDocument(ctx)
+
+	// look up a spool provider
+	desc, err := s.GetService(common.SpoolServiceName)
+	require.NoError(err)
+	t.Logf("Found spool provider: %v@%v", desc.Name, desc.Provider)
+
+	// create the spool on the remote provider
+	spoolReadDescriptor, err := NewSpoolReadDescriptor(desc.Name, desc.Provider, s)
+	require.NoError(err)
+
+	// append to a spool
+	message := []byte("hello there")
+	appendCmd, err := common.AppendToSpool(spoolReadDescriptor.ID, message, s.SphinxGeometry())
+	require.NoError(err)
+	rawResponse, err := s.BlockingSendReliableMessage(desc.Name, desc.Provider, appendCmd)
+	require.NoError(err)
+	response := new(common.SpoolResponse)
+	err = response.Unmarshal(rawResponse)
+	require.NoError(err)
+	require.True(response.IsOK())
+
+	messageID := uint32(1) // where do we learn messageID?
+
+	// read from a spool (should find our original message)
+	readCmd, err := common.ReadFromSpool(spoolReadDescriptor.ID, messageID, spoolReadDescriptor.PrivateKey)
+	require.NoError(err)
+	rawResponse, err = s.BlockingSendReliableMessage(desc.Name, desc.Provider, readCmd)
+	require.NoError(err)
+	response = new(common.SpoolResponse)
+	err = response.Unmarshal(rawResponse)
+	require.NoError(err)
+	require.True(response.IsOK())
+	// XXX require.Equal(response.SpoolID, spoolReadDescriptor.ID)
+	require.True(bytes.Equal(response.Message, message))
+
+	// purge a spool
+	purgeCmd, err := common.PurgeSpool(spoolReadDescriptor.ID, spoolReadDescriptor.PrivateKey)
+	require.NoError(err)
+	rawResponse, err = s.BlockingSendReliableMessage(desc.Name, desc.Provider, purgeCmd)
+	require.NoError(err)
+	response = new(common.SpoolResponse)
+	err = response.Unmarshal(rawResponse)
+	require.NoError(err)
+	require.True(response.IsOK())
+
+	// read from a spool (should be empty?)
+	readCmd, err = common.ReadFromSpool(spoolReadDescriptor.ID, messageID, spoolReadDescriptor.PrivateKey)
+	require.NoError(err)
+	rawResponse, err = s.BlockingSendReliableMessage(desc.Name, desc.Provider, readCmd)
+	require.NoError(err)
+	response = new(common.SpoolResponse)
+	err = response.Unmarshal(rawResponse)
+	require.NoError(err)
+	require.False(response.IsOK())
+}
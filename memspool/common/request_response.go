@@ -17,11 +17,14 @@
 package common
 
 import (
+	"encoding/binary"
 	"errors"
 
 	"github.com/fxamacker/cbor/v2"
 
 	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 )
 
@@ -39,6 +42,9 @@ const (
 	// MessageIDSize is the size of a message identity.
 	MessageIDSize = 4
 
+	// NonceSize is the size of the random nonce of a signed spool command.
+	NonceSize = 16
+
 	// ResponsePadding is size of the padding of the spool service response.
 	ResponsePadding = 171
 
@@ -46,6 +52,13 @@ const (
 	// from the spool command CBOR encoding.
 	QueryOverhead = 171
 
+	// WriteCapabilityIDSize is the size of a write capability identity.
+	WriteCapabilityIDSize = 16
+
+	// WriteCapabilityOverhead is the number of bytes overhead from
+	// the CBOR encoding of a write capability in an append command.
+	WriteCapabilityOverhead = 128
+
 	// CreateSpoolCommand is the identity of the create spool command.
 	CreateSpoolCommand = 0
 
@@ -58,6 +71,21 @@ const (
 	// RetrieveMessageCommand is the identity of the retrieve message command.
 	RetrieveMessageCommand = 3
 
+	// DeleteMessagesCommand is the identity of the delete messages command.
+	DeleteMessagesCommand = 4
+
+	// RetrieveMessagesCommand is the identity of the retrieve messages
+	// command, which retrieves several consecutive messages in one response.
+	RetrieveMessagesCommand = 5
+
+	// HighWaterMarkCommand is the identity of the command querying the
+	// message ID of the last message appended to a spool.
+	HighWaterMarkCommand = 6
+
+	// RevokeCapabilityCommand is the identity of the command revoking
+	// a write capability.
+	RevokeCapabilityCommand = 7
+
 	// SpoolServiceName is the canonical name of the memspool service.
 	SpoolServiceName = "spool"
 
@@ -76,6 +104,104 @@ type SpoolRequest struct {
 	PublicKey []byte
 	MessageID uint32
 	Message   []byte
+
+	// Count is the number of messages starting at MessageID which
+	// are deleted or retrieved. When retrieving, zero means as many
+	// messages as fit in the response.
+	Count uint32 `cbor:",omitempty"`
+
+	// Capability authorizes appending to the spool, or is the
+	// capability to revoke.
+	Capability *WriteCapability `cbor:",omitempty"`
+
+	// Epoch is the epoch in which the command was signed.
+	Epoch uint64 `cbor:",omitempty"`
+
+	// Nonce is a random value which makes each signed command unique.
+	Nonce []byte `cbor:",omitempty"`
+
+	// RequestSignature is the signature of the command, made with the
+	// spool key. Unlike Signature, which is the signature of the public
+	// key, it cannot be replayed in another command or epoch.
+	RequestSignature []byte `cbor:",omitempty"`
+}
+
+// requestContext is signed along with a spool command, so that its
+// signature cannot be mistaken for another signature made with the key.
+const requestContext = "memspool request"
+
+// SignedMessage returns the message signed by RequestSignature, which
+// binds the command to its type, spool, arguments, epoch and nonce.
+func (s *SpoolRequest) SignedMessage() []byte {
+	m := []byte(requestContext)
+	m = append(m, s.Command)
+	m = append(m, s.SpoolID[:]...)
+	m = binary.BigEndian.AppendUint32(m, s.MessageID)
+	m = binary.BigEndian.AppendUint32(m, s.Count)
+	capabilityID := [WriteCapabilityIDSize]byte{}
+	if s.Capability != nil {
+		capabilityID = s.Capability.ID
+	}
+	m = append(m, capabilityID[:]...)
+	m = binary.BigEndian.AppendUint64(m, s.Epoch)
+	return append(m, s.Nonce...)
+}
+
+// sign signs the command for the current epoch. The legacy Signature of
+// the public key is left empty, as it could be replayed in any command
+// with the RequestSignature stripped.
+func (s *SpoolRequest) sign(privKey *eddsa.PrivateKey) error {
+	s.PublicKey = privKey.PublicKey().Bytes()
+	s.Epoch, _, _ = epochtime.Now()
+	s.Nonce = make([]byte, NonceSize)
+	if _, err := rand.Reader.Read(s.Nonce); err != nil {
+		return err
+	}
+	s.RequestSignature = privKey.Sign(s.SignedMessage())
+	return nil
+}
+
+// Verify returns true if RequestSignature was made with the given key.
+func (s *SpoolRequest) Verify(publicKey *eddsa.PublicKey) bool {
+	return len(s.Nonce) == NonceSize && publicKey.Verify(s.RequestSignature, s.SignedMessage())
+}
+
+// WriteCapability authorizes appending to a spool. It is minted by the
+// owner of the spool, who gives each contact its own capability so that
+// it can be revoked without affecting the other contacts.
+type WriteCapability struct {
+	// ID is the random identity of the capability.
+	ID [WriteCapabilityIDSize]byte
+
+	// Signature is the signature of the spool ID and the capability ID
+	// made with the spool key.
+	Signature []byte
+}
+
+// writeCapabilityContext is signed along with a write capability, so that
+// its signature cannot be mistaken for the signature of a spool command.
+const writeCapabilityContext = "memspool write capability"
+
+func writeCapabilityMessage(spoolID [SpoolIDSize]byte, id [WriteCapabilityIDSize]byte) []byte {
+	m := []byte(writeCapabilityContext)
+	m = append(m, spoolID[:]...)
+	return append(m, id[:]...)
+}
+
+// NewWriteCapability returns a new write capability for the spool.
+func NewWriteCapability(spoolID [SpoolIDSize]byte, privKey *eddsa.PrivateKey) (*WriteCapability, error) {
+	w := new(WriteCapability)
+	if _, err := rand.Reader.Read(w.ID[:]); err != nil {
+		return nil, err
+	}
+	w.Signature = privKey.Sign(writeCapabilityMessage(spoolID, w.ID))
+	return w, nil
+}
+
+// Verify returns true if the capability was minted for the spool by the
+// holder of the spool key.
+func (w *WriteCapability) Verify(spoolID [SpoolIDSize]byte, publicKey *eddsa.PublicKey) bool {
+	return publicKey.Verify(w.Signature, writeCapabilityMessage(spoolID, w.ID))
 }
 
 // Marshal implements cborplugin.Command
@@ -94,6 +220,14 @@ type SpoolResponse struct {
 	MessageID uint32
 	Message   []byte
 	Status    string
+
+	// Messages are the consecutive messages starting at MessageID
+	// returned by the retrieve messages command.
+	Messages [][]byte `cbor:",omitempty"`
+
+	// HighWaterMark is the message ID of the last message appended
+	// to the spool.
+	HighWaterMark uint32 `cbor:",omitempty"`
 }
 
 // Marshal implements cborplugin.Command
@@ -115,55 +249,111 @@ func (s *SpoolResponse) StatusAsError() error {
 }
 
 func CreateSpool(privKey *eddsa.PrivateKey) ([]byte, error) {
-	signature := privKey.Sign(privKey.PublicKey().Bytes())
 	emtpySpoolID := [SpoolIDSize]byte{}
 	emptyMessage := []byte{}
 	s := SpoolRequest{
 		Command:   CreateSpoolCommand,
 		SpoolID:   emtpySpoolID,
-		Signature: signature,
-		PublicKey: privKey.PublicKey().Bytes(),
 		MessageID: 0,
 		Message:   emptyMessage,
 	}
+	if err := s.sign(privKey); err != nil {
+		return nil, err
+	}
 	return s.Marshal()
 }
 
 func PurgeSpool(spoolID [SpoolIDSize]byte, privKey *eddsa.PrivateKey) ([]byte, error) {
-	signature := privKey.Sign(privKey.PublicKey().Bytes())
 	s := SpoolRequest{
-		Command:   PurgeSpoolCommand,
-		PublicKey: privKey.PublicKey().Bytes(),
-		Signature: signature,
-		SpoolID:   spoolID,
+		Command: PurgeSpoolCommand,
+		SpoolID: spoolID,
+	}
+	if err := s.sign(privKey); err != nil {
+		return nil, err
 	}
 	return s.Marshal()
 }
 
 func SpoolPayloadLength(geo *geo.Geometry) int {
-	return (geo.UserForwardPayloadLength - 4) - QueryOverhead
+	return (geo.UserForwardPayloadLength - 4) - QueryOverhead - WriteCapabilityOverhead
 }
 
 func AppendToSpool(spoolID [SpoolIDSize]byte, message []byte, geo *geo.Geometry) ([]byte, error) {
+	return AppendToSpoolWithCapability(spoolID, nil, message, geo)
+}
+
+// AppendToSpoolWithCapability returns an append command authorized by the
+// given write capability, which may be nil.
+func AppendToSpoolWithCapability(spoolID [SpoolIDSize]byte, capability *WriteCapability, message []byte, geo *geo.Geometry) ([]byte, error) {
 	if len(message) > SpoolPayloadLength(geo) {
 		return nil, errors.New("exceeds payload maximum")
 	}
 	s := SpoolRequest{
-		Command: AppendMessageCommand,
-		SpoolID: spoolID,
-		Message: message[:],
+		Command:    AppendMessageCommand,
+		SpoolID:    spoolID,
+		Message:    message[:],
+		Capability: capability,
 	}
 	return s.Marshal()
 }
 
 func ReadFromSpool(spoolID [SpoolIDSize]byte, messageID uint32, privKey *eddsa.PrivateKey) ([]byte, error) {
-	signature := privKey.Sign(privKey.PublicKey().Bytes())
 	s := SpoolRequest{
 		Command:   RetrieveMessageCommand,
-		PublicKey: privKey.PublicKey().Bytes(),
-		Signature: signature,
 		SpoolID:   spoolID,
 		MessageID: messageID,
 	}
+	if err := s.sign(privKey); err != nil {
+		return nil, err
+	}
+	return s.Marshal()
+}
+
+func DeleteFromSpool(spoolID [SpoolIDSize]byte, messageID, count uint32, privKey *eddsa.PrivateKey) ([]byte, error) {
+	s := SpoolRequest{
+		Command:   DeleteMessagesCommand,
+		SpoolID:   spoolID,
+		MessageID: messageID,
+		Count:     count,
+	}
+	if err := s.sign(privKey); err != nil {
+		return nil, err
+	}
+	return s.Marshal()
+}
+
+func ReadRangeFromSpool(spoolID [SpoolIDSize]byte, messageID, count uint32, privKey *eddsa.PrivateKey) ([]byte, error) {
+	s := SpoolRequest{
+		Command:   RetrieveMessagesCommand,
+		SpoolID:   spoolID,
+		MessageID: messageID,
+		Count:     count,
+	}
+	if err := s.sign(privKey); err != nil {
+		return nil, err
+	}
+	return s.Marshal()
+}
+
+func QueryHighWaterMark(spoolID [SpoolIDSize]byte, privKey *eddsa.PrivateKey) ([]byte, error) {
+	s := SpoolRequest{
+		Command: HighWaterMarkCommand,
+		SpoolID: spoolID,
+	}
+	if err := s.sign(privKey); err != nil {
+		return nil, err
+	}
+	return s.Marshal()
+}
+
+func RevokeCapability(spoolID [SpoolIDSize]byte, capability *WriteCapability, privKey *eddsa.PrivateKey) ([]byte, error) {
+	s := SpoolRequest{
+		Command:    RevokeCapabilityCommand,
+		SpoolID:    spoolID,
+		Capability: &WriteCapability{ID: capability.ID},
+	}
+	if err := s.sign(privKey); err != nil {
+		return nil, err
+	}
 	return s.Marshal()
 }
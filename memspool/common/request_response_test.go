@@ -20,22 +20,74 @@ import (
 	"testing"
 
 	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/stretchr/testify/require"
 )
 
 func TestCommandSerialization(t *testing.T) {
 	require := require.New(t)
 	pk, err := eddsa.NewKeypair(rand.Reader)
-	signature := pk.Sign(pk.PublicKey().Bytes())
 	require.NoError(err)
 	cmd, err := CreateSpool(pk)
 	require.NoError(err)
 	sr := new(SpoolRequest)
 	require.NoError(sr.Unmarshal(cmd))
 	require.Equal(sr.Command, uint8(CreateSpoolCommand))
-	require.NotNil(sr.Signature)
-	require.Equal(sr.Signature, signature)
+	require.True(sr.Verify(pk.PublicKey()))
 	require.NotNil(sr.PublicKey)
 	require.NotNil(sr.MessageID)
 }
+
+func TestWriteCapability(t *testing.T) {
+	require := require.New(t)
+	pk, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	spoolID := [SpoolIDSize]byte{1}
+	capability, err := NewWriteCapability(spoolID, pk)
+	require.NoError(err)
+	require.True(capability.Verify(spoolID, pk.PublicKey()))
+	require.False(capability.Verify([SpoolIDSize]byte{2}, pk.PublicKey()))
+	other, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	require.False(capability.Verify(spoolID, other.PublicKey()))
+
+	// an append command with a capability fits in the payload
+	g := geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 2000, true, 5)
+	cmd, err := AppendToSpoolWithCapability(spoolID, capability, make([]byte, SpoolPayloadLength(g)), g)
+	require.NoError(err)
+	require.LessOrEqual(len(cmd), g.UserForwardPayloadLength-4)
+	sr := new(SpoolRequest)
+	require.NoError(sr.Unmarshal(cmd))
+	require.Equal(capability, sr.Capability)
+}
+
+func TestRequestSignature(t *testing.T) {
+	require := require.New(t)
+	pk, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	cmd, err := ReadFromSpool([SpoolIDSize]byte{1}, 2, pk)
+	require.NoError(err)
+	sr := new(SpoolRequest)
+	require.NoError(sr.Unmarshal(cmd))
+	require.True(sr.Verify(pk.PublicKey()))
+	require.Len(sr.Nonce, NonceSize)
+
+	// the replayable legacy signature is not included
+	require.Nil(sr.Signature)
+
+	for _, tamper := range []func(*SpoolRequest){
+		func(r *SpoolRequest) { r.Command = PurgeSpoolCommand },
+		func(r *SpoolRequest) { r.SpoolID[0] = 2 },
+		func(r *SpoolRequest) { r.MessageID = 3 },
+		func(r *SpoolRequest) { r.Epoch++ },
+		func(r *SpoolRequest) { r.Nonce = make([]byte, NonceSize) },
+		func(r *SpoolRequest) { r.Capability = &WriteCapability{ID: [WriteCapabilityIDSize]byte{1}} },
+	} {
+		r := new(SpoolRequest)
+		require.NoError(r.Unmarshal(cmd))
+		tamper(r)
+		require.False(r.Verify(pk.PublicKey()))
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/memspool/common"
@@ -37,9 +38,21 @@ func main() {
 	var logLevel string
 	var logDir string
 	var dataStore string
+	var maxMessages int
+	var maxAge time.Duration
+	var requireCapability bool
+	var appendRate int
+	var appendBurst int
+	var legacyUntil string
 	flag.StringVar(&dataStore, "data_store", "", "data storage file path")
 	flag.StringVar(&logDir, "log_dir", "", "logging directory")
 	flag.StringVar(&logLevel, "log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
+	flag.IntVar(&maxMessages, "max_messages", 0, "maximum number of messages kept in each spool, 0 for no limit")
+	flag.DurationVar(&maxAge, "max_age", 0, "maximum age of the messages kept in each spool, 0 for no limit")
+	flag.BoolVar(&requireCapability, "require_write_capability", false, "reject appends without a write capability")
+	flag.IntVar(&appendRate, "append_rate", 0, "maximum appends per minute for each write capability, 0 for no limit")
+	flag.IntVar(&appendBurst, "append_burst", 10, "maximum burst of appends for each write capability")
+	flag.StringVar(&legacyUntil, "legacy_signatures_until", "", "RFC 3339 time until which the requests of older clients, without replay protection, are accepted; they are rejected if unset")
 	flag.Parse()
 
 	if dataStore == "" {
@@ -73,7 +86,22 @@ func main() {
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.memspool.socket", os.Getpid()))
 
-	spoolMap, err := server.NewMemSpoolMap(dataStore, serverLog)
+	opts := []server.MemSpoolMapOption{
+		server.WithRetention(maxMessages, maxAge),
+		server.WithAppendRateLimit(appendRate, appendBurst),
+	}
+	if requireCapability {
+		opts = append(opts, server.WithRequiredWriteCapability())
+	}
+	if legacyUntil != "" {
+		t, err := time.Parse(time.RFC3339, legacyUntil)
+		if err != nil {
+			fmt.Printf("Invalid legacy_signatures_until: %s\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, server.WithLegacySignaturesUntil(t))
+	}
+	spoolMap, err := server.NewMemSpoolMap(dataStore, serverLog, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -115,7 +143,7 @@ func (s *spoolRequestHandler) OnCommand(cmd cborplugin.Command) error {
 		}
 
 		go func() {
-			resp := server.HandleSpoolRequest(s.m, req, s.log)
+			resp := server.HandleSpoolRequest(s.m, req, len(r.Payload), s.log)
 			rawResp, err := resp.Marshal()
 			if err != nil {
 				return
@@ -20,12 +20,14 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	sha512 "crypto/sha512"
 	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/memspool/common"
 	bolt "go.etcd.io/bbolt"
@@ -40,6 +42,11 @@ const (
 	messagesKey      = "message"
 	spoolMetadataKey = "spoolMetadata"
 	spoolPublicKey   = "spoolPublicKey"
+	messageTimesKey  = "messageTimes"
+	highWaterMarkKey = "highWaterMark"
+	revokedKey       = "revokedCapabilities"
+
+	noncesBucketName = "nonces"
 
 	writeBackInterval = 30 * time.Second
 
@@ -48,13 +55,40 @@ const (
 
 var (
 	errSpoolAlreadyExists = errors.New("Spool Already Exists")
+	errInvalidCount       = errors.New("invalid message count")
+	errResponseTooLarge   = errors.New("message exceeds response length")
+	errCapabilityRequired = errors.New("write capability required")
+	errInvalidCapability  = errors.New("invalid write capability")
+	errRevokedCapability  = errors.New("write capability revoked")
+	errRateLimited        = errors.New("append rate limit exceeded")
+	errInvalidSignature   = errors.New("invalid signature")
+	errLegacySignature    = errors.New("legacy signatures are no longer accepted")
+	errStaleRequest       = errors.New("request signed in another epoch")
+	errReplayedRequest    = errors.New("replayed request")
 )
 
-func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log *logging.Logger) *common.SpoolResponse {
+// HandleSpoolRequest executes a spool command and returns the response.
+// responseLength is the maximum length of the serialized response, which
+// limits how many messages the retrieve messages command returns, or zero
+// for no limit.
+func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, responseLength int, log *logging.Logger) *common.SpoolResponse {
 	log.Debug("start of handle spool request")
 	spoolResponse := common.SpoolResponse{}
 	spoolID := [common.SpoolIDSize]byte{}
 	copy(spoolID[:], request.SpoolID[:])
+	var spool *MemSpool
+	if request.Command != common.AppendMessageCommand {
+		err := spoolMap.Authenticate(request)
+		if err == nil && request.Command != common.CreateSpoolCommand {
+			spool, err = spoolMap.requestSpool(request)
+		}
+		if err != nil {
+			spoolResponse.SpoolID = spoolID
+			spoolResponse.Status = err.Error()
+			log.Error(spoolResponse.Status)
+			return &spoolResponse
+		}
+	}
 	switch request.Command {
 	case common.CreateSpoolCommand:
 		log.Debug("create spool")
@@ -66,7 +100,12 @@ func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log
 			return &spoolResponse
 		}
 		spoolResponse.Status = common.StatusOK
-		newSpoolID, err := spoolMap.CreateSpool(publicKey, request.Signature)
+		var newSpoolID *[common.SpoolIDSize]byte
+		if request.RequestSignature == nil {
+			newSpoolID, err = spoolMap.CreateSpool(publicKey, request.Signature)
+		} else {
+			newSpoolID, err = spoolMap.createSpool(publicKey)
+		}
 		if err != nil {
 			spoolResponse.Status = err.Error()
 			log.Error(spoolResponse.Status)
@@ -75,7 +114,7 @@ func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log
 		spoolResponse.SpoolID = *newSpoolID
 	case common.PurgeSpoolCommand:
 		log.Debug("purge spool")
-		err := spoolMap.PurgeSpool(spoolID, request.Signature)
+		err := spoolMap.purgeSpool(spoolID)
 		spoolResponse.SpoolID = spoolID
 		if err != nil {
 			spoolResponse.Status = err.Error()
@@ -85,7 +124,7 @@ func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log
 		spoolResponse.Status = common.StatusOK
 	case common.AppendMessageCommand:
 		log.Debugf("append to spool, with spool ID: %d", request.SpoolID)
-		err := spoolMap.AppendToSpool(spoolID, request.Message)
+		err := spoolMap.AppendToSpoolWithCapability(spoolID, request.Capability, request.Message)
 		log.Debug("after call to AppendToSpool")
 		spoolResponse.SpoolID = spoolID
 		if err != nil {
@@ -97,7 +136,7 @@ func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log
 	case common.RetrieveMessageCommand:
 		log.Debug("read from spool")
 		log.Debugf("before ReadFromSpool with message ID %d", request.MessageID)
-		message, err := spoolMap.ReadFromSpool(spoolID, request.Signature, request.MessageID)
+		message, _, err := spool.Get(request.MessageID)
 		log.Debug("after ReadFromSpool")
 		spoolResponse.SpoolID = spoolID
 		spoolResponse.MessageID = request.MessageID
@@ -108,23 +147,171 @@ func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log
 		}
 		spoolResponse.Status = common.StatusOK
 		spoolResponse.Message = message
+	case common.DeleteMessagesCommand:
+		log.Debugf("delete %d messages from spool, starting with message ID %d", request.Count, request.MessageID)
+		err := spoolMap.deleteFromSpool(spoolID, spool, request.MessageID, request.Count)
+		spoolResponse.SpoolID = spoolID
+		spoolResponse.MessageID = request.MessageID
+		if err != nil {
+			spoolResponse.Status = err.Error()
+			log.Error(spoolResponse.Status)
+			return &spoolResponse
+		}
+		spoolResponse.Status = common.StatusOK
+	case common.RetrieveMessagesCommand:
+		log.Debugf("read messages from spool, starting with message ID %d", request.MessageID)
+		spoolResponse.SpoolID = spoolID
+		spoolResponse.MessageID = request.MessageID
+		spoolResponse.Status = common.StatusOK
+		spoolResponse.HighWaterMark = spool.HighWaterMark()
+		maxLength := 0
+		if responseLength > 0 {
+			maxLength = responseLength - retrieveMessagesOverhead(&spoolResponse)
+			if maxLength <= 0 {
+				spoolResponse.Status = errResponseTooLarge.Error()
+				log.Error(spoolResponse.Status)
+				return &spoolResponse
+			}
+		}
+		first, messages, err := readRangeFromSpool(spool, request.MessageID, request.Count, maxLength)
+		if err != nil {
+			spoolResponse.Status = err.Error()
+			log.Error(spoolResponse.Status)
+			return &spoolResponse
+		}
+		spoolResponse.MessageID = first
+		spoolResponse.Messages = messages
+	case common.HighWaterMarkCommand:
+		log.Debug("query spool high water mark")
+		spoolResponse.SpoolID = spoolID
+		spoolResponse.Status = common.StatusOK
+		spoolResponse.HighWaterMark = spool.HighWaterMark()
+	case common.RevokeCapabilityCommand:
+		log.Debug("revoke write capability")
+		spoolResponse.SpoolID = spoolID
+		if request.Capability == nil {
+			spoolResponse.Status = errInvalidCapability.Error()
+			log.Error(spoolResponse.Status)
+			return &spoolResponse
+		}
+		err := spoolMap.revokeCapability(spoolID, spool, request.Capability.ID)
+		if err != nil {
+			spoolResponse.Status = err.Error()
+			log.Error(spoolResponse.Status)
+			return &spoolResponse
+		}
+		spoolResponse.Status = common.StatusOK
 	}
 	log.Debug("end of handle spool request")
 	return &spoolResponse
 }
 
+// retrieveMessagesOverhead returns an upper bound of the length of the
+// retrieve messages response beyond the encoded length of its messages.
+func retrieveMessagesOverhead(response *common.SpoolResponse) int {
+	r := *response
+	r.MessageID = ^uint32(0)
+	b, err := r.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	// the key and the header of the Messages array
+	return len(b) + len("Messages") + 2*cborHeaderLength
+}
+
+// cborHeaderLength is the maximum length of a CBOR data item header.
+const cborHeaderLength = 9
+
+// MemSpoolMapOption is an option that may be passed to NewMemSpoolMap.
+type MemSpoolMapOption func(*MemSpoolMap)
+
+// WithRetention limits every spool to the maxMessages most recent messages
+// that were appended less than maxAge ago. A zero value disables the
+// respective limit. Messages beyond the limits are deleted periodically.
+func WithRetention(maxMessages int, maxAge time.Duration) MemSpoolMapOption {
+	return func(m *MemSpoolMap) {
+		m.maxMessages = maxMessages
+		m.maxAge = maxAge
+	}
+}
+
+// WithRequiredWriteCapability rejects the appends which are not authorized
+// by a write capability.
+func WithRequiredWriteCapability() MemSpoolMapOption {
+	return func(m *MemSpoolMap) {
+		m.requireCapability = true
+	}
+}
+
+// WithAppendRateLimit limits the appends authorized by each write
+// capability to ratePerMinute, allowing bursts of up to burst appends.
+func WithAppendRateLimit(ratePerMinute, burst int) MemSpoolMapOption {
+	return func(m *MemSpoolMap) {
+		m.appendRate = float64(ratePerMinute) / float64(time.Minute)
+		m.appendBurst = float64(burst)
+	}
+}
+
+// WithLegacySignaturesUntil accepts the commands of older clients, which
+// carry no RequestSignature and are only authenticated by the replayable
+// signature of the spool public key, until the given time.  They are
+// rejected without this option.
+func WithLegacySignaturesUntil(t time.Time) MemSpoolMapOption {
+	return func(m *MemSpoolMap) {
+		m.legacyUntil = t
+	}
+}
+
+// appendLimiterKey identifies the write capability of a spool which an
+// appendLimiter applies to.
+type appendLimiterKey struct {
+	spoolID      [common.SpoolIDSize]byte
+	capabilityID [common.WriteCapabilityIDSize]byte
+}
+
+// appendLimiter is a token bucket limiting the appends of a write
+// capability.
+type appendLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
 type MemSpoolMap struct {
 	worker.Worker
 
 	spools *sync.Map
 	db     *bolt.DB
 	log    *logging.Logger
+
+	// flushLock serializes writing messages to the database with
+	// deleting them.
+	flushLock sync.Mutex
+
+	maxMessages int
+	maxAge      time.Duration
+	now         func() time.Time
+
+	requireCapability bool
+	appendRate        float64 // tokens per nanosecond
+	appendBurst       float64
+	limitersLock      sync.Mutex
+	limiters          map[appendLimiterKey]*appendLimiter
+
+	legacyUntil time.Time
+	noncesLock  sync.Mutex
+	nonces      map[[common.NonceSize]byte]uint64
 }
 
-func NewMemSpoolMap(fileStore string, log *logging.Logger) (*MemSpoolMap, error) {
+func NewMemSpoolMap(fileStore string, log *logging.Logger, opts ...MemSpoolMapOption) (*MemSpoolMap, error) {
 	m := &MemSpoolMap{
-		spools: new(sync.Map),
-		log:    log,
+		spools:   new(sync.Map),
+		log:      log,
+		now:      time.Now,
+		limiters: make(map[appendLimiterKey]*appendLimiter),
+		nonces:   make(map[[common.NonceSize]byte]uint64),
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
 	var err error
 	m.db, err = bolt.Open(fileStore, 0600, nil)
@@ -141,6 +328,14 @@ func NewMemSpoolMap(fileStore string, log *logging.Logger) (*MemSpoolMap, error)
 		if spoolsBucket, err = tx.CreateBucketIfNotExists([]byte(spoolsBucketName)); err != nil {
 			return err
 		}
+		// databases created by older versions have no nonces
+		var noncesBucket *bolt.Bucket
+		if noncesBucket, err = tx.CreateBucketIfNotExists([]byte(noncesBucketName)); err != nil {
+			return err
+		}
+		if err = m.loadNonces(noncesBucket); err != nil {
+			return err
+		}
 		if b := metaBucket.Get([]byte(versionKey)); b != nil {
 			// database loaded
 			if len(b) != 1 || b[0] != SpoolStorageVersion {
@@ -195,6 +390,16 @@ func (m *MemSpoolMap) load(tx *bolt.Tx, spoolsBucket *bolt.Bucket) error {
 		if messagesBucket == nil {
 			return errors.New("spool messages bucket not found")
 		}
+		// spools created by older versions have no message times
+		// or revoked capabilities
+		messageTimesBucket, err := spoolBucket.CreateBucketIfNotExists([]byte(messageTimesKey))
+		if err != nil {
+			return err
+		}
+		revokedBucket, err := spoolBucket.CreateBucketIfNotExists([]byte(revokedKey))
+		if err != nil {
+			return err
+		}
 		cur := messagesBucket.Cursor()
 		for k, v := cur.First(); k != nil; k, v = cur.Next() {
 			if len(k) != common.MessageIDSize {
@@ -211,10 +416,38 @@ func (m *MemSpoolMap) load(tx *bolt.Tx, spoolsBucket *bolt.Bucket) error {
 		if !ok {
 			panic("wtf")
 		}
+		spool := raw_spool.(*MemSpool)
+		err = revokedBucket.ForEach(func(k, v []byte) error {
+			if len(k) != common.WriteCapabilityIDSize {
+				return errors.New("invalid write capability ID encountered")
+			}
+			id := [common.WriteCapabilityIDSize]byte{}
+			copy(id[:], k)
+			spool.revoked.Store(id, struct{}{})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 		k, _ := cur.Last() // obtain the latest MessageID
 		if k != nil {
-			raw_spool.(*MemSpool).current = binary.BigEndian.Uint32(k[:])
+			spool.current = binary.BigEndian.Uint32(k[:])
 		} // empty spool...
+		// the latest messages may have been deleted
+		if b := spoolMetadataBucket.Get([]byte(highWaterMarkKey)); len(b) == 4 && binary.BigEndian.Uint32(b) > spool.current {
+			spool.current = binary.BigEndian.Uint32(b)
+		}
+		now := m.now()
+		spool.items.Range(func(rawMessageID, rawEntry interface{}) bool {
+			var msgID [common.MessageIDSize]byte
+			binary.BigEndian.PutUint32(msgID[:], rawMessageID.(uint32))
+			entry := rawEntry.(*SpoolEntry)
+			entry.Timestamp = now
+			if b := messageTimesBucket.Get(msgID[:]); len(b) == 8 {
+				entry.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+			}
+			return true
+		})
 	}
 	return nil
 }
@@ -247,6 +480,11 @@ func (m *MemSpoolMap) createSpoolBucket(publicKey *eddsa.PublicKey, spoolID *[co
 		if err != nil {
 			return err
 		}
+		_, err = spoolBucket.CreateBucket([]byte(messageTimesKey))
+		if err != nil {
+			return err
+		}
+		_, err = spoolBucket.CreateBucket([]byte(revokedKey))
 		return err
 	})
 	return err
@@ -257,6 +495,10 @@ func (m *MemSpoolMap) CreateSpool(publicKey *eddsa.PublicKey, signature []byte)
 	if !publicKey.Verify(signature, publicKey.Bytes()) {
 		return nil, errors.New("Spool creation failed, invalid signature")
 	}
+	return m.createSpool(publicKey)
+}
+
+func (m *MemSpoolMap) createSpool(publicKey *eddsa.PublicKey) (*[common.SpoolIDSize]byte, error) {
 	spoolID := [common.SpoolIDSize]byte{}
 	spoolhash := sha512.Sum512_256(publicKey.Bytes())
 	copy(spoolID[:], spoolhash[:common.SpoolIDSize])
@@ -287,8 +529,27 @@ func (m *MemSpoolMap) PurgeSpool(spoolID [common.SpoolIDSize]byte, signature []b
 	if !spool.PublicKey().Verify(signature, spool.PublicKey().Bytes()) {
 		return errors.New("invalid signature")
 	}
+	return m.purgeSpool(spoolID)
+}
+
+func (m *MemSpoolMap) purgeSpool(spoolID [common.SpoolIDSize]byte) error {
+	m.flushLock.Lock()
+	defer m.flushLock.Unlock()
 	m.spools.Delete(spoolID)
-	return nil
+	m.limitersLock.Lock()
+	for key := range m.limiters {
+		if key.spoolID == spoolID {
+			delete(m.limiters, key)
+		}
+	}
+	m.limitersLock.Unlock()
+	return m.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(spoolsBucketName)).DeleteBucket(spoolID[:])
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
 }
 
 func (m *MemSpoolMap) appendToSpoolWithMessageID(spoolID [common.SpoolIDSize]byte, messageID [common.MessageIDSize]byte, message []byte) error {
@@ -308,6 +569,13 @@ func (m *MemSpoolMap) appendToSpoolWithMessageID(spoolID [common.SpoolIDSize]byt
 }
 
 func (m *MemSpoolMap) AppendToSpool(spoolID [common.SpoolIDSize]byte, message []byte) error {
+	return m.AppendToSpoolWithCapability(spoolID, nil, message)
+}
+
+// AppendToSpoolWithCapability appends a message to the spool if the
+// write capability, which may be nil unless capabilities are required,
+// is valid and within its rate limit.
+func (m *MemSpoolMap) AppendToSpoolWithCapability(spoolID [common.SpoolIDSize]byte, capability *common.WriteCapability, message []byte) error {
 	raw_spool, ok := m.spools.Load(spoolID)
 	if !ok {
 		m.log.Debugf("AppendToSpool: spool not found: %x", spoolID[:])
@@ -318,10 +586,87 @@ func (m *MemSpoolMap) AppendToSpool(spoolID [common.SpoolIDSize]byte, message []
 		m.log.Debug("invalid spool found")
 		return errors.New("invalid spool found")
 	}
+	if capability == nil {
+		if m.requireCapability {
+			return errCapabilityRequired
+		}
+	} else {
+		if !capability.Verify(spoolID, spool.PublicKey()) {
+			return errInvalidCapability
+		}
+		if spool.IsRevoked(capability.ID) {
+			return errRevokedCapability
+		}
+		if !m.allowAppend(appendLimiterKey{spoolID, capability.ID}) {
+			return errRateLimited
+		}
+	}
 	spool.Append(message)
 	return nil
 }
 
+// allowAppend takes a token from the bucket of the write capability,
+// and returns false if there is none.
+func (m *MemSpoolMap) allowAppend(key appendLimiterKey) bool {
+	if m.appendRate == 0 {
+		return true
+	}
+	m.limitersLock.Lock()
+	defer m.limitersLock.Unlock()
+	now := m.now()
+	l, ok := m.limiters[key]
+	if !ok {
+		l = &appendLimiter{tokens: m.appendBurst, last: now}
+		m.limiters[key] = l
+	}
+	l.tokens += float64(now.Sub(l.last)) * m.appendRate
+	if l.tokens > m.appendBurst {
+		l.tokens = m.appendBurst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// doExpireLimiters forgets the token buckets which have refilled.
+func (m *MemSpoolMap) doExpireLimiters() {
+	m.limitersLock.Lock()
+	defer m.limitersLock.Unlock()
+	now := m.now()
+	for key, l := range m.limiters {
+		if l.tokens+float64(now.Sub(l.last))*m.appendRate >= m.appendBurst {
+			delete(m.limiters, key)
+		}
+	}
+}
+
+// RevokeCapability revokes the write capability with the given ID.
+func (m *MemSpoolMap) RevokeCapability(spoolID [common.SpoolIDSize]byte, signature []byte, capabilityID [common.WriteCapabilityIDSize]byte) error {
+	spool, err := m.getAuthenticatedSpool(spoolID, signature)
+	if err != nil {
+		return err
+	}
+	return m.revokeCapability(spoolID, spool, capabilityID)
+}
+
+func (m *MemSpoolMap) revokeCapability(spoolID [common.SpoolIDSize]byte, spool *MemSpool, capabilityID [common.WriteCapabilityIDSize]byte) error {
+	spool.revoked.Store(capabilityID, struct{}{})
+	m.limitersLock.Lock()
+	delete(m.limiters, appendLimiterKey{spoolID, capabilityID})
+	m.limitersLock.Unlock()
+	return m.db.Update(func(tx *bolt.Tx) error {
+		spoolBucket := tx.Bucket([]byte(spoolsBucketName)).Bucket(spoolID[:])
+		if spoolBucket == nil {
+			// the spool was purged
+			return nil
+		}
+		return spoolBucket.Bucket([]byte(revokedKey)).Put(capabilityID[:], []byte{})
+	})
+}
+
 func (m *MemSpoolMap) ReadFromSpool(spoolID [common.SpoolIDSize]byte, signature []byte, messageID uint32) ([]byte, error) {
 	raw_spool, ok := m.spools.Load(spoolID)
 	if !ok {
@@ -341,7 +686,287 @@ func (m *MemSpoolMap) ReadFromSpool(spoolID [common.SpoolIDSize]byte, signature
 	return payload, nil
 }
 
+// Authenticate verifies the RequestSignature of a spool command, made with
+// the spool key, or with the key of the new spool for the create spool
+// command, and rejects the commands signed in another epoch or replayed.
+// The commands without a RequestSignature are accepted until the end of
+// the compatibility period set with WithLegacySignaturesUntil, and their
+// legacy signature is verified when the command is executed.
+func (m *MemSpoolMap) Authenticate(request *common.SpoolRequest) error {
+	if request.RequestSignature == nil {
+		if !m.now().Before(m.legacyUntil) {
+			return errLegacySignature
+		}
+		return nil
+	}
+	publicKey := new(eddsa.PublicKey)
+	if request.Command == common.CreateSpoolCommand {
+		if err := publicKey.FromBytes(request.PublicKey); err != nil {
+			return err
+		}
+	} else {
+		raw_spool, ok := m.spools.Load(request.SpoolID)
+		if !ok {
+			return errors.New("spool not found")
+		}
+		publicKey = raw_spool.(*MemSpool).PublicKey()
+	}
+	if !request.Verify(publicKey) {
+		return errInvalidSignature
+	}
+	return m.checkNonce(request.Command, request.Epoch, request.Nonce)
+}
+
+// checkNonce rejects the commands signed outside of the previous, current
+// and next epochs, and the purge and delete commands whose nonce was seen
+// during these epochs, which are kept across restarts. The other commands,
+// which are the create, retrieve, range retrieve, high water mark and
+// revoke commands, are accepted again within these epochs: they may be
+// sent again by the ARQ of the client when their response is lost, and
+// repeating them changes nothing, but reveals their response again to
+// whoever replays them.
+func (m *MemSpoolMap) checkNonce(command byte, epoch uint64, nonce []byte) error {
+	now, _, _ := epochtime.FromUnix(m.now().Unix())
+	if epoch+1 < now || epoch > now+1 {
+		return errStaleRequest
+	}
+	if command != common.PurgeSpoolCommand && command != common.DeleteMessagesCommand {
+		return nil
+	}
+	n := [common.NonceSize]byte{}
+	copy(n[:], nonce)
+	m.noncesLock.Lock()
+	defer m.noncesLock.Unlock()
+	if _, ok := m.nonces[n]; ok {
+		return errReplayedRequest
+	}
+	rawEpoch := [8]byte{}
+	binary.BigEndian.PutUint64(rawEpoch[:], epoch)
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(noncesBucketName)).Put(n[:], rawEpoch[:])
+	}); err != nil {
+		return err
+	}
+	m.nonces[n] = epoch
+	return nil
+}
+
+// loadNonces populates m.nonces with the nonces stored in noncesBucket.
+func (m *MemSpoolMap) loadNonces(noncesBucket *bolt.Bucket) error {
+	return noncesBucket.ForEach(func(k, v []byte) error {
+		if len(k) != common.NonceSize || len(v) != 8 {
+			return errors.New("invalid nonce encountered")
+		}
+		n := [common.NonceSize]byte{}
+		copy(n[:], k)
+		m.nonces[n] = binary.BigEndian.Uint64(v)
+		return nil
+	})
+}
+
+// doExpireNonces forgets the nonces of the commands which would be
+// rejected as stale.
+func (m *MemSpoolMap) doExpireNonces() {
+	now, _, _ := epochtime.FromUnix(m.now().Unix())
+	m.noncesLock.Lock()
+	defer m.noncesLock.Unlock()
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		noncesBucket := tx.Bucket([]byte(noncesBucketName))
+		for n, epoch := range m.nonces {
+			if epoch+1 < now {
+				if err := noncesBucket.Delete(n[:]); err != nil {
+					return err
+				}
+				delete(m.nonces, n)
+			}
+		}
+		return nil
+	}); err != nil {
+		m.log.Errorf("Failed to expire nonces: %v", err)
+	}
+}
+
+// getAuthenticatedSpool returns the spool with the given ID if the
+// signature was made with the spool's key.
+func (m *MemSpoolMap) getAuthenticatedSpool(spoolID [common.SpoolIDSize]byte, signature []byte) (*MemSpool, error) {
+	spool, err := m.getSpool(spoolID)
+	if err != nil {
+		return nil, err
+	}
+	if !spool.PublicKey().Verify(signature, spool.PublicKey().Bytes()) {
+		return nil, errors.New("invalid signature")
+	}
+	return spool, nil
+}
+
+// getSpool returns the spool with the given ID.
+func (m *MemSpoolMap) getSpool(spoolID [common.SpoolIDSize]byte) (*MemSpool, error) {
+	raw_spool, ok := m.spools.Load(spoolID)
+	if !ok {
+		return nil, errors.New("spool not found")
+	}
+	spool, ok := raw_spool.(*MemSpool)
+	if !ok {
+		return nil, errors.New("invalid spool found")
+	}
+	return spool, nil
+}
+
+// requestSpool returns the spool of a command which passed Authenticate,
+// verifying the legacy signature of the commands without a
+// RequestSignature.
+func (m *MemSpoolMap) requestSpool(request *common.SpoolRequest) (*MemSpool, error) {
+	if request.RequestSignature == nil {
+		return m.getAuthenticatedSpool(request.SpoolID, request.Signature)
+	}
+	return m.getSpool(request.SpoolID)
+}
+
+// ReadRangeFromSpool returns up to count consecutive messages, or as many as
+// possible if count is zero, starting with the first message whose ID is
+// equal to or greater than messageID, and the ID of that message.
+// The total length of the returned messages does not exceed maxLength,
+// unless maxLength is zero.
+func (m *MemSpoolMap) ReadRangeFromSpool(spoolID [common.SpoolIDSize]byte, signature []byte, messageID, count uint32, maxLength int) (uint32, [][]byte, error) {
+	spool, err := m.getAuthenticatedSpool(spoolID, signature)
+	if err != nil {
+		return 0, nil, err
+	}
+	return readRangeFromSpool(spool, messageID, count, maxLength)
+}
+
+func readRangeFromSpool(spool *MemSpool, messageID, count uint32, maxLength int) (uint32, [][]byte, error) {
+	highWaterMark := spool.HighWaterMark()
+	// skip the messages which were deleted
+	for ; messageID <= highWaterMark; messageID++ {
+		if _, _, err := spool.Get(messageID); err == nil {
+			break
+		}
+	}
+	messages := [][]byte{}
+	length := 0
+	for id := messageID; id <= highWaterMark && (count == 0 || uint32(len(messages)) < count); id++ {
+		payload, _, err := spool.Get(id)
+		if err != nil {
+			break
+		}
+		length += len(payload) + cborHeaderLength
+		if maxLength > 0 && length > maxLength {
+			if len(messages) == 0 {
+				return 0, nil, errResponseTooLarge
+			}
+			break
+		}
+		messages = append(messages, payload)
+	}
+	return messageID, messages, nil
+}
+
+// DeleteFromSpool deletes count messages starting with messageID.
+func (m *MemSpoolMap) DeleteFromSpool(spoolID [common.SpoolIDSize]byte, signature []byte, messageID, count uint32) error {
+	spool, err := m.getAuthenticatedSpool(spoolID, signature)
+	if err != nil {
+		return err
+	}
+	return m.deleteFromSpool(spoolID, spool, messageID, count)
+}
+
+func (m *MemSpoolMap) deleteFromSpool(spoolID [common.SpoolIDSize]byte, spool *MemSpool, messageID, count uint32) error {
+	if count == 0 {
+		return errInvalidCount
+	}
+	ids := []uint32{}
+	highWaterMark := spool.HighWaterMark()
+	for id := messageID; id <= highWaterMark && id-messageID < count; id++ {
+		ids = append(ids, id)
+		if id == ^uint32(0) {
+			break
+		}
+	}
+	return m.deleteMessages(spoolID, spool, ids)
+}
+
+// HighWaterMark returns the ID of the last message appended to the spool.
+func (m *MemSpoolMap) HighWaterMark(spoolID [common.SpoolIDSize]byte, signature []byte) (uint32, error) {
+	spool, err := m.getAuthenticatedSpool(spoolID, signature)
+	if err != nil {
+		return 0, err
+	}
+	return spool.HighWaterMark(), nil
+}
+
+// deleteMessages deletes the given messages from the spool and from
+// the database.
+func (m *MemSpoolMap) deleteMessages(spoolID [common.SpoolIDSize]byte, spool *MemSpool, ids []uint32) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	m.flushLock.Lock()
+	defer m.flushLock.Unlock()
+	for _, id := range ids {
+		spool.Delete(id)
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		spoolBucket := tx.Bucket([]byte(spoolsBucketName)).Bucket(spoolID[:])
+		if spoolBucket == nil {
+			// the spool was purged
+			return nil
+		}
+		messagesBucket := spoolBucket.Bucket([]byte(messagesKey))
+		messageTimesBucket := spoolBucket.Bucket([]byte(messageTimesKey))
+		var msgID [common.MessageIDSize]byte
+		for _, id := range ids {
+			binary.BigEndian.PutUint32(msgID[:], id)
+			if err := messagesBucket.Delete(msgID[:]); err != nil {
+				return err
+			}
+			if err := messageTimesBucket.Delete(msgID[:]); err != nil {
+				return err
+			}
+		}
+		// preserve the high water mark when the latest message is deleted
+		binary.BigEndian.PutUint32(msgID[:], spool.HighWaterMark())
+		return spoolBucket.Bucket([]byte(spoolMetadataKey)).Put([]byte(highWaterMarkKey), msgID[:])
+	})
+}
+
+// doExpire deletes the messages exceeding the retention limits.
+func (m *MemSpoolMap) doExpire() {
+	if m.maxMessages == 0 && m.maxAge == 0 {
+		return
+	}
+	now := m.now()
+	m.spools.Range(func(rawSpoolID, rawSpool interface{}) bool {
+		spoolID := rawSpoolID.([common.SpoolIDSize]byte)
+		spool := rawSpool.(*MemSpool)
+		ids := []uint32{}
+		expired := []uint32{}
+		spool.items.Range(func(rawMessageID, rawEntry interface{}) bool {
+			id := rawMessageID.(uint32)
+			if m.maxAge != 0 && now.Sub(rawEntry.(*SpoolEntry).Timestamp) > m.maxAge {
+				expired = append(expired, id)
+			} else {
+				ids = append(ids, id)
+			}
+			return true
+		})
+		if m.maxMessages != 0 && len(ids) > m.maxMessages {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			expired = append(expired, ids[:len(ids)-m.maxMessages]...)
+		}
+		if len(expired) != 0 {
+			m.log.Debugf("deleting %d messages exceeding the retention limits from spool %x", len(expired), spoolID)
+		}
+		if err := m.deleteMessages(spoolID, spool, expired); err != nil {
+			m.log.Errorf("failed to delete messages from spool %x: %s", spoolID, err)
+		}
+		return true
+	})
+}
+
 func (m *MemSpoolMap) doFlush() {
+	m.flushLock.Lock()
+	defer m.flushLock.Unlock()
 	spoolsRange := func(rawSpoolID, rawSpool interface{}) bool {
 		spool, ok := rawSpool.(*MemSpool)
 		if !ok {
@@ -388,7 +1013,13 @@ func (m *MemSpoolMap) doFlush() {
 					if err != nil {
 						return err
 					}
-					spool.Put(messageID, entry.Payload, false)
+					var timestamp [8]byte
+					binary.BigEndian.PutUint64(timestamp[:], uint64(entry.Timestamp.Unix()))
+					err = spoolBucket.Bucket([]byte(messageTimesKey)).Put(msgID[:], timestamp[:])
+					if err != nil {
+						return err
+					}
+					spool.items.Store(messageID, &SpoolEntry{Payload: entry.Payload, Timestamp: entry.Timestamp})
 					return nil
 				})
 				if err != nil {
@@ -416,6 +1047,9 @@ func (m *MemSpoolMap) worker() {
 			return
 		case <-ticker.C:
 		}
+		m.doExpire()
+		m.doExpireLimiters()
+		m.doExpireNonces()
 		m.doFlush()
 	}
 }
@@ -430,13 +1064,15 @@ func (m *MemSpoolMap) Shutdown() {
 }
 
 type SpoolEntry struct {
-	Payload []byte
-	Dirty   bool
+	Payload   []byte
+	Dirty     bool
+	Timestamp time.Time
 }
 
 type MemSpool struct {
 	publicKey *eddsa.PublicKey
 	items     *sync.Map
+	revoked   *sync.Map
 	current   uint32
 }
 
@@ -444,10 +1080,18 @@ func NewMemSpool(publicKey *eddsa.PublicKey) *MemSpool {
 	return &MemSpool{
 		publicKey: publicKey,
 		items:     new(sync.Map),
+		revoked:   new(sync.Map),
 		current:   0,
 	}
 }
 
+// IsRevoked returns true if the write capability with the given ID
+// was revoked.
+func (s *MemSpool) IsRevoked(capabilityID [common.WriteCapabilityIDSize]byte) bool {
+	_, ok := s.revoked.Load(capabilityID)
+	return ok
+}
+
 func (s *MemSpool) PublicKey() *eddsa.PublicKey {
 	return s.publicKey
 }
@@ -459,12 +1103,23 @@ func (s *MemSpool) Append(message []byte) {
 
 func (s *MemSpool) Put(messageID uint32, message []byte, dirty bool) {
 	entry := SpoolEntry{
-		Payload: message,
-		Dirty:   dirty,
+		Payload:   message,
+		Dirty:     dirty,
+		Timestamp: time.Now(),
 	}
 	s.items.Store(messageID, &entry)
 }
 
+// Delete removes a message from the spool.
+func (s *MemSpool) Delete(messageID uint32) {
+	s.items.Delete(messageID)
+}
+
+// HighWaterMark returns the ID of the last message appended to the spool.
+func (s *MemSpool) HighWaterMark() uint32 {
+	return atomic.LoadUint32(&s.current)
+}
+
 // Get returns a message payload from the spool given
 // a valid message ID. Second return value is the Dirty bool
 // which is set to true if the message has not been written to disk.
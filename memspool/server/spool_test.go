@@ -19,10 +19,12 @@ package server
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/memspool/common"
@@ -135,3 +137,298 @@ func TestPersistence(t *testing.T) {
 	}
 	spoolMap.Shutdown()
 }
+
+func newTestSpoolMap(t *testing.T, opts ...MemSpoolMapOption) (*MemSpoolMap, string) {
+	fileStore, err := os.CreateTemp("", "catshadow_test_filestore")
+	assert.NoError(t, err)
+	logBackend, err := log.New("", "debug", false)
+	assert.NoError(t, err)
+	spoolMap, err := NewMemSpoolMap(fileStore.Name(), logBackend.GetLogger("test_logger"), opts...)
+	assert.NoError(t, err)
+	return spoolMap, fileStore.Name()
+}
+
+func TestDeleteAndReadRange(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	assert.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolMap, fileStore := newTestSpoolMap(t)
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	assert.NoError(err)
+
+	for i := 1; i <= 10; i++ {
+		assert.NoError(spoolMap.AppendToSpool(*spoolID, []byte{byte(i)}))
+	}
+	hwm, err := spoolMap.HighWaterMark(*spoolID, signature)
+	assert.NoError(err)
+	assert.Equal(uint32(10), hwm)
+
+	first, messages, err := spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 3, 0)
+	assert.NoError(err)
+	assert.Equal(uint32(1), first)
+	assert.Equal([][]byte{{1}, {2}, {3}}, messages)
+
+	// the length of the messages is limited
+	_, messages, err = spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 0, 2*(1+cborHeaderLength))
+	assert.NoError(err)
+	assert.Len(messages, 2)
+	_, _, err = spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 0, 1)
+	assert.ErrorIs(err, errResponseTooLarge)
+
+	// deleted messages are skipped
+	assert.ErrorIs(spoolMap.DeleteFromSpool(*spoolID, signature, 1, 0), errInvalidCount)
+	assert.Error(spoolMap.DeleteFromSpool(*spoolID, privKey.Sign([]byte("wrong")), 1, 4))
+	assert.NoError(spoolMap.DeleteFromSpool(*spoolID, signature, 1, 4))
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 4)
+	assert.Error(err)
+	first, messages, err = spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 0, 0)
+	assert.NoError(err)
+	assert.Equal(uint32(5), first)
+	assert.Len(messages, 6)
+
+	// deletions and the high water mark persist
+	assert.NoError(spoolMap.DeleteFromSpool(*spoolID, signature, 5, 100))
+	spoolMap.Shutdown()
+	spoolMap, err = NewMemSpoolMap(fileStore, spoolMap.log)
+	assert.NoError(err)
+	first, messages, err = spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 0, 0)
+	assert.NoError(err)
+	assert.Equal(uint32(11), first)
+	assert.Empty(messages)
+	assert.NoError(spoolMap.AppendToSpool(*spoolID, []byte{11}))
+	message, err := spoolMap.ReadFromSpool(*spoolID, signature, 11)
+	assert.NoError(err)
+	assert.Equal([]byte{11}, message)
+
+	// purged spools are not loaded again
+	assert.NoError(spoolMap.PurgeSpool(*spoolID, signature))
+	spoolMap.Shutdown()
+	spoolMap, err = NewMemSpoolMap(fileStore, spoolMap.log)
+	assert.NoError(err)
+	_, err = spoolMap.HighWaterMark(*spoolID, signature)
+	assert.Error(err)
+	spoolMap.Shutdown()
+}
+
+func TestRetention(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	assert.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolMap, fileStore := newTestSpoolMap(t, WithRetention(5, time.Hour))
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	assert.NoError(err)
+
+	for i := 1; i <= 8; i++ {
+		assert.NoError(spoolMap.AppendToSpool(*spoolID, []byte{byte(i)}))
+	}
+	spoolMap.doExpire()
+	first, messages, err := spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 0, 0)
+	assert.NoError(err)
+	assert.Equal(uint32(4), first)
+	assert.Len(messages, 5)
+
+	// the message times persist
+	spoolMap.doFlush()
+	spoolMap.Shutdown()
+	spoolMap, err = NewMemSpoolMap(fileStore, spoolMap.log, WithRetention(5, time.Hour))
+	assert.NoError(err)
+	spoolMap.doExpire()
+	_, messages, err = spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 0, 0)
+	assert.NoError(err)
+	assert.Len(messages, 5)
+
+	spoolMap.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	spoolMap.doExpire()
+	first, messages, err = spoolMap.ReadRangeFromSpool(*spoolID, signature, 1, 0, 0)
+	assert.NoError(err)
+	assert.Equal(uint32(9), first)
+	assert.Empty(messages)
+	spoolMap.Shutdown()
+}
+
+func TestHandleSpoolRequest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	assert.NoError(err)
+	spoolMap, _ := newTestSpoolMap(t)
+	defer spoolMap.Shutdown()
+	handle := func(cmd []byte, err error) *common.SpoolResponse {
+		assert.NoError(err)
+		request := new(common.SpoolRequest)
+		assert.NoError(request.Unmarshal(cmd))
+		response := HandleSpoolRequest(spoolMap, request, 2000, spoolMap.log)
+		b, err := response.Marshal()
+		assert.NoError(err)
+		assert.LessOrEqual(len(b), 2000)
+		return response
+	}
+
+	response := handle(common.CreateSpool(privKey))
+	assert.True(response.IsOK())
+	spoolID := response.SpoolID
+
+	message := make([]byte, 600)
+	for i := 0; i < 4; i++ {
+		assert.True(handle(common.AppendToSpool(spoolID, message, geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 2000, true, 5))).IsOK())
+	}
+	response = handle(common.QueryHighWaterMark(spoolID, privKey))
+	assert.True(response.IsOK())
+	assert.Equal(uint32(4), response.HighWaterMark)
+
+	// the messages which fit in the response are returned
+	response = handle(common.ReadRangeFromSpool(spoolID, 1, 0, privKey))
+	assert.True(response.IsOK())
+	assert.Equal(uint32(1), response.MessageID)
+	assert.Equal(uint32(4), response.HighWaterMark)
+	assert.Len(response.Messages, 3)
+
+	assert.True(handle(common.DeleteFromSpool(spoolID, 1, 3, privKey)).IsOK())
+	response = handle(common.ReadRangeFromSpool(spoolID, 1, 0, privKey))
+	assert.True(response.IsOK())
+	assert.Equal(uint32(4), response.MessageID)
+	assert.Len(response.Messages, 1)
+}
+
+func TestWriteCapability(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	assert.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolMap, fileStore := newTestSpoolMap(t, WithRequiredWriteCapability(), WithAppendRateLimit(60, 2))
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	assert.NoError(err)
+	now := time.Now()
+	spoolMap.now = func() time.Time { return now }
+
+	alice, err := common.NewWriteCapability(*spoolID, privKey)
+	assert.NoError(err)
+	bob, err := common.NewWriteCapability(*spoolID, privKey)
+	assert.NoError(err)
+	otherKey, err := eddsa.NewKeypair(rand.NewMath())
+	assert.NoError(err)
+	forged, err := common.NewWriteCapability(*spoolID, otherKey)
+	assert.NoError(err)
+
+	assert.ErrorIs(spoolMap.AppendToSpool(*spoolID, []byte("hello")), errCapabilityRequired)
+	assert.ErrorIs(spoolMap.AppendToSpoolWithCapability(*spoolID, forged, []byte("hello")), errInvalidCapability)
+
+	// appends are rate limited per capability
+	assert.NoError(spoolMap.AppendToSpoolWithCapability(*spoolID, alice, []byte("hello")))
+	assert.NoError(spoolMap.AppendToSpoolWithCapability(*spoolID, alice, []byte("hello")))
+	assert.ErrorIs(spoolMap.AppendToSpoolWithCapability(*spoolID, alice, []byte("hello")), errRateLimited)
+	assert.NoError(spoolMap.AppendToSpoolWithCapability(*spoolID, bob, []byte("hello")))
+	now = now.Add(time.Second)
+	assert.NoError(spoolMap.AppendToSpoolWithCapability(*spoolID, alice, []byte("hello")))
+	now = now.Add(time.Minute)
+	spoolMap.doExpireLimiters()
+	assert.Empty(spoolMap.limiters)
+
+	// revocation only affects the revoked capability, and persists
+	assert.Error(spoolMap.RevokeCapability(*spoolID, otherKey.Sign(otherKey.PublicKey().Bytes()), alice.ID))
+	assert.NoError(spoolMap.RevokeCapability(*spoolID, signature, alice.ID))
+	assert.ErrorIs(spoolMap.AppendToSpoolWithCapability(*spoolID, alice, []byte("hello")), errRevokedCapability)
+	spoolMap.Shutdown()
+	spoolMap, err = NewMemSpoolMap(fileStore, spoolMap.log)
+	assert.NoError(err)
+	assert.ErrorIs(spoolMap.AppendToSpoolWithCapability(*spoolID, alice, []byte("hello")), errRevokedCapability)
+	assert.NoError(spoolMap.AppendToSpoolWithCapability(*spoolID, bob, []byte("hello")))
+	hwm, err := spoolMap.HighWaterMark(*spoolID, signature)
+	assert.NoError(err)
+	assert.Equal(uint32(5), hwm)
+	spoolMap.Shutdown()
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	assert.NoError(err)
+	spoolMap, fileStore := newTestSpoolMap(t)
+	defer func() { spoolMap.Shutdown() }()
+	request := func(cmd []byte, err error) *common.SpoolRequest {
+		assert.NoError(err)
+		r := new(common.SpoolRequest)
+		assert.NoError(r.Unmarshal(cmd))
+		return r
+	}
+
+	create := request(common.CreateSpool(privKey))
+	assert.NoError(spoolMap.Authenticate(create))
+	response := HandleSpoolRequest(spoolMap, create, 0, spoolMap.log)
+	assert.True(response.IsOK())
+	spoolID := response.SpoolID
+
+	// the signature is bound to the command and its arguments
+	read := request(common.ReadFromSpool(spoolID, 1, privKey))
+	assert.NoError(spoolMap.Authenticate(read))
+	purge := *read
+	purge.Command = common.PurgeSpoolCommand
+	assert.ErrorIs(spoolMap.Authenticate(&purge), errInvalidSignature)
+	read.MessageID = 2
+	assert.ErrorIs(spoolMap.Authenticate(read), errInvalidSignature)
+
+	// reads may be repeated, but not purges
+	read = request(common.ReadFromSpool(spoolID, 1, privKey))
+	assert.NoError(spoolMap.Authenticate(read))
+	assert.NoError(spoolMap.Authenticate(read))
+	del := request(common.DeleteFromSpool(spoolID, 1, 1, privKey))
+	assert.NoError(spoolMap.Authenticate(del))
+	assert.ErrorIs(spoolMap.Authenticate(del), errReplayedRequest)
+	assert.Equal(errReplayedRequest.Error(), HandleSpoolRequest(spoolMap, del, 0, spoolMap.log).Status)
+
+	// even after a restart
+	spoolMap.Shutdown()
+	spoolMap, err = NewMemSpoolMap(fileStore, spoolMap.log)
+	assert.NoError(err)
+	assert.ErrorIs(spoolMap.Authenticate(del), errReplayedRequest)
+
+	// requests from other epochs are stale
+	spoolMap.now = func() time.Time { return time.Now().Add(3 * epochtime.Period) }
+	assert.ErrorIs(spoolMap.Authenticate(request(common.ReadFromSpool(spoolID, 1, privKey))), errStaleRequest)
+	spoolMap.doExpireNonces()
+	assert.Empty(spoolMap.nonces)
+	spoolMap.Shutdown()
+	spoolMap, err = NewMemSpoolMap(fileStore, spoolMap.log)
+	assert.NoError(err)
+	assert.Empty(spoolMap.nonces)
+
+	// legacy requests are only accepted during a compatibility period
+	legacy := &common.SpoolRequest{
+		Command:   common.RetrieveMessageCommand,
+		SpoolID:   spoolID,
+		Signature: privKey.Sign(privKey.PublicKey().Bytes()),
+	}
+	assert.ErrorIs(spoolMap.Authenticate(legacy), errLegacySignature)
+	spoolMap.legacyUntil = time.Now().Add(time.Hour)
+	assert.NoError(spoolMap.Authenticate(legacy))
+	spoolMap.legacyUntil = time.Now()
+	assert.ErrorIs(spoolMap.Authenticate(legacy), errLegacySignature)
+
+	// a replayed command with the RequestSignature stripped is rejected
+	// even during the compatibility period, as it carries no legacy
+	// signature
+	spoolMap.now = time.Now
+	spoolMap.legacyUntil = time.Now().Add(time.Hour)
+	for _, stripped := range []*common.SpoolRequest{
+		request(common.ReadFromSpool(spoolID, 1, privKey)),
+		request(common.PurgeSpool(spoolID, privKey)),
+	} {
+		assert.Nil(stripped.Signature)
+		stripped.RequestSignature = nil
+		response := HandleSpoolRequest(spoolMap, stripped, 0, spoolMap.log)
+		assert.Equal(errInvalidSignature.Error(), response.Status)
+	}
+	response = HandleSpoolRequest(spoolMap, request(common.PurgeSpool(spoolID, privKey)), 0, spoolMap.log)
+	assert.True(response.IsOK())
+}
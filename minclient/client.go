@@ -28,6 +28,7 @@ import (
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx"
@@ -115,6 +116,11 @@ type ClientConfig struct {
 	// EnableTimeSync enables the use of skewed remote provider time
 	// instead of system time when available.
 	EnableTimeSync bool
+
+	// Clock is the optional source of time and epochs, which tests may
+	// replace with an epochtime.FakeClock.  If left unset, the system
+	// time is used.
+	Clock epochtime.Clock
 }
 
 func (cfg *ClientConfig) validate() error {
@@ -158,8 +164,9 @@ func (c *Client) getPollInterval() time.Duration {
 // Client is a client instance.
 type Client struct {
 	sync.RWMutex
-	cfg *ClientConfig
-	log *logging.Logger
+	cfg   *ClientConfig
+	log   *logging.Logger
+	clock epochtime.Clock
 
 	geo    *geo.Geometry
 	sphinx *sphinx.Sphinx
@@ -220,6 +227,7 @@ func New(cfg *ClientConfig) (*Client, error) {
 		return nil, err
 	}
 	c.cfg = cfg
+	c.clock = epochtime.OrWallClock(cfg.Clock)
 	c.displayName = fmt.Sprintf("%x@%s", c.cfg.User, c.cfg.Provider)
 	c.log = cfg.LogBackend.GetLogger("minclient:" + c.displayName)
 	c.haltedCh = make(chan interface{})
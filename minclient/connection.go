@@ -30,7 +30,6 @@ import (
 	"gopkg.in/op/go-logging.v1"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
@@ -52,11 +51,14 @@ var (
 		Timeout:   connectTimeout,
 	}
 
-	keepAliveInterval   = 3 * time.Minute
-	connectTimeout      = 1 * time.Minute
-	pkiFallbackInterval = epochtime.Period / 16
+	keepAliveInterval = 3 * time.Minute
+	connectTimeout    = 1 * time.Minute
 )
 
+func (c *connection) pkiFallbackInterval() time.Duration {
+	return c.c.clock.Period() / 16
+}
+
 // ConnectError is the error used to indicate that a connect attempt has failed.
 type ConnectError struct {
 	// Err is the original error that caused the connect attempt to fail.
@@ -126,6 +128,10 @@ type getConsensusCtx struct {
 	replyCh chan interface{}
 	epoch   uint64
 	doneFn  func(error)
+
+	// baseHash is the diff base hash of the document of the previous
+	// epoch, iff the document is requested as a diff.
+	baseHash *[cpki.DiffBaseHashSize]byte
 }
 
 type connSendCtx struct {
@@ -219,7 +225,7 @@ func (c *connection) connectWorker() {
 		}
 	}()
 
-	timer := time.NewTimer(pkiFallbackInterval)
+	timer := time.NewTimer(c.pkiFallbackInterval())
 	defer timer.Stop()
 	for {
 		var timerFired bool
@@ -227,7 +233,7 @@ func (c *connection) connectWorker() {
 		// Wait for a signal from the PKI (or a fallback timer to pass)
 		// before querying the PKI for a document iff we do not have the
 		// Provider's current descriptor.
-		if now, _, _ := epochtime.FromUnix(c.c.pki.skewedUnixTime()); now != c.pkiEpoch {
+		if now, _, _ := c.c.pki.skewedEpoch(); now != c.pkiEpoch {
 			select {
 			case <-c.HaltCh():
 				return
@@ -260,7 +266,7 @@ func (c *connection) connectWorker() {
 			// Can't connect due to lacking descriptor.
 			c.c.cfg.OnConnFn(err)
 		}
-		timer.Reset(pkiFallbackInterval)
+		timer.Reset(c.pkiFallbackInterval())
 	}
 
 	// NOTREACHED
@@ -525,16 +531,23 @@ func (c *connection) onWireConn(w *wire.Session) {
 				ctx.doneFn(fmt.Errorf("outstanding GetConsensus already exists: %v", consensusCtx.epoch))
 			} else {
 				consensusCtx = ctx
-				cmd := &commands.GetConsensus{
+				var cmd commands.Command = &commands.GetConsensus{
 					Epoch: ctx.epoch,
 				}
+				if ctx.baseHash != nil {
+					cmd = &commands.GetConsensusDiff{
+						Epoch:    ctx.epoch,
+						BaseHash: *ctx.baseHash,
+						Compress: true,
+					}
+				}
 				wireErr = w.SendCommand(cmd)
 				ctx.doneFn(wireErr)
 				if wireErr != nil {
-					c.log.Debugf("Failed to send GetConsensus: %v", wireErr)
+					c.log.Debugf("Failed to send %T: %v", cmd, wireErr)
 					return
 				}
-				c.log.Debugf("Sent GetConsensus.")
+				c.log.Debugf("Sent %T.", cmd)
 			}
 
 			adjFetchDelay()
@@ -665,7 +678,7 @@ func (c *connection) onWireConn(w *wire.Session) {
 			}
 			seq++
 		case *commands.Consensus:
-			if consensusCtx != nil {
+			if consensusCtx != nil && consensusCtx.baseHash == nil {
 				c.log.Debugf("Received Consensus: ErrorCode: %v, Payload %v bytes", cmd.ErrorCode, len(cmd.Payload))
 				consensusCtx.replyCh <- cmd
 				consensusCtx = nil
@@ -675,6 +688,17 @@ func (c *connection) onWireConn(w *wire.Session) {
 				wireErr = newProtocolError("received spurious Consensus")
 				return
 			}
+		case *commands.ConsensusDiff:
+			if consensusCtx != nil && consensusCtx.baseHash != nil {
+				c.log.Debugf("Received ConsensusDiff: ErrorCode: %v, IsDiff: %v, IsCompressed: %v, Payload %v bytes", cmd.ErrorCode, cmd.IsDiff, cmd.IsCompressed, len(cmd.Payload))
+				consensusCtx.replyCh <- cmd
+				consensusCtx = nil
+			} else {
+				// Spurious ConsensusDiff replies are a protocol violation.
+				c.log.Errorf("Received spurious ConsensusDiff.")
+				wireErr = newProtocolError("received spurious ConsensusDiff")
+				return
+			}
 		default:
 			c.log.Errorf("Received unexpected command: %T", cmd)
 			wireErr = newProtocolError("received unknown command: %T", cmd)
@@ -759,6 +783,30 @@ func (c *connection) sendPacket(pkt []byte) error {
 }
 
 func (c *connection) getConsensus(ctx context.Context, epoch uint64) (*commands.Consensus, error) {
+	resp, err := c.requestConsensus(ctx, epoch, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := resp.(*commands.Consensus)
+	if !ok {
+		panic("BUG: Worker returned invalid Consensus response")
+	}
+	return r, nil
+}
+
+func (c *connection) getConsensusDiff(ctx context.Context, epoch uint64, baseHash [cpki.DiffBaseHashSize]byte) (*commands.ConsensusDiff, error) {
+	resp, err := c.requestConsensus(ctx, epoch, &baseHash)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := resp.(*commands.ConsensusDiff)
+	if !ok {
+		panic("BUG: Worker returned invalid ConsensusDiff response")
+	}
+	return r, nil
+}
+
+func (c *connection) requestConsensus(ctx context.Context, epoch uint64, baseHash *[cpki.DiffBaseHashSize]byte) (commands.Command, error) {
 	c.Lock()
 	if !c.isConnected {
 		c.Unlock()
@@ -770,8 +818,9 @@ func (c *connection) getConsensus(ctx context.Context, epoch uint64) (*commands.
 	replyCh := make(chan interface{})
 	select {
 	case c.getConsensusCh <- &getConsensusCtx{
-		replyCh: replyCh,
-		epoch:   epoch,
+		replyCh:  replyCh,
+		epoch:    epoch,
+		baseHash: baseHash,
 		doneFn: func(err error) {
 			errCh <- err
 		},
@@ -803,7 +852,7 @@ func (c *connection) getConsensus(ctx context.Context, epoch uint64) (*commands.
 		switch resp := rawResp.(type) {
 		case error:
 			return nil, resp
-		case *commands.Consensus:
+		case commands.Command:
 			return resp, nil
 		default:
 			panic("BUG: Worker returned invalid Consensus response")
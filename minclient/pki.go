@@ -24,7 +24,7 @@ import (
 	"sync"
 	"time"
 
-	vServer "github.com/katzenpost/katzenpost/authority/voting/server"
+	"github.com/katzenpost/katzenpost/authority/voting/schedule"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
@@ -35,14 +35,29 @@ import (
 var (
 	errGetConsensusCanceled = errors.New("minclient/pki: consensus fetch canceled")
 	errConsensusNotFound    = errors.New("minclient/pki: consensus not ready yet")
-	PublishDeadline         = vServer.PublishConsensusDeadline
-	mixServerCacheDelay     = epochtime.Period / 16
-	nextFetchTill           = epochtime.Period - (PublishDeadline + mixServerCacheDelay)
-	recheckInterval         = epochtime.Period / 16
 	// WarpedEpoch is a build time flag that accelerates the recheckInterval
 	WarpedEpoch = "false"
 )
 
+// PublishDeadline returns the time into an epoch by which the consensus
+// for the next epoch is published.
+func PublishDeadline() time.Duration {
+	return schedule.PublishConsensusDeadline()
+}
+
+func (p *pki) mixServerCacheDelay() time.Duration {
+	return p.c.clock.Period() / 16
+}
+
+func (p *pki) nextFetchTill() time.Duration {
+	period := p.c.clock.Period()
+	return period - (schedule.PublishConsensusDeadlineForPeriod(period) + p.mixServerCacheDelay())
+}
+
+func (p *pki) recheckInterval() time.Duration {
+	return p.c.clock.Period() / 16
+}
+
 type pki struct {
 	sync.Mutex
 	worker.Worker
@@ -54,9 +69,28 @@ type pki struct {
 	failedFetches map[uint64]error
 	clockSkew     int64
 
+	// rawDocs are the serialized documents, which the documents of the
+	// following epochs are fetched as diffs against. Only the worker
+	// accesses it.
+	rawDocs map[uint64][]byte
+
+	// fetcher fetches the documents from the Provider.
+	fetcher consensusFetcher
+
+	// noDiff is set once fetching a diff from the Provider failed, after
+	// which the documents are fetched in full. Only the worker accesses it.
+	noDiff bool
+
 	forceUpdateCh chan interface{}
 }
 
+// consensusFetcher fetches the documents from the Provider, in full or
+// as diffs.
+type consensusFetcher interface {
+	getConsensus(ctx context.Context, epoch uint64) (*commands.Consensus, error)
+	getConsensusDiff(ctx context.Context, epoch uint64, baseHash [cpki.DiffBaseHashSize]byte) (*commands.ConsensusDiff, error)
+}
+
 // ClockSkew returns the current best guess difference between the client's
 // system clock and the network's global clock, rounded to the nearest second,
 // as measured against the provider during the handshake process.  Calls to
@@ -94,18 +128,24 @@ func (p *pki) setClockSkew(skew int64) {
 }
 
 func (p *pki) skewedUnixTime() int64 {
+	now := p.c.clock.Time().Unix()
 	if !p.c.cfg.EnableTimeSync {
-		return time.Now().Unix()
+		return now
 	}
 
 	p.Lock()
 	defer p.Unlock()
 
-	return time.Now().Unix() + p.clockSkew
+	return now + p.clockSkew
+}
+
+// skewedEpoch returns the epoch of the skewed time.
+func (p *pki) skewedEpoch() (current uint64, elapsed, till time.Duration) {
+	return epochtime.At(p.c.clock, time.Unix(p.skewedUnixTime(), 0))
 }
 
 func (p *pki) currentDocument() *cpki.Document {
-	now, _, _ := epochtime.FromUnix(p.skewedUnixTime())
+	now, _, _ := p.skewedEpoch()
 	if d, _ := p.docs.Load(now); d != nil {
 		return d.(*cpki.Document)
 	}
@@ -113,32 +153,25 @@ func (p *pki) currentDocument() *cpki.Document {
 }
 
 func (p *pki) worker() {
-	timer := time.NewTimer(0)
-	defer func() {
-		p.log.Debug("Halting PKI worker.")
-		timer.Stop()
-	}()
+	wakeup := p.c.clock.NewTimer(0)
+	defer func() { wakeup.Stop() }()
+	defer p.log.Debug("Halting PKI worker.")
 
 	var lastCallbackEpoch uint64
 	for {
-		timerFired := false
 		select {
 		case <-p.HaltCh():
 			p.log.Debugf("Terminating gracefully.")
 			return
 		case <-p.forceUpdateCh:
-		case <-timer.C:
-			timerFired = true
-		}
-		if !timerFired && !timer.Stop() {
-			<-timer.C
+		case <-wakeup.C:
 		}
 
 		// Use the skewed time to determine which documents to fetch.
 		epochs := make([]uint64, 0, 2)
-		now, _, till := epochtime.FromUnix(p.skewedUnixTime())
+		now, _, till := p.skewedEpoch()
 		epochs = append(epochs, now)
-		if till < nextFetchTill {
+		if till < p.nextFetchTill() {
 			epochs = append(epochs, now+1)
 		}
 
@@ -166,7 +199,7 @@ func (p *pki) worker() {
 				}
 			}()
 
-			d, err := p.getDocument(pkiCtx, epoch)
+			d, rawDoc, err := p.getDocument(pkiCtx, epoch)
 			cancelFn()
 			if err != nil {
 				p.log.Warningf("Failed to fetch PKI for epoch %v: %v", epoch, err)
@@ -184,6 +217,7 @@ func (p *pki) worker() {
 				panic("Sphinx Geometry mismatch!")
 			}
 			p.docs.Store(epoch, d)
+			p.rawDocs[epoch] = rawDoc
 			didUpdate = true
 		}
 		p.pruneFailures(now)
@@ -203,61 +237,148 @@ func (p *pki) worker() {
 			}
 		}
 
-		timer.Reset(recheckInterval)
+		wakeup.Stop()
+		wakeup = p.c.clock.NewTimer(p.recheckInterval())
 	}
 
 	// NOTREACHED
 }
 
-func (p *pki) getDocument(ctx context.Context, epoch uint64) (*cpki.Document, error) {
-	var d *cpki.Document
-	var err error
+func (p *pki) getDocument(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	base, ok := p.rawDocs[epoch-1]
+	if !ok || !p.providerServesDiffs(epoch-1) {
+		return p.getFullDocument(ctx, epoch)
+	}
+	d, rawDoc, err := p.getDocumentDiff(ctx, epoch, base)
+	switch err {
+	case nil, cpki.ErrNoDocument, errConsensusNotFound, errGetConsensusCanceled:
+		return d, rawDoc, err
+	default:
+		// The Provider may not know the command after all, and drop
+		// the connection, so stop asking it for diffs.
+		p.log.Debugf("Failed to fetch PKI doc diff for epoch %v, fetching it in full: %v", epoch, err)
+		p.noDiff = true
+		return p.getFullDocument(ctx, epoch)
+	}
+}
+
+// providerServesDiffs returns true if our Provider advertises the
+// GetConsensusDiff command in the document of the epoch, and it has not
+// failed to serve a diff.
+func (p *pki) providerServesDiffs(epoch uint64) bool {
+	if p.noDiff {
+		return false
+	}
+	d, ok := p.docs.Load(epoch)
+	if !ok {
+		return false
+	}
+	desc, err := d.(*cpki.Document).GetProvider(p.c.cfg.Provider)
+	if err != nil {
+		return false
+	}
+	return desc.ConsensusDiff
+}
 
+func (p *pki) getFullDocument(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
 	p.log.Debug("Fetching PKI doc for epoch %v from Provider.", epoch)
-	resp, err := p.c.conn.getConsensus(ctx, epoch)
+	resp, err := p.fetcher.getConsensus(ctx, epoch)
 	switch err {
 	case nil:
 	case cpki.ErrNoDocument:
-		return nil, err
+		return nil, nil, err
 	default:
 		p.log.Debugf("Failed to fetch PKI doc for epoch %v from Provider: %v", epoch, err)
-		return p.getDocumentDirect(ctx, epoch)
+		return p.getDocumentDirect(ctx, epoch, nil)
+	}
+
+	if err = consensusError(resp.ErrorCode); err != nil {
+		return nil, nil, err
+	}
+	return p.deserialize(ctx, epoch, resp.Payload, nil)
+}
+
+// getDocumentDiff fetches the document for the epoch as a diff against
+// the serialized document of the previous epoch.
+func (p *pki) getDocumentDiff(ctx context.Context, epoch uint64, base []byte) (*cpki.Document, []byte, error) {
+	baseHash, err := cpki.DiffBaseHash(base)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.log.Debug("Fetching PKI doc diff for epoch %v from Provider.", epoch)
+	resp, err := p.fetcher.getConsensusDiff(ctx, epoch, baseHash)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	switch resp.ErrorCode {
+	if err = consensusError(resp.ErrorCode); err != nil {
+		return nil, nil, err
+	}
+	payload := &cpki.ConsensusPayload{
+		Payload:      resp.Payload,
+		IsDiff:       resp.IsDiff,
+		IsCompressed: resp.IsCompressed,
+	}
+	rawDoc, err := payload.Decode(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.deserialize(ctx, epoch, rawDoc, base)
+}
+
+func consensusError(errorCode uint8) error {
+	switch errorCode {
 	case commands.ConsensusOk:
+		return nil
 	case commands.ConsensusGone:
-		return nil, cpki.ErrNoDocument
+		return cpki.ErrNoDocument
 	case commands.ConsensusNotFound:
-		return nil, errConsensusNotFound
+		return errConsensusNotFound
 	default:
-		return nil, fmt.Errorf("minclient/pki: GetConsensus failed: %v", resp.ErrorCode)
+		return fmt.Errorf("minclient/pki: GetConsensus failed: %v", errorCode)
 	}
+}
 
-	d, err = p.c.cfg.PKIClient.Deserialize(resp.Payload)
+// deserialize verifies and deserializes the document received from the
+// Provider.
+func (p *pki) deserialize(ctx context.Context, epoch uint64, rawDoc, base []byte) (*cpki.Document, []byte, error) {
+	d, err := p.c.cfg.PKIClient.Deserialize(rawDoc)
 	if err != nil {
 		p.log.Errorf("Failed to deserialize consensus received from provider: %v", err)
-		return nil, cpki.ErrNoDocument
+		return nil, nil, cpki.ErrNoDocument
 	}
 	if d.Epoch != epoch {
 		p.log.Errorf("BUG: Provider returned document for incorrect epoch: %v", d.Epoch)
-		return p.getDocumentDirect(ctx, epoch)
+		return p.getDocumentDirect(ctx, epoch, base)
 	}
-
-	return d, err
+	return d, rawDoc, nil
 }
 
-func (p *pki) getDocumentDirect(ctx context.Context, epoch uint64) (*cpki.Document, error) {
+// getDocumentDirect fetches the document from the authorities, as a diff
+// against base if it is not nil and the PKIClient supports it.
+func (p *pki) getDocumentDirect(ctx context.Context, epoch uint64, base []byte) (*cpki.Document, []byte, error) {
 	p.log.Debugf("Fetching PKI doc for epoch %v directly from authority.", epoch)
 
-	d, _, err := p.c.cfg.PKIClient.Get(ctx, epoch)
+	var d *cpki.Document
+	var rawDoc []byte
+	var err error
+	if dc, ok := p.c.cfg.PKIClient.(cpki.DiffClient); ok && base != nil {
+		d, rawDoc, err = dc.GetDiff(ctx, epoch, base)
+		if err != nil && err != cpki.ErrNoDocument && ctx.Err() == nil {
+			p.log.Debugf("Failed to fetch PKI doc diff for epoch %v from authority: %v", epoch, err)
+			d, rawDoc, err = p.c.cfg.PKIClient.Get(ctx, epoch)
+		}
+	} else {
+		d, rawDoc, err = p.c.cfg.PKIClient.Get(ctx, epoch)
+	}
 	select {
 	case <-ctx.Done():
 		// Canceled mid-fetch.
-		return nil, errGetConsensusCanceled
+		return nil, nil, errGetConsensusCanceled
 	default:
 	}
-	return d, err
+	return d, rawDoc, err
 }
 
 func (p *pki) pruneDocuments(now uint64) {
@@ -272,6 +393,14 @@ func (p *pki) pruneDocuments(now uint64) {
 		}
 		return true
 	})
+
+	// The serialized document of the previous epoch is kept as a base
+	// for diffs.
+	for epoch := range p.rawDocs {
+		if epoch+1 < now {
+			delete(p.rawDocs, epoch)
+		}
+	}
 }
 
 func (p *pki) pruneFailures(now uint64) {
@@ -291,6 +420,8 @@ func newPKI(c *Client) *pki {
 	p.c = c
 	p.log = c.cfg.LogBackend.GetLogger("minclient/pki:" + c.displayName)
 	p.failedFetches = make(map[uint64]error)
+	p.rawDocs = make(map[uint64][]byte)
+	p.fetcher = c.conn
 	p.forceUpdateCh = make(chan interface{}, 1)
 	// Save cached documents
 	d := c.cfg.CachedDocument
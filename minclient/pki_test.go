@@ -0,0 +1,260 @@
+// pki_test.go - PKI interface tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	cpki "github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/core/wire/commands"
+)
+
+var testGeometry = geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 2000, true, 5)
+
+// mockPKIClient deserializes the documents, and fails to fetch them from
+// the authorities.
+type mockPKIClient struct {
+	gets int
+}
+
+func (c *mockPKIClient) Get(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	c.gets++
+	return nil, nil, errors.New("authorities unreachable")
+}
+
+func (c *mockPKIClient) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *cpki.MixDescriptor) error {
+	return nil
+}
+
+func (c *mockPKIClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	return cpki.ParseDocument(raw)
+}
+
+// mockProvider serves the documents of a map, and drops the connection
+// on GetConsensusDiff unless serveDiffs is set, as a Provider which does
+// not know the command does.
+type mockProvider struct {
+	docs       map[uint64][]byte
+	serveDiffs bool
+
+	gets     int
+	diffGets int
+}
+
+func (m *mockProvider) getConsensus(ctx context.Context, epoch uint64) (*commands.Consensus, error) {
+	m.gets++
+	return &commands.Consensus{ErrorCode: commands.ConsensusOk, Payload: m.docs[epoch]}, nil
+}
+
+func (m *mockProvider) getConsensusDiff(ctx context.Context, epoch uint64, baseHash [cpki.DiffBaseHashSize]byte) (*commands.ConsensusDiff, error) {
+	m.diffGets++
+	if !m.serveDiffs {
+		return nil, ErrNotConnected
+	}
+	diff, err := cpki.DiffDocument(m.docs[epoch-1], m.docs[epoch])
+	if err != nil {
+		return nil, err
+	}
+	return &commands.ConsensusDiff{ErrorCode: commands.ConsensusOk, Payload: diff, IsDiff: true}, nil
+}
+
+func genDescriptor(require *require.Assertions, name string, isProvider, consensusDiff bool, epoch uint64) *cpki.MixDescriptor {
+	idPriv, idPub := cert.Scheme.NewKeypair()
+	_, linkPub := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	mixKeys := make(map[uint64][]byte)
+	for e := epoch; e < epoch+3; e++ {
+		pub, _, err := ecdh.EcdhScheme.GenerateKeyPairFromEntropy(rand.Reader)
+		require.NoError(err)
+		mixKeys[e] = pub.Bytes()
+	}
+	desc := &cpki.MixDescriptor{
+		Name:        name,
+		Epoch:       epoch,
+		IdentityKey: idPub,
+		LinkKey:     linkPub,
+		MixKeys:     mixKeys,
+		Addresses: map[cpki.Transport][]string{
+			cpki.TransportTCPv4: []string{"tcp4://127.0.0.1:1"},
+		},
+		Provider:      isProvider,
+		ConsensusDiff: consensusDiff,
+	}
+	_, err := cpki.SignDescriptor(idPriv, idPub, desc)
+	require.NoError(err)
+	return desc
+}
+
+func genDocument(require *require.Assertions, epoch uint64, consensusDiff bool) []byte {
+	signer, verifier := cert.Scheme.NewKeypair()
+	doc := &cpki.Document{
+		Epoch:              epoch,
+		GenesisEpoch:       epoch,
+		SendRatePerMinute:  3,
+		Topology:           make([][]*cpki.MixDescriptor, 3),
+		SharedRandomCommit: make(map[[cpki.PublicKeyHashSize]byte][]byte),
+		SharedRandomReveal: make(map[[cpki.PublicKeyHashSize]byte][]byte),
+		SharedRandomValue:  make([]byte, cpki.SharedRandomValueLength),
+		PriorSharedRandom:  [][]byte{make([]byte, cpki.SharedRandomValueLength)},
+		SphinxGeometryHash: testGeometry.Hash(),
+	}
+	for i := range doc.Topology {
+		doc.Topology[i] = []*cpki.MixDescriptor{genDescriptor(require, fmt.Sprintf("mix%d", i), false, false, epoch)}
+	}
+	doc.Providers = []*cpki.MixDescriptor{genDescriptor(require, "provider", true, consensusDiff, epoch)}
+	raw, err := cpki.SignDocument(signer, verifier, doc)
+	require.NoError(err)
+	return raw
+}
+
+func newTestPKI(require *require.Assertions, provider *mockProvider, pkiClient cpki.Client, clock epochtime.Clock, epoch uint64) *pki {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	c := &Client{
+		cfg: &ClientConfig{
+			Provider:       "provider",
+			LogBackend:     logBackend,
+			PKIClient:      pkiClient,
+			SphinxGeometry: testGeometry,
+		},
+		displayName: "alice@provider",
+		clock:       clock,
+	}
+	p := newPKI(c)
+	p.fetcher = provider
+
+	// the document of the previous epoch, which diffs are made against
+	raw := provider.docs[epoch-1]
+	doc, err := cpki.ParseDocument(raw)
+	require.NoError(err)
+	p.docs.Store(epoch-1, doc)
+	p.rawDocs[epoch-1] = raw
+	return p
+}
+
+func TestGetDocumentDiff(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	epoch, _, _ := epochtime.Now()
+	for _, tc := range []struct {
+		name          string
+		advertised    bool
+		serveDiffs    bool
+		wantDiffGets  int
+		wantFullGets  int
+		wantDiffAfter bool
+	}{
+		// a Provider which serves diffs
+		{"diffs", true, true, 1, 0, true},
+		// a Provider without diff support is asked for the document in full
+		{"no diffs", false, false, 0, 1, false},
+		// a Provider which advertises diffs but fails to serve them is
+		// asked for the document in full, and not asked for diffs again
+		{"failed diffs", true, false, 1, 1, false},
+	} {
+		provider := &mockProvider{docs: map[uint64][]byte{
+			epoch - 1: genDocument(require, epoch-1, tc.advertised),
+			epoch:     genDocument(require, epoch, tc.advertised),
+		}}
+		provider.serveDiffs = tc.serveDiffs
+		pkiClient := new(mockPKIClient)
+		p := newTestPKI(require, provider, pkiClient, epochtime.WallClock, epoch)
+
+		d, raw, err := p.getDocument(context.Background(), epoch)
+		require.NoError(err, tc.name)
+		require.Equal(epoch, d.Epoch, tc.name)
+		require.Equal(provider.docs[epoch], raw, tc.name)
+		require.Equal(tc.wantDiffGets, provider.diffGets, tc.name)
+		require.Equal(tc.wantFullGets, provider.gets, tc.name)
+		require.Equal(tc.wantDiffAfter, p.providerServesDiffs(epoch-1), tc.name)
+
+		// the document is never fetched from the authorities
+		require.Zero(pkiClient.gets, tc.name)
+	}
+}
+
+func TestWorkerExpiresDocuments(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// The documents are signed for the epochs of the wall clock, so the
+	// fake clock starts at the current one.
+	epoch, _, _ := epochtime.Now()
+	period := epochtime.Period
+	clock := epochtime.NewFakeClockAtEpoch(epoch, 0, period)
+
+	provider := &mockProvider{docs: make(map[uint64][]byte), serveDiffs: true}
+	for e := epoch - 1; e <= epoch+2; e++ {
+		provider.docs[e] = genDocument(require, e, true)
+	}
+	p := newTestPKI(require, provider, new(mockPKIClient), clock, epoch)
+	p.start()
+	defer p.Halt()
+
+	hasDocument := func(e uint64) bool {
+		_, ok := p.docs.Load(e)
+		return ok
+	}
+	// advance waits for the worker to go to sleep, and wakes it at the
+	// given time.
+	advance := func(e uint64, elapsed time.Duration) {
+		require.Eventually(func() bool { return clock.Timers() == 1 }, 10*time.Second, time.Millisecond)
+		clock.AdvanceToEpoch(e, elapsed)
+	}
+	requireCurrent := func(e uint64) {
+		d := p.currentDocument()
+		require.NotNil(d)
+		require.Equal(e, d.Epoch)
+		desc, err := d.GetProvider("provider")
+		require.NoError(err)
+		require.Equal(e, desc.Epoch)
+	}
+
+	// on startup the document of the current epoch is fetched, and the
+	// one of the previous epoch discarded
+	require.Eventually(func() bool { return hasDocument(epoch) }, 10*time.Second, time.Millisecond)
+	require.Eventually(func() bool { return !hasDocument(epoch - 1) }, 10*time.Second, time.Millisecond)
+	requireCurrent(epoch)
+	require.False(hasDocument(epoch + 1))
+
+	// late in the epoch the document of the next epoch is fetched
+	advance(epoch, period*3/4)
+	require.Eventually(func() bool { return hasDocument(epoch + 1) }, 10*time.Second, time.Millisecond)
+	requireCurrent(epoch)
+
+	// once the epoch is over, its descriptors are no longer used
+	advance(epoch+1, 0)
+	requireCurrent(epoch + 1)
+
+	advance(epoch+1, period*3/4)
+	require.Eventually(func() bool { return hasDocument(epoch + 2) }, 10*time.Second, time.Millisecond)
+	require.Eventually(func() bool { return !hasDocument(epoch) }, 10*time.Second, time.Millisecond)
+	requireCurrent(epoch + 1)
+}
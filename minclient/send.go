@@ -48,7 +48,7 @@ func (c *Client) ComposeSphinxPacket(recipient, provider string, surbID *[sConst
 
 	for {
 		unixTime := c.pki.skewedUnixTime()
-		_, _, budget := epochtime.FromUnix(unixTime)
+		_, _, budget := epochtime.At(c.clock, time.Unix(unixTime, 0))
 		start := time.Now()
 
 		// Select the forward path.
@@ -76,7 +76,7 @@ func (c *Client) ComposeSphinxPacket(recipient, provider string, surbID *[sConst
 		// It is possible, but unlikely that a series of delays exceeding
 		// the PKI publication imposted limitations will be selected.  When
 		// that happens, the path selection must be redone.
-		if then.Sub(now) < epochtime.Period*2 {
+		if then.Sub(now) < c.clock.Period()*2 {
 			if surbID != nil {
 				payload := make([]byte, 2, 2+c.geo.SURBLength+len(b))
 				payload[0] = 1 // Packet has a SURB.
@@ -148,7 +148,7 @@ func (c *Client) makePath(recipient, provider string, surbID *[sConstants.SURBID
 		return nil, time.Time{}, newPKIError("minclient: failed to find destination Provider: %v", err)
 	}
 
-	p, t, err := path.New(c.rng, c.cfg.SphinxGeometry, doc, []byte(recipient), src, dst, surbID, baseTime, true, isForward)
+	p, t, err := path.NewWithClock(c.clock, c.rng, c.cfg.SphinxGeometry, doc, []byte(recipient), src, dst, surbID, baseTime, true, isForward)
 	if err == nil {
 		c.logPath(doc, p)
 	}
@@ -108,7 +108,7 @@ func (p *Panda) Exchange(id, message []byte, shutdown <-chan interface{}) ([]byt
 			return nil, SyntaxError
 		case common.PandaStatusTagContendedError:
 			return nil, TagContendedError
-		case common.PandaStatusRequestRecordedError:
+		case common.PandaStatusRequestRecordedError, common.PandaStatusOverloadError:
 			goto Sleep
 		case common.PandaStatusStorageError:
 			return nil, StorageError
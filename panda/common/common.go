@@ -30,6 +30,7 @@ const (
 	PandaStatusTagContendedError    = 3
 	PandaStatusRequestRecordedError = 4
 	PandaStatusStorageError         = 5
+	PandaStatusOverloadError        = 6
 
 	PandaTagLength = 32
 )
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/metrics"
 	"github.com/katzenpost/katzenpost/panda/server"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
 	"gopkg.in/op/go-logging.v1"
@@ -37,12 +38,20 @@ func main() {
 	var dwellTime string
 	var writeBackInterval string
 	var fileStore string
+	var maxPostings int
+	var tagRate float64
+	var tagBurst int
+	var metricsAddress string
 
 	flag.StringVar(&logDir, "log_dir", "", "logging directory")
 	flag.StringVar(&logLevel, "log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
 	flag.StringVar(&dwellTime, "dwell_time", "336h", "ciphertext max dwell time before garbage collection")
 	flag.StringVar(&writeBackInterval, "writeBackInterval", "1h", "GC and write-back cache interval")
 	flag.StringVar(&fileStore, "fileStore", "", "The file path of our on disk storage.")
+	flag.IntVar(&maxPostings, "max_postings", 100000, "maximum number of stored postings, 0 for no limit")
+	flag.Float64Var(&tagRate, "tag_rate", 6, "maximum requests per minute for each tag, 0 for no limit")
+	flag.IntVar(&tagBurst, "tag_burst", 10, "maximum burst of requests for each tag")
+	flag.StringVar(&metricsAddress, "metrics", "", "Prometheus metrics listen address, disabled if empty")
 
 	flag.Parse()
 
@@ -85,7 +94,14 @@ func main() {
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.panda.socket", os.Getpid()))
 
-	panda, err := server.New(serverLog, fileStore, dwellDuration, writeBackDuration)
+	if metricsAddress != "" {
+		if _, err = metrics.StartListener(metricsAddress, logBackend.GetLogger("panda_metrics")); err != nil {
+			panic(err)
+		}
+	}
+	panda, err := server.New(serverLog, fileStore, dwellDuration, writeBackDuration,
+		server.WithTagRateLimit(tagRate, tagBurst),
+		server.WithStorageOptions(server.WithMaxPostings(maxPostings)))
 	if err != nil {
 		panic(err)
 	}
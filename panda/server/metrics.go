@@ -0,0 +1,58 @@
+// metrics.go - PANDA Kaetzchen metrics.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/katzenpost/katzenpost/core/metrics"
+	"github.com/katzenpost/katzenpost/panda/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	storedPostings = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "panda_postings",
+			Help: "Number of stored PANDA postings",
+		},
+	)
+	evictedPostings = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "panda_evicted_postings_total",
+			Help: "Number of expired PANDA postings evicted because the storage was full",
+		},
+	)
+	requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "panda_requests_total",
+			Help: "Number of PANDA requests by response status",
+		},
+		[]string{"status"},
+	)
+)
+
+var statusNames = map[int]string{
+	common.PandaStatusReceived1:            "received1",
+	common.PandaStatusReceived2:            "received2",
+	common.PandaStatusSyntaxError:          "syntax_error",
+	common.PandaStatusTagContendedError:    "tag_contended",
+	common.PandaStatusRequestRecordedError: "request_recorded",
+	common.PandaStatusStorageError:         "storage_error",
+	common.PandaStatusOverloadError:        "overload",
+}
+
+func registerMetrics() {
+	metrics.Register(storedPostings, evictedPostings, requests)
+}
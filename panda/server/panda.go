@@ -20,8 +20,10 @@ import (
 	"bytes"
 	"encoding/base64"
 	"errors"
+	"sync"
 	"time"
 
+	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/panda/common"
 	"github.com/ugorji/go/codec"
 	"gopkg.in/op/go-logging.v1"
@@ -35,13 +37,52 @@ import (
 // ErrNoSURBRequest is the error returned when no SURB accompanies a query.
 var ErrNoSURBRequest = errors.New("Request received without SURB")
 
+// limiterExpiryInterval is the interval at which the token buckets
+// which have refilled are forgotten.
+const limiterExpiryInterval = time.Minute
+
+// PandaOption is an option that may be passed to New.
+type PandaOption func(*Panda)
+
+// WithTagRateLimit limits the requests for each tag to ratePerMinute,
+// with bursts of up to burst requests. The requests exceeding the limit
+// are answered with PandaStatusOverloadError.
+func WithTagRateLimit(ratePerMinute float64, burst int) PandaOption {
+	return func(k *Panda) {
+		k.rate = ratePerMinute / float64(time.Minute)
+		k.burst = float64(burst)
+	}
+}
+
+// WithStorageOptions sets the options of the PandaStorage.
+func WithStorageOptions(opts ...PandaStorageOption) PandaOption {
+	return func(k *Panda) {
+		k.storageOpts = append(k.storageOpts, opts...)
+	}
+}
+
+// tagLimiter is a token bucket limiting the requests for a tag.
+type tagLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
 // Panda is the PANDA server type.
 type Panda struct {
+	worker.Worker
+
 	log *logging.Logger
 
-	jsonHandle codec.JsonHandle
-	store      *PandaStorage
-	expiration time.Duration
+	jsonHandle  codec.JsonHandle
+	store       *PandaStorage
+	storageOpts []PandaStorageOption
+	expiration  time.Duration
+
+	rate         float64 // tokens per nanosecond
+	burst        float64
+	now          func() time.Time
+	limitersLock sync.Mutex
+	limiters     map[[common.PandaTagLength]byte]*tagLimiter
 }
 
 // OnRequest services a client request and returns the reply.
@@ -76,6 +117,11 @@ func (k *Panda) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, erro
 		k.log.Debug("cannot decode tag and message")
 		return k.encodeResp(&resp), nil
 	}
+	if !k.allow(tag) {
+		k.log.Debugf("request %d rate limited", id)
+		resp.StatusCode = common.PandaStatusOverloadError
+		return k.encodeResp(&resp), nil
+	}
 
 	storedPosting, err := k.store.Get(tag)
 	if storedPosting != nil {
@@ -84,6 +130,11 @@ func (k *Panda) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, erro
 	}
 	if err == common.ErrNoSuchPandaTag || err == nil && storedPosting.Expired(k.expiration) {
 		err = k.store.Put(tag, newPosting)
+		if err == ErrStorageFull {
+			k.log.Debug("PANDA storage is full")
+			resp.StatusCode = common.PandaStatusOverloadError
+			return k.encodeResp(&resp), nil
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -126,7 +177,59 @@ func (k *Panda) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, erro
 	return k.encodeResp(&resp), nil
 }
 
+// allow takes a token from the bucket of the tag, and returns false if
+// there is none.
+func (k *Panda) allow(tag *[common.PandaTagLength]byte) bool {
+	if k.rate == 0 {
+		return true
+	}
+	k.limitersLock.Lock()
+	defer k.limitersLock.Unlock()
+	now := k.now()
+	l, ok := k.limiters[*tag]
+	if !ok {
+		l = &tagLimiter{tokens: k.burst, last: now}
+		k.limiters[*tag] = l
+	}
+	l.tokens += float64(now.Sub(l.last)) * k.rate
+	if l.tokens > k.burst {
+		l.tokens = k.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// expireLimiters forgets the token buckets which have refilled.
+func (k *Panda) expireLimiters() {
+	k.limitersLock.Lock()
+	defer k.limitersLock.Unlock()
+	now := k.now()
+	for tag, l := range k.limiters {
+		if l.tokens+float64(now.Sub(l.last))*k.rate >= k.burst {
+			delete(k.limiters, tag)
+		}
+	}
+}
+
+func (k *Panda) worker() {
+	ticker := time.NewTicker(limiterExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.HaltCh():
+			return
+		case <-ticker.C:
+			k.expireLimiters()
+		}
+	}
+}
+
 func (k *Panda) encodeResp(resp *common.PandaResponse) []byte {
+	requests.WithLabelValues(statusNames[resp.StatusCode]).Inc()
 	var out []byte
 	enc := codec.NewEncoderBytes(&out, &k.jsonHandle)
 	if err := enc.Encode(resp); err != nil {
@@ -136,17 +239,26 @@ func (k *Panda) encodeResp(resp *common.PandaResponse) []byte {
 }
 
 // New constructs a new Panda server instance
-func New(log *logging.Logger, fileStore string, dwellDuration time.Duration, writeBackInterval time.Duration) (*Panda, error) {
-	store, err := NewPandaStorage(fileStore, dwellDuration, writeBackInterval)
-	if err != nil {
-		return nil, err
-	}
+func New(log *logging.Logger, fileStore string, dwellDuration time.Duration, writeBackInterval time.Duration, opts ...PandaOption) (*Panda, error) {
 	k := &Panda{
 		log:        log,
-		store:      store,
 		expiration: dwellDuration,
+		now:        time.Now,
+		limiters:   make(map[[common.PandaTagLength]byte]*tagLimiter),
+	}
+	for _, opt := range opts {
+		opt(k)
 	}
+	registerMetrics()
+	store, err := NewPandaStorage(fileStore, dwellDuration, writeBackInterval, k.storageOpts...)
+	if err != nil {
+		return nil, err
+	}
+	k.store = store
 	k.jsonHandle.Canonical = true
 	k.jsonHandle.ErrorIfNoField = true
+	if k.rate != 0 {
+		k.Go(k.worker)
+	}
 	return k, nil
 }
@@ -0,0 +1,84 @@
+// panda_test.go - PANDA Kaetzchen tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/panda/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+func pandaRequest(k *Panda, tag byte, message string) int {
+	request := common.PandaRequest{
+		Version: common.PandaVersion,
+		Tag:     hex.EncodeToString(append([]byte{tag}, make([]byte, common.PandaTagLength-1)...)),
+		Message: base64.StdEncoding.EncodeToString([]byte(message)),
+	}
+	var rawRequest []byte
+	if err := codec.NewEncoderBytes(&rawRequest, &k.jsonHandle).Encode(request); err != nil {
+		panic(err)
+	}
+	rawResponse, err := k.OnRequest(0, rawRequest, true)
+	if err != nil {
+		panic(err)
+	}
+	var response common.PandaResponse
+	if err := codec.NewDecoderBytes(rawResponse, &k.jsonHandle).Decode(&response); err != nil {
+		panic(err)
+	}
+	return response.StatusCode
+}
+
+func TestPandaOverload(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	storeFile, err := os.CreateTemp("", "pandaOverload")
+	assert.NoError(err)
+	logBackend, err := log.New("", "DEBUG", false)
+	assert.NoError(err)
+
+	k, err := New(logBackend.GetLogger("panda"), storeFile.Name(), time.Hour, time.Hour,
+		WithTagRateLimit(1, 2),
+		WithStorageOptions(WithMaxPostings(2)))
+	assert.NoError(err)
+	defer k.Halt()
+	now := time.Now()
+	k.now = func() time.Time { return now }
+
+	// the requests for a tag are rate limited
+	assert.Equal(common.PandaStatusReceived1, pandaRequest(k, 1, "alice"))
+	assert.Equal(common.PandaStatusReceived2, pandaRequest(k, 1, "bob"))
+	assert.Equal(common.PandaStatusOverloadError, pandaRequest(k, 1, "alice"))
+	assert.Equal(common.PandaStatusReceived1, pandaRequest(k, 2, "carol"))
+	now = now.Add(time.Minute)
+	assert.Equal(common.PandaStatusReceived2, pandaRequest(k, 1, "alice"))
+
+	// new postings are refused when the storage is full
+	assert.Equal(common.PandaStatusOverloadError, pandaRequest(k, 3, "dave"))
+
+	// the refilled token buckets are forgotten
+	now = now.Add(time.Hour)
+	k.expireLimiters()
+	assert.Empty(k.limiters)
+}
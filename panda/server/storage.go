@@ -42,6 +42,10 @@ const (
 	postBKey        = "B"
 )
 
+// ErrStorageFull is the error returned when a posting cannot be stored
+// because the maximum number of postings is reached.
+var ErrStorageFull = errors.New("PANDA storage is full")
+
 // PandaPosting is the data structure stored on Panda
 // server with each client interaction.
 type PandaPosting struct {
@@ -81,6 +85,18 @@ func postingFromRequest(req *common.PandaRequest) (*[common.PandaTagLength]byte,
 	return &tag, p, nil
 }
 
+// PandaStorageOption is an option that may be passed to NewPandaStorage.
+type PandaStorageOption func(*PandaStorage)
+
+// WithMaxPostings limits the number of stored postings. When the limit is
+// reached, the expired postings are evicted, and new postings are refused
+// if there are none.
+func WithMaxPostings(maxPostings int) PandaStorageOption {
+	return func(s *PandaStorage) {
+		s.maxPostings = maxPostings
+	}
+}
+
 // PandaStorage handles the on disk persistence for the PANDA server.
 type PandaStorage struct {
 	worker.Worker
@@ -90,16 +106,25 @@ type PandaStorage struct {
 	db                *bolt.DB
 	dwellDuration     time.Duration
 	writeBackInterval time.Duration
+
+	// countLock serializes adding and removing postings, so that
+	// the number of postings does not exceed maxPostings.
+	countLock   sync.Mutex
+	count       int
+	maxPostings int
 }
 
 // NewPandaStorage creates an in memory store
 // for Panda postings
-func NewPandaStorage(fileStore string, dwellDuration time.Duration, writeBackInterval time.Duration) (*PandaStorage, error) {
+func NewPandaStorage(fileStore string, dwellDuration time.Duration, writeBackInterval time.Duration, opts ...PandaStorageOption) (*PandaStorage, error) {
 	s := &PandaStorage{
 		dwellDuration:     dwellDuration,
 		writeBackInterval: writeBackInterval,
 		postings:          new(sync.Map),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
 	var err error
 	s.db, err = bolt.Open(fileStore, 0600, nil)
 	if err != nil {
@@ -155,7 +180,7 @@ func (s *PandaStorage) load(tx *bolt.Tx, postsBucket *bolt.Bucket) error {
 		if b == nil {
 			return errors.New("posting B not found")
 		}
-		posting := PandaPosting{
+		posting := &PandaPosting{
 			Dirty:    false,
 			UnixTime: int64(binary.BigEndian.Uint64(rawTime)),
 			A:        a,
@@ -164,7 +189,9 @@ func (s *PandaStorage) load(tx *bolt.Tx, postsBucket *bolt.Bucket) error {
 		tagArray := [common.PandaTagLength]byte{}
 		copy(tagArray[:], tag)
 		s.postings.Store(tagArray, posting)
+		s.count++
 	}
+	storedPostings.Set(float64(s.count))
 	return nil
 }
 
@@ -299,14 +326,53 @@ func (s *PandaStorage) Shutdown() {
 // Put stores a posting in the data store
 // such that it is referenced by the given tag.
 func (s *PandaStorage) Put(tag *[common.PandaTagLength]byte, posting *PandaPosting) error {
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	if s.maxPostings > 0 && s.count >= s.maxPostings {
+		s.evictExpired()
+		if s.count >= s.maxPostings {
+			return ErrStorageFull
+		}
+	}
 	posting.Dirty = true
 	_, loaded := s.postings.LoadOrStore(*tag, posting)
 	if loaded {
 		return errors.New("PandaStorage Put failure: tag already present")
 	}
+	s.count++
+	storedPostings.Set(float64(s.count))
 	return nil
 }
 
+// Len returns the number of stored postings.
+func (s *PandaStorage) Len() int {
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	return s.count
+}
+
+// evictExpired removes the postings that have expired, and must be
+// called with countLock held. The postings locked by a request, which
+// may be waiting for countLock, are skipped.
+func (s *PandaStorage) evictExpired() {
+	s.postings.Range(func(rawTag, rawPosting interface{}) bool {
+		posting, ok := rawPosting.(*PandaPosting)
+		if !ok || !posting.TryLock() {
+			return true
+		}
+		expired := posting.Expired(s.dwellDuration)
+		posting.Unlock()
+		if expired {
+			if _, loaded := s.postings.LoadAndDelete(rawTag); loaded {
+				s.count--
+				evictedPostings.Inc()
+			}
+		}
+		return true
+	})
+	storedPostings.Set(float64(s.count))
+}
+
 // Get returns a posting from the data store
 // that is referenced by the given tag.
 func (s *PandaStorage) Get(tag *[common.PandaTagLength]byte) (*PandaPosting, error) {
@@ -345,7 +411,12 @@ func (s *PandaStorage) Vacuum() error {
 		posting.Lock()
 		defer posting.Unlock()
 		if posting.Expired(s.dwellDuration) {
-			s.postings.Delete(tag)
+			s.countLock.Lock()
+			if _, loaded := s.postings.LoadAndDelete(tag); loaded {
+				s.count--
+				storedPostings.Set(float64(s.count))
+			}
+			s.countLock.Unlock()
 		}
 		return true
 	}
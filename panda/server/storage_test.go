@@ -174,3 +174,48 @@ func TestStoragePurgeTags(t *testing.T) {
 	err = store.Put(tag1, posting1)
 	assert.NoError(err)
 }
+
+func TestStorageEviction(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	storeFile, err := os.CreateTemp("", "pandaStorageEviction")
+	assert.NoError(err)
+
+	dwellDuration := time.Hour
+	writeBackInterval := time.Hour
+	store, err := NewPandaStorage(storeFile.Name(), dwellDuration, writeBackInterval, WithMaxPostings(3))
+	assert.NoError(err)
+	defer store.Shutdown()
+
+	put := func(age time.Duration) (*[common.PandaTagLength]byte, error) {
+		tag := &[common.PandaTagLength]byte{}
+		_, err := rand.Reader.Read(tag[:])
+		assert.NoError(err)
+		return tag, store.Put(tag, &PandaPosting{
+			UnixTime: time.Now().Add(-age).Unix(),
+			A:        []byte("A"),
+		})
+	}
+	expired, err := put(2 * time.Hour)
+	assert.NoError(err)
+	fresh, err := put(0)
+	assert.NoError(err)
+	_, err = put(0)
+	assert.NoError(err)
+	assert.Equal(3, store.Len())
+
+	// under pressure the expired posting is evicted
+	_, err = put(0)
+	assert.NoError(err)
+	assert.Equal(3, store.Len())
+	_, err = store.Get(expired)
+	assert.Error(err)
+	_, err = store.Get(fresh)
+	assert.NoError(err)
+
+	// the postings which have not expired are kept
+	_, err = put(0)
+	assert.Equal(ErrStorageFull, err)
+	assert.Equal(3, store.Len())
+}
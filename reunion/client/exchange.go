@@ -316,27 +316,33 @@ func (e *Exchange) fetchState() error {
 	fetchStateCmd.Epoch = e.session.Epoch()
 	fetchStateCmd.T1Hash = t1HashAr
 
-	rawResponse, err := e.db.Query(fetchStateCmd)
-	if err != nil {
-		return err
-	}
-	response, ok := rawResponse.(*commands.StateResponse)
-	if !ok {
-		return errors.New("fetch state: wrong response command received")
-	}
-	if response.ErrorCode != commands.ResponseStatusOK {
-		return fmt.Errorf("fetch state: received an error status code from the reunion db: %d", response.ErrorCode)
-	}
-	state := new(server.RequestedReunionState)
-	err = state.Unmarshal(response.Payload)
-	if err != nil {
-		return err
-	}
-	if response.Truncated {
-		return errors.New("truncated Reunion DB state not yet supported")
+	// a large state is sent in chunks, which are fetched in turn
+	for {
+		rawResponse, err := e.db.Query(fetchStateCmd)
+		if err != nil {
+			return err
+		}
+		response, ok := rawResponse.(*commands.StateResponse)
+		if !ok {
+			return errors.New("fetch state: wrong response command received")
+		}
+		if response.ErrorCode != commands.ResponseStatusOK {
+			return fmt.Errorf("fetch state: received an error status code from the reunion db: %d", response.ErrorCode)
+		}
+		state := new(server.RequestedReunionState)
+		err = state.Unmarshal(response.Payload)
+		if err != nil {
+			return err
+		}
+		_, err = e.processState(state)
+		if err != nil {
+			return err
+		}
+		if !response.Truncated {
+			return nil
+		}
+		fetchStateCmd.ChunkIndex++
 	}
-	_, err = e.processState(state)
-	return err
 }
 
 func (e *Exchange) sendT1() error {
@@ -37,9 +37,14 @@ const (
 	// ResponseStatusInvalidCommand is an ErrorCode value used in responses
 	// from the Reunion DB to indicate the command was not accepted.
 	ResponseInvalidCommand = 0xFF
+	// ResponseEpochFull is an ErrorCode value used in responses from the
+	// Reunion DB to indicate the message was not stored because the
+	// epoch reached its size limit.
+	ResponseEpochFull = 0xFE
 
 	cmdOverhead           = 1
 	fetchStateLength      = cmdOverhead + 8 + 32
+	fetchStateChunkLength = fetchStateLength + 4
 	stateResponseLength   = cmdOverhead + 1 + 1 + 4 + crypto.PayloadSize
 	sendT1Length          = cmdOverhead + 8 + crypto.Type1MessageSize
 	sendT2Length          = cmdOverhead + 8 + 32 + 32 + crypto.Type2MessageSize
@@ -68,26 +73,42 @@ type FetchState struct {
 
 	// T1Hash is the hash of the T1 message which is linked with a set of received messages.
 	T1Hash [sha256.Size]byte
+
+	// ChunkIndex is the index of the requested chunk of a truncated state.
+	ChunkIndex uint32
 }
 
 // ToBytes serializes the SendT1 command and returns the resulting slice.
+// The first chunk is requested with the shorter encoding understood by
+// the servers which do not truncate the state.
 func (s *FetchState) ToBytes() []byte {
-	out := make([]byte, fetchStateLength)
+	if s.ChunkIndex == 0 {
+		out := make([]byte, fetchStateLength)
+		out[0] = byte(fetchState)
+		binary.BigEndian.PutUint64(out[1:9], s.Epoch)
+		copy(out[9:], s.T1Hash[:])
+		return out
+	}
+	out := make([]byte, fetchStateChunkLength)
 	out[0] = byte(fetchState)
 	binary.BigEndian.PutUint64(out[1:9], s.Epoch)
 	copy(out[9:], s.T1Hash[:])
+	binary.BigEndian.PutUint32(out[fetchStateLength:], s.ChunkIndex)
 	return out
 }
 
 func fetchStateFromBytes(b []byte) (Command, error) {
-	if len(b) != fetchStateLength {
+	if len(b) != fetchStateLength && len(b) != fetchStateChunkLength {
 		return nil, errInvalidCommand
 	}
 	s := new(FetchState)
 	s.Epoch = binary.BigEndian.Uint64(b[1:9])
 	t1Hash := [sha256.Size]byte{}
-	copy(t1Hash[:], b[9:])
+	copy(t1Hash[:], b[9:fetchStateLength])
 	s.T1Hash = t1Hash
+	if len(b) == fetchStateChunkLength {
+		s.ChunkIndex = binary.BigEndian.Uint32(b[fetchStateLength:])
+	}
 	return s, nil
 }
 
@@ -48,6 +48,16 @@ func TestFetchStateCommand(t *testing.T) {
 	cmd2 := c.(*FetchState)
 	require.Equal(cmd.Epoch, cmd2.Epoch)
 	require.Equal(cmd.T1Hash[:], cmd2.T1Hash[:])
+	require.Zero(cmd2.ChunkIndex)
+
+	cmd.ChunkIndex = 7
+	b = cmd.ToBytes()
+	require.Equal(len(b), fetchStateChunkLength)
+	c, err = FromBytes(b)
+	require.NoError(err)
+	cmd2 = c.(*FetchState)
+	require.Equal(cmd.T1Hash[:], cmd2.T1Hash[:])
+	require.Equal(uint32(7), cmd2.ChunkIndex)
 }
 
 func TestStateResponseCommand(t *testing.T) {
@@ -0,0 +1,76 @@
+// metrics.go - Reunion server metrics.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/katzenpost/katzenpost/core/metrics"
+)
+
+var (
+	epochMessages = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "reunion_epoch_messages",
+			Help: "Number of messages stored for an epoch",
+		},
+		[]string{"epoch", "type"},
+	)
+	epochBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "reunion_epoch_bytes",
+			Help: "Number of message bytes stored for an epoch",
+		},
+		[]string{"epoch"},
+	)
+	rejectedMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reunion_rejected_messages_total",
+			Help: "Number of messages rejected because their epoch reached its size limit",
+		},
+		[]string{"type"},
+	)
+	fetchedChunks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "reunion_fetched_chunks_total",
+			Help: "Number of state chunks sent in response to fetch state commands",
+		},
+	)
+)
+
+func registerMetrics() {
+	metrics.Register(epochMessages, epochBytes, rejectedMessages, fetchedChunks)
+}
+
+// observeEpoch sets the metrics of an epoch.
+func observeEpoch(epoch uint64, stats *EpochStats) {
+	e := strconv.FormatUint(epoch, 10)
+	epochMessages.WithLabelValues(e, "t1").Set(float64(stats.T1s))
+	epochMessages.WithLabelValues(e, "t2").Set(float64(stats.T2s))
+	epochMessages.WithLabelValues(e, "t3").Set(float64(stats.T3s))
+	epochBytes.WithLabelValues(e).Set(float64(stats.Size))
+}
+
+// forgetEpoch removes the metrics of an epoch which was removed.
+func forgetEpoch(epoch uint64) {
+	e := strconv.FormatUint(epoch, 10)
+	for _, t := range []string{"t1", "t2", "t3"} {
+		epochMessages.DeleteLabelValues(e, t)
+	}
+	epochBytes.DeleteLabelValues(e)
+}
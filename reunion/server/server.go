@@ -19,13 +19,13 @@ package server
 
 import (
 	"errors"
-	"sync"
-	"sync/atomic"
+	"os"
 	"time"
 
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/reunion/commands"
+	"github.com/katzenpost/katzenpost/reunion/crypto"
 	"github.com/katzenpost/katzenpost/reunion/epochtime"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
 	"gopkg.in/op/go-logging.v1"
@@ -33,63 +33,85 @@ import (
 
 // Tune me.
 const (
-	writeBackInterval = 10 * time.Second
-	epochGracePeriod  = 3 * time.Minute
+	metricsInterval  = 10 * time.Second
+	epochGracePeriod = 3 * time.Minute
+
+	// stateResponseOverhead is the length of the StateResponse
+	// command without its payload.
+	stateResponseOverhead = 7
+
+	// cborHeaderLength is the maximum length of a CBOR data item header.
+	cborHeaderLength = 9
 )
 
+// ServerOption is an option that may be passed to NewServer.
+type ServerOption func(*Server)
+
+// WithMaxEpochSize limits the number of message bytes stored for each
+// epoch. The messages which exceed the limit are rejected.
+func WithMaxEpochSize(size uint64) ServerOption {
+	return func(s *Server) {
+		s.maxEpochSize = size
+	}
+}
+
 // Server is a reunion server.
 type Server struct {
-	sync.RWMutex
 	worker.Worker
 
 	stateFilePath string
-	states        *ReunionStates
-	nDirtyEntries uint64
+	store         *boltStore
+	maxEpochSize  uint64
 	epochClock    epochtime.EpochClock
 	log           *logging.Logger
 	logBackend    *log.Backend
 	write         func(cborplugin.Command)
+
+	// observed are the epochs whose metrics were set.
+	observed map[uint64]bool
 }
 
 // NewServerFromStatefile loads the state from a file.
-func NewServerFromStatefile(epochClock epochtime.EpochClock, stateFilePath, logPath, logLevel string) (*Server, error) {
+func NewServerFromStatefile(epochClock epochtime.EpochClock, stateFilePath, logPath, logLevel string, opts ...ServerOption) (*Server, error) {
+	if _, err := os.Stat(stateFilePath); err != nil {
+		return nil, err
+	}
+	return NewServer(epochClock, stateFilePath, logPath, logLevel, opts...)
+}
+
+// NewServer returns a new Server storing its state in the given file,
+// which is created if it does not exist.
+func NewServer(epochClock epochtime.EpochClock, stateFilePath, logPath, logLevel string, opts ...ServerOption) (*Server, error) {
 	logBackend, err := log.New(logPath, logLevel, false)
 	if err != nil {
 		return nil, err
 	}
 	s := &Server{
 		stateFilePath: stateFilePath,
-		states:        NewReunionStates(),
-		nDirtyEntries: 0,
 		epochClock:    epochClock,
 		logBackend:    logBackend,
 		log:           logBackend.GetLogger("reunion_server_core"),
+		observed:      make(map[uint64]bool),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
-	err = s.states.LoadFromFile(stateFilePath)
+	migrated, err := migrateLegacyStatefile(stateFilePath)
 	if err != nil {
 		return nil, err
 	}
-	s.states.MaybeAddEpochs(s.epochClock)
-	s.states.GarbageCollectOldEpochs(epochClock)
-	s.Go(s.worker)
-	return s, nil
-}
-
-// NewServer returns a new Server with a new ReunionState.
-func NewServer(epochClock epochtime.EpochClock, stateFilePath, logPath, logLevel string) (*Server, error) {
-	logBackend, err := log.New(logPath, logLevel, false)
+	if migrated {
+		s.log.Noticef("Moved the legacy statefile to %v%v, starting a new one.", stateFilePath, legacyStatefileSuffix)
+	}
+	s.store, err = newBoltStore(stateFilePath, s.maxEpochSize)
 	if err != nil {
 		return nil, err
 	}
-	s := &Server{
-		stateFilePath: stateFilePath,
-		states:        NewReunionStates(),
-		nDirtyEntries: 0,
-		epochClock:    epochClock,
-		logBackend:    logBackend,
-		log:           logBackend.GetLogger("reunion_server_core"),
+	if err = s.store.updateEpochs(s.epochClock); err != nil {
+		s.store.close()
+		return nil, err
 	}
-	s.states.MaybeAddEpochs(s.epochClock)
+	registerMetrics()
 	s.Go(s.worker)
 	return s, nil
 }
@@ -99,94 +121,99 @@ func (s *Server) GetNewLogger(name string) *logging.Logger {
 	return s.logBackend.GetLogger(name)
 }
 
-func (s *Server) incrementDirtyEntryCount() {
-	atomic.AddUint64(&s.nDirtyEntries, 1)
-}
-
-func (s *Server) fetchState(fetchCmd *commands.FetchState) (*commands.StateResponse, error) {
-	state, err := s.states.GetStateFromEpoch(fetchCmd.Epoch)
-	if err != nil {
-		return nil, err
+// chunkSizes returns the number of T1 messages and of T2 and T3 messages
+// of each chunk of the state, so that a chunk fits in a response of
+// maxLength bytes, or zero for no limit.
+func chunkSizes(maxLength int) (int, int, error) {
+	if maxLength == 0 {
+		return 0, 0, nil
 	}
-	messages, ok := state.messageMap.Load(fetchCmd.T1Hash)
-	if !ok {
-		return nil, errors.New("invalid message map value")
+	length := func(state *RequestedReunionState) int {
+		b, err := state.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		return len(b)
 	}
-	messageList, ok := messages.(*LockedList)
-	if !ok {
-		return nil, errors.New("invalid message list")
+	empty := length(&RequestedReunionState{T1Map: make(map[[32]byte][]byte), Messages: []*T2T3Message{}})
+	t1Length := length(&RequestedReunionState{
+		T1Map:    map[[32]byte][]byte{{}: make([]byte, crypto.Type1MessageSize)},
+		Messages: []*T2T3Message{},
+	}) - empty
+	messageLength := 0
+	for _, message := range []*T2T3Message{
+		{T2Payload: make([]byte, crypto.Type2MessageSize)},
+		{T3Payload: make([]byte, crypto.Type3MessageSize)},
+	} {
+		if l := length(&RequestedReunionState{T1Map: make(map[[32]byte][]byte), Messages: []*T2T3Message{message}}) - empty; l > messageLength {
+			messageLength = l
+		}
+	}
+	// the T1 messages and the T2 and T3 messages each get half of the chunk
+	available := (maxLength - stateResponseOverhead - empty - 2*cborHeaderLength) / 2
+	t1s, messages := available/t1Length, available/messageLength
+	if t1s == 0 || messages == 0 {
+		return 0, 0, errors.New("response length too small for the state")
 	}
-	t2t3messages, err := messageList.Serializable()
+	return t1s, messages, nil
+}
+
+func (s *Server) fetchState(fetchCmd *commands.FetchState, maxLength int) (*commands.StateResponse, error) {
+	t1s, messages, err := chunkSizes(maxLength)
 	if err != nil {
 		return nil, err
 	}
-	t1Map, err := state.SerializableT1Map()
+	requested, left, err := s.store.fetch(fetchCmd.Epoch, fetchCmd.T1Hash, fetchCmd.ChunkIndex, t1s, messages)
 	if err != nil {
 		return nil, err
 	}
-	requested := &RequestedReunionState{
-		T1Map:    t1Map,
-		Messages: t2t3messages,
-	}
 	serialized, err := requested.Marshal()
 	if err != nil {
 		return nil, err
 	}
+	fetchedChunks.Inc()
 	response := &commands.StateResponse{
 		ErrorCode:          commands.ResponseStatusOK,
-		Truncated:          false,
-		LeftOverChunksHint: 0,
+		Truncated:          left > 0,
+		LeftOverChunksHint: left,
 		Payload:            serialized,
 	}
 	return response, nil
 }
 
-func (s *Server) sendT1(sendT1 *commands.SendT1) (*commands.MessageResponse, error) {
-	state, err := s.states.GetStateFromEpoch(sendT1.Epoch)
-	if err != nil {
-		return nil, err
-	}
-	err = state.AppendMessage(sendT1)
-	if err != nil {
+// messageResponse returns the response to a send command which failed
+// with err, which is only returned if the message is not rejected
+// because its epoch is full.
+func messageResponse(err error, messageType string) (*commands.MessageResponse, error) {
+	switch err {
+	case nil:
+		return &commands.MessageResponse{ErrorCode: commands.ResponseStatusOK}, nil
+	case errEpochFull:
+		rejectedMessages.WithLabelValues(messageType).Inc()
+		return &commands.MessageResponse{ErrorCode: commands.ResponseEpochFull}, nil
+	default:
 		return nil, err
 	}
-	s.incrementDirtyEntryCount()
-	response := &commands.MessageResponse{
-		ErrorCode: commands.ResponseStatusOK,
-	}
-	return response, nil
+}
+
+func (s *Server) sendT1(sendT1 *commands.SendT1) (*commands.MessageResponse, error) {
+	return messageResponse(s.store.appendT1(sendT1.Epoch, sendT1.Payload), "t1")
 }
 
 func (s *Server) sendT2(sendT2 *commands.SendT2) (*commands.MessageResponse, error) {
-	state, err := s.states.GetStateFromEpoch(sendT2.Epoch)
-	if err != nil {
-		return nil, err
-	}
-	err = state.AppendMessage(sendT2)
-	if err != nil {
-		return nil, err
-	}
-	s.incrementDirtyEntryCount()
-	response := &commands.MessageResponse{
-		ErrorCode: commands.ResponseStatusOK,
-	}
-	return response, nil
+	err := s.store.appendMessage(sendT2.Epoch, sendT2.DstT1Hash, &T2T3Message{
+		SrcT1Hash: sendT2.SrcT1Hash,
+		T2Payload: sendT2.Payload,
+	})
+	return messageResponse(err, "t2")
 }
 
 func (s *Server) sendT3(sendT3 *commands.SendT3) (*commands.MessageResponse, error) {
-	state, err := s.states.GetStateFromEpoch(sendT3.Epoch)
-	if err != nil {
-		return nil, err
-	}
-	err = state.AppendMessage(sendT3)
-	if err != nil {
-		return nil, err
-	}
-	s.incrementDirtyEntryCount()
-	response := &commands.MessageResponse{
-		ErrorCode: commands.ResponseStatusOK,
-	}
-	return response, nil
+	err := s.store.appendMessage(sendT3.Epoch, sendT3.DstT1Hash, &T2T3Message{
+		SrcT1Hash: sendT3.SrcT1Hash,
+		T3Payload: sendT3.Payload,
+	})
+	return messageResponse(err, "t3")
 }
 
 // RegisterConsumers implements cborplugin.PluginClient
@@ -205,7 +232,9 @@ func (s *Server) OnCommand(cmd cborplugin.Command) error {
 			return err
 		}
 		s.Go(func() {
-			replyCmd, err = s.ProcessQuery(cmd)
+			// the response must fit in the payload of the SURB reply,
+			// which is as long as the request payload
+			replyCmd, err = s.processQuery(cmd, len(r.Payload))
 			if err != nil {
 				s.log.Errorf("reunion server invalid reply command: %s", err.Error())
 				// XXX: this is also triggered by an expired epoch... and does not return error to client
@@ -224,12 +253,18 @@ func (s *Server) OnCommand(cmd cborplugin.Command) error {
 
 // ProcessQuery processes the given query command and returns a response command or an error.
 func (s *Server) ProcessQuery(command commands.Command) (commands.Command, error) {
+	return s.processQuery(command, 0)
+}
+
+// processQuery processes the given query command and returns a response
+// command of up to maxLength bytes, or of any length if it is zero.
+func (s *Server) processQuery(command commands.Command, maxLength int) (commands.Command, error) {
 	var err error
 	var response commands.Command
 	switch cmd := command.(type) {
 	case *commands.FetchState:
 		s.log.Debug("fetch state")
-		response, err = s.fetchState(cmd)
+		response, err = s.fetchState(cmd, maxLength)
 		if err != nil {
 			return nil, err
 		}
@@ -258,47 +293,49 @@ func (s *Server) ProcessQuery(command commands.Command) (commands.Command, error
 	return response, nil
 }
 
-func (s *Server) doFlush() error {
-	return s.states.AtomicWriteToFile(s.stateFilePath)
-}
-
-func (s *Server) maybeFlush() {
-	nEntries := atomic.LoadUint64(&s.nDirtyEntries)
-	if nEntries == 0 {
+// updateMetrics sets the metrics of the stored epochs.
+func (s *Server) updateMetrics() {
+	epochs, err := s.store.epochs()
+	if err != nil {
+		s.log.Errorf("failed to list epochs: %s", err)
 		return
 	}
-	err := s.doFlush()
-	if err != nil {
-		panic("flush to disk failure, aborting...") // XXX should we panic here or what?
+	current := make(map[uint64]bool)
+	for _, epoch := range epochs {
+		stats, err := s.store.stats(epoch)
+		if err != nil {
+			continue
+		}
+		observeEpoch(epoch, stats)
+		current[epoch] = true
 	}
-	atomic.StoreUint64(&s.nDirtyEntries, 0)
+	for epoch := range s.observed {
+		if !current[epoch] {
+			forgetEpoch(epoch)
+		}
+	}
+	s.observed = current
 }
 
 func (s *Server) worker() {
-	defer s.doFlush()
-
-	flushTicker := time.NewTicker(writeBackInterval)
-	defer flushTicker.Stop()
+	defer s.store.close()
 
-	gcTicker := time.NewTicker(s.epochClock.Period() / 2)
-	defer gcTicker.Stop()
+	metricsTicker := time.NewTicker(metricsInterval)
+	defer metricsTicker.Stop()
 
-	newEpochTicker := time.NewTicker(s.epochClock.Period() / 8)
-	defer flushTicker.Stop()
+	epochTicker := time.NewTicker(s.epochClock.Period() / 8)
+	defer epochTicker.Stop()
 
 	for {
 		select {
 		case <-s.HaltCh():
 			return
-		case <-flushTicker.C:
-			s.maybeFlush()
-			continue
-		case <-gcTicker.C:
-			s.states.GarbageCollectOldEpochs(s.epochClock)
-			continue
-		case <-newEpochTicker.C:
-			s.states.MaybeAddEpochs(s.epochClock)
-			continue
+		case <-metricsTicker.C:
+			s.updateMetrics()
+		case <-epochTicker.C:
+			if err := s.store.updateEpochs(s.epochClock); err != nil {
+				s.log.Errorf("failed to update epochs: %s", err)
+			}
 		}
 	}
 }
@@ -17,12 +17,18 @@
 package server
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/katzenpost/reunion/commands"
+	"github.com/katzenpost/katzenpost/reunion/crypto"
 	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestServer(t *testing.T) {
@@ -48,3 +54,181 @@ func TestServer(t *testing.T) {
 
 	// XXX ...
 }
+
+func newTestServer(t *testing.T, stateFilePath string, opts ...ServerOption) *Server {
+	server, err := NewServer(new(katzenpost.Clock), stateFilePath, "", "DEBUG", opts...)
+	require.NoError(t, err)
+	return server
+}
+
+func sendT1(t *testing.T, server *Server, epoch uint64) []byte {
+	payload := make([]byte, crypto.Type1MessageSize)
+	_, err := rand.Reader.Read(payload)
+	require.NoError(t, err)
+	response, err := server.ProcessQuery(&commands.SendT1{Epoch: epoch, Payload: payload})
+	require.NoError(t, err)
+	require.EqualValues(t, commands.ResponseStatusOK, response.(*commands.MessageResponse).ErrorCode)
+	return payload
+}
+
+func TestServerFetchStateChunks(t *testing.T) {
+	require := require.New(t)
+
+	stateFilePath := filepath.Join(t.TempDir(), "statefile")
+	server := newTestServer(t, stateFilePath)
+	epoch, _, _ := server.epochClock.Now()
+
+	t1s := make(map[[32]byte][]byte)
+	for i := 0; i < 20; i++ {
+		t1 := sendT1(t, server, epoch)
+		t1s[sha256.Sum256(t1)] = t1
+	}
+	var t1Hash [32]byte
+	for t1Hash = range t1s {
+		break
+	}
+	for i := 0; i < 10; i++ {
+		response, err := server.ProcessQuery(&commands.SendT2{
+			Epoch:     epoch,
+			SrcT1Hash: [32]byte{byte(i)},
+			DstT1Hash: t1Hash,
+			Payload:   make([]byte, crypto.Type2MessageSize),
+		})
+		require.NoError(err)
+		require.EqualValues(commands.ResponseStatusOK, response.(*commands.MessageResponse).ErrorCode)
+	}
+	// the state is sent in chunks fitting the response length
+	maxLength := 8 * 1024
+	fetched := make(map[[32]byte][]byte)
+	messages := 0
+	fetch := &commands.FetchState{Epoch: epoch, T1Hash: t1Hash}
+	for {
+		response, err := server.processQuery(fetch, maxLength)
+		require.NoError(err)
+		require.LessOrEqual(len(response.ToBytes()), maxLength)
+		stateResponse := response.(*commands.StateResponse)
+		state := new(RequestedReunionState)
+		require.NoError(state.Unmarshal(stateResponse.Payload))
+		for h, t1 := range state.T1Map {
+			fetched[h] = t1
+		}
+		messages += len(state.Messages)
+		if !stateResponse.Truncated {
+			break
+		}
+		fetch.ChunkIndex++
+	}
+	require.NotZero(fetch.ChunkIndex)
+	require.Equal(t1s, fetched)
+	require.Equal(10, messages)
+
+	// the whole state is sent when there is no length limit
+	fetch.ChunkIndex = 0
+	response, err := server.ProcessQuery(fetch)
+	require.NoError(err)
+	require.False(response.(*commands.StateResponse).Truncated)
+
+	// the state persists across restarts
+	server.Halt()
+	server = newTestServer(t, stateFilePath)
+	defer server.Halt()
+	stats, err := server.store.stats(epoch)
+	require.NoError(err)
+	require.Equal(&EpochStats{T1s: 20, T2s: 10, Size: 20*crypto.Type1MessageSize + 10*crypto.Type2MessageSize}, stats)
+}
+
+func TestServerFetchStateGrowth(t *testing.T) {
+	require := require.New(t)
+
+	server := newTestServer(t, filepath.Join(t.TempDir(), "statefile"))
+	defer server.Halt()
+	epoch, _, _ := server.epochClock.Now()
+
+	t1 := sendT1(t, server, epoch)
+	t1Hash := sha256.Sum256(t1)
+	state, _, err := server.store.fetch(epoch, t1Hash, 0, 0, 0)
+	require.NoError(err)
+
+	// the database is remapped as it grows, which must not affect the
+	// state fetched before
+	payload := make([]byte, 64*1024)
+	for i := 0; i < 64; i++ {
+		_, err = rand.Reader.Read(payload)
+		require.NoError(err)
+		require.NoError(server.store.appendT1(epoch, payload))
+	}
+	require.Equal(map[[32]byte][]byte{t1Hash: t1}, state.T1Map)
+	_, err = state.Marshal()
+	require.NoError(err)
+}
+
+func TestServerMaxEpochSize(t *testing.T) {
+	require := require.New(t)
+
+	server := newTestServer(t, filepath.Join(t.TempDir(), "statefile"), WithMaxEpochSize(2*crypto.Type1MessageSize))
+	defer server.Halt()
+	epoch, _, _ := server.epochClock.Now()
+
+	t1 := sendT1(t, server, epoch)
+
+	// a duplicate T1 is an error
+	_, err := server.ProcessQuery(&commands.SendT1{Epoch: epoch, Payload: t1})
+	require.Error(err)
+
+	sendT1(t, server, epoch)
+	response, err := server.ProcessQuery(&commands.SendT1{Epoch: epoch, Payload: make([]byte, crypto.Type1MessageSize)})
+	require.NoError(err)
+	require.EqualValues(commands.ResponseEpochFull, response.(*commands.MessageResponse).ErrorCode)
+
+	// messages for epochs which are not stored are errors
+	_, err = server.ProcessQuery(&commands.SendT1{Epoch: epoch + 5, Payload: t1})
+	require.Error(err)
+}
+
+func TestServerEpochs(t *testing.T) {
+	require := require.New(t)
+
+	server := newTestServer(t, filepath.Join(t.TempDir(), "statefile"))
+	defer server.Halt()
+	epoch, _, _ := server.epochClock.Now()
+
+	// stale epochs are removed
+	require.NoError(server.store.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket([]byte(epochsBucket)).CreateBucket(epochKey(epoch - 5))
+		return err
+	}))
+	require.NoError(server.store.updateEpochs(server.epochClock))
+	epochs, err := server.store.epochs()
+	require.NoError(err)
+	require.Contains(epochs, epoch)
+	require.NotContains(epochs, epoch-5)
+
+	sendT1(t, server, epoch)
+	server.updateMetrics()
+	require.True(server.observed[epoch])
+}
+
+func TestServerLegacyStatefile(t *testing.T) {
+	require := require.New(t)
+
+	// The legacy statefile is a CBOR map, which bbolt cannot open.
+	stateFilePath := filepath.Join(t.TempDir(), "statefile")
+	legacy, err := cbor.Marshal(map[string]interface{}{})
+	require.NoError(err)
+	require.NoError(os.WriteFile(stateFilePath, legacy, 0600))
+
+	server := newTestServer(t, stateFilePath)
+	epoch, _, _ := server.epochClock.Now()
+	sendT1(t, server, epoch)
+	server.Halt()
+
+	// The legacy statefile was moved aside, and the new one reopens.
+	b, err := os.ReadFile(stateFilePath + legacyStatefileSuffix)
+	require.NoError(err)
+	require.Equal(legacy, b)
+	server = newTestServer(t, stateFilePath)
+	defer server.Halt()
+	stats, err := server.store.stats(epoch)
+	require.NoError(err)
+	require.EqualValues(1, stats.T1s)
+}
@@ -21,13 +21,10 @@ import (
 	"container/list"
 	"crypto/sha256"
 	"errors"
-	"fmt"
 	"github.com/fxamacker/cbor/v2"
-	"os"
 	"sync"
 
 	"github.com/katzenpost/katzenpost/reunion/commands"
-	"github.com/katzenpost/katzenpost/reunion/epochtime"
 )
 
 // ReunionDatabase is an interface which represents the
@@ -199,191 +196,6 @@ func (s *SerializableReunionState) Marshal() ([]byte, error) {
 	return cbor.Marshal(s)
 }
 
-// SerializableReunionStates represents the serializable
-// form of the ReunionStates type.
-type SerializableReunionStates struct {
-	states map[uint64]*ReunionState
-}
-
-// Unmarshal deserializes the state CBOR blob.
-func (s *SerializableReunionStates) Unmarshal(data []byte) error {
-	return cbor.Unmarshal(data, s)
-}
-
-// Marshal returns a CBOR serialization of the state.
-func (s *SerializableReunionStates) Marshal() ([]byte, error) {
-	return cbor.Marshal(s)
-}
-
-// ReunionStates is a type encapsulating sync.Map of uint64 -> *ReunionState.
-type ReunionStates struct {
-	states *sync.Map // uint64 -> *ReunionState
-}
-
-// NewReunionStates creates a new ReunionStates.
-func NewReunionStates() *ReunionStates {
-	s := &ReunionStates{
-		states: new(sync.Map),
-	}
-	return s
-}
-
-// Marshal returns a CBOR serialization of the state.
-func (s *ReunionStates) Unmarshal(data []byte) error {
-	ss := new(SerializableReunionStates)
-	ss.states = make(map[uint64]*ReunionState)
-	err := cbor.Unmarshal(data, ss)
-	if err != nil {
-		return err
-	}
-	for k, v := range ss.states {
-		s.states.Store(k, v)
-	}
-	return nil
-}
-
-// Marshal returns a CBOR serialization of the state.
-func (s *ReunionStates) Marshal() ([]byte, error) {
-	ss := new(SerializableReunionStates)
-	ss.states = make(map[uint64]*ReunionState)
-	var err error
-	s.states.Range(func(k, v interface{}) bool {
-		key, ok := k.(uint64)
-		if !ok {
-			err = errors.New("invalid sync.Map entry")
-			return false
-		}
-		value, ok := v.(*ReunionState)
-		if !ok {
-			err = errors.New("invalid sync.Map entry")
-			return false
-		}
-		ss.states[key] = value
-		return true
-	})
-	if err != nil {
-		return nil, err
-	}
-	return cbor.Marshal(ss)
-}
-
-// MaybeAddEpochs adds sync.Map entries for the currenlty valid epochs.
-func (s *ReunionStates) MaybeAddEpochs(epochClock epochtime.EpochClock) {
-	epoch, elapsed, till := epochClock.Now()
-	_, _ = s.states.LoadOrStore(epoch, NewReunionState())
-	if till <= epochGracePeriod {
-		_, _ = s.states.LoadOrStore(epoch-1, NewReunionState())
-	} else {
-		if elapsed <= epochGracePeriod {
-			_, _ = s.states.LoadOrStore(epoch+1, NewReunionState())
-		}
-	}
-}
-
-// GarbageCollectOldEpochs remove old epochs from our epochs sync.Map.
-func (s *ReunionStates) GarbageCollectOldEpochs(epochClock epochtime.EpochClock) {
-	epoch, elapsed, till := epochClock.Now()
-	validEpochs := make(map[uint64]bool)
-	validEpochs[epoch] = true
-	if till <= epochGracePeriod {
-		validEpochs[epoch-1] = true
-	} else {
-		if elapsed <= epochGracePeriod {
-			validEpochs[epoch+1] = true
-		}
-	}
-	s.states.Range(func(key, value interface{}) bool {
-		k, ok := key.(uint64)
-		if !ok {
-			panic("impossible error")
-		}
-		if _, ok := validEpochs[k]; !ok {
-			s.states.Delete(k)
-		}
-		return true
-	})
-}
-
-// LoadFromFile loads a ReunionStates from then given file
-// if it exists.
-func (s *ReunionStates) LoadFromFile(filePath string) error {
-	inBytes, err := os.ReadFile(filePath)
-	if err != nil {
-		return err
-	}
-	return s.Unmarshal(inBytes)
-}
-
-// AtomicWriteToFile atomically writes our state to the file.
-func (s *ReunionStates) AtomicWriteToFile(filePath string) error {
-	out, err := os.OpenFile(filePath+".tmp", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		return err
-	}
-	outBytes, err := s.Marshal()
-	if err != nil {
-		return err
-	}
-	_, err = out.Write(outBytes)
-	if err != nil {
-		return err
-	}
-	if err := os.Remove(filePath + "~"); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	if err := os.Rename(filePath, filePath+"~"); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	if err := os.Rename(filePath+".tmp", filePath); err != nil {
-		return err
-	}
-	if err := os.Remove(filePath + "~"); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	return nil
-}
-
-// GetStateFromEpoch returns a state given an epoch if such an entry
-// if found in the sync.Map.
-func (s *ReunionStates) GetStateFromEpoch(epoch uint64) (*ReunionState, error) {
-	rawState, ok := s.states.Load(epoch)
-	if !ok {
-		return nil, fmt.Errorf("epoch %d not found in state map", epoch)
-	}
-	state, ok := rawState.(*ReunionState)
-	if !ok {
-		return nil, errors.New("Bug, invalid state found in epochs sync.Map")
-	}
-	return state, nil
-}
-
-// AppendMessage receives a message which can be one of these types:
-// *commands.SendT1
-// *commands.SendT2
-// *commands.SendT3
-func (s *ReunionStates) AppendMessage(message commands.Command) error {
-	var epoch uint64
-	switch mesg := message.(type) {
-	case *commands.SendT1:
-		epoch = mesg.Epoch
-	case *commands.SendT2:
-		epoch = mesg.Epoch
-	case *commands.SendT3:
-		epoch = mesg.Epoch
-	default:
-		return errors.New("ReunionStates.AppendMessage failued: unknown message type")
-	}
-	rawState, ok := s.states.Load(epoch)
-	if ok {
-		state, ok := rawState.(*ReunionState)
-		if !ok {
-			return errors.New("Bug, invalid state found in epochs sync.Map")
-		}
-		return state.AppendMessage(message)
-	}
-	return fmt.Errorf("AppendMessage failure, %d epoch not found in sync.Map", epoch)
-}
-
 // ReunionState is the state of the Reunion DB.
 // This is the type which is fetched by the FetchState
 // command.
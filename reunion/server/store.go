@@ -0,0 +1,396 @@
+// store.go - Reunion server storage.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/katzenpost/katzenpost/reunion/epochtime"
+)
+
+const (
+	storeVersion = 0
+
+	metadataBucket = "metadata"
+	versionKey     = "version"
+	epochsBucket   = "epochs"
+
+	t1Bucket       = "t1"
+	t1HashesBucket = "t1Hashes"
+	messagesBucket = "messages"
+	epochMetaKey   = "meta"
+
+	// legacyStatefileSuffix is appended to the name of a legacy
+	// statefile when it is moved aside.
+	legacyStatefileSuffix = ".legacy"
+)
+
+var (
+	errEpochNotFound = errors.New("epoch not found")
+	errEpochFull     = errors.New("epoch reached its size limit")
+	errT1Exists      = errors.New("cannot append T1, already present")
+	errT1NotFound    = errors.New("T1 hash not found")
+)
+
+// EpochStats are the number of messages and bytes stored for an epoch.
+type EpochStats struct {
+	T1s  uint64
+	T2s  uint64
+	T3s  uint64
+	Size uint64
+}
+
+// boltStore is the Reunion DB state stored in a bbolt database, with
+// a bucket for each epoch holding its T1 messages in the order they were
+// received, and for each T1 hash, the T2 and T3 messages replying to it.
+type boltStore struct {
+	db *bolt.DB
+
+	// maxEpochSize is the maximum number of message bytes stored
+	// for an epoch, or zero for no limit.
+	maxEpochSize uint64
+}
+
+// migrateLegacyStatefile moves aside the statefile written by the servers
+// predating the bbolt storage, and reports whether it did. That file held
+// a CBOR encoding of the epoch states which carried none of the messages,
+// as the fields of the states were not exported, so nothing is lost by
+// starting a new database in its place.
+func migrateLegacyStatefile(filePath string) (bool, error) {
+	b, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// A bbolt database, which starts with a page header, never decodes
+	// as a single CBOR map.
+	var legacy map[interface{}]interface{}
+	if cbor.Unmarshal(b, &legacy) != nil {
+		return false, nil
+	}
+	if err = os.Rename(filePath, filePath+legacyStatefileSuffix); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func newBoltStore(filePath string, maxEpochSize uint64) (*boltStore, error) {
+	db, err := bolt.Open(filePath, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reunion storage: failed to open '%v': %v", filePath, err)
+	}
+	s := &boltStore{
+		db:           db,
+		maxEpochSize: maxEpochSize,
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(epochsBucket)); err != nil {
+			return err
+		}
+		if b := meta.Get([]byte(versionKey)); b != nil {
+			if len(b) != 1 || b[0] != storeVersion {
+				return fmt.Errorf("reunion storage: incompatible version: %d", uint(b[0]))
+			}
+			return nil
+		}
+		return meta.Put([]byte(versionKey), []byte{storeVersion})
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
+
+func epochKey(epoch uint64) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], epoch)
+	return k[:]
+}
+
+func sequenceKey(seq uint64) []byte {
+	return epochKey(seq)
+}
+
+// validEpochs returns the epochs for which clients may send messages: the
+// current epoch, and the previous or next one near the epoch boundaries.
+func validEpochs(epochClock epochtime.EpochClock) map[uint64]bool {
+	epoch, elapsed, till := epochClock.Now()
+	valid := map[uint64]bool{epoch: true}
+	if till <= epochGracePeriod {
+		valid[epoch-1] = true
+	} else if elapsed <= epochGracePeriod {
+		valid[epoch+1] = true
+	}
+	return valid
+}
+
+// updateEpochs creates the buckets of the valid epochs and removes the
+// buckets of the other epochs.
+func (s *boltStore) updateEpochs(epochClock epochtime.EpochClock) error {
+	valid := validEpochs(epochClock)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		epochs := tx.Bucket([]byte(epochsBucket))
+		stale := [][]byte{}
+		err := epochs.ForEach(func(k, v []byte) error {
+			if len(k) != 8 || !valid[binary.BigEndian.Uint64(k)] {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := epochs.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		for epoch := range valid {
+			epochBucket, err := epochs.CreateBucketIfNotExists(epochKey(epoch))
+			if err != nil {
+				return err
+			}
+			for _, name := range []string{t1Bucket, t1HashesBucket, messagesBucket} {
+				if _, err := epochBucket.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// epochs returns the epochs which have a bucket.
+func (s *boltStore) epochs() ([]uint64, error) {
+	epochs := []uint64{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(epochsBucket)).ForEach(func(k, v []byte) error {
+			epochs = append(epochs, binary.BigEndian.Uint64(k))
+			return nil
+		})
+	})
+	return epochs, err
+}
+
+func getStats(epochBucket *bolt.Bucket) (*EpochStats, error) {
+	stats := new(EpochStats)
+	if b := epochBucket.Get([]byte(epochMetaKey)); b != nil {
+		if err := cbor.Unmarshal(b, stats); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+func putStats(epochBucket *bolt.Bucket, stats *EpochStats) error {
+	b, err := cbor.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return epochBucket.Put([]byte(epochMetaKey), b)
+}
+
+// stats returns the number of messages and bytes stored for the epoch.
+func (s *boltStore) stats(epoch uint64) (*EpochStats, error) {
+	var stats *EpochStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		epochBucket := tx.Bucket([]byte(epochsBucket)).Bucket(epochKey(epoch))
+		if epochBucket == nil {
+			return errEpochNotFound
+		}
+		var err error
+		stats, err = getStats(epochBucket)
+		return err
+	})
+	return stats, err
+}
+
+// update runs fn in a transaction with the bucket of the epoch and its
+// stats, after checking that size more bytes fit in the epoch.
+func (s *boltStore) update(epoch uint64, size int, fn func(epochBucket *bolt.Bucket, stats *EpochStats) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		epochBucket := tx.Bucket([]byte(epochsBucket)).Bucket(epochKey(epoch))
+		if epochBucket == nil {
+			return errEpochNotFound
+		}
+		stats, err := getStats(epochBucket)
+		if err != nil {
+			return err
+		}
+		if s.maxEpochSize != 0 && stats.Size+uint64(size) > s.maxEpochSize {
+			return errEpochFull
+		}
+		stats.Size += uint64(size)
+		if err = fn(epochBucket, stats); err != nil {
+			return err
+		}
+		return putStats(epochBucket, stats)
+	})
+}
+
+// appendT1 stores a T1 message.
+func (s *boltStore) appendT1(epoch uint64, payload []byte) error {
+	t1Hash := sha256.Sum256(payload)
+	return s.update(epoch, len(payload), func(epochBucket *bolt.Bucket, stats *EpochStats) error {
+		hashes := epochBucket.Bucket([]byte(t1HashesBucket))
+		if hashes.Get(t1Hash[:]) != nil {
+			return errT1Exists
+		}
+		t1s := epochBucket.Bucket([]byte(t1Bucket))
+		seq, err := t1s.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err = t1s.Put(sequenceKey(seq), payload); err != nil {
+			return err
+		}
+		stats.T1s++
+		return hashes.Put(t1Hash[:], sequenceKey(seq))
+	})
+}
+
+// appendMessage stores a T2 or T3 message replying to the T1 message
+// with the hash dstT1Hash.
+func (s *boltStore) appendMessage(epoch uint64, dstT1Hash [sha256.Size]byte, message *T2T3Message) error {
+	b, err := cbor.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return s.update(epoch, len(message.T2Payload)+len(message.T3Payload), func(epochBucket *bolt.Bucket, stats *EpochStats) error {
+		messages, err := epochBucket.Bucket([]byte(messagesBucket)).CreateBucketIfNotExists(dstT1Hash[:])
+		if err != nil {
+			return err
+		}
+		seq, err := messages.NextSequence()
+		if err != nil {
+			return err
+		}
+		if len(message.T2Payload) > 0 {
+			stats.T2s++
+		} else {
+			stats.T3s++
+		}
+		return messages.Put(sequenceKey(seq), b)
+	})
+}
+
+// fetch returns a chunk of the state requested by the sender of the T1
+// message with the hash t1Hash: the chunk with the given index holds up
+// to t1sPerChunk T1 messages and messagesPerChunk T2 and T3 messages,
+// in the order they were received, or all of them if these are zero.
+// It also returns the number of chunks after this one.
+func (s *boltStore) fetch(epoch uint64, t1Hash [sha256.Size]byte, index uint32, t1sPerChunk, messagesPerChunk int) (*RequestedReunionState, uint32, error) {
+	state := &RequestedReunionState{
+		T1Map:    make(map[[32]byte][]byte),
+		Messages: []*T2T3Message{},
+	}
+	var left uint32
+	err := s.db.View(func(tx *bolt.Tx) error {
+		epochBucket := tx.Bucket([]byte(epochsBucket)).Bucket(epochKey(epoch))
+		if epochBucket == nil {
+			return errEpochNotFound
+		}
+		messages := epochBucket.Bucket([]byte(messagesBucket)).Bucket(t1Hash[:])
+		if messages == nil && epochBucket.Bucket([]byte(t1HashesBucket)).Get(t1Hash[:]) == nil {
+			return errT1NotFound
+		}
+
+		t1s := epochBucket.Bucket([]byte(t1Bucket))
+		err := readChunk(t1s, index, t1sPerChunk, func(v []byte) error {
+			// v is only valid for the lifetime of the transaction
+			state.T1Map[sha256.Sum256(v)] = append([]byte(nil), v...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		chunks := chunkCount(t1s.Sequence(), t1sPerChunk)
+		if messages != nil {
+			err = readChunk(messages, index, messagesPerChunk, func(v []byte) error {
+				message := new(T2T3Message)
+				if err := cbor.Unmarshal(v, message); err != nil {
+					return err
+				}
+				state.Messages = append(state.Messages, message)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if n := chunkCount(messages.Sequence(), messagesPerChunk); n > chunks {
+				chunks = n
+			}
+		}
+		if uint64(index)+1 < chunks {
+			left = uint32(chunks - uint64(index) - 1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return state, left, nil
+}
+
+// readChunk calls fn with the values of the chunk with the given index of
+// a bucket keyed by sequence numbers.
+func readChunk(b *bolt.Bucket, index uint32, perChunk int, fn func(v []byte) error) error {
+	c := b.Cursor()
+	if perChunk == 0 {
+		if index != 0 {
+			return nil
+		}
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	n := 0
+	for k, v := c.Seek(sequenceKey(uint64(index)*uint64(perChunk) + 1)); k != nil && n < perChunk; k, v = c.Next() {
+		if err := fn(v); err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
+
+// chunkCount returns the number of chunks holding n entries.
+func chunkCount(n uint64, perChunk int) uint64 {
+	if perChunk == 0 {
+		return 1
+	}
+	return (n + uint64(perChunk) - 1) / uint64(perChunk)
+}
@@ -25,6 +25,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/katzenpost/katzenpost/core/metrics"
 	"github.com/katzenpost/katzenpost/reunion/commands"
 	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
 	"github.com/katzenpost/katzenpost/reunion/server"
@@ -62,8 +63,8 @@ func httpReunionServerFactory(s *server.Server, log *logging.Logger) func(w http
 	}
 }
 
-func runHTTPServer(address, urlPath, logPath, logLevel string, clock *katzenpost.Clock, stateFilePath string) (*http.Server, *server.Server, error) {
-	reunionServer, err := server.NewServer(clock, stateFilePath, logPath, logLevel)
+func runHTTPServer(address, urlPath, logPath, logLevel string, clock *katzenpost.Clock, stateFilePath string, opts ...server.ServerOption) (*http.Server, *server.Server, error) {
+	reunionServer, err := server.NewServer(clock, stateFilePath, logPath, logLevel, opts...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -88,17 +89,24 @@ func main() {
 	logLevel := flag.String("level", "DEBUG", "Log level.")
 	stateFilePath := flag.String("s", "statefile", "State file path.")
 	epochClockName := flag.String("epochClock", "katzenpost", "The epoch-clock to use.")
+	maxEpochSize := flag.Uint64("max_epoch_size", 0, "Maximum number of message bytes stored for each epoch. Default no limit.")
+	metricsAddress := flag.String("metrics", "", "Prometheus metrics listen address. Default disabled.")
 	flag.Parse()
 	if *epochClockName != "katzenpost" {
 		panic("Thus far only the Katzenpost epoch clock is supported in this server implementation.")
 	}
-	_, server, err := runHTTPServer(*address, *urlPath, *logPath, *logLevel, new(katzenpost.Clock), *stateFilePath)
+	_, reunionServer, err := runHTTPServer(*address, *urlPath, *logPath, *logLevel, new(katzenpost.Clock), *stateFilePath, server.WithMaxEpochSize(*maxEpochSize))
 	if err != nil {
 		panic(err)
 	}
+	if *metricsAddress != "" {
+		if _, err = metrics.StartListener(*metricsAddress, reunionServer.GetNewLogger("reunion_metrics")); err != nil {
+			panic(err)
+		}
+	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	<-sigs
-	server.Halt()
+	reunionServer.Halt()
 }
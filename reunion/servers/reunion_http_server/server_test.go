@@ -41,7 +41,7 @@ func TestHTTPServer2(t *testing.T) {
 	require.NoError(err)
 	stateFile.Close()
 
-	_, reunionServer, err := runHTTPServer(address, urlPath, logPath, logLevel, clock, stateFile.Name())
+	httpServer, reunionServer, err := runHTTPServer(address, urlPath, logPath, logLevel, clock, stateFile.Name())
 	require.NoError(err)
 
 	epoch, _, _ := clock.Now()
@@ -116,6 +116,7 @@ func TestHTTPServer2(t *testing.T) {
 	require.Equal(aliceResult, bobPayload)
 	require.Equal(bobResult, alicePayload)
 
+	httpServer.Close()
 	reunionServer.Halt()
 }
 
@@ -131,7 +132,7 @@ func TestHTTPServer3(t *testing.T) {
 	require.NoError(err)
 	stateFile.Close()
 
-	_, reunionServer, err := runHTTPServer(address, urlPath, logPath, logLevel, clock, stateFile.Name())
+	httpServer, reunionServer, err := runHTTPServer(address, urlPath, logPath, logLevel, clock, stateFile.Name())
 	require.NoError(err)
 
 	epoch, _, _ := clock.Now()
@@ -257,5 +258,6 @@ func TestHTTPServer3(t *testing.T) {
 	require.Equal(nsaResult, gchqPayload)
 	require.Equal(gchqResult, nsaPayload)
 
+	httpServer.Close()
 	reunionServer.Halt()
 }
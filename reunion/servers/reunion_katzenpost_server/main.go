@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/katzenpost/katzenpost/core/metrics"
 	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
 	"github.com/katzenpost/katzenpost/reunion/server"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
@@ -39,23 +40,29 @@ func main() {
 	logLevel := flag.String("log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
 	stateFilePath := flag.String("s", "statefile", "State file path.")
 	epochClockName := flag.String("epochClock", "katzenpost", "The epoch-clock to use.")
+	maxEpochSize := flag.Uint64("max_epoch_size", 0, "Maximum number of message bytes stored for each epoch. Default no limit.")
+	metricsAddress := flag.String("metrics", "", "Prometheus metrics listen address. Default disabled.")
 	flag.Parse()
 
 	if *epochClockName != "katzenpost" {
 		panic("Thus far only the Katzenpost epoch clock is supported in this server implementation.")
 	}
-
 	// start service
 	tmpDir, err := os.MkdirTemp("", "reunion_server")
 	if err != nil {
 		panic(err)
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.reunion.socket", os.Getpid()))
-	reunionServer, err := server.NewServer(new(katzenpost.Clock), *stateFilePath, *logPath, *logLevel)
+	reunionServer, err := server.NewServer(new(katzenpost.Clock), *stateFilePath, *logPath, *logLevel, server.WithMaxEpochSize(*maxEpochSize))
 
 	if err != nil {
 		panic(err)
 	}
+	if *metricsAddress != "" {
+		if _, err = metrics.StartListener(*metricsAddress, reunionServer.GetNewLogger("reunion_metrics")); err != nil {
+			panic(err)
+		}
+	}
 
 	var server *cborplugin.Server
 	server = cborplugin.NewServer(reunionServer.GetNewLogger("reunion_cbor_listener"), socketFile, new(cborplugin.RequestFactory), reunionServer)
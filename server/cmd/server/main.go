@@ -88,10 +88,13 @@ func main() {
 		svr.Shutdown()
 	}()
 
-	// Rotate server logs upon SIGHUP.
+	// Rotate server logs and reload the configuration upon SIGHUP.
 	go func() {
-		<-rotateCh
-		svr.RotateLog()
+		for range rotateCh {
+			svr.RotateLog()
+			// Failures are logged, and leave the running configuration as is.
+			svr.ReloadConfigFile()
+		}
 	}()
 
 	// Wait for the server to explode or be terminated.
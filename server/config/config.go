@@ -102,6 +102,11 @@ type Server struct {
 
 	// IsProvider specifies if the server is a provider (vs a mix).
 	IsProvider bool
+
+	// LoadWeight is the load balancing weight advertised to the PKI,
+	// relative to pki.DefaultLoadWeight. Nodes with more capacity should
+	// advertise a higher weight.
+	LoadWeight uint8
 }
 
 func (sCfg *Server) validate() error {
@@ -355,6 +360,21 @@ type SQLDB struct {
 	//
 	//  - pgx: https://godoc.org/github.com/jackc/pgx#ParseConnectionString
 	DataSourceName string
+
+	// SpoolOnly is set to true iff the database will only be used for the
+	// spool (and not the user database).  It only takes effect when the
+	// server creates the database schema.
+	SpoolOnly bool
+
+	// MaxConnections is the maximum number of pooled database connections.
+	// If left unset, twice the number of provider workers (and at least 5)
+	// will be used.
+	MaxConnections int
+
+	// AcquireTimeout is the maximum time in milliseconds to wait for a
+	// pooled connection when all connections are busy, 0 (forever) by
+	// default.
+	AcquireTimeout int
 }
 
 func (sCfg *SQLDB) validate() error {
@@ -366,6 +386,12 @@ func (sCfg *SQLDB) validate() error {
 	if sCfg.DataSourceName == "" {
 		return fmt.Errorf("config: SQLDB: DataSourceName '%v' is invalid", sCfg.DataSourceName)
 	}
+	if sCfg.MaxConnections < 0 || sCfg.MaxConnections == 1 {
+		return fmt.Errorf("config: SQLDB: MaxConnections %v is invalid", sCfg.MaxConnections)
+	}
+	if sCfg.AcquireTimeout < 0 {
+		return fmt.Errorf("config: SQLDB: AcquireTimeout %v is invalid", sCfg.AcquireTimeout)
+	}
 	return nil
 }
 
@@ -404,6 +430,55 @@ type SpoolDB struct {
 
 	// BoltDB backed spool (`bolt`).
 	Bolt *BoltSpoolDB
+
+	// MaxMessagesPerUser is the maximum number of messages in each user's
+	// spool, 0 (unlimited) by default.
+	MaxMessagesPerUser int
+
+	// MaxBytesPerUser is the maximum total size of the messages in each
+	// user's spool in bytes, 0 (unlimited) by default.
+	MaxBytesPerUser int
+
+	// MessageTTL is the number of seconds a message is retained in a
+	// user's spool, 0 (forever) by default.
+	MessageTTL int
+
+	// QuotaPolicy is what happens to a new message that would exceed a
+	// user's quota, either `reject` (the default) to discard the new
+	// message, or `drop_oldest` to discard the oldest spooled messages.
+	QuotaPolicy string
+}
+
+const (
+	// QuotaPolicyReject discards new messages that exceed a user's quota.
+	QuotaPolicyReject = "reject"
+
+	// QuotaPolicyDropOldest discards the oldest spooled messages to make
+	// room for new messages that exceed a user's quota.
+	QuotaPolicyDropOldest = "drop_oldest"
+)
+
+// HasQuota returns true iff any per-user spool limit is configured.
+func (sCfg *SpoolDB) HasQuota() bool {
+	return sCfg.MaxMessagesPerUser > 0 || sCfg.MaxBytesPerUser > 0 || sCfg.MessageTTL > 0
+}
+
+func (sCfg *SpoolDB) validate() error {
+	if sCfg.MaxMessagesPerUser < 0 {
+		return fmt.Errorf("config: Provider: SpoolDB MaxMessagesPerUser %v is invalid", sCfg.MaxMessagesPerUser)
+	}
+	if sCfg.MaxBytesPerUser < 0 {
+		return fmt.Errorf("config: Provider: SpoolDB MaxBytesPerUser %v is invalid", sCfg.MaxBytesPerUser)
+	}
+	if sCfg.MessageTTL < 0 {
+		return fmt.Errorf("config: Provider: SpoolDB MessageTTL %v is invalid", sCfg.MessageTTL)
+	}
+	switch sCfg.QuotaPolicy {
+	case QuotaPolicyReject, QuotaPolicyDropOldest:
+	default:
+		return fmt.Errorf("config: Provider: SpoolDB QuotaPolicy '%v' is invalid", sCfg.QuotaPolicy)
+	}
+	return nil
 }
 
 // BoltSpoolDB is the BolTDB implementation of the spool.
@@ -526,6 +601,9 @@ func (pCfg *Provider) applyDefaults(sCfg *Server) {
 	if pCfg.SpoolDB.Backend == "" {
 		pCfg.SpoolDB.Backend = BackendBolt
 	}
+	if pCfg.SpoolDB.QuotaPolicy == "" {
+		pCfg.SpoolDB.QuotaPolicy = QuotaPolicyReject
+	}
 	switch pCfg.SpoolDB.Backend {
 	case BackendBolt:
 		if pCfg.SpoolDB.Bolt == nil {
@@ -583,9 +661,15 @@ func (pCfg *Provider) validate() error {
 		if pCfg.SQLDB == nil {
 			return fmt.Errorf("config: Provider: SpoolDB configured for an SQL backend without a SQLDB block")
 		}
+		if pCfg.EnableEphemeralClients {
+			return fmt.Errorf("config: Provider: EnableEphemeralClients is not supported by the SQL SpoolDB backend")
+		}
 	default:
 		return fmt.Errorf("config: Provider: Invalid SpoolDB Backend: '%v'", pCfg.SpoolDB.Backend)
 	}
+	if err := pCfg.SpoolDB.validate(); err != nil {
+		return err
+	}
 
 	capaMap := make(map[string]bool)
 	for _, v := range pCfg.Kaetzchen {
@@ -683,6 +767,22 @@ type Management struct {
 	// Path specifies the path to the manaagment interface socket.  If left
 	// empty it will use `management_sock` under the DataDir.
 	Path string
+
+	// HTTPAddress is the TCP address (ip:port) of the HTTP/JSON management
+	// interface.  If left empty, the HTTP/JSON interface is disabled.
+	HTTPAddress string
+
+	// HTTPAuthToken is the bearer token that every HTTP/JSON management
+	// request must carry.
+	HTTPAuthToken string
+
+	// HTTPTLSCertFile and HTTPTLSKeyFile are the PEM encoded certificate
+	// and private key files with which the HTTP/JSON management interface
+	// is served over TLS.  TLS is required unless HTTPAddress is a
+	// loopback address, as the HTTPAuthToken would otherwise be sent in
+	// the clear.
+	HTTPTLSCertFile string
+	HTTPTLSKeyFile  string
 }
 
 func (mCfg *Management) applyDefaults(sCfg *Server) {
@@ -692,6 +792,21 @@ func (mCfg *Management) applyDefaults(sCfg *Server) {
 }
 
 func (mCfg *Management) validate() error {
+	if mCfg.HTTPAddress != "" {
+		addrPort, err := netip.ParseAddrPort(mCfg.HTTPAddress)
+		if err != nil {
+			return fmt.Errorf("config: Management: HTTPAddress '%v' is invalid: %v", mCfg.HTTPAddress, err)
+		}
+		if mCfg.HTTPAuthToken == "" {
+			return errors.New("config: Management: HTTPAddress set without a HTTPAuthToken")
+		}
+		if (mCfg.HTTPTLSCertFile == "") != (mCfg.HTTPTLSKeyFile == "") {
+			return errors.New("config: Management: HTTPTLSCertFile and HTTPTLSKeyFile must both be set")
+		}
+		if mCfg.HTTPTLSCertFile == "" && !addrPort.Addr().IsLoopback() {
+			return fmt.Errorf("config: Management: HTTPAddress '%v' is not a loopback address and TLS is not configured", mCfg.HTTPAddress)
+		}
+	}
 	if !mCfg.Enable {
 		return nil
 	}
@@ -701,6 +816,30 @@ func (mCfg *Management) validate() error {
 	return nil
 }
 
+// DirectoryCache is the Katzenpost directory cache configuration, with
+// which the server re-serves the verified consensus documents it fetched
+// to clients, on behalf of the authorities.
+type DirectoryCache struct {
+	// Addresses are the IP address/port combinations that the server will
+	// bind to for the directory cache connections, which use the PKI wire
+	// protocol rather than the mix wire protocol.
+	Addresses []string
+}
+
+func (dCfg *DirectoryCache) validate() error {
+	if len(dCfg.Addresses) == 0 {
+		return errors.New("config: DirectoryCache: No Addresses specified")
+	}
+	for _, v := range dCfg.Addresses {
+		if u, err := url.Parse(v); err != nil {
+			return fmt.Errorf("config: DirectoryCache: Address '%v' is invalid: %v", v, err)
+		} else if u.Port() == "" {
+			return fmt.Errorf("config: DirectoryCache: Address '%v' is invalid: Must contain Port", v)
+		}
+	}
+	return nil
+}
+
 // Config is the top level Katzenpost server configuration.
 type Config struct {
 	Server         *Server
@@ -708,9 +847,19 @@ type Config struct {
 	Provider       *Provider
 	PKI            *PKI
 	Management     *Management
+	DirectoryCache *DirectoryCache
 	SphinxGeometry *geo.Geometry
 
 	Debug *Debug
+
+	// file is the path of the file the config was loaded from, if any.
+	file string
+}
+
+// File returns the path of the file the config was loaded from with
+// LoadFile, or the empty string.
+func (cfg *Config) File() string {
+	return cfg.file
 }
 
 // FixupAndValidate applies defaults to config entries and validates the
@@ -769,6 +918,11 @@ func (cfg *Config) FixupAndValidate() error {
 	if err := cfg.Management.validate(); err != nil {
 		return err
 	}
+	if cfg.DirectoryCache != nil {
+		if err := cfg.DirectoryCache.validate(); err != nil {
+			return err
+		}
+	}
 	cfg.Debug.applyDefaults()
 
 	cfg.Server.Identifier, err = idna.Lookup.ToASCII(cfg.Server.Identifier)
@@ -822,5 +976,10 @@ func LoadFile(f string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return Load(b)
+	cfg, err := Load(b)
+	if err != nil {
+		return nil, err
+	}
+	cfg.file = f
+	return cfg, nil
 }
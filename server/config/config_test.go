@@ -244,3 +244,27 @@ PublicKeyPem = "id_pub_key.pem"
 	_, err = json.Marshal(cfg)
 	require.NoError(err)
 }
+
+func TestManagementHTTPAddress(t *testing.T) {
+	require := require.New(t)
+
+	mCfg := &Management{
+		HTTPAddress:   "127.0.0.1:8081",
+		HTTPAuthToken: "long random secret",
+	}
+	require.NoError(mCfg.validate(), "loopback address without TLS")
+
+	mCfg.HTTPAddress = "[::1]:8081"
+	require.NoError(mCfg.validate(), "IPv6 loopback address without TLS")
+
+	for _, addr := range []string{"0.0.0.0:8081", "192.0.2.1:8081", "[::]:8081"} {
+		mCfg.HTTPAddress = addr
+		require.Error(mCfg.validate(), "non-loopback address %v without TLS", addr)
+	}
+
+	mCfg.HTTPTLSCertFile = "/etc/katzenpost/mgmt.crt"
+	require.Error(mCfg.validate(), "TLS certificate without a key")
+
+	mCfg.HTTPTLSKeyFile = "/etc/katzenpost/mgmt.key"
+	require.NoError(mCfg.validate(), "non-loopback address with TLS")
+}
@@ -22,7 +22,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/internal/constants"
@@ -60,7 +59,7 @@ func (w *Worker) doUnwrap(pkt *packet.Packet) error {
 
 	// Figure out the candidate mix private keys for this packet.
 	keys := make([]*mixkey.MixKey, 0, 2)
-	epoch, elapsed, till := epochtime.Now()
+	epoch, elapsed, till := w.glue.Clock().Now()
 	k, ok := w.mixKeys[epoch]
 	if !ok || k == nil {
 		// There always will be a key for the current epoch, since
@@ -142,7 +141,6 @@ func (w *Worker) worker() {
 	const absoluteMinimumDelay = 1 * time.Millisecond
 
 	isProvider := w.glue.Config().Server.IsProvider
-	unwrapSlack := time.Duration(w.glue.Config().Debug.UnwrapDelay) * time.Millisecond
 	defer w.derefKeys()
 
 	for {
@@ -170,6 +168,7 @@ func (w *Worker) worker() {
 
 		// Drop the packet if it has been sitting in the queue waiting to
 		// be unwrapped for way too long.
+		unwrapSlack := time.Duration(w.glue.Config().Debug.UnwrapDelay) * time.Millisecond
 		dwellTime := startAt.Sub(pkt.RecvAt)
 		if dwellTime > unwrapSlack {
 			w.log.Debugf("Dropping packet: %v (Spent %v waiting for Unwrap())", pkt.ID, dwellTime)
@@ -208,7 +207,7 @@ func (w *Worker) worker() {
 
 			// Check and adjust the delay for queue dwell time.
 			pkt.Delay = time.Duration(pkt.NodeDelay.Delay) * time.Millisecond
-			if pkt.Delay > constants.NumMixKeys*epochtime.Period {
+			if pkt.Delay > constants.NumMixKeys*w.glue.Clock().Period() {
 				w.log.Debugf("Dropping packet: %v (Delay %v is past what is possible)", pkt.ID, pkt.Delay)
 				instrument.PacketsDropped()
 				pkt.Dispose()
@@ -29,7 +29,6 @@ import (
 	"time"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/sphinx/commands"
@@ -145,7 +144,7 @@ func (d *decoy) worker() {
 				continue
 			}
 
-			now, _, _ := epochtime.Now()
+			now, _, _ := d.glue.Clock().Now()
 			if entEpoch := newEnt.Epoch(); entEpoch != now {
 				d.log.Debugf("Received PKI document for non-current epoch, ignoring: %v", entEpoch)
 				instrument.IgnoredPKIDocs()
@@ -163,7 +162,7 @@ func (d *decoy) worker() {
 			timerFired = true
 		}
 
-		now, _, _ := epochtime.Now()
+		now, _, _ := d.glue.Clock().Now()
 		if docCache == nil || docCache.Epoch() != now {
 			d.log.Debugf("Suspending operation till the next PKI document.")
 			wakeInterval = time.Duration(maxDuration)
@@ -246,21 +245,21 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 	d.makeSURBID(&surbID)
 
 	for attempts := 0; attempts < maxAttempts; attempts++ {
-		now := time.Now()
+		now := d.glue.Clock().Time()
 
-		fwdPath, then, err := path.New(d.rng, d.geo, doc, recipient, src, dst, &surbID, time.Now(), false, true)
+		fwdPath, then, err := path.NewWithClock(d.glue.Clock(), d.rng, d.geo, doc, recipient, src, dst, &surbID, now, false, true)
 		if err != nil {
 			d.log.Debugf("Failed to select forward path: %v", err)
 			return
 		}
 
-		revPath, then, err := path.New(d.rng, d.geo, doc, d.recipient, dst, src, &surbID, then, false, false)
+		revPath, then, err := path.NewWithClock(d.glue.Clock(), d.rng, d.geo, doc, d.recipient, dst, src, &surbID, then, false, false)
 		if err != nil {
 			d.log.Debugf("Failed to select reverse path: %v", err)
 			return
 		}
 
-		if deltaT := then.Sub(now); deltaT < epochtime.Period*2 {
+		if deltaT := then.Sub(now); deltaT < d.glue.Clock().Period()*2 {
 			zeroBytes := make([]byte, d.geo.UserForwardPayloadLength)
 			payload := make([]byte, 2, 2+d.geo.SURBLength+d.geo.UserForwardPayloadLength)
 			payload[0] = 1 // Packet has a SURB.
@@ -304,15 +303,15 @@ func (d *decoy) sendDiscardPacket(doc *pki.Document, recipient []byte, src, dst
 	payload := make([]byte, 2+d.geo.SURBLength+d.geo.UserForwardPayloadLength)
 
 	for attempts := 0; attempts < maxAttempts; attempts++ {
-		now := time.Now()
+		now := d.glue.Clock().Time()
 
-		fwdPath, then, err := path.New(d.rng, d.geo, doc, recipient, src, dst, nil, time.Now(), false, true)
+		fwdPath, then, err := path.NewWithClock(d.glue.Clock(), d.rng, d.geo, doc, recipient, src, dst, nil, now, false, true)
 		if err != nil {
 			d.log.Debugf("Failed to select forward path: %v", err)
 			return
 		}
 
-		if then.Sub(now) < epochtime.Period*2 {
+		if then.Sub(now) < d.glue.Clock().Period()*2 {
 			pkt, err := d.sphinx.NewPacket(rand.Reader, fwdPath, payload)
 			if err != nil {
 				d.log.Debugf("Failed to generate Sphinx packet: %v", err)
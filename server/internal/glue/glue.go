@@ -20,12 +20,14 @@ package glue
 
 import (
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/server/config"
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
 	"github.com/katzenpost/katzenpost/server/internal/mixkey"
 	"github.com/katzenpost/katzenpost/server/internal/packet"
 	"github.com/katzenpost/katzenpost/server/internal/pkicache"
@@ -40,8 +42,10 @@ type Glue interface {
 	IdentityKey() sign.PrivateKey
 	IdentityPublicKey() sign.PublicKey
 	LinkKey() wire.PrivateKey
+	Clock() epochtime.Clock
 
 	Management() *thwack.Server
+	HTTPManagement() *httpmgmt.Server
 	MixKeys() MixKeys
 	PKI() PKI
 	Provider() Provider
@@ -67,7 +71,9 @@ type PKI interface {
 	OutgoingDestinations() map[[constants.NodeIDLength]byte]*pki.MixDescriptor
 	AuthenticateConnection(*wire.PeerCredentials, bool) (*pki.MixDescriptor, bool, bool)
 	GetRawConsensus(uint64) ([]byte, error)
+	GetConsensusPayload(uint64, [pki.DiffBaseHashSize]byte, bool) (*pki.ConsensusPayload, error)
 	CurrentDocument() (*pki.Document, error)
+	RepublishDescriptor()
 }
 
 type Provider interface {
@@ -77,12 +83,15 @@ type Provider interface {
 	AuthenticateClient(*wire.PeerCredentials) bool
 	OnPacket(*packet.Packet)
 	KaetzchenForPKI() (map[string]map[string]interface{}, error)
+	ReconfigurePlugins([]*config.CBORPluginKaetzchen) (bool, error)
+	QueueLen() int
 }
 
 type Scheduler interface {
 	Halt()
 	OnNewMixMaxDelay(uint64)
 	OnPacket(*packet.Packet)
+	QueueLen() int
 }
 
 type Connector interface {
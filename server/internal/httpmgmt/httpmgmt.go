@@ -0,0 +1,243 @@
+// httpmgmt.go - HTTP/JSON management interface.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package httpmgmt provides an authenticated HTTP/JSON management
+// interface, exposing the same operations as the thwack text protocol.
+package httpmgmt
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+)
+
+// maxRequestSize is the maximum size of a request body.
+const maxRequestSize = 1 << 16
+
+// ErrNotFound is the error returned by handlers when the requested
+// object does not exist.
+var ErrNotFound = errors.New("not found")
+
+// StatusError is an error carrying the HTTP status code to reply with.
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// BadRequest returns a StatusError for a malformed request.
+func BadRequest(format string, a ...interface{}) error {
+	return &StatusError{
+		Status: http.StatusBadRequest,
+		Err:    fmt.Errorf(format, a...),
+	}
+}
+
+// HandlerFn is a request handler hook function.  The returned value is
+// serialized as the JSON reply body.  Errors are serialized as
+// `{"error": "..."}`, with the status from a StatusError, 404 for
+// ErrNotFound, or 500.
+type HandlerFn func(*http.Request) (interface{}, error)
+
+// Config is a Server configuration.
+type Config struct {
+	// Addr is the TCP address the server listens on.
+	Addr string
+
+	// AuthToken is the bearer token every request must carry.
+	AuthToken string
+
+	// TLSCertFile and TLSKeyFile are the PEM encoded certificate and
+	// private key files to serve TLS with.  If left empty, the Server
+	// serves plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Log is the Server's Logger.
+	Log *logging.Logger
+}
+
+// Server is a HTTP/JSON management server instance.
+type Server struct {
+	sync.WaitGroup
+
+	cfg      *Config
+	l        net.Listener
+	srv      *http.Server
+	handlers map[string]map[string]HandlerFn
+}
+
+// Start starts the Server's listener and starts serving requests.
+func (s *Server) Start() error {
+	var tlsConfig *tls.Config
+	if s.cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	var err error
+	s.l, err = net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		s.l = tls.NewListener(s.l, tlsConfig)
+	}
+	s.cfg.Log.Debugf("Listening on: %v", s.l.Addr())
+
+	s.srv = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.Add(1)
+	go func() {
+		defer s.Done()
+		if err := s.srv.Serve(s.l); err != http.ErrServerClosed {
+			s.cfg.Log.Errorf("Critical serve failure: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Addr returns the address the Server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// RegisterHandler sets the handler function for the specified method and
+// path.  This MUST NOT be called after the Server has been started with
+// Start().
+func (s *Server) RegisterHandler(method, path string, fn HandlerFn) {
+	if s.handlers[path] == nil {
+		s.handlers[path] = make(map[string]HandlerFn)
+	}
+	s.handlers[path][strings.ToUpper(method)] = fn
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const bearerPrefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearerPrefix) || subtle.ConstantTimeCompare([]byte(auth[len(bearerPrefix):]), []byte(s.cfg.AuthToken)) != 1 {
+		s.cfg.Log.Debugf("Unauthorized request: %v %v (%v)", r.Method, r.URL.Path, r.RemoteAddr)
+		writeJSON(w, http.StatusUnauthorized, errorReply(errors.New("unauthorized")))
+		return
+	}
+
+	s.cfg.Log.Debugf("Received request: %v %v", r.Method, r.URL.Path)
+
+	methods, ok := s.handlers[r.URL.Path]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorReply(ErrNotFound))
+		return
+	}
+	fn, ok := methods[r.Method]
+	if !ok {
+		writeJSON(w, http.StatusMethodNotAllowed, errorReply(errors.New("method not allowed")))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	resp, err := fn(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var sErr *StatusError
+		switch {
+		case errors.As(err, &sErr):
+			status = sErr.Status
+		case errors.Is(err, ErrNotFound):
+			status = http.StatusNotFound
+		default:
+			s.cfg.Log.Errorf("%v %v failed: %v", r.Method, r.URL.Path, err)
+		}
+		writeJSON(w, status, errorReply(err))
+		return
+	}
+	if resp == nil {
+		resp = struct{}{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Halt halts the Server.
+func (s *Server) Halt() {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+	s.Wait()
+	s.srv = nil
+}
+
+// DecodeRequest deserializes the JSON body of r into v.
+func DecodeRequest(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return BadRequest("invalid request: %v", err)
+	}
+	return nil
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func errorReply(err error) *errorResponse {
+	return &errorResponse{Error: err.Error()}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// New constructs a new Server, but does not start the listener.
+func New(cfg *Config) (*Server, error) {
+	if cfg.AuthToken == "" {
+		return nil, errors.New("httpmgmt: no AuthToken")
+	}
+	s := &Server{
+		cfg:      cfg,
+		handlers: make(map[string]map[string]HandlerFn),
+	}
+	return s, nil
+}
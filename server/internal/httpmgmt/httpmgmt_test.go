@@ -0,0 +1,200 @@
+// httpmgmt_test.go - HTTP/JSON management interface tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpmgmt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+const testToken = "correct horse battery staple"
+
+func doRequest(t *testing.T, s *Server, method, path, token, body string) (int, map[string]interface{}) {
+	url := fmt.Sprintf("http://%v%v", s.Addr(), path)
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	reply := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(b, &reply))
+	return resp.StatusCode, reply
+}
+
+func TestServer(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	_, err = New(&Config{Addr: "127.0.0.1:0"})
+	require.Error(err, "New() with no AuthToken")
+
+	s, err := New(&Config{
+		Addr:      "127.0.0.1:0",
+		AuthToken: testToken,
+		Log:       logBackend.GetLogger("httpmgmt_test"),
+	})
+	require.NoError(err)
+
+	type echoRequest struct {
+		Value string `json:"value"`
+	}
+	s.RegisterHandler(http.MethodPost, "/v1/echo", func(r *http.Request) (interface{}, error) {
+		req := new(echoRequest)
+		if err := DecodeRequest(r, req); err != nil {
+			return nil, err
+		}
+		switch req.Value {
+		case "missing":
+			return nil, ErrNotFound
+		case "fail":
+			return nil, errors.New("internal failure")
+		}
+		return req, nil
+	})
+	s.RegisterHandler(http.MethodGet, "/v1/empty", func(r *http.Request) (interface{}, error) {
+		return nil, nil
+	})
+	require.NoError(s.Start())
+	defer s.Halt()
+
+	// Authentication.
+	status, reply := doRequest(t, s, http.MethodGet, "/v1/empty", "", "")
+	require.Equal(http.StatusUnauthorized, status)
+	require.Equal("unauthorized", reply["error"])
+	status, _ = doRequest(t, s, http.MethodGet, "/v1/empty", "wrong", "")
+	require.Equal(http.StatusUnauthorized, status)
+
+	// Routing.
+	status, reply = doRequest(t, s, http.MethodGet, "/v1/empty", testToken, "")
+	require.Equal(http.StatusOK, status)
+	require.Empty(reply)
+	status, _ = doRequest(t, s, http.MethodGet, "/v1/nonexistent", testToken, "")
+	require.Equal(http.StatusNotFound, status)
+	status, _ = doRequest(t, s, http.MethodGet, "/v1/echo", testToken, "")
+	require.Equal(http.StatusMethodNotAllowed, status)
+
+	// Requests and replies.
+	status, reply = doRequest(t, s, http.MethodPost, "/v1/echo", testToken, `{"value": "hello"}`)
+	require.Equal(http.StatusOK, status)
+	require.Equal("hello", reply["value"])
+	status, reply = doRequest(t, s, http.MethodPost, "/v1/echo", testToken, `{"bogus": "hello"}`)
+	require.Equal(http.StatusBadRequest, status)
+	require.Contains(reply["error"], "invalid request")
+	status, _ = doRequest(t, s, http.MethodPost, "/v1/echo", testToken, `{"value": "`+strings.Repeat("A", maxRequestSize)+`"}`)
+	require.Equal(http.StatusBadRequest, status)
+
+	// Error mapping.
+	status, reply = doRequest(t, s, http.MethodPost, "/v1/echo", testToken, `{"value": "missing"}`)
+	require.Equal(http.StatusNotFound, status)
+	require.Equal(ErrNotFound.Error(), reply["error"])
+	status, reply = doRequest(t, s, http.MethodPost, "/v1/echo", testToken, `{"value": "fail"}`)
+	require.Equal(http.StatusInternalServerError, status)
+	require.Equal("internal failure", reply["error"])
+}
+
+func writeTestCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "mgmt.crt")
+	keyFile := filepath.Join(dir, "mgmt.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return cert, certFile, keyFile
+}
+
+func TestServerTLS(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	cert, certFile, keyFile := writeTestCertificate(t)
+	s, err := New(&Config{
+		Addr:        "127.0.0.1:0",
+		AuthToken:   testToken,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		Log:         logBackend.GetLogger("httpmgmt_test"),
+	})
+	require.NoError(err)
+	s.RegisterHandler(http.MethodGet, "/v1/empty", func(r *http.Request) (interface{}, error) {
+		return nil, nil
+	})
+	require.NoError(s.Start())
+	defer s.Halt()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%v/v1/empty", s.Addr()), nil)
+	require.NoError(err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := client.Do(req)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	// Plain HTTP requests are refused.
+	resp, err = http.Get(fmt.Sprintf("http://%v/v1/empty", s.Addr()))
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+}
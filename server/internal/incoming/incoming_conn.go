@@ -296,6 +296,13 @@ func (c *incomingConn) worker() {
 					return
 				}
 				continue
+			case *commands.GetConsensusDiff:
+				c.log.Debugf("Received GetConsensusDiff from peer.")
+				if err := c.onGetConsensusDiff(cmd); err != nil {
+					c.log.Debugf("Failed to handle GetConsensusDiff: %v", err)
+					return
+				}
+				continue
 			default:
 				// Probably a common command, like SendPacket.
 			}
@@ -345,6 +352,23 @@ func (c *incomingConn) onGetConsensus(cmd *commands.GetConsensus) error {
 	return c.w.SendCommand(respCmd)
 }
 
+func (c *incomingConn) onGetConsensusDiff(cmd *commands.GetConsensusDiff) error {
+	respCmd := &commands.ConsensusDiff{}
+	p, err := c.l.glue.PKI().GetConsensusPayload(cmd.Epoch, cmd.BaseHash, cmd.Compress)
+	switch err {
+	case nil:
+		respCmd.ErrorCode = commands.ConsensusOk
+		respCmd.IsDiff = p.IsDiff
+		respCmd.IsCompressed = p.IsCompressed
+		respCmd.Payload = p.Payload
+	case cpki.ErrNoDocument:
+		respCmd.ErrorCode = commands.ConsensusGone
+	default: // Covers errNotCached
+		respCmd.ErrorCode = commands.ConsensusNotFound
+	}
+	return c.w.SendCommand(respCmd)
+}
+
 func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 	advance := false
 	switch cmd.Sequence {
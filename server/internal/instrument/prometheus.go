@@ -5,12 +5,11 @@ package instrument
 
 import (
 	"fmt"
-	"net/http"
 
+	"github.com/katzenpost/katzenpost/core/metrics"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -158,40 +157,68 @@ var (
 		},
 		[]string{"epoch"},
 	)
+	spoolMessagesRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "katzenpost_spool_rejected_messages_total",
+			Help: "Number of messages rejected because they exceed the user's spool quota",
+		},
+	)
+	spoolMessagesDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "katzenpost_spool_dropped_messages_total",
+			Help: "Number of spooled messages dropped to make room for new messages",
+		},
+	)
+	spoolMessagesExpired = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "katzenpost_spool_expired_messages_total",
+			Help: "Number of spooled messages removed because they expired",
+		},
+	)
 )
 
+func register() {
+	metrics.Register(
+		deadlineBlownPacketsDropped,
+		incomingConns,
+		invalidPacketsDropped,
+		outgoingConns,
+		ingressQueueSize,
+		outgoingPacketsDropped,
+		packetsDropped,
+		packetsReplayed,
+		ignoredPKIDocs,
+		kaetzchenRequests,
+		kaetzchenPacketsDropped,
+		kaetzchenRequestsDropped,
+		kaetzchenRequestsDuration,
+		kaetzchenRequestsFailed,
+		mixPacketsDropped,
+		mixQueueSize,
+		pkiDocs,
+		cancelledOutgoingConns,
+		fetchedPKIDocs,
+		fetchedPKIDocsDuration,
+		failedFetchPKIDocs,
+		failedPKICacheGeneration,
+		invalidPKICache,
+		spoolMessagesRejected,
+		spoolMessagesDropped,
+		spoolMessagesExpired,
+	)
+}
+
 // StartPrometheusListener starts the Prometheus metrics TCP/HTTP Listener
 func StartPrometheusListener(glue glue.Glue) {
-
-	prometheus.MustRegister(deadlineBlownPacketsDropped)
-	prometheus.MustRegister(incomingConns)
-	prometheus.MustRegister(invalidPacketsDropped)
-	prometheus.MustRegister(outgoingConns)
-	prometheus.MustRegister(ingressQueueSize)
-	prometheus.MustRegister(outgoingPacketsDropped)
-	prometheus.MustRegister(packetsDropped)
-	prometheus.MustRegister(packetsReplayed)
-	prometheus.MustRegister(ignoredPKIDocs)
-	prometheus.MustRegister(kaetzchenRequests)
-	prometheus.MustRegister(kaetzchenPacketsDropped)
-	prometheus.MustRegister(kaetzchenRequestsDropped)
-	prometheus.MustRegister(kaetzchenRequestsDuration)
-	prometheus.MustRegister(kaetzchenRequestsFailed)
-	prometheus.MustRegister(mixPacketsDropped)
-	prometheus.MustRegister(mixQueueSize)
-	prometheus.MustRegister(pkiDocs)
-	prometheus.MustRegister(cancelledOutgoingConns)
-	prometheus.MustRegister(fetchedPKIDocs)
-	prometheus.MustRegister(fetchedPKIDocsDuration)
-	prometheus.MustRegister(failedFetchPKIDocs)
-	prometheus.MustRegister(failedPKICacheGeneration)
-	prometheus.MustRegister(invalidPKICache)
+	register()
 
 	metricsAddress := glue.Config().Server.MetricsAddress
 	if metricsAddress != "" {
 		// Expose registered metrics via HTTP
-		http.Handle("/metrics", promhttp.Handler())
-		go http.ListenAndServe(metricsAddress, nil)
+		log := glue.LogBackend().GetLogger("instrument")
+		if _, err := metrics.StartListener(metricsAddress, log); err != nil {
+			log.Errorf("Failed to start the metrics listener: %v", err)
+		}
 	}
 }
 
@@ -300,3 +327,18 @@ func FailedPKICacheGeneration(epoch string) {
 func InvalidPKICache(epoch string) {
 	invalidPKICache.With(prometheus.Labels{"epoch": epoch})
 }
+
+// SpoolMessagesRejected increments the counter for the number of messages rejected by the spool quota
+func SpoolMessagesRejected() {
+	spoolMessagesRejected.Inc()
+}
+
+// SpoolMessagesDropped increments the counter for the number of spooled messages dropped by the spool quota
+func SpoolMessagesDropped(n int) {
+	spoolMessagesDropped.Add(float64(n))
+}
+
+// SpoolMessagesExpired increments the counter for the number of expired spooled messages
+func SpoolMessagesExpired(n int) {
+	spoolMessagesExpired.Add(float64(n))
+}
@@ -85,3 +85,12 @@ func FailedPKICacheGeneration(epoch string) {}
 
 // InvalidPKICache increments the counter for the number of invalid cached PKI docs per epoch
 func InvalidPKICache(epoch string) {}
+
+// SpoolMessagesRejected increments the counter for the number of messages rejected by the spool quota
+func SpoolMessagesRejected() {}
+
+// SpoolMessagesDropped increments the counter for the number of spooled messages dropped by the spool quota
+func SpoolMessagesDropped(n int) {}
+
+// SpoolMessagesExpired increments the counter for the number of expired spooled messages
+func SpoolMessagesExpired(n int) {}
@@ -21,7 +21,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/internal/debug"
@@ -96,8 +95,8 @@ func (co *connector) DispatchPacket(pkt *packet.Packet) {
 
 func (co *connector) worker() {
 	var (
-		initialSpawnDelay = epochtime.Period / 64
-		resweepInterval   = epochtime.Period / 8
+		initialSpawnDelay = co.glue.Clock().Period() / 64
+		resweepInterval   = co.glue.Clock().Period() / 8
 	)
 
 	timer := time.NewTimer(initialSpawnDelay)
@@ -28,7 +28,6 @@ import (
 	"github.com/katzenpost/katzenpost/server/internal/instrument"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/wire"
@@ -99,8 +98,8 @@ func (c *outgoingConn) dispatchPacket(pkt *packet.Packet) {
 
 func (c *outgoingConn) worker() {
 	var (
-		retryIncrement = epochtime.Period / 64
-		maxRetryDelay  = epochtime.Period / 8
+		retryIncrement = c.co.glue.Clock().Period() / 64
+		maxRetryDelay  = c.co.glue.Clock().Period() / 8
 	)
 
 	defer func() {
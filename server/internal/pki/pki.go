@@ -24,12 +24,13 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"path/filepath"
 	"sync"
 	"time"
 
 	nClient "github.com/katzenpost/katzenpost/authority/nonvoting/client"
 	vClient "github.com/katzenpost/katzenpost/authority/voting/client"
-	vServer "github.com/katzenpost/katzenpost/authority/voting/server"
+	"github.com/katzenpost/katzenpost/authority/voting/schedule"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
@@ -43,28 +44,49 @@ import (
 )
 
 var (
-	errNotCached         = errors.New("pki: requested epoch document not in cache")
-	recheckInterval      = epochtime.Period / 32
-	WarpedEpoch          = "false"
-	pkiEarlyConnectSlack = epochtime.Period / 8
-	PublishDeadline      = vServer.MixPublishDeadline
-	nextFetchTill        = epochtime.Period - PublishDeadline
+	errNotCached = errors.New("pki: requested epoch document not in cache")
+	WarpedEpoch  = "false"
 )
 
+func (p *pki) recheckInterval() time.Duration {
+	return p.clock.Period() / 32
+}
+
+func (p *pki) pkiEarlyConnectSlack() time.Duration {
+	return p.clock.Period() / 8
+}
+
+// PublishDeadline returns the time into an epoch by which the descriptor
+// for the next epoch must be published.
+func PublishDeadline() time.Duration {
+	return schedule.MixPublishDeadline()
+}
+
+func (p *pki) publishDeadline() time.Duration {
+	return schedule.MixPublishDeadlineForPeriod(p.clock.Period())
+}
+
+func (p *pki) nextFetchTill() time.Duration {
+	return p.clock.Period() - p.publishDeadline()
+}
+
 type pki struct {
 	sync.RWMutex
 	worker.Worker
 
-	glue glue.Glue
-	log  *logging.Logger
+	glue  glue.Glue
+	log   *logging.Logger
+	clock epochtime.Clock
 
 	impl               cpki.Client
 	descAddrMap        map[cpki.Transport][]string
 	docs               map[uint64]*pkicache.Entry
 	rawDocs            map[uint64][]byte
+	consensusEncoder   *cpki.ConsensusEncoder
 	failedFetches      map[uint64]error
 	lastPublishedEpoch uint64
 	lastWarnedEpoch    uint64
+	republishCh        chan interface{}
 }
 
 func (p *pki) StartWorker() {
@@ -72,13 +94,11 @@ func (p *pki) StartWorker() {
 }
 
 func (p *pki) worker() {
-	var initialSpawnDelay = epochtime.Period / 64
+	var initialSpawnDelay = p.clock.Period() / 64
 
-	timer := time.NewTimer(initialSpawnDelay)
-	defer func() {
-		p.log.Debugf("Halting PKI worker.")
-		timer.Stop()
-	}()
+	wakeup := p.clock.NewTimer(initialSpawnDelay)
+	defer func() { wakeup.Stop() }()
+	defer p.log.Debugf("Halting PKI worker.")
 
 	if p.impl == nil {
 		p.log.Warningf("No implementation is configured, disabling PKI interface.")
@@ -108,20 +128,20 @@ func (p *pki) worker() {
 	var lastUpdateEpoch, lastMuMaxDelay, lastSendTokenDuration uint64
 
 	for {
-		var timerFired bool
 		select {
 		case <-p.HaltCh():
 			p.log.Debugf("Terminating gracefully.")
 			return
 		case <-pkiCtx.Done():
 			return
-		case <-timer.C:
-			timerFired = true
-		}
-		if !timerFired && !timer.Stop() {
-			<-timer.C
+		case <-wakeup.C:
+		case <-p.republishCh:
+			// Descriptors can not be changed once uploaded, so this only
+			// takes effect for the next epoch that is yet to be published.
+			if now, _, _ := p.clock.Now(); p.lastPublishedEpoch == now+1 {
+				p.log.Noticef("Descriptor for epoch %v already published, changes will be published for epoch %v.", now+1, now+2)
+			}
 		}
-
 		// Check to see if we need to publish the descriptor, and do so, along
 		// with all the key rotation bits.
 		err := p.publishDescriptorIfNeeded(pkiCtx)
@@ -144,7 +164,7 @@ func (p *pki) worker() {
 				continue
 			}
 
-			d, rawDoc, err := p.impl.Get(pkiCtx, epoch)
+			d, rawDoc, err := p.getDocument(pkiCtx, epoch)
 			if isCanceled() {
 				// Canceled mid-fetch.
 				return
@@ -197,7 +217,7 @@ func (p *pki) worker() {
 		// Internal component depend on network wide paramemters, and or the
 		// list of nodes.  Update if there is a new document for the current
 		// epoch.
-		if now, _, _ := epochtime.Now(); now != lastUpdateEpoch {
+		if now, _, _ := p.clock.Now(); now != lastUpdateEpoch {
 			if ent := p.entryForEpoch(now); ent != nil {
 				if newMuMaxDelay := ent.MuMaxDelay(); newMuMaxDelay != lastMuMaxDelay {
 					p.log.Debugf("Updating scheduler MuMaxDelay for epoch %v: %v", now, newMuMaxDelay)
@@ -222,36 +242,53 @@ func (p *pki) worker() {
 			}
 		}
 
-		p.updateTimer(timer)
+		wakeup.Stop()
+		wakeup = p.clock.NewTimer(p.nextWakeup())
 	}
 }
 
-// updateTimer is used by the worker loop to determine when next to wake and fetch.
-func (p *pki) updateTimer(timer *time.Timer) {
-	now, elapsed, till := epochtime.Now()
+// nextWakeup is used by the worker loop to determine when next to wake and fetch.
+// getDocument fetches the document for the epoch, as a diff against the
+// document of the previous epoch if possible.
+func (p *pki) getDocument(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	p.RLock()
+	base, ok := p.rawDocs[epoch-1]
+	p.RUnlock()
+	if dc, isDiffClient := p.impl.(cpki.DiffClient); ok && isDiffClient {
+		d, rawDoc, err := dc.GetDiff(ctx, epoch, base)
+		if err == nil || err == cpki.ErrNoDocument {
+			return d, rawDoc, err
+		}
+		p.log.Debugf("Failed to fetch PKI diff for epoch %v, fetching it in full: %v", epoch, err)
+	}
+	return p.impl.Get(ctx, epoch)
+}
+
+func (p *pki) nextWakeup() time.Duration {
+	now, elapsed, till := p.clock.Now()
 	p.log.Debugf("pki woke %v into epoch %v with %v remaining", elapsed, now, till)
 
 	// it's after the consensus publication deadline
-	if elapsed > vServer.PublishConsensusDeadline {
+	if elapsed > schedule.PublishConsensusDeadlineForPeriod(p.clock.Period()) {
 		p.log.Debugf("After deadline for next epoch publication")
 		if p.entryForEpoch(now+1) == nil {
-			p.log.Debugf("no document for %v yet, reset to %v", now+1, recheckInterval)
-			timer.Reset(recheckInterval)
+			p.log.Debugf("no document for %v yet, reset to %v", now+1, p.recheckInterval())
+			return p.recheckInterval()
 		} else {
 			interval := till
 			p.log.Debugf("document cached for %v, reset to %v", now+1, interval)
-			timer.Reset(interval)
+			return interval
 		}
 	} else {
 		p.log.Debugf("Not yet time for next epoch publication")
 		// no document for current epoch
 		if p.entryForEpoch(now) == nil {
-			p.log.Debugf("no document cached for current epoch %v, reset to %v", now, recheckInterval)
-			timer.Reset(recheckInterval)
+			p.log.Debugf("no document cached for current epoch %v, reset to %v", now, p.recheckInterval())
+			return p.recheckInterval()
 		} else {
-			interval := vServer.PublishConsensusDeadline - elapsed
-			p.log.Debugf("Document cached for current epoch %v, reset to %v", now, recheckInterval)
-			timer.Reset(interval)
+			interval := schedule.PublishConsensusDeadlineForPeriod(p.clock.Period()) - elapsed
+			p.log.Debugf("Document cached for current epoch %v, reset to %v", now, p.recheckInterval())
+			return interval
 		}
 	}
 }
@@ -291,7 +328,7 @@ func (p *pki) pruneFailures() {
 	p.Lock()
 	defer p.Unlock()
 
-	now, _, _ := epochtime.Now()
+	now, _, _ := p.clock.Now()
 
 	for epoch := range p.failedFetches {
 		// Be more aggressive about pruning failures than pruning documents,
@@ -303,7 +340,7 @@ func (p *pki) pruneFailures() {
 }
 
 func (p *pki) pruneDocuments() {
-	now, _, _ := epochtime.Now()
+	now, _, _ := p.clock.Now()
 
 	p.Lock()
 	defer p.Unlock()
@@ -322,7 +359,7 @@ func (p *pki) pruneDocuments() {
 
 func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 
-	epoch, _, till := epochtime.Now()
+	epoch, _, till := p.clock.Now()
 	doPublishEpoch := uint64(0)
 	switch p.lastPublishedEpoch {
 	case 0:
@@ -331,7 +368,7 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		doPublishEpoch = epoch
 	case epoch:
 		// Check the deadline for the next publication time.
-		if till > PublishDeadline {
+		if till > p.publishDeadline() {
 			p.log.Debugf("Within the publication time for epoch: %v", epoch+1)
 			doPublishEpoch = epoch + 1
 			break
@@ -370,11 +407,13 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		LinkKey:     p.glue.LinkKey().PublicKey(),
 		Addresses:   p.descAddrMap,
 		Epoch:       epoch,
+		LoadWeight:  p.glue.Config().Server.LoadWeight,
 	}
 	if p.glue.Config().Server.IsProvider {
 		// Only set the layer if the node is a provider.  Otherwise, nodes
 		// shouldn't be self assigning this.
 		desc.Provider = true
+		desc.ConsensusDiff = true
 
 		// Publish currently running Kaetzchen.
 		var err error
@@ -456,9 +495,9 @@ func (p *pki) entryForEpoch(epoch uint64) *pkicache.Entry {
 func (p *pki) documentsToFetch() []uint64 {
 
 	ret := make([]uint64, 0, constants.NumMixKeys+1)
-	now, _, till := epochtime.Now()
+	now, _, till := p.clock.Now()
 	start := now
-	if till < nextFetchTill {
+	if till < p.nextFetchTill() {
 		start = now + 1
 	}
 
@@ -480,10 +519,10 @@ func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry,
 	//
 	// Note: The ordering is important and should not be changed without
 	// changes to pki.AuthenticateConnection().
-	now, _, till := epochtime.Now()
+	now, _, till := p.clock.Now()
 	epochs := make([]uint64, 0, constants.NumMixKeys+1)
 	start := now
-	if till < pkiEarlyConnectSlack {
+	if till < p.pkiEarlyConnectSlack() {
 		// Allow connections to new nodes 30 mins in advance of an epoch
 		// transition.
 		start = now + 1
@@ -510,7 +549,7 @@ func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry,
 }
 
 func (p *pki) AuthenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (desc *cpki.MixDescriptor, canSend, isValid bool) {
-	var earlySendSlack = epochtime.Period / 8
+	var earlySendSlack = p.clock.Period() / 8
 
 	dirStr := "Incoming"
 	if isOutgoing {
@@ -624,7 +663,7 @@ func (p *pki) OutgoingDestinations() map[[sConstants.NodeIDLength]byte]*cpki.Mix
 }
 
 func (p *pki) CurrentDocument() (*cpki.Document, error) {
-	epoch, _, _ := epochtime.Now()
+	epoch, _, _ := p.clock.Now()
 	p.RLock()
 	defer p.RUnlock()
 	val, ok := p.docs[epoch]
@@ -634,6 +673,18 @@ func (p *pki) CurrentDocument() (*cpki.Document, error) {
 	return nil, cpki.ErrNoDocument
 }
 
+// RepublishDescriptor wakes the worker to publish a descriptor reflecting
+// the current configuration, if it is still possible to do so for the next
+// epoch.
+func (p *pki) RepublishDescriptor() {
+	// Like the connector's ForceUpdate, this uses a non-blocking write to a
+	// buffered channel, as the descriptor is regenerated from scratch.
+	select {
+	case p.republishCh <- true:
+	default:
+	}
+}
+
 func (p *pki) GetRawConsensus(epoch uint64) ([]byte, error) {
 	if ok, err := p.getFailedFetch(epoch); ok {
 		p.log.Debugf("GetRawConsensus failure: no cached PKI document for epoch %v: %v", epoch, err)
@@ -643,7 +694,7 @@ func (p *pki) GetRawConsensus(epoch uint64) ([]byte, error) {
 	defer p.RUnlock()
 	val, ok := p.rawDocs[epoch]
 	if !ok {
-		now, _, _ := epochtime.Now()
+		now, _, _ := p.clock.Now()
 		// Return cpki.ErrNoDocument if documents will never exist.
 		if epoch < now-1 {
 			return nil, cpki.ErrNoDocument
@@ -654,14 +705,31 @@ func (p *pki) GetRawConsensus(epoch uint64) ([]byte, error) {
 	return val, nil
 }
 
+// GetConsensusPayload returns the cached document for the epoch, as a diff
+// against the document of the previous epoch if the peer holds it, and
+// compressed if requested.
+func (p *pki) GetConsensusPayload(epoch uint64, baseHash [cpki.DiffBaseHashSize]byte, compress bool) (*cpki.ConsensusPayload, error) {
+	rawDoc, err := p.GetRawConsensus(epoch)
+	if err != nil {
+		return nil, err
+	}
+	p.RLock()
+	base := p.rawDocs[epoch-1]
+	p.RUnlock()
+	return p.consensusEncoder.Encode(rawDoc, base, baseHash, compress)
+}
+
 // New reuturns a new pki.
 func New(glue glue.Glue) (glue.PKI, error) {
 	p := &pki{
-		glue:          glue,
-		log:           glue.LogBackend().GetLogger("pki"),
-		docs:          make(map[uint64]*pkicache.Entry),
-		rawDocs:       make(map[uint64][]byte),
-		failedFetches: make(map[uint64]error),
+		glue:             glue,
+		log:              glue.LogBackend().GetLogger("pki"),
+		clock:            glue.Clock(),
+		docs:             make(map[uint64]*pkicache.Entry),
+		rawDocs:          make(map[uint64][]byte),
+		consensusEncoder: cpki.NewConsensusEncoder(),
+		failedFetches:    make(map[uint64]error),
+		republishCh:      make(chan interface{}, 1), // See RepublishDescriptor().
 	}
 
 	var err error
@@ -697,6 +765,7 @@ func New(glue glue.Glue) (glue.PKI, error) {
 			LinkKey:     glue.LinkKey(),
 			LogBackend:  glue.LogBackend(),
 			Authorities: glue.Config().PKI.Voting.Authorities,
+			StateFile:   filepath.Join(glue.Config().Server.DataDir, "authority_sets.cbor"),
 		}
 		p.impl, err = vClient.New(pkiCfg)
 		if err != nil {
@@ -0,0 +1,299 @@
+// pki_test.go - Katzenpost server PKI interface tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	cpki "github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/thwack"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/server/config"
+	"github.com/katzenpost/katzenpost/server/internal/constants"
+	"github.com/katzenpost/katzenpost/server/internal/glue"
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
+	"github.com/katzenpost/katzenpost/server/internal/mixkey"
+)
+
+// mockMixKeys keeps random public keys in place of mix keys, and prunes
+// them by the clock of the glue as the real ones are.
+type mockMixKeys struct {
+	sync.Mutex
+
+	glue glue.Glue
+	keys map[uint64][]byte
+}
+
+func (m *mockMixKeys) Halt() {}
+
+func (m *mockMixKeys) Generate(baseEpoch uint64) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	didGenerate := false
+	for e := baseEpoch; e < baseEpoch+constants.NumMixKeys; e++ {
+		if _, ok := m.keys[e]; ok {
+			continue
+		}
+		k := make([]byte, 32)
+		rand.Reader.Read(k)
+		m.keys[e] = k
+		didGenerate = true
+	}
+	return didGenerate, nil
+}
+
+func (m *mockMixKeys) Prune() bool {
+	epoch, _, _ := m.glue.Clock().Now()
+
+	m.Lock()
+	defer m.Unlock()
+
+	didPrune := false
+	for e := range m.keys {
+		if e < epoch-1 {
+			delete(m.keys, e)
+			didPrune = true
+		}
+	}
+	return didPrune
+}
+
+func (m *mockMixKeys) Get(epoch uint64) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	k, ok := m.keys[epoch]
+	return k, ok
+}
+
+func (m *mockMixKeys) Shadow(map[uint64]*mixkey.MixKey) {}
+
+func (m *mockMixKeys) epochs() map[uint64]bool {
+	m.Lock()
+	defer m.Unlock()
+
+	epochs := make(map[uint64]bool)
+	for e := range m.keys {
+		epochs[e] = true
+	}
+	return epochs
+}
+
+// mockPKIClient has no documents, and hands the posted descriptors to
+// the test.
+type mockPKIClient struct {
+	postCh chan *cpki.MixDescriptor
+}
+
+func (c *mockPKIClient) Get(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	return nil, nil, cpki.ErrNoDocument
+}
+
+func (c *mockPKIClient) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *cpki.MixDescriptor) error {
+	c.postCh <- d
+	return nil
+}
+
+func (c *mockPKIClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	return cpki.ParseDocument(raw)
+}
+
+type mockGlue struct {
+	sync.Mutex
+
+	cfg               *config.Config
+	logBackend        *log.Backend
+	identityKey       sign.PrivateKey
+	identityPublicKey sign.PublicKey
+	linkKey           wire.PrivateKey
+	clock             epochtime.Clock
+	mixKeys           glue.MixKeys
+	reshadows         int
+}
+
+func (g *mockGlue) Config() *config.Config {
+	return g.cfg
+}
+
+func (g *mockGlue) LogBackend() *log.Backend {
+	return g.logBackend
+}
+
+func (g *mockGlue) IdentityKey() sign.PrivateKey {
+	return g.identityKey
+}
+
+func (g *mockGlue) IdentityPublicKey() sign.PublicKey {
+	return g.identityPublicKey
+}
+
+func (g *mockGlue) LinkKey() wire.PrivateKey {
+	return g.linkKey
+}
+
+func (g *mockGlue) Clock() epochtime.Clock {
+	return g.clock
+}
+
+func (g *mockGlue) Management() *thwack.Server {
+	return nil
+}
+
+func (g *mockGlue) HTTPManagement() *httpmgmt.Server {
+	return nil
+}
+
+func (g *mockGlue) MixKeys() glue.MixKeys {
+	return g.mixKeys
+}
+
+func (g *mockGlue) PKI() glue.PKI {
+	return nil
+}
+
+func (g *mockGlue) Provider() glue.Provider {
+	return nil
+}
+
+func (g *mockGlue) Scheduler() glue.Scheduler {
+	return nil
+}
+
+func (g *mockGlue) Connector() glue.Connector {
+	return nil
+}
+
+func (g *mockGlue) Listeners() []glue.Listener {
+	return nil
+}
+
+func (g *mockGlue) Decoy() glue.Decoy {
+	return nil
+}
+
+func (g *mockGlue) ReshadowCryptoWorkers() {
+	g.Lock()
+	defer g.Unlock()
+	g.reshadows++
+}
+
+func (g *mockGlue) reshadowCount() int {
+	g.Lock()
+	defer g.Unlock()
+	return g.reshadows
+}
+
+func TestWorkerRotatesMixKeys(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	const period = time.Hour
+	const epoch = 1000
+	clock := epochtime.NewFakeClockAtEpoch(epoch, 0, period)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	identityKey, identityPublicKey := cert.Scheme.NewKeypair()
+	_, authorityKey := cert.Scheme.NewKeypair()
+	linkKey, _ := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	g := &mockGlue{
+		cfg: &config.Config{
+			Server: &config.Server{
+				Identifier: "mix",
+				Addresses:  []string{"tcp://127.0.0.1:1234"},
+				DataDir:    t.TempDir(),
+			},
+			PKI: &config.PKI{
+				Nonvoting: &config.Nonvoting{
+					Address:   "tcp://127.0.0.1:1235",
+					PublicKey: authorityKey,
+				},
+			},
+		},
+		logBackend:        logBackend,
+		identityKey:       identityKey,
+		identityPublicKey: identityPublicKey,
+		linkKey:           linkKey,
+		clock:             clock,
+	}
+	mixKeys := &mockMixKeys{glue: g, keys: make(map[uint64][]byte)}
+	g.mixKeys = mixKeys
+
+	gp, err := New(g)
+	require.NoError(err)
+	p := gp.(*pki)
+	pkiClient := &mockPKIClient{postCh: make(chan *cpki.MixDescriptor, 1)}
+	p.impl = pkiClient
+	p.StartWorker()
+	defer p.Halt()
+
+	// advance waits for the worker to go to sleep, wakes it at the given
+	// time, and returns the descriptor it posts.
+	advance := func(e uint64, elapsed time.Duration) *cpki.MixDescriptor {
+		require.Eventually(func() bool { return clock.Timers() == 1 }, 10*time.Second, time.Millisecond)
+		clock.AdvanceToEpoch(e, elapsed)
+		select {
+		case desc := <-pkiClient.postCh:
+			return desc
+		case <-time.After(10 * time.Second):
+			require.FailNow("worker did not post a descriptor")
+			return nil
+		}
+	}
+	// requireKeys checks that desc was published for epoch e, with the
+	// keys of the epochs it covers.
+	requireKeys := func(desc *cpki.MixDescriptor, e uint64) {
+		require.Len(desc.MixKeys, constants.NumMixKeys)
+		for i := uint64(0); i < constants.NumMixKeys; i++ {
+			require.Contains(desc.MixKeys, e+i)
+		}
+	}
+
+	// on startup the descriptor for the current epoch is published
+	first := advance(epoch, period/16)
+	requireKeys(first, epoch)
+
+	// followed by the one for the next epoch, with a new key for the last
+	// epoch it covers, and the keys of the other epochs kept
+	second := advance(epoch, period/4)
+	requireKeys(second, epoch+1)
+	require.Equal(first.MixKeys[epoch+1], second.MixKeys[epoch+1])
+	require.Equal(first.MixKeys[epoch+2], second.MixKeys[epoch+2])
+	require.Equal(map[uint64]bool{epoch: true, epoch + 1: true, epoch + 2: true, epoch + 3: true}, mixKeys.epochs())
+
+	third := advance(epoch+1, period/16)
+	requireKeys(third, epoch+2)
+	require.Contains(mixKeys.epochs(), uint64(epoch))
+
+	// once the epoch after the key's epoch is over, the key is pruned
+	reshadows := g.reshadowCount()
+	fourth := advance(epoch+2, period/16)
+	requireKeys(fourth, epoch+3)
+	require.Equal(third.MixKeys[epoch+3], fourth.MixKeys[epoch+3])
+	require.Equal(map[uint64]bool{epoch + 1: true, epoch + 2: true, epoch + 3: true, epoch + 4: true, epoch + 5: true}, mixKeys.epochs())
+	require.Equal(reshadows+1, g.reshadowCount())
+}
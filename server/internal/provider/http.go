@@ -0,0 +1,261 @@
+// http.go - Katzenpost provider HTTP/JSON management handlers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
+	"github.com/katzenpost/katzenpost/server/spool"
+	"github.com/katzenpost/katzenpost/server/userdb"
+)
+
+// userRequest is the request body of the user management operations.
+type userRequest struct {
+	User        string `json:"user"`
+	LinkKey     string `json:"link_key,omitempty"`
+	IdentityKey string `json:"identity_key,omitempty"`
+}
+
+func (r *userRequest) user() ([]byte, error) {
+	if r.User == "" {
+		return nil, httpmgmt.BadRequest("missing user")
+	}
+	return []byte(r.User), nil
+}
+
+type keyResponse struct {
+	Key string `json:"key"`
+}
+
+type rateRequest struct {
+	Value uint64 `json:"value"`
+}
+
+type spoolUsageResponse struct {
+	Messages int `json:"messages"`
+	Bytes    int `json:"bytes"`
+}
+
+func (p *provider) registerHTTPHandlers(s *httpmgmt.Server) {
+	s.RegisterHandler(http.MethodPost, "/v1/users/add", p.onHTTPAddUser)
+	s.RegisterHandler(http.MethodPost, "/v1/users/update", p.onHTTPUpdateUser)
+	s.RegisterHandler(http.MethodPost, "/v1/users/remove", p.onHTTPRemoveUser)
+	s.RegisterHandler(http.MethodPost, "/v1/users/identity/set", p.onHTTPSetUserIdentity)
+	s.RegisterHandler(http.MethodPost, "/v1/users/identity/remove", p.onHTTPRemoveUserIdentity)
+	s.RegisterHandler(http.MethodGet, "/v1/users/identity", p.onHTTPUserIdentity)
+	s.RegisterHandler(http.MethodGet, "/v1/users/link", p.onHTTPUserLink)
+	s.RegisterHandler(http.MethodPost, "/v1/send_rate", p.onHTTPSendRate)
+	s.RegisterHandler(http.MethodPost, "/v1/send_burst", p.onHTTPSendBurst)
+	s.RegisterHandler(http.MethodGet, "/v1/spool/usage", p.onHTTPSpoolUsage)
+	s.RegisterHandler(http.MethodGet, "/v1/kaetzchen", p.onHTTPKaetzchen)
+}
+
+func (p *provider) onHTTPAddUser(r *http.Request) (interface{}, error) {
+	return nil, p.doHTTPAddUpdate(r, false)
+}
+
+func (p *provider) onHTTPUpdateUser(r *http.Request) (interface{}, error) {
+	return nil, p.doHTTPAddUpdate(r, true)
+}
+
+func (p *provider) doHTTPAddUpdate(r *http.Request, isUpdate bool) error {
+	req := new(userRequest)
+	if err := httpmgmt.DecodeRequest(r, req); err != nil {
+		return err
+	}
+	u, err := req.user()
+	if err != nil {
+		return err
+	}
+	pubKey, err := parsePublicKey(req.LinkKey)
+	if err != nil {
+		return httpmgmt.BadRequest("invalid link_key: %v", err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	return userDBError(p.userDB.Add(u, pubKey, isUpdate))
+}
+
+func (p *provider) onHTTPRemoveUser(r *http.Request) (interface{}, error) {
+	req := new(userRequest)
+	if err := httpmgmt.DecodeRequest(r, req); err != nil {
+		return nil, err
+	}
+	u, err := req.user()
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	return nil, userDBError(p.removeUser(u))
+}
+
+func (p *provider) onHTTPSetUserIdentity(r *http.Request) (interface{}, error) {
+	req := new(userRequest)
+	if err := httpmgmt.DecodeRequest(r, req); err != nil {
+		return nil, err
+	}
+	u, err := req.user()
+	if err != nil {
+		return nil, err
+	}
+	var pubKey wire.PublicKey
+	if req.IdentityKey != "" {
+		if pubKey, err = parsePublicKey(req.IdentityKey); err != nil {
+			return nil, httpmgmt.BadRequest("invalid identity_key: %v", err)
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	return nil, userDBError(p.userDB.SetIdentity(u, pubKey))
+}
+
+func (p *provider) onHTTPRemoveUserIdentity(r *http.Request) (interface{}, error) {
+	req := new(userRequest)
+	if err := httpmgmt.DecodeRequest(r, req); err != nil {
+		return nil, err
+	}
+	u, err := req.user()
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	return nil, userDBError(p.userDB.SetIdentity(u, nil))
+}
+
+func (p *provider) onHTTPUserIdentity(r *http.Request) (interface{}, error) {
+	req := &userRequest{User: r.URL.Query().Get("user")}
+	u, err := req.user()
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	pubKey, err := p.userDB.Identity(u)
+	if err != nil {
+		return nil, userDBError(err)
+	}
+	return toKeyResponse(pubKey)
+}
+
+func (p *provider) onHTTPUserLink(r *http.Request) (interface{}, error) {
+	req := &userRequest{User: r.URL.Query().Get("user")}
+	u, err := req.user()
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	pubKey, err := p.userDB.Link(u)
+	if err != nil {
+		return nil, userDBError(err)
+	}
+	return toKeyResponse(pubKey)
+}
+
+func (p *provider) onHTTPSendRate(r *http.Request) (interface{}, error) {
+	req := new(rateRequest)
+	if err := httpmgmt.DecodeRequest(r, req); err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.setSendRate(req.Value)
+	return req, nil
+}
+
+func (p *provider) onHTTPSendBurst(r *http.Request) (interface{}, error) {
+	req := new(rateRequest)
+	if err := httpmgmt.DecodeRequest(r, req); err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.setSendBurst(req.Value)
+	return req, nil
+}
+
+func (p *provider) onHTTPSpoolUsage(r *http.Request) (interface{}, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	// The user is hex encoded, as in the listing below.
+	if user := r.URL.Query().Get("user"); user != "" {
+		u, err := hex.DecodeString(user)
+		if err != nil {
+			return nil, httpmgmt.BadRequest("invalid user: %v", err)
+		}
+		usage, err := p.spool.Usage(u)
+		if err != nil {
+			return nil, err
+		}
+		return toSpoolUsageResponse(usage), nil
+	}
+
+	// With no user specified, list the usage of every spool, keyed by
+	// the hex encoded user, as they are often binary.
+	usages, err := p.spool.AllUsage()
+	if err != nil {
+		return nil, err
+	}
+	resp := make(map[string]*spoolUsageResponse)
+	for u, usage := range usages {
+		resp[hex.EncodeToString([]byte(u))] = toSpoolUsageResponse(usage)
+	}
+	return resp, nil
+}
+
+func (p *provider) onHTTPKaetzchen(r *http.Request) (interface{}, error) {
+	return p.KaetzchenForPKI()
+}
+
+func toKeyResponse(pubKey wire.PublicKey) (*keyResponse, error) {
+	b, err := pubKey.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return &keyResponse{Key: string(b)}, nil
+}
+
+func toSpoolUsageResponse(usage *spool.Usage) *spoolUsageResponse {
+	return &spoolUsageResponse{
+		Messages: usage.Messages,
+		Bytes:    usage.Bytes,
+	}
+}
+
+func userDBError(err error) error {
+	if errors.Is(err, userdb.ErrNoSuchUser) || errors.Is(err, userdb.ErrNoIdentity) {
+		return &httpmgmt.StatusError{
+			Status: http.StatusNotFound,
+			Err:    err,
+		}
+	}
+	return err
+}
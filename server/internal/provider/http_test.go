@@ -0,0 +1,63 @@
+// http_test.go - Provider HTTP/JSON management handler tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
+	"github.com/katzenpost/katzenpost/server/spool/boltspool"
+)
+
+func TestHTTPSpoolUsage(t *testing.T) {
+	require := require.New(t)
+
+	s, err := boltspool.New(filepath.Join(t.TempDir(), "spool.db"))
+	require.NoError(err)
+	defer s.Close()
+	p := &provider{spool: s}
+
+	// user names are often binary
+	u := []byte{0x00, 'a', 0xff}
+	require.NoError(s.StoreMessage(u, []byte("hello")))
+	require.NoError(s.StoreMessage(u, []byte("world!")))
+
+	resp, err := p.onHTTPSpoolUsage(httptest.NewRequest(http.MethodGet, "/v1/spool/usage", nil))
+	require.NoError(err)
+	usages := resp.(map[string]*spoolUsageResponse)
+	require.Len(usages, 1)
+
+	// a user from the listing may be looked up
+	for user, usage := range usages {
+		query := url.Values{"user": []string{user}}
+		resp, err = p.onHTTPSpoolUsage(httptest.NewRequest(http.MethodGet, "/v1/spool/usage?"+query.Encode(), nil))
+		require.NoError(err)
+		require.Equal(usage, resp)
+		require.Equal(&spoolUsageResponse{Messages: 2, Bytes: 11}, resp)
+	}
+
+	_, err = p.onHTTPSpoolUsage(httptest.NewRequest(http.MethodGet, "/v1/spool/usage?user=alice", nil))
+	var sErr *httpmgmt.StatusError
+	require.True(errors.As(err, &sErr))
+	require.Equal(http.StatusBadRequest, sErr.Status)
+}
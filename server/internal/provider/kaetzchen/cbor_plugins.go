@@ -21,6 +21,7 @@ package kaetzchen
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
@@ -32,6 +33,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server/config"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
 	"github.com/katzenpost/katzenpost/server/internal/instrument"
 	"github.com/katzenpost/katzenpost/server/internal/packet"
@@ -65,6 +67,15 @@ type CBORPluginWorker struct {
 	haltOnce    sync.Once
 	pluginChans PluginChans
 	clients     []*cborplugin.Client
+	plugins     map[PluginName]*cborPlugin
+}
+
+// cborPlugin is a running plugin.
+type cborPlugin struct {
+	cfg      *config.CBORPluginKaetzchen
+	endpoint [constants.RecipientIDLength]byte
+	client   *cborplugin.Client
+	haltCh   chan interface{}
 }
 
 // OnKaetzchen enqueues the pkt for processing by our thread pool of plugins.
@@ -79,18 +90,7 @@ func (k *CBORPluginWorker) OnKaetzchen(pkt *packet.Packet) {
 	handlerCh.In() <- pkt
 }
 
-func (k *CBORPluginWorker) worker(recipient [constants.RecipientIDLength]byte, pluginClient *cborplugin.Client) {
-	// Kaetzchen delay is our max dwell time.
-	maxDwell := time.Duration(k.glue.Config().Debug.KaetzchenDelay) * time.Millisecond
-
-	defer k.haltOnce.Do(k.haltAllClients)
-
-	handlerCh, ok := k.pluginChans[recipient]
-	if !ok {
-		k.log.Debugf("Failed to find handler. Dropping Kaetzchen request: %v", recipient)
-		instrument.KaetzchenRequestsDropped(1)
-		return
-	}
+func (k *CBORPluginWorker) worker(plugin *cborPlugin, handlerCh *channels.InfiniteChannel) {
 	ch := handlerCh.Out()
 
 	for {
@@ -98,8 +98,15 @@ func (k *CBORPluginWorker) worker(recipient [constants.RecipientIDLength]byte, p
 		select {
 		case <-k.HaltCh():
 			k.log.Debugf("Terminating gracefully.")
+			k.haltOnce.Do(k.haltAllClients)
+			return
+		case <-plugin.haltCh:
+			k.log.Debugf("%v: Terminating plugin worker.", plugin.cfg.Capability)
 			return
 		case e := <-ch:
+			// Kaetzchen delay is our max dwell time.
+			maxDwell := time.Duration(k.glue.Config().Debug.KaetzchenDelay) * time.Millisecond
+
 			pkt = e.(*packet.Packet)
 			if dwellTime := time.Now().Sub(pkt.DispatchAt); dwellTime > maxDwell {
 				k.log.Debugf("Dropping packet: %v (Spend %v in queue)", pkt.ID, dwellTime)
@@ -109,13 +116,15 @@ func (k *CBORPluginWorker) worker(recipient [constants.RecipientIDLength]byte, p
 			}
 		}
 
-		k.processKaetzchen(pkt, pluginClient)
+		k.processKaetzchen(pkt, plugin.client)
 		instrument.KaetzchenRequests()
 	}
 }
 
 func (k *CBORPluginWorker) haltAllClients() {
 	k.log.Debug("Halting plugin clients.")
+	k.Lock()
+	defer k.Unlock()
 	for _, client := range k.clients {
 		go client.Halt()
 	}
@@ -140,13 +149,16 @@ func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient *cb
 	}
 }
 
-func (k *CBORPluginWorker) sendworker(pluginClient *cborplugin.Client) {
+func (k *CBORPluginWorker) sendworker(plugin *cborPlugin) {
+	pluginClient := plugin.client
 	pluginCap := pluginClient.Capability()
 	surbLength := k.geo.SURBLength
 	for {
 		select {
 		case <-k.HaltCh():
 			return
+		case <-plugin.haltCh:
+			return
 		case cborResponse := <-pluginClient.ReadChan():
 			switch r := cborResponse.(type) {
 			case *cborplugin.Response:
@@ -224,11 +236,19 @@ func (k *CBORPluginWorker) launch(command, capability, endpoint string, args []s
 	return plugin, err
 }
 
-func (k *CBORPluginWorker) unregister(endpoint [constants.RecipientIDLength]byte, pluginClient *cborplugin.Client) {
+func (k *CBORPluginWorker) unregister(plugin *cborPlugin) {
+	pluginClient := plugin.client
 	k.log.Debugf("Unregistering %s", pluginClient.Capability())
 	k.Lock()
 	defer k.Unlock()
-	delete(k.pluginChans, endpoint)
+
+	// If the plugin halted on its own, rather than being stopped by
+	// Reconfigure, tear down its workers.
+	if k.plugins[plugin.cfg.Capability] == plugin {
+		delete(k.plugins, plugin.cfg.Capability)
+		delete(k.pluginChans, plugin.endpoint)
+		close(plugin.haltCh)
+	}
 	for i, c := range k.clients {
 		if c == pluginClient {
 			// last element in clients
@@ -243,33 +263,120 @@ func (k *CBORPluginWorker) unregister(endpoint [constants.RecipientIDLength]byte
 	}
 }
 
-// NewCBORPluginWorker returns a new CBORPluginWorker
-func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
+// startPlugin launches the plugin described by pluginConf, and starts its
+// workers.  The caller MUST hold the lock.
+func (k *CBORPluginWorker) startPlugin(pluginConf *config.CBORPluginKaetzchen) error {
+	k.log.Noticef("Starting Kaetzchen plugin client: %s", pluginConf.Capability)
 
-	kaetzchenWorker := CBORPluginWorker{
-		geo:         glue.Config().SphinxGeometry,
-		glue:        glue,
-		log:         glue.LogBackend().GetLogger("CBOR plugin worker"),
-		pluginChans: make(PluginChans),
-		clients:     make([]*cborplugin.Client, 0),
+	var args []string
+	if len(pluginConf.Config) > 0 {
+		args = []string{}
+		for key, val := range pluginConf.Config {
+			args = append(args, fmt.Sprintf("-%s", key), val.(string))
+		}
 	}
 
-	// hold lock while mutating pluginChans and clients
-	kaetzchenWorker.Lock()
-	defer kaetzchenWorker.Unlock()
+	pluginClient, err := k.launch(pluginConf.Command, pluginConf.Capability, pluginConf.Endpoint, args)
+	if err != nil {
+		k.log.Errorf("Failed to start a plugin client: %s", err)
+		return err
+	}
 
-	capaMap := make(map[string]bool)
+	plugin := &cborPlugin{
+		cfg:    pluginConf,
+		client: pluginClient,
+		haltCh: make(chan interface{}),
+	}
+	copy(plugin.endpoint[:], []byte(pluginConf.Endpoint))
 
-	for _, pluginConf := range glue.Config().Provider.CBORPluginKaetzchen {
-		kaetzchenWorker.log.Noticef("Configuring plugin handler for %s", pluginConf.Capability)
+	// Add an infinite channel for this plugin.
+	handlerCh := channels.NewInfiniteChannel()
+	k.pluginChans[plugin.endpoint] = handlerCh
 
+	// Accumulate a list of all clients to facilitate clean shutdown.
+	k.clients = append(k.clients, pluginClient)
+	k.plugins[pluginConf.Capability] = plugin
+
+	k.Go(func() {
+		k.worker(plugin, handlerCh)
+	})
+
+	// start the sendworker
+	k.Go(func() {
+		k.sendworker(plugin)
+	})
+
+	// Unregister pluginClient when it halts
+	k.Go(func() {
+		<-pluginClient.HaltCh()
+		k.unregister(plugin)
+	})
+
+	return nil
+}
+
+// stopPlugin stops the plugin's workers and halts the plugin client.  The
+// caller MUST hold the lock.
+func (k *CBORPluginWorker) stopPlugin(plugin *cborPlugin) {
+	k.log.Noticef("Stopping Kaetzchen plugin client: %s", plugin.cfg.Capability)
+	delete(k.plugins, plugin.cfg.Capability)
+	delete(k.pluginChans, plugin.endpoint)
+	close(plugin.haltCh)
+	go plugin.client.Halt()
+}
+
+// Reconfigure brings the running plugins in line with the provided plugin
+// configuration, stopping the plugins that were removed or changed and
+// starting the plugins that were added or changed, along with any that
+// have halted since.  It returns true iff the set of running plugins
+// changed, which may be the case even if an error is returned.
+func (k *CBORPluginWorker) Reconfigure(pluginConfs []*config.CBORPluginKaetzchen) (bool, error) {
+	enabled, err := k.validatePlugins(pluginConfs)
+	if err != nil {
+		return false, err
+	}
+	enabledMap := make(map[PluginName]*config.CBORPluginKaetzchen)
+	for _, pluginConf := range enabled {
+		enabledMap[pluginConf.Capability] = pluginConf
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	changed := false
+	for capa, plugin := range k.plugins {
+		if pluginConf, ok := enabledMap[capa]; !ok || !reflect.DeepEqual(pluginConf, plugin.cfg) {
+			k.stopPlugin(plugin)
+			changed = true
+		}
+	}
+	for _, pluginConf := range enabled {
+		if _, ok := k.plugins[pluginConf.Capability]; ok {
+			continue
+		}
+		if err := k.startPlugin(pluginConf); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// validatePlugins validates the plugin configuration, and returns the
+// enabled plugins.
+func (k *CBORPluginWorker) validatePlugins(pluginConfs []*config.CBORPluginKaetzchen) ([]*config.CBORPluginKaetzchen, error) {
+	capaMap := make(map[string]bool)
+	endpointMap := make(map[string]bool)
+	enabled := make([]*config.CBORPluginKaetzchen, 0, len(pluginConfs))
+
+	for _, pluginConf := range pluginConfs {
 		// Ensure no duplicates.
 		capa := pluginConf.Capability
 		if capa == "" {
 			return nil, errors.New("kaetzchen plugin capability cannot be empty string")
 		}
 		if pluginConf.Disable {
-			kaetzchenWorker.log.Noticef("Skipping disabled Kaetzchen: '%v'.", capa)
+			k.log.Noticef("Skipping disabled Kaetzchen: '%v'.", capa)
 			continue
 		}
 		if capaMap[capa] {
@@ -288,49 +395,43 @@ func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 		if len(rawEp) == 0 || len(rawEp) > constants.RecipientIDLength {
 			return nil, fmt.Errorf("provider: Kaetzchen: '%v' invalid endpoint, length out of bounds", capa)
 		}
-
-		// Add an infinite channel for this plugin.
-		var endpoint [constants.RecipientIDLength]byte
-		copy(endpoint[:], rawEp)
-		kaetzchenWorker.pluginChans[endpoint] = channels.NewInfiniteChannel()
-		kaetzchenWorker.log.Noticef("Starting Kaetzchen plugin client: %s", capa)
-
-		var args []string
-		if len(pluginConf.Config) > 0 {
-			args = []string{}
-			for key, val := range pluginConf.Config {
-				args = append(args, fmt.Sprintf("-%s", key), val.(string))
-			}
-		}
-
-		pluginClient, err := kaetzchenWorker.launch(pluginConf.Command, pluginConf.Capability, pluginConf.Endpoint, args)
-		if err != nil {
-			kaetzchenWorker.log.Error("Failed to start a plugin client: %s", err)
-			return nil, err
+		if endpointMap[pluginConf.Endpoint] {
+			return nil, fmt.Errorf("provider: Kaetzchen: '%v' endpoint '%v' already registered", capa, pluginConf.Endpoint)
 		}
 
-		// Accumulate a list of all clients to facilitate clean shutdown.
-		kaetzchenWorker.clients = append(kaetzchenWorker.clients, pluginClient)
+		capaMap[capa] = true
+		endpointMap[pluginConf.Endpoint] = true
+		enabled = append(enabled, pluginConf)
+	}
+	return enabled, nil
+}
 
-		// Start the workers _after_ we have added all of the entries to pluginChans
-		// otherwise the worker() goroutines race this thread.
-		defer kaetzchenWorker.Go(func() {
-			kaetzchenWorker.worker(endpoint, pluginClient)
-		})
+// NewCBORPluginWorker returns a new CBORPluginWorker
+func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 
-		// start the sendworker
-		defer kaetzchenWorker.Go(func() {
-			kaetzchenWorker.sendworker(pluginClient)
-		})
+	kaetzchenWorker := CBORPluginWorker{
+		geo:         glue.Config().SphinxGeometry,
+		glue:        glue,
+		log:         glue.LogBackend().GetLogger("CBOR plugin worker"),
+		pluginChans: make(PluginChans),
+		clients:     make([]*cborplugin.Client, 0),
+		plugins:     make(map[PluginName]*cborPlugin),
+	}
 
+	enabled, err := kaetzchenWorker.validatePlugins(glue.Config().Provider.CBORPluginKaetzchen)
+	if err != nil {
+		return nil, err
+	}
 
-		// Unregister pluginClient when it halts
-		defer kaetzchenWorker.Go(func() {
-			<-pluginClient.HaltCh()
-			kaetzchenWorker.unregister(endpoint, pluginClient)
-		})
+	// hold lock while mutating pluginChans and clients
+	kaetzchenWorker.Lock()
+	defer kaetzchenWorker.Unlock()
 
-		capaMap[capa] = true
+	for _, pluginConf := range enabled {
+		kaetzchenWorker.log.Noticef("Configuring plugin handler for %s", pluginConf.Capability)
+		if err := kaetzchenWorker.startPlugin(pluginConf); err != nil {
+			return nil, err
+		}
 	}
 
 	return &kaetzchenWorker, nil
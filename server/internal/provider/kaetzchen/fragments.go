@@ -0,0 +1,96 @@
+// fragments.go - Reassembly of fragmented Kaetzchen requests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+
+	"gopkg.in/op/go-logging.v1"
+
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/client/fragment"
+	"github.com/katzenpost/katzenpost/server/internal/glue"
+)
+
+// ParameterFragments is the Kaetzchen configuration and Parameter key
+// indicating that the Kaetzchen reassembles the requests sent with the
+// client's SendLargeMessage.
+const ParameterFragments = "fragments"
+
+// maxPendingFragmented is the maximum number of requests a fragmented
+// Kaetzchen reassembles at a time.
+const maxPendingFragmented = 128
+
+type fragmentedKaetzchen struct {
+	Kaetzchen
+
+	log *logging.Logger
+
+	params        Parameters
+	reassembler   *fragment.Reassembler
+	payloadLength int
+}
+
+func (k *fragmentedKaetzchen) Parameters() Parameters {
+	return k.params
+}
+
+// OnRequest answers every fragment with a fragment.Reply, and hands the
+// request to the Kaetzchen once its last fragment arrives, the response
+// to which is carried in the last Reply.
+func (k *fragmentedKaetzchen) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, error) {
+	_, request, err := k.reassembler.Add(payload)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(fragment.Reply)
+	if request != nil {
+		k.log.Debugf("Reassembled request: %v (%v bytes)", id, len(request))
+		reply.Complete = true
+		reply.Payload, err = k.Kaetzchen.OnRequest(id, request, hasSURB)
+		if err != nil && err != ErrNoResponse {
+			return nil, err
+		}
+	}
+	if !hasSURB {
+		return nil, ErrNoResponse
+	}
+	resp := reply.Bytes()
+	if len(resp) > k.payloadLength {
+		return nil, fmt.Errorf("kaetzchen: response too large: %v > %v", len(resp), k.payloadLength)
+	}
+	return resp, nil
+}
+
+// newFragmented wraps k in a Kaetzchen which reassembles the requests
+// sent to it in fragments, and advertises so in its Parameters.
+func newFragmented(k Kaetzchen, glue glue.Glue) Kaetzchen {
+	params := make(Parameters)
+	for key, v := range k.Parameters() {
+		params[key] = v
+	}
+	params[ParameterFragments] = true
+
+	payloadLength := glue.Config().SphinxGeometry.UserForwardPayloadLength
+	maxRequestSize := cConstants.MaxEgressQueueSize * fragment.MaxDataLength(payloadLength)
+	return &fragmentedKaetzchen{
+		Kaetzchen:     k,
+		log:           glue.LogBackend().GetLogger(fmt.Sprintf("kaetzchen/%v/fragments", k.Capability())),
+		params:        params,
+		reassembler:   fragment.NewReassembler(glue.Clock().Period(), maxRequestSize, maxPendingFragmented),
+		payloadLength: payloadLength,
+	}
+}
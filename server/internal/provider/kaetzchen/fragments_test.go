@@ -0,0 +1,97 @@
+// fragments_test.go - Fragmented Kaetzchen request tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/client/fragment"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/server/config"
+)
+
+// recordingKaetzchen keeps the requests it is handed.
+type recordingKaetzchen struct {
+	MockKaetzchen
+
+	requests [][]byte
+}
+
+func (m *recordingKaetzchen) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, error) {
+	m.requests = append(m.requests, append([]byte{}, payload...))
+	return []byte("ok"), nil
+}
+
+func TestFragmentedKaetzchen(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	g := geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 2000, true, 5)
+	goo := &mockGlue{
+		s: &mockServer{
+			logBackend: logBackend,
+			cfg:        &config.Config{SphinxGeometry: g},
+		},
+	}
+
+	inner := &recordingKaetzchen{
+		MockKaetzchen: MockKaetzchen{
+			capability: "test",
+			parameters: Parameters{ParameterEndpoint: "+test"},
+		},
+	}
+	k := newFragmented(inner, goo)
+	require.Equal("test", k.Capability())
+	require.Equal(Parameters{ParameterEndpoint: "+test", ParameterFragments: true}, k.Parameters())
+
+	message := make([]byte, 5000)
+	_, err = rand.Reader.Read(message)
+	require.NoError(err)
+	id := [fragment.MessageIDLength]byte{1}
+	fragments, err := fragment.Split(&id, message, g.UserForwardPayloadLength)
+	require.NoError(err)
+	require.Len(fragments, 3)
+
+	for i, f := range fragments {
+		// requests are padded to the payload length
+		payload := make([]byte, g.UserForwardPayloadLength)
+		copy(payload, f.Bytes())
+		resp, err := k.OnRequest(uint64(i), payload, true)
+		require.NoError(err)
+		reply, err := fragment.ReplyFromBytes(resp)
+		require.NoError(err)
+		if i < len(fragments)-1 {
+			require.False(reply.Complete)
+			require.Empty(inner.requests)
+			continue
+		}
+		require.True(reply.Complete)
+		require.Equal([]byte("ok"), reply.Payload)
+	}
+	require.Equal([][]byte{message}, inner.requests)
+
+	// a forged fragment count does not make the Kaetzchen allocate for it
+	forged := *fragments[0]
+	forged.Count = 0xffffffff
+	_, err = k.OnRequest(0, forged.Bytes(), true)
+	require.Equal(fragment.ErrMessageTooLarge, err)
+}
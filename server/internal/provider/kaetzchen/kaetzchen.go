@@ -155,9 +155,6 @@ func (k *KaetzchenWorker) incrementDropCounter() uint64 {
 }
 
 func (k *KaetzchenWorker) worker() {
-	// Kaetzchen delay is our max dwell time.
-	maxDwell := time.Duration(k.glue.Config().Debug.KaetzchenDelay) * time.Millisecond
-
 	defer k.log.Debugf("Halting Kaetzchen internal worker.")
 
 	ch := k.ch.Out()
@@ -169,6 +166,9 @@ func (k *KaetzchenWorker) worker() {
 			k.log.Debugf("Terminating gracefully.")
 			return
 		case e := <-ch:
+			// Kaetzchen delay is our max dwell time.
+			maxDwell := time.Duration(k.glue.Config().Debug.KaetzchenDelay) * time.Millisecond
+
 			pkt = e.(*packet.Packet)
 			if dwellTime := time.Now().Sub(pkt.DispatchAt); dwellTime > maxDwell {
 				count := k.incrementDropCounter()
@@ -276,6 +276,9 @@ func New(glue glue.Glue) (*KaetzchenWorker, error) {
 		if err != nil {
 			return nil, err
 		}
+		if fragments, _ := v.Config[ParameterFragments].(bool); fragments {
+			k = newFragmented(k, glue)
+		}
 		if err = kaetzchenWorker.registerKaetzchen(k); err != nil {
 			return nil, err
 		}
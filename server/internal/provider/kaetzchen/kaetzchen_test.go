@@ -29,6 +29,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/sphinx/commands"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
@@ -38,6 +39,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/server/config"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
 	"github.com/katzenpost/katzenpost/server/internal/packet"
 	"github.com/katzenpost/katzenpost/server/internal/pkicache"
 	"github.com/katzenpost/katzenpost/server/spool"
@@ -90,6 +92,12 @@ func (s *mockSpool) VacuumExpired(udb userdb.UserDB, ignoreIdentities map[[32]by
 
 func (s *mockSpool) Vacuum(udb userdb.UserDB) error { return nil }
 
+func (s *mockSpool) Usage(u []byte) (*spool.Usage, error) { return new(spool.Usage), nil }
+
+func (s *mockSpool) AllUsage() (map[string]*spool.Usage, error) { return nil, nil }
+
+func (s *mockSpool) Expire() (int, error) { return 0, nil }
+
 func (s *mockSpool) Close() {}
 
 type mockProvider struct {
@@ -115,6 +123,14 @@ func (p *mockProvider) AuthenticateClient(*wire.PeerCredentials) bool {
 
 func (p *mockProvider) OnPacket(*packet.Packet) {}
 
+func (p *mockProvider) ReconfigurePlugins([]*config.CBORPluginKaetzchen) (bool, error) {
+	return false, nil
+}
+
+func (p *mockProvider) QueueLen() int {
+	return 0
+}
+
 func (p *mockProvider) KaetzchenForPKI() (map[string]map[string]interface{}, error) {
 	return nil, nil
 }
@@ -170,6 +186,10 @@ func (g *mockGlue) Management() *thwack.Server {
 	return g.s.management
 }
 
+func (g *mockGlue) HTTPManagement() *httpmgmt.Server {
+	return nil
+}
+
 func (g *mockGlue) MixKeys() glue.MixKeys {
 	return g.s.mixKeys
 }
@@ -196,6 +216,10 @@ func (g *mockGlue) Listeners() []glue.Listener {
 
 func (g *mockGlue) ReshadowCryptoWorkers() {}
 
+func (g *mockGlue) Clock() epochtime.Clock {
+	return epochtime.WallClock
+}
+
 func (g *mockGlue) Decoy() glue.Decoy {
 	return &mockDecoy{}
 }
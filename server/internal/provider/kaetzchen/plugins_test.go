@@ -81,3 +81,65 @@ func TestCBORInvalidCommandWithPluginKaetzchenWorker(t *testing.T) {
 	_, err = NewCBORPluginWorker(goo)
 	require.Error(err)
 }
+
+func TestCBORPluginWorkerReconfigure(t *testing.T) {
+	require := require.New(t)
+
+	idKey, _ := cert.Scheme.NewKeypair()
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	scheme := wire.DefaultScheme
+	userKey, _ := scheme.GenerateKeypair(rand.Reader)
+	linkKey, _ := scheme.GenerateKeypair(rand.Reader)
+
+	mockProvider := &mockProvider{
+		userName: "alice",
+		userKey:  userKey.PublicKey(),
+	}
+
+	goo := getGlue(logBackend, mockProvider, linkKey, idKey)
+	worker, err := NewCBORPluginWorker(goo)
+	require.NoError(err)
+	defer worker.Halt()
+
+	// Disabled plugins are never started.
+	changed, err := worker.Reconfigure([]*config.CBORPluginKaetzchen{
+		&config.CBORPluginKaetzchen{
+			Capability: "echo",
+			Endpoint:   "echo",
+			Disable:    true,
+			Command:    "non-existent command",
+		},
+	})
+	require.NoError(err)
+	require.False(changed)
+
+	// Invalid configurations are rejected before anything is started.
+	_, err = worker.Reconfigure([]*config.CBORPluginKaetzchen{
+		&config.CBORPluginKaetzchen{
+			Capability: "echo",
+			Endpoint:   "echo",
+			Command:    "non-existent command",
+		},
+		&config.CBORPluginKaetzchen{
+			Capability: "echo2",
+			Endpoint:   "echo",
+			Command:    "non-existent command",
+		},
+	})
+	require.Error(err)
+	require.Contains(err.Error(), "already registered")
+
+	// Plugins that fail to start are not running.
+	_, err = worker.Reconfigure([]*config.CBORPluginKaetzchen{
+		&config.CBORPluginKaetzchen{
+			Capability: "echo",
+			Endpoint:   "echo",
+			Command:    "non-existent command",
+		},
+	})
+	require.Error(err)
+	require.Empty(worker.KaetzchenForPKI())
+}
@@ -18,6 +18,7 @@
 package provider
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strconv"
@@ -26,7 +27,6 @@ import (
 	"time"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/wire"
@@ -105,6 +105,10 @@ func (p *provider) OnPacket(pkt *packet.Packet) {
 	p.ch.In() <- pkt
 }
 
+func (p *provider) QueueLen() int {
+	return p.ch.Len()
+}
+
 func (p *provider) KaetzchenForPKI() (map[string]map[string]interface{}, error) {
 	map1 := p.kaetzchenWorker.KaetzchenForPKI()
 	map2 := p.cborPluginKaetzchenWorker.KaetzchenForPKI()
@@ -129,6 +133,12 @@ func (p *provider) KaetzchenForPKI() (map[string]map[string]interface{}, error)
 	return merged, nil
 }
 
+// ReconfigurePlugins applies a new CBOR plugin Kaetzchen configuration,
+// returning true iff the set of running plugins changed.
+func (p *provider) ReconfigurePlugins(pluginConfs []*config.CBORPluginKaetzchen) (bool, error) {
+	return p.cborPluginKaetzchenWorker.Reconfigure(pluginConfs)
+}
+
 func (p *provider) connectedClients() (map[[sConstants.RecipientIDLength]byte]interface{}, error) {
 	identities := make(map[[sConstants.RecipientIDLength]byte]interface{})
 	for _, listener := range p.glue.Listeners() {
@@ -158,9 +168,36 @@ func (p *provider) gcEphemeralClients() {
 	}
 }
 
-func (p *provider) worker() {
-	maxDwell := time.Duration(p.glue.Config().Debug.ProviderDelay) * time.Millisecond
+func (p *provider) expiryWorker() {
+	ttl := time.Duration(p.glue.Config().Provider.SpoolDB.MessageTTL) * time.Second
+
+	defer p.log.Debugf("Halting Provider expiry worker.")
+
+	// Sweep often enough that no message outlives its TTL by more than
+	// half of it.
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.HaltCh():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := p.spool.Expire()
+		if err != nil {
+			p.log.Errorf("Failed to expire spooled messages: %v", err)
+			continue
+		}
+		if n > 0 {
+			p.log.Debugf("Expired %v spooled messages.", n)
+			instrument.SpoolMessagesExpired(n)
+		}
+	}
+}
 
+func (p *provider) worker() {
 	defer p.log.Debugf("Halting Provider worker.")
 
 	ch := p.ch.Out()
@@ -171,7 +208,7 @@ func (p *provider) worker() {
 	// write to the channel triggering our GC routine.
 	var gcEphemeralClientGCTickerChan <-chan time.Time
 	if p.glue.Config().Provider.EnableEphemeralClients {
-		ticker := time.NewTicker(epochtime.Period)
+		ticker := time.NewTicker(p.glue.Clock().Period())
 		gcEphemeralClientGCTickerChan = ticker.C
 		defer ticker.Stop()
 	}
@@ -188,6 +225,8 @@ func (p *provider) worker() {
 		case e := <-ch:
 			pkt = e.(*packet.Packet)
 
+			// Provider delay is our max dwell time.
+			maxDwell := time.Duration(p.glue.Config().Debug.ProviderDelay) * time.Millisecond
 			if dwellTime := time.Now().Sub(pkt.DispatchAt); dwellTime > maxDwell {
 				p.log.Debugf("Dropping packet: %v (Spend %v in queue)", pkt.ID, dwellTime)
 				instrument.PacketsDropped()
@@ -265,6 +304,9 @@ func (p *provider) onSURBReply(pkt *packet.Packet, recipient []byte) {
 
 	// Store the payload in the spool.
 	if err := p.spool.StoreSURBReply(recipient, &pkt.SurbReply.ID, pkt.Payload); err != nil {
+		if errors.Is(err, spool.ErrQuotaExceeded) {
+			instrument.SpoolMessagesRejected()
+		}
 		p.log.Debugf("Failed to store SURB-Reply: %v (%v)", pkt.ID, err)
 	} else {
 		p.log.Debugf("Stored SURB-Reply: %v", pkt.ID)
@@ -281,6 +323,9 @@ func (p *provider) onToUser(pkt *packet.Packet, recipient []byte) {
 
 	// Store the ciphertext in the spool.
 	if err := p.spool.StoreMessage(recipient, ct); err != nil {
+		if errors.Is(err, spool.ErrQuotaExceeded) {
+			instrument.SpoolMessagesRejected()
+		}
 		p.log.Debugf("Failed to store message payload: %v (%v)", pkt.ID, err)
 		return
 	}
@@ -319,8 +364,7 @@ func (p *provider) doAddUpdate(c *thwack.Conn, l string, isUpdate bool) error {
 	}
 
 	// Deserialize the public key.
-	_, pubKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
-	err := pubKey.UnmarshalText([]byte(sp[2]))
+	pubKey, err := parsePublicKey(sp[2])
 	if err != nil {
 		c.Log().Errorf("[ADD/UPDATE]_USER invalid public key: %v", err)
 		return c.WriteReply(thwack.StatusSyntaxError)
@@ -347,20 +391,29 @@ func (p *provider) onRemoveUser(c *thwack.Conn, l string) error {
 	}
 
 	u := []byte(sp[1])
-	// Remove the user from the UserDB.
-	if err := p.userDB.Remove(u); err != nil {
+	if err := p.removeUser(u); err != nil {
 		c.Log().Errorf("Failed to remove user '%v': %v", u, err)
 		return c.WriteReply(thwack.StatusTransactionFailed)
 	}
 
+	return c.WriteReply(thwack.StatusOk)
+}
+
+// removeUser removes the user u from the UserDB, and their spool.  The
+// caller must hold the provider lock.
+func (p *provider) removeUser(u []byte) error {
+	// Remove the user from the UserDB.
+	if err := p.userDB.Remove(u); err != nil {
+		return err
+	}
+
 	// Remove the user's spool.
 	if err := p.spool.Remove(u); err != nil {
-		// Log an error, but don't return a failed status, because the
+		// Log an error, but don't return a failure, because the
 		// user has been obliterated from the UserDB at this point.
-		c.Log().Errorf("Failed to remove spool '%v': %v", u, err)
+		p.log.Errorf("Failed to remove spool '%v': %v", u, err)
 	}
-
-	return c.WriteReply(thwack.StatusOk)
+	return nil
 }
 
 func (p *provider) onRemoveUserIdentity(c *thwack.Conn, l string) error {
@@ -395,8 +448,7 @@ func (p *provider) onSetUserIdentity(c *thwack.Conn, l string) error {
 	switch len(sp) {
 	case 2:
 	case 3:
-		_, pubKey = wire.DefaultScheme.GenerateKeypair(rand.Reader)
-		err = pubKey.UnmarshalText([]byte(sp[2]))
+		pubKey, err = parsePublicKey(sp[2])
 		if err != nil {
 			c.Log().Errorf("SET_USER_IDENTITY invalid public key: %v", err)
 			return c.WriteReply(thwack.StatusSyntaxError)
@@ -471,9 +523,7 @@ func (p *provider) onSendRate(c *thwack.Conn, l string) error {
 		return c.WriteReply(thwack.StatusSyntaxError)
 	}
 
-	for _, l := range p.glue.Listeners() {
-		l.OnNewSendRatePerMinute(rate)
-	}
+	p.setSendRate(rate)
 
 	return c.Writer().PrintfLine("%v %v", thwack.StatusOk, rate)
 }
@@ -494,11 +544,70 @@ func (p *provider) onSendBurst(c *thwack.Conn, l string) error {
 		return c.WriteReply(thwack.StatusSyntaxError)
 	}
 
+	p.setSendBurst(burst)
+
+	return c.Writer().PrintfLine("%v %v", thwack.StatusOk, burst)
+}
+
+func (p *provider) onSpoolUsage(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	switch len(sp) {
+	case 1:
+	case 2:
+		// The user is hex encoded, as in the listing below.
+		u, err := hex.DecodeString(sp[1])
+		if err != nil {
+			c.Log().Debugf("SPOOL_USAGE invalid user: '%v'", sp[1])
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		usage, err := p.spool.Usage(u)
+		if err != nil {
+			c.Log().Errorf("Failed to query spool usage for user '%x': %v", u, err)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+		return c.Writer().PrintfLine("%v %v %v", thwack.StatusOk, usage.Messages, usage.Bytes)
+	default:
+		c.Log().Debugf("SPOOL_USAGE invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// With no user specified, list the usage of every spool, one user
+	// (hex encoded, as they are often binary) per line.
+	usages, err := p.spool.AllUsage()
+	if err != nil {
+		c.Log().Errorf("Failed to query spool usage: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	for u, usage := range usages {
+		if err = c.Writer().PrintfLine("%v-%x %v %v", thwack.StatusOk, u, usage.Messages, usage.Bytes); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) setSendRate(rate uint64) {
+	for _, l := range p.glue.Listeners() {
+		l.OnNewSendRatePerMinute(rate)
+	}
+}
+
+func (p *provider) setSendBurst(burst uint64) {
 	for _, l := range p.glue.Listeners() {
 		l.OnNewSendBurst(burst)
 	}
+}
 
-	return c.Writer().PrintfLine("%v %v", thwack.StatusOk, burst)
+// parsePublicKey deserializes a wire public key from its text encoding.
+func parsePublicKey(s string) (wire.PublicKey, error) {
+	_, pubKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	if err := pubKey.UnmarshalText([]byte(s)); err != nil {
+		return nil, err
+	}
+	return pubKey, nil
 }
 
 // New constructs a new provider instance.
@@ -561,12 +670,25 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		return nil, err
 	}
 
+	var quota *spool.Quota
+	if sCfg := cfg.Provider.SpoolDB; sCfg.HasQuota() {
+		quota = &spool.Quota{
+			MaxMessages: sCfg.MaxMessagesPerUser,
+			MaxBytes:    sCfg.MaxBytesPerUser,
+			MessageTTL:  time.Duration(sCfg.MessageTTL) * time.Second,
+			DropOldest:  sCfg.QuotaPolicy == config.QuotaPolicyDropOldest,
+		}
+	}
 	switch cfg.Provider.SpoolDB.Backend {
 	case config.BackendBolt:
-		p.spool, err = boltspool.New(cfg.Provider.SpoolDB.Bolt.SpoolDB)
+		var opts []boltspool.BoltSpoolOption
+		if quota != nil {
+			opts = append(opts, boltspool.WithQuota(quota), boltspool.WithDropHook(instrument.SpoolMessagesDropped))
+		}
+		p.spool, err = boltspool.New(cfg.Provider.SpoolDB.Bolt.SpoolDB, opts...)
 	case config.BackendSQL:
 		if p.sqlDB != nil {
-			p.spool = p.sqlDB.Spool()
+			p.spool = p.sqlDB.Spool(quota, instrument.SpoolMessagesDropped)
 		} else {
 			err = errors.New("provider: SQL SpoolDB backend with no SQL database")
 		}
@@ -594,6 +716,7 @@ func New(glue glue.Glue) (glue.Provider, error) {
 			cmdUserLink           = "USER_LINK"
 			cmdSendRate           = "SEND_RATE"
 			cmdSendBurst          = "SEND_BURST"
+			cmdSpoolUsage         = "SPOOL_USAGE"
 		)
 
 		glue.Management().RegisterCommand(cmdAddUser, p.onAddUser)
@@ -605,12 +728,19 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		glue.Management().RegisterCommand(cmdUserLink, p.onUserLink)
 		glue.Management().RegisterCommand(cmdSendRate, p.onSendRate)
 		glue.Management().RegisterCommand(cmdSendBurst, p.onSendBurst)
+		glue.Management().RegisterCommand(cmdSpoolUsage, p.onSpoolUsage)
+	}
+	if glue.HTTPManagement() != nil {
+		p.registerHTTPHandlers(glue.HTTPManagement())
 	}
 
 	// Start the workers.
 	for i := 0; i < cfg.Debug.NumProviderWorkers; i++ {
 		p.Go(p.worker)
 	}
+	if cfg.Provider.SpoolDB.MessageTTL > 0 {
+		p.Go(p.expiryWorker)
+	}
 
 	isOk = true
 	return p, nil
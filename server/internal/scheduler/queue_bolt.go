@@ -282,6 +282,14 @@ func (q *boltQueue) Pop() {
 	}
 }
 
+func (q *boltQueue) Len() int {
+	n := int(q.dbCount)
+	if q.headPkt != nil {
+		n++
+	}
+	return n
+}
+
 func (q *boltQueue) BulkEnqueue(batch []*packet.Packet) {
 	var added uint64
 	now := time.Now()
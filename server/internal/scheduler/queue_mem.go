@@ -53,6 +53,10 @@ func (q *memoryQueue) Pop() {
 	heap.Pop(q.q)
 }
 
+func (q *memoryQueue) Len() int {
+	return q.q.Len()
+}
+
 func (q *memoryQueue) BulkEnqueue(batch []*packet.Packet) {
 	now := time.Now()
 	for _, pkt := range batch {
@@ -23,12 +23,14 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/server/config"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
 	"github.com/katzenpost/katzenpost/server/internal/packet"
 	"github.com/stretchr/testify/require"
 )
@@ -72,6 +74,9 @@ func (m *mockGlue) LogBackend() *log.Backend {
 func (m *mockGlue) Management() *thwack.Server {
 	return nil
 }
+func (m *mockGlue) HTTPManagement() *httpmgmt.Server {
+	return nil
+}
 func (m *mockGlue) MixKeys() glue.MixKeys {
 	return nil
 }
@@ -85,6 +90,9 @@ func (m *mockGlue) Scheduler() glue.Scheduler {
 	return nil
 }
 func (m *mockGlue) ReshadowCryptoWorkers() {}
+func (m *mockGlue) Clock() epochtime.Clock {
+	return epochtime.WallClock
+}
 
 // TestMemoryQueueBulkEnqueue verifies that the queue orders packets by delay
 func TestMemoryQueueBulkEnqueue(t *testing.T) {
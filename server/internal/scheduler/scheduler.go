@@ -19,9 +19,9 @@ package scheduler
 
 import (
 	"math"
+	"sync/atomic"
 	"time"
 
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/internal/constants"
 	"github.com/katzenpost/katzenpost/server/internal/debug"
@@ -37,6 +37,7 @@ type queueImpl interface {
 	Peek() (time.Time, *packet.Packet)
 	Pop()
 	BulkEnqueue([]*packet.Packet)
+	Len() int
 }
 
 type scheduler struct {
@@ -49,6 +50,8 @@ type scheduler struct {
 	inCh       *channels.InfiniteChannel
 	outCh      *channels.BatchingChannel
 	maxDelayCh chan uint64
+
+	queueLen atomic.Int64
 }
 
 func (sch *scheduler) Halt() {
@@ -65,10 +68,14 @@ func (sch *scheduler) OnPacket(pkt *packet.Packet) {
 	sch.inCh.In() <- pkt
 }
 
+// QueueLen returns the number of packets waiting to be dispatched.
+func (sch *scheduler) QueueLen() int {
+	return sch.inCh.Len() + int(sch.queueLen.Load())
+}
+
 func (sch *scheduler) worker() {
-	var absoluteMaxDelay = epochtime.Period * constants.NumMixKeys
+	var absoluteMaxDelay = sch.glue.Clock().Period() * constants.NumMixKeys
 
-	timerSlack := time.Duration(sch.glue.Config().Debug.SchedulerSlack) * time.Millisecond
 	timer := time.NewTimer(math.MaxInt64)
 	defer timer.Stop()
 
@@ -146,6 +153,9 @@ func (sch *scheduler) worker() {
 			<-timer.C
 		}
 
+		// The Debug knobs are read on every wakeup, as they may be changed
+		// when the configuration is reloaded.
+		timerSlack := time.Duration(sch.glue.Config().Debug.SchedulerSlack) * time.Millisecond
 		nrBurst, maxBurst := 0, sch.glue.Config().Debug.SchedulerMaxBurst
 		for {
 			// Peek at the next packet in the queue.
@@ -199,6 +209,7 @@ func (sch *scheduler) worker() {
 				sch.glue.Connector().DispatchPacket(pkt)
 			}
 		}
+		sch.queueLen.Store(int64(sch.q.Len()))
 	}
 
 	// NOTREACHED
@@ -20,12 +20,14 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/server/config"
 	"github.com/katzenpost/katzenpost/server/spool"
 	"github.com/katzenpost/katzenpost/server/userdb"
 )
@@ -38,10 +40,15 @@ const (
 	pgxTagUserSetAuthKey  = "user_set_authentication_key"
 	pgxTagUserGetIdentKey = "user_get_identity_key"
 	pgxTagUserSetIdentKey = "user_set_identity_key"
+	pgxTagUserList        = "user_list"
 	pgxTagSpoolStore      = "spool_store"
 	pgxTagSpoolGet        = "spool_get"
+	pgxTagSpoolExpire     = "spool_expire"
+	pgxTagSpoolUsage      = "spool_usage"
+	pgxTagSpoolUsageAll   = "spool_usage_all"
 
-	pgCodeNoDataFound = "P0002" // `no_data_found`
+	pgCodeNoDataFound                = "P0002" // `no_data_found`
+	pgCodeConfigurationLimitExceeded = "53400" // `configuration_limit_exceeded`
 )
 
 type pgxImpl struct {
@@ -63,8 +70,8 @@ func (p *pgxImpl) UserDB() (userdb.UserDB, error) {
 	return newPgxUserDB(p), nil
 }
 
-func (p *pgxImpl) Spool() spool.Spool {
-	return newPgxSpool(p)
+func (p *pgxImpl) Spool(q *spool.Quota, onDrop func(n int)) spool.Spool {
+	return newPgxSpool(p, q, onDrop)
 }
 
 func (p *pgxImpl) Close() {
@@ -96,10 +103,7 @@ func (p *pgxImpl) Log(level pgx.LogLevel, msg string, data map[string]interface{
 }
 
 func (p *pgxImpl) initMetadata() error {
-	const (
-		metadataQuery    = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
-		pgxSchemaVersion = 0
-	)
+	const metadataQuery = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
 
 	var schemaVersion int
 	err := p.pool.QueryRow(metadataQuery).Scan(&schemaVersion, &p.spoolOnly)
@@ -109,7 +113,7 @@ func (p *pgxImpl) initMetadata() error {
 	case err != nil:
 		return fmt.Errorf("sql/pgx: metadata_get() failed: %v", err)
 	default:
-		if schemaVersion != pgxSchemaVersion {
+		if schemaVersion != pgxSchemaVersion() {
 			return fmt.Errorf("sql/pgx: invalid schema version: %v", schemaVersion)
 		}
 	}
@@ -126,8 +130,12 @@ func (p *pgxImpl) initStatements() error {
 		{pgxTagUserSetAuthKey, "SELECT user_set_authentication_key($1, $2, $3);"},
 		{pgxTagUserGetIdentKey, "SELECT user_get_identity_key($1);"},
 		{pgxTagUserSetIdentKey, "SELECT user_set_identity_key($1, $2);"},
-		{pgxTagSpoolStore, "SELECT spool_store($1, $2, $3);"},
+		{pgxTagUserList, "SELECT * FROM user_list();"},
+		{pgxTagSpoolStore, "SELECT spool_store($1, $2, $3, $4, $5, $6);"},
 		{pgxTagSpoolGet, "SELECT * FROM spool_get($1, $2) AS (message_body bytea, surb_id bytea, remaining integer);"},
+		{pgxTagSpoolExpire, "SELECT spool_expire($1);"},
+		{pgxTagSpoolUsage, "SELECT count(*), coalesce(sum(octet_length(message_body)), 0) FROM spool WHERE user_id = (SELECT user_id FROM users WHERE users.user_name = $1);"},
+		{pgxTagSpoolUsageAll, "SELECT users.user_name, count(*), sum(octet_length(spool.message_body)) FROM spool JOIN users ON spool.user_id = users.user_id GROUP BY users.user_name;"},
 	}
 
 	for _, v := range stmts {
@@ -145,12 +153,15 @@ func (p *pgxImpl) doUserDelete(u []byte) error {
 	return err
 }
 
-func newPgxImpl(db *SQLDB, dataSourceName string) (dbImpl, error) {
+func newPgxImpl(db *SQLDB, sCfg *config.SQLDB, numWorkers int, logLevel string) (dbImpl, error) {
 	// The pgx connection pool code requires at least 2 conns, and internally
 	// will default to 5 if unspecified.  At a minimum all of the provider
 	// workers should be able to hit up the database simultaneously, while
 	// allowing for sufficient connections to authenticate.
-	numConns := 2 * db.glue.Config().Debug.NumProviderWorkers
+	numConns := sCfg.MaxConnections
+	if numConns == 0 {
+		numConns = 2 * numWorkers
+	}
 	if numConns < 5 {
 		numConns = 5
 	}
@@ -159,15 +170,16 @@ func newPgxImpl(db *SQLDB, dataSourceName string) (dbImpl, error) {
 		d: db,
 	}
 
-	connCfg, err := pgx.ParseConnectionString(dataSourceName)
+	connCfg, err := pgx.ParseConnectionString(sCfg.DataSourceName)
 	if err != nil {
 		return nil, err
 	}
 	connCfg.Logger = p
-	connCfg.LogLevel = toPgxLogLevel(p.d.glue.Config().Logging.Level)
+	connCfg.LogLevel = toPgxLogLevel(logLevel)
 	poolCfg := pgx.ConnPoolConfig{
 		ConnConfig:     connCfg,
 		MaxConnections: numConns,
+		AcquireTimeout: time.Duration(sCfg.AcquireTimeout) * time.Millisecond,
 	}
 
 	isOk := false
@@ -182,6 +194,9 @@ func newPgxImpl(db *SQLDB, dataSourceName string) (dbImpl, error) {
 	if p.pool, err = pgx.NewConnPool(poolCfg); err != nil {
 		return nil, err
 	}
+	if err = p.migrate(sCfg.SpoolOnly); err != nil {
+		return nil, err
+	}
 	if err = p.initMetadata(); err != nil {
 		return nil, err
 	}
@@ -297,6 +312,9 @@ func newPgxUserDB(p *pgxImpl) *pgxUserDB {
 
 type pgxSpool struct {
 	pgx *pgxImpl
+
+	quota  *spool.Quota
+	onDrop func(n int)
 }
 
 func (s *pgxSpool) StoreMessage(u, msg []byte) error {
@@ -311,8 +329,24 @@ func (s *pgxSpool) StoreSURBReply(u []byte, id *[constants.SURBIDLength]byte, ms
 }
 
 func (s *pgxSpool) doStore(u, id, msg []byte) error {
-	_, err := s.pgx.pool.Exec(pgxTagSpoolStore, u, id, msg)
-	return err
+	var maxMessages, maxBytes int32
+	var dropOldest bool
+	if s.quota != nil {
+		maxMessages, maxBytes = int32(s.quota.MaxMessages), int32(s.quota.MaxBytes)
+		dropOldest = s.quota.DropOldest
+	}
+
+	var dropped int32
+	if err := s.pgx.pool.QueryRow(pgxTagSpoolStore, u, id, msg, maxMessages, maxBytes, dropOldest).Scan(&dropped); err != nil {
+		if isPgError(err, pgCodeConfigurationLimitExceeded) {
+			return spool.ErrQuotaExceeded
+		}
+		return err
+	}
+	if dropped > 0 && s.onDrop != nil {
+		s.onDrop(int(dropped))
+	}
+	return nil
 }
 
 func (s *pgxSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
@@ -323,6 +357,51 @@ func (s *pgxSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining in
 	return
 }
 
+func (s *pgxSpool) Usage(u []byte) (*spool.Usage, error) {
+	var nrMessages, nrBytes int64
+	if err := s.pgx.pool.QueryRow(pgxTagSpoolUsage, u).Scan(&nrMessages, &nrBytes); err != nil {
+		return nil, err
+	}
+	return &spool.Usage{
+		Messages: int(nrMessages),
+		Bytes:    int(nrBytes),
+	}, nil
+}
+
+func (s *pgxSpool) AllUsage() (map[string]*spool.Usage, error) {
+	rows, err := s.pgx.pool.Query(pgxTagSpoolUsageAll)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := make(map[string]*spool.Usage)
+	for rows.Next() {
+		var u []byte
+		var nrMessages, nrBytes int64
+		if err = rows.Scan(&u, &nrMessages, &nrBytes); err != nil {
+			return nil, err
+		}
+		usages[string(u)] = &spool.Usage{
+			Messages: int(nrMessages),
+			Bytes:    int(nrBytes),
+		}
+	}
+	return usages, rows.Err()
+}
+
+func (s *pgxSpool) Expire() (int, error) {
+	if s.quota == nil || s.quota.MessageTTL <= 0 {
+		return 0, nil
+	}
+
+	var expired int32
+	if err := s.pgx.pool.QueryRow(pgxTagSpoolExpire, int32(s.quota.MessageTTL/time.Second)).Scan(&expired); err != nil {
+		return 0, err
+	}
+	return int(expired), nil
+}
+
 func (s *pgxSpool) Remove(u []byte) error {
 	// Removal is handled by removing from the UserDB, iff the database
 	// is acting as both.
@@ -334,8 +413,11 @@ func (s *pgxSpool) Remove(u []byte) error {
 }
 
 func (s *pgxSpool) VacuumExpired(udb userdb.UserDB, ignoreIdentities map[[constants.RecipientIDLength]byte]interface{}) error {
-	panic("failure! VacuumExpired not implemented for pgxSpool :(")
-	return nil // XXX *le sigh* implement me
+	// A frontend only knows which clients are connected to itself, so
+	// it can't tell which ephemeral clients are expired when the database
+	// is shared, and the configuration refuses ephemeral clients with
+	// this backend.
+	return errors.New("pgx/spool: VacuumExpired() not supported")
 }
 
 func (s *pgxSpool) Vacuum(udb userdb.UserDB) error {
@@ -345,7 +427,34 @@ func (s *pgxSpool) Vacuum(udb userdb.UserDB) error {
 		return nil
 	}
 
-	s.pgx.d.log.Errorf("Vacuum() not supported yet.") // TODO
+	rows, err := s.pgx.pool.Query(pgxTagUserList)
+	if err != nil {
+		return err
+	}
+	var users [][]byte
+	for rows.Next() {
+		var u []byte
+		if err = rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		// Note: If the provided UserDB doesn't do something intelligent
+		// like cache the valid users, this will really suck.
+		if udb.Exists(u) {
+			continue
+		}
+		if err = s.pgx.doUserDelete(u); err != nil && !isPgNoDataFound(err) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -353,9 +462,11 @@ func (s *pgxSpool) Close() {
 	// Nothing to do.
 }
 
-func newPgxSpool(p *pgxImpl) *pgxSpool {
+func newPgxSpool(p *pgxImpl, q *spool.Quota, onDrop func(n int)) *pgxSpool {
 	return &pgxSpool{
-		pgx: p,
+		pgx:    p,
+		quota:  q,
+		onDrop: onDrop,
 	}
 }
 
@@ -375,13 +486,18 @@ func toPgxLogLevel(cfgLevel string) pgx.LogLevel {
 }
 
 func isPgNoDataFound(err error) bool {
-	if pgxErr, ok := err.(pgx.PgError); ok {
-		if pgxErr.Code == pgCodeNoDataFound {
-			return true
-		}
+	if isPgError(err, pgCodeNoDataFound) {
+		return true
 	}
 	if err == pgx.ErrNoRows { // Treat ErrNoRows as `no_data_found`.
 		return true
 	}
 	return false
 }
+
+func isPgError(err error, code string) bool {
+	if pgxErr, ok := err.(pgx.PgError); ok {
+		return pgxErr.Code == code
+	}
+	return false
+}
@@ -0,0 +1,385 @@
+// pgx_migrations.go - Postgresql schema migrations.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx"
+)
+
+// pgxMigrationLock is the advisory lock held while migrating the schema,
+// so that provider frontends sharing a database don't race.
+const pgxMigrationLock = 0x6b61747a // "katz"
+
+// pgxMigration is a step in the evolution of the database schema.
+type pgxMigration struct {
+	description string
+	stmts       func(spoolOnly bool) []string
+}
+
+// pgxMigrations is the schema history.  Migration 0 creates the schema,
+// and every following migration i upgrades schema version i-1 to i.
+// Migrations must never be edited once released, only appended.
+//
+// All Katzenpost server -> RDBMS interactions happen via functions so
+// that:
+//
+//   - The user the server uses can have an extremely limited set of access
+//     priviledges to prevent horrific things from happening.
+//   - People that are good at database development can contribute without
+//     having to deal with the server code at all.
+var pgxMigrations = []pgxMigration{
+	{
+		description: "create the schema",
+		stmts: func(spoolOnly bool) []string {
+			stmts := []string{
+				`DO $$
+				BEGIN
+				  -- INSERT ... ON CONFLICT [UPDATE, DO NOTHING] requires >= 9.5.
+				  IF current_setting('server_version_num')::integer < 90500 THEN
+				    RAISE 'Insufficiently recent database: %', current_setting('server_version_num') USING HINT = '9.5 or newer is requred';
+				  END IF;
+				END $$;`,
+
+				`CREATE TABLE metadata (
+				  schema_version smallint NOT NULL,
+				  spool_only     boolean NOT NULL
+				);`,
+				fmt.Sprintf("INSERT INTO metadata(schema_version, spool_only) VALUES (0, %t);", spoolOnly),
+
+				`CREATE TABLE users (
+				  user_id    bigserial PRIMARY KEY,
+				  user_name  bytea NOT NULL UNIQUE
+				);`,
+
+				`CREATE TABLE spool (
+				  message_id   bigserial PRIMARY KEY,
+				  user_id      bigint REFERENCES users ON DELETE CASCADE,
+				  surb_id      bytea,
+				  message_body bytea NOT NULL
+				);`,
+				`CREATE INDEX ON spool(user_id);`,
+
+				`CREATE FUNCTION metadata_get() RETURNS record AS $METADATA_GET$
+				DECLARE
+				  ret record;
+				BEGIN
+				  SELECT * INTO STRICT ret FROM metadata;
+				  RETURN ret;
+				END $METADATA_GET$ LANGUAGE plpgsql STABLE;`,
+
+				`CREATE FUNCTION user_delete(user_name bytea) RETURNS void AS $USER_DELETE$
+				DECLARE
+				  deleted integer;
+				BEGIN
+				  DELETE FROM users WHERE users.user_name = $1 RETURNING 1 INTO STRICT deleted;
+				END $USER_DELETE$ LANGUAGE plpgsql;`,
+
+				`CREATE FUNCTION spool_get(user_name bytea, advance boolean) RETURNS record AS $SPOOL_GET$
+				DECLARE
+				  spool_cursor refcursor;
+				  spool_row    record;
+				  surb_id      bytea;
+				  message_body bytea;
+				  remaining    integer;
+				  ret          record;
+				BEGIN
+				  OPEN spool_cursor NO SCROLL FOR SELECT * from spool WHERE user_id = (SELECT user_id FROM users WHERE users.user_name = $1) ORDER BY message_id FOR UPDATE;
+
+				  -- Set the output to something sane.
+				  ret := (NULL::bytea, NULL::bytea, 0);
+
+				  -- Grab the first message.
+				  FETCH spool_cursor INTO spool_row;
+				  IF NOT FOUND THEN
+				    -- The user's spool is empty, bail out.
+				    RETURN ret;
+				  ELSIF $2 = true THEN
+				    -- Delete the first row, and advance the cursor.
+				    DELETE FROM spool WHERE CURRENT OF spool_cursor;
+				    FETCH spool_cursor INTO spool_row;
+				    IF NOT FOUND THEN
+				      -- The delete drained the user's spool, bail out.
+				      RETURN ret;
+				    END IF;
+				  END IF;
+
+				  -- Copy the (new) head of the user's spool into the output.
+				  surb_id := spool_row.surb_id;
+				  message_body := spool_row.message_body;
+
+				  -- Figure out if there is at least one more message in the user's spool.
+				  MOVE spool_cursor;
+				  IF FOUND THEN
+				    remaining := 1;
+				  ELSE
+				    remaining := 0;
+				  END IF;
+
+				  ret := (message_body, surb_id, remaining);
+				  RETURN ret;
+				END $SPOOL_GET$ LANGUAGE plpgsql;`,
+			}
+
+			if spoolOnly {
+				return append(stmts,
+					`CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea) RETURNS void AS $SPOOL_STORE$
+					BEGIN
+					  -- Can't use RETURNING to get the user_id, because when nothing is
+					  -- updated, nothing is returned.
+					  INSERT INTO users(user_id, user_name) VALUES (DEFAULT, $1) ON CONFLICT DO NOTHING;
+					  INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, (SELECT user_id FROM users WHERE users.user_name = $1), $2, $3);
+					END $SPOOL_STORE$ LANGUAGE plpgsql;`,
+				)
+			}
+
+			// If the user table is an actual user database, then it needs a
+			// column for the user's authentication key and identity key.
+			return append(stmts,
+				`ALTER TABLE users ADD COLUMN authentication_key bytea NOT NULL;`,
+				`ALTER TABLE users ADD COLUMN identity_key bytea;`,
+
+				`CREATE FUNCTION user_get_authentication_key(user_name bytea) RETURNS bytea AS $USER_GET_AUTH$
+				DECLARE
+				  ret bytea;
+				BEGIN
+				  SELECT authentication_key INTO STRICT ret FROM users WHERE users.user_name = $1;
+				  RETURN ret;
+				END $USER_GET_AUTH$ LANGUAGE plpgsql STABLE;`,
+
+				`CREATE FUNCTION user_set_authentication_key(user_name bytea, authentication_key bytea, is_update boolean) RETURNS void AS $USER_SET_AUTH$
+				BEGIN
+				  IF $3 = true THEN
+				    UPDATE users SET authentication_key = $2 WHERE user_name = $1;
+				    IF NOT FOUND THEN
+				      RAISE SQLSTATE 'P0002'; -- `+"`no_data_found`"+`
+				    END IF;
+				  ELSE
+				    INSERT INTO users(user_id, user_name, authentication_key) VALUES (DEFAULT, $1, $2);
+				  END IF;
+				END $USER_SET_AUTH$ LANGUAGE plpgsql;`,
+
+				`CREATE FUNCTION user_get_identity_key(user_name bytea) RETURNS bytea AS $USER_GET_IDENT$
+				DECLARE
+				  ret bytea;
+				BEGIN
+				  SELECT identity_key INTO STRICT ret FROM users WHERE users.user_name = $1;
+				  RETURN ret;
+				END $USER_GET_IDENT$ LANGUAGE plpgsql STABLE;`,
+
+				`CREATE FUNCTION user_set_identity_key(user_name bytea, identity_key bytea) RETURNS void AS $USER_SET_IDENT$
+				BEGIN
+				  UPDATE users SET identity_key = $2 WHERE users.user_name = $1;
+				  IF NOT FOUND THEN
+				    RAISE SQLSTATE 'P0002'; -- `+"`no_data_found`"+`
+				  END IF;
+				END $USER_SET_IDENT$ LANGUAGE plpgsql;`,
+
+				`CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea) RETURNS void AS $SPOOL_STORE$
+				BEGIN
+				  INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, (SELECT user_id FROM users WHERE users.user_name = $1), $2, $3);
+				END $SPOOL_STORE$ LANGUAGE plpgsql;`,
+			)
+		},
+	},
+	{
+		description: "record when messages are stored, and enforce spool quotas",
+		stmts: func(spoolOnly bool) []string {
+			return []string{
+				`ALTER TABLE spool ADD COLUMN stored_at timestamptz NOT NULL DEFAULT now();`,
+				`CREATE INDEX ON spool(stored_at);`,
+
+				`DROP FUNCTION spool_store(bytea, bytea, bytea);`,
+
+				// spool_store() returns the number of messages dropped to
+				// make room for the new one.  The user's row is locked, so
+				// that concurrent stores by other frontends see a consistent
+				// quota.
+				`CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea, max_messages integer, max_bytes integer, drop_oldest boolean) RETURNS integer AS $SPOOL_STORE$
+				DECLARE
+				  uid         bigint;
+				  nr_messages integer;
+				  nr_bytes    bigint;
+				  dropped     integer := 0;
+				  oldest      record;
+				BEGIN
+				  IF (SELECT spool_only FROM metadata) THEN
+				    INSERT INTO users(user_id, user_name) VALUES (DEFAULT, $1) ON CONFLICT DO NOTHING;
+				  END IF;
+				  SELECT user_id INTO uid FROM users WHERE users.user_name = $1 FOR UPDATE;
+
+				  IF $4 > 0 OR $5 > 0 THEN
+				    IF $5 > 0 AND octet_length($3) > $5 THEN
+				      RAISE SQLSTATE '53400'; -- ` + "`configuration_limit_exceeded`" + `
+				    END IF;
+				    SELECT count(*), coalesce(sum(octet_length(message_body)), 0) INTO nr_messages, nr_bytes FROM spool WHERE spool.user_id = uid;
+				    FOR oldest IN SELECT message_id, octet_length(message_body) AS len FROM spool WHERE spool.user_id = uid ORDER BY message_id LOOP
+				      EXIT WHEN NOT (($4 > 0 AND nr_messages + 1 > $4) OR ($5 > 0 AND nr_bytes + octet_length($3) > $5));
+				      IF NOT $6 THEN
+				        RAISE SQLSTATE '53400'; -- ` + "`configuration_limit_exceeded`" + `
+				      END IF;
+				      DELETE FROM spool WHERE spool.message_id = oldest.message_id;
+				      nr_messages := nr_messages - 1;
+				      nr_bytes := nr_bytes - oldest.len;
+				      dropped := dropped + 1;
+				    END LOOP;
+				  END IF;
+
+				  INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, uid, $2, $3);
+				  RETURN dropped;
+				END $SPOOL_STORE$ LANGUAGE plpgsql;`,
+
+				`CREATE FUNCTION spool_expire(ttl integer) RETURNS integer AS $SPOOL_EXPIRE$
+				DECLARE
+				  expired integer;
+				BEGIN
+				  DELETE FROM spool WHERE stored_at < now() - $1 * interval '1 second';
+				  GET DIAGNOSTICS expired = ROW_COUNT;
+				  RETURN expired;
+				END $SPOOL_EXPIRE$ LANGUAGE plpgsql;`,
+
+				`CREATE FUNCTION user_list() RETURNS SETOF bytea AS $USER_LIST$
+				BEGIN
+				  RETURN QUERY SELECT users.user_name FROM users;
+				END $USER_LIST$ LANGUAGE plpgsql STABLE;`,
+			}
+		},
+	},
+	{
+		description: "pop the message last returned to a user instead of the oldest",
+		stmts: func(spoolOnly bool) []string {
+			return []string{
+				`ALTER TABLE users ADD COLUMN spool_head bigint;`,
+
+				// Quotas and expiry delete the oldest messages, which may
+				// include the one last returned, so advancing deletes that
+				// message by ID, and never one the user has not seen.
+				`CREATE OR REPLACE FUNCTION spool_get(user_name bytea, advance boolean) RETURNS record AS $SPOOL_GET$
+				DECLARE
+				  uid       bigint;
+				  head      bigint;
+				  spool_row record;
+				  remaining integer := 0;
+				  ret       record;
+				BEGIN
+				  -- Set the output to something sane.
+				  ret := (NULL::bytea, NULL::bytea, 0);
+
+				  SELECT users.user_id, users.spool_head INTO uid, head FROM users WHERE users.user_name = $1 FOR UPDATE;
+				  IF NOT FOUND THEN
+				    RETURN ret;
+				  END IF;
+				  IF $2 = true AND head IS NOT NULL THEN
+				    DELETE FROM spool WHERE spool.message_id = head;
+				  END IF;
+
+				  SELECT spool.message_id, spool.surb_id, spool.message_body INTO spool_row FROM spool WHERE spool.user_id = uid ORDER BY spool.message_id LIMIT 1;
+				  IF NOT FOUND THEN
+				    -- The user's spool is empty, bail out.
+				    UPDATE users SET spool_head = NULL WHERE users.user_id = uid;
+				    RETURN ret;
+				  END IF;
+				  UPDATE users SET spool_head = spool_row.message_id WHERE users.user_id = uid;
+
+				  -- Figure out if there is at least one more message in the user's spool.
+				  IF EXISTS (SELECT 1 FROM spool WHERE spool.user_id = uid AND spool.message_id > spool_row.message_id) THEN
+				    remaining := 1;
+				  END IF;
+
+				  ret := (spool_row.message_body, spool_row.surb_id, remaining);
+				  RETURN ret;
+				END $SPOOL_GET$ LANGUAGE plpgsql;`,
+			}
+		},
+	},
+}
+
+// pgxSchemaVersion returns the schema version this code requires.
+func pgxSchemaVersion() int {
+	return len(pgxMigrations) - 1
+}
+
+// pgxMigrationTx is the part of a pgx.Tx that the migrations use, so that
+// they can be run against a stand-in for the database.
+type pgxMigrationTx interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+	QueryRow(sql string, args ...interface{}) pgxRow
+}
+
+// pgxRow is a row returned by pgxMigrationTx.QueryRow.
+type pgxRow interface {
+	Scan(dest ...interface{}) error
+}
+
+// pgxTx adapts a pgx.Tx to pgxMigrationTx.
+type pgxTx struct {
+	*pgx.Tx
+}
+
+func (tx pgxTx) QueryRow(sql string, args ...interface{}) pgxRow {
+	return tx.Tx.QueryRow(sql, args...)
+}
+
+// migrate creates or upgrades the database schema to pgxSchemaVersion.
+// The spoolOnly flag only applies when the schema is created.
+func (p *pgxImpl) migrate(spoolOnly bool) error {
+	tx, err := p.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = p.migrateTx(pgxTx{tx}, spoolOnly); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateTx runs the migrations within tx.
+func (p *pgxImpl) migrateTx(tx pgxMigrationTx, spoolOnly bool) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1);", pgxMigrationLock); err != nil {
+		return fmt.Errorf("sql/pgx: failed to acquire migration lock: %v", err)
+	}
+
+	var hasMetadata bool
+	if err := tx.QueryRow("SELECT to_regclass('metadata') IS NOT NULL;").Scan(&hasMetadata); err != nil {
+		return err
+	}
+	version := -1
+	if hasMetadata {
+		if err := tx.QueryRow("SELECT schema_version, spool_only FROM metadata;").Scan(&version, &spoolOnly); err != nil {
+			return fmt.Errorf("sql/pgx: failed to query schema version: %v", err)
+		}
+	}
+	if version > pgxSchemaVersion() {
+		return fmt.Errorf("sql/pgx: schema version %v is newer than supported (%v)", version, pgxSchemaVersion())
+	}
+	if version == pgxSchemaVersion() {
+		return nil
+	}
+
+	for v := version + 1; v <= pgxSchemaVersion(); v++ {
+		p.d.log.Noticef("Migrating database schema to version %v: %v", v, pgxMigrations[v].description)
+		for _, stmt := range pgxMigrations[v].stmts(spoolOnly) {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("sql/pgx: schema version %v migration failed: %v", v, err)
+			}
+		}
+	}
+	_, err := tx.Exec("UPDATE metadata SET schema_version = $1;", pgxSchemaVersion())
+	return err
+}
@@ -0,0 +1,340 @@
+// pgx_test.go - Postgresql backend tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/server/config"
+	"github.com/katzenpost/katzenpost/server/spool"
+	"github.com/katzenpost/katzenpost/server/userdb"
+)
+
+// testDSNEnv names the environment variable holding the data source name
+// of a disposable Postgresql database to run the pgx tests against.  The
+// tests wipe the database's public schema.
+const testDSNEnv = "KATZENPOST_TEST_PGX_DSN"
+
+func TestPgxMigrations(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(len(pgxMigrations)-1, pgxSchemaVersion())
+	for v, m := range pgxMigrations {
+		require.NotEmpty(m.description, "migration %v", v)
+		for _, spoolOnly := range []bool{false, true} {
+			stmts := m.stmts(spoolOnly)
+			require.NotEmpty(stmts, "migration %v", v)
+			for _, stmt := range stmts {
+				require.NotContains(stmt, "\\", "migration %v has psql meta-commands", v)
+			}
+		}
+	}
+
+	// The schema is created at version 0, the rest is up to migrate().
+	for _, spoolOnly := range []bool{false, true} {
+		insert := fmt.Sprintf("VALUES (0, %t);", spoolOnly)
+		found := false
+		for _, stmt := range pgxMigrations[0].stmts(spoolOnly) {
+			found = found || strings.Contains(stmt, insert)
+		}
+		require.True(found, "spoolOnly: %v", spoolOnly)
+	}
+}
+
+// fakeMigrationTx stands in for the database in the migrations.  It keeps
+// the metadata table, and records the other statements.
+type fakeMigrationTx struct {
+	locked        bool
+	hasMetadata   bool
+	schemaVersion int
+	spoolOnly     bool
+
+	stmts  []string
+	failOn string
+}
+
+func (tx *fakeMigrationTx) Exec(sql string, args ...interface{}) (pgx.CommandTag, error) {
+	if sql == "SELECT pg_advisory_xact_lock($1);" {
+		tx.locked = true
+		return "SELECT 1", nil
+	}
+	if !tx.locked {
+		return "", errors.New("migration lock not held")
+	}
+	if tx.failOn != "" && strings.Contains(sql, tx.failOn) {
+		return "", errors.New("statement failed")
+	}
+
+	switch {
+	case strings.HasPrefix(sql, "UPDATE metadata SET schema_version"):
+		tx.schemaVersion = args[0].(int)
+		return "UPDATE 1", nil
+	case strings.HasPrefix(sql, "CREATE TABLE metadata"):
+		tx.hasMetadata = true
+	case strings.HasPrefix(sql, "INSERT INTO metadata"):
+		if _, err := fmt.Sscanf(sql, "INSERT INTO metadata(schema_version, spool_only) VALUES (%d, %t);", &tx.schemaVersion, &tx.spoolOnly); err != nil {
+			return "", err
+		}
+	}
+	tx.stmts = append(tx.stmts, sql)
+	return "", nil
+}
+
+func (tx *fakeMigrationTx) QueryRow(sql string, args ...interface{}) pgxRow {
+	switch sql {
+	case "SELECT to_regclass('metadata') IS NOT NULL;":
+		return &fakeRow{vals: []interface{}{tx.hasMetadata}}
+	case "SELECT schema_version, spool_only FROM metadata;":
+		if !tx.hasMetadata {
+			return &fakeRow{err: errors.New("relation \"metadata\" does not exist")}
+		}
+		return &fakeRow{vals: []interface{}{tx.schemaVersion, tx.spoolOnly}}
+	}
+	return &fakeRow{err: fmt.Errorf("unexpected query: %v", sql)}
+}
+
+type fakeRow struct {
+	vals []interface{}
+	err  error
+}
+
+func (r *fakeRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	for i, v := range r.vals {
+		switch d := dest[i].(type) {
+		case *bool:
+			*d = v.(bool)
+		case *int:
+			*d = v.(int)
+		default:
+			return fmt.Errorf("unsupported destination: %T", d)
+		}
+	}
+	return nil
+}
+
+// migrationStmts returns the statements of the migrations from version
+// from on.
+func migrationStmts(from int, spoolOnly bool) []string {
+	var stmts []string
+	for _, m := range pgxMigrations[from:] {
+		stmts = append(stmts, m.stmts(spoolOnly)...)
+	}
+	return stmts
+}
+
+func TestPgxMigrate(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	p := &pgxImpl{
+		d: &SQLDB{log: logBackend.GetLogger("sqldb")},
+	}
+
+	// A new database gets every migration.
+	for _, spoolOnly := range []bool{false, true} {
+		tx := new(fakeMigrationTx)
+		require.NoError(p.migrateTx(tx, spoolOnly))
+		require.Equal(migrationStmts(0, spoolOnly), tx.stmts)
+		require.Equal(pgxSchemaVersion(), tx.schemaVersion)
+		require.Equal(spoolOnly, tx.spoolOnly)
+
+		// After which it is up to date.
+		tx.stmts = nil
+		require.NoError(p.migrateTx(tx, !spoolOnly))
+		require.Empty(tx.stmts)
+		require.Equal(spoolOnly, tx.spoolOnly)
+	}
+
+	// An existing database gets the migrations it is missing, for the
+	// kind of database it was created as.
+	tx := &fakeMigrationTx{hasMetadata: true, schemaVersion: 0, spoolOnly: true}
+	require.NoError(p.migrateTx(tx, false))
+	require.Equal(migrationStmts(1, true), tx.stmts)
+	require.Equal(pgxSchemaVersion(), tx.schemaVersion)
+
+	// A database from the future is left alone.
+	tx = &fakeMigrationTx{hasMetadata: true, schemaVersion: pgxSchemaVersion() + 1}
+	require.Error(p.migrateTx(tx, false))
+	require.Empty(tx.stmts)
+
+	// A failed migration is reported, and the schema version not bumped.
+	tx = &fakeMigrationTx{hasMetadata: true, schemaVersion: 0, failOn: "spool_expire"}
+	err = p.migrateTx(tx, false)
+	require.ErrorContains(err, "schema version 1 migration failed")
+	require.Equal(0, tx.schemaVersion)
+}
+
+func newTestPgx(t *testing.T, dsn string, spoolOnly bool) *pgxImpl {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+
+	db := &SQLDB{
+		log: logBackend.GetLogger("sqldb"),
+	}
+	impl, err := newPgxImpl(db, &config.SQLDB{
+		Backend:        implPgx,
+		DataSourceName: dsn,
+		SpoolOnly:      spoolOnly,
+	}, 1, "DEBUG")
+	require.NoError(t, err)
+	db.impl = impl
+	return impl.(*pgxImpl)
+}
+
+func resetTestPgx(t *testing.T, dsn string) {
+	connCfg, err := pgx.ParseConnectionString(dsn)
+	require.NoError(t, err)
+	conn, err := pgx.Connect(connCfg)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public;")
+	require.NoError(t, err)
+}
+
+// TestPgx exercises the stored procedures, which unlike the migrations
+// need a real database.
+func TestPgx(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%v not set", testDSNEnv)
+	}
+	require := require.New(t)
+
+	resetTestPgx(t, dsn)
+
+	// Two frontends sharing the database, the second of which finds the
+	// schema already migrated.
+	p1 := newTestPgx(t, dsn, false)
+	defer p1.Close()
+	p2 := newTestPgx(t, dsn, false)
+	defer p2.Close()
+	require.False(p1.IsSpoolOnly())
+
+	udb1, err := p1.UserDB()
+	require.NoError(err)
+	udb2, err := p2.UserDB()
+	require.NoError(err)
+
+	u := []byte("alice")
+	_, linkKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	require.False(udb1.Exists(u))
+	require.NoError(udb1.Add(u, linkKey, false))
+	require.True(udb2.Exists(u))
+	require.True(udb2.IsValid(u, linkKey))
+	_, err = udb2.Identity(u)
+	require.ErrorIs(err, userdb.ErrNoIdentity)
+
+	// Messages stored by one frontend are retrieved by the other.
+	s1 := p1.Spool(&spool.Quota{MaxMessages: 2}, nil)
+	s2 := p2.Spool(nil, nil)
+	require.NoError(s1.StoreMessage(u, []byte("one")))
+	require.NoError(s1.StoreMessage(u, []byte("two")))
+	require.ErrorIs(s1.StoreMessage(u, []byte("three")), spool.ErrQuotaExceeded)
+
+	usage, err := s2.Usage(u)
+	require.NoError(err)
+	require.Equal(&spool.Usage{Messages: 2, Bytes: 6}, usage)
+
+	msg, _, remaining, err := s2.Get(u, false)
+	require.NoError(err)
+	require.Equal([]byte("one"), msg)
+	require.Equal(1, remaining)
+
+	// Dropping the oldest message makes room.
+	dropped := 0
+	s3 := p1.Spool(&spool.Quota{MaxMessages: 2, DropOldest: true}, func(n int) {
+		dropped += n
+	})
+	require.NoError(s3.StoreMessage(u, []byte("three")))
+	require.Equal(1, dropped)
+
+	// Advancing past the dropped message does not drop the next one,
+	// which the user has not seen yet.
+	msg, _, _, err = s2.Get(u, true)
+	require.NoError(err)
+	require.Equal([]byte("two"), msg)
+
+	usages, err := s2.AllUsage()
+	require.NoError(err)
+	require.Equal(map[string]*spool.Usage{"alice": {Messages: 2, Bytes: 8}}, usages)
+
+	// Expire everything.
+	s4 := p2.Spool(&spool.Quota{MessageTTL: time.Second}, nil)
+	time.Sleep(2 * time.Second)
+	n, err := s4.Expire()
+	require.NoError(err)
+	require.Equal(2, n)
+	msg, _, remaining, err = s1.Get(u, true)
+	require.NoError(err)
+	require.Nil(msg)
+	require.Equal(0, remaining)
+
+	require.NoError(udb1.Remove(u))
+	require.False(udb2.Exists(u))
+}
+
+func TestPgxSpoolOnly(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%v not set", testDSNEnv)
+	}
+	require := require.New(t)
+
+	resetTestPgx(t, dsn)
+	p := newTestPgx(t, dsn, true)
+	defer p.Close()
+	require.True(p.IsSpoolOnly())
+	_, err := p.UserDB()
+	require.Error(err)
+
+	s := p.Spool(nil, nil)
+	require.NoError(s.StoreMessage([]byte("bob"), []byte("hello")))
+	require.NoError(s.StoreMessage([]byte("carol"), []byte("hello")))
+	require.NoError(s.Vacuum(&onlyUser{[]byte("bob")}))
+
+	usages, err := s.AllUsage()
+	require.NoError(err)
+	require.Equal(map[string]*spool.Usage{"bob": {Messages: 1, Bytes: 5}}, usages)
+}
+
+// onlyUser is a userdb.UserDB with a single user.
+type onlyUser struct {
+	u []byte
+}
+
+func (o *onlyUser) Exists(u []byte) bool                              { return string(u) == string(o.u) }
+func (o *onlyUser) IsValid(u []byte, k wire.PublicKey) bool           { return o.Exists(u) }
+func (o *onlyUser) Add(u []byte, k wire.PublicKey, update bool) error { return nil }
+func (o *onlyUser) SetIdentity(u []byte, k wire.PublicKey) error      { return nil }
+func (o *onlyUser) Link(u []byte) (wire.PublicKey, error)             { return nil, nil }
+func (o *onlyUser) Identity(u []byte) (wire.PublicKey, error)         { return nil, nil }
+func (o *onlyUser) Remove(u []byte) error                             { return nil }
+func (o *onlyUser) Close()                                            {}
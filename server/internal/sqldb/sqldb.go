@@ -29,7 +29,7 @@ import (
 type dbImpl interface {
 	IsSpoolOnly() bool
 	UserDB() (userdb.UserDB, error)
-	Spool() spool.Spool
+	Spool(q *spool.Quota, onDrop func(n int)) spool.Spool
 	Close()
 }
 
@@ -52,9 +52,12 @@ func (d *SQLDB) UserDB() (userdb.UserDB, error) {
 	return d.impl.UserDB()
 }
 
-// Spool returns a spool.Spool instance backed by the SQL database.
-func (d *SQLDB) Spool() spool.Spool {
-	return d.impl.Spool()
+// Spool returns a spool.Spool instance backed by the SQL database,
+// enforcing the optional quota q.  If non-nil, onDrop is called with the
+// number of messages discarded from a user's spool to make room for a new
+// message.
+func (d *SQLDB) Spool(q *spool.Quota, onDrop func(n int)) spool.Spool {
+	return d.impl.Spool(q, onDrop)
 }
 
 // Close closes the SQL database connection(s).
@@ -69,12 +72,13 @@ func New(glue glue.Glue) (*SQLDB, error) {
 		log:  glue.LogBackend().GetLogger("sqldb"),
 	}
 
-	sCfg := glue.Config().Provider.SQLDB
+	cfg := glue.Config()
+	sCfg := cfg.Provider.SQLDB
 
 	switch sCfg.Backend {
 	case implPgx:
 		var err error
-		db.impl, err = newPgxImpl(db, sCfg.DataSourceName)
+		db.impl, err = newPgxImpl(db, sCfg, cfg.Debug.NumProviderWorkers, cfg.Logging.Level)
 		if err != nil {
 			return nil, err
 		}
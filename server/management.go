@@ -0,0 +1,159 @@
+// management.go - Katzenpost server HTTP/JSON management handlers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
+)
+
+type queueStatus struct {
+	Inbound   int `json:"inbound"`
+	Scheduler int `json:"scheduler"`
+	Provider  int `json:"provider"`
+}
+
+type statusResponse struct {
+	Identifier       string      `json:"identifier"`
+	IsProvider       bool        `json:"is_provider"`
+	Epoch            uint64      `json:"epoch"`
+	EpochElapsedMs   int64       `json:"epoch_elapsed_ms"`
+	EpochTillMs      int64       `json:"epoch_till_ms"`
+	ConnectedClients int         `json:"connected_clients"`
+	Queues           queueStatus `json:"queues"`
+}
+
+type pkiStatusResponse struct {
+	Epoch       uint64 `json:"epoch"`
+	HasDocument bool   `json:"has_document"`
+	Error       string `json:"error,omitempty"`
+	Mixes       int    `json:"mixes"`
+	Providers   int    `json:"providers"`
+}
+
+func (s *Server) registerHTTPHandlers() {
+	s.httpManagement.RegisterHandler(http.MethodPost, "/v1/shutdown", s.onHTTPShutdown)
+	s.httpManagement.RegisterHandler(http.MethodPost, "/v1/reload", s.onHTTPReload)
+	s.httpManagement.RegisterHandler(http.MethodGet, "/v1/status", s.onHTTPStatus)
+	s.httpManagement.RegisterHandler(http.MethodGet, "/v1/clients", s.onHTTPClients)
+	s.httpManagement.RegisterHandler(http.MethodGet, "/v1/pki", s.onHTTPPKI)
+}
+
+func (s *Server) onHTTPShutdown(r *http.Request) (interface{}, error) {
+	s.fatalErrCh <- fmt.Errorf("user requested shutdown via HTTP mgmt interface")
+	return nil, nil
+}
+
+func (s *Server) onHTTPReload(r *http.Request) (interface{}, error) {
+	if err := s.ReloadConfigFile(); err != nil {
+		return nil, &httpmgmt.StatusError{
+			Status: http.StatusConflict,
+			Err:    err,
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) connectedClients() (map[string]interface{}, error) {
+	clients := make(map[string]interface{})
+	for _, l := range s.listeners {
+		if l == nil {
+			continue
+		}
+		ids, err := l.GetConnIdentities()
+		if err != nil {
+			return nil, err
+		}
+		for id := range ids {
+			clients[hex.EncodeToString(id[:])] = struct{}{}
+		}
+	}
+	return clients, nil
+}
+
+func (s *Server) onHTTPStatus(r *http.Request) (interface{}, error) {
+	clients, err := s.connectedClients()
+	if err != nil {
+		return nil, err
+	}
+
+	epoch, elapsed, till := s.clock.Now()
+	resp := &statusResponse{
+		Identifier:       s.cfg.Server.Identifier,
+		IsProvider:       s.cfg.Server.IsProvider,
+		Epoch:            epoch,
+		EpochElapsedMs:   elapsed.Milliseconds(),
+		EpochTillMs:      till.Milliseconds(),
+		ConnectedClients: len(clients),
+		Queues: queueStatus{
+			Inbound:   s.inboundPackets.Len(),
+			Scheduler: s.scheduler.QueueLen(),
+		},
+	}
+	if s.provider != nil {
+		resp.Queues.Provider = s.provider.QueueLen()
+	}
+	return resp, nil
+}
+
+func (s *Server) onHTTPClients(r *http.Request) (interface{}, error) {
+	clients, err := s.connectedClients()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *Server) onHTTPPKI(r *http.Request) (interface{}, error) {
+	epoch, _, _ := s.clock.Now()
+	resp := &pkiStatusResponse{
+		Epoch: epoch,
+	}
+	doc, err := s.pki.CurrentDocument()
+	if err != nil {
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	resp.HasDocument = true
+	for _, l := range doc.Topology {
+		resp.Mixes += len(l)
+	}
+	resp.Providers = len(doc.Providers)
+	return resp, nil
+}
+
+func (s *Server) initHTTPManagement() error {
+	var err error
+	s.httpManagement, err = httpmgmt.New(&httpmgmt.Config{
+		Addr:        s.cfg.Management.HTTPAddress,
+		AuthToken:   s.cfg.Management.HTTPAuthToken,
+		TLSCertFile: s.cfg.Management.HTTPTLSCertFile,
+		TLSKeyFile:  s.cfg.Management.HTTPTLSKeyFile,
+		Log:         s.logBackend.GetLogger("mgmt_http"),
+	})
+	if err != nil {
+		return err
+	}
+	s.registerHTTPHandlers()
+	return nil
+}
@@ -24,7 +24,6 @@ import (
 
 	"github.com/cloudflare/circl/kem"
 	"github.com/katzenpost/katzenpost/core/crypto/nike"
-	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/server/internal/constants"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
@@ -51,7 +50,7 @@ func (m *mixKeys) init() error {
 	// TODO: In theory this should also try to load the previous epoch's key
 	// if the current time is in the clock skew grace period.  But it may not
 	// matter much in practice.
-	epoch, _, _ := epochtime.Now()
+	epoch, _, _ := m.glue.Clock().Now()
 	if _, err := m.Generate(epoch); err != nil {
 		return err
 	}
@@ -108,7 +107,7 @@ func (m *mixKeys) Generate(baseEpoch uint64) (bool, error) {
 }
 
 func (m *mixKeys) Prune() bool {
-	epoch, _, _ := epochtime.Now()
+	epoch, _, _ := m.glue.Clock().Now()
 	didPrune := false
 
 	m.Lock()
@@ -0,0 +1,191 @@
+// reload.go - Katzenpost server configuration reloading.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/katzenpost/katzenpost/server/config"
+)
+
+// reloadableDebug are the Debug parameters that take effect without a
+// restart.  Everything else, such as the number of workers, is fixed when
+// the server is started.
+var reloadableDebug = []string{
+	"SchedulerQueueSize",
+	"SchedulerMaxBurst",
+	"UnwrapDelay",
+	"ProviderDelay",
+	"KaetzchenDelay",
+	"SchedulerSlack",
+	"SendSlack",
+	"DecoySlack",
+	"ConnectTimeout",
+	"HandshakeTimeout",
+	"ReauthInterval",
+	"SendDecoyTraffic",
+	"DisableRateLimit",
+}
+
+// ErrNoConfigFile is the error returned by ReloadConfigFile when the
+// server's configuration was not loaded from a file.
+var ErrNoConfigFile = errors.New("server: configuration was not loaded from a file")
+
+// changedFields returns the names of the exported fields that differ
+// between the structs (or pointers to structs) a and b, prefixed with
+// section, ignoring the fields named in reloadable.
+func changedFields(section string, a, b interface{}, reloadable ...string) []string {
+	va, vb := reflect.Indirect(reflect.ValueOf(a)), reflect.Indirect(reflect.ValueOf(b))
+	if !va.IsValid() || !vb.IsValid() {
+		if va.IsValid() != vb.IsValid() {
+			return []string{section}
+		}
+		return nil
+	}
+
+	var changed []string
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		isReloadable := false
+		for _, name := range reloadable {
+			isReloadable = isReloadable || name == f.Name
+		}
+		if !isReloadable && !equalValues(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, section+"."+f.Name)
+		}
+	}
+	return changed
+}
+
+// equalValues returns true iff a and b are equal, or serialize to the same
+// TOML, as keys that were deserialized separately may differ in their
+// internal state.
+func equalValues(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	var bufA, bufB bytes.Buffer
+	if err := toml.NewEncoder(&bufA).Encode(map[string]interface{}{"v": a}); err != nil {
+		return false
+	}
+	if err := toml.NewEncoder(&bufB).Encode(map[string]interface{}{"v": b}); err != nil {
+		return false
+	}
+	return bytes.Equal(bufA.Bytes(), bufB.Bytes())
+}
+
+// checkReload returns an error naming every parameter that differs
+// between oldCfg and newCfg, and can not be changed without a restart.
+func checkReload(oldCfg, newCfg *config.Config) error {
+	var changed []string
+	changed = append(changed, changedFields("Server", oldCfg.Server, newCfg.Server)...)
+	changed = append(changed, changedFields("Logging", oldCfg.Logging, newCfg.Logging, "Level")...)
+	changed = append(changed, changedFields("Provider", oldCfg.Provider, newCfg.Provider, "CBORPluginKaetzchen")...)
+	changed = append(changed, changedFields("PKI", oldCfg.PKI, newCfg.PKI)...)
+	changed = append(changed, changedFields("Management", oldCfg.Management, newCfg.Management)...)
+	changed = append(changed, changedFields("DirectoryCache", oldCfg.DirectoryCache, newCfg.DirectoryCache)...)
+	changed = append(changed, changedFields("SphinxGeometry", oldCfg.SphinxGeometry, newCfg.SphinxGeometry)...)
+	changed = append(changed, changedFields("Debug", oldCfg.Debug, newCfg.Debug, append(reloadableDebug, "GenerateOnly")...)...)
+	if len(changed) != 0 {
+		return fmt.Errorf("server: parameters can not be changed without a restart: %v", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// Reload applies the reloadable parameters of the provided configuration
+// to the running server: the logging level, the CBOR plugin Kaetzchen and
+// the Debug parameters listed in reloadableDebug.  If any other parameter
+// differs from the running configuration, nothing is changed and an error
+// is returned.  If the set of running plugins changed, the descriptor is
+// republished.
+//
+// The configuration MUST have been validated with FixupAndValidate, as
+// done by config.Load.
+func (s *Server) Reload(newCfg *config.Config) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	oldCfg := s.liveCfg.Load()
+	if err := checkReload(oldCfg, newCfg); err != nil {
+		s.log.Errorf("Refusing to reload configuration: %v", err)
+		return err
+	}
+
+	// Everything that differs is reloadable, so build the new configuration
+	// from the running one, so that the parameters that were fixed up when
+	// the server was started are preserved.
+	cfg := *oldCfg
+	cfg.Logging = newCfg.Logging
+	debugCfg := *newCfg.Debug
+	debugCfg.GenerateOnly = oldCfg.Debug.GenerateOnly
+	cfg.Debug = &debugCfg
+
+	if cfg.Logging.Level != oldCfg.Logging.Level {
+		if err := s.logBackend.SetDefaultLevel(cfg.Logging.Level); err != nil {
+			return err
+		}
+		s.log.Noticef("Logging level changed to %v.", cfg.Logging.Level)
+	}
+	if s.provider != nil {
+		providerCfg := *oldCfg.Provider
+		providerCfg.CBORPluginKaetzchen = newCfg.Provider.CBORPluginKaetzchen
+		cfg.Provider = &providerCfg
+	}
+	s.liveCfg.Store(&cfg)
+
+	// Plugins that fail to start are retried by the next reload, as the
+	// plugin worker compares against the running plugins.
+	if s.provider != nil {
+		changed, err := s.provider.ReconfigurePlugins(cfg.Provider.CBORPluginKaetzchen)
+		if changed {
+			s.log.Noticef("Kaetzchen plugins changed, republishing descriptor.")
+			s.pki.RepublishDescriptor()
+		}
+		if err != nil {
+			s.log.Errorf("Failed to reconfigure Kaetzchen plugins: %v", err)
+			return err
+		}
+	}
+
+	s.log.Noticef("Configuration reloaded.")
+	return nil
+}
+
+// ReloadConfigFile reloads the configuration from the file the running
+// configuration was loaded from.  See Reload.
+func (s *Server) ReloadConfigFile() error {
+	f := s.liveCfg.Load().File()
+	if f == "" {
+		return ErrNoConfigFile
+	}
+	s.log.Noticef("Reloading configuration from '%v'.", f)
+	newCfg, err := config.LoadFile(f)
+	if err != nil {
+		s.log.Errorf("Failed to load configuration file '%v': %v", f, err)
+		return err
+	}
+	return s.Reload(newCfg)
+}
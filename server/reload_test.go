@@ -0,0 +1,101 @@
+// reload_test.go - Katzenpost server configuration reloading tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/server/config"
+)
+
+// copyTestConfig returns a copy of cfg, deep enough to change any of the
+// Server, Logging and Debug parameters.
+func copyTestConfig(cfg *config.Config) *config.Config {
+	newCfg := *cfg
+	serverCfg := *cfg.Server
+	newCfg.Server = &serverCfg
+	loggingCfg := *cfg.Logging
+	newCfg.Logging = &loggingCfg
+	debugCfg := *cfg.Debug
+	newCfg.Debug = &debugCfg
+	return &newCfg
+}
+
+func TestCheckReload(t *testing.T) {
+	require := require.New(t)
+
+	cfg := newTestConfig(t)
+	require.NoError(checkReload(cfg, copyTestConfig(cfg)))
+
+	// Reloadable parameters.
+	newCfg := copyTestConfig(cfg)
+	newCfg.Logging.Level = "ERROR"
+	newCfg.Debug.SchedulerMaxBurst++
+	newCfg.Debug.KaetzchenDelay++
+	newCfg.Debug.DisableRateLimit = !newCfg.Debug.DisableRateLimit
+	newCfg.Debug.GenerateOnly = !newCfg.Debug.GenerateOnly
+	require.NoError(checkReload(cfg, newCfg))
+
+	// Everything else.
+	newCfg = copyTestConfig(cfg)
+	newCfg.Server.DataDir = "/nonexistent"
+	newCfg.Logging.File = "katzenpost.log"
+	newCfg.Debug.NumSphinxWorkers++
+	newCfg.SphinxGeometry = geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 1000, true, 5)
+	newCfg.Provider = &config.Provider{}
+	err := checkReload(cfg, newCfg)
+	require.Error(err)
+	for _, param := range []string{"Server.DataDir", "Logging.File", "Debug.NumSphinxWorkers", "SphinxGeometry.", "Provider"} {
+		require.Contains(err.Error(), param)
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	require := require.New(t)
+
+	cfg := newTestConfig(t)
+	s, err := New(cfg)
+	require.NoError(err)
+	defer s.Shutdown()
+	goo := &serverGlue{s}
+
+	require.ErrorIs(s.ReloadConfigFile(), ErrNoConfigFile)
+
+	newCfg := copyTestConfig(cfg)
+	newCfg.Logging.Level = "ERROR"
+	newCfg.Debug.SchedulerMaxBurst = 32
+	require.NoError(s.Reload(newCfg))
+	require.Equal(32, goo.Config().Debug.SchedulerMaxBurst)
+	require.Equal("ERROR", goo.Config().Logging.Level)
+	require.False(s.logBackend.IsEnabledFor(logging.DEBUG, "server"))
+	require.True(s.logBackend.IsEnabledFor(logging.ERROR, "server"))
+
+	// Unsafe changes are rejected as a whole.
+	newCfg = copyTestConfig(newCfg)
+	newCfg.Debug.SchedulerMaxBurst = 64
+	newCfg.Server.Identifier = "renamed"
+	err = s.Reload(newCfg)
+	require.Error(err)
+	require.Contains(err.Error(), "Server.Identifier")
+	require.Equal(32, goo.Config().Debug.SchedulerMaxBurst)
+	require.Equal("testserver", goo.Config().Server.Identifier)
+}
@@ -23,15 +23,18 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"gitlab.com/yawning/aez.git"
 	"gopkg.in/eapache/channels.v1"
 	"gopkg.in/op/go-logging.v1"
 
+	"github.com/katzenpost/katzenpost/authority/cache"
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/utils"
@@ -40,6 +43,7 @@ import (
 	"github.com/katzenpost/katzenpost/server/internal/cryptoworker"
 	"github.com/katzenpost/katzenpost/server/internal/decoy"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
+	"github.com/katzenpost/katzenpost/server/internal/httpmgmt"
 	"github.com/katzenpost/katzenpost/server/internal/incoming"
 	"github.com/katzenpost/katzenpost/server/internal/instrument"
 	"github.com/katzenpost/katzenpost/server/internal/outgoing"
@@ -52,29 +56,49 @@ import (
 // terminates due to the `GenerateOnly` debug config option.
 var ErrGenerateOnly = errors.New("server: GenerateOnly set")
 
+// ServerOption is an option that may be passed to New.
+type ServerOption func(*Server)
+
+// WithClock sets the clock of the server, which defaults to the system
+// time, so that epoch transitions may be simulated in tests.
+func WithClock(clock epochtime.Clock) ServerOption {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
 // Server is a Katzenpost server instance.
 type Server struct {
 	cfg *config.Config
 
+	// liveCfg is the running configuration, with any parameters changed by
+	// Reload applied, and reloadLock serializes reloads.
+	liveCfg    atomic.Pointer[config.Config]
+	reloadLock sync.Mutex
+
 	identityPrivateKey sign.PrivateKey
 	identityPublicKey  sign.PublicKey
 	linkKey            wire.PrivateKey
 
+	clock epochtime.Clock
+
 	logBackend *log.Backend
 	log        *logging.Logger
 
 	inboundPackets *channels.InfiniteChannel
 
-	scheduler     glue.Scheduler
-	cryptoWorkers []*cryptoworker.Worker
-	periodic      *periodicTimer
-	mixKeys       glue.MixKeys
-	pki           glue.PKI
-	listeners     []glue.Listener
-	connector     glue.Connector
-	provider      glue.Provider
-	decoy         glue.Decoy
-	management    *thwack.Server
+	scheduler      glue.Scheduler
+	cryptoWorkers  []*cryptoworker.Worker
+	periodic       *periodicTimer
+	mixKeys        glue.MixKeys
+	pki            glue.PKI
+	listeners      []glue.Listener
+	directoryCache *cache.Listener
+	connector      glue.Connector
+	provider       glue.Provider
+	decoy          glue.Decoy
+	management     *thwack.Server
+	httpManagement *httpmgmt.Server
 
 	fatalErrCh chan error
 	haltedCh   chan interface{}
@@ -146,6 +170,10 @@ func (s *Server) halt() {
 		s.management.Halt()
 		s.management = nil
 	}
+	if s.httpManagement != nil {
+		s.httpManagement.Halt()
+		s.httpManagement = nil
+	}
 
 	// Stop the decoy source/sink.
 	if s.decoy != nil {
@@ -160,6 +188,10 @@ func (s *Server) halt() {
 			s.listeners[i] = nil
 		}
 	}
+	if s.directoryCache != nil {
+		s.directoryCache.Halt()
+		s.directoryCache = nil
+	}
 
 	// Close all outgoing connections.
 	if s.connector != nil {
@@ -218,12 +250,17 @@ func (s *Server) halt() {
 
 // New returns a new Server instance parameterized with the specified
 // configuration.
-func New(cfg *config.Config) (*Server, error) {
+func New(cfg *config.Config, opts ...ServerOption) (*Server, error) {
 	s := &Server{
 		cfg:        cfg,
+		clock:      epochtime.WallClock,
 		fatalErrCh: make(chan error),
 		haltedCh:   make(chan interface{}),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.liveCfg.Store(cfg)
 	goo := &serverGlue{s}
 
 	// Do the early initialization and bring up logging.
@@ -371,6 +408,20 @@ func New(cfg *config.Config) (*Server, error) {
 			s.fatalErrCh <- fmt.Errorf("user requested shutdown via mgmt interface")
 			return nil
 		})
+
+		const reloadCmd = "RELOAD"
+		s.management.RegisterCommand(reloadCmd, func(c *thwack.Conn, l string) error {
+			if err := s.ReloadConfigFile(); err != nil {
+				return c.Writer().PrintfLine("%v %v", thwack.StatusTransactionFailed, err)
+			}
+			return c.WriteReply(thwack.StatusOk)
+		})
+	}
+	if s.cfg.Management.HTTPAddress != "" {
+		if err = s.initHTTPManagement(); err != nil {
+			s.log.Errorf("Failed to initialize HTTP management interface: %v", err)
+			return nil, err
+		}
 	}
 
 	// Initialize the PKI interface.
@@ -420,6 +471,15 @@ func New(cfg *config.Config) (*Server, error) {
 		s.listeners = append(s.listeners, l)
 	}
 
+	// Serve the documents fetched by the PKI worker as a directory cache,
+	// if enabled.
+	if s.cfg.DirectoryCache != nil {
+		if s.directoryCache, err = cache.NewListener(s.pki, s.identityPublicKey, s.linkKey, s.logBackend, s.cfg.DirectoryCache.Addresses); err != nil {
+			s.log.Errorf("Failed to start directory cache: %v", err)
+			return nil, err
+		}
+	}
+
 	s.pki.StartWorker()
 
 	// Start the periodic 1 Hz utility timer.
@@ -431,6 +491,12 @@ func New(cfg *config.Config) (*Server, error) {
 	if s.management != nil {
 		s.management.Start()
 	}
+	if s.httpManagement != nil {
+		if err = s.httpManagement.Start(); err != nil {
+			s.log.Errorf("Failed to start HTTP management interface: %v", err)
+			return nil, err
+		}
+	}
 
 	isOk = true
 	return s, nil
@@ -441,7 +507,7 @@ type serverGlue struct {
 }
 
 func (g *serverGlue) Config() *config.Config {
-	return g.s.cfg
+	return g.s.liveCfg.Load()
 }
 
 func (g *serverGlue) LogBackend() *log.Backend {
@@ -460,10 +526,18 @@ func (g *serverGlue) LinkKey() wire.PrivateKey {
 	return g.s.linkKey
 }
 
+func (g *serverGlue) Clock() epochtime.Clock {
+	return g.s.clock
+}
+
 func (g *serverGlue) Management() *thwack.Server {
 	return g.s.management
 }
 
+func (g *serverGlue) HTTPManagement() *httpmgmt.Server {
+	return g.s.httpManagement
+}
+
 func (g *serverGlue) MixKeys() glue.MixKeys {
 	return g.s.mixKeys
 }
@@ -34,11 +34,9 @@ import (
 	"github.com/katzenpost/katzenpost/server/config"
 )
 
-func TestServerStartShutdown(t *testing.T) {
-	assert := assert.New(t)
-
+func newTestConfig(t *testing.T) *config.Config {
 	datadir, err := os.MkdirTemp("", "server_data_dir")
-	assert.NoError(err)
+	require.NoError(t, err)
 
 	authLinkPubKeyPem := "auth_link_pub_key.pem"
 
@@ -117,9 +115,14 @@ func TestServerStartShutdown(t *testing.T) {
 	}
 
 	err = cfg.FixupAndValidate()
-	assert.NoError(err)
+	require.NoError(t, err)
+	return &cfg
+}
+
+func TestServerStartShutdown(t *testing.T) {
+	assert := assert.New(t)
 
-	s, err := New(&cfg)
+	s, err := New(newTestConfig(t))
 	assert.NoError(err)
 	s.Shutdown()
 }
@@ -19,8 +19,10 @@
 package boltspool
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"time"
 
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/server/spool"
@@ -30,12 +32,36 @@ import (
 
 const (
 	usersBucket = "users"
+	headsBucket = "heads"
 	msgKey      = "message"
 	surbIDKey   = "surbID"
+	storedKey   = "stored"
 )
 
+// BoltSpoolOption is an option that may be passed to New.
+type BoltSpoolOption func(*boltSpool)
+
+// WithQuota enforces the quota q on every user's spool.
+func WithQuota(q *spool.Quota) BoltSpoolOption {
+	return func(s *boltSpool) {
+		s.quota = q
+	}
+}
+
+// WithDropHook sets a function that is called with the number of messages
+// discarded from a user's spool to make room for a new message.
+func WithDropHook(fn func(n int)) BoltSpoolOption {
+	return func(s *boltSpool) {
+		s.onDrop = fn
+	}
+}
+
 type boltSpool struct {
 	db *bolt.DB
+
+	quota  *spool.Quota
+	onDrop func(n int)
+	now    func() time.Time
 }
 
 func (s *boltSpool) Close() {
@@ -60,7 +86,8 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 		return fmt.Errorf("spool: invalid username: `%v`", u)
 	}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+	dropped := 0
+	if err := s.db.Update(func(tx *bolt.Tx) error {
 		// Grab the `users` bucket.
 		uBkt := tx.Bucket([]byte(usersBucket))
 
@@ -70,6 +97,11 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 			return err
 		}
 
+		// Make room for the message, if there is a quota.
+		if dropped, err = s.enforceQuota(sBkt, len(msg)); err != nil {
+			return err
+		}
+
 		// Allocate a unique identifier for this message.
 		seq, err := sBkt.NextSequence()
 		if err != nil {
@@ -84,14 +116,79 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 			return err
 		}
 
-		// Store the message and (optional) SURB ID.
+		// Store the message, (optional) SURB ID, and the time it was
+		// stored.
 		mBkt.Put([]byte(msgKey), msg)
 		if id != nil {
 			mBkt.Put([]byte(surbIDKey), id[:])
 		}
+		var stored [8]byte
+		binary.BigEndian.PutUint64(stored[:], uint64(s.now().UnixNano()))
+		mBkt.Put([]byte(storedKey), stored[:])
 
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+
+	if dropped > 0 && s.onDrop != nil {
+		s.onDrop(dropped)
+	}
+	return nil
+}
+
+// enforceQuota ensures that a message of msgLen bytes can be added to
+// the user's spool sBkt, discarding the oldest messages if the quota
+// allows it, and returns the number of messages discarded.
+func (s *boltSpool) enforceQuota(sBkt *bolt.Bucket, msgLen int) (int, error) {
+	q := s.quota
+	if q == nil || (q.MaxMessages <= 0 && q.MaxBytes <= 0) {
+		return 0, nil
+	}
+	if q.MaxBytes > 0 && msgLen > q.MaxBytes {
+		return 0, spool.ErrQuotaExceeded
+	}
+
+	keys, sizes := spoolEntries(sBkt)
+	nrMessages, nrBytes := len(keys), 0
+	for _, sz := range sizes {
+		nrBytes += sz
+	}
+	isOver := func() bool {
+		if q.MaxMessages > 0 && nrMessages+1 > q.MaxMessages {
+			return true
+		}
+		return q.MaxBytes > 0 && nrBytes+msgLen > q.MaxBytes
+	}
+	if !isOver() {
+		return 0, nil
+	}
+	if !q.DropOldest {
+		return 0, spool.ErrQuotaExceeded
+	}
+
+	dropped := 0
+	for ; isOver(); dropped++ {
+		if err := sBkt.DeleteBucket(keys[dropped]); err != nil {
+			return 0, err
+		}
+		nrMessages--
+		nrBytes -= sizes[dropped]
+	}
+	return dropped, nil
+}
+
+// spoolEntries returns the keys and message sizes of every entry in the
+// user's spool sBkt, oldest first.
+func spoolEntries(sBkt *bolt.Bucket) (keys [][]byte, sizes []int) {
+	cur := sBkt.Cursor()
+	for mKey, _ := cur.First(); mKey != nil; mKey, _ = cur.Next() {
+		k := make([]byte, len(mKey))
+		copy(k, mKey)
+		keys = append(keys, k)
+		sizes = append(sizes, len(sBkt.Bucket(mKey).Get([]byte(msgKey))))
+	}
+	return
 }
 
 func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
@@ -120,43 +217,45 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 		return
 	}
 
+	// Grab the ID of the message returned last.
+	hBkt := tx.Bucket([]byte(headsBucket))
+	head := hBkt.Get(u)
+
+	if advance && head != nil {
+		// Delete the message returned last, unless the quota or expiry
+		// already did, in which case the message now at the head of the
+		// spool has not been seen by the user, and must be kept.
+		if sBkt.Bucket(head) != nil {
+			if err = sBkt.DeleteBucket(head); err != nil {
+				return
+			}
+		}
+	}
+
 	// Grab a cursor into the user's spool.
 	cur := sBkt.Cursor()
 	mKey, _ := cur.First()
 	if mKey == nil {
 		// If the user's spool bucket is empty, the spool is empty.
-		return
-	}
-
-	// Well, there has to be at least one message in the spool, and this
-	// is merely a hint, so just return 0 if the queue is empty or there
-	// is only one message, and 1 if there are any number of messages.
-	remaining = 1
-	next, _ := cur.Next()
-
-	if advance {
-		// Delete the 0th message.
-		if err = sBkt.DeleteBucket(mKey); err != nil {
-			return
-		}
-
-		if next == nil {
-			// Deleting the message drained the queue.
-			err = sBkt.SetSequence(0) // Don't keep a lifetime message count.
-			if err != nil {
+		if advance {
+			// Advancing drained the queue.
+			if err = sBkt.SetSequence(0); err != nil { // Don't keep a lifetime message count.
+				return
+			}
+			if err = hBkt.Delete(u); err != nil {
 				return
 			}
-			remaining = 0
 			err = tx.Commit()
-			return
 		}
-		mKey = next
-		next, _ = cur.Next()
+		return
 	}
 
-	if next == nil {
-		// "excluding the current message".
-		remaining = 0
+	// Well, there has to be at least one message in the spool, and this
+	// is merely a hint, so just return 0 if there is only one message,
+	// and 1 if there are any number of messages "excluding the current
+	// message".
+	if next, _ := cur.Next(); next != nil {
+		remaining = 1
 	}
 
 	// Retrieve the stored message and (optional) SURB ID.
@@ -170,10 +269,25 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 		surbID = append(surbID, id...)
 	}
 
-	// If we modified the database, commit the transaction.
+	// Remember the message returned, which the next advance deletes.
+	if bytes.Equal(head, mKey) {
+		if advance {
+			err = tx.Commit()
+		}
+		return
+	}
+	newHead := append([]byte{}, mKey...)
 	if advance {
+		if err = hBkt.Put(u, newHead); err != nil {
+			return
+		}
 		err = tx.Commit()
+		return
 	}
+	tx.Rollback()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(headsBucket)).Put(u, newHead)
+	})
 	return
 }
 
@@ -189,10 +303,115 @@ func (s *boltSpool) Remove(u []byte) error {
 			return nil
 		}
 
+		if err := tx.Bucket([]byte(headsBucket)).Delete(u); err != nil {
+			return err
+		}
 		return uBkt.DeleteBucket(u)
 	})
 }
 
+// spoolUsage returns the usage of the user's spool sBkt.
+func spoolUsage(sBkt *bolt.Bucket) *spool.Usage {
+	usage := new(spool.Usage)
+	_, sizes := spoolEntries(sBkt)
+	usage.Messages = len(sizes)
+	for _, sz := range sizes {
+		usage.Bytes += sz
+	}
+	return usage
+}
+
+func (s *boltSpool) Usage(u []byte) (*spool.Usage, error) {
+	usage := new(spool.Usage)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		sBkt := tx.Bucket([]byte(usersBucket)).Bucket(u)
+		if sBkt == nil {
+			return nil
+		}
+		usage = spoolUsage(sBkt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func (s *boltSpool) AllUsage() (map[string]*spool.Usage, error) {
+	usages := make(map[string]*spool.Usage)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		uBkt := tx.Bucket([]byte(usersBucket))
+		cur := uBkt.Cursor()
+		for u, _ := cur.First(); u != nil; u, _ = cur.Next() {
+			usages[string(u)] = spoolUsage(uBkt.Bucket(u))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+func (s *boltSpool) Expire() (int, error) {
+	if s.quota == nil || s.quota.MessageTTL <= 0 {
+		return 0, nil
+	}
+
+	now := s.now()
+	var nowBuf [8]byte
+	binary.BigEndian.PutUint64(nowBuf[:], uint64(now.UnixNano()))
+
+	expired := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		uBkt := tx.Bucket([]byte(usersBucket))
+
+		var users [][]byte
+		cur := uBkt.Cursor()
+		for u, _ := cur.First(); u != nil; u, _ = cur.Next() {
+			users = append(users, append([]byte{}, u...))
+		}
+
+		for _, u := range users {
+			sBkt := uBkt.Bucket(u)
+			keys, _ := spoolEntries(sBkt)
+			nrExpired := 0
+			for _, mKey := range keys {
+				mBkt := sBkt.Bucket(mKey)
+				b := mBkt.Get([]byte(storedKey))
+				if len(b) != 8 {
+					// Messages stored before expiry was supported have no
+					// timestamp, so start their clock now.
+					if err := mBkt.Put([]byte(storedKey), nowBuf[:]); err != nil {
+						return err
+					}
+					continue
+				}
+				stored := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+				if now.Sub(stored) < s.quota.MessageTTL {
+					continue
+				}
+				if err := sBkt.DeleteBucket(mKey); err != nil {
+					return err
+				}
+				nrExpired++
+			}
+			if nrExpired > 0 && nrExpired == len(keys) {
+				// Expiring the messages drained the queue.
+				if err := sBkt.SetSequence(0); err != nil {
+					return err
+				}
+			}
+			expired += nrExpired
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
 func (s *boltSpool) VacuumExpired(udb userdb.UserDB, ignoreIdentities map[[sConstants.RecipientIDLength]byte]interface{}) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		uBkt := tx.Bucket([]byte(usersBucket))
@@ -211,6 +430,10 @@ func (s *boltSpool) VacuumExpired(udb userdb.UserDB, ignoreIdentities map[[sCons
 			if err != nil {
 				return err
 			}
+			err = tx.Bucket([]byte(headsBucket)).Delete(identity)
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -231,13 +454,16 @@ func (s *boltSpool) Vacuum(udb userdb.UserDB) error {
 			if err := uBkt.DeleteBucket(u); err != nil {
 				return err
 			}
+			if err := tx.Bucket([]byte(headsBucket)).Delete(u); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 }
 
 // New creates (or loads) a user message spool with the given file name f.
-func New(f string) (spool.Spool, error) {
+func New(f string, opts ...BoltSpoolOption) (spool.Spool, error) {
 	const (
 		metadataBucket = "metadata"
 		versionKey     = "version"
@@ -245,7 +471,12 @@ func New(f string) (spool.Spool, error) {
 
 	var err error
 
-	s := new(boltSpool)
+	s := &boltSpool{
+		now: time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
 	s.db, err = bolt.Open(f, 0600, nil)
 	if err != nil {
 		return nil, err
@@ -260,6 +491,9 @@ func New(f string) (spool.Spool, error) {
 		if _, err = tx.CreateBucketIfNotExists([]byte(usersBucket)); err != nil {
 			return err
 		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(headsBucket)); err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -28,6 +29,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/server/spool"
 )
 
 const (
@@ -131,6 +133,140 @@ func doTestLoad(t *testing.T) {
 	assert.NoError(err, "Delete(u)")
 }
 
+func TestBoltSpoolQuota(t *testing.T) {
+	require := require.New(t)
+
+	u := []byte(testUser)
+	msg := func(b byte) []byte {
+		return []byte{b, b, b, b}
+	}
+
+	// Reject new messages once the spool is full.
+	s, err := New(filepath.Join(t.TempDir(), testSpool), WithQuota(&spool.Quota{
+		MaxMessages: 2,
+		MaxBytes:    10,
+	}))
+	require.NoError(err)
+	require.NoError(s.StoreMessage(u, msg(1)))
+	require.NoError(s.StoreMessage(u, msg(2)))
+	require.ErrorIs(s.StoreMessage(u, msg(3)), spool.ErrQuotaExceeded)
+	require.ErrorIs(s.StoreMessage([]byte("bob"), make([]byte, 11)), spool.ErrQuotaExceeded)
+
+	usage, err := s.Usage(u)
+	require.NoError(err)
+	require.Equal(&spool.Usage{Messages: 2, Bytes: 8}, usage)
+	s.Close()
+
+	// Drop the oldest messages to make room.
+	dropped := 0
+	s, err = New(filepath.Join(t.TempDir(), testSpool), WithQuota(&spool.Quota{
+		MaxBytes:   10,
+		DropOldest: true,
+	}), WithDropHook(func(n int) {
+		dropped += n
+	}))
+	require.NoError(err)
+	defer s.Close()
+	require.NoError(s.StoreMessage(u, msg(1)))
+	require.NoError(s.StoreMessage(u, msg(2)))
+	require.NoError(s.StoreMessage(u, msg(3)))
+	require.Equal(1, dropped)
+	require.NoError(s.StoreMessage(u, make([]byte, 10)))
+	require.Equal(3, dropped)
+
+	require.NoError(s.StoreMessage([]byte("bob"), msg(4)))
+	usages, err := s.AllUsage()
+	require.NoError(err)
+	require.Equal(map[string]*spool.Usage{
+		testUser: {Messages: 1, Bytes: 10},
+		"bob":    {Messages: 1, Bytes: 4},
+	}, usages)
+}
+
+func TestBoltSpoolAdvanceDropped(t *testing.T) {
+	require := require.New(t)
+
+	s, err := New(filepath.Join(t.TempDir(), testSpool), WithQuota(&spool.Quota{
+		MaxMessages: 2,
+		MessageTTL:  time.Hour,
+		DropOldest:  true,
+	}))
+	require.NoError(err)
+	defer s.Close()
+
+	now := time.Now()
+	s.(*boltSpool).now = func() time.Time { return now }
+
+	u := []byte(testUser)
+	get := func(advance bool) []byte {
+		msg, _, _, err := s.Get(u, advance)
+		require.NoError(err)
+		return msg
+	}
+
+	// The message returned last is dropped to make room, so advancing
+	// keeps the next message, which the user has not seen.
+	require.NoError(s.StoreMessage(u, []byte("one")))
+	require.NoError(s.StoreMessage(u, []byte("two")))
+	require.Equal([]byte("one"), get(false))
+	require.NoError(s.StoreMessage(u, []byte("three")))
+	require.Equal([]byte("two"), get(true))
+	require.Equal([]byte("three"), get(true))
+
+	// Likewise when it expires.
+	now = now.Add(30 * time.Minute)
+	require.NoError(s.StoreMessage(u, []byte("four")))
+	now = now.Add(45 * time.Minute)
+	n, err := s.Expire()
+	require.NoError(err)
+	require.Equal(1, n)
+	require.Equal([]byte("four"), get(true))
+	require.Nil(get(true))
+}
+
+func TestBoltSpoolExpire(t *testing.T) {
+	require := require.New(t)
+
+	s, err := New(filepath.Join(t.TempDir(), testSpool), WithQuota(&spool.Quota{
+		MessageTTL: time.Hour,
+	}))
+	require.NoError(err)
+	defer s.Close()
+
+	now := time.Now()
+	bs := s.(*boltSpool)
+	bs.now = func() time.Time { return now }
+
+	u := []byte(testUser)
+	require.NoError(s.StoreMessage(u, []byte("old")))
+	now = now.Add(30 * time.Minute)
+	require.NoError(s.StoreSURBReply(u, &testSurbID, []byte("new")))
+
+	n, err := s.Expire()
+	require.NoError(err)
+	require.Equal(0, n)
+
+	now = now.Add(45 * time.Minute)
+	n, err = s.Expire()
+	require.NoError(err)
+	require.Equal(1, n)
+
+	msg, id, remaining, err := s.Get(u, false)
+	require.NoError(err)
+	require.Equal([]byte("new"), msg)
+	require.Equal(testSurbID[:], id)
+	require.Equal(0, remaining)
+
+	now = now.Add(time.Hour)
+	n, err = s.Expire()
+	require.NoError(err)
+	require.Equal(1, n)
+
+	usage, err := s.Usage(u)
+	require.NoError(err)
+	require.Equal(0, usage.Messages)
+}
+
 func init() {
 	var err error
 	tmpDir, err = os.MkdirTemp("", "boltspool_tests")
@@ -19,10 +19,47 @@
 package spool
 
 import (
+	"errors"
+	"time"
+
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/server/userdb"
 )
 
+// ErrQuotaExceeded is the error returned when storing a message would
+// exceed the user's spool quota, and the quota policy is to reject new
+// messages.
+var ErrQuotaExceeded = errors.New("spool: user quota exceeded")
+
+// Quota is a per-user spool quota.  A zero value for any of the limits
+// disables that limit.
+type Quota struct {
+	// MaxMessages is the maximum number of messages in a user's spool.
+	MaxMessages int
+
+	// MaxBytes is the maximum total size of the messages in a user's
+	// spool.
+	MaxBytes int
+
+	// MessageTTL is the maximum amount of time a message is retained
+	// in a user's spool.
+	MessageTTL time.Duration
+
+	// DropOldest causes the oldest messages in a user's spool to be
+	// discarded to make room for a new message, instead of rejecting the
+	// new message with ErrQuotaExceeded.
+	DropOldest bool
+}
+
+// Usage is a user's spool usage.
+type Usage struct {
+	// Messages is the number of messages in the user's spool.
+	Messages int
+
+	// Bytes is the total size of the messages in the user's spool.
+	Bytes int
+}
+
 // Spool is the interface provided by all user messgage spool implementations.
 type Spool interface {
 	// StoreMessage stores a message in the user's spool.
@@ -31,8 +68,9 @@ type Spool interface {
 	// StoreSURBReply stores a SURBReply in the user's spool.
 	StoreSURBReply(u []byte, id *[constants.SURBIDLength]byte, msg []byte) error
 
-	// Get optionally deletes the first entry in a user's spool, and returns
-	// the (new) first entry.  Both messages and SURBReplies may be returned.
+	// Get optionally deletes the entry of a user's spool that it returned
+	// last, unless it already was dropped or expired, and returns the (new)
+	// first entry.  Both messages and SURBReplies may be returned.
 	Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error)
 
 	// Remove removes the spool identified by the username from the database.
@@ -47,6 +85,17 @@ type Spool interface {
 	// ignoreIdentities.
 	VacuumExpired(udb userdb.UserDB, ignoreIdentities map[[constants.RecipientIDLength]byte]interface{}) error
 
+	// Usage returns the spool usage of the user.
+	Usage(u []byte) (*Usage, error)
+
+	// AllUsage returns the spool usage of every user with a spool, keyed
+	// by username.
+	AllUsage() (map[string]*Usage, error)
+
+	// Expire removes messages that have outlived the spool's message TTL,
+	// and returns the number of messages removed.
+	Expire() (int, error)
+
 	// Close closes the Spool instance.
 	Close()
 }
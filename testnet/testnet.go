@@ -0,0 +1,640 @@
+// testnet.go - Katzenpost in-process test network.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package testnet runs a complete Katzenpost mix network, voting
+// authorities, mixes and providers, inside the calling process on loopback
+// addresses so that end to end behaviour can be exercised with plain
+// `go test`, without Docker.
+//
+// Every node of a network runs on the network's epochtime.FakeClock, which
+// only moves when the test advances it, directly or by waiting for the
+// network with WaitForConsensus and WaitForEpoch. Several networks may
+// run in the same process.
+package testnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/katzenpost/authority/voting/client"
+	vServer "github.com/katzenpost/katzenpost/authority/voting/server"
+	vConfig "github.com/katzenpost/katzenpost/authority/voting/server/config"
+	cConfig "github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/schemes"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/server"
+	sConfig "github.com/katzenpost/katzenpost/server/config"
+)
+
+const (
+	defaultAuthorities              = 3
+	defaultLayers                   = 3
+	defaultMixesPerLayer            = 1
+	defaultProviders                = 2
+	defaultEpochPeriod              = 2 * time.Minute
+	defaultUserForwardPayloadLength = 2000
+	defaultLogLevel                 = "DEBUG"
+	bindAddr                        = "127.0.0.1"
+
+	// The clock is advanced by a 64th of an epoch at a time, after which
+	// the nodes are given at least tickDelay, and up to maxTickDelay, to
+	// act on the timers which fired.
+	ticksPerEpoch = 64
+	tickDelay     = 10 * time.Millisecond
+	maxTickDelay  = 10 * time.Second
+)
+
+// ErrRunning is the error returned when starting a Network which is
+// already running.
+var ErrRunning = errors.New("testnet: the network is already running")
+
+// Config is the test network configuration. The zero value of every
+// field selects a default suitable for unit tests.
+type Config struct {
+	// DataDir is the directory holding the state and logs of every node,
+	// typically the result of testing.T.TempDir. It is mandatory.
+	DataDir string
+
+	// Authorities is the number of voting authorities.
+	Authorities int
+
+	// Layers is the number of mix layers.
+	Layers int
+
+	// MixesPerLayer is the number of mixes in each layer.
+	MixesPerLayer int
+
+	// Providers is the number of providers.
+	Providers int
+
+	// EpochPeriod is the duration of an epoch of the network's clock.
+	EpochPeriod time.Duration
+
+	// UserForwardPayloadLength is the Sphinx user forward payload length.
+	UserForwardPayloadLength int
+
+	// LogLevel is the log level of every node.
+	LogLevel string
+
+	// Parameters are the network parameters voted by the authorities.
+	Parameters *vConfig.Parameters
+
+	// Kaetzchen are internal Kaetzchen configured on every provider in
+	// addition to the echo service.
+	Kaetzchen []*sConfig.Kaetzchen
+
+	// CBORPluginKaetzchen are the CBOR plugins configured on every
+	// provider. The log_dir plugin argument is set to the provider's
+	// DataDir unless specified, and $DATA_DIR in string arguments is
+	// replaced with it.
+	CBORPluginKaetzchen []*sConfig.CBORPluginKaetzchen
+}
+
+func (cfg *Config) applyDefaults() {
+	if cfg.Authorities <= 0 {
+		cfg.Authorities = defaultAuthorities
+	}
+	if cfg.Layers <= 0 {
+		cfg.Layers = defaultLayers
+	}
+	if cfg.MixesPerLayer <= 0 {
+		cfg.MixesPerLayer = defaultMixesPerLayer
+	}
+	if cfg.Providers <= 0 {
+		cfg.Providers = defaultProviders
+	}
+	if cfg.EpochPeriod <= 0 {
+		cfg.EpochPeriod = defaultEpochPeriod
+	}
+	if cfg.UserForwardPayloadLength <= 0 {
+		cfg.UserForwardPayloadLength = defaultUserForwardPayloadLength
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = defaultLogLevel
+	}
+	if cfg.Parameters == nil {
+		// Short delays keep round trips well within an epoch.
+		cfg.Parameters = &vConfig.Parameters{
+			Mu:              0.01,
+			MuMaxDelay:      500,
+			LambdaP:         0.01,
+			LambdaPMaxDelay: 200,
+			LambdaL:         0.0005,
+			LambdaLMaxDelay: 1000,
+			LambdaD:         0.0005,
+			LambdaDMaxDelay: 1000,
+			LambdaM:         0.2,
+			LambdaMMaxDelay: 100,
+		}
+	}
+}
+
+// Network is an in-process Katzenpost mix network.
+type Network struct {
+	sync.Mutex
+
+	cfg   *Config
+	geo   *geo.Geometry
+	clock *epochtime.FakeClock
+
+	authorityConfigs []*vConfig.Config
+	nodeConfigs      []*sConfig.Config
+	peers            []*vConfig.Authority
+	caches           []*vConfig.Authority
+
+	authorities []*vServer.Server
+	nodes       []*server.Server
+
+	logBackend *log.Backend
+	pkiClient  pki.Client
+	started    bool
+}
+
+// New generates the keys and configuration of every node of a network.
+// The configurations may be adjusted with AuthorityConfigs and
+// NodeConfigs before calling Start.
+func New(cfg *Config) (*Network, error) {
+	if cfg.DataDir == "" {
+		return nil, errors.New("testnet: DataDir is mandatory")
+	}
+	cfg.applyDefaults()
+
+	n := &Network{
+		cfg: cfg,
+		geo: geo.GeometryFromUserForwardPayloadLength(
+			schemes.ByName("x25519"),
+			cfg.UserForwardPayloadLength,
+			true,
+			cfg.Layers+2,
+		),
+		clock: epochtime.NewFakeClock(time.Now(), cfg.EpochPeriod),
+	}
+	if err := n.genAuthorityConfigs(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < cfg.Providers; i++ {
+		if err := n.genNodeConfig(fmt.Sprintf("provider%d", i+1), true); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < cfg.Layers*cfg.MixesPerLayer; i++ {
+		if err := n.genNodeConfig(fmt.Sprintf("mix%d", i+1), false); err != nil {
+			return nil, err
+		}
+	}
+	n.genAuthorizedNodes()
+	return n, nil
+}
+
+// Clock returns the clock of the network, which the clients of the
+// network must use too, see client.WithClock.
+func (n *Network) Clock() *epochtime.FakeClock {
+	return n.clock
+}
+
+// Geometry returns the Sphinx geometry of the network.
+func (n *Network) Geometry() *geo.Geometry {
+	return n.geo
+}
+
+// AuthorityConfigs returns the voting authority configurations.
+func (n *Network) AuthorityConfigs() []*vConfig.Config {
+	return n.authorityConfigs
+}
+
+// NodeConfigs returns the provider and mix configurations.
+func (n *Network) NodeConfigs() []*sConfig.Config {
+	return n.nodeConfigs
+}
+
+// Providers returns the identifiers of the providers.
+func (n *Network) Providers() []string {
+	providers := []string{}
+	for _, cfg := range n.nodeConfigs {
+		if cfg.Server.IsProvider {
+			providers = append(providers, cfg.Server.Identifier)
+		}
+	}
+	return providers
+}
+
+// ClientConfig returns a new client configuration for the network.
+func (n *Network) ClientConfig() (*cConfig.Config, error) {
+	cfg := &cConfig.Config{
+		SphinxGeometry: n.geo,
+		Logging: &cConfig.Logging{
+			Level: n.cfg.LogLevel,
+		},
+		UpstreamProxy: &cConfig.UpstreamProxy{Type: "none"},
+		Debug: &cConfig.Debug{
+			DisableDecoyTraffic: true,
+			PollingInterval:     1,
+		},
+		VotingAuthority: &cConfig.VotingAuthority{
+			Peers:  n.peers,
+			Caches: n.caches,
+		},
+	}
+	return cfg, cfg.FixupAndValidate()
+}
+
+func (n *Network) genAuthorityConfigs() error {
+	for i := 0; i < n.cfg.Authorities; i++ {
+		id := fmt.Sprintf("auth%d", i+1)
+		dataDir := filepath.Join(n.cfg.DataDir, id)
+		idKey, err := genIdentityKey(dataDir)
+		if err != nil {
+			return err
+		}
+		linkKey, err := genLinkKey(dataDir)
+		if err != nil {
+			return err
+		}
+		addr, err := freeAddress()
+		if err != nil {
+			return err
+		}
+		cfg := &vConfig.Config{
+			SphinxGeometry: n.geo,
+			Server: &vConfig.Server{
+				Identifier: id,
+				Addresses:  []string{addr},
+				DataDir:    dataDir,
+			},
+			Logging: &vConfig.Logging{
+				File:  "katzenpost.log",
+				Level: n.cfg.LogLevel,
+			},
+			Parameters: n.cfg.Parameters,
+			Debug: &vConfig.Debug{
+				Layers:           n.cfg.Layers,
+				MinNodesPerLayer: 1,
+			},
+		}
+		n.authorityConfigs = append(n.authorityConfigs, cfg)
+		n.peers = append(n.peers, &vConfig.Authority{
+			Identifier:        id,
+			IdentityPublicKey: idKey,
+			LinkPublicKey:     linkKey,
+			Addresses:         cfg.Server.Addresses,
+		})
+	}
+	for _, cfg := range n.authorityConfigs {
+		cfg.Authorities = n.peers
+	}
+	return nil
+}
+
+func (n *Network) genNodeConfig(id string, isProvider bool) error {
+	dataDir := filepath.Join(n.cfg.DataDir, id)
+	idKey, err := genIdentityKey(dataDir)
+	if err != nil {
+		return err
+	}
+	addr, err := freeAddress()
+	if err != nil {
+		return err
+	}
+	cfg := &sConfig.Config{
+		SphinxGeometry: n.geo,
+		Server: &sConfig.Server{
+			Identifier: id,
+			Addresses:  []string{addr},
+			DataDir:    dataDir,
+			IsProvider: isProvider,
+		},
+		Logging: &sConfig.Logging{
+			File:  "katzenpost.log",
+			Level: n.cfg.LogLevel,
+		},
+		PKI: &sConfig.PKI{
+			Voting: &sConfig.Voting{Authorities: n.peers},
+		},
+		Debug: &sConfig.Debug{
+			DisableRateLimit: true,
+		},
+	}
+	if isProvider {
+		// Providers serve the consensus to clients as directory caches.
+		linkKey, err := genLinkKey(dataDir)
+		if err != nil {
+			return err
+		}
+		cacheAddr, err := freeAddress()
+		if err != nil {
+			return err
+		}
+		cfg.DirectoryCache = &sConfig.DirectoryCache{Addresses: []string{cacheAddr}}
+		n.caches = append(n.caches, &vConfig.Authority{
+			Identifier:        id,
+			IdentityPublicKey: idKey,
+			LinkPublicKey:     linkKey,
+			Addresses:         []string{cacheAddr},
+		})
+
+		cfg.Provider = &sConfig.Provider{
+			TrustOnFirstUse:        true,
+			EnableEphemeralClients: true,
+			Kaetzchen: []*sConfig.Kaetzchen{
+				&sConfig.Kaetzchen{
+					Capability: "echo",
+					Endpoint:   "+echo",
+				},
+			},
+		}
+		cfg.Provider.Kaetzchen = append(cfg.Provider.Kaetzchen, n.cfg.Kaetzchen...)
+		for _, plugin := range n.cfg.CBORPluginKaetzchen {
+			p := *plugin
+			p.Config = map[string]interface{}{"log_dir": dataDir}
+			for k, v := range plugin.Config {
+				if arg, ok := v.(string); ok {
+					v = strings.ReplaceAll(arg, "$DATA_DIR", dataDir)
+				}
+				p.Config[k] = v
+			}
+			cfg.Provider.CBORPluginKaetzchen = append(cfg.Provider.CBORPluginKaetzchen, &p)
+		}
+	}
+	n.nodeConfigs = append(n.nodeConfigs, cfg)
+	return nil
+}
+
+func (n *Network) genAuthorizedNodes() {
+	mixes := []*vConfig.Node{}
+	providers := []*vConfig.Node{}
+	for _, cfg := range n.nodeConfigs {
+		node := &vConfig.Node{
+			Identifier:           cfg.Server.Identifier,
+			IdentityPublicKeyPem: filepath.Join("..", cfg.Server.Identifier, "identity.public.pem"),
+		}
+		if cfg.Server.IsProvider {
+			providers = append(providers, node)
+		} else {
+			mixes = append(mixes, node)
+		}
+	}
+	topology := &vConfig.Topology{
+		Layers: make([]vConfig.Layer, n.cfg.Layers),
+	}
+	for i, mix := range mixes {
+		layer := i % n.cfg.Layers
+		topology.Layers[layer].Nodes = append(topology.Layers[layer].Nodes, *mix)
+	}
+	for _, cfg := range n.authorityConfigs {
+		cfg.Mixes = mixes
+		cfg.Providers = providers
+		cfg.Topology = topology
+	}
+}
+
+// Start starts every node of the network.
+// Use WaitForConsensus to wait for the network to become usable.
+func (n *Network) Start() error {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.started {
+		return ErrRunning
+	}
+
+	for _, cfg := range n.authorityConfigs {
+		if err := cfg.FixupAndValidate(); err != nil {
+			return err
+		}
+	}
+	for _, cfg := range n.nodeConfigs {
+		if err := cfg.FixupAndValidate(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	n.logBackend, err = log.New(filepath.Join(n.cfg.DataDir, "testnet.log"), n.cfg.LogLevel, false)
+	if err != nil {
+		return err
+	}
+	linkKey, _ := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	n.pkiClient, err = client.New(&client.Config{
+		LinkKey:     linkKey,
+		LogBackend:  n.logBackend,
+		Authorities: n.peers,
+	})
+	if err != nil {
+		return err
+	}
+
+	n.started = true
+	for _, cfg := range n.authorityConfigs {
+		s, err := vServer.New(cfg, vServer.WithClock(n.clock))
+		if err != nil {
+			n.shutdown()
+			return fmt.Errorf("testnet: failed to start %v: %v", cfg.Server.Identifier, err)
+		}
+		n.authorities = append(n.authorities, s)
+	}
+	for _, cfg := range n.nodeConfigs {
+		s, err := server.New(cfg, server.WithClock(n.clock))
+		if err != nil {
+			n.shutdown()
+			return fmt.Errorf("testnet: failed to start %v: %v", cfg.Server.Identifier, err)
+		}
+		n.nodes = append(n.nodes, s)
+	}
+	return nil
+}
+
+// Shutdown stops every node of the network.
+func (n *Network) Shutdown() {
+	n.Lock()
+	defer n.Unlock()
+
+	n.shutdown()
+}
+
+func (n *Network) shutdown() {
+	if !n.started {
+		return
+	}
+	for _, s := range n.nodes {
+		s.Shutdown()
+		s.Wait()
+	}
+	n.nodes = nil
+	for _, s := range n.authorities {
+		s.Shutdown()
+		s.Wait()
+	}
+	n.authorities = nil
+
+	n.started = false
+}
+
+// Advance advances the clock of the network by d, a step at a time so
+// that the nodes keep up with it.
+func (n *Network) Advance(ctx context.Context, d time.Duration) error {
+	step := n.clock.Period() / ticksPerEpoch
+	for ; d > step; d -= step {
+		if err := n.tick(ctx, step); err != nil {
+			return err
+		}
+	}
+	return n.tick(ctx, d)
+}
+
+// tick advances the clock by d, and waits for the nodes woken up by the
+// timers which fired to go back to sleep, so that the time of the network
+// does not run away from nodes busy signing.
+func (n *Network) tick(ctx context.Context, d time.Duration) error {
+	sleeping := n.clock.Timers()
+	n.clock.Advance(d)
+	deadline := time.Now().Add(maxTickDelay)
+	for {
+		if err := sleep(ctx, tickDelay); err != nil {
+			return err
+		}
+		if n.clock.Timers() >= sleeping || time.Now().After(deadline) {
+			return nil
+		}
+	}
+}
+
+// WaitForConsensus advances the clock until the authorities have published
+// a consensus for the current epoch that includes every node, and returns
+// it.
+func (n *Network) WaitForConsensus(ctx context.Context) (*pki.Document, error) {
+	for {
+		epoch, _, _ := n.clock.Now()
+		if doc := n.complete(ctx, epoch); doc != nil {
+			return doc, nil
+		}
+		if err := n.Advance(ctx, n.clock.Period()/ticksPerEpoch); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WaitForEpoch advances the clock until the given epoch has started and
+// the consensus for it includes every node, and returns it.
+func (n *Network) WaitForEpoch(ctx context.Context, epoch uint64) (*pki.Document, error) {
+	if now, _, till := n.clock.Now(); now < epoch {
+		if err := n.Advance(ctx, till+time.Duration(epoch-now-1)*n.clock.Period()); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		if doc := n.complete(ctx, epoch); doc != nil {
+			return doc, nil
+		}
+		if err := n.Advance(ctx, n.clock.Period()/ticksPerEpoch); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// NextEpoch advances the clock until the next epoch has started and its
+// consensus includes every node, and returns it.
+func (n *Network) NextEpoch(ctx context.Context) (*pki.Document, error) {
+	epoch, _, _ := n.clock.Now()
+	return n.WaitForEpoch(ctx, epoch+1)
+}
+
+func (n *Network) complete(ctx context.Context, epoch uint64) *pki.Document {
+	doc, _, err := n.pkiClient.Get(ctx, epoch)
+	if err != nil {
+		return nil
+	}
+	if len(doc.Providers) != n.cfg.Providers {
+		return nil
+	}
+	mixes := 0
+	for _, layer := range doc.Topology {
+		mixes += len(layer)
+	}
+	if mixes != n.cfg.Layers*n.cfg.MixesPerLayer {
+		return nil
+	}
+	return doc
+}
+
+// BuildPlugin builds the CBOR plugin main package pkg into dir and returns
+// the path to the resulting executable.
+func BuildPlugin(pkg, dir string) (string, error) {
+	bin := filepath.Join(dir, filepath.Base(pkg))
+	cmd := exec.Command("go", "build", "-o", bin, pkg)
+	cmd.Env = os.Environ()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("testnet: failed to build %v: %v\n%s", pkg, err, out)
+	}
+	return bin, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp4", bindAddr+":0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return fmt.Sprintf("%s://%s", pki.TransportTCPv4, l.Addr().String()), nil
+}
+
+func genIdentityKey(dataDir string) (sign.PublicKey, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	idKey, idPubKey := cert.Scheme.NewKeypair()
+	if err := pem.ToFile(filepath.Join(dataDir, "identity.private.pem"), idKey); err != nil {
+		return nil, err
+	}
+	if err := pem.ToFile(filepath.Join(dataDir, "identity.public.pem"), idPubKey); err != nil {
+		return nil, err
+	}
+	return idPubKey, nil
+}
+
+func genLinkKey(dataDir string) (wire.PublicKey, error) {
+	linkKey, linkPubKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	if err := pem.ToFile(filepath.Join(dataDir, "link.private.pem"), linkKey); err != nil {
+		return nil, err
+	}
+	if err := pem.ToFile(filepath.Join(dataDir, "link.public.pem"), linkPubKey); err != nil {
+		return nil, err
+	}
+	return linkPubKey, nil
+}
@@ -0,0 +1,109 @@
+// testnet_test.go - Katzenpost in-process test network tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package testnet
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	sConfig "github.com/katzenpost/katzenpost/server/config"
+)
+
+func roundTrip(t *testing.T, s *client.Session, capability string, payload []byte) {
+	require := require.New(t)
+
+	desc, err := s.GetService(capability)
+	require.NoError(err)
+	msgID, err := s.SendReliableMessage(desc.Name, desc.Provider, payload)
+	require.NoError(err)
+
+	timeout := time.After(time.Minute)
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("no reply from %v", capability)
+		case eventRaw := <-s.EventSink:
+			switch event := eventRaw.(type) {
+			case *client.MessageSentEvent:
+				if bytes.Equal(msgID[:], event.MessageID[:]) {
+					require.NoError(event.Err)
+				}
+			case *client.MessageReplyEvent:
+				if bytes.Equal(msgID[:], event.MessageID[:]) {
+					require.NoError(event.Err)
+					require.True(bytes.HasPrefix(event.Payload, payload))
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	pluginDir := t.TempDir()
+	echo, err := BuildPlugin("github.com/katzenpost/katzenpost/server_plugins/cbor_plugins/echo-go", pluginDir)
+	require.NoError(err)
+
+	period := epochtime.Period
+	n, err := New(&Config{
+		DataDir:  t.TempDir(),
+		LogLevel: "INFO",
+		CBORPluginKaetzchen: []*sConfig.CBORPluginKaetzchen{
+			&sConfig.CBORPluginKaetzchen{
+				Capability:     "cbor_echo",
+				Endpoint:       "+cbor_echo",
+				Command:        echo,
+				MaxConcurrency: 1,
+			},
+		},
+	})
+	require.NoError(err)
+	require.Len(n.Providers(), defaultProviders)
+
+	require.NoError(n.Start())
+	require.ErrorIs(n.Start(), ErrRunning)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	doc, err := n.WaitForConsensus(ctx)
+	require.NoError(err)
+	require.Len(doc.Providers, defaultProviders)
+
+	cfg, err := n.ClientConfig()
+	require.NoError(err)
+	c, err := client.New(cfg)
+	require.NoError(err)
+	s, err := c.NewTOFUSession(ctx, client.WithClock(n.Clock()))
+	require.NoError(err)
+	s.WaitForDocument(ctx)
+
+	roundTrip(t, s, "echo", []byte("hello"))
+	roundTrip(t, s, "cbor_echo", []byte("hello cbor"))
+
+	c.Shutdown()
+	c.Wait()
+	n.Shutdown()
+	require.Equal(period, epochtime.Period)
+}